@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+)
+
+const usage = `Usage: mkv-validate [FILE]
+
+Reads an MKV file (or stdin when FILE is omitted or "-") with the same parser
+as whip-go and prints track info, frame counts, timestamp monotonicity,
+keyframe intervals and parse warnings. Exits with status 1 if parsing failed.
+`
+
+// internalパッケージはwhep-go/whip-goのフラグをpflagに登録するため、引数は直接解釈する
+func main() {
+	args := os.Args[1:]
+	if len(args) > 1 || (len(args) == 1 && (args[0] == "-h" || args[0] == "--help")) {
+		fmt.Fprint(os.Stderr, usage)
+		if len(args) > 1 {
+			os.Exit(2)
+		}
+		return
+	}
+
+	var input io.Reader = os.Stdin
+	if len(args) == 1 && args[0] != "-" {
+		file, err := os.Open(args[0])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		defer file.Close()
+		input = file
+	}
+
+	report, err := internal.ValidateMKV(input)
+	report.Print(os.Stdout)
+	if err != nil {
+		os.Exit(1)
+	}
+}
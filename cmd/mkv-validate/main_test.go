@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	width  = 64
+	height = 48
+)
+
+// TestMain は環境変数MKV_VALIDATE_TEST_MAINが設定されている場合、テストの代わりにmkv-validateとして動く
+// 終了コードを検証するため、テストバイナリをmkv-validateとして起動し直す
+func TestMain(m *testing.M) {
+	if os.Getenv("MKV_VALIDATE_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// validateCommand はargsを引数とするmkv-validateとしてテストバイナリを起動するコマンドを作る
+func validateCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "MKV_VALIDATE_TEST_MAIN=1")
+	return cmd
+}
+
+// unknownSize はサイズ不定の要素（Segment/Cluster）に使うサイズ
+var unknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// idBytes はEBML要素IDのバイト列を作る（先頭のマーカーを含む値）
+func idBytes(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// element はEBML要素（ID、サイズ、データ）を作る
+func element(id uint32, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	out := idBytes(id)
+	out = append(out, 0x08, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(out[len(out)-8:], uint64(len(data)))
+	out[len(out)-8] = 0x01
+	return append(out, data...)
+}
+
+// uintData はEBMLの符号なし整数要素のデータを8バイトで作る
+func uintData(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// makeMKV はYUV420Pのrawvideoのみを持つMKVを作る（30fps、keyframeEvery枚ごとにキーフレーム）
+func makeMKV(frames, keyframeEvery int) []byte {
+	parts := [][]byte{
+		element(0x1A45DFA3, element(0x4282, []byte("matroska"))),
+		append(idBytes(0x18538067), unknownSize...),
+		element(0x1549A966, element(0x2AD7B1, uintData(1000000))),
+		element(0x1654AE6B, element(0xAE,
+			element(0xD7, uintData(1)),
+			element(0x86, []byte("V_UNCOMPRESSED")),
+			element(0xE0, element(0xB0, uintData(width)), element(0xBA, uintData(height)), element(0x2EB524, []byte("YUV420P"))),
+		)),
+		append(idBytes(0x1F43B675), unknownSize...),
+		element(0xE7, uintData(0)),
+	}
+	yuv := make([]byte, width*height*3/2)
+	for i := 0; i < frames; i++ {
+		flags := byte(0)
+		if i%keyframeEvery == 0 {
+			flags = 0x80
+		}
+		ms := i * 100 / 3
+		parts = append(parts, element(0xA3, []byte{0x81, byte(ms >> 8), byte(ms), flags}, yuv))
+	}
+	return bytes.Join(parts, nil)
+}
+
+// TestExitStatus はmkv-validateの終了コードをファイル入力と標準入力で検証する
+func TestExitStatus(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.mkv")
+	data := makeMKV(10, 5)
+	if err := os.WriteFile(valid, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := validateCommand(valid).Output()
+	if err != nil {
+		t.Fatalf("valid file: %v\n%s", err, out)
+	}
+	if !strings.Contains(string(out), "Video frames: 10 (2 keyframes)") {
+		t.Fatalf("unexpected report for the valid file:\n%s", out)
+	}
+
+	cmd := validateCommand("-")
+	cmd.Stdin = bytes.NewReader(data[:len(data)/2])
+	out, err = cmd.Output()
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("truncated stdin exited with %v, want status 1\n%s", err, out)
+	}
+
+	if err := validateCommand(filepath.Join(dir, "missing.mkv")).Run(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 1 {
+		t.Fatalf("missing file exited with %v, want status 1", err)
+	}
+}
@@ -1,22 +1,23 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+	"github.com/pion/webrtc/v4"
 	"github.com/spf13/pflag"
 )
 
 const (
-	maxReconnectAttempts = 10               // 最大再接続試行回数
-	reconnectInterval    = 5 * time.Second  // 再接続間隔（固定）
-	mediaTimeout         = 5 * time.Second  // メディア受信タイムアウト
-	connectionTimeout    = 10 * time.Second // ICE接続タイムアウト
+	maxReconnectAttempts = 10              // 最大再接続試行回数
+	reconnectInterval    = 5 * time.Second // 再接続間隔（固定）
+	probeDuration        = 2 * time.Second // --probe で計測する時間
 )
 
 func main() {
@@ -29,9 +30,31 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := run(); err != nil {
-		log.Fatal(err)
+	// 終了理由は終了コードとstderrのサマリー行で通知する
+	if internal.CheckMode {
+		internal.Exit(internal.RunPreflightCheck(internal.WhepURL))
 	}
+	if internal.DryRun {
+		internal.Exit(dryRun())
+	}
+	internal.Exit(run())
+}
+
+// dryRun は受信時と同じMediaEngineとPeerConnectionでofferを作成し、offerと設定を表示して終了する（--dry-run）
+// 出力もWHEPサーバーへのPOSTも行わない
+func dryRun() error {
+	mediaEngine, err := internal.CreateVP8VP9MediaEngine()
+	if err != nil {
+		return fmt.Errorf("failed to create media engine: %w", err)
+	}
+	// トラックは届かないため、受信したフレームの書き込み先は使われない
+	streamManager := internal.NewStreamManager(internal.NewProbeWriter(), internal.NewDefaultRTPProcessor(), 0, make(chan struct{}, 1))
+	peerConnection, err := internal.CreatePeerConnection(mediaEngine, make(chan internal.ConnectionEvent, 10), streamManager)
+	if err != nil {
+		return fmt.Errorf("failed to create peer connection: %w", err)
+	}
+	defer peerConnection.Close()
+	return internal.NewWHEPSession(internal.WhepURL).DryRun(os.Stdout, peerConnection)
 }
 
 func run() error {
@@ -42,12 +65,107 @@ func run() error {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
 	defer signal.Stop(sigChan)
+	// stdoutのパイプが閉じられた時にSIGPIPEで即終了せず、EPIPEとして検出して終了処理を行う
+	signal.Ignore(syscall.SIGPIPE)
+
+	// --output 指定時は出力先をファイルにし、SIGHUPでローテーションする（未指定時のSIGHUPは従来どおり終了）
+	output := &outputFile{file: os.Stdout}
+	var hupChan chan os.Signal
+	if internal.OutputPath != "" && !internal.ProbeMode {
+		var err error
+		output, err = openOutput(internal.OutputPath)
+		if err != nil {
+			return err
+		}
+		defer output.Close()
+		hupChan = make(chan os.Signal, 1)
+		signal.Notify(hupChan, syscall.SIGHUP)
+		defer signal.Stop(hupChan)
+		fmt.Fprintf(os.Stderr, "Writing output to %s (send SIGHUP to rotate)\n", output)
+	}
+
+	// --probe は計測のみのため再接続しない
+	maxAttempts := maxReconnectAttempts
+	if internal.ProbeMode {
+		maxAttempts = 1
+	}
+
+	// 出力は再接続をまたいで1つのファイルになるよう、接続ごとのセッションで共有する（--probe では出力しない）
+	var sink internal.OutputSink
+	splitOutput := internal.VideoOutPath != "" || internal.AudioOutPath != ""
+	if splitOutput && !internal.ProbeMode {
+		var closeSplit func()
+		var err error
+		if sink, closeSplit, err = openSplitOutput(); err != nil {
+			return err
+		}
+		defer closeSplit()
+	} else if !internal.ProbeMode {
+		var err error
+		if sink, err = internal.NewOutputSink(internal.OutputFormat, output.file); err != nil {
+			return err
+		}
+	}
+	// --wav-out は再接続をまたいで1つのWAVファイルに書き込み、終了時にヘッダーのサイズを確定する
+	var wav *internal.WAVWriter
+	if internal.WAVOutPath != "" && !internal.ProbeMode {
+		var closeWAV func()
+		var err error
+		if wav, closeWAV, err = openWAVOutput(); err != nil {
+			return err
+		}
+		defer closeWAV()
+	}
+	if internal.OutputFormat == internal.OutputFormatIVF && !internal.ProbeMode {
+		fmt.Fprintln(os.Stderr, "Output format: IVF (compressed video only, audio is discarded)")
+		if internal.AutoRotate {
+			fmt.Fprintln(os.Stderr, "--auto-rotate has no effect on IVF output (no rotation metadata)")
+		}
+		if internal.MKVCRC {
+			fmt.Fprintln(os.Stderr, "--mkv-crc has no effect on IVF output")
+		}
+		if internal.MKVTrackLayout != "" {
+			fmt.Fprintln(os.Stderr, "--mkv-track-layout has no effect on IVF output")
+		}
+		if internal.SyncStart {
+			fmt.Fprintln(os.Stderr, "--sync-start has no effect on IVF output (audio is discarded)")
+		}
+		if internal.NoDate || internal.SegmentUIDSeed != 0 {
+			fmt.Fprintln(os.Stderr, "--no-date and --segment-uid-seed have no effect on IVF output")
+		}
+		if internal.AudioTracks != internal.AudioTracksFirst {
+			fmt.Fprintln(os.Stderr, "--audio-tracks has no effect on IVF output (audio is discarded)")
+		}
+	}
+	if internal.MaxTemporalLayer >= 0 {
+		fmt.Fprintf(os.Stderr, "Temporal layers: dropping frames above TID %d (streams without temporal layers are unaffected)\n", internal.MaxTemporalLayer)
+	}
+	if internal.SpatialLayer >= 0 {
+		fmt.Fprintf(os.Stderr, "Spatial layers: decoding VP9 up to SID %d (streams without spatial layers are unaffected)\n", internal.SpatialLayer)
+	}
+	if internal.MeasureLatency {
+		fmt.Fprintln(os.Stderr, "Measuring end-to-end latency from abs-capture-time (assumes sender and receiver clocks are synchronized)")
+	}
+	if internal.SimulateLoss > 0 {
+		fmt.Fprintf(os.Stderr, "Simulating %g%% packet loss on received RTP (--loss-seed %d)\n", internal.SimulateLoss, internal.LossSeed)
+	}
+
+	// 接続状態とRTP受信時刻は再接続をまたいで共有し、/readyz はメディアタイムアウトと同じ閾値で判定する
+	health := internal.NewHealthState(time.Duration(internal.MediaTimeoutMs) * time.Millisecond)
+	if internal.HealthAddr != "" {
+		server, err := internal.StartHealthServer(internal.HealthAddr, health)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+		fmt.Fprintf(os.Stderr, "Health endpoints: http://%s/healthz, http://%s/readyz\n", server.Addr, server.Addr)
+	}
 
 	var lastErr error
-	for attempt := 1; attempt <= maxReconnectAttempts; attempt++ {
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
 		if attempt > 1 {
 			fmt.Fprintf(os.Stderr, "Reconnection attempt %d/%d in %v...\n",
-				attempt, maxReconnectAttempts, reconnectInterval)
+				attempt, maxAttempts, reconnectInterval)
 
 			select {
 			case <-sigChan:
@@ -57,20 +175,41 @@ func run() error {
 			}
 		}
 
-		err := connectAndStream(sigChan)
+		err := connectAndStream(sigChan, hupChan, output, sink, wav, health)
 		if err == nil {
 			return nil
 		}
+		// 下流のプレイヤーが終了した場合は再接続しても書き込めないため終了する
+		if errors.Is(err, internal.ErrOutputClosed) {
+			fmt.Fprintf(os.Stderr, "Output closed by downstream player, exiting: %v\n", err)
+			return nil
+		}
+		// 送信側がキーフレームを送らない場合、--codec のコーデックが選ばれない場合、認証エラーは再接続しても同じため、すぐにエラーで終了する
+		if errors.Is(err, internal.ErrKeyframeTimeout) || errors.Is(err, internal.ErrVideoCodecNotNegotiated) || internal.ExitCode(err) == internal.ExitAuth {
+			return err
+		}
+		// 出力自体の書き込み失敗と --on-write-error exit は再接続せずに終了する
+		if errors.Is(err, internal.ErrStreamWrite) {
+			return err
+		}
 
 		lastErr = err
 		fmt.Fprintf(os.Stderr, "Connection error: %v\n", err)
 	}
 
+	if internal.ProbeMode {
+		return fmt.Errorf("probe failed: %w", lastErr)
+	}
 	return fmt.Errorf("max reconnection attempts (%d) exceeded: %w",
 		maxReconnectAttempts, lastErr)
 }
 
-func connectAndStream(sigChan <-chan os.Signal) error {
+func connectAndStream(sigChan, hupChan <-chan os.Signal, output *outputFile, sink internal.OutputSink, wav *internal.WAVWriter, health *internal.HealthState) (retErr error) {
+	// 失敗した段階が分かるよう、ICE接続・最初のメディア・受信中の途絶でタイムアウトを分ける
+	connectTimeout := time.Duration(internal.ConnectTimeoutMs) * time.Millisecond
+	mediaTimeout := time.Duration(internal.MediaTimeoutMs) * time.Millisecond
+	streamTimeout := time.Duration(internal.StreamTimeoutMs) * time.Millisecond
+
 	// Create MediaEngine with VP8/VP9
 	mediaEngine, err := internal.CreateVP8VP9MediaEngine()
 	if err != nil {
@@ -82,9 +221,34 @@ func connectAndStream(sigChan <-chan os.Signal) error {
 	mediaReceivedChan := make(chan struct{}, 1)
 
 	// StreamManagerを先に作成
+	// キーフレーム要求はKeyframeControllerに集約して頻度を制限する
+	keyframeCtl := internal.NewKeyframeController(time.Duration(internal.PLIIntervalMs) * time.Millisecond)
+
+	// --probe 時はMKVを出力せず計測のみ行う。--output-format ivf 時はデコードせずに出力する
 	processor := internal.NewDefaultRTPProcessor()
-	writer := internal.NewRawVideoMKVWriter(os.Stdout, "vp8")
-	streamManager := internal.NewStreamManager(writer, processor, mediaTimeout, mediaReceivedChan)
+	var writer internal.StreamWriter
+	var probeWriter *internal.ProbeWriter
+	var rotator internal.OutputRotator
+	if internal.ProbeMode {
+		probeWriter = internal.NewProbeWriter()
+		writer = probeWriter
+	} else {
+		writer = sink.Session(internal.SinkOptions{KeyframeController: keyframeCtl})
+		rotator = sink
+	}
+	streamManager := internal.NewStreamManager(writer, processor, streamTimeout, mediaReceivedChan)
+	streamManager.SetKeyframeController(keyframeCtl)
+	streamManager.SetHealthState(health)
+	defer health.SetConnected(false)
+	// --wav-out のデコーダーはStreamManagerの停止（defer）より後に解放する
+	if wav != nil {
+		tap, err := internal.NewOpusWAVTap(wav)
+		if err != nil {
+			return err
+		}
+		defer tap.Close()
+		streamManager.SetAudioTap(tap.WriteAudioFrame)
+	}
 
 	// Create PeerConnection
 	peerConnection, err := internal.CreatePeerConnection(mediaEngine, eventChan, streamManager)
@@ -103,14 +267,71 @@ func connectAndStream(sigChan <-chan os.Signal) error {
 	}()
 
 	// Exchange SDP with WHEP server
-	if err := internal.ExchangeSDPWithWHEP(peerConnection, internal.WhepURL); err != nil {
+	session := internal.NewWHEPSession(internal.WhepURL)
+	session.SetTwoPhase(internal.WHEPTwoPhase)
+	session.SetOptionsICEServers(internal.OptionsICEServers)
+	if err := session.ExchangeSDP(peerConnection); err != nil {
 		return fmt.Errorf("SDP exchange failed: %w", err)
 	}
+	defer func() {
+		if dErr := session.Delete(); dErr != nil {
+			fmt.Fprintf(os.Stderr, "cannot delete WHEP session: %v\n", dErr)
+		}
+	}()
+	// 正常終了時は、WHEPセッションのDELETE（defer）より前にRTCP BYEで受信の終了を通知する
+	mediaStarted := false
+	defer func() {
+		if retErr == nil && mediaStarted {
+			sendGoodbye(peerConnection, streamManager)
+		}
+	}()
+
+	// ICEがcheckingのまま進まない場合は候補ペアを表示し、--ice-restart ならICE restartを行う
+	checkingMonitor := session.CheckingMonitor(peerConnection)
+	if checkingMonitor != nil {
+		checkingStop := make(chan struct{})
+		defer close(checkingStop)
+		go checkingMonitor.Run(checkingStop)
+	}
+
+	// サーバーがSSE拡張を広告していればイベントストリームを購読する
+	if internal.WHEPEvents {
+		if eventStream := session.NewEventStream(); eventStream != nil {
+			eventsStop := make(chan struct{})
+			defer close(eventsStop)
+			go eventStream.Run(eventsStop)
+		} else {
+			fmt.Fprintln(os.Stderr, "WHEP server does not advertise server-sent events, --whep-events ignored")
+		}
+	}
+
+	// サーバーが映像を送らない場合、MKVは映像を待たずに音声のみで書き込む
+	// 音声を送らない場合は、データの届かない音声トラックを宣言しないよう映像のみで書き込む
+	// 映像がある場合は --codec のコーデックが選ばれたかを確認する
+	// answerに複数の映像コーデックがあれば送信側がRTPのペイロードタイプで選ぶため、writerのコーデックは
+	// 最初の映像RTPで決める（StreamManager.AddVideoTrack、途中で変わった場合も追従する）
+	if !internal.AnswerHasVideo(peerConnection.RemoteDescription().SDP) {
+		fmt.Fprintln(os.Stderr, "Server answer has no video (audio-only stream, or the server supports neither VP8 nor VP9)")
+		streamManager.SetAudioOnly()
+	} else {
+		if !internal.AnswerHasAudio(peerConnection.RemoteDescription().SDP) {
+			fmt.Fprintln(os.Stderr, "Server answer has no audio (the server declined audio), writing no audio track")
+			streamManager.SetVideoOnly()
+		}
+		negotiated := internal.NegotiatedVideoCodecs(peerConnection)
+		if _, err := internal.SelectVideoCodec(internal.VideoCodec, negotiated, internal.CodecFallback); err != nil {
+			return err
+		}
+		if len(negotiated) > 1 {
+			fmt.Fprintf(os.Stderr, "Server answered %d video codecs (%s); using the one the first video RTP packet carries\n",
+				len(negotiated), strings.ToUpper(strings.Join(negotiated, ", ")))
+		}
+	}
 
 	fmt.Fprintln(os.Stderr, "SDP exchange complete, waiting for connection...")
 
 	// ICE接続待機
-	connectionTimer := time.NewTimer(connectionTimeout)
+	connectionTimer := time.NewTimer(connectTimeout)
 	defer connectionTimer.Stop()
 
 WaitConnection:
@@ -121,13 +342,21 @@ WaitConnection:
 			return nil
 		case event := <-eventChan:
 			switch event.State {
+			case internal.StateChecking:
+				if checkingMonitor != nil {
+					checkingMonitor.SetState(webrtc.ICEConnectionStateChecking)
+				}
 			case internal.StateConnected:
+				if checkingMonitor != nil {
+					checkingMonitor.SetState(webrtc.ICEConnectionStateConnected)
+				}
+				health.SetConnected(true)
 				break WaitConnection
 			case internal.StateFailed:
-				return fmt.Errorf("connection failed: %w", event.Error)
+				return fmt.Errorf("%w: never connected: %w", internal.ErrConnection, event.Error)
 			}
 		case <-connectionTimer.C:
-			return fmt.Errorf("connection timeout after %v", connectionTimeout)
+			return fmt.Errorf("%w: never connected: ICE did not connect within %v (check network, firewall and TURN settings)", internal.ErrConnection, connectTimeout)
 		}
 	}
 
@@ -147,28 +376,65 @@ WaitConnection:
 	mediaTimer := time.NewTimer(mediaTimeout)
 	defer mediaTimer.Stop()
 
-	select {
-	case <-sigChan:
-		fmt.Fprintln(os.Stderr, "Interrupted while waiting for media...")
-		return nil
-	case <-mediaReceivedChan:
-		fmt.Fprintln(os.Stderr, "Media received, streaming...")
-	case err := <-streamErrChan:
-		return fmt.Errorf("stream error during startup: %w", err)
-	case <-mediaTimer.C:
-		return fmt.Errorf("media timeout after %v", mediaTimeout)
+WaitMedia:
+	for {
+		select {
+		case <-sigChan:
+			fmt.Fprintln(os.Stderr, "Interrupted while waiting for media...")
+			return nil
+		case <-mediaReceivedChan:
+			fmt.Fprintln(os.Stderr, "Media received, streaming...")
+			mediaStarted = true
+			break WaitMedia
+		case err := <-streamErrChan:
+			return fmt.Errorf("stream error during startup: %w", err)
+		case event := <-eventChan:
+			// DTLSハンドシェイクはICE接続後に行われるため、その失敗はメディア待ちの間に届く
+			switch event.State {
+			case internal.StateFailed:
+				return fmt.Errorf("%w: connected but no media: %w", internal.ErrConnection, event.Error)
+			case internal.StateDisconnected:
+				health.SetConnected(false)
+			case internal.StateConnected:
+				health.SetConnected(true)
+			}
+		case <-mediaTimer.C:
+			return fmt.Errorf("%w: connected but no media within %v (DTLS/SRTP failed or the server is not sending)", internal.ErrMediaTimeout, mediaTimeout)
+		}
+	}
+
+	if probeWriter != nil {
+		return probeStream(probeWriter, sigChan, streamErrChan, eventChan)
 	}
 
 	fmt.Fprintln(os.Stderr, "Connected to WHEP server, receiving media...")
-	fmt.Fprintln(os.Stderr, "Piping Matroska (MKV) stream with decoded rawvideo + Opus audio to stdout")
+	if internal.VideoOutPath == "" && internal.AudioOutPath == "" {
+		fmt.Fprintf(os.Stderr, "Piping Matroska (MKV) stream with decoded rawvideo + Opus audio to %s\n", output)
+	}
 	fmt.Fprintln(os.Stderr, "Press Ctrl+C to stop")
 
+	// 受信ジッターを定期的に出力する（--stats-format）
+	statsStop := make(chan struct{})
+	defer close(statsStop)
+	go runStats(statsStop, streamManager, peerConnection)
+
 	// ストリーミング中のイベント監視
 	for {
 		select {
 		case <-sigChan:
 			fmt.Fprintln(os.Stderr, "Closing...")
 			return nil
+		case <-hupChan:
+			// 接続待ちの間に届いたSIGHUPもここで処理する（それまでは古いファイルに書き込む）
+			if err := output.rotate(rotator); err != nil {
+				fmt.Fprintf(os.Stderr, "Output rotation skipped: %v\n", err)
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Output rotated, writing a new file at %s\n", output)
+			// IVFは新しいファイルをキーフレームから始めるため、送信側に要求する
+			if internal.OutputFormat == internal.OutputFormatIVF {
+				keyframeCtl.Request("output rotated")
+			}
 		case err := <-streamErrChan:
 			if err != nil {
 				return fmt.Errorf("stream error: %w", err)
@@ -177,20 +443,22 @@ WaitConnection:
 		case event := <-eventChan:
 			switch event.State {
 			case internal.StateFailed:
-				return fmt.Errorf("connection lost: %w", event.Error)
+				return fmt.Errorf("%w: connection lost: %w", internal.ErrConnection, event.Error)
 			case internal.StateDisconnected:
+				health.SetConnected(false)
 				fmt.Fprintln(os.Stderr, "ICE disconnected, waiting for recovery...")
 				recoveryTimer := time.NewTimer(5 * time.Second)
 				select {
 				case <-recoveryTimer.C:
-					return fmt.Errorf("ICE recovery timeout")
+					return fmt.Errorf("%w: ICE recovery timeout", internal.ErrConnection)
 				case recoverEvent := <-eventChan:
 					recoveryTimer.Stop()
 					if recoverEvent.State == internal.StateConnected {
+						health.SetConnected(true)
 						fmt.Fprintln(os.Stderr, "ICE reconnected")
 						continue
 					}
-					return fmt.Errorf("ICE recovery failed: state=%d", recoverEvent.State)
+					return fmt.Errorf("%w: ICE recovery failed: state=%d", internal.ErrConnection, recoverEvent.State)
 				case <-sigChan:
 					recoveryTimer.Stop()
 					fmt.Fprintln(os.Stderr, "Interrupted during recovery...")
@@ -200,3 +468,41 @@ WaitConnection:
 		}
 	}
 }
+
+// sendGoodbye は正常終了時にRTCP BYEを送り、サーバーに受信の終了を通知する
+func sendGoodbye(peerConnection *webrtc.PeerConnection, streamManager *internal.StreamManager) {
+	if err := internal.SendGoodbye(peerConnection, streamManager.FeedbackSSRCs()); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot send RTCP BYE: %v\n", err)
+		return
+	}
+	internal.DebugLog("Sent RTCP BYE\n")
+}
+
+// probeStream はprobeDurationの間受信して計測結果を出力する
+// 戻った後のdeferでStreamManager停止、PeerConnection切断、WHEPセッションのDELETEが行われる
+func probeStream(probeWriter *internal.ProbeWriter, sigChan <-chan os.Signal, streamErrChan <-chan error, eventChan <-chan internal.ConnectionEvent) error {
+	fmt.Fprintf(os.Stderr, "Probing stream for %v...\n", probeDuration)
+
+	probeTimer := time.NewTimer(probeDuration)
+	defer probeTimer.Stop()
+
+	for {
+		select {
+		case <-sigChan:
+			fmt.Fprintln(os.Stderr, "Interrupted, printing partial result...")
+			internal.PrintProbeSummary(probeWriter.Result())
+			return nil
+		case err := <-streamErrChan:
+			if err != nil {
+				return fmt.Errorf("stream error: %w", err)
+			}
+		case event := <-eventChan:
+			if event.State == internal.StateFailed {
+				return fmt.Errorf("%w: connection lost: %w", internal.ErrConnection, event.Error)
+			}
+		case <-probeTimer.C:
+			internal.PrintProbeSummary(probeWriter.Result())
+			return nil
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+)
+
+// outputFile はwhep-goの出力先（--output のファイル、未指定ならstdout）
+// 再接続をまたいで同じファイルに書き込み、SIGHUPでパスを開き直す
+type outputFile struct {
+	path string // 空の場合はstdout
+	file *os.File
+}
+
+// openOutput は --output のファイルを作成（既存なら切り詰め）して開く
+func openOutput(path string) (*outputFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open output: %w", err)
+	}
+	return &outputFile{path: path, file: file}, nil
+}
+
+func (o *outputFile) String() string {
+	if o.path == "" {
+		return "stdout"
+	}
+	return o.path
+}
+
+// openSplitOutput は --video-out と --audio-out のファイルを開き、映像と音声を別々に書き込むOutputSinkを作る
+// 返す関数は開いたファイルを閉じる（SIGHUPでのローテーションには対応しない）
+func openSplitOutput() (internal.OutputSink, func(), error) {
+	var files []*outputFile
+	closeFiles := func() {
+		for _, output := range files {
+			if err := output.Close(); err != nil {
+				fmt.Fprintf(os.Stderr, "cannot close %s: %v\n", output, err)
+			}
+		}
+	}
+	var video, audio *os.File
+	if internal.VideoOutPath != "" {
+		output, err := openOutput(internal.VideoOutPath)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, output)
+		video = output.file
+		fmt.Fprintf(os.Stderr, "Writing video (%s) to %s\n", internal.VideoOutFormat, internal.VideoOutPath)
+	}
+	if internal.AudioOutPath != "" {
+		output, err := openOutput(internal.AudioOutPath)
+		if err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+		files = append(files, output)
+		audio = output.file
+		fmt.Fprintf(os.Stderr, "Writing audio (%s) to %s\n", internal.AudioOutFormat, internal.AudioOutPath)
+	}
+	sink, err := internal.NewSplitOutputSink(internal.VideoOutFormat, video, internal.AudioOutFormat, audio)
+	if err != nil {
+		closeFiles()
+		return nil, nil, err
+	}
+	return sink, closeFiles, nil
+}
+
+// openWAVOutput は --wav-out のファイルを開き、デコードした音声を書き込むWAVWriterを作る
+// 返す関数はWAVのヘッダーのサイズを確定してファイルを閉じる
+func openWAVOutput() (*internal.WAVWriter, func(), error) {
+	output, err := openOutput(internal.WAVOutPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	wav := internal.NewWAVWriter(output.file, 48000, 2)
+	fmt.Fprintf(os.Stderr, "Writing decoded audio (WAV, 48kHz stereo) to %s\n", internal.WAVOutPath)
+	return wav, func() {
+		if err := wav.Close(); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot finish WAV output: %v\n", err)
+		}
+		output.Close()
+	}, nil
+}
+
+// Close は --output のファイルを閉じる（stdoutは閉じない）
+func (o *outputFile) Close() error {
+	if o.path == "" {
+		return nil
+	}
+	return o.file.Close()
+}
+
+// rotate はパスを新しいファイルとして開き直し、rotatorの書き込み先を切り替えてから古いファイルを閉じる
+// rotatorがnilの場合はファイルのみ切り替え、次の接続のライターから新しいファイルに書き込む
+// logrotate等でファイルが移動されていない場合は、書き込み中のファイルを切り詰めないよう何もしない
+func (o *outputFile) rotate(rotator internal.OutputRotator) error {
+	if o.path == "" {
+		return fmt.Errorf("output is stdout, use --output to rotate")
+	}
+	current, err := o.file.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat current output: %w", err)
+	}
+	if info, err := os.Stat(o.path); err == nil && os.SameFile(info, current) {
+		return fmt.Errorf("%s has not been moved, keeping the current file", o.path)
+	}
+
+	file, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen output: %w", err)
+	}
+	if rotator != nil {
+		if err := rotator.Rotate(file); err != nil {
+			file.Close()
+			return err
+		}
+	}
+	if err := o.file.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot close rotated output: %v\n", err)
+	}
+	o.file = file
+	return nil
+}
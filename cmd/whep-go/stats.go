@@ -0,0 +1,149 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	statsFormatHuman  = "human"
+	statsFormatLogfmt = "logfmt"
+	statsFormatJSON   = "json"
+	statsInterval     = 5 * time.Second
+)
+
+// trackJitterStats は受信中の1トラックのジッター
+// local_jitter_msは読み取りループで計算した値、rtcp_jitter_msはpionがRTCPレシーバーレポートに載せる値
+// latency_msは --measure-latency でabs-capture-timeから計算したend-to-end遅延（計測できたトラックのみ）
+type trackJitterStats struct {
+	Kind          string   `json:"kind"`
+	Index         int      `json:"index"`
+	SSRC          uint32   `json:"ssrc"`
+	Packets       int64    `json:"packets"`
+	LocalJitterMs float64  `json:"local_jitter_ms"`
+	RTCPJitterMs  *float64 `json:"rtcp_jitter_ms,omitempty"`
+	LatencyMs     *float64 `json:"latency_ms,omitempty"`
+}
+
+// statsSnapshot は統計出力1回分の値
+type statsSnapshot struct {
+	ElapsedSec float64            `json:"elapsed_s"`
+	Tracks     []trackJitterStats `json:"tracks"`
+}
+
+// collectStats はStreamManagerのジッターと、PeerConnectionのinbound-rtp統計のジッターをSSRCで対応付ける
+func collectStats(elapsed time.Duration, streamManager *internal.StreamManager, peerConnection *webrtc.PeerConnection) statsSnapshot {
+	rtcpJitter := map[uint32]float64{}
+	for _, report := range peerConnection.GetStats() {
+		if inbound, ok := report.(webrtc.InboundRTPStreamStats); ok {
+			rtcpJitter[uint32(inbound.SSRC)] = inbound.Jitter * 1000
+		}
+	}
+	snapshot := statsSnapshot{ElapsedSec: elapsed.Seconds()}
+	for _, track := range streamManager.Jitter() {
+		stats := trackJitterStats{
+			Kind:          track.Kind,
+			Index:         track.Index,
+			SSRC:          track.SSRC,
+			Packets:       track.Packets,
+			LocalJitterMs: float64(track.Jitter) / float64(time.Millisecond),
+		}
+		if jitter, ok := rtcpJitter[track.SSRC]; ok {
+			stats.RTCPJitterMs = &jitter
+		}
+		if track.LatencySamples > 0 {
+			latency := float64(track.Latency) / float64(time.Millisecond)
+			stats.LatencyMs = &latency
+		}
+		snapshot.Tracks = append(snapshot.Tracks, stats)
+	}
+	return snapshot
+}
+
+// runStats はstopが閉じられるまでstatsInterval間隔で統計を出力する
+// humanはデバッグモードか --measure-latency 指定時のみ、logfmt/jsonは常に出力する
+func runStats(stop <-chan struct{}, streamManager *internal.StreamManager, peerConnection *webrtc.PeerConnection) {
+	if !internal.DebugMode && !internal.MeasureLatency && internal.StatsFormat == statsFormatHuman {
+		return
+	}
+	start := time.Now()
+	ticker := time.NewTicker(statsInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			snapshot := collectStats(now.Sub(start), streamManager, peerConnection)
+			fmt.Fprint(os.Stderr, formatStats(snapshot, internal.StatsFormat))
+		}
+	}
+}
+
+// formatStats はsnapshotを指定形式の文字列にする
+func formatStats(snapshot statsSnapshot, format string) string {
+	switch format {
+	case statsFormatLogfmt:
+		return formatStatsLogfmt(snapshot)
+	case statsFormatJSON:
+		return formatStatsJSON(snapshot)
+	default:
+		return formatStatsHuman(snapshot)
+	}
+}
+
+// trackName はlogfmtのキーと表示に使うトラック名（video, audio0, audio1, ...）
+func trackName(t trackJitterStats) string {
+	if t.Kind == "audio" {
+		return fmt.Sprintf("audio%d", t.Index)
+	}
+	return t.Kind
+}
+
+func formatStatsHuman(s statsSnapshot) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n[STATS] ---- %.1fs elapsed ----\n", s.ElapsedSec)
+	for _, t := range s.Tracks {
+		rtcp := "n/a"
+		if t.RTCPJitterMs != nil {
+			rtcp = fmt.Sprintf("%.2fms", *t.RTCPJitterMs)
+		}
+		fmt.Fprintf(&b, "[STATS] %s: SSRC=%x packets=%d jitter(local)=%.2fms jitter(rtcp)=%s",
+			trackName(t), t.SSRC, t.Packets, t.LocalJitterMs, rtcp)
+		if t.LatencyMs != nil {
+			fmt.Fprintf(&b, " latency=%.1fms", *t.LatencyMs)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+func formatStatsLogfmt(s statsSnapshot) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "stats elapsed_s=%.1f", s.ElapsedSec)
+	for _, t := range s.Tracks {
+		fmt.Fprintf(&b, " %[1]s_ssrc=%[2]d %[1]s_packets=%[3]d %[1]s_local_jitter_ms=%.2[4]f", trackName(t), t.SSRC, t.Packets, t.LocalJitterMs)
+		if t.RTCPJitterMs != nil {
+			fmt.Fprintf(&b, " %s_rtcp_jitter_ms=%.2f", trackName(t), *t.RTCPJitterMs)
+		}
+		if t.LatencyMs != nil {
+			fmt.Fprintf(&b, " %s_latency_ms=%.1f", trackName(t), *t.LatencyMs)
+		}
+	}
+	b.WriteString("\n")
+	return b.String()
+}
+
+func formatStatsJSON(s statsSnapshot) string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("{\"error\":%q}\n", err.Error())
+	}
+	return string(data) + "\n"
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// TestMain は環境変数WHIP_GO_TEST_MAINが設定されている場合、テストの代わりにwhip-goとして動く
+// プロセスの終了までを検証するテストは、テストバイナリをwhip-goとして起動し直す
+func TestMain(m *testing.M) {
+	if os.Getenv("WHIP_GO_TEST_MAIN") != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// whipGoCommand はargsを引数とするwhip-goとしてテストバイナリを起動するコマンドを作る
+func whipGoCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "WHIP_GO_TEST_MAIN=1")
+	return cmd
+}
+
+// unknownSize はサイズ不定の要素（Segment/Cluster）に使うサイズ
+var unknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// idBytes はEBML要素IDのバイト列を作る（先頭のマーカーを含む値）
+func idBytes(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// element はEBML要素（ID、サイズ、データ）を作る
+func element(id uint32, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	out := idBytes(id)
+	out = append(out, 0x08, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(out[len(out)-8:], uint64(len(data)))
+	out[len(out)-8] = 0x01
+	return append(out, data...)
+}
+
+// uintData はEBMLの符号なし整数要素のデータを8バイトで作る
+func uintData(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+const (
+	width          = 320
+	height         = 240
+	videoFrames    = 24 // 30fps x 0.8秒
+	runTimeout     = 30 * time.Second
+	connectTimeout = 10 * time.Second
+	deleteGrace    = 1 * time.Second
+)
+
+// mkvHeader はYUV420Pのrawvideoトラックを持つMKVの先頭（Cluster開始まで）を作る
+func mkvHeader() []byte {
+	return bytes.Join([][]byte{
+		element(0x1A45DFA3, element(0x4282, []byte("matroska"))),
+		append(idBytes(0x18538067), unknownSize...),
+		element(0x1549A966, element(0x2AD7B1, uintData(1000000))),
+		element(0x1654AE6B, element(0xAE,
+			element(0xD7, uintData(1)),
+			element(0x86, []byte("V_UNCOMPRESSED")),
+			element(0xE0, element(0xB0, uintData(width)), element(0xBA, uintData(height)), element(0x2EB524, []byte("YUV420P"))),
+		)),
+		append(idBytes(0x1F43B675), unknownSize...),
+		element(0xE7, uintData(0)),
+	}, nil)
+}
+
+// mkvFrame はi番目の映像フレームのSimpleBlockを作る（30fps）
+func mkvFrame(i int) []byte {
+	frame := make([]byte, width*height*3/2)
+	for j := range frame {
+		frame[j] = byte(i*4 + j/width)
+	}
+	timecode := i * 1000 / 30
+	return element(0xA3, []byte{0x81, byte(timecode >> 8), byte(timecode), 0x80}, frame)
+}
+
+// server はWHIPエンドポイントとして受信し、映像フレーム数・BYE・DELETEの順序を記録する
+type server struct {
+	mu             sync.Mutex
+	peerConnection *webrtc.PeerConnection
+	frames         int      // marker bitの立った映像RTPパケット数
+	events         []string // "bye" / "delete" を受け取った順
+	framesAtDelete int
+	connected      chan struct{}
+}
+
+func (s *server) record(event string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = append(s.events, event)
+}
+
+// awaitBeforeDelete はDELETEへの応答を保留し、BYEと全フレームの到着を待つ
+// UDPのRTCPとTCPのDELETEは到着順が前後しうるため、応答を返すまでに届けばDELETE前に送信されたとみなす
+func (s *server) awaitBeforeDelete() {
+	deadline := time.Now().Add(deleteGrace)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		ready := len(s.events) > 0 && s.frames >= videoFrames-1
+		s.mu.Unlock()
+		if ready {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.mu.Lock()
+	s.framesAtDelete = s.frames
+	s.mu.Unlock()
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		offer, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		answer, err := s.answer(string(offer))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", "/session/1")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+	case http.MethodDelete:
+		s.awaitBeforeDelete()
+		s.record("delete")
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// answer は受信側PeerConnectionを作成し、映像RTPとRTCP BYEを監視する
+func (s *server) answer(offer string) (string, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return "", err
+	}
+	interceptorRegistry := &interceptor.Registry{}
+	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return "", err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(internal.NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return "", err
+	}
+	s.peerConnection = peerConnection
+	var connectedOnce sync.Once
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		if state == webrtc.PeerConnectionStateConnected {
+			connectedOnce.Do(func() { close(s.connected) })
+		}
+	})
+
+	var byeOnce sync.Once
+	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+		go func() {
+			for {
+				packets, _, err := receiver.ReadRTCP()
+				if err != nil {
+					return
+				}
+				for _, packet := range packets {
+					if _, ok := packet.(*rtcp.Goodbye); ok {
+						byeOnce.Do(func() { s.record("bye") })
+					}
+				}
+			}
+		}()
+		for {
+			packet, _, err := track.ReadRTP()
+			if err != nil {
+				return
+			}
+			if track.Kind() == webrtc.RTPCodecTypeVideo && packet.Marker {
+				s.mu.Lock()
+				s.frames++
+				s.mu.Unlock()
+			}
+		}
+	})
+
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gathered
+	return peerConnection.LocalDescription().SDP, nil
+}
+
+// TestDrainOnEOF は入力終端でキュー内の全フレームを送信し、BYE→DELETEの順に終了することを検証する
+// 最初のフレームはSDP交換直後（SRTP確立前）に送られpionが破棄しうるため、残りのフレームは接続後に
+// まとめて書き込む。入力は即座に終端に達し、キューに溜まったフレームはペーシングに従って送信される
+func TestDrainOnEOF(t *testing.T) {
+	srv := &server{connected: make(chan struct{})}
+	httpServer := httptest.NewServer(srv)
+	defer httpServer.Close()
+	defer func() {
+		if srv.peerConnection != nil {
+			srv.peerConnection.Close()
+		}
+	}()
+
+	var stderr bytes.Buffer
+	cmd := whipGoCommand("--queue-capacity", "100", "--drop-threshold", "0", httpServer.URL)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	stdin.Write(mkvHeader())
+	stdin.Write(mkvFrame(0))
+	select {
+	case <-srv.connected:
+	case err := <-done:
+		t.Fatalf("whip-go exited before connecting: %v\n%s", err, stderr.String())
+	case <-time.After(connectTimeout):
+		cmd.Process.Kill()
+		t.Fatalf("not connected within %v\n%s", connectTimeout, stderr.String())
+	}
+	for i := 1; i < videoFrames; i++ {
+		stdin.Write(mkvFrame(i))
+	}
+	stdin.Close()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("whip-go exited with %v\n%s", err, stderr.String())
+		}
+	case <-time.After(runTimeout):
+		cmd.Process.Kill()
+		t.Fatalf("whip-go did not exit within %v\n%s", runTimeout, stderr.String())
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if fmt.Sprint(srv.events) != "[bye delete]" {
+		t.Fatalf("events %v, want [bye delete]", srv.events)
+	}
+	// 接続後に書き込んだ videoFrames-1 枚はすべて届いていること
+	if srv.framesAtDelete < videoFrames-1 {
+		t.Fatalf("%d video frames received before DELETE, want at least %d\n%s", srv.framesAtDelete, videoFrames-1, stderr.String())
+	}
+	if !bytes.Contains(stderr.Bytes(), []byte("End of input stream, all queued frames sent")) {
+		t.Fatalf("no end of stream message\n%s", stderr.String())
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+)
+
+// keyframeRequester は受信側から届いたPLI/FIRに応じて、エンコーダーの次のフレームをキーフレームにする
+// 受信側やSFUが同じ欠落に対して何度も要求を送っても帯域を食い潰さないよう、
+// 最後に強制してから --pli-interval 以内の要求はまとめる
+type keyframeRequester struct {
+	encoder     *internal.VP8Encoder
+	minInterval time.Duration
+	clock       internal.Clock
+
+	mu         sync.Mutex
+	last       time.Time // 最後にキーフレームを強制した時刻
+	forced     int64     // 要求に応じてキーフレームを強制した回数
+	suppressed int64     // 間引いた要求の数
+}
+
+// newKeyframeRequester はencoderのキーフレームを要求に応じて強制するkeyframeRequesterを作成する
+// passthrough（encoderがnil）の場合はnilを返す（入力のキーフレームを待つしかない）
+func newKeyframeRequester(encoder *internal.VP8Encoder, minInterval time.Duration) *keyframeRequester {
+	if encoder == nil {
+		return nil
+	}
+	return &keyframeRequester{encoder: encoder, minInterval: minInterval, clock: internal.SystemClock{}}
+}
+
+// request はPLI/FIRを受けてキーフレームを強制する。間引いた場合はfalseを返す
+func (r *keyframeRequester) request(kind string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.clock.Now()
+	if !r.last.IsZero() && now.Sub(r.last) < r.minInterval {
+		r.suppressed++
+		internal.DebugLog("%s received, keyframe already forced %v ago (--pli-interval %v)\n", kind, now.Sub(r.last), r.minInterval)
+		return false
+	}
+	r.encoder.ForceKeyframe()
+	r.last = now
+	r.forced++
+	internal.DebugLog("%s received, forcing a keyframe (forced=%d, suppressed=%d)\n", kind, r.forced, r.suppressed)
+	return true
+}
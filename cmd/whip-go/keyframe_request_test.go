@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+)
+
+// keyframeRequestClock は手動で進める時計
+type keyframeRequestClock struct {
+	now time.Time
+}
+
+func (c *keyframeRequestClock) Now() time.Time {
+	return c.now
+}
+
+// keyframeRequestEncode は灰色の64x64フレームをエンコードし、キーフレームだったかを返す
+func keyframeRequestEncode(t *testing.T, encoder *internal.VP8Encoder, i int) bool {
+	t.Helper()
+	yuv := make([]byte, 64*64*3/2)
+	for j := range yuv {
+		yuv[j] = byte(0x40 + i)
+	}
+	_, keyframe, err := encoder.Encode(yuv)
+	if err != nil {
+		t.Fatalf("encode frame %d: %v", i, err)
+	}
+	return keyframe
+}
+
+// TestKeyframeRequesterRateLimit は受信したPLI/FIRで次のフレームがキーフレームになり、
+// --pli-interval 以内に続いた要求は間引かれることを検証する
+func TestKeyframeRequesterRateLimit(t *testing.T) {
+	encoder, err := internal.NewVP8Encoder(64, 64, "YUV420P", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	clock := &keyframeRequestClock{now: time.Unix(0, 0)}
+	r := newKeyframeRequester(encoder, time.Second)
+	r.clock = clock
+
+	// 最初のフレームはエンコーダー自身のキーフレーム
+	keyframeRequestEncode(t, encoder, 0)
+	if keyframeRequestEncode(t, encoder, 1) {
+		t.Fatal("second frame was a keyframe without a request")
+	}
+
+	if !r.request("PLI") {
+		t.Fatal("first PLI was suppressed")
+	}
+	if !keyframeRequestEncode(t, encoder, 2) {
+		t.Fatal("frame after a PLI was not a keyframe")
+	}
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	if r.request("FIR") {
+		t.Fatal("FIR 500ms after the forced keyframe was not suppressed")
+	}
+	if keyframeRequestEncode(t, encoder, 3) {
+		t.Fatal("suppressed FIR forced a keyframe")
+	}
+
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	if !r.request("PLI") {
+		t.Fatal("PLI 1s after the forced keyframe was suppressed")
+	}
+	if !keyframeRequestEncode(t, encoder, 4) {
+		t.Fatal("frame after the second PLI was not a keyframe")
+	}
+	if forced, _ := encoder.KeyframeCounts(); forced != 2 || r.forced != 2 || r.suppressed != 1 {
+		t.Fatalf("forced %d (requester %d), suppressed %d, want 2, 2 and 1", forced, r.forced, r.suppressed)
+	}
+}
+
+// TestKeyframeRequesterPassthrough はエンコーダーの無いpassthroughでは要求を無視することを検証する
+func TestKeyframeRequesterPassthrough(t *testing.T) {
+	r := newKeyframeRequester(nil, time.Second)
+	if r != nil {
+		t.Fatal("requester created without an encoder")
+	}
+	if r.request("PLI") {
+		t.Fatal("nil requester reported a forced keyframe")
+	}
+}
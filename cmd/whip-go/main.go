@@ -8,6 +8,7 @@ import (
 	"os/signal"
 	"runtime"
 	"runtime/pprof"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -15,7 +16,9 @@ import (
 
 	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
 	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
 	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 	"github.com/spf13/pflag"
 )
@@ -33,6 +36,9 @@ type stats struct {
 	encodeErrors       int64 // エンコードエラー数
 	sendErrors         int64 // 送信エラー数
 	queueDroppedFrames int64 // キュー由来の破棄フレーム数
+	videoQueueDrops    int64 // キューから映像を破棄しようとした回数（取り出す前に数える、passthrough時のキーフレーム待ち用）
+	audioCatchupFrames int64 // 遅延解消のためエンコード前に破棄した10ms音声フレーム数
+	fpsLimitedFrames   int64 // --max-fpsによりエンコード前に間引いた映像フレーム数
 	lastVideoPTS       int64 // 送信成功した最後の映像PTS（ms）
 	lastVideoSentAtNs  int64 // 送信成功した最後の映像時刻（UnixNano）
 	lastAudioPTS       int64 // 送信成功した最後の音声PTS（ms）
@@ -40,10 +46,11 @@ type stats struct {
 }
 
 const (
-	frameQueueCapacity         = 12
-	frameQueueLowLatencyTarget = 4
-	frameQueueTrimInterval     = 3
-	ptsSyncWindow              = 20 * time.Millisecond
+	frameQueueTrimInterval = 3
+	ptsSyncWindow          = 20 * time.Millisecond
+	audioBitrateReserveBps = 64_000 // 帯域推定値から音声用に確保する帯域
+	minVideoBitrateKbps    = 100
+	rtcpTimeout            = 5 * time.Second // RTCPレポートがこの時間届かなければ接続断とみなす
 )
 
 func main() {
@@ -56,10 +63,15 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := run(); err != nil {
+	// 終了理由は終了コードとstderrのサマリー行で通知する
+	if internal.CheckMode {
+		internal.Exit(internal.RunPreflightCheck(internal.WhipURL))
+	}
+	err := run()
+	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
 	}
+	internal.Exit(err)
 }
 
 func run() error {
@@ -96,10 +108,7 @@ func run() error {
 	}
 
 	fmt.Fprintf(os.Stderr, "Connecting to WHIP server: %s\n", internal.WhipURL)
-	fmt.Fprintln(os.Stderr, "Reading MKV from stdin (rawvideo + Opus)")
-
-	// Create MKV reader
-	mkvReader := internal.NewMKVReader(os.Stdin)
+	source := newFrameSource()
 
 	// 統計情報の初期化
 	var s stats
@@ -110,7 +119,7 @@ func run() error {
 	// Read first video frame to get dimensions
 	var firstFrame *internal.Frame
 	for {
-		frame, err := mkvReader.ReadFrame()
+		frame, err := source.ReadFrame()
 		if err != nil {
 			if err == io.EOF {
 				return fmt.Errorf("no video frames found in input")
@@ -125,16 +134,76 @@ func run() error {
 		}
 	}
 
-	width := mkvReader.VideoWidth()
-	height := mkvReader.VideoHeight()
-	if width == 0 || height == 0 {
-		return fmt.Errorf("could not determine video dimensions")
+	// 入力映像コーデックから送信コーデックを決定
+	// --no-reencode 指定時、VP8/VP9入力はエンコーダーを通さずそのままパケット化する
+	videoCodec := source.VideoCodec()
+	videoMimeType := webrtc.MimeTypeVP8
+	videoPayloadType := webrtc.PayloadType(internal.VP8PayloadType)
+	passthrough := false
+	if internal.NoReencode {
+		switch videoCodec {
+		case "V_VP8":
+			passthrough = true
+		case "V_VP9":
+			passthrough = true
+			videoMimeType = webrtc.MimeTypeVP9
+			videoPayloadType = webrtc.PayloadType(internal.VP9PayloadType)
+		default:
+			fmt.Fprintf(os.Stderr, "--no-reencode ignored: input video codec %s requires encoding\n", videoCodec)
+		}
+	}
+
+	width := source.VideoWidth()
+	height := source.VideoHeight()
+	pixelFormat := source.PixelFormat()
+	if passthrough {
+		fmt.Fprintf(os.Stderr, "Video codec: %s (passthrough, no re-encoding)\n", videoCodec)
+		if internal.InputPixelFormat != "" {
+			fmt.Fprintf(os.Stderr, "--input-pixel-format ignored: passthrough video is not decoded\n")
+		}
+	} else {
+		if width == 0 || height == 0 {
+			return fmt.Errorf("could not determine video dimensions")
+		}
+		// ColourSpaceを省略したMKVはRGBA扱いになるため、--input-pixel-format で入力の指定より優先する
+		if internal.InputPixelFormat != "" && internal.InputPixelFormat != pixelFormat {
+			fmt.Fprintf(os.Stderr, "Input pixel format override: %s (input declares %s)\n", internal.InputPixelFormat, pixelFormat)
+			pixelFormat = internal.InputPixelFormat
+		}
+		fmt.Fprintf(os.Stderr, "Video resolution: %dx%d, pixel format: %s\n", width, height, pixelFormat)
+		if size := len(firstFrame.Data); size != internal.RawFrameSize(pixelFormat, width, height) {
+			if guess := internal.GuessPixelFormat(size, width, height); guess != "" {
+				fmt.Fprintf(os.Stderr, "Warning: first frame is %d bytes, which matches %s rather than %s; try --input-pixel-format %s\n", size, guess, pixelFormat, guess)
+			}
+		}
+		fmt.Fprintf(os.Stderr, "VP8 encoder: deadline=%s, cpu-used=%d\n", internal.EncodeDeadline, internal.CPUUsed)
+		// good/bestは1フレームのエンコードに時間がかかり、ライブ入力ではペーシングに追いつかずフレームが破棄されうる
+		if internal.EncodeDeadline != "realtime" && !internal.NoPacing {
+			fmt.Fprintf(os.Stderr, "Warning: --encode-deadline %s may not keep up with real-time input; use --no-pacing for file transcode\n", internal.EncodeDeadline)
+		}
+	}
+
+	// passthrough時はデルタフレームを間引くと参照が壊れるため、--max-fpsはエンコード時のみ有効
+	var fpsLimiter *internal.FrameRateLimiter
+	if internal.MaxFPS > 0 {
+		if passthrough {
+			fmt.Fprintf(os.Stderr, "--max-fps ignored: passthrough video cannot drop frames without re-encoding\n")
+		} else {
+			fpsLimiter = internal.NewFrameRateLimiter(internal.MaxFPS)
+			fpsLimiter.Allow(firstFrame.TimestampMs)
+			fmt.Fprintf(os.Stderr, "Max frame rate: %d fps\n", internal.MaxFPS)
+		}
+	}
+
+	// 入力PTSの逆戻りの補正（--pts-monotonic）。最初の映像フレームを各映像トラックの基準にする
+	ptsFilter := newPTSMonotonic(internal.PTSMonotonic, internal.PTSToleranceMs, passthrough)
+	if ptsFilter != nil {
+		ptsFilter.filter(firstFrame)
+		fmt.Fprintf(os.Stderr, "PTS monotonic: %s backward jumps over %dms\n", internal.PTSMonotonic, internal.PTSToleranceMs)
 	}
-	pixelFormat := mkvReader.PixelFormat()
-	fmt.Fprintf(os.Stderr, "Video resolution: %dx%d, pixel format: %s\n", width, height, pixelFormat)
 
 	// Check audio codec
-	audioCodec := mkvReader.AudioCodec()
+	audioCodec := source.AudioCodec()
 	needsOpusEncode := (audioCodec == "A_PCM/INT/LIT")
 	if audioCodec != "" {
 		fmt.Fprintf(os.Stderr, "Audio codec: %s\n", audioCodec)
@@ -146,8 +215,8 @@ func run() error {
 	// Create Opus encoder if needed
 	var opusEncoder *internal.OpusEncoder
 	if needsOpusEncode {
-		sampleRate := mkvReader.AudioSampleRate()
-		channels := mkvReader.AudioChannels()
+		sampleRate := source.AudioSampleRate()
+		channels := source.AudioChannels()
 		if sampleRate == 0 {
 			sampleRate = 48000
 		}
@@ -155,6 +224,9 @@ func run() error {
 			channels = 2
 		}
 		fmt.Fprintf(os.Stderr, "Audio: %dHz, %d channels\n", sampleRate, channels)
+		if channels > 2 {
+			fmt.Fprintf(os.Stderr, "Downmixing %d-channel PCM to stereo before Opus encoding\n", channels)
+		}
 		var opusErr error
 		opusEncoder, opusErr = internal.NewOpusEncoder(sampleRate, channels)
 		if opusErr != nil {
@@ -163,20 +235,23 @@ func run() error {
 		defer opusEncoder.Close()
 	}
 
-	// Create VP8 encoder
-	encoder, err := internal.NewVP8Encoder(width, height, pixelFormat, internal.VideoBitrateKbps)
+	// Create VP8 encoders (passthrough時は不要、simulcast時はレイヤーごとに1つ)
+	videoLayers, err := newVideoLayers(width, height, pixelFormat, passthrough)
 	if err != nil {
-		return fmt.Errorf("failed to create VP8 encoder: %v", err)
+		return err
 	}
-	defer encoder.Close()
+	defer closeVideoLayers(videoLayers)
+	simulcast := len(videoLayers) > 1
+	// 帯域推定による制御は最上位レイヤー（simulcastでない場合は唯一のレイヤー）のエンコーダーに適用する
+	encoder := videoLayers[len(videoLayers)-1].encoder
 
 	// Create MediaEngine
 	mediaEngine := &webrtc.MediaEngine{}
 	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
 		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType: webrtc.MimeTypeVP8, ClockRate: 90000,
+			MimeType: videoMimeType, ClockRate: 90000,
 		},
-		PayloadType: 97,
+		PayloadType: videoPayloadType,
 	}, webrtc.RTPCodecTypeVideo); err != nil {
 		return err
 	}
@@ -184,14 +259,21 @@ func run() error {
 		RTPCodecCapability: webrtc.RTPCodecCapability{
 			MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2,
 		},
-		PayloadType: 111,
+		PayloadType: webrtc.PayloadType(internal.OpusPayloadType),
 	}, webrtc.RTPCodecTypeAudio); err != nil {
 		return err
 	}
+	if err := internal.RegisterHeaderExtensions(mediaEngine); err != nil {
+		return err
+	}
 
 	// Create InterceptorRegistry
 	interceptorRegistry := &interceptor.Registry{}
-	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+	if err := internal.RegisterInterceptors(mediaEngine, interceptorRegistry); err != nil {
+		return err
+	}
+	estimatorChan, err := internal.ConfigureCongestionControl(mediaEngine, interceptorRegistry, internal.VideoBitrateKbps*1000+audioBitrateReserveBps)
+	if err != nil {
 		return err
 	}
 
@@ -199,75 +281,192 @@ func run() error {
 	api := webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(internal.NewSettingEngine()),
 	)
 
 	// Create PeerConnection
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-	peerConnection, err := api.NewPeerConnection(config)
+	peerConnection, err := api.NewPeerConnection(internal.NewPeerConnectionConfig())
 	if err != nil {
 		return err
 	}
 	defer peerConnection.Close()
 
-	// Create video track
-	videoTrack, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8},
-		"video", "whip-go",
-	)
-	if err != nil {
-		return err
+	// 帯域推定器はPeerConnection作成時にインターセプターから渡される
+	var bandwidthEstimator cc.BandwidthEstimator
+	if estimatorChan != nil {
+		bandwidthEstimator = <-estimatorChan
 	}
-	videoSender, err := peerConnection.AddTrack(videoTrack)
+
+	// SSRC/CNAMEを決定（未指定の場合はランダム/デフォルト）
+	rand.Seed(time.Now().UnixNano())
+	videoSSRC, audioSSRC, err := resolveSSRCs(internal.VideoSSRC, internal.AudioSSRC)
 	if err != nil {
 		return err
 	}
+	cname := internal.CNAME
+	if cname == "" {
+		cname = "whip-go"
+	}
+	internal.DebugLog("SSRC: video=%d, audio=%d, CNAME=%s\n", videoSSRC, audioSSRC, cname)
+
+	// Create video track
+	// pionはトラックのStreamIDをSDPのCNAMEとして使用する
+	// simulcast時はレイヤーごとにRIDを持つトラックを作り、1つのトランシーバーにまとめる
+	for _, layer := range videoLayers {
+		var options []func(*webrtc.TrackLocalStaticRTP)
+		if layer.rid != "" {
+			options = append(options, webrtc.WithRTPStreamID(layer.rid))
+		}
+		layer.track, err = webrtc.NewTrackLocalStaticRTP(
+			webrtc.RTPCodecCapability{MimeType: videoMimeType},
+			"video", cname, options...,
+		)
+		if err != nil {
+			return err
+		}
+		layer.writeRTP = layer.track.WriteRTP
+	}
+	var videoSender *webrtc.RTPSender
+	var videoTransceiver *webrtc.RTPTransceiver
+	if simulcast {
+		if internal.VideoSSRC != 0 {
+			fmt.Fprintln(os.Stderr, "--ssrc-video ignored (simulcast SSRCs are assigned per RID)")
+		}
+		videoTransceiver, err = addSimulcastTrack(peerConnection, videoLayers)
+		if err != nil {
+			return err
+		}
+		videoSender = videoTransceiver.Sender()
+	} else {
+		videoSender, err = addSendTrack(peerConnection, videoLayers[0].track, videoSSRC)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Create audio track
 	audioTrack, err := webrtc.NewTrackLocalStaticRTP(
 		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus},
-		"audio", "whip-go",
+		"audio", cname,
 	)
 	if err != nil {
 		return err
 	}
-	audioSender, err := peerConnection.AddTrack(audioTrack)
+	audioSender, err := addSendTrack(peerConnection, audioTrack, audioSSRC)
 	if err != nil {
 		return err
 	}
 
+	// RTCP受信時刻はタイムアウト監視と /readyz で共有する
+	health := internal.NewHealthState(rtcpTimeout)
+	if internal.HealthAddr != "" {
+		server, err := internal.StartHealthServer(internal.HealthAddr, health)
+		if err != nil {
+			return err
+		}
+		defer server.Close()
+		fmt.Fprintf(os.Stderr, "Health endpoints: http://%s/healthz, http://%s/readyz\n", server.Addr, server.Addr)
+	}
+
+	// DTLSハンドシェイクの失敗はRTCPタイムアウトを待たずに終了理由として通知する
+	dtlsFailed := make(chan struct{}, 1)
+	internal.WatchDTLSState(peerConnection, func() {
+		select {
+		case dtlsFailed <- struct{}{}:
+		default:
+		}
+	})
+
+	// Exchange SDP with WHIP server
+	session := internal.NewWHIPSession(internal.WhipURL)
+	session.SetPostRetry(internal.PostRetries, time.Duration(internal.PostRetryBackoffMs)*time.Millisecond)
+	session.SetOptionsICEServers(internal.OptionsICEServers)
+	if simulcast {
+		// simulcast時は全レイヤーの合計の送信帯域をb=TIASで通知する
+		session.SetVideoBandwidth(totalBitrateKbps(videoLayers) * 1000)
+	}
+	// --dry-run は入力から決めたトラックでofferを作成して表示し、WHIPサーバーには送らずに終了する
+	if internal.DryRun {
+		return session.DryRun(os.Stdout, peerConnection)
+	}
+
+	// ICEがcheckingのまま進まない場合は候補ペアを表示し、--ice-restart ならICE restartを行う
+	checkingMonitor := session.CheckingMonitor(peerConnection)
+	if checkingMonitor != nil {
+		checkingStop := make(chan struct{})
+		defer close(checkingStop)
+		go checkingMonitor.Run(checkingStop)
+	}
+
 	// Set ICE connection state handler
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		internal.DebugLog("ICE Connection State has changed: %s\n", connectionState.String())
+		health.SetConnected(connectionState == webrtc.ICEConnectionStateConnected || connectionState == webrtc.ICEConnectionStateCompleted)
 		if connectionState == webrtc.ICEConnectionStateFailed {
 			fmt.Fprintln(os.Stderr, "ICE Connection Failed")
 		}
+		if checkingMonitor != nil {
+			checkingMonitor.SetState(connectionState)
+		}
 	})
 
-	// Exchange SDP with WHIP server
-	if err := internal.ExchangeSDPWithWHIP(peerConnection, internal.WhipURL); err != nil {
-		return fmt.Errorf("failed to exchange SDP: %v", err)
+	if err := session.ExchangeSDP(peerConnection); err != nil {
+		return fmt.Errorf("failed to exchange SDP: %w", err)
+	}
+	defer func() {
+		if dErr := session.Delete(); dErr != nil {
+			fmt.Fprintf(os.Stderr, "cannot delete WHIP session: %v\n", dErr)
+		}
+	}()
+
+	// 送信する映像コーデックがネゴシエーション結果と一致するか確認
+	if err := validateNegotiatedVideoCodec(videoSender, videoMimeType); err != nil {
+		return err
 	}
 
 	fmt.Fprintln(os.Stderr, "Connected to WHIP server, sending media...")
 	fmt.Fprintln(os.Stderr, "Press Ctrl+C to stop")
 
 	// Read RTCP reports from senders
-	// RTCP受信時刻を追跡し、5秒間受信がなければ自動終了
-	var lastRTCPReceived int64
-	atomic.StoreInt64(&lastRTCPReceived, time.Now().UnixNano())
-	go readRTCP("video", videoSender, &lastRTCPReceived)
-	go readRTCP("audio", audioSender, &lastRTCPReceived)
+	// RTCP受信時刻を追跡し、rtcpTimeoutの間受信がなければ自動終了
+	// 映像のPLI/FIRにはそのレイヤーのエンコーダーでキーフレームを強制して応える
+	rtcpWatchStart := time.Now()
+	keyframeInterval := time.Duration(internal.PLIIntervalMs) * time.Millisecond
+	if simulcast {
+		for _, layer := range videoLayers {
+			rid := layer.rid
+			go readRTCP("video/"+rid, func() ([]rtcp.Packet, error) {
+				packets, _, err := videoSender.ReadSimulcastRTCP(rid)
+				return packets, err
+			}, health, newKeyframeRequester(layer.encoder, keyframeInterval))
+		}
+	} else {
+		go readRTCP("video", senderRTCPReader(videoSender), health, newKeyframeRequester(videoLayers[0].encoder, keyframeInterval))
+	}
+	go readRTCP("audio", senderRTCPReader(audioSender), health, nil)
 
 	// Create packetizers
-	rand.Seed(time.Now().UnixNano())
-	videoPacketizer := internal.NewVP8Packetizer(rand.Uint32())
-	audioPacketizer := internal.NewOpusPacketizer(rand.Uint32())
+	newVideoPacketizer := func(ssrc uint32) internal.VideoPacketizer {
+		if videoMimeType == webrtc.MimeTypeVP9 {
+			return internal.NewVP9Packetizer(ssrc)
+		}
+		return internal.NewVP8Packetizer(ssrc)
+	}
+	if simulcast {
+		if err := bindSimulcastLayers(videoTransceiver, videoLayers, newVideoPacketizer); err != nil {
+			return err
+		}
+	} else {
+		videoLayers[0].packetizer = newVideoPacketizer(videoSSRC)
+	}
+	audioPacketizer := internal.NewOpusPacketizer(audioSSRC)
+	if internal.VP8Partitions {
+		if encoder != nil && videoMimeType == webrtc.MimeTypeVP8 {
+			fmt.Fprintf(os.Stderr, "VP8 partitioned packetization enabled (%d token partition(s))\n", internal.TokenPartitions)
+		} else {
+			fmt.Fprintln(os.Stderr, "--vp8-partitions and --partitions ignored (only apply when re-encoding to VP8)")
+		}
+	}
 
 	// Create per-track pacers for PTS-based timing
 	// Video/Audioで別々に管理し、異なる時刻系列の混在を防ぐ
@@ -285,6 +484,15 @@ func run() error {
 		fmt.Fprintln(os.Stderr, "PTS-based pacing disabled")
 	}
 
+	// --max-send-bitrate は映像と音声のRTPの書き込みを合わせて均し、ペーシングの有無によらず上限を超えて送らない
+	sendLimiter := internal.NewSendRateLimiter(internal.MaxSendBitrateKbps * 1000)
+	if sendLimiter != nil {
+		for _, layer := range videoLayers {
+			layer.writeRTP = sendLimiter.Wrap(layer.writeRTP)
+		}
+		fmt.Fprintf(os.Stderr, "Send rate limit: %d kbps\n", internal.MaxSendBitrateKbps)
+	}
+
 	statsStartTime := time.Now()
 
 	// Handle interrupt signal
@@ -293,21 +501,56 @@ func run() error {
 
 	stopChan := make(chan struct{})
 	var stopOnce sync.Once
-	closeStop := func() {
-		stopOnce.Do(func() { close(stopChan) })
+	var stopErr error // 停止理由（Ctrl+C等の正常停止ではnil）、stopChanのクローズ後に参照する
+	stopWithError := func(err error) {
+		stopOnce.Do(func() {
+			stopErr = err
+			close(stopChan)
+			// --max-send-bitrate の待ちで送信中のワーカーも止める
+			sendLimiter.Stop()
+		})
+	}
+	closeStop := func() { stopWithError(nil) }
+
+	// 帯域推定値をエンコーダー（passthrough時はPacer）へ反映する
+	if bandwidthEstimator != nil {
+		bandwidthEstimator.OnTargetBitrateChange(func(bps int) {
+			applyBandwidthEstimate(bps, encoder, videoPacer)
+		})
+		go internal.LogBandwidthEstimate(bandwidthEstimator, stopChan)
+		fmt.Fprintln(os.Stderr, "Congestion control enabled (gcc)")
 	}
 
-	videoFrameQueue := make(chan *internal.Frame, frameQueueCapacity)
-	audioFrameQueue := make(chan *internal.Frame, frameQueueCapacity)
+	videoFrameQueue := make(chan *internal.Frame, internal.QueueCapacity)
+	audioFrameQueue := make(chan *internal.Frame, internal.QueueCapacity)
 	frameReadErr := make(chan error, 1)
 
+	// キューが満杯で破棄したフレームは、--spill-dir があれば後から調べられるようファイルに書き出す
+	var spiller *internal.FrameSpiller
+	if internal.SpillDir != "" {
+		spiller, err = internal.NewFrameSpiller(internal.SpillDir, internal.SpillMaxSize)
+		if err != nil {
+			return err
+		}
+		defer spiller.Close()
+		fmt.Fprintf(os.Stderr, "Spilling frames dropped by full queues to %s (up to %d bytes)\n", internal.SpillDir, internal.SpillMaxSize)
+	}
+
 	go func() {
 		<-sigChan
 		fmt.Fprintln(os.Stderr, "Stopping...")
 		closeStop()
 	}()
 
-	// RTCPタイムアウト監視: 5秒間RTCPレポートが来なければ自動終了
+	go func() {
+		select {
+		case <-stopChan:
+		case <-dtlsFailed:
+			stopWithError(fmt.Errorf("%w: %w", internal.ErrConnection, internal.ErrDTLSHandshake))
+		}
+	}()
+
+	// RTCPタイムアウト監視: rtcpTimeoutの間RTCPレポートが来なければ自動終了
 	go func() {
 		ticker := time.NewTicker(1 * time.Second)
 		defer ticker.Stop()
@@ -316,10 +559,13 @@ func run() error {
 			case <-stopChan:
 				return
 			case <-ticker.C:
-				last := atomic.LoadInt64(&lastRTCPReceived)
-				if time.Since(time.Unix(0, last)) > 5*time.Second {
-					fmt.Fprintln(os.Stderr, "RTCP timeout: no reports received for 5 seconds, stopping...")
-					closeStop()
+				since, received := health.SinceActivity()
+				if !received {
+					since = time.Since(rtcpWatchStart)
+				}
+				if since > rtcpTimeout {
+					fmt.Fprintf(os.Stderr, "RTCP timeout: no reports received for %v, stopping...\n", rtcpTimeout)
+					stopWithError(fmt.Errorf("%w: no RTCP reports received for %v", internal.ErrConnection, rtcpTimeout))
 					return
 				}
 			}
@@ -327,7 +573,8 @@ func run() error {
 	}()
 
 	// 統計情報を5秒ごとに出力するgoroutine
-	if internal.DebugMode {
+	// logfmt/json指定時はデバッグモードでなくても出力する
+	if internal.DebugMode || internal.StatsFormat != statsFormatHuman {
 		go func() {
 			ticker := time.NewTicker(5 * time.Second)
 			defer ticker.Stop()
@@ -385,29 +632,58 @@ func run() error {
 
 					// 全体経過時間
 					totalElapsed := now.Sub(statsStartTime).Seconds()
-
-					fmt.Fprintf(os.Stderr, "\n[STATS] ---- %.1fs elapsed ----\n", totalElapsed)
-					fmt.Fprintf(os.Stderr, "[STATS] Video: input=%d (%.1f fps), sent=%d (%.1f fps), dropped=%d, RTP packets=%d\n",
-						currentInputVideo, inputVideoFPS, currentSentVideo, sentVideoFPS, diffDroppedVideo, diffSentVideoRTP)
-					fmt.Fprintf(os.Stderr, "[STATS] Audio: input=%d (%.1f fps), sent=%d (%.1f fps), dropped=%d, RTP packets=%d\n",
-						currentInputAudio, inputAudioFPS, currentSentAudio, sentAudioFPS, diffDroppedAudio, diffSentAudioRTP)
-					fmt.Fprintf(os.Stderr, "[STATS] Queue: video=%d/%d, audio=%d/%d, dropped(total=%d, +%d)\n",
-						videoQueueDepth, videoQueueCap, audioQueueDepth, audioQueueCap, currentQueueDropped, diffQueueDropped)
-					fmt.Fprintf(os.Stderr, "[STATS] Last PTS(ms): video=%d, audio=%d\n", lastVideoPTS, lastAudioPTS)
+					forcedKeyframes, naturalKeyframes := keyframeCounts(videoLayers)
+
+					snapshot := statsSnapshot{
+						ElapsedSec: totalElapsed,
+						Video: trackStats{
+							Input: currentInputVideo, InputFPS: inputVideoFPS,
+							Sent: currentSentVideo, SentFPS: sentVideoFPS,
+							Dropped: diffDroppedVideo, RTPPackets: diffSentVideoRTP,
+							LastPTSMs: lastVideoPTS,
+						},
+						Audio: trackStats{
+							Input: currentInputAudio, InputFPS: inputAudioFPS,
+							Sent: currentSentAudio, SentFPS: sentAudioFPS,
+							Dropped: diffDroppedAudio, RTPPackets: diffSentAudioRTP,
+							LastPTSMs: lastAudioPTS,
+						},
+						VideoQueueDepth:    videoQueueDepth,
+						VideoQueueCap:      videoQueueCap,
+						AudioQueueDepth:    audioQueueDepth,
+						AudioQueueCap:      audioQueueCap,
+						QueueDroppedTotal:  currentQueueDropped,
+						QueueDroppedRecent: diffQueueDropped,
+						AudioCatchupFrames: atomic.LoadInt64(&s.audioCatchupFrames),
+						FPSLimitedFrames:   atomic.LoadInt64(&s.fpsLimitedFrames),
+						ForcedKeyframes:    forcedKeyframes,
+						NaturalKeyframes:   naturalKeyframes,
+						SpillEnabled:       spiller != nil,
+						RateLimitEnabled:   sendLimiter != nil,
+						EncodeErrors:       encodeErrors,
+						SendErrors:         sendErrors,
+					}
+					if ptsFilter != nil {
+						snapshot.PTSFilterEnabled = true
+						snapshot.PTSGlitches, snapshot.PTSDropped = ptsFilter.glitches()
+					}
+					if spiller != nil {
+						snapshot.SpilledFrames, snapshot.SpilledBytes, snapshot.SpillSkipped = spiller.Stats()
+					}
+					if sendLimiter != nil {
+						var waited time.Duration
+						snapshot.RateLimitedPackets, snapshot.RateLimitedBytes, waited = sendLimiter.Stats()
+						snapshot.RateLimitWaitMs = waited.Milliseconds()
+					}
 					if lastVideoSentAtNs > 0 && lastAudioSentAtNs > 0 {
-						sendGap := time.Duration(absInt64(lastVideoSentAtNs - lastAudioSentAtNs))
-						if sendGap <= ptsSyncWindow {
-							fmt.Fprintf(os.Stderr, "[STATS] PTS delta (video-audio, same timing<=%v): %dms (sendGap=%v)\n",
-								ptsSyncWindow, lastVideoPTS-lastAudioPTS, sendGap)
-						} else {
-							fmt.Fprintf(os.Stderr, "[STATS] PTS delta skipped: sendGap=%v (> %v)\n", sendGap, ptsSyncWindow)
+						snapshot.BothTracks = true
+						snapshot.SendGap = time.Duration(absInt64(lastVideoSentAtNs - lastAudioSentAtNs))
+						if snapshot.SendGap <= ptsSyncWindow {
+							ptsDelta := lastVideoPTS - lastAudioPTS
+							snapshot.PTSDeltaMs = &ptsDelta
 						}
-					} else {
-						fmt.Fprintln(os.Stderr, "[STATS] PTS delta skipped: waiting for both tracks")
-					}
-					if encodeErrors > 0 || sendErrors > 0 {
-						fmt.Fprintf(os.Stderr, "[STATS] Errors: encode=%d, send=%d\n", encodeErrors, sendErrors)
 					}
+					fmt.Fprint(os.Stderr, formatStats(snapshot, internal.StatsFormat))
 
 					// 最後の値を更新
 					lastInputVideo = currentInputVideo
@@ -432,7 +708,7 @@ func run() error {
 			videoPacer.Wait(firstFrame.TimestampMs)
 		}
 		// 最初のフレームは破棄チェックなし（基準時刻設定後なので必ず通る）
-		sentRTP, err := processVideoFrameWithStats(firstFrame, encoder, videoPacketizer, videoTrack)
+		sentRTP, err := processVideoLayers(firstFrame, videoLayers, pixelFormat)
 		if err != nil {
 			internal.DebugLog("Error processing video frame: %v\n", err)
 			atomic.AddInt64(&s.encodeErrors, 1)
@@ -446,12 +722,12 @@ func run() error {
 	// 3並列処理を開始: 入力取り込み/振り分け + 映像ワーカー + 音声ワーカー
 	videoWorkerErr := make(chan error, 1)
 	audioWorkerErr := make(chan error, 1)
-	go ingestFrames(mkvReader, videoFrameQueue, audioFrameQueue, frameReadErr, &s)
+	go ingestFrames(source, videoFrameQueue, audioFrameQueue, frameReadErr, &s, fpsLimiter, ptsFilter, spiller)
 	go func() {
-		videoWorkerErr <- processVideoFrames(videoFrameQueue, stopChan, &s, encoder, videoPacketizer, videoTrack, videoPacer, dropThreshold)
+		videoWorkerErr <- processVideoFrames(videoFrameQueue, stopChan, &s, videoLayers, pixelFormat, videoPacer, dropThreshold)
 	}()
 	go func() {
-		audioWorkerErr <- processAudioFrames(audioFrameQueue, stopChan, &s, needsOpusEncode, opusEncoder, audioPacketizer, audioTrack, audioPacer, dropThreshold)
+		audioWorkerErr <- processAudioFrames(audioFrameQueue, stopChan, &s, needsOpusEncode, opusEncoder, audioPacketizer, sendLimiter.Wrap(audioTrack.WriteRTP), audioPacer, dropThreshold)
 	}()
 
 	readDone := false
@@ -459,27 +735,34 @@ func run() error {
 	audioDone := false
 	var inputErr error
 
+	// 入力終端では両ワーカーがキューを送り切るのを待ってから、BYE送信→WHIPリソースのDELETE（defer）の順に終了する
 	for {
 		if readDone && videoDone && audioDone {
 			if inputErr != nil && inputErr != io.EOF {
 				return fmt.Errorf("failed to read frame: %v", inputErr)
 			}
 			if inputErr == io.EOF {
-				fmt.Fprintf(os.Stderr, "End of input stream\n")
+				fmt.Fprintf(os.Stderr, "End of input stream, all queued frames sent\n")
 			}
 			printSentSummary(&s)
+			ptsFilter.printSummary()
+			sendGoodbye(peerConnection)
 			return nil
 		}
 
 		select {
 		case <-stopChan:
 			printSentSummary(&s)
-			return nil
+			ptsFilter.printSummary()
+			if stopErr == nil {
+				sendGoodbye(peerConnection)
+			}
+			return stopErr
 		case err := <-frameReadErr:
 			readDone = true
 			inputErr = err
 			if err != nil && err != io.EOF {
-				closeStop()
+				stopWithError(fmt.Errorf("failed to read frame: %w", err))
 			}
 		case err := <-videoWorkerErr:
 			videoDone = true
@@ -495,25 +778,61 @@ func run() error {
 	}
 }
 
-func ingestFrames(mkvReader *internal.MKVReader, videoQueue chan *internal.Frame, audioQueue chan *internal.Frame, frameReadErr chan<- error, s *stats) {
+// sendGoodbye は正常終了時にRTCP BYEを送り、サーバーに送信の終了を通知する
+func sendGoodbye(peerConnection *webrtc.PeerConnection) {
+	if err := internal.SendGoodbye(peerConnection, nil); err != nil {
+		fmt.Fprintf(os.Stderr, "cannot send RTCP BYE: %v\n", err)
+		return
+	}
+	internal.DebugLog("Sent RTCP BYE\n")
+}
+
+// newFrameSource は --input に応じた入力を作成する
+func newFrameSource() internal.FrameSource {
+	switch internal.Input {
+	case "testsrc":
+		fmt.Fprintf(os.Stderr, "Generating test pattern (%dx%d, %dfps, color bars + 440Hz tone)\n",
+			internal.TestSourceWidth, internal.TestSourceHeight, internal.TestSourceFPS)
+		return internal.NewTestPatternSource(internal.TestSourceWidth, internal.TestSourceHeight, internal.TestSourceFPS)
+	case "y4m":
+		// YUV4MPEG2はPTSを持たないため、--no-pacing でなければフレームレートに合わせて読み出す
+		fmt.Fprintln(os.Stderr, "Reading YUV4MPEG2 from stdin (video only)")
+		return internal.NewY4MReader(os.Stdin, !internal.NoPacing)
+	default:
+		fmt.Fprintln(os.Stderr, "Reading MKV from stdin (rawvideo + Opus)")
+		return internal.NewMKVReader(os.Stdin)
+	}
+}
+
+// fpsLimiterがnilでなければ、超過分の映像フレームはキューに入れる前に間引く（ペーシングや遅延破棄の対象にしない）
+// ptsFilterがnilでなければ、PTSが戻ったフレームを破棄するかPTSをずらしてからキューに入れる
+// spillerがnilでなければ、キューが満杯で破棄したフレームを書き出す
+func ingestFrames(source internal.FrameSource, videoQueue chan *internal.Frame, audioQueue chan *internal.Frame, frameReadErr chan<- error, s *stats, fpsLimiter *internal.FrameRateLimiter, ptsFilter *ptsMonotonic, spiller *internal.FrameSpiller) {
 	defer close(videoQueue)
 	defer close(audioQueue)
 	videoTrimCounter := 0
 	audioTrimCounter := 0
 
 	for {
-		frame, err := mkvReader.ReadFrame()
+		frame, err := source.ReadFrame()
 		if err != nil {
 			frameReadErr <- err
 			return
 		}
 
 		addInputFrameStats(s, frame)
+		if ptsFilter != nil && !ptsFilter.filter(frame) {
+			continue
+		}
 		switch frame.Type {
 		case internal.FrameTypeVideo:
-			enqueueFrame(videoQueue, frame, s, &videoTrimCounter)
+			if fpsLimiter != nil && !fpsLimiter.Allow(frame.TimestampMs) {
+				atomic.AddInt64(&s.fpsLimitedFrames, 1)
+				continue
+			}
+			enqueueFrame(videoQueue, frame, s, &videoTrimCounter, spiller)
 		case internal.FrameTypeAudio:
-			enqueueFrame(audioQueue, frame, s, &audioTrimCounter)
+			enqueueFrame(audioQueue, frame, s, &audioTrimCounter, spiller)
 		}
 	}
 }
@@ -522,13 +841,16 @@ func processVideoFrames(
 	videoQueue <-chan *internal.Frame,
 	stopChan <-chan struct{},
 	s *stats,
-	encoder *internal.VP8Encoder,
-	videoPacketizer *internal.VP8Packetizer,
-	videoTrack *webrtc.TrackLocalStaticRTP,
+	videoLayers []*videoLayer,
+	pixelFormat string,
 	videoPacer *internal.Pacer,
 	dropThreshold time.Duration,
 ) error {
 	lastQueueDropSeen := atomic.LoadInt64(&s.queueDroppedFrames)
+	waitKeyframe := false // passthrough時、フレームを破棄した後で次のキーフレームを待っている
+	passthrough := videoLayers[0].encoder == nil
+	// 取り込みはこのワーカーと同時に始まるため、開始前の破棄も見逃さないよう0から数える
+	var lastVideoQueueDrops int64
 
 	for {
 		select {
@@ -548,15 +870,43 @@ func processVideoFrames(
 				lastQueueDropSeen = currentQueueDropSeen
 			}
 
-			if videoPacer != nil && videoPacer.ShouldDrop(frame.TimestampMs, dropThreshold) {
+			// passthrough時に差分フレームを破棄すると後続フレームの参照が壊れるため、
+			// 破棄の理由（キュー溢れ、遅延、帯域超過）によらず次のキーフレームまで破棄を続ける
+			if passthrough {
+				if drops := atomic.LoadInt64(&s.videoQueueDrops); drops != lastVideoQueueDrops {
+					lastVideoQueueDrops = drops
+					waitKeyframe = true
+				}
+				if frame.IsKeyframe {
+					waitKeyframe = false
+				}
+			}
+
+			// passthrough時のキーフレームは遅れていても送る（破棄すると次のキーフレームまで復帰できない）
+			if videoPacer != nil && !(passthrough && frame.IsKeyframe) && videoPacer.ShouldDrop(frame.TimestampMs, dropThreshold) {
 				atomic.AddInt64(&s.droppedVideoFrames, 1)
+				if passthrough {
+					waitKeyframe = true
+				}
 				continue
 			}
+
+			// passthrough時はビットレートを変えられないため、帯域推定を超える分を間引く
+			if passthrough {
+				overBudget := videoPacer != nil && videoPacer.ExceedsBitrate(len(frame.Data))
+				if !frame.IsKeyframe && (waitKeyframe || overBudget) {
+					waitKeyframe = true
+					atomic.AddInt64(&s.droppedVideoFrames, 1)
+					internal.DebugLogPeriodic("cc.drop.video", time.Second, "Dropping video frame until the next keyframe: PTS=%dms\n", frame.TimestampMs)
+					continue
+				}
+			}
+
 			if videoPacer != nil {
 				videoPacer.Wait(frame.TimestampMs)
 			}
 
-			sentRTP, err := processVideoFrameWithStats(frame, encoder, videoPacketizer, videoTrack)
+			sentRTP, err := processVideoLayers(frame, videoLayers, pixelFormat)
 			if err != nil {
 				internal.DebugLog("Error processing video frame: %v\n", err)
 				atomic.AddInt64(&s.encodeErrors, 1)
@@ -576,11 +926,12 @@ func processAudioFrames(
 	needsOpusEncode bool,
 	opusEncoder *internal.OpusEncoder,
 	audioPacketizer *internal.OpusPacketizer,
-	audioTrack *webrtc.TrackLocalStaticRTP,
+	writeAudioRTP func(*rtp.Packet) error,
 	audioPacer *internal.Pacer,
 	dropThreshold time.Duration,
 ) error {
 	lastQueueDropSeen := atomic.LoadInt64(&s.queueDroppedFrames)
+	catchupThreshold := time.Duration(internal.AudioCatchupMs) * time.Millisecond
 
 	for {
 		select {
@@ -588,6 +939,23 @@ func processAudioFrames(
 			return nil
 		case frame, ok := <-audioQueue:
 			if !ok {
+				// 入力終端: エンコーダーに残った10ms未満のPCMも送信してから終了する
+				if needsOpusEncode && opusEncoder != nil {
+					encodedFrames, err := opusEncoder.Flush()
+					if err != nil {
+						internal.DebugLog("Error encoding audio: %v\n", err)
+						atomic.AddInt64(&s.encodeErrors, 1)
+						return nil
+					}
+					for _, packet := range audioPacketizer.PacketizeFrames(encodedFrames) {
+						if err := writeAudioRTP(packet); err != nil {
+							internal.DebugLog("Error writing audio RTP: %v\n", err)
+							atomic.AddInt64(&s.sendErrors, 1)
+						} else {
+							atomic.AddInt64(&s.sentAudioRTP, 1)
+						}
+					}
+				}
 				return nil
 			}
 
@@ -604,30 +972,40 @@ func processAudioFrames(
 				atomic.AddInt64(&s.droppedAudioFrames, 1)
 				continue
 			}
+			// エンコーダーが追いつけず遅れている場合は、閾値を超えた分のPCMをエンコード前に捨てる
+			var behindMs int64
+			if audioPacer != nil && needsOpusEncode && catchupThreshold > 0 {
+				if lateness := audioPacer.Lateness(frame.TimestampMs); lateness > catchupThreshold {
+					behindMs = (lateness - catchupThreshold).Milliseconds()
+				}
+			}
 			if audioPacer != nil {
 				audioPacer.Wait(frame.TimestampMs)
 			}
 
 			if needsOpusEncode && opusEncoder != nil {
-				encodedFrames, err := opusEncoder.Encode(frame.Data, frame.TimestampMs, frame.ClusterTimeMs)
+				encodedFrames, skipped, err := opusEncoder.EncodeCatchUp(frame.Data, frame.TimestampMs, frame.ClusterTimeMs, behindMs)
 				if err != nil {
 					internal.DebugLog("Error encoding audio: %v\n", err)
 					atomic.AddInt64(&s.encodeErrors, 1)
 					continue
 				}
+				atomic.AddInt64(&s.audioCatchupFrames, int64(skipped))
 				var lastSentAudioPTS int64
 				audioSent := false
+				// 空のフレームはパケット化されないため、送信したパケットのPTSはフレームごとに取る
 				for _, encoded := range encodedFrames {
-					packet := audioPacketizer.Packetize(encoded.Data, encoded.TimestampMs)
-					if packet != nil {
-						if err := audioTrack.WriteRTP(packet); err != nil {
-							internal.DebugLog("Error writing audio RTP: %v\n", err)
-							atomic.AddInt64(&s.sendErrors, 1)
-						} else {
-							atomic.AddInt64(&s.sentAudioRTP, 1)
-							lastSentAudioPTS = encoded.TimestampMs
-							audioSent = true
-						}
+					packet := audioPacketizer.PacketizeFrame(encoded)
+					if packet == nil {
+						continue
+					}
+					if err := writeAudioRTP(packet); err != nil {
+						internal.DebugLog("Error writing audio RTP: %v\n", err)
+						atomic.AddInt64(&s.sendErrors, 1)
+					} else {
+						atomic.AddInt64(&s.sentAudioRTP, 1)
+						lastSentAudioPTS = encoded.TimestampMs
+						audioSent = true
 					}
 				}
 				if audioSent {
@@ -637,9 +1015,10 @@ func processAudioFrames(
 				continue
 			}
 
-			packet := audioPacketizer.Packetize(frame.Data, frame.TimestampMs)
-			if packet != nil {
-				if err := audioTrack.WriteRTP(packet); err != nil {
+			// パススルー時はTOCからフレーム長を求めてtimestampを進める
+			packets := audioPacketizer.PacketizeFrames([]internal.EncodedAudioFrame{{Data: frame.Data, TimestampMs: frame.TimestampMs}})
+			for _, packet := range packets {
+				if err := writeAudioRTP(packet); err != nil {
 					internal.DebugLog("Error writing audio RTP: %v\n", err)
 					atomic.AddInt64(&s.sendErrors, 1)
 				} else {
@@ -658,26 +1037,30 @@ func printSentSummary(s *stats) {
 		atomic.LoadInt64(&s.sentAudioFrames))
 }
 
-func enqueueFrame(frameQueue chan *internal.Frame, frame *internal.Frame, s *stats, trimCounter *int) {
+func enqueueFrame(frameQueue chan *internal.Frame, frame *internal.Frame, s *stats, trimCounter *int, spiller *internal.FrameSpiller) {
 	for {
 		select {
 		case frameQueue <- frame:
 			break
 		default:
-			dropped := dropOldestFrame(frameQueue)
+			dropped := dropOldestFrame(frameQueue, frame.Type, s)
 			if dropped != nil {
 				recordQueueDrop(s, dropped, "queue-full", len(frameQueue), cap(frameQueue))
+				// 遅延を詰めるための破棄（latency-trim）は送信が追いついているため書き出さない
+				if spiller != nil {
+					spiller.Spill(dropped)
+				}
 			}
 			continue
 		}
 		break
 	}
 
-	// 入出力FPSが同程度で滞留する場合、目標超過時に段階的に先頭を捨てて低遅延へ近づける
-	if len(frameQueue) > frameQueueLowLatencyTarget {
+	// 入出力FPSが同程度で滞留する場合、目標（容量の1/3）超過時に段階的に先頭を捨てて低遅延へ近づける
+	if len(frameQueue) > max(cap(frameQueue)/3, 1) {
 		(*trimCounter)++
 		if *trimCounter >= frameQueueTrimInterval {
-			dropped := dropOldestFrame(frameQueue)
+			dropped := dropOldestFrame(frameQueue, frame.Type, s)
 			if dropped != nil {
 				recordQueueDrop(s, dropped, "latency-trim", len(frameQueue), cap(frameQueue))
 			}
@@ -689,7 +1072,12 @@ func enqueueFrame(frameQueue chan *internal.Frame, frame *internal.Frame, s *sta
 	*trimCounter = 0
 }
 
-func dropOldestFrame(frameQueue chan *internal.Frame) *internal.Frame {
+// dropOldestFrame はキューの先頭のフレームを取り出して返す（空ならnil）
+// 映像キューでは取り出す前にvideoQueueDropsを数え、送信側が破棄の直後のフレームを受け取った時点で必ず破棄に気付けるようにする
+func dropOldestFrame(frameQueue chan *internal.Frame, frameType internal.FrameType, s *stats) *internal.Frame {
+	if frameType == internal.FrameTypeVideo {
+		atomic.AddInt64(&s.videoQueueDrops, 1)
+	}
 	select {
 	case frame := <-frameQueue:
 		return frame
@@ -750,31 +1138,160 @@ func frameTypeString(frameType internal.FrameType) string {
 	}
 }
 
-func processVideoFrameWithStats(frame *internal.Frame, encoder *internal.VP8Encoder, packetizer *internal.VP8Packetizer, track *webrtc.TrackLocalStaticRTP) (int, error) {
-	// Encode RGBA to VP8
-	encoded, isKeyframe, err := encoder.Encode(frame.Data)
-	if err != nil {
-		return 0, fmt.Errorf("encode error: %v", err)
+// processVideoLayers はフレームを全レイヤーで送信する
+// 上位レイヤーから順に縮小した画像を次のレイヤーに渡すため、縮小は1段ずつで済む
+// 一部のレイヤーで失敗しても残りのレイヤーは送信し、最初のエラーを返す
+func processVideoLayers(frame *internal.Frame, layers []*videoLayer, pixelFormat string) (int, error) {
+	total := 0
+	var firstErr error
+	current := frame
+	width, height := layers[len(layers)-1].width, layers[len(layers)-1].height
+	for i := len(layers) - 1; i >= 0; i-- {
+		layer := layers[i]
+		for width > layer.width {
+			data, w, h := internal.HalveFrame(current.Data, pixelFormat, width, height)
+			scaled := *current
+			scaled.Data = data
+			current = &scaled
+			width, height = w, h
+		}
+		sent, err := processVideoFrameWithStats(current, layer.encoder, layer.packetizer, layer.writeRTP)
+		total += sent
+		if err != nil && firstErr == nil {
+			firstErr = err
+			if layer.rid != "" {
+				firstErr = fmt.Errorf("layer %s: %v", layer.rid, err)
+			}
+		}
+	}
+	return total, firstErr
+}
+
+// processVideoFrameWithStats はフレームをエンコードして送信する
+// encoderがnilの場合はエンコード済みフレームとしてそのまま送信する
+func processVideoFrameWithStats(frame *internal.Frame, encoder *internal.VP8Encoder, packetizer internal.VideoPacketizer, writeRTP func(*rtp.Packet) error) (int, error) {
+	encoded := frame.Data
+	isKeyframe := frame.IsKeyframe
+	if encoder != nil {
+		// パーティション境界を保持できる場合はパーティション単位で送信する
+		if partitionedPacketizer, ok := packetizer.(internal.PartitionedVideoPacketizer); ok && internal.VP8Partitions {
+			partitions, isKeyframe, err := encoder.EncodePartitions(frame.Data)
+			if err != nil {
+				return 0, fmt.Errorf("encode error: %v", err)
+			}
+			if len(partitions) == 0 {
+				return 0, nil
+			}
+			sentCount, err := partitionedPacketizer.PacketizePartitionsAndWrite(partitions, frame.TimestampMs, isKeyframe, writeRTP)
+			if err != nil {
+				return sentCount, fmt.Errorf("write RTP error: %v", err)
+			}
+			return sentCount, nil
+		}
+
+		// Encode RGBA to VP8
+		var err error
+		encoded, isKeyframe, err = encoder.Encode(frame.Data)
+		if err != nil {
+			return 0, fmt.Errorf("encode error: %v", err)
+		}
 	}
 	if encoded == nil {
 		return 0, nil
 	}
 
 	// Packetize and send without intermediate packet slice allocation.
-	sentCount, err := packetizer.PacketizeAndWrite(encoded, frame.TimestampMs, isKeyframe, track.WriteRTP)
+	sentCount, err := packetizer.PacketizeAndWrite(encoded, frame.TimestampMs, isKeyframe, writeRTP)
 	if err != nil {
 		return sentCount, fmt.Errorf("write RTP error: %v", err)
 	}
 	return sentCount, nil
 }
 
-func readRTCP(trackType string, sender *webrtc.RTPSender, lastReceived *int64) {
-	for {
+// applyBandwidthEstimate は帯域推定値から音声分を差し引いた帯域を映像の目標ビットレートとする
+// 上限は --video-bitrate-kbps
+func applyBandwidthEstimate(bps int, encoder *internal.VP8Encoder, videoPacer *internal.Pacer) {
+	videoKbps := (bps - audioBitrateReserveBps) / 1000
+	if videoKbps > internal.VideoBitrateKbps {
+		videoKbps = internal.VideoBitrateKbps
+	}
+	if videoKbps < minVideoBitrateKbps {
+		videoKbps = minVideoBitrateKbps
+	}
+	internal.DebugLog("Bandwidth estimate: %dkbps -> video target %dkbps\n", bps/1000, videoKbps)
+
+	if encoder != nil {
+		encoder.SetBitrate(videoKbps)
+	} else if videoPacer != nil {
+		videoPacer.SetTargetBitrate(videoKbps * 1000)
+	}
+}
+
+// resolveSSRCs は映像/音声のSSRCを決定する
+// 0（未指定）の場合はランダムに生成し、両トラックで重複しないことを保証する
+func resolveSSRCs(video, audio uint32) (uint32, uint32, error) {
+	if video != 0 && video == audio {
+		return 0, 0, fmt.Errorf("--ssrc-video and --ssrc-audio must differ (both %d)", video)
+	}
+	for video == 0 || video == audio {
+		video = rand.Uint32()
+	}
+	for audio == 0 || audio == video {
+		audio = rand.Uint32()
+	}
+	return video, audio, nil
+}
+
+// addSendTrack は指定SSRCで送信専用トランシーバーを追加する
+func addSendTrack(peerConnection *webrtc.PeerConnection, track webrtc.TrackLocal, ssrc uint32) (*webrtc.RTPSender, error) {
+	transceiver, err := peerConnection.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{
+		Direction:     webrtc.RTPTransceiverDirectionSendonly,
+		SendEncodings: []webrtc.RTPEncodingParameters{{RTPCodingParameters: webrtc.RTPCodingParameters{SSRC: webrtc.SSRC(ssrc)}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return transceiver.Sender(), nil
+}
+
+// validateNegotiatedVideoCodec はネゴシエーションされた映像コーデックが送信コーデックと一致するか確認する
+func validateNegotiatedVideoCodec(sender *webrtc.RTPSender, mimeType string) error {
+	codecs := sender.GetParameters().Codecs
+	if len(codecs) == 0 {
+		return fmt.Errorf("no video codec negotiated with WHIP server")
+	}
+	if !strings.EqualFold(codecs[0].MimeType, mimeType) {
+		return fmt.Errorf("negotiated video codec %s does not match input codec %s", codecs[0].MimeType, mimeType)
+	}
+	return nil
+}
+
+// senderRTCPReader はsenderのRTCPを読む関数を返す
+func senderRTCPReader(sender *webrtc.RTPSender) func() ([]rtcp.Packet, error) {
+	return func() ([]rtcp.Packet, error) {
 		packets, _, err := sender.ReadRTCP()
+		return packets, err
+	}
+}
+
+// readRTCP はRTCPを読み続け、受信時刻を記録する（デバッグ時は内容を表示する）
+// PLI/FIRはkeyframesでキーフレームを強制する（音声とpassthroughではnil）
+// simulcast時はRIDごとに呼び出す
+func readRTCP(trackType string, read func() ([]rtcp.Packet, error), health *internal.HealthState, keyframes *keyframeRequester) {
+	for {
+		packets, err := read()
 		if err != nil {
 			return
 		}
-		atomic.StoreInt64(lastReceived, time.Now().UnixNano())
+		health.MarkActivity()
+		for _, pkt := range packets {
+			switch pkt.(type) {
+			case *rtcp.PictureLossIndication:
+				keyframes.request(trackType + " PLI")
+			case *rtcp.FullIntraRequest:
+				keyframes.request(trackType + " FIR")
+			}
+		}
 		if !internal.DebugMode {
 			continue
 		}
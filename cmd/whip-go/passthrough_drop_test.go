@@ -0,0 +1,111 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+	"github.com/pion/rtp"
+)
+
+// passthroughDropClock は手動で進める時計（Sleepで待つ代わりに進める）
+type passthroughDropClock struct {
+	now time.Time
+}
+
+func (c *passthroughDropClock) Now() time.Time {
+	return c.now
+}
+
+func (c *passthroughDropClock) Sleep(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// passthroughDropFrame はPTSとキーフレームフラグを持つ圧縮済みの映像フレーム
+func passthroughDropFrame(timestampMs int64, keyframe bool) *internal.Frame {
+	return &internal.Frame{Type: internal.FrameTypeVideo, Data: []byte{0x00, 0x01, 0x02}, TimestampMs: timestampMs, IsKeyframe: keyframe}
+}
+
+// passthroughDropRun はpassthroughのレイヤーでキューのフレームをすべて送り、送信したフレームのPTSを返す
+// onSend は各フレームの最初のパケットを送る時に呼ばれる
+func passthroughDropRun(t *testing.T, queue chan *internal.Frame, s *stats, pacer *internal.Pacer, dropThreshold time.Duration, onSend func(timestampMs int64)) []int64 {
+	t.Helper()
+	var sent []int64
+	layer := &videoLayer{
+		packetizer: internal.NewVP8Packetizer(1),
+		writeRTP: func(packet *rtp.Packet) error {
+			timestampMs := int64(packet.Timestamp) * 1000 / internal.VP8ClockRate
+			if len(sent) == 0 || sent[len(sent)-1] != timestampMs {
+				sent = append(sent, timestampMs)
+				if onSend != nil {
+					onSend(timestampMs)
+				}
+			}
+			return nil
+		},
+	}
+	close(queue)
+	if err := processVideoFrames(queue, make(chan struct{}), s, []*videoLayer{layer}, "", pacer, dropThreshold); err != nil {
+		t.Fatal(err)
+	}
+	return sent
+}
+
+// TestPassthroughLateDropWaitsForKeyframe はpassthroughで遅れた差分フレームを破棄した後、
+// 次のキーフレームまでの差分フレームを送らないことを検証する
+func TestPassthroughLateDropWaitsForKeyframe(t *testing.T) {
+	clock := &passthroughDropClock{now: time.Unix(0, 0)}
+	pacer := internal.NewPacer(time.Second)
+	pacer.SetClock(clock)
+
+	// K(0) を送った直後に500ms止まり、D(33) だけが遅れる（D(600) は間に合う）
+	queue := make(chan *internal.Frame, 8)
+	for _, frame := range []*internal.Frame{
+		passthroughDropFrame(0, true),
+		passthroughDropFrame(33, false),
+		passthroughDropFrame(600, false),
+		passthroughDropFrame(700, true),
+		passthroughDropFrame(733, false),
+	} {
+		queue <- frame
+	}
+	s := &stats{}
+	sent := passthroughDropRun(t, queue, s, pacer, 100*time.Millisecond, func(timestampMs int64) {
+		if timestampMs == 0 {
+			clock.Sleep(500 * time.Millisecond)
+		}
+	})
+	if want := []int64{0, 700, 733}; !reflect.DeepEqual(sent, want) {
+		t.Fatalf("sent frames %v, want %v (nothing between the late drop and the next keyframe)", sent, want)
+	}
+	if s.droppedVideoFrames != 2 {
+		t.Fatalf("%d video frames dropped, want 2", s.droppedVideoFrames)
+	}
+}
+
+// TestPassthroughQueueDropWaitsForKeyframe はpassthroughでキューから差分フレームの参照先を破棄した後、
+// 残った差分フレームを送らず次のキーフレームから送ることを検証する
+func TestPassthroughQueueDropWaitsForKeyframe(t *testing.T) {
+	queue := make(chan *internal.Frame, 6)
+	s := &stats{}
+	trimCounter := 0
+	// 容量6のキューに滞留が続くと、遅延を詰めるためにK(0) が破棄され、それを参照する差分フレームが残る
+	for _, frame := range []*internal.Frame{
+		passthroughDropFrame(0, true),
+		passthroughDropFrame(33, false),
+		passthroughDropFrame(66, false),
+		passthroughDropFrame(100, false),
+		passthroughDropFrame(133, false),
+		passthroughDropFrame(166, true),
+	} {
+		enqueueFrame(queue, frame, s, &trimCounter, nil)
+	}
+	if s.queueDroppedFrames != 1 {
+		t.Fatalf("%d frames dropped from the queue, want 1", s.queueDroppedFrames)
+	}
+	sent := passthroughDropRun(t, queue, s, nil, 0, nil)
+	if want := []int64{166}; !reflect.DeepEqual(sent, want) {
+		t.Fatalf("sent frames %v, want %v (delta frame after the queue drop was sent)", sent, want)
+	}
+}
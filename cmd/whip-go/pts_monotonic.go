@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+)
+
+// ptsMonotonic は --pts-monotonic の映像・音声ごとのPTSFilter
+// 入力のPTSが戻ると、ペーサーの基準時刻やRTP timestampの計算が大きな負の差分で狂うため、キューに入れる前に補正する
+// rebaseのずれは映像と音声で共有し、先に戻ったトラックで決めたずれを両方に足して同期を保つ
+type ptsMonotonic struct {
+	video        *internal.PTSFilter
+	audio        *internal.PTSFilter
+	passthrough  bool // 差分フレームを破棄すると参照が壊れるため、映像を破棄した後は次のキーフレームまで破棄する
+	waitKeyframe bool
+	waitDropped  atomic.Int64 // キーフレームを待つ間に破棄した映像フレーム数
+}
+
+// newPTSMonotonic は --pts-monotonic がoffの場合はnilを返す
+func newPTSMonotonic(mode string, toleranceMs int, passthrough bool) *ptsMonotonic {
+	if mode == internal.PTSMonotonicOff {
+		return nil
+	}
+	filters := internal.NewLinkedPTSFilters(mode, int64(toleranceMs), 2)
+	return &ptsMonotonic{
+		video:       filters[0],
+		audio:       filters[1],
+		passthrough: passthrough,
+	}
+}
+
+// filter はframeのPTSを補正し、フレームを破棄する場合はfalseを返す
+func (p *ptsMonotonic) filter(frame *internal.Frame) bool {
+	filter, kind := p.video, "video"
+	if frame.Type == internal.FrameTypeAudio {
+		filter, kind = p.audio, "audio"
+	}
+	before, _ := filter.Glitches()
+	pts, ok := filter.Filter(frame.TimestampMs)
+	if after, _ := filter.Glitches(); after != before {
+		internal.DebugLog("PTS went backward: %s frame at %dms (--pts-monotonic %s)\n", kind, frame.TimestampMs, internal.PTSMonotonic)
+	}
+	if frame.Type == internal.FrameTypeAudio {
+		frame.TimestampMs = pts
+		return ok
+	}
+
+	if !ok {
+		p.waitKeyframe = p.passthrough
+		return false
+	}
+	if p.waitKeyframe {
+		if !frame.IsKeyframe {
+			p.waitDropped.Add(1)
+			return false
+		}
+		p.waitKeyframe = false
+	}
+	frame.TimestampMs = pts
+	return true
+}
+
+// glitches は映像・音声でPTSが戻った回数と、破棄したフレーム数の合計を返す
+func (p *ptsMonotonic) glitches() (int64, int64) {
+	videoGlitches, videoDropped := p.video.Glitches()
+	audioGlitches, audioDropped := p.audio.Glitches()
+	return videoGlitches + audioGlitches, videoDropped + audioDropped + p.waitDropped.Load()
+}
+
+// printSummary は補正したPTSの乱れがあれば終了時に表示する
+func (p *ptsMonotonic) printSummary() {
+	if p == nil {
+		return
+	}
+	glitches, dropped := p.glitches()
+	if glitches > 0 {
+		fmt.Fprintf(os.Stderr, "PTS went backward %d time(s) in the input (--pts-monotonic %s, %d frame(s) dropped)\n", glitches, internal.PTSMonotonic, dropped)
+	}
+}
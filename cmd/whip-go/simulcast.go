@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Azunyan1111/go-webrtc-whep-client/internal"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// simulcastの下位レイヤーとして許容する最小解像度
+const minSimulcastDimension = 32
+
+// videoLayer は映像送信の1レイヤー
+// simulcastでない場合はridが空のレイヤーが1つだけとなる
+type videoLayer struct {
+	rid         string
+	scaleSteps  int // 入力解像度から縦横1/2に縮小する回数
+	width       int
+	height      int
+	bitrateKbps int
+	encoder     *internal.VP8Encoder // passthrough時はnil
+	track       *webrtc.TrackLocalStaticRTP
+	packetizer  internal.VideoPacketizer
+	writeRTP    func(*rtp.Packet) error
+}
+
+// newVideoLayers は送信レイヤーを作成する
+// --simulcast 指定時はRIDの順（低→高）に並べ、最上位が入力解像度、
+// 1段下がるごとに解像度を1/2、ビットレートを1/4にしたエンコーダーを持つ
+func newVideoLayers(width, height int, pixelFormat string, passthrough bool) ([]*videoLayer, error) {
+	if len(internal.SimulcastRIDs) == 0 {
+		layer := &videoLayer{width: width, height: height, bitrateKbps: internal.VideoBitrateKbps}
+		if !passthrough {
+			encoder, err := internal.NewVP8Encoder(width, height, pixelFormat, internal.VideoBitrateKbps)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create VP8 encoder: %v", err)
+			}
+			layer.encoder = encoder
+		}
+		return []*videoLayer{layer}, nil
+	}
+
+	if passthrough {
+		return nil, fmt.Errorf("--simulcast cannot be combined with --no-reencode passthrough")
+	}
+
+	layers := make([]*videoLayer, 0, len(internal.SimulcastRIDs))
+	for i, rid := range internal.SimulcastRIDs {
+		steps := len(internal.SimulcastRIDs) - 1 - i
+		layerWidth, layerHeight := width, height
+		for j := 0; j < steps; j++ {
+			layerWidth = (layerWidth / 2) &^ 1
+			layerHeight = (layerHeight / 2) &^ 1
+		}
+		if layerWidth < minSimulcastDimension || layerHeight < minSimulcastDimension {
+			closeVideoLayers(layers)
+			return nil, fmt.Errorf("simulcast layer %q would be %dx%d (input %dx%d is too small)", rid, layerWidth, layerHeight, width, height)
+		}
+		bitrateKbps := max(internal.VideoBitrateKbps>>(2*steps), minVideoBitrateKbps)
+
+		encoder, err := internal.NewVP8Encoder(layerWidth, layerHeight, pixelFormat, bitrateKbps)
+		if err != nil {
+			closeVideoLayers(layers)
+			return nil, fmt.Errorf("failed to create VP8 encoder for simulcast layer %q: %v", rid, err)
+		}
+		layers = append(layers, &videoLayer{
+			rid:         rid,
+			scaleSteps:  steps,
+			width:       layerWidth,
+			height:      layerHeight,
+			bitrateKbps: bitrateKbps,
+			encoder:     encoder,
+		})
+		fmt.Fprintf(os.Stderr, "Simulcast layer %s: %dx%d, %dkbps\n", rid, layerWidth, layerHeight, bitrateKbps)
+	}
+	return layers, nil
+}
+
+// closeVideoLayers はレイヤーのエンコーダーを解放する
+func closeVideoLayers(layers []*videoLayer) {
+	for _, layer := range layers {
+		if layer.encoder != nil {
+			layer.encoder.Close()
+		}
+	}
+}
+
+// totalBitrateKbps は全レイヤーの目標ビットレートの合計
+func totalBitrateKbps(layers []*videoLayer) int {
+	total := 0
+	for _, layer := range layers {
+		total += layer.bitrateKbps
+	}
+	return total
+}
+
+// keyframeCounts は全レイヤーのエンコーダーが強制したキーフレーム数と自ら判断したキーフレーム数の合計を返す
+// passthrough時は0
+func keyframeCounts(layers []*videoLayer) (forced, natural int64) {
+	for _, layer := range layers {
+		if layer.encoder == nil {
+			continue
+		}
+		f, n := layer.encoder.KeyframeCounts()
+		forced += f
+		natural += n
+	}
+	return forced, natural
+}
+
+// addSimulcastTrack はレイヤーのトラックを1つの送信専用トランシーバーにまとめて追加する
+// SSRCはpionがエンコーディングごとに割り当てるため指定できない
+func addSimulcastTrack(peerConnection *webrtc.PeerConnection, layers []*videoLayer) (*webrtc.RTPTransceiver, error) {
+	transceiver, err := peerConnection.AddTransceiverFromTrack(layers[0].track, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionSendonly,
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, layer := range layers[1:] {
+		if err := transceiver.Sender().AddEncoding(layer.track); err != nil {
+			return nil, fmt.Errorf("failed to add simulcast encoding %q: %v", layer.rid, err)
+		}
+	}
+	return transceiver, nil
+}
+
+// bindSimulcastLayers はネゴシエーション後にRIDごとのSSRCでパケタイザーを作成し、
+// MID/RIDヘッダー拡張を付与する書き込み関数を設定する
+// TrackLocalStaticRTPはヘッダー拡張を付与しないため、受信側がRIDでストリームを識別できるよう自前で付ける
+func bindSimulcastLayers(transceiver *webrtc.RTPTransceiver, layers []*videoLayer, newPacketizer func(ssrc uint32) internal.VideoPacketizer) error {
+	params := transceiver.Sender().GetParameters()
+	var midID, ridID uint8
+	for _, ext := range params.HeaderExtensions {
+		switch ext.URI {
+		case sdp.SDESMidURI:
+			midID = uint8(ext.ID)
+		case sdp.SDESRTPStreamIDURI:
+			ridID = uint8(ext.ID)
+		}
+	}
+	if midID == 0 || ridID == 0 {
+		return fmt.Errorf("WHIP server did not negotiate MID/RID header extensions required for simulcast")
+	}
+	mid := []byte(transceiver.Mid())
+
+	ssrcs := make(map[string]uint32, len(params.Encodings))
+	for _, encoding := range params.Encodings {
+		ssrcs[encoding.RID] = uint32(encoding.SSRC)
+	}
+	for _, layer := range layers {
+		ssrc, ok := ssrcs[layer.rid]
+		if !ok {
+			return fmt.Errorf("no SSRC assigned to simulcast layer %q", layer.rid)
+		}
+		internal.DebugLog("Simulcast layer %s: SSRC=%d\n", layer.rid, ssrc)
+		layer.packetizer = newPacketizer(ssrc)
+
+		track := layer.track
+		rid := []byte(layer.rid)
+		layer.writeRTP = func(packet *rtp.Packet) error {
+			if err := packet.Header.SetExtension(midID, mid); err != nil {
+				return err
+			}
+			if err := packet.Header.SetExtension(ridID, rid); err != nil {
+				return err
+			}
+			return track.WriteRTP(packet)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	statsFormatHuman  = "human"
+	statsFormatLogfmt = "logfmt"
+	statsFormatJSON   = "json"
+)
+
+// trackStats は1トラック分の統計（dropped/RTPパケット数は直近区間の値）
+type trackStats struct {
+	Input      int64   `json:"input"`
+	InputFPS   float64 `json:"input_fps"`
+	Sent       int64   `json:"sent"`
+	SentFPS    float64 `json:"sent_fps"`
+	Dropped    int64   `json:"dropped"`
+	RTPPackets int64   `json:"rtp_packets"`
+	LastPTSMs  int64   `json:"last_pts_ms"`
+}
+
+// statsSnapshot は統計出力1回分の値
+type statsSnapshot struct {
+	ElapsedSec         float64    `json:"elapsed_s"`
+	Video              trackStats `json:"video"`
+	Audio              trackStats `json:"audio"`
+	VideoQueueDepth    int        `json:"video_queue"`
+	VideoQueueCap      int        `json:"video_queue_cap"`
+	AudioQueueDepth    int        `json:"audio_queue"`
+	AudioQueueCap      int        `json:"audio_queue_cap"`
+	QueueDroppedTotal  int64      `json:"queue_dropped_total"`
+	QueueDroppedRecent int64      `json:"queue_dropped"`
+	AudioCatchupFrames int64      `json:"audio_catchup_frames"` // エンコード前に破棄した10ms音声フレーム数（累計）
+	FPSLimitedFrames   int64      `json:"fps_limited_frames"`   // --max-fpsで間引いた映像フレーム数（累計）
+	ForcedKeyframes    int64      `json:"forced_keyframes"`     // --force-keyframe-interval等で強制したキーフレーム数（累計）
+	NaturalKeyframes   int64      `json:"natural_keyframes"`    // エンコーダーが自ら判断したキーフレーム数（累計）
+	SpilledFrames      int64      `json:"spilled_frames"`       // --spill-dirに書き出したフレーム数（累計）
+	SpilledBytes       int64      `json:"spilled_bytes"`        // --spill-dirに書き出したフレームのデータのバイト数（累計）
+	SpillSkipped       int64      `json:"spill_skipped"`        // 上限やエラーで書き出さなかったフレーム数（累計）
+	SpillEnabled       bool       `json:"-"`
+	RateLimitedPackets int64      `json:"rate_limited_packets"` // --max-send-bitrateで送信を待たせたRTPパケット数（累計）
+	RateLimitedBytes   int64      `json:"rate_limited_bytes"`   // --max-send-bitrateで送信を待たせたRTPパケットのバイト数（累計）
+	RateLimitWaitMs    int64      `json:"rate_limit_wait_ms"`   // --max-send-bitrateで待たせた時間の合計（累計）
+	RateLimitEnabled   bool       `json:"-"`
+	PTSGlitches        int64      `json:"pts_glitches"` // --pts-monotonicで補正したPTSの逆戻りの回数（累計）
+	PTSDropped         int64      `json:"pts_dropped"`  // --pts-monotonicで破棄したフレーム数（累計）
+	PTSFilterEnabled   bool       `json:"-"`
+	// PTS差分はvideo/audioをほぼ同時に送信した時のみ有効（PTSDeltaMs != nil）
+	PTSDeltaMs   *int64        `json:"pts_delta_ms,omitempty"`
+	SendGap      time.Duration `json:"-"`
+	BothTracks   bool          `json:"-"`
+	EncodeErrors int64         `json:"encode_errors"`
+	SendErrors   int64         `json:"send_errors"`
+}
+
+// formatStats はsnapshotを指定形式の文字列にする
+// humanは従来の複数行形式、logfmt/jsonはログ収集向けの1行形式（末尾改行付き）
+func formatStats(snapshot statsSnapshot, format string) string {
+	switch format {
+	case statsFormatLogfmt:
+		return formatStatsLogfmt(snapshot)
+	case statsFormatJSON:
+		return formatStatsJSON(snapshot)
+	default:
+		return formatStatsHuman(snapshot)
+	}
+}
+
+func formatStatsHuman(s statsSnapshot) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "\n[STATS] ---- %.1fs elapsed ----\n", s.ElapsedSec)
+	fmt.Fprintf(&b, "[STATS] Video: input=%d (%.1f fps), sent=%d (%.1f fps), dropped=%d, RTP packets=%d\n",
+		s.Video.Input, s.Video.InputFPS, s.Video.Sent, s.Video.SentFPS, s.Video.Dropped, s.Video.RTPPackets)
+	fmt.Fprintf(&b, "[STATS] Audio: input=%d (%.1f fps), sent=%d (%.1f fps), dropped=%d, RTP packets=%d\n",
+		s.Audio.Input, s.Audio.InputFPS, s.Audio.Sent, s.Audio.SentFPS, s.Audio.Dropped, s.Audio.RTPPackets)
+	fmt.Fprintf(&b, "[STATS] Queue: video=%d/%d, audio=%d/%d, dropped(total=%d, +%d)\n",
+		s.VideoQueueDepth, s.VideoQueueCap, s.AudioQueueDepth, s.AudioQueueCap, s.QueueDroppedTotal, s.QueueDroppedRecent)
+	if s.AudioCatchupFrames > 0 {
+		fmt.Fprintf(&b, "[STATS] Audio catch-up: skipped=%d frames (%dms)\n", s.AudioCatchupFrames, s.AudioCatchupFrames*10)
+	}
+	if s.FPSLimitedFrames > 0 {
+		fmt.Fprintf(&b, "[STATS] Max fps: skipped=%d video frames\n", s.FPSLimitedFrames)
+	}
+	if s.ForcedKeyframes > 0 || s.NaturalKeyframes > 0 {
+		fmt.Fprintf(&b, "[STATS] Keyframes: forced=%d, natural=%d\n", s.ForcedKeyframes, s.NaturalKeyframes)
+	}
+	if s.SpillEnabled {
+		fmt.Fprintf(&b, "[STATS] Spill: frames=%d, bytes=%d, skipped=%d\n", s.SpilledFrames, s.SpilledBytes, s.SpillSkipped)
+	}
+	if s.RateLimitEnabled {
+		fmt.Fprintf(&b, "[STATS] Send rate limit: delayed=%d packets (%d bytes), waited=%dms\n", s.RateLimitedPackets, s.RateLimitedBytes, s.RateLimitWaitMs)
+	}
+	if s.PTSGlitches > 0 {
+		fmt.Fprintf(&b, "[STATS] PTS monotonic: backward jumps=%d, dropped=%d frames\n", s.PTSGlitches, s.PTSDropped)
+	}
+	fmt.Fprintf(&b, "[STATS] Last PTS(ms): video=%d, audio=%d\n", s.Video.LastPTSMs, s.Audio.LastPTSMs)
+	switch {
+	case s.PTSDeltaMs != nil:
+		fmt.Fprintf(&b, "[STATS] PTS delta (video-audio, same timing<=%v): %dms (sendGap=%v)\n",
+			ptsSyncWindow, *s.PTSDeltaMs, s.SendGap)
+	case s.BothTracks:
+		fmt.Fprintf(&b, "[STATS] PTS delta skipped: sendGap=%v (> %v)\n", s.SendGap, ptsSyncWindow)
+	default:
+		b.WriteString("[STATS] PTS delta skipped: waiting for both tracks\n")
+	}
+	if s.EncodeErrors > 0 || s.SendErrors > 0 {
+		fmt.Fprintf(&b, "[STATS] Errors: encode=%d, send=%d\n", s.EncodeErrors, s.SendErrors)
+	}
+	return b.String()
+}
+
+func formatStatsLogfmt(s statsSnapshot) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "stats elapsed_s=%.1f", s.ElapsedSec)
+	for _, track := range []struct {
+		name  string
+		stats trackStats
+	}{{"video", s.Video}, {"audio", s.Audio}} {
+		t := track.stats
+		fmt.Fprintf(&b, " %[1]s_input=%[2]d %[1]s_input_fps=%.1[3]f %[1]s_sent=%[4]d %[1]s_sent_fps=%.1[5]f %[1]s_dropped=%[6]d %[1]s_rtp_packets=%[7]d %[1]s_last_pts_ms=%[8]d",
+			track.name, t.Input, t.InputFPS, t.Sent, t.SentFPS, t.Dropped, t.RTPPackets, t.LastPTSMs)
+	}
+	fmt.Fprintf(&b, " video_queue=%d video_queue_cap=%d audio_queue=%d audio_queue_cap=%d queue_dropped_total=%d queue_dropped=%d audio_catchup_frames=%d fps_limited_frames=%d forced_keyframes=%d natural_keyframes=%d",
+		s.VideoQueueDepth, s.VideoQueueCap, s.AudioQueueDepth, s.AudioQueueCap, s.QueueDroppedTotal, s.QueueDroppedRecent, s.AudioCatchupFrames, s.FPSLimitedFrames, s.ForcedKeyframes, s.NaturalKeyframes)
+	if s.SpillEnabled {
+		fmt.Fprintf(&b, " spilled_frames=%d spilled_bytes=%d spill_skipped=%d", s.SpilledFrames, s.SpilledBytes, s.SpillSkipped)
+	}
+	if s.RateLimitEnabled {
+		fmt.Fprintf(&b, " rate_limited_packets=%d rate_limited_bytes=%d rate_limit_wait_ms=%d", s.RateLimitedPackets, s.RateLimitedBytes, s.RateLimitWaitMs)
+	}
+	if s.PTSFilterEnabled {
+		fmt.Fprintf(&b, " pts_glitches=%d pts_dropped=%d", s.PTSGlitches, s.PTSDropped)
+	}
+	if s.PTSDeltaMs != nil {
+		fmt.Fprintf(&b, " pts_delta_ms=%d", *s.PTSDeltaMs)
+	}
+	fmt.Fprintf(&b, " encode_errors=%d send_errors=%d\n", s.EncodeErrors, s.SendErrors)
+	return b.String()
+}
+
+func formatStatsJSON(s statsSnapshot) string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("{\"error\":%q}\n", err.Error())
+	}
+	return string(data) + "\n"
+}
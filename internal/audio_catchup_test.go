@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	audioCatchupSampleRate = 48000
+	audioCatchupChannels   = 2
+	chunkMs                = 20
+	chunkBytes             = audioCatchupSampleRate / 1000 * chunkMs * audioCatchupChannels * 2 // S16LE
+	warmupChunks           = 25                                                                 // 0.5秒はリアルタイムに供給
+	totalChunks            = 75
+	stallDuration          = 400 * time.Millisecond
+	catchupMs              = 60
+	// 出力フレームの遅れの許容値（閾値 + 入力チャンク1つ分）
+	latencyBound = (catchupMs + chunkMs) * time.Millisecond
+)
+
+// audioCatchupResult はバースト供給の結果
+type audioCatchupResult struct {
+	maxLateness time.Duration // 出力したフレームの最大遅延
+	skipped     int           // エンコード前に破棄したフレーム数
+	encoded     int
+	lastPTS     int64
+}
+
+// runBurst はwarmupChunks分をリアルタイムに供給した後stallDurationだけ停止し、
+// 溜まった分を一気に供給する。whip-goのprocessAudioFramesと同じ手順で
+// Pacerの遅れからbehindMsを求め、EncodeCatchUpに渡す
+// PacerはmanualClockで動かし、エンコードにかかる時間は0とみなす
+func runBurst(catchup time.Duration) (audioCatchupResult, error) {
+	encoder, err := NewOpusEncoder(audioCatchupSampleRate, audioCatchupChannels)
+	if err != nil {
+		return audioCatchupResult{}, err
+	}
+	defer encoder.Close()
+
+	clock := newManualClock(time.Unix(0, 0))
+	pacer := NewPacer(time.Second)
+	pacer.SetClock(clock)
+	pcm := make([]byte, chunkBytes)
+	var res audioCatchupResult
+	lastPTS := int64(-1)
+	for i := 0; i < totalChunks; i++ {
+		if i == warmupChunks {
+			clock.Advance(stallDuration)
+		}
+		for j := range pcm {
+			pcm[j] = byte(j*5 + i)
+		}
+		ts := int64(i * chunkMs)
+
+		var behindMs int64
+		if catchup > 0 {
+			if lateness := pacer.Lateness(ts); lateness > catchup {
+				behindMs = (lateness - catchup).Milliseconds()
+			}
+		}
+		pacer.Wait(ts)
+
+		frames, skipped, err := encoder.EncodeCatchUp(pcm, ts, 0, behindMs)
+		if err != nil {
+			return res, err
+		}
+		res.skipped += skipped
+		for _, frame := range frames {
+			if frame.TimestampMs <= lastPTS {
+				return res, fmt.Errorf("PTS not increasing: %dms after %dms", frame.TimestampMs, lastPTS)
+			}
+			lastPTS = frame.TimestampMs
+			res.maxLateness = max(res.maxLateness, pacer.Lateness(frame.TimestampMs))
+			res.encoded++
+		}
+	}
+	res.lastPTS = lastPTS
+	return res, nil
+}
+
+// TestAudioCatchupBurstWithoutCatchup は --audio-catchup-ms 0 では音声のバーストで遅延が溜まることを確かめる
+func TestAudioCatchupBurstWithoutCatchup(t *testing.T) {
+	baseline, err := runBurst(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("encoded=%d, max lateness=%v", baseline.encoded, baseline.maxLateness)
+	if baseline.maxLateness <= latencyBound {
+		t.Fatalf("burst did not build up latency (max %v <= %v)", baseline.maxLateness, latencyBound)
+	}
+}
+
+// TestAudioCatchupBurst は --audio-catchup-ms で古いフレームを読み飛ばし、遅延を上限内に保つことを検証する
+func TestAudioCatchupBurst(t *testing.T) {
+	res, err := runBurst(catchupMs * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Logf("encoded=%d, skipped=%d, max lateness=%v", res.encoded, res.skipped, res.maxLateness)
+	switch {
+	case res.maxLateness > latencyBound:
+		t.Fatalf("audio latency %v exceeds %v", res.maxLateness, latencyBound)
+	case res.skipped == 0:
+		t.Fatal("no frames were skipped")
+	case res.encoded+res.skipped != totalChunks*chunkMs/10:
+		t.Fatalf("encoded+skipped=%d, want %d", res.encoded+res.skipped, totalChunks*chunkMs/10)
+	case res.lastPTS != int64((totalChunks*chunkMs)-10):
+		t.Fatalf("last PTS %dms, want %dms", res.lastPTS, totalChunks*chunkMs-10)
+	}
+}
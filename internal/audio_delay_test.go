@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	audioDelayWidth     = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	audioDelayHeight    = 360
+	audioDelayAudioStep = 20 * time.Millisecond // Opusのフレーム長
+	audioDelayVideoStep = 40 * time.Millisecond // 25fps
+	audioDelayDuration  = time.Second
+)
+
+// track番号（DefaultTrackLayout）
+const (
+	audioDelayVideoTrack = 1
+	audioDelayAudioTrack = 2
+)
+
+// audioDelayEncodeFrames はVP8フレームをn枚エンコードする（最初のフレームがキーフレーム）
+func audioDelayEncodeFrames(n int) ([][]byte, []bool, error) {
+	encoder, err := NewVP8Encoder(audioDelayWidth, audioDelayHeight, "YUV420P", 500)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer encoder.Close()
+	yuv := bytes.Repeat([]byte{0x80}, audioDelayWidth*audioDelayHeight*3/2)
+	var frames [][]byte
+	var keyframes []bool
+	for i := 0; i < n; i++ {
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return nil, nil, err
+		}
+		frames = append(frames, encoded)
+		keyframes = append(keyframes, keyframe)
+	}
+	return frames, keyframes, nil
+}
+
+// record は --audio-delay-ms にdelayを指定し、同時に始まった映像と音声を書き込んだ出力のブロックを返す
+func record(delay time.Duration) ([]block, error) {
+	AudioDelayMs = int(delay.Milliseconds())
+	defer func() { AudioDelayMs = 0 }()
+
+	frames, keyframes, err := audioDelayEncodeFrames(int(audioDelayDuration / audioDelayVideoStep))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	clock := newManualClock(time.Unix(0, 0))
+	writer.SetClock(clock)
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	for t := time.Duration(0); t < audioDelayDuration; t += audioDelayAudioStep {
+		if t > 0 {
+			clock.Advance(audioDelayAudioStep)
+		}
+		if t%audioDelayVideoStep == 0 {
+			i := int(t / audioDelayVideoStep)
+			if err := writer.WriteVideoFrame(frames[i], uint32(t*90000/time.Second), keyframes[i]); err != nil {
+				return nil, fmt.Errorf("video frame %d: %v", i, err)
+			}
+		}
+		seq := int(t / audioDelayAudioStep)
+		if err := writer.WriteAudioFrame(opusPacket(seq), uint32(seq*960)); err != nil {
+			return nil, fmt.Errorf("audio frame %d: %v", seq, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return scanBlocks(out.Bytes())
+}
+
+// audioDelayCheck は映像のtimecodeが変わらず、音声のtimecodeがdelayだけずれ、負になる分は0に切り詰められることを検証する
+func audioDelayCheck(delay time.Duration) error {
+	blocks, err := record(delay)
+	if err != nil {
+		return err
+	}
+	videoFrames, audioFrames := 0, 0
+	for _, b := range blocks {
+		switch b.track {
+		case audioDelayVideoTrack:
+			if want := (time.Duration(videoFrames) * audioDelayVideoStep).Milliseconds(); b.timecode != want {
+				return fmt.Errorf("video frame %d at %dms, want %dms", videoFrames, b.timecode, want)
+			}
+			videoFrames++
+		case audioDelayAudioTrack:
+			seq := int(b.data[3])<<8 | int(b.data[4])
+			want := max((time.Duration(seq)*audioDelayAudioStep + delay).Milliseconds(), 0)
+			if b.timecode != want {
+				return fmt.Errorf("audio frame %d at %dms, want %dms with --audio-delay-ms %d", seq, b.timecode, want, delay.Milliseconds())
+			}
+			audioFrames++
+		default:
+			return fmt.Errorf("block on unexpected track %d", b.track)
+		}
+	}
+	if want := int(audioDelayDuration / audioDelayVideoStep); videoFrames != want {
+		return fmt.Errorf("%d video frames written, want %d", videoFrames, want)
+	}
+	if want := int(audioDelayDuration / audioDelayAudioStep); audioFrames != want {
+		return fmt.Errorf("%d audio frames written, want %d", audioFrames, want)
+	}
+	return nil
+}
+
+// TestAudioDelayNoDelay は指定が無い場合に音声と映像が同じtimecodeから並ぶことを検証する
+func TestAudioDelayNoDelay(t *testing.T) {
+	if err := audioDelayCheck(0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAudioDelay は正の値で音声が遅れ、インターリーブバッファで映像と並べ替えられることを検証する
+func TestAudioDelay(t *testing.T) {
+	if err := audioDelayCheck(150 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAudioDelayAdvance は負の値で音声が早まり、最初の60ms分の音声がtimecode 0に切り詰められることを検証する
+func TestAudioDelayAdvance(t *testing.T) {
+	if err := audioDelayCheck(-60 * time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAudioDelayBeyond はストリームより長く音声を早めた場合に、すべての音声がtimecode 0に切り詰められることを検証する
+// 映像より大きく前にずれた音声はインターリーブバッファの深さでは並べ替えきれないため、到着順に書き込む
+func TestAudioDelayBeyond(t *testing.T) {
+	saved := InterleaveWindowMs
+	InterleaveWindowMs = 0
+	defer func() { InterleaveWindowMs = saved }()
+	if err := audioDelayCheck(-2 * audioDelayDuration); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,69 @@
+package internal
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// ITU-R BS.775のダウンミックス係数（-3dB）
+const downmixCenter = 0.7071
+
+// downmixMatrices はWAVEチャンネル順（ffmpegのPCM出力と同じ）の入力をステレオにする係数
+// 各要素は入力チャンネルごとの[L, R]への寄与で、LFEは含めない
+var downmixMatrices = map[int][][2]float64{
+	// 3.0: FL FR FC
+	3: {{1, 0}, {0, 1}, {downmixCenter, downmixCenter}},
+	// quad: FL FR BL BR
+	4: {{1, 0}, {0, 1}, {downmixCenter, 0}, {0, downmixCenter}},
+	// 5.0: FL FR FC BL BR
+	5: {{1, 0}, {0, 1}, {downmixCenter, downmixCenter}, {downmixCenter, 0}, {0, downmixCenter}},
+	// 5.1: FL FR FC LFE BL BR
+	6: {{1, 0}, {0, 1}, {downmixCenter, downmixCenter}, {0, 0}, {downmixCenter, 0}, {0, downmixCenter}},
+	// 6.1: FL FR FC LFE BC SL SR（BCは左右に-6dBずつ）
+	7: {{1, 0}, {0, 1}, {downmixCenter, downmixCenter}, {0, 0}, {0.5, 0.5}, {downmixCenter, 0}, {0, downmixCenter}},
+	// 7.1: FL FR FC LFE BL BR SL SR
+	8: {{1, 0}, {0, 1}, {downmixCenter, downmixCenter}, {0, 0}, {downmixCenter, 0}, {0, downmixCenter}, {downmixCenter, 0}, {0, downmixCenter}},
+}
+
+// CanDownmixToStereo はchannelsチャンネルのPCMをステレオにダウンミックスできるか判定する
+func CanDownmixToStereo(channels int) bool {
+	_, ok := downmixMatrices[channels]
+	return ok
+}
+
+// DownmixToStereo はS16LEインターリーブのマルチチャンネルPCMをステレオにダウンミックスする
+// 係数の合計が1を超えるため、範囲外のサンプルはクリップする
+// 末尾の不完全なサンプルフレームは捨てる
+func DownmixToStereo(pcm []byte, channels int) ([]byte, error) {
+	matrix, ok := downmixMatrices[channels]
+	if !ok {
+		return nil, fmt.Errorf("no stereo downmix for %d channels", channels)
+	}
+
+	frameBytes := channels * 2
+	frames := len(pcm) / frameBytes
+	out := make([]byte, frames*4)
+	for i := 0; i < frames; i++ {
+		var left, right float64
+		for c, gain := range matrix {
+			sample := float64(int16(binary.LittleEndian.Uint16(pcm[i*frameBytes+c*2:])))
+			left += sample * gain[0]
+			right += sample * gain[1]
+		}
+		binary.LittleEndian.PutUint16(out[i*4:], uint16(clampInt16(left)))
+		binary.LittleEndian.PutUint16(out[i*4+2:], uint16(clampInt16(right)))
+	}
+	return out, nil
+}
+
+func clampInt16(v float64) int16 {
+	v = math.Round(v)
+	if v > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	if v < math.MinInt16 {
+		return math.MinInt16
+	}
+	return int16(v)
+}
@@ -0,0 +1,47 @@
+package internal
+
+import (
+	"github.com/pion/sdp/v3"
+)
+
+// AnswerHasVideo はanswerに、サーバーが映像を送信するm-lineがあるかを返す
+// ポートが0でなく、sendonlyまたはsendrecvで、送信するトラック（a=msid、または古い実装のa=ssrc）があるものを映像ありとする
+// JSEPでは送信するトラックの無いm-lineもsendonlyで返されることがあるため、方向だけでは判定しない
+// 解析できない場合は映像ありとみなし、従来どおり映像を待つ
+func AnswerHasVideo(answer string) bool {
+	return answerSends(answer, "video")
+}
+
+// AnswerHasAudio はanswerに、サーバーが音声を送信するm-lineがあるかをAnswerHasVideoと同じ基準で返す
+// 音声のm-lineを拒否（ポート0）した場合や省略した場合にfalseになる
+// 解析できない場合は音声ありとみなし、従来どおり音声トラックを書き込む
+func AnswerHasAudio(answer string) bool {
+	return answerSends(answer, "audio")
+}
+
+// answerSends はanswerに、サーバーがkind（video, audio）を送信するm-lineがあるかを返す
+func answerSends(answer, kind string) bool {
+	desc := &sdp.SessionDescription{}
+	if err := desc.UnmarshalString(answer); err != nil {
+		return true
+	}
+	for _, md := range desc.MediaDescriptions {
+		if md.MediaName.Media != kind || md.MediaName.Port.Value == 0 {
+			continue
+		}
+		direction := "sendrecv"
+		hasTrack := false
+		for _, attr := range md.Attributes {
+			switch attr.Key {
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				direction = attr.Key
+			case "msid", "ssrc":
+				hasTrack = true
+			}
+		}
+		if hasTrack && (direction == "sendrecv" || direction == "sendonly") {
+			return true
+		}
+	}
+	return false
+}
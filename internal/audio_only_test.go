@@ -0,0 +1,381 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const audioOnlyAudioStep = 20 * time.Millisecond // Opusのフレーム長
+
+// audioOnlyAnswerSDP はvideoの行を映像のm-lineとして含むanswerを作る（空の場合は音声のみ）
+func audioOnlyAnswerSDP(video string) string {
+	lines := []string{
+		"v=0",
+		"o=- 1 1 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"c=IN IP4 0.0.0.0",
+		"a=sendonly",
+		"a=rtpmap:111 opus/48000/2",
+	}
+	if video != "" {
+		lines = append(lines, strings.Split(video, "\n")...)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// TestAudioOnlyAnswerHasVideo はanswerのm-lineからサーバーが映像を送るかどうかを判定できることを検証する
+func TestAudioOnlyAnswerHasVideo(t *testing.T) {
+	cases := []struct {
+		name  string
+		video string
+		want  bool
+	}{
+		{"sendonly video", "m=video 9 UDP/TLS/RTP/SAVPF 96\na=sendonly\na=msid:stream video\na=rtpmap:96 VP8/90000", true},
+		{"sendrecv video", "m=video 9 UDP/TLS/RTP/SAVPF 96\na=msid:stream video\na=rtpmap:96 VP8/90000", true},
+		{"video with ssrc only", "m=video 9 UDP/TLS/RTP/SAVPF 96\na=sendonly\na=rtpmap:96 VP8/90000\na=ssrc:1234 cname:test", true},
+		{"sendonly without a track", "m=video 9 UDP/TLS/RTP/SAVPF 96\na=sendonly\na=rtpmap:96 VP8/90000", false},
+		{"inactive video", "m=video 9 UDP/TLS/RTP/SAVPF 96\na=inactive\na=msid:stream video\na=rtpmap:96 VP8/90000", false},
+		{"rejected video", "m=video 0 UDP/TLS/RTP/SAVPF 96\na=sendonly\na=msid:stream video\na=rtpmap:96 VP8/90000", false},
+		{"no video m-line", "", false},
+	}
+	for _, c := range cases {
+		if got := AnswerHasVideo(audioOnlyAnswerSDP(c.video)); got != c.want {
+			t.Fatalf("%s: AnswerHasVideo = %v, want %v", c.name, got, c.want)
+		}
+	}
+	if !AnswerHasVideo("not an SDP") {
+		t.Fatalf("an unparsable answer was treated as audio-only")
+	}
+}
+
+// audioOnlyWriteAudio はManualClockを20msずつ進めながらRawVideoMKVWriterに音声をnフレーム書き込んだ出力を返す
+// beforeは各フレームの前に呼ばれ、映像の書き込みや音声のみの設定に使う
+func audioOnlyWriteAudio(n int, before func(writer *RawVideoMKVWriter, i int) error) ([]byte, error) {
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	clock := newManualClock(time.Unix(0, 0))
+	writer.SetClock(clock)
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	for i := 0; i < n; i++ {
+		if i > 0 {
+			clock.Advance(audioOnlyAudioStep)
+		}
+		if before != nil {
+			if err := before(writer, i); err != nil {
+				return nil, err
+			}
+		}
+		if err := writer.WriteAudioFrame(opusSilence, uint32(i*960)); err != nil {
+			return nil, fmt.Errorf("audio frame %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// checkAudioOnly はdataが映像トラックの無い、音声をframesフレーム含むMKVであることを検証する
+func checkAudioOnly(data []byte, frames int) error {
+	if len(data) == 0 {
+		return fmt.Errorf("no MKV output")
+	}
+	report, err := ValidateMKV(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("mkv-validate: %v", err)
+	}
+	if report.VideoCodec != "" || report.Video.Frames != 0 {
+		return fmt.Errorf("video track %q with %d frames in an audio-only MKV", report.VideoCodec, report.Video.Frames)
+	}
+	if report.AudioCodec != "A_OPUS" || report.AudioSampleRate != 48000 {
+		return fmt.Errorf("audio track %s %dHz, want A_OPUS 48000Hz", report.AudioCodec, report.AudioSampleRate)
+	}
+	if report.Audio.Frames != frames {
+		return fmt.Errorf("%d audio frames, want %d", report.Audio.Frames, frames)
+	}
+	if report.Audio.FirstMs != 0 || report.Audio.Backwards != 0 {
+		return fmt.Errorf("audio starts at %dms with %d backward timestamps, want 0 and 0", report.Audio.FirstMs, report.Audio.Backwards)
+	}
+	return nil
+}
+
+// TestAudioOnlySetAudioOnly はSetAudioOnly後の最初の音声フレームで音声のみのMKVを書き込むことを検証する
+func TestAudioOnlySetAudioOnly(t *testing.T) {
+	data, err := audioOnlyWriteAudio(50, func(writer *RawVideoMKVWriter, i int) error {
+		if i == 0 {
+			writer.SetAudioOnly()
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAudioOnly(data, 50); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAudioOnlyTimeout は最初の音声から --audio-only-timeout の間に映像が届かなければ、それまでの音声を含めて音声のみのMKVを書き込み、
+// その後に届いた映像は破棄することを検証する
+func TestAudioOnlyTimeout(t *testing.T) {
+	saved := AudioOnlyTimeoutMs
+	AudioOnlyTimeoutMs = 3000
+	defer func() { AudioOnlyTimeoutMs = saved }()
+
+	encoder, err := NewVP8Encoder(640, 360, "YUV420P", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	yuv := bytes.Repeat([]byte{0x80}, 640*360*3/2)
+
+	after := time.Duration(AudioOnlyTimeoutMs) * time.Millisecond
+	n := int(after/audioOnlyAudioStep) + 50
+	data, err := audioOnlyWriteAudio(n, func(writer *RawVideoMKVWriter, i int) error {
+		if time.Duration(i)*audioOnlyAudioStep <= after+audioOnlyAudioStep {
+			return nil
+		}
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return err
+		}
+		return writer.WriteVideoFrame(encoded, uint32(i*1800), keyframe)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkAudioOnly(data, n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestAudioOnlyVideoPending は映像フレームが届いている間（キーフレーム待ち）は音声のみにしないことを検証する
+func TestAudioOnlyVideoPending(t *testing.T) {
+	saved := AudioOnlyTimeoutMs
+	AudioOnlyTimeoutMs = 3000
+	defer func() { AudioOnlyTimeoutMs = saved }()
+
+	encoder, err := NewVP8Encoder(320, 180, "YUV420P", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	yuv := bytes.Repeat([]byte{0x80}, 320*180*3/2)
+
+	n := int(time.Duration(AudioOnlyTimeoutMs)*time.Millisecond/audioOnlyAudioStep) + 50
+	data, err := audioOnlyWriteAudio(n, func(writer *RawVideoMKVWriter, i int) error {
+		if i != 0 {
+			return nil
+		}
+		// 低解像度プレビューのキーフレームのみ（ヘッダーは書き込まれない）
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return err
+		}
+		return writer.WriteVideoFrame(encoded, 0, keyframe)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("%d bytes written while waiting for a video keyframe", len(data))
+	}
+}
+
+// TestAudioOnlyTimeoutDisabled は --audio-only-timeout 0 の場合に映像を待ち続けることを検証する
+func TestAudioOnlyTimeoutDisabled(t *testing.T) {
+	saved := AudioOnlyTimeoutMs
+	AudioOnlyTimeoutMs = 0
+	defer func() { AudioOnlyTimeoutMs = saved }()
+
+	data, err := audioOnlyWriteAudio(int(3*time.Second/audioOnlyAudioStep)+50, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("%d bytes written with --audio-only-timeout 0", len(data))
+	}
+}
+
+// TestAudioOnlyLateVideo はデフォルト設定では、最初の音声から3秒以上遅れて始まった映像も映像トラックに書き込むことを検証する
+func TestAudioOnlyLateVideo(t *testing.T) {
+	encoder, err := NewVP8Encoder(640, 360, "YUV420P", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	yuv := bytes.Repeat([]byte{0x80}, 640*360*3/2)
+
+	const videoStart = 4 * time.Second
+	n := int(videoStart/audioOnlyAudioStep) + 50
+	videoFrames := 0
+	data, err := audioOnlyWriteAudio(n, func(writer *RawVideoMKVWriter, i int) error {
+		if time.Duration(i)*audioOnlyAudioStep < videoStart || i%2 != 0 {
+			return nil
+		}
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return err
+		}
+		videoFrames++
+		return writer.WriteVideoFrame(encoded, uint32(i*1800), keyframe)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := ValidateMKV(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("mkv-validate: %v", err)
+	}
+	if report.VideoCodec == "" || report.Video.Frames == 0 {
+		t.Fatalf("video starting %v after audio was not written (video track %q, %d frames)", videoStart, report.VideoCodec, report.Video.Frames)
+	}
+	if report.Audio.Frames == 0 {
+		t.Fatalf("no audio frames written")
+	}
+}
+
+// TestAudioOnlyLoopback は音声トラックのみを送るサーバーとネゴシエーションし、映像を待たずに音声のみのMKVを書き込むことを検証する
+func TestAudioOnlyLoopback(t *testing.T) {
+	// ネゴシエーション結果のみで音声のみと判定することを確認するため、タイムアウトは無効にする
+	saved := AudioOnlyTimeoutMs
+	AudioOnlyTimeoutMs = 0
+	defer func() { AudioOnlyTimeoutMs = saved }()
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	mediaReceived := make(chan struct{}, 1)
+	streamManager := NewStreamManager(writer, NewDefaultRTPProcessor(), 0, mediaReceived)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := connect(receiver, sender); err != nil {
+		t.Fatal(err)
+	}
+	if AnswerHasVideo(receiver.RemoteDescription().SDP) {
+		t.Fatalf("answer from an audio-only sender was detected as having video")
+	}
+	streamManager.SetAudioOnly()
+
+	go streamManager.Run()
+	stopped := false
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	stop := func() {
+		if !stopped {
+			stopped = true
+			receiver.Close()
+			streamManager.Stop()
+		}
+	}
+	defer stop()
+
+	// SRTPの準備完了前のパケットは破棄されるため、メディア受信の通知後もしばらく送り続ける
+	received := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; time.Now().Before(deadline) && received < 25; i++ {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+			Payload: opusSilence,
+		}
+		if err := track.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		select {
+		case <-mediaReceived:
+			received = 1
+		default:
+			if received > 0 {
+				received++
+			}
+		}
+	}
+	if received == 0 {
+		t.Fatalf("no media received notification for an audio-only stream")
+	}
+	stop()
+
+	report, err := ValidateMKV(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("mkv-validate: %v (%d bytes)", err, out.Len())
+	}
+	if report.VideoCodec != "" || report.AudioCodec != "A_OPUS" || report.Audio.Frames == 0 {
+		t.Fatalf("MKV has video %q, audio %q with %d frames; want audio-only A_OPUS with frames", report.VideoCodec, report.AudioCodec, report.Audio.Frames)
+	}
+}
+
+// TestAudioOnlyLoopbackWithVideo は映像トラックを送るサーバーのanswerを映像ありと判定することを検証する
+func TestAudioOnlyLoopbackWithVideo(t *testing.T) {
+	streamManager := NewStreamManager(&discardWriter{}, NewDefaultRTPProcessor(), 0, nil)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(receiver, sender); err != nil {
+		t.Fatal(err)
+	}
+	if !AnswerHasVideo(receiver.RemoteDescription().SDP) {
+		t.Fatalf("answer from a video sender was detected as audio-only")
+	}
+}
@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// --audio-tracks の値（それ以外は0始まりのインデックス）
+const (
+	AudioTracksAll   = "all"   // 受信したすべての音声トラックを書き込む
+	AudioTracksFirst = "first" // 最初の音声トラックのみ（デフォルト）
+)
+
+// MaxAudioTracks は --audio-tracks all でofferに含める音声m-lineの数
+// WHEPではクライアントがofferを作るため、サーバーが送れる音声トラックはこの数までになる
+const MaxAudioTracks = 4
+
+// AudioTracksAllIndex は --audio-tracks all を表すAudioTrackIndexの値
+const AudioTracksAllIndex = -1
+
+// ParseAudioTracks は --audio-tracks の値を書き込む音声トラックのインデックス（m-line順、0始まり）に変換する
+// allの場合はAudioTracksAllIndexを返す
+func ParseAudioTracks(value string) (int, error) {
+	switch value {
+	case AudioTracksAll:
+		return AudioTracksAllIndex, nil
+	case AudioTracksFirst, "":
+		return 0, nil
+	}
+	index, err := strconv.Atoi(value)
+	if err != nil || index < 0 || index >= MaxAudioTracks {
+		return 0, fmt.Errorf("invalid --audio-tracks: %s (use %s, %s or an index 0-%d)", value, AudioTracksAll, AudioTracksFirst, MaxAudioTracks-1)
+	}
+	return index, nil
+}
+
+// audioTransceiverCount はofferに含める音声のrecvonlyトランシーバー数を返す
+// インデックス指定時はそのトラックまでのm-lineが必要になる
+func audioTransceiverCount(selected int) int {
+	if selected == AudioTracksAllIndex {
+		return MaxAudioTracks
+	}
+	return selected + 1
+}
+
+// audioReceiverIndex はreceiverが何番目の音声トランシーバーのものかを返す（見つからない場合は-1）
+// トランシーバーは追加順にofferのm-lineになるため、サーバーが送る音声トラックの順序と一致する
+func audioReceiverIndex(pc *webrtc.PeerConnection, receiver *webrtc.RTPReceiver) int {
+	index := 0
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Kind() != webrtc.RTPCodecTypeAudio {
+			continue
+		}
+		if transceiver.Receiver() == receiver {
+			return index
+		}
+		index++
+	}
+	return -1
+}
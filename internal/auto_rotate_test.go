@@ -0,0 +1,348 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	autoRotateWidth  = 640
+	autoRotateHeight = 360
+)
+
+// autoRotateEncodeFrames は640x360の単色RGBAフレームをVP8でエンコードする
+func autoRotateEncodeFrames(n int) ([][]byte, []bool, error) {
+	encoder, err := NewVP8Encoder(autoRotateWidth, autoRotateHeight, "RGBA", 500)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer encoder.Close()
+	frame := bytes.Repeat([]byte{0x40, 0x80, 0xC0, 0xFF}, autoRotateWidth*autoRotateHeight)
+	var frames [][]byte
+	var keyframes []bool
+	for i := 0; i < n; i++ {
+		encoded, keyframe, err := encoder.Encode(frame)
+		if err != nil {
+			return nil, nil, err
+		}
+		frames = append(frames, encoded)
+		keyframes = append(keyframes, keyframe)
+	}
+	return frames, keyframes, nil
+}
+
+// findElement はヘッダー部分（最初のClusterより前）からidの要素を探し、データ部を返す
+func findElement(data []byte, id uint32) ([]byte, bool) {
+	idBytes := binary.BigEndian.AppendUint32(nil, id)
+	for len(idBytes) > 1 && idBytes[0] == 0 {
+		idBytes = idBytes[1:]
+	}
+	if end := bytes.Index(data, binary.BigEndian.AppendUint32(nil, idCluster)); end >= 0 {
+		data = data[:end]
+	}
+	pos := bytes.Index(data, idBytes)
+	if pos < 0 {
+		return nil, false
+	}
+	rest := data[pos+len(idBytes):]
+	size, n := readVint(rest, false)
+	if n == 0 || uint64(len(rest)-n) < size {
+		return nil, false
+	}
+	return rest[n : n+int(size)], true
+}
+
+// readProjection はProjection要素のProjectionTypeとProjectionPoseRollを返す
+func readProjection(data []byte) (uint64, float64, bool, error) {
+	projection, ok := findElement(data, idProjection)
+	if !ok {
+		return 0, 0, false, nil
+	}
+	var projType uint64
+	var roll float64
+	for len(projection) > 0 {
+		id, n := readVint(projection, true)
+		size, m := readVint(projection[n:], false)
+		if n == 0 || m == 0 || uint64(len(projection)-n-m) < size {
+			return 0, 0, true, fmt.Errorf("malformed Projection element")
+		}
+		value := projection[n+m : n+m+int(size)]
+		switch id {
+		case idProjType:
+			for _, b := range value {
+				projType = projType<<8 | uint64(b)
+			}
+		case idProjectRoll:
+			switch size {
+			case 4:
+				roll = float64(math.Float32frombits(binary.BigEndian.Uint32(value)))
+			case 8:
+				roll = math.Float64frombits(binary.BigEndian.Uint64(value))
+			}
+		}
+		projection = projection[n+m+int(size):]
+	}
+	return projType, roll, true, nil
+}
+
+// autoRotateWriteMKV はrotationを設定したRawVideoMKVWriterにフレームを書き込み、ヘッダー書き込み後にlateRotationを設定する
+func autoRotateWriteMKV(rotation, lateRotation int) ([]byte, error) {
+	frames, keyframes, err := autoRotateEncodeFrames(3)
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	writer.SetVideoRotation(rotation)
+	for i, frame := range frames {
+		if err := writer.WriteVideoFrame(frame, uint32(i*3000), keyframes[i]); err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		if i == 0 {
+			writer.SetVideoRotation(lateRotation)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// TestAutoRotateParse はCVOの1バイトから回転角度と左右反転を取り出せることを検証する
+func TestAutoRotateParse(t *testing.T) {
+	cases := []struct {
+		b       byte
+		degrees int
+		flip    bool
+	}{
+		{0x00, 0, false}, {0x01, 90, false}, {0x02, 180, false}, {0x03, 270, false},
+		{0x04, 0, true}, {0x07, 270, true}, {0x09, 90, false}, {0xF2, 180, false},
+	}
+	for _, c := range cases {
+		degrees, flip := ParseVideoOrientation(c.b)
+		if degrees != c.degrees || flip != c.flip {
+			t.Fatalf("0x%02X parsed as %d degrees flip=%v, want %d flip=%v", c.b, degrees, flip, c.degrees, c.flip)
+		}
+	}
+}
+
+// TestAutoRotateProjection はCVOの回転がProjectionPoseRoll（反時計回り）として書き込まれることを検証する
+func TestAutoRotateProjection(t *testing.T) {
+	for _, c := range []struct {
+		rotation int
+		roll     float64
+	}{{90, -90}, {180, 180}, {270, 90}} {
+		data, err := autoRotateWriteMKV(c.rotation, c.rotation)
+		if err != nil {
+			t.Fatalf("rotation %d: %v", c.rotation, err)
+		}
+		projType, roll, ok, err := readProjection(data)
+		if err != nil {
+			t.Fatalf("rotation %d: %v", c.rotation, err)
+		}
+		if !ok {
+			t.Fatalf("rotation %d: no Projection element", c.rotation)
+		}
+		if projType != 0 || roll != c.roll {
+			t.Fatalf("rotation %d: ProjectionType=%d ProjectionPoseRoll=%v, want 0 and %v", c.rotation, projType, roll, c.roll)
+		}
+	}
+}
+
+// TestAutoRotateNoRotation は回転が0の場合にProjectionを書かないことを検証する
+func TestAutoRotateNoRotation(t *testing.T) {
+	data, err := autoRotateWriteMKV(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, _ := readProjection(data); ok {
+		t.Fatalf("Projection element written for 0 degrees")
+	}
+}
+
+// TestAutoRotateLateRotation はヘッダー書き込み後の回転の変更が出力に反映されないことを検証する
+func TestAutoRotateLateRotation(t *testing.T) {
+	data, err := autoRotateWriteMKV(0, 90)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, ok, _ := readProjection(data); ok {
+		t.Fatalf("Projection element written for a rotation set after the header")
+	}
+}
+
+// rotationWriter はSetVideoRotationの呼び出しを記録するStreamWriter
+type rotationWriter struct {
+	mu        sync.Mutex
+	rotations []int
+	frames    int
+}
+
+func (w *rotationWriter) SetVideoRotation(degrees int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.rotations = append(w.rotations, degrees)
+}
+
+func (w *rotationWriter) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.frames++
+	return nil
+}
+
+func (w *rotationWriter) WriteAudioFrame(data []byte, timestamp uint32) error { return nil }
+func (w *rotationWriter) Run() error                                          { return nil }
+func (w *rotationWriter) Close() error                                        { return nil }
+
+func (w *rotationWriter) snapshot() ([]int, int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]int(nil), w.rotations...), w.frames
+}
+
+// autoRotateNewSender はCVOヘッダー拡張に対応したVP8送信側のPeerConnectionを作成する
+func autoRotateNewSender() (*webrtc.PeerConnection, *webrtc.TrackLocalStaticRTP, *webrtc.RTPSender, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, nil, err
+	}
+	if err := RegisterVideoOrientation(mediaEngine); err != nil {
+		return nil, nil, nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+	if err != nil {
+		peerConnection.Close()
+		return nil, nil, nil, err
+	}
+	sender, err := peerConnection.AddTrack(track)
+	if err != nil {
+		peerConnection.Close()
+		return nil, nil, nil, err
+	}
+	return peerConnection, track, sender, nil
+}
+
+// autoRotateLoopback はCVO付きのVP8パケットを送信し、受信側のwriterに通知された回転と受信フレーム数を返す
+func autoRotateLoopback(autoRotate bool, orientation byte) ([]int, int, error) {
+	AutoRotate = autoRotate
+	defer func() { AutoRotate = false }()
+
+	writer := &rotationWriter{}
+	streamManager := NewStreamManager(writer, NewDefaultRTPProcessor(), 0, nil)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, 0, err
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer receiver.Close()
+	senderPC, track, sender, err := autoRotateNewSender()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer senderPC.Close()
+
+	if err := connect(receiver, senderPC); err != nil {
+		return nil, 0, err
+	}
+	var extensionID uint8
+	for _, ext := range sender.GetParameters().HeaderExtensions {
+		if ext.URI == VideoOrientationURI {
+			extensionID = uint8(ext.ID)
+		}
+	}
+	if autoRotate && extensionID == 0 {
+		return nil, 0, fmt.Errorf("video orientation extension was not negotiated")
+	}
+	if !autoRotate && extensionID != 0 {
+		return nil, 0, fmt.Errorf("video orientation extension negotiated without --auto-rotate")
+	}
+
+	go streamManager.Run()
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	defer func() {
+		receiver.Close()
+		streamManager.Stop()
+	}()
+
+	frames, keyframes, err := autoRotateEncodeFrames(30)
+	if err != nil {
+		return nil, 0, err
+	}
+	// SRTPの準備完了前のパケットは破棄されるため、フレームを受信するまで送り続ける
+	packetizer := NewVP8Packetizer(1234)
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; time.Now().Before(deadline); i++ {
+		frame := frames[i%len(frames)]
+		for _, packet := range packetizer.Packetize(frame, int64(i)*33, keyframes[i%len(frames)]) {
+			// CVOはフレームの最終パケットに付ける
+			if packet.Marker {
+				ext := extensionID
+				if ext == 0 {
+					ext = 1
+				}
+				if err := packet.SetExtension(ext, []byte{orientation}); err != nil {
+					return nil, 0, err
+				}
+			}
+			if err := track.WriteRTP(packet); err != nil {
+				return nil, 0, err
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if _, received := writer.snapshot(); received >= 10 {
+			break
+		}
+	}
+	rotations, received := writer.snapshot()
+	return rotations, received, nil
+}
+
+// TestAutoRotateLoopback は --auto-rotate 指定時に受信したCVOがwriterへ一度だけ通知されることを検証する
+func TestAutoRotateLoopback(t *testing.T) {
+	rotations, received, err := autoRotateLoopback(true, 0x01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received == 0 {
+		t.Fatalf("no video frames received")
+	}
+	if len(rotations) != 1 || rotations[0] != 90 {
+		t.Fatalf("writer was notified of rotations %v, want [90]", rotations)
+	}
+}
+
+// TestAutoRotateLoopbackDisabled は --auto-rotate 未指定時にCVOがネゴシエーションされず、回転も通知されないことを検証する
+func TestAutoRotateLoopbackDisabled(t *testing.T) {
+	rotations, received, err := autoRotateLoopback(false, 0x01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received == 0 {
+		t.Fatalf("no video frames received")
+	}
+	if len(rotations) != 0 {
+		t.Fatalf("writer was notified of rotations %v without --auto-rotate", rotations)
+	}
+}
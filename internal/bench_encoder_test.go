@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+const (
+	benchEncoderWidth       = 640
+	benchEncoderHeight      = 360
+	benchEncoderBitrateKbps = 1000
+	benchEncoderLoopFrames  = 60 // 2秒分の入力を繰り返しエンコードする
+)
+
+// encoderSetting は比較する --encode-deadline と --cpu-used の組み合わせ
+type encoderSetting struct {
+	deadline string
+	cpuUsed  int
+}
+
+var encoderSettings = []encoderSetting{
+	{"realtime", 0},
+	{"realtime", 8},
+	{"realtime", 16},
+	{"good", 0},
+	{"good", 5},
+	{"best", 0},
+}
+
+// benchEncoderMakeFrames は動きのあるYUV420Pフレームを用意する（グラデーションの上を四角が横に移動する）
+func benchEncoderMakeFrames() [][]byte {
+	frames := make([][]byte, benchEncoderLoopFrames)
+	ySize := benchEncoderWidth * benchEncoderHeight
+	for n := range frames {
+		yuv := make([]byte, ySize*3/2)
+		for y := 0; y < benchEncoderHeight; y++ {
+			for x := 0; x < benchEncoderWidth; x++ {
+				yuv[y*benchEncoderWidth+x] = byte((x + y + n) / 2)
+			}
+		}
+		for i := ySize; i < len(yuv); i++ {
+			yuv[i] = byte(96 + i%64)
+		}
+		left := (n * 8) % (benchEncoderWidth - 64)
+		for y := 148; y < 212; y++ {
+			for x := left; x < left+64; x++ {
+				yuv[y*benchEncoderWidth+x] = 235
+			}
+		}
+		frames[n] = yuv
+	}
+	return frames
+}
+
+// BenchmarkVP8Encoder は --encode-deadline と --cpu-used の組み合わせごとに、VP8Encoder.Encodeの1フレームを1回の操作として計測する
+func BenchmarkVP8Encoder(b *testing.B) {
+	frames := benchEncoderMakeFrames()
+
+	for _, setting := range encoderSettings {
+		b.Run(fmt.Sprintf("deadline=%s/cpu-used=%d", setting.deadline, setting.cpuUsed), func(b *testing.B) {
+			savedDeadline, savedCPUUsed := EncodeDeadline, CPUUsed
+			EncodeDeadline = setting.deadline
+			CPUUsed = setting.cpuUsed
+			b.Cleanup(func() { EncodeDeadline, CPUUsed = savedDeadline, savedCPUUsed })
+
+			encoder, err := NewVP8Encoder(benchEncoderWidth, benchEncoderHeight, "YUV420P", benchEncoderBitrateKbps)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer encoder.Close()
+
+			var total int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				encoded, _, err := encoder.Encode(frames[i%len(frames)])
+				if err != nil {
+					b.Fatal(err)
+				}
+				total += int64(len(encoded))
+			}
+			b.StopTimer()
+			b.ReportMetric(float64(total)/float64(b.N), "bytes/frame")
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package internal
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+)
+
+const (
+	benchWriterWidth        = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	benchWriterHeight       = 360
+	benchWriterVideoFrames  = 30 // 1秒分をエンコードして繰り返し書き込む
+	benchWriterVideoTSStep  = 3000
+	benchWriterAudioTSStep  = 960
+	benchWriterAudioPerFrag = 2 // 映像1フレームあたりの音声フレーム数（30fpsに対し20ms）
+)
+
+// writeCounter は書き込みを捨て、Write呼び出し回数（パイプへのシステムコール数に相当）を数える
+type writeCounter struct {
+	writes int
+	bytes  int64
+}
+
+func (w *writeCounter) Write(p []byte) (int, error) {
+	w.writes++
+	w.bytes += int64(len(p))
+	return len(p), nil
+}
+
+// benchWriterEncodeFrames はベンチマーク用のVP8フレームを用意する
+func benchWriterEncodeFrames(b *testing.B) ([][]byte, []bool) {
+	b.Helper()
+	encoder, err := NewVP8Encoder(benchWriterWidth, benchWriterHeight, "YUV420P", 500)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer encoder.Close()
+
+	var frames [][]byte
+	var keyframes []bool
+	yuv := make([]byte, benchWriterWidth*benchWriterHeight*3/2)
+	for i := 0; i < benchWriterVideoFrames; i++ {
+		for j := range yuv {
+			yuv[j] = byte(j + i*3)
+		}
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			b.Fatal(err)
+		}
+		frames = append(frames, append([]byte(nil), encoded...))
+		keyframes = append(keyframes, keyframe)
+	}
+	if !keyframes[0] {
+		b.Fatal("first frame is not a keyframe")
+	}
+	return frames, keyframes
+}
+
+// setWriterOptions はベンチマークの間だけRawVideoMKVWriterの設定を差し替える
+func setWriterOptions(b *testing.B, bufferSize, flushIntervalMs, interleaveWindowMs int) {
+	b.Helper()
+	savedBuffer, savedFlush, savedInterleave := OutputBufferSize, FlushIntervalMs, InterleaveWindowMs
+	OutputBufferSize = bufferSize
+	FlushIntervalMs = flushIntervalMs
+	InterleaveWindowMs = interleaveWindowMs
+	b.Cleanup(func() {
+		OutputBufferSize, FlushIntervalMs, InterleaveWindowMs = savedBuffer, savedFlush, savedInterleave
+	})
+}
+
+// runWriterBenchmark はRawVideoMKVWriterに映像1フレームと音声2フレームを書き込む処理を1回の操作として計測し、
+// 計測中に確保したバイト数を返す
+func runWriterBenchmark(b *testing.B, frames [][]byte, keyframes []bool) (*writeCounter, uint64) {
+	b.Helper()
+	out := &writeCounter{}
+	writer := NewRawVideoMKVWriter(out, "vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	var before, after runtime.MemStats
+	b.ReportAllocs()
+	runtime.ReadMemStats(&before)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// 先頭のキーフレームから繰り返すため、参照が壊れないよう1周ごとにキーフレームから始まる
+		idx := i % len(frames)
+		if err := writer.WriteVideoFrame(frames[idx], uint32(i*benchWriterVideoTSStep), keyframes[idx]); err != nil {
+			b.Fatal(err)
+		}
+		for j := 0; j < benchWriterAudioPerFrag; j++ {
+			if err := writer.WriteAudioFrame([]byte{0xFC, byte(j), 0x00, 0x01}, uint32((i*benchWriterAudioPerFrag+j)*benchWriterAudioTSStep)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.StopTimer()
+	runtime.ReadMemStats(&after)
+
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+	if err := <-runErr; err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(out.bytes / int64(b.N))
+	return out, after.TotalAlloc - before.TotalAlloc
+}
+
+// BenchmarkRawVideoMKVWriter は --output-buffer と --flush-interval の組み合わせごとに書き込み性能とWrite回数を比べる
+func BenchmarkRawVideoMKVWriter(b *testing.B) {
+	disableFrameValidation(b)
+	frames, keyframes := benchWriterEncodeFrames(b)
+
+	for _, bufferSize := range []int{4 * 1024, 64 * 1024, 1024 * 1024} {
+		for _, flushIntervalMs := range []int{0, 100, 1000} {
+			name := fmt.Sprintf("buffer=%dKB/flush=%dms", bufferSize/1024, flushIntervalMs)
+			b.Run(name, func(b *testing.B) {
+				setWriterOptions(b, bufferSize, flushIntervalMs, 0)
+				out, _ := runWriterBenchmark(b, frames, keyframes)
+				b.ReportMetric(float64(out.writes)/float64(b.N), "writes/op")
+			})
+		}
+	}
+}
+
+// BenchmarkRawVideoMKVWriterAllocs はデコード後のRGBA変換とインターリーブでのフレームごとの確保量を、RGBA 1フレームの大きさと比べる
+func BenchmarkRawVideoMKVWriterAllocs(b *testing.B) {
+	disableFrameValidation(b)
+	frames, keyframes := benchWriterEncodeFrames(b)
+	frameSize := float64(benchWriterWidth * benchWriterHeight * 4)
+
+	for _, windowMs := range []int{0, 50} {
+		b.Run(fmt.Sprintf("interleave=%dms", windowMs), func(b *testing.B) {
+			setWriterOptions(b, 64*1024, 100, windowMs)
+			_, allocated := runWriterBenchmark(b, frames, keyframes)
+			b.ReportMetric(float64(allocated)/float64(b.N)/frameSize, "frames-allocated/op")
+		})
+	}
+}
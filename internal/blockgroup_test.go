@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+	"time"
+)
+
+// blockgroupSegmentHead はSegmentの先頭（Info、Tracks）を作る
+func blockgroupSegmentHead(timecodeScale uint64, trackEntries ...[]byte) []byte {
+	return bytes.Join([][]byte{
+		element(0x1A45DFA3, element(0x4282, []byte("matroska"))),
+		append(idBytes(0x18538067), unknownSize...),
+		element(0x1549A966, element(0x2AD7B1, uintData(timecodeScale))),
+		element(0x1654AE6B, trackEntries...),
+	}, nil)
+}
+
+func blockgroupAudioTrack(number uint64, codec string) []byte {
+	return element(0xAE,
+		element(0xD7, uintData(number)),
+		element(0x86, []byte(codec)),
+		element(0xE1,
+			element(0x9F, uintData(2)),
+			element(0xB5, binary.BigEndian.AppendUint64(nil, math.Float64bits(48000))),
+		),
+	)
+}
+
+func blockgroupVideoTrack(number uint64) []byte {
+	return element(0xAE,
+		element(0xD7, uintData(number)),
+		element(0x86, []byte("V_VP8")),
+		element(0xE0, element(0xB0, uintData(640)), element(0xBA, uintData(360))),
+	)
+}
+
+// xiphLacedBlock はXiph lacingで複数フレームを詰めたBlockのデータを作る
+func xiphLacedBlock(track byte, frames ...[]byte) []byte {
+	out := []byte{0x80 | track, 0x00, 0x00, 0x02, byte(len(frames) - 1)}
+	for _, frame := range frames[:len(frames)-1] {
+		size := len(frame)
+		for ; size >= 255; size -= 255 {
+			out = append(out, 255)
+		}
+		out = append(out, byte(size))
+	}
+	for _, frame := range frames {
+		out = append(out, frame...)
+	}
+	return out
+}
+
+// blockgroupFixedLacedBlock は固定長lacingで複数フレームを詰めたBlockのデータを作る
+func blockgroupFixedLacedBlock(track byte, frames ...[]byte) []byte {
+	out := []byte{0x80 | track, 0x00, 0x00, 0x04, byte(len(frames) - 1)}
+	for _, frame := range frames {
+		out = append(out, frame...)
+	}
+	return out
+}
+
+// blockgroupReadAll はMKVReaderで全フレームを読む
+func blockgroupReadAll(data []byte) ([]*Frame, error) {
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	var frames []*Frame
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return frames, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// checkSplit はlacingされたフレームのtimestampと、各フレームの長さの合計がBlockDurationに一致することを確認する
+func checkSplit(frames []*Frame, want []int64, blockEndMs int64) error {
+	if len(frames) != len(want) {
+		return fmt.Errorf("got %d frames, want %d", len(frames), len(want))
+	}
+	var total int64
+	for i, frame := range frames {
+		if frame.TimestampMs != want[i] {
+			return fmt.Errorf("frame %d timestamp: got %dms, want %dms", i, frame.TimestampMs, want[i])
+		}
+		end := blockEndMs
+		if i+1 < len(frames) {
+			end = frames[i+1].TimestampMs
+		}
+		total += end - frame.TimestampMs
+	}
+	if start := frames[0].TimestampMs; total != blockEndMs-start {
+		return fmt.Errorf("frame durations sum to %dms, want %dms", total, blockEndMs-start)
+	}
+	return nil
+}
+
+// testPCMSplit はBlockDurationを持つPCMのlaced Blockがサンプル数の比で分配されることを検証する
+// 48kHz stereoで10ms、20ms、10msの3フレームを40msのBlockに詰める
+func testPCMSplit(timecodeScale uint64) error {
+	ticksPerMs := uint64(1000000) / timecodeScale
+	pcm10 := make([]byte, 480*4)
+	pcm20 := make([]byte, 960*4)
+	data := append(blockgroupSegmentHead(timecodeScale, blockgroupAudioTrack(1, "A_PCM/INT/LIT")),
+		unsizedElement(0x1F43B675,
+			element(0xE7, uintData(1000*ticksPerMs)),
+			element(0xA0,
+				element(0xA1, xiphLacedBlock(1, pcm10, pcm20, pcm10)),
+				element(0x9B, uintData(40*ticksPerMs)),
+			),
+		)...)
+
+	frames, err := blockgroupReadAll(data)
+	if err != nil {
+		return err
+	}
+	if err := checkSplit(frames, []int64{1000, 1010, 1030}, 1040); err != nil {
+		return err
+	}
+	if !frames[0].IsKeyframe {
+		return fmt.Errorf("block without ReferenceBlock should be a keyframe")
+	}
+	return nil
+}
+
+// TestBlockgroupOpusSplit はBlockDurationがOpusパケットの想定長より優先されることを検証する
+// 20msのパケット3つを30msのBlockに詰めた場合、10msずつに分配する
+func TestBlockgroupOpusSplit(t *testing.T) {
+	packet := []byte{0xFC, 0x01, 0x02, 0x03} // CELT FB 20ms
+	data := append(blockgroupSegmentHead(1000000, blockgroupAudioTrack(1, "A_OPUS")),
+		element(0x1F43B675,
+			element(0xE7, uintData(500)),
+			element(0xA0,
+				element(0xA1, blockgroupFixedLacedBlock(1, packet, packet, packet)),
+				element(0x9B, uintData(30)),
+			),
+			// BlockDurationがないBlockは従来どおりパケットの想定長で進める
+			element(0xA0,
+				element(0xA1, append([]byte{0x81, 0x00, 0x30, 0x04, 0x01}, append(packet, packet...)...)),
+			),
+		)...)
+
+	frames, err := blockgroupReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 5 {
+		t.Fatalf("got %d frames, want 5", len(frames))
+	}
+	if err := checkSplit(frames[:3], []int64{500, 510, 520}, 530); err != nil {
+		t.Fatal(err)
+	}
+	if frames[3].TimestampMs != 548 || frames[4].TimestampMs != 568 {
+		t.Fatalf("unlaced-duration block: got %dms, %dms, want 548ms, 568ms", frames[3].TimestampMs, frames[4].TimestampMs)
+	}
+}
+
+// TestBlockgroupReferenceBlock はBlockGroupのキーフレーム判定（ReferenceBlockの有無）を検証する
+func TestBlockgroupReferenceBlock(t *testing.T) {
+	vp8 := []byte{0x10, 0x02, 0x00, 0x9D, 0x01, 0x2A}
+	data := append(blockgroupSegmentHead(1000000, blockgroupVideoTrack(1)),
+		unsizedElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			element(0xA0, element(0xA1, append([]byte{0x81, 0x00, 0x00, 0x00}, vp8...))),
+			element(0xA0,
+				element(0xA1, append([]byte{0x81, 0x00, 0x21, 0x00}, vp8...)),
+				element(0xFB, []byte{0xDF}),
+			),
+		)...)
+
+	frames, err := blockgroupReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("got %d frames, want 2", len(frames))
+	}
+	if !frames[0].IsKeyframe || frames[1].IsKeyframe {
+		t.Fatalf("keyframe flags: got %v, %v, want true, false", frames[0].IsKeyframe, frames[1].IsKeyframe)
+	}
+	if frames[1].TimestampMs != 33 {
+		t.Fatalf("second block timestamp: got %dms, want 33ms", frames[1].TimestampMs)
+	}
+}
+
+// TestBlockgroupNegativeRelativeTimecode は負の相対timecodeを持つBlockを検証する
+// Clusterの時刻より前でも0以上ならそのままのPTSとし、0より前になるPTSは0に切り上げて、
+// Pacerが再同期せず、RTPタイムスタンプが巻き戻らないことを確認する
+func TestBlockgroupNegativeRelativeTimecode(t *testing.T) {
+	vp8 := []byte{0x10, 0x02, 0x00, 0x9D, 0x01, 0x2A}
+	block := func(relativeMs int16) []byte {
+		return append([]byte{0x81, byte(uint16(relativeMs) >> 8), byte(relativeMs), 0x80}, vp8...)
+	}
+	data := append(blockgroupSegmentHead(1000000, blockgroupVideoTrack(1)),
+		unsizedElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			element(0xA3, block(-66)),
+			element(0xA3, block(-33)),
+			element(0xA3, block(0)),
+		)...)
+	data = append(data, unsizedElement(0x1F43B675,
+		element(0xE7, uintData(1000)),
+		element(0xA3, block(-20)),
+	)...)
+
+	frames, err := blockgroupReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 4 {
+		t.Fatalf("got %d frames, want 4", len(frames))
+	}
+	want := []struct{ timestampMs, relativeMs int64 }{{0, -66}, {0, -33}, {0, 0}, {980, -20}}
+	for i, frame := range frames {
+		if frame.TimestampMs != want[i].timestampMs || frame.BlockRelativeTsMs != want[i].relativeMs {
+			t.Fatalf("frame %d: got PTS %dms (relative %dms), want %dms (relative %dms)",
+				i, frame.TimestampMs, frame.BlockRelativeTsMs, want[i].timestampMs, want[i].relativeMs)
+		}
+	}
+
+	packetizer := NewVP8Packetizer(1)
+	first := packetizer.Packetize(frames[0].Data, frames[0].TimestampMs, true)[0].Timestamp
+	last := packetizer.Packetize(frames[3].Data, frames[3].TimestampMs, false)[0].Timestamp
+	if diff := last - first; diff != 980*90 {
+		t.Fatalf("RTP timestamps %d and %d are %d ticks apart, want %d", first, last, diff, 980*90)
+	}
+
+	// 同じPTSが続いてもPacerは基準時刻を保ち、980ms後のフレームを待つ
+	pacer := NewPacer(2 * time.Second)
+	start := time.Now()
+	for _, frame := range frames[:3] {
+		pacer.Wait(frame.TimestampMs)
+	}
+	if pacer.Lateness(frames[3].TimestampMs) != 0 {
+		t.Fatalf("pacer reports a frame at %dms as late", frames[3].TimestampMs)
+	}
+	pacer.Wait(frames[3].TimestampMs)
+	if elapsed := time.Since(start); elapsed < 900*time.Millisecond {
+		t.Fatalf("pacer waited %v for the frame at %dms, want about 980ms", elapsed, frames[3].TimestampMs)
+	}
+}
+
+// TestBlockgroupPCMSplit はTimecodeScaleごとにPCMのBlockDurationの分割を検証する
+func TestBlockgroupPCMSplit(t *testing.T) {
+	for _, scale := range []uint64{1000000, 100000} {
+		t.Run(fmt.Sprintf("TimecodeScale=%dns", scale), func(t *testing.T) {
+			if err := testPCMSplit(scale); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// removeBundleGroup はanswerからa=group:BUNDLEを削除する（m-lineごとのトランスポート指定と同じ形になる）
+func removeBundleGroup(sdp string) string {
+	lines := strings.Split(sdp, "\r\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "a=group:BUNDLE") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\r\n")
+}
+
+// separateICE はa=group:BUNDLEを削除し、2番目以降のm-lineのice-ufragを別の値にする
+func separateICE(sdp string) string {
+	lines := strings.Split(removeBundleGroup(sdp), "\r\n")
+	seen := 0
+	for i, line := range lines {
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			seen++
+			if seen > 1 {
+				lines[i] = fmt.Sprintf("a=ice-ufrag:separate%d", seen)
+			}
+		}
+	}
+	return strings.Join(lines, "\r\n")
+}
+
+// newWHEPServer はpionでanswerを作成し、mutateで書き換えて返すWHEPサーバーを起動する
+func newWHEPServer(mutate func(string) string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		offer, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		answer, err := createAnswer(string(offer))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if mutate != nil {
+			answer = mutate(answer)
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", "/session/1")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+	}))
+}
+
+// bundleExchange はpolicyを設定したWHEPクライアントのPeerConnectionでmutateされたanswerを受け取る
+// SDP交換のエラーと、answerがリモートSDPとして設定されたかを返す
+func bundleExchange(policy string, mutate func(string) string) (error, bool, error) {
+	BundlePolicy = policy
+	server := newWHEPServer(mutate)
+	defer server.Close()
+
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, false, err
+	}
+	streamManager := NewStreamManager(NewProbeWriter(), NewDefaultRTPProcessor(), 0, nil)
+	peerConnection, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		return nil, false, err
+	}
+	defer peerConnection.Close()
+
+	if got, want := peerConnection.GetConfiguration().BundlePolicy.String(), policy; got != want {
+		return nil, false, fmt.Errorf("PeerConnection bundle policy is %s, want %s", got, want)
+	}
+
+	exchangeErr := NewWHEPSession(server.URL).ExchangeSDP(peerConnection)
+	return exchangeErr, peerConnection.RemoteDescription() != nil, nil
+}
+
+// expectAccepted はanswerが受け付けられることを検証する
+func expectAccepted(policy string, mutate func(string) string) error {
+	exchangeErr, applied, err := bundleExchange(policy, mutate)
+	if err != nil {
+		return err
+	}
+	if exchangeErr != nil {
+		return fmt.Errorf("answer rejected: %v", exchangeErr)
+	}
+	if !applied {
+		return fmt.Errorf("answer was not set as the remote description")
+	}
+	return nil
+}
+
+// expectRejected はanswerがErrAnswerNotBundledで拒否され、リモートSDPとして設定されないことを検証する
+func expectRejected(policy string, mutate func(string) string, wantMessage string) error {
+	exchangeErr, applied, err := bundleExchange(policy, mutate)
+	if err != nil {
+		return err
+	}
+	if !errors.Is(exchangeErr, ErrAnswerNotBundled) || !strings.Contains(exchangeErr.Error(), wantMessage) {
+		return fmt.Errorf("got error %v, want ErrAnswerNotBundled containing %q", exchangeErr, wantMessage)
+	}
+	if applied {
+		return fmt.Errorf("rejected answer was set as the remote description")
+	}
+	return nil
+}
+
+// TestBundleAccepted はBUNDLEポリシーごとに受け入れるanswerを検証する
+func TestBundleAccepted(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		modify func(string) string
+	}{
+		{"bundled answer with max-bundle", BundlePolicyMaxBundle, nil},
+		{"non-bundled answer with balanced (shared ICE)", BundlePolicyBalanced, removeBundleGroup},
+		{"non-bundled answer with max-compat (shared ICE)", BundlePolicyMaxCompat, removeBundleGroup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := expectAccepted(tt.policy, tt.modify); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestBundleRejected はBUNDLEポリシーに合わないanswerを拒否することを検証する
+func TestBundleRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		modify func(string) string
+		reason string
+	}{
+		{"non-bundled answer with max-bundle", BundlePolicyMaxBundle, removeBundleGroup, "outside a=group:BUNDLE"},
+		{"non-bundled answer with separate ICE transports", BundlePolicyBalanced, separateICE, "separate ICE transports"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := expectRejected(tt.policy, tt.modify, tt.reason); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// AbsCaptureTimeURI はabsolute-capture-timeのRTPヘッダー拡張
+// 送信側がフレームをキャプチャした時刻（NTP形式）を載せ、受信時刻との差からend-to-endの遅延を求められる
+const AbsCaptureTimeURI = "http://www.webrtc.org/experiments/rtp-hdrext/abs-capture-time"
+
+// RegisterAbsCaptureTime は --measure-latency 指定時にabs-capture-timeヘッダー拡張を映像・音声のネゴシエーション対象に加える
+func RegisterAbsCaptureTime(mediaEngine *webrtc.MediaEngine) error {
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio} {
+		if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: AbsCaptureTimeURI}, kind); err != nil {
+			return fmt.Errorf("failed to register %s: %w", AbsCaptureTimeURI, err)
+		}
+	}
+	return nil
+}
+
+// absCaptureTimeExtensionID はネゴシエーションされたabs-capture-timeヘッダー拡張のIDを返す（無い場合は0）
+func absCaptureTimeExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == AbsCaptureTimeURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// LatencyEstimator はabs-capture-time拡張のキャプチャ時刻と受信時刻の差から、1トラックのend-to-end遅延を計算する
+// 送信側と受信側の時計がNTP等で同期している前提で、ずれはそのまま遅延の誤差になる
+// 拡張は一部のパケット（キーフレーム等）にのみ付くことがあるため、拡張の無いパケットは無視する
+type LatencyEstimator struct {
+	mu          sync.Mutex
+	extensionID uint8
+	samples     int64
+	latency     time.Duration // 1/16の重みで平滑化した遅延
+}
+
+// NewLatencyEstimator はヘッダー拡張IDがextensionIDのabs-capture-timeを読むLatencyEstimatorを作成する
+func NewLatencyEstimator(extensionID uint8) *LatencyEstimator {
+	return &LatencyEstimator{extensionID: extensionID}
+}
+
+// Update はパケットのabs-capture-time拡張を読み、arrivalとの差を記録する（拡張が無い場合はok=false）
+// 拡張にestimated capture clock offsetがあれば、キャプチャ時刻を送信側の時計に補正してから差を取る
+func (l *LatencyEstimator) Update(packet *rtp.Packet, arrival time.Time) (time.Duration, bool) {
+	if l.extensionID == 0 {
+		return 0, false
+	}
+	payload := packet.GetExtension(l.extensionID)
+	if payload == nil {
+		return 0, false
+	}
+	var ext rtp.AbsCaptureTimeExtension
+	if err := ext.Unmarshal(payload); err != nil {
+		return 0, false
+	}
+	captured := ext.CaptureTime()
+	if offset := ext.EstimatedCaptureClockOffsetDuration(); offset != nil {
+		captured = captured.Add(*offset)
+	}
+	latency := arrival.Sub(captured)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.samples == 0 {
+		l.latency = latency
+	} else {
+		l.latency += (latency - l.latency) / 16
+	}
+	l.samples++
+	return latency, true
+}
+
+// Latency は平滑化した遅延を返す
+func (l *LatencyEstimator) Latency() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.latency
+}
+
+// Samples は遅延を計算したパケット数を返す
+func (l *LatencyEstimator) Samples() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.samples
+}
@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	extensionID              = 3
+	captureLatencyAudioStep  = 20 * time.Millisecond // Opusのフレーム長
+	captureLatencyAudioTicks = 960                   // 20ms（48kHz）
+	// NTP形式（32.32固定小数点）の丸め誤差を許容する
+	captureLatencyTolerance = time.Microsecond
+)
+
+// packetWithCaptureTime はabs-capture-time拡張を付けたRTPパケットを作成する
+func packetWithCaptureTime(ext *rtp.AbsCaptureTimeExtension) (*rtp.Packet, error) {
+	packet := &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: opusSilence}
+	payload, err := ext.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err := packet.SetExtension(extensionID, payload); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
+
+// captureLatencyNear はgotがwantからtolerance以内かを返す
+func captureLatencyNear(got, want time.Duration) bool {
+	diff := got - want
+	return diff >= -captureLatencyTolerance && diff <= captureLatencyTolerance
+}
+
+// TestCaptureLatency はキャプチャ時刻の150ms後に受信したパケットの遅延が150msになることを検証する
+func TestCaptureLatency(t *testing.T) {
+	arrival := time.Now()
+	packet, err := packetWithCaptureTime(rtp.NewAbsCaptureTimeExtension(arrival.Add(-150 * time.Millisecond)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	estimator := NewLatencyEstimator(extensionID)
+	latency, ok := estimator.Update(packet, arrival)
+	if !ok {
+		t.Fatalf("abs-capture-time extension was not read")
+	}
+	if !captureLatencyNear(latency, 150*time.Millisecond) || !captureLatencyNear(estimator.Latency(), 150*time.Millisecond) {
+		t.Fatalf("latency %v (smoothed %v), want 150ms", latency, estimator.Latency())
+	}
+	if estimator.Samples() != 1 {
+		t.Fatalf("%d samples, want 1", estimator.Samples())
+	}
+}
+
+// TestCaptureLatencyCaptureClockOffset はestimated capture clock offsetでキャプチャ時刻を送信側の時計に補正することを検証する
+// キャプチャ側の時計が送信側より2秒遅れている場合、offsetは+2秒となる
+func TestCaptureLatencyCaptureClockOffset(t *testing.T) {
+	arrival := time.Now()
+	captured := arrival.Add(-150*time.Millisecond - 2*time.Second)
+	packet, err := packetWithCaptureTime(rtp.NewAbsCaptureTimeExtensionWithCaptureClockOffset(captured, 2*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	latency, ok := NewLatencyEstimator(extensionID).Update(packet, arrival)
+	if !ok {
+		t.Fatalf("abs-capture-time extension was not read")
+	}
+	if !captureLatencyNear(latency, 150*time.Millisecond) {
+		t.Fatalf("latency %v with a 2s capture clock offset, want 150ms", latency)
+	}
+}
+
+// TestCaptureLatencyWithoutExtension は拡張の無いパケットや、拡張がネゴシエーションされていない場合は計測しないことを検証する
+func TestCaptureLatencyWithoutExtension(t *testing.T) {
+	estimator := NewLatencyEstimator(extensionID)
+	if _, ok := estimator.Update(&rtp.Packet{Header: rtp.Header{Version: 2}, Payload: opusSilence}, time.Now()); ok {
+		t.Fatalf("measured latency on a packet without the extension")
+	}
+	packet, err := packetWithCaptureTime(rtp.NewAbsCaptureTimeExtension(time.Now()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled := NewLatencyEstimator(0)
+	if _, ok := disabled.Update(packet, time.Now()); ok {
+		t.Fatalf("measured latency without a negotiated extension ID")
+	}
+	if estimator.Samples() != 0 || disabled.Samples() != 0 {
+		t.Fatalf("samples %d/%d, want 0", estimator.Samples(), disabled.Samples())
+	}
+}
+
+// TestCaptureLatencySmoothing は遅延の変化を1/16の重みで平滑化し、一時的な外れ値で大きく動かないことを検証する
+func TestCaptureLatencySmoothing(t *testing.T) {
+	estimator := NewLatencyEstimator(extensionID)
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		arrival := start.Add(time.Duration(i) * captureLatencyAudioStep)
+		delay := 100 * time.Millisecond
+		if i == 50 {
+			delay = 500 * time.Millisecond
+		}
+		packet, err := packetWithCaptureTime(rtp.NewAbsCaptureTimeExtension(arrival.Add(-delay)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		estimator.Update(packet, arrival)
+		if i == 50 && !captureLatencyNear(estimator.Latency(), 125*time.Millisecond) {
+			t.Fatalf("smoothed latency %v after a 500ms outlier, want 125ms", estimator.Latency())
+		}
+	}
+	if got := estimator.Latency(); got < 100*time.Millisecond || got > 102*time.Millisecond {
+		t.Fatalf("smoothed latency %v 49 packets after the outlier, want 100..102ms", got)
+	}
+}
+
+// TestCaptureLatencyLoopback は --measure-latency でabs-capture-timeがネゴシエーションされ、
+// StreamManagerが送信側の付けたキャプチャ時刻から遅延を報告することを検証する
+func TestCaptureLatencyLoopback(t *testing.T) {
+	const delay = 80 * time.Millisecond
+	MeasureLatency = true
+	defer func() { MeasureLatency = false }()
+
+	mediaReceived := make(chan struct{}, 1)
+	streamManager := NewStreamManager(&discardWriter{}, NewDefaultRTPProcessor(), 0, mediaReceived)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	if err := RegisterAbsCaptureTime(senderEngine); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtpSender, err := sender.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(receiver, sender); err != nil {
+		t.Fatal(err)
+	}
+	var id int
+	for _, ext := range rtpSender.GetParameters().HeaderExtensions {
+		if ext.URI == AbsCaptureTimeURI {
+			id = ext.ID
+		}
+	}
+	if id == 0 {
+		t.Fatalf("abs-capture-time was not negotiated")
+	}
+
+	go streamManager.Run()
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	defer func() {
+		receiver.Close()
+		streamManager.Stop()
+	}()
+
+	// SRTPの準備完了前のパケットは破棄されるため、十分な数を受信するまで送り続ける
+	var stats []TrackJitter
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; time.Now().Before(deadline); i++ {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * captureLatencyAudioTicks)},
+			Payload: opusSilence,
+		}
+		payload, err := rtp.NewAbsCaptureTimeExtension(time.Now().Add(-delay)).Marshal()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := packet.SetExtension(uint8(id), payload); err != nil {
+			t.Fatal(err)
+		}
+		if err := track.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(captureLatencyAudioStep)
+		stats = streamManager.Jitter()
+		if len(stats) == 1 && stats[0].LatencySamples >= 25 {
+			break
+		}
+	}
+	if len(stats) != 1 || stats[0].LatencySamples < 25 {
+		t.Fatalf("StreamManager reported %+v, want one audio track with at least 25 latency samples", stats)
+	}
+	// ループバックの転送時間の分だけ遅延は大きくなるため、上限には余裕を持たせる
+	if stats[0].Latency < delay || stats[0].Latency > delay+50*time.Millisecond {
+		t.Fatalf("latency %v on loopback, want %v..%v", stats[0].Latency, delay, delay+50*time.Millisecond)
+	}
+}
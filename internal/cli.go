@@ -3,22 +3,158 @@ package internal
 import (
 	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/spf13/pflag"
 )
 
 var (
-	WhepURL           string
-	WhipURL           string
-	DebugMode         bool
-	NoFrameValidation bool
-	NoPacing          bool
-	DropThreshold     int // 遅延フレーム破棄閾値（ミリ秒）
-	VideoBitrateKbps  int // VP8目標ビットレート（kbps）
-	CPUProfilePath    string
-	MemProfilePath    string
+	WhepURL            string
+	WhipURL            string
+	DebugMode          bool
+	NoFrameValidation  bool
+	NoPacing           bool
+	DropThreshold      int // 遅延フレーム破棄閾値（ミリ秒）
+	VideoBitrateKbps   int // VP8目標ビットレート（kbps）
+	CPUProfilePath     string
+	MemProfilePath     string
+	DisableMDNS        bool   // mDNSによるホスト候補の秘匿を無効化
+	CheckMode          bool   // 接続前チェックのみ実行して終了
+	DryRun             bool   // offerと実際に使う設定を表示して終了（サーバーには接続しない）
+	NoReencode         bool   // 入力がVP8/VP9の場合は再エンコードせずに送信
+	PLIIntervalMs      int    // キーフレーム要求（PLI）の最小送信間隔（ミリ秒）
+	KeyframeTimeoutMs  int    // 最初の映像フレームからキーフレームをデコードできるまでの待機上限（ミリ秒、0で無効）
+	ConcealFrames      int    // デコード失敗時に最後の正常フレームを繰り返す連続数（超えたらキーフレームまで映像を出力しない）
+	DecodeStallMs      int    // デコード失敗からキーフレームで復帰するまでの待機上限（ミリ秒、0で無効）
+	AudioOnlyTimeoutMs int    // 最初の音声から映像が届かない場合に音声のみのMKVとするまでの時間（ミリ秒、0で無効）
+	SyncStart          bool   // MKVの書き込みを映像キーフレームと音声が揃うまで待ち、最初のブロックをtimecode 0にそろえる
+	SyncStartTimeoutMs int    // --sync-start で映像のキーフレームから音声を待つ上限（ミリ秒、0で無制限）
+	AudioDelayMs       int    // MKVの音声timecodeに加えるオフセット（ミリ秒、負の値で音声を早める）
+	ConnectTimeoutMs   int    // SDP交換後にICE接続を待つ上限（ミリ秒）
+	ICECheckTimeoutMs  int    // ICEがcheckingのまま進まない場合に候補ペアを表示するまでの時間（ミリ秒、0で無効）
+	ICERestart         bool   // ICEがcheckingのまま進まない場合にICE restartを1回行う
+	MediaTimeoutMs     int    // ICE接続後に最初のRTPを待つ上限（ミリ秒）
+	StreamTimeoutMs    int    // 受信開始後にトラックのRTPが途絶えたとみなすまでの時間（ミリ秒、0で無効）
+	VerboseSDP         bool   // offer/answerの要約と差分を出力
+	VideoSSRC          uint32 // 映像送信SSRC（0でランダム）
+	AudioSSRC          uint32 // 音声送信SSRC（0でランダム）
+	CNAME              string // 送信トラックのCNAME
+	NoNACK             bool   // NACKによる再送を無効化
+	NoTWCC             bool   // TWCCフィードバックを無効化
+	CongestionControl  string // 送信側輻輳制御（"gcc"で帯域推定を有効化）
+	InterleaveWindowMs int    // MKV出力前にA/Vブロックを並べ替えるため保持する時間（ミリ秒、0で無効）
+	InterleaveDepth    int    // 並べ替えのため保持するブロック数の上限
+	WHEPEvents         bool   // WHEPのserver-sent events拡張を購読
+	WHEPTwoPhase       bool   // offerの前に空のPOSTでセッションを作成し、offerをPATCHで送る
+	OptionsICEServers  bool   // offerの前にOPTIONSでエンドポイントのICEサーバーを問い合わせる
+	MKVTimecodeScale   int    // 出力MKVのTimecodeScale（ナノ秒）
+	OutputBufferSize   int    // MKV出力のバッファサイズ（バイト）
+	FlushIntervalMs    int    // MKV出力をフラッシュする間隔（ミリ秒、0でブロックごと）
+	VP8Partitions      bool   // VP8パーティション境界を保持してパケット化
+	PayloadTypes       string // コーデックごとのペイロードタイプ指定（例: "vp8=100,opus=111"）
+	StatsFormat        string // 統計出力形式（human, logfmt, json）
+	AudioCatchupMs     int    // 音声の遅れがこれを超えたらエンコード前にPCMを破棄する（ミリ秒、0で無効）
+	ProbeMode          bool   // ストリームの性質を計測して表示し終了
+	Simulcast          string // simulcastのRID（低解像度から順にカンマ区切り）
+	SimulcastRIDs      []string
+	Input              string // whip-goの入力形式（mkv, y4m, testsrc）
+	InputPixelFormat   string // 入力rawvideoの画素形式を強制する（RGBA, YUV420P, I420、空で入力の指定に従う）
+	EncodeDeadline     string // VP8エンコードのdeadline（realtime, good, best）
+	CPUUsed            int    // VP8のcpu-used（大きいほど高速・低画質）
+	ErrorResilient     bool   // VP8のエラー耐性モード（フレーム間で確率テーブルを引き継がない）
+	TokenPartitions    int    // VP8のトークンパーティション数（1, 2, 4, 8）
+	KeyframeInterval   int    // VP8のキーフレーム最大間隔（フレーム数）
+	ForceKeyframeEvery int    // エンコーダーの判断によらずキーフレームを強制する間隔（フレーム数、0で無効）
+	QueueCapacity      int    // whip-goの送信前フレームキューの容量（フレーム数）
+	SpillDir           string // キューが満杯で破棄したフレームを書き出すディレクトリ（空で無効）
+	SpillMaxSize       int64  // --spill-dir に書き出すファイルの合計の上限（バイト）
+	PostRetries        int    // whip-goのofferのPOSTを一時的な失敗でやり直す回数
+	PostRetryBackoffMs int    // 最初のやり直しまでの待ち時間（ミリ秒、やり直すごとに2倍）
+	MaxBlockSize       int64  // 入力MKVで読み込むBlockの最大サイズ（バイト、0で無制限）
+	PresetName         string // 遅延と品質のプリセット（low-latency, balanced, quality）
+	OutputFormat       string // whep-goの出力形式（mkv, ivf）
+	VideoCodec         string // whep-goが優先して受信する映像コーデック（auto, vp8, vp9）
+	CodecFallback      bool   // --codec のコーデックがanswerに無い場合に、answerのコーデックで受信する
+	OutputPath         string // whep-goの出力先ファイル（空でstdout、SIGHUPで開き直す）
+	HealthAddr         string // /healthz, /readyz を提供するHTTPサーバーの待ち受けアドレス（空で無効）
+	OnWriteError       string // フレーム単位の書き込みエラー時の動作（exit, reconnect, ignore）
+	BundlePolicy       string // PeerConnectionのBundlePolicy（balanced, max-compat, max-bundle）
+	MaxFPS             int    // whip-goでエンコード前に間引く最大フレームレート（0で無効）
+	MaxSendBitrateKbps int    // whip-goが送信するRTPの合計ビットレートの上限（kbps、0で無効）
+	PTSMonotonic       string // whip-goの入力PTSが戻った場合の処理（off, drop, rebase）
+	PTSToleranceMs     int    // --pts-monotonic で揺らぎとみなして通す、PTSが戻る幅（ミリ秒）
+	DSCP               string // 送信メディアパケットのDSCP（ef, af41, cs5 等または0-63、空で無効）
+	DSCPCodepoint      int
+	UDPRecvBuffer      int         // メディア用UDPソケットの受信バッファサイズ（バイト、0でOSのデフォルト）
+	Extensions         string      // offerに載せるRTPヘッダー拡張（カンマ区切り、none で無し）
+	RobustClusters     bool        // MKVのクラスタにPosition/PrevSizeを書き込む（通常のファイルへの出力では常に有効）
+	MaxTemporalLayer   int         // 受信時にこれより上のVP8/VP9テンポラルレイヤーを破棄する（-1で全レイヤー）
+	SpatialLayer       int         // 受信時にこれより上のVP9空間レイヤーを破棄する（-1で全レイヤー）
+	SimulateLoss       float64     // 受信RTPパケットを破棄する割合（%、回復処理の確認用、0で無効）
+	LossSeed           int64       // --simulate-loss の乱数シード（0で起動時刻から決める）
+	AutoRotate         bool        // CVOヘッダー拡張の回転をMKVのProjectionに書き込む
+	MeasureLatency     bool        // abs-capture-timeヘッダー拡張からend-to-end遅延を計測して統計に出す
+	MKVCRC             bool        // MKVのInfo/TracksにCRC-32要素を書き込む
+	NoDate             bool        // MKVのInfoにDateUTCを書き込まない（再現可能な出力用）
+	SegmentUIDSeed     int64       // MKVのSegmentUIDの乱数シード（0でランダム）
+	MKVTrackLayout     string      // MKVのトラック番号とTrackUID（VIDEO[:UID],AUDIO[:UID]、空で1,2）
+	MKVTracks          TrackLayout // 未設定（VideoNumが0）の場合はDefaultTrackLayout
+	AudioTracks        string      // 書き込む音声トラック（all, first または0始まりのインデックス）
+	AudioTrackIndex    int         // AudioTracksAllIndexで全トラック
+	SelectSSRC         uint32      // 書き込む映像トラックのSSRC（0で指定しない）
+	SelectMID          string      // 書き込む映像トラックのMID（空で指定しない）
+	MKVTitle           string      // MKVのTagsに書き込むタイトル（TITLE、空で書き込まない）
+	MKVTagArgs         []string    // MKVのTagsに書き込むタグ（KEY=VALUE、複数指定可）
+	MKVTags            []MKVTag    // --title と --tag から作る書き込むタグ（録画元のURLタグを含む）
+	MuxingApp          string      // MKVのInfoに書き込むMuxingApp
+	WritingApp         string      // MKVのInfoに書き込むWritingApp
+	KeyframesOnly      bool        // whep-goで映像のキーフレームのみを書き込む（差分フレームは破棄）
+	VideoOutPath       string      // whep-goの映像のみの出力先ファイル（.mkv, .ivf、--audio-out と同時に書き込む）
+	AudioOutPath       string      // whep-goの音声のみの出力先ファイル（.ogg, .opus, .mka）
+	VideoOutFormat     string      // --video-out の拡張子から決めた出力形式（未指定で空）
+	AudioOutFormat     string      // --audio-out の拡張子から決めた出力形式（未指定で空）
+	WAVOutPath         string      // whep-goで音声をデコードしたPCMを書き込むWAVファイル（空で無効）
 )
 
+// --output-format の値
+const (
+	OutputFormatMKV = "mkv" // デコードしたrawvideo（RGBA）とOpusのMKV
+	OutputFormatIVF = "ivf" // デコードせずにVP8/VP9ビットストリームをそのまま格納したIVF（映像のみ）
+)
+
+// --codec の値
+const (
+	VideoCodecAuto = "auto" // answerで選ばれたコーデックを受信する
+	VideoCodecVP8  = "vp8"
+	VideoCodecVP9  = "vp9"
+)
+
+// --bundle-policy の値（W3CのRTCBundlePolicyと同じ名前）
+const (
+	BundlePolicyBalanced  = "balanced"   // BUNDLEされないanswerも受け付ける（デフォルト）
+	BundlePolicyMaxCompat = "max-compat" // balancedと同様（pionはm-lineごとのトランスポートを持てない）
+	BundlePolicyMaxBundle = "max-bundle" // BUNDLEされないanswerはエラーとする
+)
+
+// --on-write-error の値
+const (
+	OnWriteErrorExit      = "exit"      // エラーで終了する
+	OnWriteErrorReconnect = "reconnect" // WHEPセッションを張り直す（出力は継続）
+	OnWriteErrorIgnore    = "ignore"    // そのフレームを破棄して続ける
+)
+
+// --output-buffer の範囲
+const (
+	minOutputBufferSize = 4 * 1024
+	maxOutputBufferSize = 64 * 1024 * 1024
+)
+
+// simulcastの最大レイヤー数（エンコーダー数に比例してCPU負荷が増えるため上限を設ける）
+const maxSimulcastLayers = 3
+
 func init() {
 	pflag.BoolVarP(&DebugMode, "debug", "d", false, "Enable debug logging")
 	pflag.BoolVar(&NoFrameValidation, "no-validate", false, "Disable frame validation (show raw packet loss artifacts)")
@@ -27,6 +163,96 @@ func init() {
 	pflag.IntVarP(&VideoBitrateKbps, "video-bitrate-kbps", "b", 5000, "VP8 target video bitrate in kbps")
 	pflag.StringVar(&CPUProfilePath, "cpu-profile", "", "Write CPU profile to file (whip-go only)")
 	pflag.StringVar(&MemProfilePath, "mem-profile", "", "Write heap profile to file at exit (whip-go only)")
+	pflag.BoolVar(&DisableMDNS, "disable-mdns", false, "Advertise real host IPs instead of mDNS .local candidates (exposes local IPs to the server)")
+	pflag.StringVar(&HealthAddr, "health-addr", "", "Serve /healthz (process up) and /readyz (ICE connected and media flowing, 503 otherwise) on this address, e.g. \":8080\"")
+	pflag.BoolVar(&CheckMode, "check", false, "Run a preflight check (ICE gathering and endpoint reachability) and exit")
+	pflag.BoolVar(&DryRun, "dry-run", false, "Create the PeerConnection and SDP offer, print the offer and the effective ICE, codec and flag configuration to stdout, then exit without contacting the server")
+	pflag.BoolVar(&ProbeMode, "probe", false, "Receive about 2 seconds of the stream, print codec, resolution, fps and bitrate per track, then exit (whep-go only)")
+	pflag.BoolVar(&NoReencode, "no-reencode", false, "Send V_VP8/V_VP9 input as-is without re-encoding (whip-go only)")
+	pflag.IntVar(&PLIIntervalMs, "pli-interval", 1000, "Minimum interval in milliseconds between keyframe requests (PLI), backed off while no keyframe arrives; whip-go forces at most one keyframe per interval for the PLI/FIR it receives")
+	pflag.IntVar(&AudioOnlyTimeoutMs, "audio-only-timeout", 0, "Write an audio-only MKV when no video frame arrives within this many milliseconds of the first audio frame, 0 (default) to keep waiting for video; a server answer without video switches immediately (whep-go only)")
+	pflag.IntVar(&ConnectTimeoutMs, "connect-timeout", 10000, "Fail the attempt if ICE does not connect within this many milliseconds of the SDP exchange (whep-go only)")
+	pflag.IntVar(&ICECheckTimeoutMs, "ice-checking-timeout", 5000, "Print the candidate pair states when ICE stays in checking for this many milliseconds without receiving any STUN response or request, 0 to disable")
+	pflag.BoolVar(&ICERestart, "ice-restart", false, "When ICE is stuck in checking for --ice-checking-timeout, restart ICE once with new credentials via a PATCH to the session resource (RFC 9725)")
+	pflag.IntVar(&MediaTimeoutMs, "media-timeout", 5000, "Fail the attempt if no RTP arrives within this many milliseconds of ICE connecting, e.g. DTLS/SRTP failed or the server is not sending (whep-go only)")
+	pflag.IntVar(&StreamTimeoutMs, "stream-timeout", 2000, "Reconnect when a track that was receiving gets no RTP for this many milliseconds, 0 to wait forever (whep-go only)")
+	pflag.BoolVar(&SyncStart, "sync-start", false, "Hold MKV output until both a decoded video keyframe and the first audio frame are available, then start both at timecode 0 so playback does not begin with one of them missing (whep-go only)")
+	pflag.IntVar(&SyncStartTimeoutMs, "sync-start-timeout", 2000, "With --sync-start, start with video only if no audio arrives within this many milliseconds of the first decoded keyframe, 0 to wait for audio forever (whep-go only)")
+	pflag.IntVar(&AudioDelayMs, "audio-delay-ms", 0, "Shift audio block timecodes in the MKV output by this many milliseconds to correct a fixed lip-sync offset of the source; negative values make audio earlier, clamped at timecode 0 (whep-go only)")
+	pflag.IntVar(&KeyframeTimeoutMs, "keyframe-timeout", 10000, "Fail if no decodable keyframe arrives within this many milliseconds of the first video frame (a burst of PLIs is sent halfway), 0 to wait forever (whep-go only)")
+	pflag.IntVar(&ConcealFrames, "conceal-frames", 5, "On decode errors or corrupt frames, repeat the last good frame for up to this many consecutive failures while requesting a keyframe (PLI), then write no video until a keyframe arrives (whep-go only)")
+	pflag.IntVar(&DecodeStallMs, "decode-stall-timeout", 10000, "Give up on the session (exit, or as set by --on-write-error) when video has not recovered with a keyframe within this many milliseconds of the first decode error, 0 to wait forever (whep-go only)")
+	pflag.BoolVar(&VerboseSDP, "verbose-sdp", false, "Print a per-m-line summary of the SDP offer/answer and codecs that were not answered")
+	pflag.Uint32Var(&VideoSSRC, "ssrc-video", 0, "SSRC for the outgoing video track, 0 for random (whip-go only)")
+	pflag.Uint32Var(&AudioSSRC, "ssrc-audio", 0, "SSRC for the outgoing audio track, 0 for random (whip-go only)")
+	pflag.StringVar(&CNAME, "cname", "", "RTCP CNAME for the outgoing tracks (default \"whip-go\", whip-go only)")
+	pflag.BoolVar(&NoNACK, "no-nack", false, "Disable NACK retransmission (lower latency, but packet loss becomes visible)")
+	pflag.BoolVar(&NoTWCC, "no-twcc", false, "Disable transport-wide congestion control feedback (no sender-side bandwidth estimation)")
+	pflag.BoolVar(&NoTWCC, "no-twcc-feedback", false, "Same as --no-twcc: do not negotiate transport-wide-cc, so no TWCC feedback is sent for received media")
+	pflag.StringVar(&CongestionControl, "congestion-control", "", "Sender-side congestion control: \"gcc\" adapts the video bitrate to the TWCC bandwidth estimate (whip-go only)")
+	pflag.IntVar(&InterleaveWindowMs, "interleave-window", 0, "Hold MKV blocks this many milliseconds to write video/audio in timecode order, 0 to disable (whep-go only)")
+	pflag.IntVar(&InterleaveDepth, "interleave-depth", 16, "Maximum number of MKV blocks held for video/audio reordering (whep-go only)")
+	pflag.BoolVar(&WHEPEvents, "whep-events", false, "Subscribe to the WHEP server-sent events extension when advertised and log stream/layer changes (whep-go only)")
+	pflag.BoolVar(&WHEPTwoPhase, "whep-two-phase", false, "Two-phase WHEP handshake: POST without a body to create the session and get ICE servers, then PATCH the offer to the session resource; falls back to a single POST if the server rejects the empty POST (whep-go only)")
+	pflag.BoolVar(&OptionsICEServers, "options-ice-servers", false, "Before each offer, send OPTIONS to the endpoint and gather candidates with the STUN/TURN servers of its rel=\"ice-server\" links (waits up to 5s if the server does not answer OPTIONS)")
+	pflag.IntVar(&MKVTimecodeScale, "mkv-timecode-scale", 1000000, "Matroska TimecodeScale in nanoseconds for the output, e.g. 100000 for 0.1ms precision (whep-go only)")
+	pflag.StringVar(&OutputFormat, "output-format", OutputFormatMKV, "Output format: mkv (decoded rawvideo + Opus) or ivf (compressed VP8/VP9 as received, video only, no decoding) (whep-go only)")
+	pflag.StringVar(&VideoCodec, "codec", VideoCodecAuto, "Video codec to receive: auto (whatever the server answers), vp8 or vp9 (offered first); fails with the codecs the server answered if it does not pick it (whep-go only)")
+	pflag.BoolVar(&CodecFallback, "codec-fallback", false, "With --codec vp8/vp9, receive the codec the server answered instead of failing when it did not pick the requested one (whep-go only)")
+	pflag.StringVarP(&OutputPath, "output", "o", "", "Write to this file instead of stdout; on SIGHUP the current file is finished and the path is reopened as a new file without dropping the session, for logrotate-style rotation (whep-go only)")
+	pflag.StringVar(&OnWriteError, "on-write-error", OnWriteErrorExit, "What to do when a single frame cannot be processed or written: exit (default), reconnect (new WHEP session, continuing the same output) or ignore (drop the frame); output failures such as a closed pipe always exit (whep-go only)")
+	pflag.IntVar(&MaxTemporalLayer, "max-temporal-layer", -1, "Drop VP8/VP9 frames above this temporal layer ID before decoding to save CPU at a lower frame rate, e.g. 0 for the base layer only; -1 keeps all layers (whep-go only)")
+	pflag.IntVar(&SpatialLayer, "spatial-layer", -1, "Decode VP9 SVC only up to this spatial layer ID and drop higher layers before decoding, e.g. 0 for the lowest resolution on constrained devices; -1 keeps all layers (whep-go only)")
+	pflag.Float64Var(&SimulateLoss, "simulate-loss", 0, "Debug: drop this percentage (0-100) of received RTP packets before depacketization to exercise PLI, keyframe and frame validation recovery; dropped after the NACK interceptor, so they are not retransmitted (whep-go only)")
+	pflag.Int64Var(&LossSeed, "loss-seed", 0, "Random seed for --simulate-loss so the same packets are dropped on every run, 0 to pick one from the clock (printed at startup) (whep-go only)")
+	pflag.BoolVar(&AutoRotate, "auto-rotate", false, "Negotiate the urn:3gpp:video-orientation (CVO) RTP header extension and write the sender's rotation to MKV output as ProjectionPoseRoll so players show portrait video upright (whep-go only)")
+	pflag.StringVar(&AudioTracks, "audio-tracks", AudioTracksFirst, "Which audio tracks to receive and write to MKV output when the server sends several (e.g. program + commentary): all (up to 4, as separate MKV tracks numbered after the audio track), first, or a 0-based index in SDP order (whep-go only)")
+	pflag.Uint32Var(&SelectSSRC, "ssrc", 0, "Write only the incoming video track with this SSRC (decimal or 0x hex) and ignore other video tracks when the server sends several; up to 4 video tracks are offered; each track's SSRC, MID and RID are printed when it arrives (whep-go only)")
+	pflag.StringVar(&SelectMID, "mid", "", "Write only the incoming video track of this SDP media ID (MID) and ignore other video tracks when the server sends several; up to 4 video tracks are offered (whep-go only)")
+	pflag.StringVar(&MKVTrackLayout, "mkv-track-layout", "", "MKV track numbers and optional TrackUIDs as VIDEO[:UID],AUDIO[:UID], e.g. 3:1001,4:1002 to match an existing file when remuxing (default 1,2 with UIDs equal to the numbers) (whep-go only)")
+	pflag.BoolVar(&MeasureLatency, "measure-latency", false, "Negotiate the abs-capture-time RTP header extension and report the end-to-end (capture to receive) latency per track in stats; needs a sender that sets it and clocks synchronized with NTP (whep-go only)")
+	pflag.BoolVar(&MKVCRC, "mkv-crc", false, "Write a CRC-32 element into the MKV Info and Tracks elements so corrupted headers can be detected when the file is read back (whep-go only)")
+	pflag.BoolVar(&NoDate, "no-date", false, "Do not write the MKV DateUTC (recording start time) so the same input produces byte-identical output; combine with --segment-uid-seed (whep-go only)")
+	pflag.Int64Var(&SegmentUIDSeed, "segment-uid-seed", 0, "Random seed for the MKV SegmentUID so it is the same on every run (later segments in a run take the next UIDs in the sequence), 0 for a random UID per file (whep-go only)")
+	pflag.StringVar(&MKVTitle, "title", "", "Write this title into the MKV Tags element as a TITLE SimpleTag so players and media libraries can label the recording (whep-go only)")
+	pflag.StringArrayVar(&MKVTagArgs, "tag", nil, "Write a KEY=VALUE SimpleTag into the MKV Tags element, e.g. ARTIST=Alice; can be repeated; the WHEP URL is written as a URL tag unless --tag URL=... is given (whep-go only)")
+	pflag.StringVar(&MuxingApp, "muxing-app", DefaultAppName(), "MuxingApp string written into the MKV Info element (whep-go only)")
+	pflag.StringVar(&WritingApp, "writing-app", DefaultAppName(), "WritingApp string written into the MKV Info element, e.g. the name of the recorder that runs whep-go (whep-go only)")
+	pflag.BoolVar(&KeyframesOnly, "keyframes-only", false, "Write only video keyframes and drop the frames between them without decoding, for thumbnails or sparse archives; timecodes follow the RTP timestamps and audio is written as usual (whep-go only)")
+	pflag.StringVar(&VideoOutPath, "video-out", "", "Write video only to this file while --audio-out writes audio: .mkv (decoded rawvideo) or .ivf (VP8/VP9 as received); replaces --output (whep-go only)")
+	pflag.StringVar(&AudioOutPath, "audio-out", "", "Write audio only to this file while --video-out writes video: .ogg/.opus (Opus as received) or .mka (audio-only MKV); replaces --output (whep-go only)")
+	pflag.StringVar(&WAVOutPath, "wav-out", "", "Also decode the first audio track and write it as 48kHz stereo 16-bit PCM to this WAV file for audio analysis; gaps from lost packets are filled with silence (whep-go only)")
+	pflag.BoolVar(&RobustClusters, "robust-clusters", false, "Write Cluster Position/PrevSize elements to MKV output so players can recover after seeking or corruption; always on when stdout is a regular file (whep-go only)")
+	pflag.IntVar(&OutputBufferSize, "output-buffer", 64*1024, "MKV output buffer size in bytes; larger helps file output throughput, smaller lowers pipe latency (whep-go only)")
+	pflag.IntVar(&FlushIntervalMs, "flush-interval", 100, "Flush buffered MKV output at least this often in milliseconds (also on every keyframe), 0 to flush every block (whep-go only)")
+	pflag.StringVar(&PayloadTypes, "payload-types", "", "Override RTP payload types as codec=pt pairs, e.g. \"vp8=100,vp9=101,opus=111\" (dynamic range 96-127)")
+	pflag.StringVar(&StatsFormat, "stats-format", "human", "Periodic stats format: human (multi-line, debug only), logfmt or json (one line per interval, always printed); whep-go reports per-track receive jitter")
+	pflag.IntVar(&AudioCatchupMs, "audio-catchup-ms", 0, "Skip 10ms PCM frames before Opus encoding while audio is more than this many milliseconds behind, 0 (default) to disable (whip-go only)")
+	pflag.StringVar(&Input, "input", "mkv", "Input source: mkv (MKV on stdin), y4m (YUV4MPEG2 4:2:0 video on stdin, no audio) or testsrc (generated color bars and a 440Hz tone) (whip-go only)")
+	pflag.StringVar(&InputPixelFormat, "input-pixel-format", "", "Force the pixel format of input rawvideo frames regardless of what the input declares: RGBA, YUV420P or I420, e.g. YUV420P for ffmpeg MKV output without a ColourSpace element (whip-go only)")
+	pflag.StringVar(&Simulcast, "simulcast", "", "Send VP8 simulcast with these RIDs from lowest to highest quality, e.g. \"low,high\"; each lower layer is half the resolution and a quarter of the bitrate, and costs one extra encoder (whip-go only)")
+	pflag.StringVar(&EncodeDeadline, "encode-deadline", "realtime", "VP8 encode deadline: realtime (live), good or best (slower, for recording/transcode with --no-pacing) (whip-go only)")
+	pflag.IntVar(&CPUUsed, "cpu-used", 0, "VP8 cpu-used speed/quality trade-off: -16..16 for realtime, 0..5 for good, higher is faster (whip-go only)")
+	pflag.BoolVar(&ErrorResilient, "error-resilient", false, "Encode VP8 in error-resilient mode so a lost packet does not corrupt the entropy state of later frames, at a small bitrate cost (whip-go only)")
+	pflag.IntVar(&TokenPartitions, "partitions", 1, "Split each VP8 frame's coefficients into 1, 2, 4 or 8 token partitions; more than 1 turns on --vp8-partitions so each partition is packetized separately and a loss damages only part of the frame (whip-go only)")
+	pflag.StringVar(&PTSMonotonic, "pts-monotonic", PTSMonotonicOff, "When an input track's PTS jumps backward by more than --pts-tolerance: off (send as is), drop (drop frames until the PTS catches up) or rebase (shift the rest of the track to continue from the last PTS) (whip-go only)")
+	pflag.IntVar(&PTSToleranceMs, "pts-tolerance", 50, "Backward PTS steps up to this many milliseconds are treated as jitter and passed unchanged by --pts-monotonic (whip-go only)")
+	pflag.IntVar(&MaxSendBitrateKbps, "max-send-bitrate", 0, "Cap the total rate of sent RTP packets (video and audio) in kbps by delaying packets at the RTP write, independent of frame pacing, so bursts and --no-pacing do not flood the link; 0 to disable (whip-go only)")
+	pflag.IntVar(&MaxFPS, "max-fps", 0, "Drop input video frames by PTS before encoding so at most this many frames per second are sent, 0 to disable; ignored with --no-reencode passthrough (whip-go only)")
+	pflag.IntVar(&KeyframeInterval, "keyframe-interval", 30, "Maximum number of frames between VP8 keyframes (whip-go only)")
+	pflag.IntVar(&ForceKeyframeEvery, "force-keyframe-interval", 0, "Force a VP8 keyframe every this many encoded frames regardless of the encoder's own keyframe decisions, for SFUs that need a fixed keyframe cadence, 0 to disable; ignored with --no-reencode passthrough (whip-go only)")
+	pflag.Int64Var(&MaxBlockSize, "max-block-size", 256*1024*1024, "Reject input MKV blocks larger than this many bytes with an error before buffering them; the default fits one 8K RGBA frame, 0 for no limit (whip-go only)")
+	pflag.IntVar(&QueueCapacity, "queue-capacity", 12, "Capacity in frames of the video/audio queues between input and encoder; latency trimming starts at a third of it (whip-go only)")
+	pflag.StringVar(&SpillDir, "spill-dir", "", "Write frames dropped because a send queue is full to a ring of files in this directory for later analysis; spilled frames are not re-sent (whip-go only)")
+	pflag.IntVar(&PostRetries, "post-retries", 2, "Retry the WHIP offer POST this many times on connection errors and 5xx responses (not on 4xx); a session the failed POST created is DELETEd first, 0 to disable (whip-go only)")
+	pflag.IntVar(&PostRetryBackoffMs, "post-retry-backoff", 500, "Wait this many milliseconds before the first WHIP POST retry, doubling on each further retry (whip-go only)")
+	pflag.Int64Var(&SpillMaxSize, "spill-max-size", 1024*1024*1024, "Total size limit in bytes of the --spill-dir files; the oldest file is overwritten once the ring is full (whip-go only)")
+	pflag.StringVar(&BundlePolicy, "bundle-policy", BundlePolicyBalanced, "Bundle policy: balanced or max-compat accept answers that do not bundle all m-lines if they share one ICE transport; max-bundle rejects them")
+	pflag.StringVar(&DSCP, "dscp", "", "Mark outgoing media packets with this DSCP value: ef, afXY, csN or 0-63 (empty to leave unmarked; Linux/macOS/BSD, ignored by Windows without a QoS policy)")
+	pflag.IntVar(&UDPRecvBuffer, "udp-recv-buffer", 0, "Request this UDP socket receive buffer size in bytes for media sockets so high-bitrate bursts are not lost before they are read, e.g. 4194304; the OS may clamp it (Linux: net.core.rmem_max), 0 to keep the OS default")
+	pflag.StringVar(&Extensions, "extensions", strings.Join(defaultExtensions, ","), "RTP header extensions to offer as a=extmap lines, comma separated: "+supportedExtensionNames()+"; \"none\" offers none (transport-cc is left out with --no-twcc)")
+	pflag.StringVar(&PresetName, "preset", "", "Set buffering, pacing and encoder flags at once: low-latency, balanced or quality; flags given explicitly take precedence")
+	pflag.BoolVar(&VP8Partitions, "vp8-partitions", false, "Packetize each VP8 partition separately with partition index (PID) and start bits (whip-go only)")
 }
 
 func SetupUsage() {
@@ -38,7 +264,11 @@ func SetupUsage() {
 		fmt.Fprintf(os.Stderr, "  WHEP_URL    WHEP server URL (required)\n\n")
 		fmt.Fprintf(os.Stderr, "Examples:\n")
 		fmt.Fprintf(os.Stderr, "  %s http://example.com/whep | ffplay -i -\n", os.Args[0])
-		fmt.Fprintf(os.Stderr, "  %s http://example.com/whep -d | ffplay -i -\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s http://example.com/whep -d | ffplay -i -\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s http://example.com/whep --output-format ivf > stream.ivf\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s http://example.com/whep -o recording.mkv\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s http://example.com/whep --check\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s http://example.com/whep --probe\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		pflag.PrintDefaults()
 	}
@@ -50,7 +280,130 @@ func ParseArgs() error {
 		return fmt.Errorf("WHEP_URL is required")
 	}
 	WhepURL = args[0]
-	return nil
+	if err := applyPreset(PresetName); err != nil {
+		return err
+	}
+	if MKVTimecodeScale <= 0 || MKVTimecodeScale > 1000000000 {
+		return fmt.Errorf("invalid --mkv-timecode-scale: %d (must be 1..1000000000)", MKVTimecodeScale)
+	}
+	if OutputBufferSize < minOutputBufferSize || OutputBufferSize > maxOutputBufferSize {
+		return fmt.Errorf("invalid --output-buffer: %d (must be %d..%d)", OutputBufferSize, minOutputBufferSize, maxOutputBufferSize)
+	}
+	if FlushIntervalMs < 0 {
+		return fmt.Errorf("invalid --flush-interval: %d (must be >= 0)", FlushIntervalMs)
+	}
+	if ConnectTimeoutMs <= 0 {
+		return fmt.Errorf("invalid --connect-timeout: %d (must be > 0)", ConnectTimeoutMs)
+	}
+	if MediaTimeoutMs <= 0 {
+		return fmt.Errorf("invalid --media-timeout: %d (must be > 0)", MediaTimeoutMs)
+	}
+	if StreamTimeoutMs < 0 {
+		return fmt.Errorf("invalid --stream-timeout: %d (must be >= 0)", StreamTimeoutMs)
+	}
+	if KeyframeTimeoutMs < 0 {
+		return fmt.Errorf("invalid --keyframe-timeout: %d (must be >= 0)", KeyframeTimeoutMs)
+	}
+	if ConcealFrames < 0 {
+		return fmt.Errorf("invalid --conceal-frames: %d (must be >= 0)", ConcealFrames)
+	}
+	if DecodeStallMs < 0 {
+		return fmt.Errorf("invalid --decode-stall-timeout: %d (must be >= 0)", DecodeStallMs)
+	}
+	if AudioOnlyTimeoutMs < 0 {
+		return fmt.Errorf("invalid --audio-only-timeout: %d (must be >= 0)", AudioOnlyTimeoutMs)
+	}
+	if SyncStartTimeoutMs < 0 {
+		return fmt.Errorf("invalid --sync-start-timeout: %d (must be >= 0)", SyncStartTimeoutMs)
+	}
+	if err := validateStatsFormat(StatsFormat); err != nil {
+		return err
+	}
+	if MaxTemporalLayer < -1 || MaxTemporalLayer > 7 {
+		return fmt.Errorf("invalid --max-temporal-layer: %d (must be -1..7)", MaxTemporalLayer)
+	}
+	if SpatialLayer < -1 || SpatialLayer > 7 {
+		return fmt.Errorf("invalid --spatial-layer: %d (must be -1..7)", SpatialLayer)
+	}
+	if SimulateLoss < 0 || SimulateLoss > 100 {
+		return fmt.Errorf("invalid --simulate-loss: %g (must be 0..100)", SimulateLoss)
+	}
+	if SimulateLoss > 0 && LossSeed == 0 {
+		LossSeed = time.Now().UnixNano()
+	}
+	if err := ValidateOutputFormat(OutputFormat); err != nil {
+		return err
+	}
+	if err := ValidateVideoCodec(VideoCodec); err != nil {
+		return err
+	}
+	if err := ValidateOnWriteError(OnWriteError); err != nil {
+		return err
+	}
+	if err := ValidateBundlePolicy(BundlePolicy); err != nil {
+		return err
+	}
+	layout, err := ParseTrackLayout(MKVTrackLayout)
+	if err != nil {
+		return err
+	}
+	MKVTracks = layout
+	audioIndex, err := ParseAudioTracks(AudioTracks)
+	if err != nil {
+		return err
+	}
+	AudioTrackIndex = audioIndex
+	tags, err := ParseMKVTags(MKVTitle, MKVTagArgs)
+	if err != nil {
+		return err
+	}
+	MKVTags = WithSourceURLTag(tags, WhepURL)
+	if MuxingApp == "" || WritingApp == "" {
+		return fmt.Errorf("--muxing-app and --writing-app must not be empty")
+	}
+	if VideoOutPath != "" || AudioOutPath != "" {
+		if OutputPath != "" {
+			return fmt.Errorf("--video-out and --audio-out cannot be combined with --output")
+		}
+		if OutputFormat != OutputFormatMKV {
+			return fmt.Errorf("--video-out and --audio-out choose the format from the file extension, do not set --output-format")
+		}
+		if VideoOutPath != "" && filepath.Clean(VideoOutPath) == filepath.Clean(AudioOutPath) {
+			return fmt.Errorf("--video-out and --audio-out must be different files")
+		}
+		if VideoOutPath != "" {
+			if VideoOutFormat, err = SplitOutputFormat(VideoOutPath, true); err != nil {
+				return err
+			}
+		}
+		if AudioOutPath != "" {
+			if AudioOutFormat, err = SplitOutputFormat(AudioOutPath, false); err != nil {
+				return err
+			}
+		}
+	}
+	if WAVOutPath != "" {
+		for _, other := range []string{OutputPath, VideoOutPath, AudioOutPath} {
+			if other != "" && filepath.Clean(other) == filepath.Clean(WAVOutPath) {
+				return fmt.Errorf("--wav-out must be a different file from the other outputs")
+			}
+		}
+	}
+	codepoint, err := ParseDSCP(DSCP)
+	if err != nil {
+		return err
+	}
+	DSCPCodepoint = codepoint
+	if UDPRecvBuffer < 0 {
+		return fmt.Errorf("invalid --udp-recv-buffer: %d (must be >= 0)", UDPRecvBuffer)
+	}
+	if ICECheckTimeoutMs < 0 {
+		return fmt.Errorf("invalid --ice-checking-timeout: %d (must be >= 0)", ICECheckTimeoutMs)
+	}
+	if _, err := ParseExtensions(Extensions); err != nil {
+		return err
+	}
+	return parsePayloadTypes(PayloadTypes)
 }
 
 func SetupWhipUsage() {
@@ -61,20 +414,273 @@ func SetupWhipUsage() {
 		fmt.Fprintf(os.Stderr, "Arguments:\n")
 		fmt.Fprintf(os.Stderr, "  WHIP_URL    WHIP server URL (required)\n\n")
 		fmt.Fprintf(os.Stderr, "Input:\n")
-		fmt.Fprintf(os.Stderr, "  stdin       MKV stream with rawvideo (RGBA) + Opus audio\n\n")
+		fmt.Fprintf(os.Stderr, "  stdin       MKV stream with rawvideo (RGBA) + Opus audio (--input mkv)\n")
+		fmt.Fprintf(os.Stderr, "  stdin       YUV4MPEG2 4:2:0 video, e.g. ffmpeg -f yuv4mpegpipe (--input y4m)\n")
+		fmt.Fprintf(os.Stderr, "  testsrc     Generated 640x360 30fps color bars + 440Hz tone (--input testsrc)\n\n")
 		fmt.Fprintf(os.Stderr, "Examples:\n")
 		fmt.Fprintf(os.Stderr, "  cat video.mkv | %s http://example.com/whip\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  ffmpeg -i input.mp4 -pix_fmt yuv420p -f yuv4mpegpipe - | %s --input y4m http://example.com/whip\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  %s --input testsrc http://example.com/whip\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "  whep-go http://in.example.com/whep | %s http://out.example.com/whip\n\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		pflag.PrintDefaults()
 	}
 }
 
+// validateStatsFormat は --stats-format の値を検証する
+func validateStatsFormat(format string) error {
+	switch format {
+	case "human", "logfmt", "json":
+		return nil
+	}
+	return fmt.Errorf("invalid --stats-format: %s (supported: human, logfmt, json)", format)
+}
+
 func ParseWhipArgs() error {
 	args := pflag.Args()
 	if len(args) < 1 {
 		return fmt.Errorf("WHIP_URL is required")
 	}
 	WhipURL = args[0]
+	if err := applyPreset(PresetName); err != nil {
+		return err
+	}
+	if err := validateStatsFormat(StatsFormat); err != nil {
+		return err
+	}
+	switch Input {
+	case "mkv", "y4m", "testsrc":
+	default:
+		return fmt.Errorf("invalid --input: %s (supported: mkv, y4m, testsrc)", Input)
+	}
+	if err := ValidateInputPixelFormat(InputPixelFormat); err != nil {
+		return err
+	}
+	if err := validateEncodeDeadline(EncodeDeadline, CPUUsed); err != nil {
+		return err
+	}
+	if err := validateTokenPartitions(TokenPartitions); err != nil {
+		return err
+	}
+	// 複数のトークンパーティションは、パーティションごとにパケット化しないと損失を局所化できない
+	if TokenPartitions > 1 {
+		VP8Partitions = true
+	}
+	if KeyframeInterval < 1 {
+		return fmt.Errorf("invalid --keyframe-interval: %d (must be >= 1)", KeyframeInterval)
+	}
+	if ForceKeyframeEvery < 0 {
+		return fmt.Errorf("invalid --force-keyframe-interval: %d (must be >= 0)", ForceKeyframeEvery)
+	}
+	if MaxBlockSize < 0 {
+		return fmt.Errorf("invalid --max-block-size: %d (must be >= 0)", MaxBlockSize)
+	}
+	if QueueCapacity < 1 {
+		return fmt.Errorf("invalid --queue-capacity: %d (must be >= 1)", QueueCapacity)
+	}
+	if SpillMaxSize < 1024*1024 {
+		return fmt.Errorf("invalid --spill-max-size: %d (must be >= 1048576)", SpillMaxSize)
+	}
+	if PostRetries < 0 {
+		return fmt.Errorf("invalid --post-retries: %d (must be >= 0)", PostRetries)
+	}
+	if PostRetryBackoffMs < 0 {
+		return fmt.Errorf("invalid --post-retry-backoff: %d (must be >= 0)", PostRetryBackoffMs)
+	}
+	if MaxFPS < 0 {
+		return fmt.Errorf("invalid --max-fps: %d (must be >= 0)", MaxFPS)
+	}
+	if MaxSendBitrateKbps < 0 {
+		return fmt.Errorf("invalid --max-send-bitrate: %d (must be >= 0)", MaxSendBitrateKbps)
+	}
+	if err := ValidatePTSMonotonic(PTSMonotonic); err != nil {
+		return err
+	}
+	if PTSToleranceMs < 0 {
+		return fmt.Errorf("invalid --pts-tolerance: %d (must be >= 0)", PTSToleranceMs)
+	}
+	rids, err := parseSimulcastRIDs(Simulcast)
+	if err != nil {
+		return err
+	}
+	if len(rids) > 0 && CongestionControl != "" {
+		return fmt.Errorf("--simulcast cannot be combined with --congestion-control")
+	}
+	if len(rids) > 0 && (!ExtensionEnabled("mid") || !ExtensionEnabled("rid")) {
+		return fmt.Errorf("--simulcast requires the mid and rid header extensions in --extensions")
+	}
+	SimulcastRIDs = rids
+	if err := ValidateBundlePolicy(BundlePolicy); err != nil {
+		return err
+	}
+	codepoint, err := ParseDSCP(DSCP)
+	if err != nil {
+		return err
+	}
+	DSCPCodepoint = codepoint
+	if UDPRecvBuffer < 0 {
+		return fmt.Errorf("invalid --udp-recv-buffer: %d (must be >= 0)", UDPRecvBuffer)
+	}
+	if ICECheckTimeoutMs < 0 {
+		return fmt.Errorf("invalid --ice-checking-timeout: %d (must be >= 0)", ICECheckTimeoutMs)
+	}
+	if _, err := ParseExtensions(Extensions); err != nil {
+		return err
+	}
+	return parsePayloadTypes(PayloadTypes)
+}
+
+// ValidateBundlePolicy は --bundle-policy の値を検証する
+func ValidateBundlePolicy(policy string) error {
+	switch policy {
+	case BundlePolicyBalanced, BundlePolicyMaxCompat, BundlePolicyMaxBundle:
+		return nil
+	default:
+		return fmt.Errorf("invalid --bundle-policy: %s (supported: %s, %s, %s)", policy, BundlePolicyBalanced, BundlePolicyMaxCompat, BundlePolicyMaxBundle)
+	}
+}
+
+// ValidateOnWriteError は --on-write-error の値を検証する
+func ValidateOnWriteError(policy string) error {
+	switch policy {
+	case OnWriteErrorExit, OnWriteErrorReconnect, OnWriteErrorIgnore:
+		return nil
+	default:
+		return fmt.Errorf("invalid --on-write-error: %s (supported: %s, %s, %s)", policy, OnWriteErrorExit, OnWriteErrorReconnect, OnWriteErrorIgnore)
+	}
+}
+
+// ValidateVideoCodec は --codec の値を検証する
+func ValidateVideoCodec(codec string) error {
+	switch codec {
+	case VideoCodecAuto, VideoCodecVP8, VideoCodecVP9:
+		return nil
+	default:
+		return fmt.Errorf("invalid --codec: %s (supported: %s, %s, %s)", codec, VideoCodecAuto, VideoCodecVP8, VideoCodecVP9)
+	}
+}
+
+// ValidateOutputFormat は --output-format の値を検証する
+func ValidateOutputFormat(format string) error {
+	switch format {
+	case OutputFormatMKV, OutputFormatIVF:
+		return nil
+	default:
+		return fmt.Errorf("invalid --output-format: %s (supported: %s, %s)", format, OutputFormatMKV, OutputFormatIVF)
+	}
+}
+
+// validateTokenPartitions は --partitions を検証する（VP8のトークンパーティション数は2の累乗で8まで）
+func validateTokenPartitions(partitions int) error {
+	switch partitions {
+	case 1, 2, 4, 8:
+		return nil
+	default:
+		return fmt.Errorf("invalid --partitions: %d (supported: 1, 2, 4, 8)", partitions)
+	}
+}
+
+// validateEncodeDeadline は --encode-deadline と --cpu-used の組み合わせを検証する
+// libvpxのVP8はgoodでcpu-used 0〜5のみ、bestではcpu-usedを使わない
+func validateEncodeDeadline(deadline string, cpuUsed int) error {
+	switch deadline {
+	case "realtime":
+		if cpuUsed < -16 || cpuUsed > 16 {
+			return fmt.Errorf("invalid --cpu-used: %d (must be -16..16 with --encode-deadline realtime)", cpuUsed)
+		}
+	case "good":
+		if cpuUsed < 0 || cpuUsed > 5 {
+			return fmt.Errorf("invalid --cpu-used: %d (must be 0..5 with --encode-deadline good)", cpuUsed)
+		}
+	case "best":
+		if cpuUsed != 0 {
+			return fmt.Errorf("--cpu-used has no effect with --encode-deadline best")
+		}
+	default:
+		return fmt.Errorf("invalid --encode-deadline: %s (supported: realtime, good, best)", deadline)
+	}
+	return nil
+}
+
+// parseSimulcastRIDs は --simulcast のRID一覧を解析する
+// RIDはRFC 8851のrid-id（英数字、'-'、'_'）で、2〜maxSimulcastLayers個の重複しない値とする
+func parseSimulcastRIDs(spec string) ([]string, error) {
+	if spec == "" {
+		return nil, nil
+	}
+
+	var rids []string
+	seen := map[string]bool{}
+	for _, rid := range strings.Split(spec, ",") {
+		rid = strings.TrimSpace(rid)
+		if rid == "" {
+			return nil, fmt.Errorf("invalid --simulcast: empty RID in %q", spec)
+		}
+		for _, r := range rid {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return nil, fmt.Errorf("invalid --simulcast RID %q (allowed: letters, digits, '-', '_')", rid)
+			}
+		}
+		if seen[rid] {
+			return nil, fmt.Errorf("invalid --simulcast: duplicate RID %q", rid)
+		}
+		seen[rid] = true
+		rids = append(rids, rid)
+	}
+	if len(rids) < 2 || len(rids) > maxSimulcastLayers {
+		return nil, fmt.Errorf("invalid --simulcast: %d RIDs given (must be 2-%d)", len(rids), maxSimulcastLayers)
+	}
+	return rids, nil
+}
+
+// parsePayloadTypes は --payload-types の "codec=pt" 指定を解析し、ペイロードタイプを上書きする
+// 指定は動的範囲（96-127）に限り、コーデック間で重複してはならない
+func parsePayloadTypes(spec string) error {
+	if spec == "" {
+		return nil
+	}
+
+	payloadTypes := map[string]*uint8{
+		"vp8":  &VP8PayloadType,
+		"vp9":  &VP9PayloadType,
+		"opus": &OpusPayloadType,
+	}
+	values := map[string]uint8{}
+	for name, pt := range payloadTypes {
+		values[name] = *pt
+	}
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("invalid --payload-types entry %q (expected codec=pt)", entry)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, known := payloadTypes[name]; !known {
+			return fmt.Errorf("invalid --payload-types entry %q: unknown codec %s (supported: vp8, vp9, opus)", entry, name)
+		}
+		pt, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || pt < 96 || pt > 127 {
+			return fmt.Errorf("invalid --payload-types entry %q: payload type must be 96-127", entry)
+		}
+		values[name] = uint8(pt)
+	}
+
+	owners := map[uint8]string{}
+	for _, name := range []string{"vp8", "vp9", "opus"} {
+		if other, dup := owners[values[name]]; dup {
+			return fmt.Errorf("invalid --payload-types: %s and %s both use payload type %d", other, name, values[name])
+		}
+		owners[values[name]] = name
+	}
+
+	for name, pt := range payloadTypes {
+		*pt = values[name]
+	}
+	DebugLog("Payload types: vp8=%d, vp9=%d, opus=%d\n", VP8PayloadType, VP9PayloadType, OpusPayloadType)
 	return nil
 }
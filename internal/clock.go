@@ -0,0 +1,28 @@
+package internal
+
+import "time"
+
+// Clock は現在時刻の取得元
+// ライターのフラッシュ間隔や経過時間の計算に使い、テストでは手動で進める時計に差し替える
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock はtime.Nowを返すClock
+type SystemClock struct{}
+
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clockAfter はdが経過すると時刻を送るチャネルを返す
+// clockがAfter(time.Duration) <-chan time.Timeを持つ場合はそれを使い、持たない場合はtime.Afterを使う
+// Sleepと違いselectで停止と並べて待てるため、止められる必要がある待機に使う
+func clockAfter(clock Clock, d time.Duration) <-chan time.Time {
+	if timer, ok := clock.(interface {
+		After(time.Duration) <-chan time.Time
+	}); ok {
+		return timer.After(d)
+	}
+	return time.After(d)
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// manualClock はAdvanceを呼んだ時だけ進むClock
+type manualClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []manualTimer // Afterで待っているタイマー
+}
+
+// manualTimer はmanualClockの時刻がatに達すると発火するタイマー
+type manualTimer struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// newManualClock はstartから始まるmanualClockを作成する
+func newManualClock(start time.Time) *manualClock {
+	return &manualClock{now: start}
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance は時刻をdだけ進め、期限に達したタイマーを発火する
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, timer := range c.timers {
+		if timer.at.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.timers = pending
+}
+
+// Sleep は待たずに時刻をdだけ進める（Pacerの待機用）
+func (c *manualClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+// After は時刻がdだけ進むと発火するチャネルを返す（clockAfterの待機用）
+func (c *manualClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+	c.timers = append(c.timers, manualTimer{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// waitTimer は別goroutineがAfterで待ち始めるまで待ち、最も早いタイマーの残り時間を返す
+func (c *manualClock) waitTimer(t *testing.T) time.Duration {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mu.Lock()
+		if len(c.timers) > 0 {
+			earliest := c.timers[0].at
+			for _, timer := range c.timers[1:] {
+				if timer.at.Before(earliest) {
+					earliest = timer.at
+				}
+			}
+			remaining := earliest.Sub(c.now)
+			c.mu.Unlock()
+			return remaining
+		}
+		c.mu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("no timer started within 5s")
+	return 0
+}
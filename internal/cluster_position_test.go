@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+const (
+	clusterPositionWidth       = 640 // RawVideoMKVWriterは640x360未満のキーフレームをプレビューとして読み飛ばす
+	clusterPositionHeight      = 360
+	clusterPositionVideoFrames = 70   // 30fps x 約2.3秒（キーフレームと1秒ごとに新しいクラスタ）
+	clusterPositionVideoTSStep = 3000 // 90kHz / 30fps
+	clusterPositionAudioTSStep = 960  // 48kHz x 20ms
+
+)
+
+// clusterInfo はMKVから読み戻したクラスタの実際の位置と、書き込まれたPosition/PrevSize
+type clusterInfo struct {
+	offset      uint64 // ファイル先頭からのClusterの開始位置
+	position    uint64
+	hasPosition bool
+	prevSize    uint64
+	hasPrevSize bool
+}
+
+// clusterPositionWriteTestMKV はRawVideoMKVWriterでVP8映像とOpus音声を書き込む
+func clusterPositionWriteTestMKV(out io.Writer) error {
+	encoder, err := NewVP8Encoder(clusterPositionWidth, clusterPositionHeight, "RGBA", 500)
+	if err != nil {
+		return fmt.Errorf("failed to create encoder: %v", err)
+	}
+	defer encoder.Close()
+
+	writer := NewRawVideoMKVWriter(out, "vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	rgba := make([]byte, clusterPositionWidth*clusterPositionHeight*4)
+	audioIndex := 0
+	for i := 0; i < clusterPositionVideoFrames; i++ {
+		for j := range rgba {
+			rgba[j] = byte(i + j)
+		}
+		encoded, keyframe, err := encoder.Encode(rgba)
+		if err != nil {
+			return fmt.Errorf("encode error at frame %d: %v", i, err)
+		}
+		if err := writer.WriteVideoFrame(encoded, uint32(i*clusterPositionVideoTSStep), keyframe); err != nil {
+			return fmt.Errorf("failed to write video frame %d: %v", i, err)
+		}
+		for audioIndex*clusterPositionAudioTSStep*90000/48000 <= i*clusterPositionVideoTSStep {
+			if err := writer.WriteAudioFrame([]byte{0xFC, byte(audioIndex), 0x00}, uint32(audioIndex*clusterPositionAudioTSStep)); err != nil {
+				return fmt.Errorf("failed to write audio frame %d: %v", audioIndex, err)
+			}
+			audioIndex++
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close writer: %v", err)
+	}
+	return <-runErr
+}
+
+// readVarInt はEBMLの可変長整数を読む（markerを残す場合はIDとして扱う）
+func readVarInt(data []byte, pos int, keepMarker bool) (uint64, int, error) {
+	if pos >= len(data) {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	first := data[pos]
+	length := 1
+	for mask := byte(0x80); length <= 8 && first&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || pos+length > len(data) {
+		return 0, 0, fmt.Errorf("invalid varint at %d", pos)
+	}
+	value := uint64(first)
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	for i := 1; i < length; i++ {
+		value = value<<8 | uint64(data[pos+i])
+	}
+	return value, length, nil
+}
+
+// isUnknownSize はサイズが「不明」（全ビットが1）かを返す
+func isUnknownSize(size uint64, length int) bool {
+	return size == 1<<(7*uint(length))-1
+}
+
+// readUInt はEBMLの符号なし整数の値を読む
+func readUInt(data []byte) uint64 {
+	var value uint64
+	for _, b := range data {
+		value = value<<8 | uint64(b)
+	}
+	return value
+}
+
+// parseClusters はMKVを要素単位で走査し、Segmentのデータ開始位置と各クラスタの情報を返す
+// クラスタはサイズ不明で書かれるため、次のClusterのIDが現れた位置を終端とする
+func parseClusters(data []byte) (uint64, []clusterInfo, error) {
+	var segmentStart uint64
+	var clusters []clusterInfo
+	pos := 0
+	for pos < len(data) {
+		elementStart := pos
+		id, idLen, err := readVarInt(data, pos, true)
+		if err != nil {
+			return 0, nil, err
+		}
+		size, sizeLen, err := readVarInt(data, pos+idLen, false)
+		if err != nil {
+			return 0, nil, err
+		}
+		pos += idLen + sizeLen
+
+		switch {
+		case id == idSegment:
+			segmentStart = uint64(pos)
+			continue
+		case id == idCluster:
+			clusters = append(clusters, clusterInfo{offset: uint64(elementStart)})
+			continue
+		case isUnknownSize(size, sizeLen):
+			return 0, nil, fmt.Errorf("unexpected unknown-size element %#x at %d", id, elementStart)
+		}
+
+		end := pos + int(size)
+		if end > len(data) {
+			return 0, nil, fmt.Errorf("element %#x at %d overruns the file", id, elementStart)
+		}
+		if len(clusters) > 0 {
+			current := &clusters[len(clusters)-1]
+			switch id {
+			case idPosition:
+				current.position, current.hasPosition = readUInt(data[pos:end]), true
+			case idPrevSize:
+				current.prevSize, current.hasPrevSize = readUInt(data[pos:end]), true
+			}
+		}
+		pos = end
+	}
+	return segmentStart, clusters, nil
+}
+
+// verifyPositions はPosition/PrevSizeが実際のクラスタの位置・サイズと一致することを検証する
+func verifyPositions(data []byte) error {
+	segmentStart, clusters, err := parseClusters(data)
+	if err != nil {
+		return err
+	}
+	if len(clusters) < 3 {
+		return fmt.Errorf("only %d clusters written, want at least 3", len(clusters))
+	}
+	for i, c := range clusters {
+		if !c.hasPosition {
+			return fmt.Errorf("cluster %d has no Position", i)
+		}
+		if want := c.offset - segmentStart; c.position != want {
+			return fmt.Errorf("cluster %d Position=%d, want %d", i, c.position, want)
+		}
+		if i == 0 {
+			if c.hasPrevSize {
+				return fmt.Errorf("first cluster has PrevSize=%d", c.prevSize)
+			}
+			continue
+		}
+		if !c.hasPrevSize {
+			return fmt.Errorf("cluster %d has no PrevSize", i)
+		}
+		if want := c.offset - clusters[i-1].offset; c.prevSize != want {
+			return fmt.Errorf("cluster %d PrevSize=%d, want %d", i, c.prevSize, want)
+		}
+	}
+	return nil
+}
+
+// TestClusterPositionRobustClustersFlag は--robust-clusters指定時にパイプ相当の出力でも書き込まれることを検証する
+func TestClusterPositionRobustClustersFlag(t *testing.T) {
+	RobustClusters = true
+	defer func() { RobustClusters = false }()
+
+	var out bytes.Buffer
+	if err := clusterPositionWriteTestMKV(&out); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPositions(out.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClusterPositionSeekableOutput は通常のファイルへの出力では指定なしでも書き込まれることを検証する
+func TestClusterPositionSeekableOutput(t *testing.T) {
+	f, err := os.CreateTemp("", "test_cluster_position_*.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if err := clusterPositionWriteTestMKV(f); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyPositions(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestClusterPositionStreamingDefault はストリーミング出力（ファイル以外）ではデフォルトで書き込まれないことを検証する
+func TestClusterPositionStreamingDefault(t *testing.T) {
+	var out bytes.Buffer
+	if err := clusterPositionWriteTestMKV(&out); err != nil {
+		t.Fatal(err)
+	}
+	_, clusters, err := parseClusters(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(clusters) == 0 {
+		t.Fatalf("no clusters written")
+	}
+	for i, c := range clusters {
+		if c.hasPosition || c.hasPrevSize {
+			t.Fatalf("cluster %d has Position/PrevSize without --robust-clusters", i)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ErrVideoCodecNotNegotiated は --codec で指定した映像コーデックをサーバーが選ばなかったことを示す
+// サーバーの対応コーデックは再接続しても変わらないため、再接続せずに終了する
+var ErrVideoCodecNotNegotiated = errors.New("requested video codec not negotiated")
+
+// NegotiatedVideoCodecs はSDP交換後の映像トランシーバーで受信できるコーデック（vp8, vp9）をanswerの順に返す
+// SetRemoteDescriptionの後に呼ぶ。映像のm-lineが拒否された場合は空
+func NegotiatedVideoCodecs(peerConnection *webrtc.PeerConnection) []string {
+	var codecs []string
+	seen := make(map[string]bool)
+	for _, transceiver := range peerConnection.GetTransceivers() {
+		if transceiver.Kind() != webrtc.RTPCodecTypeVideo || transceiver.Receiver() == nil {
+			continue
+		}
+		for _, codec := range transceiver.Receiver().GetParameters().Codecs {
+			name := MimeTypeToCodec(codec.MimeType)
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			codecs = append(codecs, name)
+		}
+	}
+	return codecs
+}
+
+// SelectVideoCodec はanswerで選ばれたコーデックnegotiatedから、受信する映像コーデックを決める
+// requestedがautoなら先頭のコーデック、answerに含まれていればrequestedを返す
+// 含まれない場合、fallbackなら先頭のコーデックに切り替え、そうでなければサーバーの選んだコーデックを示すエラーを返す
+func SelectVideoCodec(requested string, negotiated []string, fallback bool) (string, error) {
+	if len(negotiated) == 0 {
+		return "", nil
+	}
+	if requested == VideoCodecAuto {
+		return negotiated[0], nil
+	}
+	for _, codec := range negotiated {
+		if codec == requested {
+			return codec, nil
+		}
+	}
+	answered := strings.ToUpper(strings.Join(negotiated, ", "))
+	if fallback {
+		fmt.Fprintf(os.Stderr, "Server did not answer %s (answered %s), falling back to %s (--codec-fallback)\n",
+			strings.ToUpper(requested), answered, strings.ToUpper(negotiated[0]))
+		return negotiated[0], nil
+	}
+	return "", fmt.Errorf("%w: --codec %s, but the server answered %s (use --codec %s, --codec auto or --codec-fallback)",
+		ErrVideoCodecNotNegotiated, requested, answered, negotiated[0])
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// TestCodecNegotiationSelect はanswerのコーデックと --codec / --codec-fallback の組み合わせで選ばれるコーデックを検証する
+func TestCodecNegotiationSelect(t *testing.T) {
+	tests := []struct {
+		requested  string
+		negotiated []string
+		fallback   bool
+		want       string
+		wantErr    bool
+	}{
+		{VideoCodecAuto, []string{"vp8", "vp9"}, false, "vp8", false},
+		{VideoCodecAuto, []string{"vp9"}, false, "vp9", false},
+		{VideoCodecVP9, []string{"vp8", "vp9"}, false, "vp9", false},
+		{VideoCodecVP9, []string{"vp8"}, false, "", true},
+		{VideoCodecVP9, []string{"vp8"}, true, "vp8", false},
+		{VideoCodecVP8, []string{"vp9"}, true, "vp9", false},
+		// 映像が拒否された場合は音声のみとして扱う
+		{VideoCodecVP9, nil, false, "", false},
+	}
+	for _, tt := range tests {
+		got, err := SelectVideoCodec(tt.requested, tt.negotiated, tt.fallback)
+		if tt.wantErr {
+			if !errors.Is(err, ErrVideoCodecNotNegotiated) {
+				t.Fatalf("--codec %s with answer %v: got %q, %v, want ErrVideoCodecNotNegotiated", tt.requested, tt.negotiated, got, err)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Fatalf("--codec %s with answer %v (fallback=%v): got %q, %v, want %q", tt.requested, tt.negotiated, tt.fallback, got, err, tt.want)
+		}
+	}
+}
+
+// negotiate は --codec requestedで受信側のofferを作り、videoCodecsだけを登録した送信側のanswerを設定する
+// 受信側のofferと、受信側の映像トランシーバーでネゴシエーションされたコーデックを返す
+func negotiate(requested string, videoCodecs ...webrtc.RTPCodecParameters) (string, []string, error) {
+	saved := VideoCodec
+	VideoCodec = requested
+	defer func() { VideoCodec = saved }()
+
+	streamManager := NewStreamManager(&discardWriter{}, NewDefaultRTPProcessor(), 0, make(chan struct{}, 1))
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return "", nil, err
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		return "", nil, err
+	}
+	defer receiver.Close()
+
+	senderEngine := &webrtc.MediaEngine{}
+	for _, codec := range videoCodecs {
+		if err := senderEngine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return "", nil, err
+		}
+	}
+	if err := senderEngine.RegisterCodec(webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2},
+		PayloadType:        111,
+	}, webrtc.RTPCodecTypeAudio); err != nil {
+		return "", nil, err
+	}
+	sender, err := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return "", nil, err
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticSample(videoCodecs[0].RTPCodecCapability, "video", "test")
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := sender.AddTrack(track); err != nil {
+		return "", nil, err
+	}
+
+	offer, err := receiver.CreateOffer(nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := receiver.SetLocalDescription(offer); err != nil {
+		return "", nil, err
+	}
+	if err := sender.SetRemoteDescription(offer); err != nil {
+		return "", nil, err
+	}
+	answer, err := sender.CreateAnswer(nil)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := sender.SetLocalDescription(answer); err != nil {
+		return "", nil, err
+	}
+	if err := receiver.SetRemoteDescription(answer); err != nil {
+		return "", nil, err
+	}
+	if !AnswerHasVideo(answer.SDP) {
+		return "", nil, fmt.Errorf("answer has no video")
+	}
+	return offer.SDP, NegotiatedVideoCodecs(receiver), nil
+}
+
+var (
+	vp8 = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+		PayloadType:        96,
+	}
+	vp9 = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000},
+		PayloadType:        98,
+	}
+	h264 = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+		PayloadType:        102,
+	}
+)
+
+// videoPayloadTypes はSDPのm=videoの行のペイロードタイプ（offerの優先順）を返す
+func videoPayloadTypes(raw string) string {
+	for _, line := range strings.Split(raw, "\r\n") {
+		if strings.HasPrefix(line, "m=video ") {
+			fields := strings.Fields(line)
+			return strings.Join(fields[3:], " ")
+		}
+	}
+	return ""
+}
+
+// TestCodecNegotiationOfferOrder は --codec vp9 でVP9をofferの先頭に置くことを検証する
+func TestCodecNegotiationOfferOrder(t *testing.T) {
+	offer, _, err := negotiate(VideoCodecVP9, vp9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := fmt.Sprintf("%d %d", VP9PayloadType, VP8PayloadType)
+	if got := videoPayloadTypes(offer); got != want {
+		t.Fatalf("--codec vp9 offered payload types %q, want %q", got, want)
+	}
+}
+
+// TestCodecNegotiationMismatchedAnswer はVP8とH264のみに対応するサーバーのanswerで、--codec vp9がVP8を示すエラーになり、
+// --codec-fallback ではVP8に切り替わることを検証する
+func TestCodecNegotiationMismatchedAnswer(t *testing.T) {
+	_, negotiated, err := negotiate(VideoCodecVP9, vp8, h264)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(negotiated) != 1 || negotiated[0] != "vp8" {
+		t.Fatalf("negotiated video codecs %v, want [vp8]", negotiated)
+	}
+	_, err = SelectVideoCodec(VideoCodecVP9, negotiated, false)
+	if !errors.Is(err, ErrVideoCodecNotNegotiated) || !strings.Contains(err.Error(), "answered VP8") {
+		t.Fatalf("got %v, want an error listing the answered VP8", err)
+	}
+	codec, err := SelectVideoCodec(VideoCodecVP9, negotiated, true)
+	if err != nil || codec != "vp8" {
+		t.Fatalf("--codec-fallback selected %q, %v, want vp8", codec, err)
+	}
+}
+
+// TestCodecNegotiationMatchingAnswer はサーバーがVP9に対応していれば、--codec vp9でVP9が選ばれることを検証する
+func TestCodecNegotiationMatchingAnswer(t *testing.T) {
+	_, negotiated, err := negotiate(VideoCodecVP9, vp8, vp9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := SelectVideoCodec(VideoCodecVP9, negotiated, false)
+	if err != nil || codec != "vp9" {
+		t.Fatalf("negotiated %v: selected %q, %v, want vp9", negotiated, codec, err)
+	}
+}
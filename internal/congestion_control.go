@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	congestionControlGCC = "gcc"
+
+	// GCCの推定値の下限（これ以下には絞らない）
+	gccMinBitrateBps = 100_000
+	// 推定値を定期出力する間隔
+	gccLogInterval = 5 * time.Second
+)
+
+// ConfigureCongestionControl は --congestion-control の指定に応じて
+// 送信側帯域推定（GCC）インターセプターを登録する。
+// 無効の場合はnilチャネルを返す。有効の場合、PeerConnection作成時に
+// 帯域推定器がチャネルへ送られる。
+// パケット単位のペーシングはPTSベースのPacerと二重になるため、GCC側はNoOpPacerを使う
+func ConfigureCongestionControl(mediaEngine *webrtc.MediaEngine, interceptorRegistry *interceptor.Registry, maxBitrateBps int) (<-chan cc.BandwidthEstimator, error) {
+	switch strings.ToLower(CongestionControl) {
+	case "":
+		return nil, nil
+	case congestionControlGCC:
+	default:
+		return nil, fmt.Errorf("unsupported congestion control: %s (supported: gcc)", CongestionControl)
+	}
+
+	if !ExtensionEnabled("transport-cc") {
+		return nil, fmt.Errorf("--congestion-control gcc requires TWCC feedback (remove --no-twcc and keep transport-cc in --extensions)")
+	}
+
+	if maxBitrateBps < gccMinBitrateBps {
+		maxBitrateBps = gccMinBitrateBps
+	}
+
+	ccFactory, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(
+			gcc.SendSideBWEInitialBitrate(maxBitrateBps),
+			gcc.SendSideBWEMinBitrate(gccMinBitrateBps),
+			gcc.SendSideBWEMaxBitrate(maxBitrateBps),
+			gcc.SendSideBWEPacer(gcc.NewNoOpPacer()),
+		)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create congestion control interceptor: %w", err)
+	}
+
+	estimatorChan := make(chan cc.BandwidthEstimator, 1)
+	ccFactory.OnNewPeerConnection(func(_ string, estimator cc.BandwidthEstimator) {
+		select {
+		case estimatorChan <- estimator:
+		default:
+		}
+	})
+	interceptorRegistry.Add(ccFactory)
+
+	// 送信パケットにtransport-wide sequence numberを付与する
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(mediaEngine, interceptorRegistry); err != nil {
+		return nil, err
+	}
+
+	DebugLog("Congestion control: GCC enabled (min=%dkbps, max=%dkbps)\n", gccMinBitrateBps/1000, maxBitrateBps/1000)
+	return estimatorChan, nil
+}
+
+// LogBandwidthEstimate は帯域推定値をstopChanが閉じられるまで定期的に出力する
+func LogBandwidthEstimate(estimator cc.BandwidthEstimator, stopChan <-chan struct{}) {
+	ticker := time.NewTicker(gccLogInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopChan:
+			return
+		case <-ticker.C:
+			stats := estimator.GetStats()
+			fmt.Fprintf(os.Stderr, "[CC] target=%dkbps, loss=%v, delay(state=%v, usage=%v, estimate=%vms)\n",
+				estimator.GetTargetBitrate()/1000, stats["averageLoss"], stats["state"], stats["usage"], stats["delayEstimate"])
+		}
+	}
+}
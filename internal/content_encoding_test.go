@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+// contentEncodingVP8Keyframe はVP8キーフレームの先頭（header strippingで先頭3バイトを取り除く）
+var contentEncodingVP8Keyframe = []byte{0x10, 0x02, 0x00, 0x9D, 0x01, 0x2A, 0x80, 0x02, 0x68, 0x01}
+
+// contentEncodingSegmentHead はSegmentの先頭（Info、Tracks）を作る
+func contentEncodingSegmentHead(trackEntries ...[]byte) []byte {
+	return bytes.Join([][]byte{
+		element(0x1A45DFA3, element(0x4282, []byte("matroska"))),
+		append(idBytes(0x18538067), unknownSize...),
+		element(0x1549A966, element(0x2AD7B1, uintData(1000000))),
+		element(0x1654AE6B, trackEntries...),
+	}, nil)
+}
+
+// compression はContentCompressionのContentEncoding（settingsがnilならContentCompSettings無し）を作る
+func compression(order, algo uint64, settings []byte) []byte {
+	children := [][]byte{element(0x4254, uintData(algo))}
+	if settings != nil {
+		children = append(children, element(0x4255, settings))
+	}
+	return element(0x6240,
+		element(0x5031, uintData(order)),
+		element(0x5032, uintData(1)),
+		element(0x5033, uintData(0)),
+		element(0x5034, children...),
+	)
+}
+
+// encryption はContentEncryptionのContentEncodingを作る
+func encryption() []byte {
+	return element(0x6240,
+		element(0x5033, uintData(1)),
+		element(0x5035, element(0x47E1, uintData(5))),
+	)
+}
+
+func contentEncodingVideoTrack(number uint64, encodings ...[]byte) []byte {
+	children := [][]byte{
+		element(0xD7, uintData(number)),
+		element(0x86, []byte("V_VP8")),
+		element(0xE0, element(0xB0, uintData(640)), element(0xBA, uintData(360))),
+	}
+	if len(encodings) > 0 {
+		children = append(children, element(0x6D80, encodings...))
+	}
+	return element(0xAE, children...)
+}
+
+func contentEncodingAudioTrack(number uint64, codec string, encodings ...[]byte) []byte {
+	children := [][]byte{
+		element(0xD7, uintData(number)),
+		element(0x86, []byte(codec)),
+		element(0xE1,
+			element(0x9F, uintData(2)),
+			element(0xB5, binary.BigEndian.AppendUint64(nil, math.Float64bits(48000))),
+		),
+	}
+	if len(encodings) > 0 {
+		children = append(children, element(0x6D80, encodings...))
+	}
+	return element(0xAE, children...)
+}
+
+// contentEncodingSimpleBlock はtrackのキーフレームのSimpleBlockを作る
+func contentEncodingSimpleBlock(track byte, relativeMs int16, frame []byte) []byte {
+	return element(0xA3, append([]byte{0x80 | track, byte(uint16(relativeMs) >> 8), byte(relativeMs), 0x80}, frame...))
+}
+
+// contentEncodingFixedLacedBlock は固定長lacingで複数フレームを詰めたSimpleBlockを作る
+func contentEncodingFixedLacedBlock(track byte, frames ...[]byte) []byte {
+	out := []byte{0x80 | track, 0x00, 0x00, 0x84, byte(len(frames) - 1)}
+	for _, frame := range frames {
+		out = append(out, frame...)
+	}
+	return element(0xA3, out)
+}
+
+func deflate(data []byte) []byte {
+	var out bytes.Buffer
+	zw := zlib.NewWriter(&out)
+	zw.Write(data)
+	zw.Close()
+	return out.Bytes()
+}
+
+// contentEncodingReadAll はMKVReaderで全フレームを読む
+func contentEncodingReadAll(data []byte) ([]*Frame, error) {
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	var frames []*Frame
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// checkFrames は読んだフレームの内容がwantと一致することを検証する
+func checkFrames(frames []*Frame, want ...[]byte) error {
+	if len(frames) != len(want) {
+		return fmt.Errorf("got %d frames, want %d", len(frames), len(want))
+	}
+	for i, frame := range frames {
+		if !bytes.Equal(frame.Data, want[i]) {
+			return fmt.Errorf("frame %d: got %x, want %x", i, frame.Data, want[i])
+		}
+	}
+	return nil
+}
+
+// TestContentEncodingHeaderStripping はheader strippingで取り除かれた先頭のバイト列を、映像の各フレームに戻すことを検証する
+func TestContentEncodingHeaderStripping(t *testing.T) {
+	stripped := contentEncodingVP8Keyframe[:3]
+	second := append(append([]byte(nil), contentEncodingVP8Keyframe...), 0xAA)
+	data := append(contentEncodingSegmentHead(contentEncodingVideoTrack(1, compression(0, 3, stripped))),
+		unsizedElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			contentEncodingSimpleBlock(1, 0, contentEncodingVP8Keyframe[3:]),
+			contentEncodingSimpleBlock(1, 33, second[3:]),
+		)...)
+
+	frames, err := contentEncodingReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFrames(frames, contentEncodingVP8Keyframe, second); err != nil {
+		t.Fatal(err)
+	}
+	if frames[1].TimestampMs != 33 {
+		t.Fatalf("second frame at %dms, want 33ms", frames[1].TimestampMs)
+	}
+}
+
+// TestContentEncodingLacedHeaderStripping はlacingされた音声の各フレームに、取り除かれたバイト列を個別に戻すことを検証する
+func TestContentEncodingLacedHeaderStripping(t *testing.T) {
+	packets := [][]byte{{0xFC, 0x01, 0x02}, {0xFC, 0x03, 0x04}, {0xFC, 0x05, 0x06}}
+	data := append(contentEncodingSegmentHead(contentEncodingAudioTrack(1, "A_OPUS", compression(0, 3, []byte{0xFC}))),
+		unsizedElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			contentEncodingFixedLacedBlock(1, packets[0][1:], packets[1][1:], packets[2][1:]),
+		)...)
+
+	frames, err := contentEncodingReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFrames(frames, packets...); err != nil {
+		t.Fatal(err)
+	}
+	// timestampは復元後のOpusパケットの想定長（20ms）で進む
+	if frames[1].TimestampMs != 20 || frames[2].TimestampMs != 40 {
+		t.Fatalf("laced frames at %dms, %dms, want 20ms, 40ms", frames[1].TimestampMs, frames[2].TimestampMs)
+	}
+}
+
+// TestContentEncodingZlib はzlibで圧縮されたフレームを展開することを検証する
+func TestContentEncodingZlib(t *testing.T) {
+	pcm := bytes.Repeat([]byte{0x01, 0x00, 0xFF, 0xFF}, 480)
+	data := append(contentEncodingSegmentHead(contentEncodingAudioTrack(1, "A_PCM/INT/LIT", compression(0, 0, nil))),
+		unsizedElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			contentEncodingSimpleBlock(1, 0, deflate(pcm)),
+		)...)
+
+	frames, err := contentEncodingReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFrames(frames, pcm); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestContentEncodingChained はzlib（order 0）の後にheader stripping（order 1）を適用したフレームを、逆の順に復元することを検証する
+func TestContentEncodingChained(t *testing.T) {
+	// header strippingはzlibの出力の先頭を取り除く
+	compressed := deflate(contentEncodingVP8Keyframe)
+	data := append(contentEncodingSegmentHead(contentEncodingVideoTrack(1, compression(0, 0, nil), compression(1, 3, compressed[:2]))),
+		unsizedElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			contentEncodingSimpleBlock(1, 0, compressed[2:]),
+		)...)
+
+	frames, err := contentEncodingReadAll(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkFrames(frames, contentEncodingVP8Keyframe); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestContentEncodingUnsupported は読み込むトラックの復元できない方式（LZO、暗号化）をErrUnsupportedContentEncodingとし、
+// 読み込まないトラックの方式は無視することを検証する
+func TestContentEncodingUnsupported(t *testing.T) {
+	cases := []struct {
+		name     string
+		encoding []byte
+	}{
+		{"lzo1x", compression(0, 2, nil)},
+		{"bzlib", compression(0, 1, nil)},
+		{"encryption", encryption()},
+	}
+	for _, c := range cases {
+		data := append(contentEncodingSegmentHead(contentEncodingVideoTrack(1, c.encoding)),
+			unsizedElement(0x1F43B675,
+				element(0xE7, uintData(0)),
+				contentEncodingSimpleBlock(1, 0, contentEncodingVP8Keyframe),
+			)...)
+		frames, err := contentEncodingReadAll(data)
+		if !errors.Is(err, ErrUnsupportedContentEncoding) {
+			t.Fatalf("%s: got %v, want ErrUnsupportedContentEncoding", c.name, err)
+		}
+		if len(frames) != 0 {
+			t.Fatalf("%s: %d frames delivered from an undecodable track", c.name, len(frames))
+		}
+		t.Logf("%s: %v", c.name, err)
+	}
+
+	// 2つ目の音声トラックは読み込まないため、方式を問わない
+	data := append(contentEncodingSegmentHead(contentEncodingVideoTrack(1), contentEncodingAudioTrack(2, "A_OPUS"), contentEncodingAudioTrack(3, "A_OPUS", compression(0, 2, nil))),
+		unsizedElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			contentEncodingSimpleBlock(1, 0, contentEncodingVP8Keyframe),
+			contentEncodingSimpleBlock(3, 0, []byte{0x00, 0x01}),
+		)...)
+	frames, err := contentEncodingReadAll(data)
+	if err != nil {
+		t.Fatalf("unused LZO track: %v", err)
+	}
+	if err := checkFrames(frames, contentEncodingVP8Keyframe); err != nil {
+		t.Fatal(err)
+	}
+}
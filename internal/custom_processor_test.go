@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// 実験的なペイロード形式の先頭1バイトのフラグ
+// VP8のペイロードデスクリプタのS/Nビットと同じ位置にし、videoframe interceptorもフレームとして組み立てる形にする
+// （NewStreamManagerではinterceptorのフレームが優先され、このプロセッサは使われない）
+const (
+	flagStart    = 0x10 // フレームの最初のパケット
+	flagKeyframe = 0x20 // キーフレーム
+)
+
+const (
+	customProcessorVideoTicks = 3000 // 30fps（90kHz）
+	customProcessorFrameStep  = 33 * time.Millisecond
+)
+
+var errSequenceGap = errors.New("sequence gap inside a frame")
+
+// markerProcessor は独自のRTPProcessorの例
+// 各パケットは1バイトのフラグに続くフレームの断片を運び、RTPのマーカービットでフレームが終わる
+// 音声はペイロードをそのままフレームとする
+type markerProcessor struct {
+	mu        sync.Mutex // 映像と音声の読み取りループから並行に呼ばれる
+	frame     []byte
+	keyframe  bool
+	assemble  bool // フレームの途中（最初のパケットを受信済み）
+	lastSeq   uint16
+	processed int
+}
+
+var (
+	_ RTPProcessor     = (*markerProcessor)(nil)
+	_ KeyframeDetector = (*markerProcessor)(nil)
+)
+
+func (p *markerProcessor) ProcessRTPPacket(packet *rtp.Packet, codecType string) ([][]byte, error) {
+	if codecType == "opus" {
+		return [][]byte{packet.Payload}, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.processed++
+	if len(packet.Payload) < 1 {
+		return nil, nil
+	}
+	flags, data := packet.Payload[0], packet.Payload[1:]
+	if flags&flagStart != 0 {
+		// 先頭1バイトにキーフレームかどうかを残し、IsKeyframeで判定する
+		p.frame = append(p.frame[:0], flags&flagKeyframe)
+		p.assemble = true
+	} else if !p.assemble {
+		return nil, nil
+	} else if packet.SequenceNumber != p.lastSeq+1 {
+		p.assemble = false
+		return nil, errSequenceGap
+	}
+	p.lastSeq = packet.SequenceNumber
+	p.frame = append(p.frame, data...)
+	if !packet.Marker {
+		return nil, nil
+	}
+	p.assemble = false
+	return [][]byte{p.frame}, nil
+}
+
+func (p *markerProcessor) IsKeyframe(frame []byte, codecType string) bool {
+	return frame[0]&flagKeyframe != 0
+}
+
+// packetize はframeをsize バイトずつの断片に分けたパケットを返す
+func packetize(frame []byte, size int, keyframe bool, seq *uint16, timestamp uint32) []*rtp.Packet {
+	var packets []*rtp.Packet
+	for offset := 0; offset < len(frame); offset += size {
+		end := min(offset+size, len(frame))
+		flags := byte(0)
+		if offset == 0 {
+			flags |= flagStart
+			if keyframe {
+				flags |= flagKeyframe
+			}
+		}
+		packets = append(packets, &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         end == len(frame),
+				SequenceNumber: *seq,
+				Timestamp:      timestamp,
+			},
+			Payload: append([]byte{flags}, frame[offset:end]...),
+		})
+		*seq++
+	}
+	return packets
+}
+
+// TestCustomProcessor は例のプロセッサが断片からフレームを組み立て、途中の欠落したフレームを捨てることを検証する
+func TestCustomProcessor(t *testing.T) {
+	processor := &markerProcessor{}
+	var seq uint16
+	frame := bytes.Repeat([]byte("abcdefgh"), 40)
+	var got [][]byte
+	for _, packet := range packetize(frame, 100, true, &seq, 0) {
+		out, err := processor.ProcessRTPPacket(packet, "vp8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, out...)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0][1:], frame) || !processor.IsKeyframe(got[0], "vp8") {
+		t.Fatalf("assembled %d frames, want one keyframe of %d bytes", len(got), len(frame))
+	}
+
+	lost := packetize(frame, 100, false, &seq, customProcessorVideoTicks)
+	lost = append(lost[:1], lost[2:]...)
+	var sawGap bool
+	for _, packet := range lost {
+		out, err := processor.ProcessRTPPacket(packet, "vp8")
+		if errors.Is(err, errSequenceGap) {
+			sawGap = true
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if len(out) != 0 {
+			t.Fatalf("assembled a frame with a missing packet")
+		}
+	}
+	if !sawGap {
+		t.Fatalf("missing packet was not reported")
+	}
+}
+
+// customProcessorVideoFrame はwriterに渡された映像フレーム
+type customProcessorVideoFrame struct {
+	size      int
+	timestamp uint32
+	keyframe  bool
+}
+
+// customProcessorRecordingWriter は映像フレームを記録するStreamWriter
+type customProcessorRecordingWriter struct {
+	mu     sync.Mutex
+	frames []customProcessorVideoFrame
+}
+
+func (w *customProcessorRecordingWriter) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.frames = append(w.frames, customProcessorVideoFrame{size: len(data), timestamp: timestamp, keyframe: keyframe})
+	return nil
+}
+func (w *customProcessorRecordingWriter) WriteAudioFrame(data []byte, timestamp uint32) error {
+	return nil
+}
+func (w *customProcessorRecordingWriter) Run() error   { return nil }
+func (w *customProcessorRecordingWriter) Close() error { return nil }
+
+func (w *customProcessorRecordingWriter) Frames() []customProcessorVideoFrame {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]customProcessorVideoFrame(nil), w.frames...)
+}
+
+// TestCustomProcessorLoopback はNewStreamManagerWithProcessorに渡した独自のプロセッサが、
+// VP8としてネゴシエーションされた映像のすべてのパケットを処理し、組み立てたフレームとキーフレーム判定がwriterに届くことを検証する
+func TestCustomProcessorLoopback(t *testing.T) {
+	const (
+		frames    = 10
+		frameSize = 3000
+	)
+	processor := &markerProcessor{}
+	writer := &customProcessorRecordingWriter{}
+	mediaReceived := make(chan struct{}, 1)
+	streamManager := NewStreamManagerWithProcessor(writer, processor, 0, mediaReceived)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(receiver, sender); err != nil {
+		t.Fatal(err)
+	}
+
+	go streamManager.Run()
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	defer func() {
+		receiver.Close()
+		streamManager.Stop()
+	}()
+
+	var seq uint16
+	frame := bytes.Repeat([]byte{0x5A}, frameSize)
+	send := func(i int) error {
+		for _, packet := range packetize(frame, 1000, i%5 == 0, &seq, uint32(i*customProcessorVideoTicks)) {
+			if err := track.WriteRTP(packet); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// SRTPの準備完了前のパケットは破棄されるため、最初のメディアが届くまで送り続ける
+	i := 0
+	deadline := time.Now().Add(5 * time.Second)
+	for received := false; !received; i++ {
+		if time.Now().After(deadline) {
+			t.Fatalf("no media received within 5s")
+		}
+		if err := send(i); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-mediaReceived:
+			received = true
+		case <-time.After(customProcessorFrameStep):
+		}
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	before := len(writer.Frames())
+	first := i
+	for ; i < first+frames; i++ {
+		if err := send(i); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(customProcessorFrameStep)
+	}
+	time.Sleep(300 * time.Millisecond)
+
+	got := writer.Frames()[before:]
+	if len(got) != frames {
+		t.Fatalf("writer received %d frames, want %d", len(got), frames)
+	}
+	for n, f := range got {
+		index := first + n
+		want := customProcessorVideoFrame{size: frameSize + 1, timestamp: uint32(index * customProcessorVideoTicks), keyframe: index%5 == 0}
+		if f != want {
+			t.Fatalf("frame %d: got %+v, want %+v", index, f, want)
+		}
+	}
+}
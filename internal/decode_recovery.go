@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrDecodeStalled は映像のデコードの失敗が --decode-stall-timeout の間続き、キーフレームでも復帰しないことを示す
+// ErrFrameDroppedで包んで返すため、--on-write-error に従って終了（デフォルト）や再接続を行う
+var ErrDecodeStalled = errors.New("video decode stalled")
+
+// decodeStage はデコード失敗からの復帰の段階
+type decodeStage int
+
+const (
+	decodeHealthy    decodeStage = iota
+	decodeConcealing             // 最後の正常フレームを繰り返しながらキーフレームを要求する
+	decodeSkipping               // 映像を出力せずにキーフレームを待つ
+)
+
+func (s decodeStage) String() string {
+	switch s {
+	case decodeConcealing:
+		return "concealing"
+	case decodeSkipping:
+		return "skipping"
+	default:
+		return "healthy"
+	}
+}
+
+// decodeRecovery はデコードの失敗や破損フレームが続いた場合の段階的な対処を決める
+// 連続concealFrames回までは最後の正常フレームを繰り返しながらPLIを送り、
+// それを超えるかFrameValidatorがキーフレーム待ちを示したら、キーフレームが届くまで映像を出力しない
+// 最初の失敗からstallTimeoutが経過しても復帰しなければErrDecodeStalledを返す（0で無効）
+type decodeRecovery struct {
+	concealFrames int
+	stallTimeout  time.Duration
+
+	stage    decodeStage
+	failures int       // 連続した失敗の数
+	since    time.Time // 最初の失敗の時刻
+}
+
+// newDecodeRecovery は新しいdecodeRecoveryを作成する
+func newDecodeRecovery(concealFrames int, stallTimeout time.Duration) *decodeRecovery {
+	return &decodeRecovery{concealFrames: concealFrames, stallTimeout: stallTimeout}
+}
+
+// onFailure はデコードか検証の失敗を記録し、最後の正常フレームを繰り返すか（falseなら出力しない）を返す
+// waitForKeyframeはFrameValidator.ShouldWaitForKeyframeの値で、trueなら繰り返しの回数によらず出力を止める
+// escalatedは今回の失敗でキーフレーム待ちに移ったことを示す
+func (r *decodeRecovery) onFailure(now time.Time, waitForKeyframe bool) (repeat, escalated bool, err error) {
+	if r.stage == decodeHealthy {
+		r.stage = decodeConcealing
+		r.since = now
+	}
+	r.failures++
+	if err := r.checkStall(now); err != nil {
+		return false, false, err
+	}
+	if r.stage == decodeConcealing && (r.failures > r.concealFrames || waitForKeyframe) {
+		r.stage = decodeSkipping
+		escalated = true
+	}
+	return r.stage == decodeConcealing, escalated, nil
+}
+
+// acceptFrame はデコードと検証に成功したフレームを出力してよいかを返す
+// キーフレーム待ちの間は、壊れた参照からデコードされた差分フレームを出力しない
+func (r *decodeRecovery) acceptFrame(now time.Time, keyframe bool) (bool, error) {
+	if r.stage == decodeSkipping && !keyframe {
+		return false, r.checkStall(now)
+	}
+	r.stage = decodeHealthy
+	r.failures = 0
+	return true, nil
+}
+
+// checkStall は最初の失敗からstallTimeoutが経過していればErrDecodeStalledを返す
+// 次の失敗から数え直すため、段階を初期状態に戻す
+func (r *decodeRecovery) checkStall(now time.Time) error {
+	if r.stallTimeout <= 0 || now.Sub(r.since) < r.stallTimeout {
+		return nil
+	}
+	failures := r.failures
+	r.stage = decodeHealthy
+	r.failures = 0
+	return fmt.Errorf("%w: %w: no decodable keyframe within %v of the first decode error (%d failed frames)",
+		ErrFrameDropped, ErrDecodeStalled, r.stallTimeout, failures)
+}
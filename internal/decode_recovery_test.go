@@ -0,0 +1,223 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	decodeRecoveryWidth       = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	decodeRecoveryHeight      = 360
+	decodeRecoveryVideoTSStep = 3000 // 30fps（90kHz）
+	decodeRecoveryFrameStep   = 33 * time.Millisecond
+)
+
+// harness はManualClockとPLIを数えるKeyframeControllerを付けたRawVideoMKVWriterに、VP8フレームを順に書き込む
+type harness struct {
+	encoder *VP8Encoder
+	writer  *RawVideoMKVWriter
+	clock   *manualClock
+	runErr  chan error
+	plis    int
+	frame   int
+}
+
+func newHarness(concealFrames, stallMs int) (*harness, error) {
+	ConcealFrames = concealFrames
+	DecodeStallMs = stallMs
+	defer func() {
+		ConcealFrames = 5
+		DecodeStallMs = 10000
+	}()
+
+	encoder, err := NewVP8Encoder(decodeRecoveryWidth, decodeRecoveryHeight, "YUV420P", 500)
+	if err != nil {
+		return nil, err
+	}
+	h := &harness{
+		encoder: encoder,
+		writer:  NewRawVideoMKVWriter(io.Discard, "vp8"),
+		clock:   newManualClock(time.Unix(0, 0)),
+		runErr:  make(chan error, 1),
+	}
+	// 間引かずに送信したPLIをすべて数える
+	keyframeCtl := NewKeyframeController(0)
+	keyframeCtl.Attach(func(packets []rtcp.Packet) error {
+		h.plis += len(packets)
+		return nil
+	}, 0x1234)
+	h.writer.SetClock(h.clock)
+	h.writer.SetKeyframeController(keyframeCtl)
+	go func() { h.runErr <- h.writer.Run() }()
+	return h, nil
+}
+
+func (h *harness) close() {
+	h.writer.Close()
+	<-h.runErr
+	h.encoder.Close()
+}
+
+// write はフレームを書き込み、時刻を1フレーム分進める
+func (h *harness) write(data []byte, keyframe bool) error {
+	err := h.writer.WriteVideoFrame(data, uint32(h.frame*decodeRecoveryVideoTSStep), keyframe)
+	h.frame++
+	h.clock.Advance(decodeRecoveryFrameStep)
+	return err
+}
+
+// encode は次のフレームをエンコードして書き込む（forceKeyframeでキーフレームにする）
+func (h *harness) encode(forceKeyframe bool) error {
+	if forceKeyframe {
+		h.encoder.ForceKeyframe()
+	}
+	yuv := bytes.Repeat([]byte{byte(0x40 + h.frame)}, decodeRecoveryWidth*decodeRecoveryHeight*3/2)
+	encoded, keyframe, err := h.encoder.Encode(yuv)
+	if err != nil {
+		return err
+	}
+	if forceKeyframe && !keyframe {
+		return fmt.Errorf("encoder did not produce a keyframe")
+	}
+	return h.write(encoded, keyframe)
+}
+
+// corrupt は第1パーティションの長さが実データを超える、デコードできないインターフレームを書き込む
+func (h *harness) corrupt() error {
+	return h.write([]byte{0xF1, 0xFF, 0x0F, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, false)
+}
+
+// TestDecodeRecoveryConcealThenSkip は連続したデコードエラーのうち --conceal-frames 回までは最後の正常フレームを繰り返しながら
+// PLIを送り、それを超えるとPLIをまとめて送ってからキーフレームまで映像を出力せず、キーフレームで復帰することを検証する
+func TestDecodeRecoveryConcealThenSkip(t *testing.T) {
+	disableFrameValidation(t)
+	h, err := newHarness(3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+
+	for i := 0; i < 3; i++ {
+		if err := h.encode(i == 0); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+
+	for i := 1; i <= 3; i++ {
+		before := h.plis
+		if err := h.corrupt(); err != nil {
+			t.Fatalf("corrupt frame %d: %v", i, err)
+		}
+		if h.plis-before != 1 {
+			t.Fatalf("%d PLIs sent for corrupt frame %d, want 1", h.plis-before, i)
+		}
+	}
+	stats := h.writer.GetValidationStats()
+	if stats.DecodeErrors != 3 || stats.RepeatedFrames != 3 || stats.SkippedFrames != 0 {
+		t.Fatalf("after 3 errors: %d decode errors, %d repeated, %d skipped, want 3/3/0",
+			stats.DecodeErrors, stats.RepeatedFrames, stats.SkippedFrames)
+	}
+
+	// 4つ目で繰り返しをやめ、PLIをまとめて送る
+	before := h.plis
+	if err := h.corrupt(); err != nil {
+		t.Fatalf("corrupt frame 4: %v", err)
+	}
+	if h.plis-before != 3 {
+		t.Fatalf("%d PLIs sent when freezing stopped, want a burst of 3", h.plis-before)
+	}
+	// キーフレーム待ちの間は、デコードできたインターフレームも出力しない
+	for i := 0; i < 5; i++ {
+		if i%2 == 0 {
+			err = h.corrupt()
+		} else {
+			err = h.encode(false)
+		}
+		if err != nil {
+			t.Fatalf("frame %d while waiting for a keyframe: %v", i, err)
+		}
+	}
+	stats = h.writer.GetValidationStats()
+	if stats.RepeatedFrames != 3 || stats.SkippedFrames != 6 {
+		t.Fatalf("while waiting for a keyframe: %d repeated, %d skipped, want 3/6", stats.RepeatedFrames, stats.SkippedFrames)
+	}
+
+	// キーフレームで復帰し、次の失敗からは再び最後の正常フレームを繰り返す
+	if err := h.encode(true); err != nil {
+		t.Fatalf("recovery keyframe: %v", err)
+	}
+	if err := h.encode(false); err != nil {
+		t.Fatalf("frame after the keyframe: %v", err)
+	}
+	if err := h.corrupt(); err != nil {
+		t.Fatalf("corrupt frame after recovery: %v", err)
+	}
+	stats = h.writer.GetValidationStats()
+	if stats.RepeatedFrames != 4 || stats.SkippedFrames != 6 {
+		t.Fatalf("after recovery: %d repeated, %d skipped, want 4/6", stats.RepeatedFrames, stats.SkippedFrames)
+	}
+}
+
+// TestDecodeRecoveryConcealZero は --conceal-frames 0 で最初のデコードエラーから繰り返さずにキーフレームを待つことを検証する
+func TestDecodeRecoveryConcealZero(t *testing.T) {
+	disableFrameValidation(t)
+	h, err := newHarness(0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+
+	if err := h.encode(true); err != nil {
+		t.Fatal(err)
+	}
+	if err := h.corrupt(); err != nil {
+		t.Fatal(err)
+	}
+	if h.plis != 3 {
+		t.Fatalf("%d PLIs sent, want a burst of 3", h.plis)
+	}
+	if stats := h.writer.GetValidationStats(); stats.RepeatedFrames != 0 || stats.SkippedFrames != 1 {
+		t.Fatalf("%d repeated, %d skipped, want 0/1", stats.RepeatedFrames, stats.SkippedFrames)
+	}
+}
+
+// TestDecodeRecoveryStall は最初のデコードエラーから --decode-stall-timeout の間キーフレームで復帰しなければ、
+// ErrFrameDroppedで包んだErrDecodeStalledを返し、それまでにPLIを送っていることを検証する
+func TestDecodeRecoveryStall(t *testing.T) {
+	disableFrameValidation(t)
+	h, err := newHarness(3, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.close()
+
+	if err := h.encode(true); err != nil {
+		t.Fatal(err)
+	}
+	start := h.clock.Now()
+	for i := 0; i < 100; i++ {
+		elapsed := h.clock.Now().Sub(start)
+		err := h.corrupt()
+		if elapsed < time.Second {
+			if err != nil {
+				t.Fatalf("unexpected error after %v: %v", elapsed, err)
+			}
+			continue
+		}
+		if !errors.Is(err, ErrDecodeStalled) || !errors.Is(err, ErrFrameDropped) {
+			t.Fatalf("got %v after %v, want ErrDecodeStalled wrapped in ErrFrameDropped", err, elapsed)
+		}
+		if h.plis < 4+3 {
+			t.Fatalf("%d PLIs sent before giving up, want at least 7", h.plis)
+		}
+		t.Logf("%v", err)
+		return
+	}
+	t.Fatalf("decode stall timeout did not fire")
+}
@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// pcmFrames はサンプルフレームの列をS16LEインターリーブのPCMにする
+func pcmFrames(frames ...[]int16) []byte {
+	var pcm []byte
+	for _, frame := range frames {
+		for _, sample := range frame {
+			pcm = binary.LittleEndian.AppendUint16(pcm, uint16(sample))
+		}
+	}
+	return pcm
+}
+
+// stereoSamples はステレオPCMを[L, R]の列にする
+func stereoSamples(pcm []byte) [][2]int16 {
+	var out [][2]int16
+	for i := 0; i+4 <= len(pcm); i += 4 {
+		out = append(out, [2]int16{
+			int16(binary.LittleEndian.Uint16(pcm[i:])),
+			int16(binary.LittleEndian.Uint16(pcm[i+2:])),
+		})
+	}
+	return out
+}
+
+// TestDownmix51 は5.1（FL FR FC LFE BL BR）のダウンミックス結果をITU係数から求めた値と比較する
+func TestDownmix51(t *testing.T) {
+	pcm := pcmFrames(
+		// L = 1000 + 0.7071*2000 + 0.7071*400 = 2697、R = -1000 + 0.7071*2000 - 0.7071*400 = 131（LFEは含めない）
+		[]int16{1000, -1000, 2000, 30000, 400, -400},
+		// センターのみ: 両チャンネルに-3dB
+		[]int16{0, 0, 10000, 0, 0, 0},
+		// 係数の合計が1を超える場合はクリップする（L = 30000 + 0.7071*30000*2 > 32767、R = -30000）
+		[]int16{30000, -30000, 30000, 0, 30000, -30000},
+	)
+	// 末尾の不完全なサンプルフレームは捨てる
+	pcm = append(pcm, 0x01, 0x02)
+
+	out, err := DownmixToStereo(pcm, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := stereoSamples(out)
+	want := [][2]int16{{2697, 131}, {7071, 7071}, {32767, -30000}}
+	if len(got) != len(want) {
+		t.Fatalf("got %d stereo frames, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("frame %d: got L=%d R=%d, want L=%d R=%d", i, got[i][0], got[i][1], want[i][0], want[i][1])
+		}
+	}
+}
+
+// TestDownmixChannelCounts は対応するチャンネル数とそうでないものを確認する
+func TestDownmixChannelCounts(t *testing.T) {
+	for channels := 3; channels <= 8; channels++ {
+		if !CanDownmixToStereo(channels) {
+			t.Fatalf("%d channels not supported", channels)
+		}
+		// 全チャンネル同じ値の場合、Lは左側とセンター系の寄与の合計になる
+		frame := make([]int16, channels)
+		for c := range frame {
+			frame[c] = 100
+		}
+		out, err := DownmixToStereo(pcmFrames(frame), channels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := stereoSamples(out)[0]; s[0] != s[1] || s[0] <= 100 {
+			t.Fatalf("%d channels: unbalanced or missing contribution L=%d R=%d", channels, s[0], s[1])
+		}
+	}
+	for _, channels := range []int{1, 2, 9} {
+		if CanDownmixToStereo(channels) {
+			t.Fatalf("%d channels unexpectedly supported", channels)
+		}
+	}
+}
+
+// TestDownmix51Encode は6チャンネルPCMを受け付け、10msごとにOpusフレームを出力することを確認する
+func TestDownmix51Encode(t *testing.T) {
+	encoder, err := NewOpusEncoder(48000, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	pcm := make([]byte, 48000/1000*20*6*2) // 20ms
+	for i := range pcm {
+		pcm[i] = byte(i * 7)
+	}
+	frames, err := encoder.Encode(pcm, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("got %d Opus frames for 20ms, want 2", len(frames))
+	}
+	if frames[1].TimestampMs != 10 {
+		t.Fatalf("second frame at %dms, want 10ms", frames[1].TimestampMs)
+	}
+	// TOCのsビットでステレオとしてエンコードされたことを確認する
+	if frames[0].Data[0]&0x04 == 0 {
+		t.Fatalf("downmixed audio was not encoded as stereo")
+	}
+
+	if _, err := NewOpusEncoder(48000, 9); err == nil {
+		t.Fatalf("9 channels accepted")
+	}
+}
@@ -0,0 +1,59 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/spf13/pflag"
+)
+
+// DryRun はサーバーへのPOSTと同じ手順でofferを作成し、offerと実際に使う設定をwに出力する（--dry-run）
+// サーバーには接続しないため、エンドポイントのOPTIONSで広告されるICEサーバーは取得しない
+func (s *httpSession) DryRun(w io.Writer, peerConnection *webrtc.PeerConnection) error {
+	offerSDP, err := s.createOffer(peerConnection)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "=== Dry run: %s offer (not sent) ===\n", s.protocol)
+	fmt.Fprint(w, offerSDP)
+	if !strings.HasSuffix(offerSDP, "\n") {
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "=== End Offer ===")
+
+	fmt.Fprintln(w, "\n=== Configuration ===")
+	fmt.Fprintf(w, "Endpoint: %s (not contacted)\n", s.endpointURL)
+	config := peerConnection.GetConfiguration()
+	for _, server := range config.ICEServers {
+		fmt.Fprintf(w, "ICE server: %s\n", strings.Join(server.URLs, ", "))
+	}
+	fmt.Fprintf(w, "Bundle policy: %s\n", config.BundlePolicy)
+	if summaries, err := summarizeSDP(offerSDP); err != nil {
+		fmt.Fprintf(w, "failed to parse offer: %v\n", err)
+	} else {
+		printMediaSummaries(w, "Media", summaries)
+	}
+	flags := changedFlags()
+	if len(flags) == 0 {
+		fmt.Fprintln(w, "Flags: all defaults")
+	} else {
+		fmt.Fprintf(w, "Flags: %s\n", strings.Join(flags, " "))
+	}
+	fmt.Fprintln(w, "=== End Configuration ===")
+	return nil
+}
+
+// changedFlags はデフォルトと異なる値のフラグを "--name=value" 形式で返す
+// --preset で変わった値も含める
+func changedFlags() []string {
+	var flags []string
+	pflag.CommandLine.VisitAll(func(flag *pflag.Flag) {
+		if flag.Value.String() != flag.DefValue {
+			flags = append(flags, fmt.Sprintf("--%s=%s", flag.Name, flag.Value.String()))
+		}
+	})
+	return flags
+}
@@ -0,0 +1,111 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/spf13/pflag"
+)
+
+// newServer はリクエストを数えるだけのWHEP/WHIPサーバーを作る（--dry-run では1つも届かない）
+func newServer(requests *atomic.Int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+}
+
+// checkContains はoutputが全てのwantを含むことを検証する
+func checkContains(output string, want ...string) error {
+	for _, s := range want {
+		if !strings.Contains(output, s) {
+			return fmt.Errorf("output does not contain %q:\n%s", s, output)
+		}
+	}
+	return nil
+}
+
+// TestDryRunWHEP はwhep-goと同じPeerConnectionのofferと設定を表示し、サーバーにリクエストを送らないことを検証する
+func TestDryRunWHEP(t *testing.T) {
+	var requests atomic.Int64
+	server := newServer(&requests)
+	defer server.Close()
+
+	if err := pflag.Set("queue-capacity", "5"); err != nil {
+		t.Fatal(err)
+	}
+	defer pflag.Set("queue-capacity", pflag.Lookup("queue-capacity").DefValue)
+
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamManager := NewStreamManager(NewProbeWriter(), NewDefaultRTPProcessor(), 0, make(chan struct{}, 1))
+	peerConnection, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+
+	var out bytes.Buffer
+	if err := NewWHEPSession(server.URL).DryRun(&out, peerConnection); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("server received %d requests, want none", n)
+	}
+	if err := checkContains(out.String(),
+		"=== Dry run: WHEP offer (not sent) ===",
+		"a=rtpmap:", "VP8/90000", "VP9/90000", "opus/48000/2", "a=recvonly", "a=candidate:",
+		server.URL+" (not contacted)",
+		"ICE server: stun:",
+		"m=video [0]", "m=audio [1]",
+		"--queue-capacity=5",
+	); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestDryRunWHIP はwhip-goと同じく、送信帯域のb=TIASを付けたofferを表示し、サーバーにリクエストを送らないことを検証する
+func TestDryRunWHIP(t *testing.T) {
+	var requests atomic.Int64
+	server := newServer(&requests)
+	defer server.Close()
+
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(NewPeerConnectionConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := peerConnection.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionSendonly}); err != nil {
+		t.Fatal(err)
+	}
+
+	session := NewWHIPSession(server.URL)
+	session.SetVideoBandwidth(1_000_000)
+	var out bytes.Buffer
+	if err := session.DryRun(&out, peerConnection); err != nil {
+		t.Fatal(err)
+	}
+	if n := requests.Load(); n != 0 {
+		t.Fatalf("server received %d requests, want none", n)
+	}
+	if err := checkContains(out.String(),
+		"=== Dry run: WHIP offer (not sent) ===",
+		"b=TIAS:1000000", "a=sendonly",
+		"direction=sendonly", "VP8/90000",
+	); err != nil {
+		t.Fatal(err)
+	}
+}
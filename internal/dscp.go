@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pion/transport/v4"
+	"github.com/pion/transport/v4/stdnet"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// dscpNames はDSCPの名前とコードポイント（RFC 2474, 2597, 3246）
+var dscpNames = map[string]int{
+	"ef":  46,
+	"cs0": 0, "cs1": 8, "cs2": 16, "cs3": 24, "cs4": 32, "cs5": 40, "cs6": 48, "cs7": 56,
+	"af11": 10, "af12": 12, "af13": 14,
+	"af21": 18, "af22": 20, "af23": 22,
+	"af31": 26, "af32": 28, "af33": 30,
+	"af41": 34, "af42": 36, "af43": 38,
+}
+
+// ParseDSCP は --dscp の値（ef, af41, cs5 等の名前、または0-63の数値）をコードポイントに変換する
+// 空の場合は0（マーキングしない）を返す
+func ParseDSCP(value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if codepoint, ok := dscpNames[strings.ToLower(value)]; ok {
+		return codepoint, nil
+	}
+	codepoint, err := strconv.Atoi(value)
+	if err != nil || codepoint < 0 || codepoint > 63 {
+		return 0, fmt.Errorf("invalid --dscp: %s (use ef, afXY, csN or 0-63)", value)
+	}
+	return codepoint, nil
+}
+
+// dscpNet はpionが開くUDPソケットにDSCPを設定するtransport.Net
+// pionのSettingEngineはDSCPを直接設定できないため、ICEのソケット作成をフックする
+type dscpNet struct {
+	*stdnet.Net
+	tos      int // IPv4のToS / IPv6のTraffic Class（DSCPは上位6ビット）
+	warnOnce sync.Once
+}
+
+// NewDSCPNet はUDPソケットにDSCPのcodepointを設定するtransport.Netを作成する
+func NewDSCPNet(codepoint int) (transport.Net, error) {
+	base, err := stdnet.NewNet()
+	if err != nil {
+		return nil, err
+	}
+	return &dscpNet{Net: base, tos: codepoint << 2}, nil
+}
+
+// ListenUDP はICEのホスト候補・srflx候補のソケットを作成する
+func (n *dscpNet) ListenUDP(network string, locAddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, locAddr)
+	if err == nil {
+		n.mark(conn, network)
+	}
+	return conn, err
+}
+
+// ListenPacket はTURNのrelay候補のソケットを作成する
+func (n *dscpNet) ListenPacket(network string, address string) (net.PacketConn, error) {
+	conn, err := n.Net.ListenPacket(network, address)
+	if err == nil {
+		if udpConn, ok := conn.(*net.UDPConn); ok {
+			n.mark(udpConn, network)
+		}
+	}
+	return conn, err
+}
+
+// DialUDP はsrflx候補の問い合わせ用ソケットを作成する
+func (n *dscpNet) DialUDP(network string, laddr, raddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.DialUDP(network, laddr, raddr)
+	if err == nil {
+		n.mark(conn, network)
+	}
+	return conn, err
+}
+
+// mark はソケットにToS/Traffic Classを設定する
+// 設定できないプラットフォームでは一度だけ警告し、マーキングせずに続行する
+func (n *dscpNet) mark(conn transport.UDPConn, network string) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	if err := setSocketTOS(udpConn, network, n.tos); err != nil {
+		n.warnOnce.Do(func() {
+			fmt.Fprintf(os.Stderr, "Warning: --dscp not applied on this platform: %v\n", err)
+		})
+	}
+}
+
+// setSocketTOS はソケットのアドレスファミリーに応じてIPv4のToSまたはIPv6のTraffic Classを設定する
+// デュアルスタックのソケットでは両方を設定し、どちらかが成功すればよい
+func setSocketTOS(conn *net.UDPConn, network string, tos int) error {
+	isIPv4 := network == "udp4"
+	isIPv6 := network == "udp6"
+	if !isIPv4 && !isIPv6 {
+		if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok && addr.IP.To4() != nil {
+			isIPv4 = true
+		}
+	}
+	if isIPv4 {
+		return ipv4.NewConn(conn).SetTOS(tos)
+	}
+	err6 := ipv6.NewConn(conn).SetTrafficClass(tos)
+	if isIPv6 {
+		return err6
+	}
+	if err4 := ipv4.NewConn(conn).SetTOS(tos); err4 != nil && err6 != nil {
+		return err6
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package internal
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"golang.org/x/net/ipv4"
+)
+
+const dscpConnectTimeout = 10 * time.Second
+
+// TestDSCPParse は名前と数値のDSCP指定を検証する
+func TestDSCPParse(t *testing.T) {
+	valid := map[string]int{
+		"":     0,
+		"ef":   46,
+		"EF":   46,
+		"af41": 34,
+		"af11": 10,
+		"cs5":  40,
+		"cs0":  0,
+		"46":   46,
+		"63":   63,
+	}
+	for value, want := range valid {
+		got, err := ParseDSCP(value)
+		if err != nil {
+			t.Fatalf("ParseDSCP(%q): %v", value, err)
+		}
+		if got != want {
+			t.Fatalf("ParseDSCP(%q) = %d, want %d", value, got, want)
+		}
+	}
+	for _, value := range []string{"64", "-1", "af44", "voice", "0x2e"} {
+		if _, err := ParseDSCP(value); err == nil {
+			t.Fatalf("ParseDSCP(%q) accepted an invalid value", value)
+		}
+	}
+}
+
+// TestDSCPSocketTOS はDSCP用のNetが作成したUDPソケットにToSが設定されることを検証する
+func TestDSCPSocketTOS(t *testing.T) {
+	dscpNet, err := NewDSCPNet(46)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := dscpNet.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		t.Fatalf("ListenUDP returned %T, want *net.UDPConn", conn)
+	}
+	tos, err := ipv4.NewConn(udpConn).TOS()
+	if err != nil {
+		t.Fatalf("cannot read IP_TOS on this platform: %v", err)
+	}
+	if tos != 46<<2 {
+		t.Fatalf("socket ToS is %#x, want %#x (EF)", tos, 46<<2)
+	}
+}
+
+// TestDSCPConnect は--dscp指定時もPeerConnection同士がDTLSまで接続できることを検証する
+func TestDSCPConnect(t *testing.T) {
+	DSCPCodepoint = 46
+	defer func() { DSCPCodepoint = 0 }()
+
+	offerer, err := newPeerConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offerer.Close()
+	answerer, err := newPeerConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer answerer.Close()
+
+	if _, err := offerer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(offerer, answerer); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(dscpConnectTimeout)
+	for offerer.SCTP().Transport().State() != webrtc.DTLSTransportStateConnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("DTLS not connected within %v", dscpConnectTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,168 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const eventTimeout = 10 * time.Second
+
+// corruptFingerprint はSDPのa=fingerprintの値の先頭バイトを書き換える
+func corruptFingerprint(sdp string) (string, error) {
+	lines := strings.Split(sdp, "\r\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, "a=fingerprint:") {
+			continue
+		}
+		algorithm, value, ok := strings.Cut(strings.TrimPrefix(line, "a=fingerprint:"), " ")
+		if !ok || len(value) < 2 {
+			continue
+		}
+		first := "00"
+		if strings.EqualFold(value[:2], "00") {
+			first = "FF"
+		}
+		lines[i] = "a=fingerprint:" + algorithm + " " + first + value[2:]
+		return strings.Join(lines, "\r\n"), nil
+	}
+	return "", fmt.Errorf("no a=fingerprint line in SDP")
+}
+
+// dtlsConnect はWHEPクライアント相当のPeerConnection（offerer）と送信側を接続する
+// corrupt指定時はanswerのフィンガープリントを書き換えてからofferer側に設定する
+func dtlsConnect(corrupt bool) (<-chan ConnectionEvent, *webrtc.PeerConnection, func(), error) {
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	eventChan := make(chan ConnectionEvent, 10)
+	streamManager := NewStreamManager(NewProbeWriter(), NewDefaultRTPProcessor(), 0, nil)
+	receiver, err := CreatePeerConnection(mediaEngine, eventChan, streamManager)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		receiver.Close()
+		return nil, nil, nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		receiver.Close()
+		return nil, nil, nil, err
+	}
+	cleanup := func() {
+		sender.Close()
+		receiver.Close()
+	}
+
+	if err := dtlsExchange(receiver, sender, corrupt); err != nil {
+		cleanup()
+		return nil, nil, nil, err
+	}
+	return eventChan, receiver, cleanup, nil
+}
+
+// dtlsExchange はICE候補の収集を待ってSDPを交換する
+func dtlsExchange(offerer, answerer *webrtc.PeerConnection, corrupt bool) error {
+	offer, err := offerer.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(offerer)
+	if err := offerer.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gathered
+	if err := answerer.SetRemoteDescription(*offerer.LocalDescription()); err != nil {
+		return err
+	}
+
+	answer, err := answerer.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	gathered = webrtc.GatheringCompletePromise(answerer)
+	if err := answerer.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	<-gathered
+
+	remote := *answerer.LocalDescription()
+	if corrupt {
+		if remote.SDP, err = corruptFingerprint(remote.SDP); err != nil {
+			return err
+		}
+	}
+	return offerer.SetRemoteDescription(remote)
+}
+
+// TestDTLSFingerprintMismatch はICE接続後にDTLSが失敗した場合、ErrDTLSHandshakeが通知されることを検証する
+func TestDTLSFingerprintMismatch(t *testing.T) {
+	eventChan, _, cleanup, err := dtlsConnect(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	timeout := time.After(eventTimeout)
+	iceConnected := false
+	for {
+		select {
+		case event := <-eventChan:
+			switch event.State {
+			case StateConnected:
+				iceConnected = true
+			case StateFailed:
+				if !errors.Is(event.Error, ErrDTLSHandshake) {
+					t.Fatalf("failed with %v, want ErrDTLSHandshake", event.Error)
+				}
+				if !iceConnected {
+					t.Fatalf("DTLS failure reported before ICE connected")
+				}
+				// whep-goと同様に包んだ場合、終了コードは接続エラーになる
+				wrapped := fmt.Errorf("%w: %w", ErrConnection, event.Error)
+				if code := ExitCode(wrapped); code != ExitConnection {
+					t.Fatalf("exit code %d, want %d", code, ExitConnection)
+				}
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no DTLS failure within %v (ICE connected=%v)", eventTimeout, iceConnected)
+		}
+	}
+}
+
+// TestDTLSFingerprintMatch は正しいフィンガープリントではDTLSが接続し、失敗が通知されないことを検証する
+func TestDTLSFingerprintMatch(t *testing.T) {
+	eventChan, receiver, cleanup, err := dtlsConnect(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	deadline := time.Now().Add(eventTimeout)
+	for receiver.SCTP().Transport().State() != webrtc.DTLSTransportStateConnected {
+		if time.Now().After(deadline) {
+			t.Fatalf("DTLS not connected within %v", eventTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for {
+		select {
+		case event := <-eventChan:
+			if event.State == StateFailed {
+				t.Fatalf("unexpected failure: %v", event.Error)
+			}
+		default:
+			return
+		}
+	}
+}
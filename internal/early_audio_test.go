@@ -0,0 +1,237 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	earlyAudioWidth     = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	earlyAudioHeight    = 360
+	earlyAudioAudioStep = 20 * time.Millisecond // Opusのフレーム長
+	earlyAudioVideoStep = 40 * time.Millisecond // 25fps
+	videoAfter          = time.Second           // 映像開始後に書き込む長さ
+)
+
+// earlyAudioScenario は音声と映像の到着時刻（書き込み開始からの経過時間）
+type earlyAudioScenario struct {
+	audioStarts []time.Duration // 音声トラックごとの開始時刻
+	videoStart  time.Duration   // 640x360の映像の開始時刻
+	previewAt   time.Duration   // 低解像度プレビューのキーフレームの時刻（負で無し）
+}
+
+// earlyAudioOpusPacket はトラックとシーケンス番号を末尾に付けた20msのOpusパケット
+func earlyAudioOpusPacket(track, seq int) []byte {
+	return []byte{0xF8, 0xFF, 0xFE, byte(track), byte(seq >> 8), byte(seq)}
+}
+
+// earlyAudioEncodeFrames はw×hのVP8フレームをn枚エンコードする
+func earlyAudioEncodeFrames(w, h, n int) ([][]byte, []bool, error) {
+	encoder, err := NewVP8Encoder(w, h, "YUV420P", 500)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer encoder.Close()
+	yuv := bytes.Repeat([]byte{0x80}, w*h*3/2)
+	var frames [][]byte
+	var keyframes []bool
+	for i := 0; i < n; i++ {
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return nil, nil, err
+		}
+		frames = append(frames, encoded)
+		keyframes = append(keyframes, keyframe)
+	}
+	return frames, keyframes, nil
+}
+
+// earlyAudioRun はManualClockを20msずつ進めながらscenarioどおりに音声と映像を書き込み、出力のブロックを返す
+func earlyAudioRun(s earlyAudioScenario) ([]block, error) {
+	frames, keyframes, err := earlyAudioEncodeFrames(earlyAudioWidth, earlyAudioHeight, int(videoAfter/earlyAudioVideoStep))
+	if err != nil {
+		return nil, err
+	}
+	var preview []byte
+	videoFirst := s.videoStart
+	if s.previewAt >= 0 {
+		previewFrames, _, err := earlyAudioEncodeFrames(320, 180, 1)
+		if err != nil {
+			return nil, err
+		}
+		preview = previewFrames[0]
+		videoFirst = s.previewAt
+	}
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	clock := newManualClock(time.Unix(0, 0))
+	writer.SetClock(clock)
+	for range s.audioStarts {
+		if _, err := writer.AddAudioTrack(); err != nil {
+			return nil, err
+		}
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	videoTS := func(t time.Duration) uint32 { return uint32((t - videoFirst) * 90000 / time.Second) }
+	end := s.videoStart + videoAfter
+	for t := time.Duration(0); t < end; t += earlyAudioAudioStep {
+		if t > 0 {
+			clock.Advance(earlyAudioAudioStep)
+		}
+		if preview != nil && t == s.previewAt {
+			if err := writer.WriteVideoFrame(preview, videoTS(t), true); err != nil {
+				return nil, fmt.Errorf("preview: %v", err)
+			}
+		}
+		if t >= s.videoStart && (t-s.videoStart)%earlyAudioVideoStep == 0 {
+			i := int((t - s.videoStart) / earlyAudioVideoStep)
+			if err := writer.WriteVideoFrame(frames[i], videoTS(t), keyframes[i]); err != nil {
+				return nil, fmt.Errorf("video frame %d: %v", i, err)
+			}
+		}
+		for track, start := range s.audioStarts {
+			if t < start {
+				continue
+			}
+			seq := int((t - start) / earlyAudioAudioStep)
+			if err := writer.WriteAudioTrackFrame(track, earlyAudioOpusPacket(track, seq), uint32(seq*960)); err != nil {
+				return nil, fmt.Errorf("audio track %d frame %d: %v", track, seq, err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return scanBlocks(out.Bytes())
+}
+
+// earlyAudioCheck は各音声トラックでfirstSeq以降のフレームがすべて書き込まれ、
+// すべてのブロックのtimecodeが到着時刻からoriginを引いた値（ms）と一致することを検証する
+func earlyAudioCheck(s earlyAudioScenario, blocks []block, firstSeq int, origin time.Duration) error {
+	audioFrames := map[int]int{}
+	videoFrames := 0
+	for _, b := range blocks {
+		if b.track == 1 {
+			want := (s.videoStart + time.Duration(videoFrames)*earlyAudioVideoStep - origin).Milliseconds()
+			if b.timecode != want {
+				return fmt.Errorf("video frame %d at %dms, want %dms", videoFrames, b.timecode, want)
+			}
+			videoFrames++
+			continue
+		}
+		if len(b.data) != 6 {
+			return fmt.Errorf("unexpected block on track %d", b.track)
+		}
+		track := int(b.data[3])
+		seq := int(b.data[4])<<8 | int(b.data[5])
+		if b.track != uint64(2+track) {
+			return fmt.Errorf("audio track %d frame written to MKV track %d", track, b.track)
+		}
+		if want := firstSeq + audioFrames[track]; seq != want {
+			return fmt.Errorf("audio track %d: frame %d written, want frame %d (lost or reordered)", track, seq, want)
+		}
+		want := (s.audioStarts[track] + time.Duration(seq)*earlyAudioAudioStep - origin).Milliseconds()
+		if b.timecode != want {
+			return fmt.Errorf("audio track %d frame %d at %dms, want %dms", track, seq, b.timecode, want)
+		}
+		audioFrames[track]++
+	}
+	if videoFrames != int(videoAfter/earlyAudioVideoStep) {
+		return fmt.Errorf("%d video frames written, want %d", videoFrames, int(videoAfter/earlyAudioVideoStep))
+	}
+	end := s.videoStart + videoAfter
+	for track, start := range s.audioStarts {
+		if want := int((end-start+earlyAudioAudioStep-1)/earlyAudioAudioStep) - firstSeq; audioFrames[track] != want {
+			return fmt.Errorf("audio track %d: %d frames written, want %d", track, audioFrames[track], want)
+		}
+	}
+	return nil
+}
+
+// testAudioFirst は映像より500ms先に始まった音声が失われず、映像がその分後ろにずれることを検証する
+func testAudioFirst() error {
+	s := earlyAudioScenario{audioStarts: []time.Duration{0}, videoStart: 500 * time.Millisecond, previewAt: -1}
+	blocks, err := earlyAudioRun(s)
+	if err != nil {
+		return err
+	}
+	return earlyAudioCheck(s, blocks, 0, 0)
+}
+
+// TestEarlyAudioAudioFirst は映像より500ms先に始まった音声が失われないことを検証する
+func TestEarlyAudioAudioFirst(t *testing.T) {
+	if err := testAudioFirst(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEarlyAudioNoInterleave はインターリーブ無効時も先行した音声が失われないことを検証する
+func TestEarlyAudioNoInterleave(t *testing.T) {
+	saved := InterleaveWindowMs
+	InterleaveWindowMs = 0
+	defer func() { InterleaveWindowMs = saved }()
+	if err := testAudioFirst(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEarlyAudioMultipleTracks は開始時刻の異なる2つの音声トラックがそれぞれの到着時刻に合わせて書き込まれることを検証する
+func TestEarlyAudioMultipleTracks(t *testing.T) {
+	s := earlyAudioScenario{audioStarts: []time.Duration{100 * time.Millisecond, 300 * time.Millisecond}, videoStart: 500 * time.Millisecond, previewAt: -1}
+	blocks, err := earlyAudioRun(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := earlyAudioCheck(s, blocks, 0, 100*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEarlyAudioAfterPreview は低解像度プレビューの後、ヘッダー前に始まった音声が映像のtimecodeをずらさずに書き込まれることを検証する
+func TestEarlyAudioAfterPreview(t *testing.T) {
+	s := earlyAudioScenario{audioStarts: []time.Duration{100 * time.Millisecond}, videoStart: 400 * time.Millisecond, previewAt: 0}
+	blocks, err := earlyAudioRun(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := earlyAudioCheck(s, blocks, 0, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEarlyAudioBufferLimit はヘッダー前の音声が上限を超えた場合に古いフレームから破棄されることを検証する
+func TestEarlyAudioBufferLimit(t *testing.T) {
+	const limit = 250 // maxEarlyAudioFrames
+	s := earlyAudioScenario{audioStarts: []time.Duration{0}, videoStart: 6 * time.Second, previewAt: -1}
+	blocks, err := earlyAudioRun(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := int(s.videoStart/earlyAudioAudioStep) - limit
+	if err := earlyAudioCheck(s, blocks, dropped, time.Duration(dropped)*earlyAudioAudioStep); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestEarlyAudioBufferLimitPerTrack は上限が音声トラックごとに適用され、
+// 2つのトラックがどちらも直近5秒分を保持することを検証する
+func TestEarlyAudioBufferLimitPerTrack(t *testing.T) {
+	const limit = 250 // maxEarlyAudioFrames
+	s := earlyAudioScenario{audioStarts: []time.Duration{0, 0}, videoStart: 6 * time.Second, previewAt: -1}
+	blocks, err := earlyAudioRun(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := int(s.videoStart/earlyAudioAudioStep) - limit
+	if err := earlyAudioCheck(s, blocks, dropped, time.Duration(dropped)*earlyAudioAudioStep); err != nil {
+		t.Fatal(err)
+	}
+}
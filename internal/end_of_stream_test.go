@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"testing"
+)
+
+// TestEndOfStreamOpusFlush は入力終端で10ms未満の端数PCMもエンコードされることを検証する
+func TestEndOfStreamOpusFlush(t *testing.T) {
+	encoder, err := NewOpusEncoder(48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	// 25ms分（10msフレーム2つ + 5msの端数）
+	pcm := make([]byte, 48*25*2*2)
+	frames, err := encoder.Encode(pcm, 1000, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("encoded %d frames, want 2", len(frames))
+	}
+	flushed, err := encoder.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flushed) != 1 || len(flushed[0].Data) == 0 {
+		t.Fatalf("flush returned %d frames, want 1", len(flushed))
+	}
+	if flushed[0].TimestampMs != 1020 {
+		t.Fatalf("flushed frame at %dms, want 1020ms", flushed[0].TimestampMs)
+	}
+	if again, err := encoder.Flush(); err != nil || len(again) != 0 {
+		t.Fatalf("second flush returned %d frames (err=%v), want 0", len(again), err)
+	}
+}
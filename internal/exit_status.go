@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// 終了コード（スクリプトから終了理由を判別できるよう、原因ごとに分ける）
+const (
+	ExitOK           = 0
+	ExitError        = 1 // 上記以外（入力エラー、引数エラー等）
+	ExitConnection   = 2 // サーバーへの到達、ICE接続、接続断
+	ExitAuth         = 3 // サーバーが401/403を返した
+	ExitMediaTimeout = 4 // 接続後にメディア（またはキーフレーム）が届かない
+	ExitServerError  = 5 // サーバーが上記以外のエラー応答を返した
+)
+
+var (
+	// ErrConnection はサーバーへの接続、またはWebRTC接続の確立・維持に失敗したことを示す
+	ErrConnection = errors.New("connection failed")
+	// ErrMediaTimeout は接続後に一定時間メディアが届かなかったことを示す
+	ErrMediaTimeout = errors.New("media timeout")
+)
+
+// ServerError はWHIP/WHEPサーバーがofferに201以外で応答したことを示す
+type ServerError struct {
+	Protocol   string
+	StatusCode int
+	Body       string
+}
+
+func (e *ServerError) Error() string {
+	return fmt.Sprintf("%s server returned status %d: %s", e.Protocol, e.StatusCode, e.Body)
+}
+
+// ExitCode はerrの原因に対応する終了コードを返す
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	var serverErr *ServerError
+	switch {
+	case errors.As(err, &serverErr):
+		if serverErr.StatusCode == http.StatusUnauthorized || serverErr.StatusCode == http.StatusForbidden {
+			return ExitAuth
+		}
+		return ExitServerError
+	case errors.Is(err, ErrMediaTimeout), errors.Is(err, ErrKeyframeTimeout):
+		return ExitMediaTimeout
+	case errors.Is(err, ErrConnection):
+		return ExitConnection
+	default:
+		return ExitError
+	}
+}
+
+// exitReason は終了コードをサマリー行のreasonに変換する
+func exitReason(code int) string {
+	switch code {
+	case ExitOK:
+		return "ok"
+	case ExitConnection:
+		return "connection"
+	case ExitAuth:
+		return "auth"
+	case ExitMediaTimeout:
+		return "media_timeout"
+	case ExitServerError:
+		return "server_error"
+	default:
+		return "error"
+	}
+}
+
+// FormatExitSummary は終了理由を1行のlogfmt形式（末尾改行付き）にする
+// 例: exit code=4 reason=media_timeout error="media timeout: connected but no media within 5s"
+func FormatExitSummary(err error) string {
+	code := ExitCode(err)
+	if err == nil {
+		return fmt.Sprintf("exit code=%d reason=%s\n", code, exitReason(code))
+	}
+	return fmt.Sprintf("exit code=%d reason=%s error=%q\n", code, exitReason(code), err.Error())
+}
+
+// Exit はサマリー行をstderrに出力し、errに対応する終了コードで終了する
+func Exit(err error) {
+	fmt.Fprint(os.Stderr, FormatExitSummary(err))
+	os.Exit(ExitCode(err))
+}
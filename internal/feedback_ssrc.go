@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"slices"
+	"sync"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v4"
+)
+
+// feedbackSSRCRecorder は送信したRTCPフィードバックの送信元SSRCを記録する
+// 受信専用のPeerConnectionは送信トラックを持たず、レシーバーレポート等のSSRCはインターセプターが決めるため、
+// 送信したRTCPから集めてRTCP BYEに使う。CreatePeerConnectionがセッションのStreamManagerに設定する
+type feedbackSSRCRecorder struct {
+	mu    sync.Mutex
+	ssrcs []uint32
+}
+
+func (r *feedbackSSRCRecorder) add(ssrc uint32) {
+	if ssrc == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !slices.Contains(r.ssrcs, ssrc) {
+		r.ssrcs = append(r.ssrcs, ssrc)
+	}
+}
+
+func (r *feedbackSSRCRecorder) list() []uint32 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.Clone(r.ssrcs)
+}
+
+// feedbackSSRCRecorderFactory はRTCPフィードバックの送信元SSRCを記録するインターセプターを作成する
+// 先に登録したインターセプターほど送信路の下流になるため、NACK・レポート・TWCCのインターセプターより前に登録する
+type feedbackSSRCRecorderFactory struct {
+	recorder *feedbackSSRCRecorder
+}
+
+func (f feedbackSSRCRecorderFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &feedbackSSRCInterceptor{recorder: f.recorder}, nil
+}
+
+// feedbackSSRCInterceptor は送信するRTCPのうちレシーバーレポートとフィードバックの送信元SSRCを記録する
+type feedbackSSRCInterceptor struct {
+	interceptor.NoOp
+	recorder *feedbackSSRCRecorder
+}
+
+func (i *feedbackSSRCInterceptor) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		for _, pkt := range pkts {
+			switch p := pkt.(type) {
+			case *rtcp.ReceiverReport:
+				i.recorder.add(p.SSRC)
+			case *rtcp.TransportLayerNack:
+				i.recorder.add(p.SenderSSRC)
+			case *rtcp.TransportLayerCC:
+				i.recorder.add(p.SenderSSRC)
+			case *rtcp.PictureLossIndication:
+				i.recorder.add(p.SenderSSRC)
+			}
+		}
+		return writer.Write(pkts, attributes)
+	})
+}
+
+// GoodbyeSources はRTCP BYEで終了を通知するSSRCを返す
+// 送信中の全SSRC（simulcast時は全レイヤー）と、feedbackSSRCs（受信時にこれまで送ったRTCPフィードバックのSSRC、
+// StreamManager.FeedbackSSRCsで取得する。送信側はnil）
+func GoodbyeSources(peerConnection *webrtc.PeerConnection, feedbackSSRCs []uint32) []uint32 {
+	var sources []uint32
+	for _, sender := range peerConnection.GetSenders() {
+		if sender.Track() == nil {
+			continue
+		}
+		for _, encoding := range sender.GetParameters().Encodings {
+			if encoding.SSRC != 0 {
+				sources = append(sources, uint32(encoding.SSRC))
+			}
+		}
+	}
+	return append(sources, feedbackSSRCs...)
+}
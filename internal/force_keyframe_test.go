@@ -0,0 +1,118 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+const (
+	forceKeyframeWidth  = 320
+	forceKeyframeHeight = 240
+	forceKeyframeFrames = 50
+)
+
+// encode はForceKeyframeEvery、KeyframeIntervalを設定したエンコーダーでframes枚をエンコードし、
+// 各フレームがキーフレームかどうかとエンコーダーを返す
+// forceAtに含まれるフレームの前にForceKeyframeを呼ぶ
+func encode(every, maxDist int, forceAt ...int) ([]bool, *VP8Encoder, error) {
+	savedEvery, savedMaxDist := ForceKeyframeEvery, KeyframeInterval
+	ForceKeyframeEvery, KeyframeInterval = every, maxDist
+	defer func() { ForceKeyframeEvery, KeyframeInterval = savedEvery, savedMaxDist }()
+
+	encoder, err := NewVP8Encoder(forceKeyframeWidth, forceKeyframeHeight, "YUV420P", 500)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer encoder.Close()
+	var keyframes []bool
+	for i := 0; i < forceKeyframeFrames; i++ {
+		for _, at := range forceAt {
+			if at == i {
+				encoder.ForceKeyframe()
+			}
+		}
+		// 静止画では自然なキーフレームが入らないため、フレームごとに輝度を変える
+		yuv := bytes.Repeat([]byte{byte(64 + i)}, forceKeyframeWidth*forceKeyframeHeight*3/2)
+		_, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return nil, nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		keyframes = append(keyframes, keyframe)
+	}
+	return keyframes, encoder, nil
+}
+
+// forceKeyframeKeyframeIndexes はキーフレームのフレーム番号を返す
+func forceKeyframeKeyframeIndexes(keyframes []bool) []int {
+	var indexes []int
+	for i, keyframe := range keyframes {
+		if keyframe {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// TestForceKeyframeCadence は --force-keyframe-interval 10 で10フレームごとにキーフレームが入り、
+// 最初のフレーム以外が強制したキーフレームとして数えられることを検証する
+func TestForceKeyframeCadence(t *testing.T) {
+	keyframes, encoder, err := encode(10, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := forceKeyframeKeyframeIndexes(keyframes)
+	if fmt.Sprint(got) != fmt.Sprint([]int{0, 10, 20, 30, 40}) {
+		t.Fatalf("keyframes at %v, want [0 10 20 30 40]", got)
+	}
+	if forced, natural := encoder.KeyframeCounts(); forced != 4 || natural != 1 {
+		t.Fatalf("counted forced=%d natural=%d, want forced=4 natural=1", forced, natural)
+	}
+}
+
+// TestForceKeyframeIndependentOfAuto はエンコーダーの自動キーフレーム（--keyframe-interval）と併用しても
+// 周期的なキーフレームが入り、自動のキーフレームは自然なキーフレームとして数えられることを検証する
+func TestForceKeyframeIndependentOfAuto(t *testing.T) {
+	keyframes, encoder, err := encode(10, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 10; i < forceKeyframeFrames; i += 10 {
+		if !keyframes[i] {
+			t.Fatalf("frame %d is not a keyframe (keyframes at %v)", i, forceKeyframeKeyframeIndexes(keyframes))
+		}
+	}
+	forced, natural := encoder.KeyframeCounts()
+	if total := int64(len(forceKeyframeKeyframeIndexes(keyframes))); forced != 4 || natural < 2 || forced+natural != total {
+		t.Fatalf("counted forced=%d natural=%d for %d keyframes at %v, want forced=4 and natural auto keyframes",
+			forced, natural, total, forceKeyframeKeyframeIndexes(keyframes))
+	}
+}
+
+// TestForceKeyframeDisabled は0（デフォルト）で周期的なキーフレームを強制しないことを検証する
+func TestForceKeyframeDisabled(t *testing.T) {
+	keyframes, encoder, err := encode(0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := forceKeyframeKeyframeIndexes(keyframes); fmt.Sprint(got) != "[0]" {
+		t.Fatalf("keyframes at %v, want only the first frame", got)
+	}
+	if forced, natural := encoder.KeyframeCounts(); forced != 0 || natural != 1 {
+		t.Fatalf("counted forced=%d natural=%d, want forced=0 natural=1", forced, natural)
+	}
+}
+
+// TestForceKeyframeRequest はForceKeyframeで次のフレームのみがキーフレームになることを検証する
+func TestForceKeyframeRequest(t *testing.T) {
+	keyframes, encoder, err := encode(0, 1000, 17)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := forceKeyframeKeyframeIndexes(keyframes); fmt.Sprint(got) != "[0 17]" {
+		t.Fatalf("keyframes at %v, want [0 17]", got)
+	}
+	if forced, natural := encoder.KeyframeCounts(); forced != 1 || natural != 1 {
+		t.Fatalf("counted forced=%d natural=%d, want forced=1 natural=1", forced, natural)
+	}
+}
@@ -0,0 +1,43 @@
+package internal
+
+// frameRateLimiterToleranceMs はPTSがミリ秒に丸められていることによる誤差を吸収する幅
+const frameRateLimiterToleranceMs = 1.0
+
+// FrameRateLimiter はPTSに基づいてフレームを間引き、maxFPSを超えないようにする
+// 入力がmaxFPS以下の場合は全てのフレームを通す
+type FrameRateLimiter struct {
+	intervalMs  float64 // 通すフレームの最小間隔（ミリ秒）
+	nextMs      float64 // 次にフレームを通すPTS（ミリ秒）
+	lastMs      int64   // 最後に通したフレームのPTS
+	initialized bool
+}
+
+// NewFrameRateLimiter は新しいFrameRateLimiterを作成する
+func NewFrameRateLimiter(maxFPS int) *FrameRateLimiter {
+	return &FrameRateLimiter{
+		intervalMs: 1000.0 / float64(maxFPS),
+	}
+}
+
+// Allow はPTSのフレームを通す場合はtrue、間引く場合はfalseを返す
+func (l *FrameRateLimiter) Allow(timestampMs int64) bool {
+	// 最初のフレーム、またはPTSが戻った場合（ループ等）は再同期する
+	if !l.initialized || timestampMs < l.lastMs {
+		l.initialized = true
+		l.lastMs = timestampMs
+		l.nextMs = float64(timestampMs) + l.intervalMs
+		return true
+	}
+
+	pts := float64(timestampMs)
+	if pts+frameRateLimiterToleranceMs < l.nextMs {
+		return false
+	}
+	l.lastMs = timestampMs
+	l.nextMs += l.intervalMs
+	// 入力が途切れた後に遅れを取り戻そうとして連続で通さないよう、現在のPTSから数え直す
+	if l.nextMs <= pts {
+		l.nextMs = pts + l.intervalMs
+	}
+	return true
+}
@@ -0,0 +1,48 @@
+package internal
+
+// HalveFrame はフレームを縦横1/2に縮小する（2x2画素の平均）
+// 出力サイズはエンコーダーのI420変換に合わせて偶数に切り捨てる。
+// pixelFormatはVP8Encoderと同じくYUV420P/I420、それ以外はRGBAとして扱う
+func HalveFrame(data []byte, pixelFormat string, width, height int) ([]byte, int, int) {
+	dstWidth := (width / 2) &^ 1
+	dstHeight := (height / 2) &^ 1
+
+	switch pixelFormat {
+	case "YUV420P", "I420":
+		// 奇数サイズの入力の色差プレーンは切り上げた (w+1)/2 x (h+1)/2（VP8Encoderと同じ）
+		srcCWidth, srcCHeight := (width+1)/2, (height+1)/2
+		srcY := width * height
+		srcC := srcCWidth * srcCHeight
+		dstY := dstWidth * dstHeight
+		dstC := (dstWidth / 2) * (dstHeight / 2)
+		out := make([]byte, dstY+2*dstC)
+		halvePlane(data[:srcY], width, height, 1, out[:dstY], dstWidth, dstHeight)
+		halvePlane(data[srcY:srcY+srcC], srcCWidth, srcCHeight, 1, out[dstY:dstY+dstC], dstWidth/2, dstHeight/2)
+		halvePlane(data[srcY+srcC:srcY+2*srcC], srcCWidth, srcCHeight, 1, out[dstY+dstC:], dstWidth/2, dstHeight/2)
+		return out, dstWidth, dstHeight
+	default:
+		out := make([]byte, dstWidth*dstHeight*4)
+		halvePlane(data, width, height, 4, out, dstWidth, dstHeight)
+		return out, dstWidth, dstHeight
+	}
+}
+
+// halvePlane はchannels個のチャンネルがインターリーブされた1プレーンを縮小する
+// 入力の端を超える画素は端の画素で補う
+func halvePlane(src []byte, srcWidth, srcHeight, channels int, dst []byte, dstWidth, dstHeight int) {
+	for y := 0; y < dstHeight; y++ {
+		y0 := min(2*y, srcHeight-1)
+		y1 := min(2*y+1, srcHeight-1)
+		row0 := src[y0*srcWidth*channels:]
+		row1 := src[y1*srcWidth*channels:]
+		out := dst[y*dstWidth*channels:]
+		for x := 0; x < dstWidth; x++ {
+			x0 := min(2*x, srcWidth-1) * channels
+			x1 := min(2*x+1, srcWidth-1) * channels
+			for c := 0; c < channels; c++ {
+				sum := int(row0[x0+c]) + int(row0[x1+c]) + int(row1[x0+c]) + int(row1[x1+c])
+				out[x*channels+c] = byte((sum + 2) / 4)
+			}
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+// frameScaleI420 はY、U、Vをそれぞれ一定の値で埋めたI420フレームを作る（奇数サイズの色差は切り上げ）
+func frameScaleI420(width, height int, y, u, v byte) []byte {
+	chroma := ((width + 1) / 2) * ((height + 1) / 2)
+	frame := bytes.Repeat([]byte{y}, width*height)
+	frame = append(frame, bytes.Repeat([]byte{u}, chroma)...)
+	return append(frame, bytes.Repeat([]byte{v}, chroma)...)
+}
+
+// TestFrameScaleOddI420 は奇数サイズのI420入力で、色差プレーンを切り上げたサイズで読み、
+// UとVのプレーンを取り違えずに偶数サイズへ縮小することを検証する
+func TestFrameScaleOddI420(t *testing.T) {
+	for _, size := range [][2]int{{641, 361}, {5, 3}, {7, 7}, {640, 360}} {
+		width, height := size[0], size[1]
+		out, w, h := HalveFrame(frameScaleI420(width, height, 0x10, 0x64, 0xC8), "I420", width, height)
+		if wantW, wantH := (width/2)&^1, (height/2)&^1; w != wantW || h != wantH {
+			t.Fatalf("%dx%d: halved to %dx%d, want %dx%d", width, height, w, h, wantW, wantH)
+		}
+		dstY, dstC := w*h, (w/2)*(h/2)
+		if len(out) != dstY+2*dstC {
+			t.Fatalf("%dx%d: %d bytes, want %d", width, height, len(out), dstY+2*dstC)
+		}
+		for _, plane := range []struct {
+			name string
+			data []byte
+			want byte
+		}{
+			{"Y", out[:dstY], 0x10},
+			{"U", out[dstY : dstY+dstC], 0x64},
+			{"V", out[dstY+dstC:], 0xC8},
+		} {
+			for i, v := range plane.data {
+				if v != plane.want {
+					t.Fatalf("%dx%d: %s plane byte %d is %#x, want %#x", width, height, plane.name, i, v, plane.want)
+				}
+			}
+		}
+	}
+}
+
+// TestFrameScaleAverage は2x2画素の平均で縮小し、奇数サイズの端の列と行は使わないことを検証する
+func TestFrameScaleAverage(t *testing.T) {
+	// 5x4のRGBAの左上2x2に0, 10, 20, 30、右端の列に255を置く
+	const width, height = 5, 4
+	rgba := make([]byte, width*height*4)
+	set := func(x, y int, v byte) {
+		for c := 0; c < 4; c++ {
+			rgba[(y*width+x)*4+c] = v
+		}
+	}
+	set(0, 0, 0)
+	set(1, 0, 10)
+	set(0, 1, 20)
+	set(1, 1, 30)
+	for y := 0; y < height; y++ {
+		set(width-1, y, 255)
+	}
+
+	out, w, h := HalveFrame(rgba, "RGBA", width, height)
+	if w != 2 || h != 2 {
+		t.Fatalf("halved to %dx%d, want 2x2", w, h)
+	}
+	if out[0] != 15 {
+		t.Fatalf("top-left pixel %d, want the average 15", out[0])
+	}
+	for i := range out {
+		if out[i] > 30 {
+			t.Fatalf("byte %d is %d: the dropped right edge column leaked into the output", i, out[i])
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// spillFileCount はリングにするファイル数（合計の上限をこの数で等分する）
+	spillFileCount = 4
+	// spillMagic はspillファイルの先頭のシグネチャ
+	spillMagic = "WSPL"
+	// spillRecordHeaderSize は1フレームのレコードヘッダー（種類、キーフレーム、予約、サイズ、PTS）のサイズ
+	spillRecordHeaderSize = 16
+)
+
+// FrameSpiller はwhip-goの送信キューが満杯で破棄したフレームを、後から調べられるよう --spill-dir のファイルに書き出す
+// 書き出したフレームは再送しない
+// ファイルはspill-0.frames〜spill-3.framesのリングで、1ファイルが上限の1/4に達すると次のファイルを先頭から上書きする
+type FrameSpiller struct {
+	dir       string
+	fileLimit int64 // 1ファイルあたりの上限（ヘッダーを含むバイト数）
+
+	mu        sync.Mutex
+	file      *os.File
+	index     int   // 書き込み中のファイル番号
+	fileBytes int64 // 書き込み中のファイルのバイト数
+	err       error // 最初の書き込みエラー（以降は書き出さない）
+
+	frames  atomic.Int64 // 書き出したフレーム数
+	bytes   atomic.Int64 // 書き出したフレームのデータのバイト数
+	skipped atomic.Int64 // 1ファイルに収まらない、または書き込みエラーで書き出さなかったフレーム数
+}
+
+// NewFrameSpiller はdirに合計maxBytesまでのspillファイルを書き出すFrameSpillerを作成する
+// dirが無ければ作成し、書き込めない場合はエラーを返す
+func NewFrameSpiller(dir string, maxBytes int64) (*FrameSpiller, error) {
+	fileLimit := maxBytes / spillFileCount
+	if fileLimit <= int64(len(spillMagic)+spillRecordHeaderSize) {
+		return nil, fmt.Errorf("spill size %d bytes is too small for %d files", maxBytes, spillFileCount)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("cannot create spill directory: %w", err)
+	}
+	// 前回の実行のファイルが残っていると合計が上限を超えるため、リングのファイルを消してから始める
+	for i := 1; i < spillFileCount; i++ {
+		if err := os.Remove(SpillFilePath(dir, i)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("cannot remove old spill file: %w", err)
+		}
+	}
+	s := &FrameSpiller{dir: dir, fileLimit: fileLimit}
+	if err := s.openFile(0); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// SpillFilePath はdirのindex番目のspillファイルのパスを返す
+func SpillFilePath(dir string, index int) string {
+	return filepath.Join(dir, fmt.Sprintf("spill-%d.frames", index))
+}
+
+// openFile はindex番目のファイルを空にして開き、シグネチャを書き込む
+func (s *FrameSpiller) openFile(index int) error {
+	file, err := os.Create(SpillFilePath(s.dir, index))
+	if err != nil {
+		return fmt.Errorf("cannot create spill file: %w", err)
+	}
+	if _, err := file.WriteString(spillMagic); err != nil {
+		file.Close()
+		return fmt.Errorf("cannot write spill file: %w", err)
+	}
+	s.file = file
+	s.index = index
+	s.fileBytes = int64(len(spillMagic))
+	return nil
+}
+
+// Spill はframeをspillファイルに書き出す
+// 書き込みエラーは最初の1回だけ表示し、以降のフレームは書き出さない（送信は続ける）
+func (s *FrameSpiller) Spill(frame *Frame) {
+	size := int64(spillRecordHeaderSize + len(frame.Data))
+	if size > s.fileLimit-int64(len(spillMagic)) {
+		s.skipped.Add(1)
+		DebugLogPeriodic("spill.too_large", time.Second, "Spill: frame of %d bytes exceeds the per-file limit of %d bytes, not spilled\n", len(frame.Data), s.fileLimit)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil || s.file == nil {
+		s.skipped.Add(1)
+		return
+	}
+	if s.fileBytes+size > s.fileLimit {
+		s.file.Close()
+		if err := s.openFile((s.index + 1) % spillFileCount); err != nil {
+			s.fail(err)
+			return
+		}
+	}
+
+	var header [spillRecordHeaderSize]byte
+	header[0] = byte(frame.Type)
+	if frame.IsKeyframe {
+		header[1] = 1
+	}
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(frame.Data)))
+	binary.BigEndian.PutUint64(header[8:16], uint64(frame.TimestampMs))
+	if _, err := s.file.Write(header[:]); err != nil {
+		s.fail(fmt.Errorf("cannot write spill file: %w", err))
+		return
+	}
+	if _, err := s.file.Write(frame.Data); err != nil {
+		s.fail(fmt.Errorf("cannot write spill file: %w", err))
+		return
+	}
+	s.fileBytes += size
+	s.frames.Add(1)
+	s.bytes.Add(int64(len(frame.Data)))
+}
+
+// fail は書き込みエラーを記録して以降の書き出しを止める（s.muを保持して呼ぶ）
+func (s *FrameSpiller) fail(err error) {
+	s.err = err
+	s.skipped.Add(1)
+	fmt.Fprintf(os.Stderr, "Warning: %v; dropped frames are no longer spilled\n", err)
+}
+
+// Stats は書き出したフレーム数、データのバイト数、書き出さなかったフレーム数を返す
+func (s *FrameSpiller) Stats() (frames, bytes, skipped int64) {
+	return s.frames.Load(), s.bytes.Load(), s.skipped.Load()
+}
+
+// Close は書き込み中のファイルを閉じる
+func (s *FrameSpiller) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// ReadSpillFile はspillファイルのフレームを書き出した順に読む
+// 書き込み中に終了して末尾のレコードが途切れている場合は、それより前のフレームを返す
+func ReadSpillFile(r io.Reader) ([]*Frame, error) {
+	magic := make([]byte, len(spillMagic))
+	if _, err := io.ReadFull(r, magic); err != nil || string(magic) != spillMagic {
+		return nil, fmt.Errorf("not a spill file")
+	}
+	var frames []*Frame
+	for {
+		var header [spillRecordHeaderSize]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return frames, nil
+			}
+			return frames, err
+		}
+		data := make([]byte, binary.BigEndian.Uint32(header[4:8]))
+		if _, err := io.ReadFull(r, data); err != nil {
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+				return frames, nil
+			}
+			return frames, err
+		}
+		frames = append(frames, &Frame{
+			Type:        FrameType(header[0]),
+			IsKeyframe:  header[1] == 1,
+			TimestampMs: int64(binary.BigEndian.Uint64(header[8:16])),
+			Data:        data,
+		})
+	}
+}
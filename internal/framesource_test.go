@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// checkSource はFrameSourceからdurationMs分のフレームを読み、
+// PTSが映像/音声それぞれで単調増加し、フレームサイズが入力情報と一致することを検証する
+func checkSource(source FrameSource, durationMs int64) (videoFrames, audioFrames int, err error) {
+	width, height := source.VideoWidth(), source.VideoHeight()
+	videoSize := width * height * 3 / 2
+	lastPTS := map[FrameType]int64{FrameTypeVideo: -1, FrameTypeAudio: -1}
+	for {
+		frame, err := source.ReadFrame()
+		if err != nil {
+			return videoFrames, audioFrames, err
+		}
+		if frame.TimestampMs >= durationMs {
+			return videoFrames, audioFrames, nil
+		}
+		if frame.TimestampMs <= lastPTS[frame.Type] {
+			return videoFrames, audioFrames, fmt.Errorf("PTS %dms not increasing after %dms", frame.TimestampMs, lastPTS[frame.Type])
+		}
+		lastPTS[frame.Type] = frame.TimestampMs
+
+		switch frame.Type {
+		case FrameTypeVideo:
+			if len(frame.Data) != videoSize {
+				return videoFrames, audioFrames, fmt.Errorf("video frame %d: %d bytes, want %d", videoFrames, len(frame.Data), videoSize)
+			}
+			videoFrames++
+		case FrameTypeAudio:
+			if want := source.AudioSampleRate() / 1000 * 20 * source.AudioChannels() * 2; len(frame.Data) != want {
+				return videoFrames, audioFrames, fmt.Errorf("audio frame %d: %d bytes, want %d", audioFrames, len(frame.Data), want)
+			}
+			audioFrames++
+		}
+	}
+}
+
+// TestFramesourcePatternSource はテストパターンが実時間で生成され、VP8/Opusでエンコードできることを検証する
+func TestFramesourcePatternSource(t *testing.T) {
+	source := NewTestPatternSource(TestSourceWidth, TestSourceHeight, TestSourceFPS)
+	if source.PixelFormat() != "YUV420P" || source.VideoCodec() != "V_UNCOMPRESSED" || source.AudioCodec() != "A_PCM/INT/LIT" {
+		t.Fatalf("unexpected format %s/%s/%s", source.PixelFormat(), source.VideoCodec(), source.AudioCodec())
+	}
+
+	start := time.Now()
+	videoFrames, audioFrames, err := checkSource(source, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	t.Logf("video=%d, audio=%d frames in %v", videoFrames, audioFrames, elapsed.Round(time.Millisecond))
+	if videoFrames != 15 || audioFrames != 25 {
+		t.Fatalf("got %d video / %d audio frames in 500ms, want 15 / 25", videoFrames, audioFrames)
+	}
+	if elapsed < 450*time.Millisecond {
+		t.Fatalf("frames generated faster than real time (%v)", elapsed)
+	}
+
+	encoder, err := NewVP8Encoder(source.VideoWidth(), source.VideoHeight(), source.PixelFormat(), 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	frame, err := source.ReadFrame()
+	for err == nil && frame.Type != FrameTypeVideo {
+		frame, err = source.ReadFrame()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := encoder.Encode(frame.Data); err != nil {
+		t.Fatalf("encode test pattern: %v", err)
+	}
+}
+
+// makeY4M は4x2のI420フレームをcount枚含むYUV4MPEG2ストリームを作る
+func makeY4M(header string, count int) ([]byte, [][]byte) {
+	var buf bytes.Buffer
+	buf.WriteString(header + "\n")
+	var frames [][]byte
+	for i := 0; i < count; i++ {
+		frame := make([]byte, 4*2+2*2*1)
+		for j := range frame {
+			frame[j] = byte(i*16 + j)
+		}
+		frames = append(frames, frame)
+		if i%2 == 0 {
+			buf.WriteString("FRAME\n")
+		} else {
+			buf.WriteString("FRAME Ip\n") // フレームヘッダーのパラメータは読み飛ばす
+		}
+		buf.Write(frame)
+	}
+	return buf.Bytes(), frames
+}
+
+// TestFramesourceY4MFrames は最小限のヘッダーを解析し、I420フレームとフレームレート由来のPTSを得られることを検証する
+func TestFramesourceY4MFrames(t *testing.T) {
+	stream, want := makeY4M("YUV4MPEG2 W4 H2 F30000:1001 Ip A1:1 C420mpeg2 XYSCSS=420MPEG2", 3)
+	reader := NewY4MReader(bytes.NewReader(stream), false)
+	wantPTS := []int64{0, 33, 66}
+	for i := range want {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if frame.Type != FrameTypeVideo || !bytes.Equal(frame.Data, want[i]) {
+			t.Fatalf("frame %d: data mismatch", i)
+		}
+		if frame.TimestampMs != wantPTS[i] {
+			t.Fatalf("frame %d: PTS %dms, want %dms", i, frame.TimestampMs, wantPTS[i])
+		}
+	}
+	if reader.VideoWidth() != 4 || reader.VideoHeight() != 2 || reader.PixelFormat() != "I420" || reader.AudioCodec() != "" {
+		t.Fatalf("unexpected info %dx%d %s audio=%q", reader.VideoWidth(), reader.VideoHeight(), reader.PixelFormat(), reader.AudioCodec())
+	}
+	if num, den := reader.FrameRate(); num != 30000 || den != 1001 || reader.Colorspace() != "420mpeg2" {
+		t.Fatalf("unexpected F%d:%d C%s", num, den, reader.Colorspace())
+	}
+	if _, err := reader.ReadFrame(); err != io.EOF {
+		t.Fatalf("after last frame: %v, want io.EOF", err)
+	}
+
+	// Cを省略した場合は420jpeg
+	stream, _ = makeY4M("YUV4MPEG2 W4 H2 F25:1", 1)
+	reader = NewY4MReader(bytes.NewReader(stream), false)
+	if _, err := reader.ReadFrame(); err != nil {
+		t.Fatal(err)
+	}
+	if reader.Colorspace() != "420jpeg" {
+		t.Fatalf("default colorspace %s, want 420jpeg", reader.Colorspace())
+	}
+}
+
+// TestFramesourceY4MErrors は対応していない入力と途中で切れた入力がエラーになることを検証する
+func TestFramesourceY4MErrors(t *testing.T) {
+	cases := []struct {
+		name    string
+		stream  string
+		wantErr string
+	}{
+		{"bad magic", "YUV4MPEG W4 H2 F25:1\n", "not a YUV4MPEG2 stream"},
+		{"colorspace", "YUV4MPEG2 W4 H2 F25:1 C444\n", "unsupported Y4M colorspace"},
+		{"no frame rate", "YUV4MPEG2 W4 H2\n", "no frame rate"},
+		{"odd size", "YUV4MPEG2 W5 H2 F25:1\n", "must be even"},
+		{"bad frame header", "YUV4MPEG2 W4 H2 F25:1\nFRAMEX\n", "invalid Y4M frame header"},
+		{"truncated frame", "YUV4MPEG2 W4 H2 F25:1\nFRAME\n\x01\x02", "unexpected EOF"},
+	}
+	for _, tc := range cases {
+		reader := NewY4MReader(strings.NewReader(tc.stream), false)
+		_, err := reader.ReadFrame()
+		if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Fatalf("%s: got %v, want error containing %q", tc.name, err, tc.wantErr)
+		}
+		if tc.name == "truncated frame" && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("%s: %v does not wrap io.ErrUnexpectedEOF", tc.name, err)
+		}
+	}
+}
+
+// TestFramesourceY4MEncode はY4MのI420フレームをRGBA変換せずにエンコードできることを検証する
+func TestFramesourceY4MEncode(t *testing.T) {
+	const w, h = 64, 48
+	var buf bytes.Buffer
+	buf.WriteString(fmt.Sprintf("YUV4MPEG2 W%d H%d F30:1 C420jpeg\n", w, h))
+	for i := 0; i < 2; i++ {
+		buf.WriteString("FRAME\n")
+		buf.Write(bytes.Repeat([]byte{byte(64 + i*32)}, w*h*3/2))
+	}
+	reader := NewY4MReader(&buf, false)
+	frame, err := reader.ReadFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoder, err := NewVP8Encoder(reader.VideoWidth(), reader.VideoHeight(), reader.PixelFormat(), 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	for frame != nil {
+		if _, _, err := encoder.Encode(frame.Data); err != nil {
+			t.Fatalf("encode: %v", err)
+		}
+		if frame, err = reader.ReadFrame(); err != nil && err != io.EOF {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
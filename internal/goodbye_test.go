@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	goodbyeOpusTicks = 960 // 20ms（48kHz）
+	goodbyeOpusStep  = 20 * time.Millisecond
+)
+
+// goodbyeSession はwhep-goと同じ受信側と、whip-goと同じく映像と音声のトラックを持つ送信側の接続
+type goodbyeSession struct {
+	receiver      *webrtc.PeerConnection
+	sender        *webrtc.PeerConnection
+	streamManager *StreamManager
+	audio         *webrtc.TrackLocalStaticRTP
+	videoSender   *webrtc.RTPSender
+	audioSender   *webrtc.RTPSender
+	seq           uint16
+}
+
+// goodbyeNewSession は受信側と送信側を接続し、最初のメディアが届くまで音声を送る
+func goodbyeNewSession() (*goodbyeSession, error) {
+	s := &goodbyeSession{}
+	mediaReceived := make(chan struct{}, 1)
+	s.streamManager = NewStreamManager(discardWriter{}, NewDefaultRTPProcessor(), 0, mediaReceived)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, err
+	}
+	if s.receiver, err = CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), s.streamManager); err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(NewSettingEngine()))
+	if s.sender, err = api.NewPeerConnection(webrtc.Configuration{}); err != nil {
+		s.close()
+		return nil, err
+	}
+	video, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "test")
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.audio, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "test"); err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.videoSender, err = s.sender.AddTrack(video); err != nil {
+		s.close()
+		return nil, err
+	}
+	if s.audioSender, err = s.sender.AddTrack(s.audio); err != nil {
+		s.close()
+		return nil, err
+	}
+	if err := connect(s.receiver, s.sender); err != nil {
+		s.close()
+		return nil, err
+	}
+	go s.streamManager.Run()
+
+	// SRTPの準備完了前のパケットは破棄されるため、最初のメディアが届くまで送り続ける
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			s.close()
+			return nil, fmt.Errorf("no media received within 5s")
+		}
+		if err := s.sendAudio(); err != nil {
+			s.close()
+			return nil, err
+		}
+		select {
+		case <-mediaReceived:
+			return s, nil
+		case <-time.After(goodbyeOpusStep):
+		}
+	}
+}
+
+func (s *goodbyeSession) sendAudio() error {
+	s.seq++
+	return s.audio.WriteRTP(&rtp.Packet{
+		Header:  rtp.Header{Version: 2, SequenceNumber: s.seq, Timestamp: uint32(s.seq) * goodbyeOpusTicks},
+		Payload: []byte{0xF8, 0xFF, 0xFE},
+	})
+}
+
+// ssrc はRTPSenderの送信SSRCを返す
+func ssrc(sender *webrtc.RTPSender) uint32 {
+	return uint32(sender.GetParameters().Encodings[0].SSRC)
+}
+
+// close はReadRTPを終わらせるため、PeerConnectionを閉じてからStreamManagerを停止する
+func (s *goodbyeSession) close() {
+	if s.sender != nil {
+		s.sender.Close()
+	}
+	if s.receiver != nil {
+		s.receiver.Close()
+	}
+	if s.streamManager != nil {
+		s.streamManager.Stop()
+	}
+}
+
+// readRTCP はreadで読んだRTCPのうちmatchがtrueを返したものを、timeoutまで待って返す
+func readRTCP(read func() ([]rtcp.Packet, error), timeout time.Duration, match func(rtcp.Packet) bool) (rtcp.Packet, error) {
+	found := make(chan rtcp.Packet, 1)
+	go func() {
+		for {
+			packets, err := read()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				if match(packet) {
+					select {
+					case found <- packet:
+					default:
+					}
+					return
+				}
+			}
+		}
+	}()
+	select {
+	case packet := <-found:
+		return packet, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("no matching RTCP within %v", timeout)
+	}
+}
+
+// TestGoodbyeSender はwhip-goと同じ送信側のSendGoodbyeで、受信側に送信中の全トラックのSSRCのBYEが届くことを検証する
+func TestGoodbyeSender(t *testing.T) {
+	s, err := goodbyeNewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	// 音声のRTPが届いたSSRCのRTCPだけが受信側のRTPReceiverに渡される
+	var audioReceiver *webrtc.RTPReceiver
+	for _, transceiver := range s.receiver.GetTransceivers() {
+		if transceiver.Kind() == webrtc.RTPCodecTypeAudio {
+			audioReceiver = transceiver.Receiver()
+		}
+	}
+	if audioReceiver == nil {
+		t.Fatalf("receiver has no audio transceiver")
+	}
+	if err := SendGoodbye(s.sender, nil); err != nil {
+		t.Fatal(err)
+	}
+	packet, err := readRTCP(func() ([]rtcp.Packet, error) {
+		packets, _, err := audioReceiver.ReadRTCP()
+		return packets, err
+	}, 3*time.Second, func(packet rtcp.Packet) bool {
+		_, ok := packet.(*rtcp.Goodbye)
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("receiver got no RTCP BYE: %v", err)
+	}
+	bye := packet.(*rtcp.Goodbye)
+	want := []uint32{ssrc(s.videoSender), ssrc(s.audioSender)}
+	for _, source := range want {
+		if !slices.Contains(bye.Sources, source) {
+			t.Fatalf("BYE sources %v, want the video and audio SSRCs %v", bye.Sources, want)
+		}
+	}
+	if len(bye.Sources) != len(want) {
+		t.Fatalf("BYE sources %v, want only %v", bye.Sources, want)
+	}
+}
+
+// TestGoodbyeReceiver はwhep-goの受信側のBYEが、送信側に届いたレシーバーレポートのSSRCを含み、
+// 送信側のメディアのSSRCを含まないことを検証する
+// pionの送信側は自分のSSRC宛て以外のRTCPをアプリに渡さないため、送信内容はGoodbyeSourcesで確かめる
+func TestGoodbyeReceiver(t *testing.T) {
+	s, err := goodbyeNewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	// レシーバーレポートは1秒ごと
+	reports := make(chan uint32, 1)
+	go func() {
+		for end := time.Now().Add(3 * time.Second); time.Now().Before(end); {
+			if s.sendAudio() != nil {
+				return
+			}
+			select {
+			case <-reports:
+				return
+			case <-time.After(goodbyeOpusStep):
+			}
+		}
+	}()
+	packet, err := readRTCP(func() ([]rtcp.Packet, error) {
+		packets, _, err := s.audioSender.ReadRTCP()
+		return packets, err
+	}, 3*time.Second, func(packet rtcp.Packet) bool {
+		_, ok := packet.(*rtcp.ReceiverReport)
+		return ok
+	})
+	if err != nil {
+		t.Fatalf("sender got no receiver report: %v", err)
+	}
+	reportSSRC := packet.(*rtcp.ReceiverReport).SSRC
+
+	sources := GoodbyeSources(s.receiver, s.streamManager.FeedbackSSRCs())
+	if !slices.Contains(sources, reportSSRC) {
+		t.Fatalf("BYE sources %v do not include the receiver report SSRC %d", sources, reportSSRC)
+	}
+	if slices.Contains(sources, ssrc(s.audioSender)) || slices.Contains(sources, ssrc(s.videoSender)) {
+		t.Fatalf("BYE sources %v include the remote media SSRCs", sources)
+	}
+	if err := SendGoodbye(s.receiver, s.streamManager.FeedbackSSRCs()); err != nil {
+		t.Fatalf("send BYE: %v", err)
+	}
+}
@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// headerExtension は --extensions で指定できるRTPヘッダー拡張
+type headerExtension struct {
+	name  string
+	uris  []string
+	kinds []webrtc.RTPCodecType
+}
+
+// headerExtensions はサーバーが必須とすることの多いRTPヘッダー拡張
+// --measure-latency のabs-capture-timeと --auto-rotate のCVOは、それぞれのフラグで登録する
+var headerExtensions = []headerExtension{
+	{name: "mid", uris: []string{sdp.SDESMidURI}, kinds: []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio}},
+	// simulcastのレイヤーの識別に使う（repaired-ridはRTXで再送されたパケットのレイヤー）
+	{name: "rid", uris: []string{sdp.SDESRTPStreamIDURI, sdp.SDESRepairRTPStreamIDURI}, kinds: []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo}},
+	{name: "abs-send-time", uris: []string{sdp.ABSSendTimeURI}, kinds: []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio}},
+	{name: "transport-cc", uris: []string{sdp.TransportCCURI}, kinds: []webrtc.RTPCodecType{webrtc.RTPCodecTypeVideo, webrtc.RTPCodecTypeAudio}},
+	{name: "audio-level", uris: []string{sdp.AudioLevelURI}, kinds: []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio}},
+}
+
+// defaultExtensions は以前から暗黙に登録していたヘッダー拡張（--extensions のデフォルト）
+var defaultExtensions = []string{"mid", "rid", "transport-cc"}
+
+// ParseExtensions は --extensions のカンマ区切りのヘッダー拡張名を解析する
+// 空文字列か"none"ではヘッダー拡張を登録しない
+func ParseExtensions(spec string) ([]string, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == "" || strings.EqualFold(spec, "none") {
+		return nil, nil
+	}
+
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			return nil, fmt.Errorf("invalid --extensions: empty name in %q", spec)
+		}
+		if !slices.ContainsFunc(headerExtensions, func(ext headerExtension) bool { return ext.name == name }) {
+			return nil, fmt.Errorf("invalid --extensions: unknown header extension %q (supported: %s)", name, supportedExtensionNames())
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// supportedExtensionNames は --extensions で指定できる名前の一覧を返す
+func supportedExtensionNames() string {
+	names := make([]string, len(headerExtensions))
+	for i, ext := range headerExtensions {
+		names[i] = ext.name
+	}
+	return strings.Join(names, ", ")
+}
+
+// ExtensionEnabled は --extensions でnameのヘッダー拡張が有効かを返す
+// transport-ccは --no-twcc 指定時には無効になる
+func ExtensionEnabled(name string) bool {
+	if name == "transport-cc" && NoTWCC {
+		return false
+	}
+	names, err := ParseExtensions(Extensions)
+	if err != nil {
+		return false
+	}
+	return slices.Contains(names, name)
+}
+
+// RegisterHeaderExtensions は --extensions で有効なRTPヘッダー拡張をofferのa=extmapに載るよう登録する
+func RegisterHeaderExtensions(mediaEngine *webrtc.MediaEngine) error {
+	for _, ext := range headerExtensions {
+		if !ExtensionEnabled(ext.name) {
+			continue
+		}
+		for _, uri := range ext.uris {
+			for _, kind := range ext.kinds {
+				if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: uri}, kind); err != nil {
+					return fmt.Errorf("failed to register %s: %w", uri, err)
+				}
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,157 @@
+package internal
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/pion/sdp/v3"
+)
+
+// offerExtensions はwhep-goと同じPeerConnection（映像と音声の受信トランシーバー付き）でofferを作り、
+// m-lineの種類ごとのa=extmapのURIとセッションレベルのa=extmap-allow-mixedの有無を返す
+func offerExtensions(extensions string) (map[string][]string, bool, error) {
+	Extensions = extensions
+	defer func() { Extensions = "mid,rid,transport-cc" }()
+
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, false, err
+	}
+	streamManager := NewStreamManager(NewProbeWriter(), NewDefaultRTPProcessor(), 0, make(chan struct{}, 1))
+	peerConnection, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		return nil, false, err
+	}
+	defer peerConnection.Close()
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return nil, false, err
+	}
+
+	parsed := &sdp.SessionDescription{}
+	if err := parsed.Unmarshal([]byte(offer.SDP)); err != nil {
+		return nil, false, err
+	}
+	_, allowMixed := parsed.Attribute(sdp.AttrKeyExtMapAllowMixed)
+	uris := map[string][]string{}
+	for _, media := range parsed.MediaDescriptions {
+		kind := media.MediaName.Media
+		for _, attr := range media.Attributes {
+			if attr.Key != sdp.AttrKeyExtMap {
+				continue
+			}
+			var extmap sdp.ExtMap
+			if err := extmap.Unmarshal("extmap:" + attr.Value); err != nil {
+				return nil, false, fmt.Errorf("malformed a=extmap:%s: %v", attr.Value, err)
+			}
+			uris[kind] = append(uris[kind], extmap.URI.String())
+		}
+	}
+	return uris, allowMixed, nil
+}
+
+// checkURIs はm-lineの種類ごとのa=extmapのURIがwantと一致する（順不同）ことを検証する
+func checkURIs(got map[string][]string, want map[string][]string) error {
+	for _, kind := range []string{"video", "audio"} {
+		g := slices.Sorted(slices.Values(got[kind]))
+		w := slices.Sorted(slices.Values(want[kind]))
+		if !slices.Equal(g, w) {
+			return fmt.Errorf("%s extmap URIs:\n  got  %s\n  want %s", kind, strings.Join(g, " "), strings.Join(w, " "))
+		}
+	}
+	return nil
+}
+
+// TestHeaderExtensionsDefault はデフォルトで、以前から暗黙に登録していたmid、rid、transport-ccのa=extmapと
+// a=extmap-allow-mixedがofferに載ることを検証する
+func TestHeaderExtensionsDefault(t *testing.T) {
+	got, allowMixed, err := offerExtensions("mid,rid,transport-cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !allowMixed {
+		t.Fatalf("offer has no a=extmap-allow-mixed")
+	}
+	if err := checkURIs(got, map[string][]string{
+		"video": {sdp.SDESMidURI, sdp.SDESRTPStreamIDURI, sdp.SDESRepairRTPStreamIDURI, sdp.TransportCCURI},
+		"audio": {sdp.SDESMidURI, sdp.TransportCCURI},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHeaderExtensionsSelected は --extensions abs-send-time,transport-cc で指定したヘッダー拡張だけがofferに載ることを検証する
+func TestHeaderExtensionsSelected(t *testing.T) {
+	got, _, err := offerExtensions("abs-send-time, Transport-CC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkURIs(got, map[string][]string{
+		"video": {sdp.ABSSendTimeURI, sdp.TransportCCURI},
+		"audio": {sdp.ABSSendTimeURI, sdp.TransportCCURI},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHeaderExtensionsAudioLevel はaudio-levelが音声のm-lineにだけ載ることを検証する
+func TestHeaderExtensionsAudioLevel(t *testing.T) {
+	got, _, err := offerExtensions("mid,audio-level")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkURIs(got, map[string][]string{
+		"video": {sdp.SDESMidURI},
+		"audio": {sdp.SDESMidURI, sdp.AudioLevelURI},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHeaderExtensionsNone は --extensions none でa=extmapを1つも載せないことを検証する
+func TestHeaderExtensionsNone(t *testing.T) {
+	got, _, err := offerExtensions("none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkURIs(got, map[string][]string{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHeaderExtensionsNoTWCC は --no-twcc 指定時には --extensions にあってもtransport-ccを載せないことを検証する
+func TestHeaderExtensionsNoTWCC(t *testing.T) {
+	NoTWCC = true
+	defer func() { NoTWCC = false }()
+
+	got, _, err := offerExtensions("abs-send-time,transport-cc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkURIs(got, map[string][]string{
+		"video": {sdp.ABSSendTimeURI},
+		"audio": {sdp.ABSSendTimeURI},
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestHeaderExtensionsParse は名前の重複と大文字小文字を許し、未知の名前をエラーにすることを検証する
+func TestHeaderExtensionsParse(t *testing.T) {
+	names, err := ParseExtensions(" mid,MID, transport-cc ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(names, []string{"mid", "transport-cc"}) {
+		t.Fatalf("parsed %v, want [mid transport-cc]", names)
+	}
+	for _, spec := range []string{"mid,abs-capture-time", "mid,,rid", "video-orientation"} {
+		if _, err := ParseExtensions(spec); err == nil {
+			t.Fatalf("%q accepted, want an error", spec)
+		} else {
+			t.Logf("%q: %v", spec, err)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// HealthState は接続状態と最後にメディア（whip-goではRTCP）を受信した時刻を保持する
+// タイムアウト監視と --health-addr の /readyz で同じ状態を参照する
+type HealthState struct {
+	clock        Clock
+	window       time.Duration
+	connected    atomic.Bool
+	lastActivity atomic.Int64 // UnixNano（0は未受信）
+}
+
+// NewHealthState は新しいHealthStateを作成
+// window: 最後の受信からこの時間以内であればメディアが流れているとみなす
+func NewHealthState(window time.Duration) *HealthState {
+	return &HealthState{
+		clock:  SystemClock{},
+		window: window,
+	}
+}
+
+// SetClock は時刻の取得元を差し替える（使用開始前に呼ぶ）
+func (h *HealthState) SetClock(clock Clock) {
+	h.clock = clock
+}
+
+// SetConnected はICE接続状態を設定する
+func (h *HealthState) SetConnected(connected bool) {
+	h.connected.Store(connected)
+}
+
+// MarkActivity はメディアを受信したことを記録する
+func (h *HealthState) MarkActivity() {
+	h.lastActivity.Store(h.clock.Now().UnixNano())
+}
+
+// SinceActivity は最後の受信からの経過時間を返す（未受信の場合はfalse）
+func (h *HealthState) SinceActivity() (time.Duration, bool) {
+	last := h.lastActivity.Load()
+	if last == 0 {
+		return 0, false
+	}
+	return h.clock.Now().Sub(time.Unix(0, last)), true
+}
+
+// Ready はICE接続済みかつwindow以内にメディアを受信していればtrueを返す
+// falseの場合は理由を返す
+func (h *HealthState) Ready() (bool, string) {
+	if !h.connected.Load() {
+		return false, "not connected"
+	}
+	since, ok := h.SinceActivity()
+	if !ok {
+		return false, "no media received yet"
+	}
+	if since > h.window {
+		return false, fmt.Sprintf("no media for %v", since.Round(time.Millisecond))
+	}
+	return true, ""
+}
+
+// Handler は /healthz と /readyz を返すhttp.Handlerを作る
+// /healthz: プロセスが動作していれば200
+// /readyz: Readyであれば200、そうでなければ503
+func (h *HealthState) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		if ready, reason := h.Ready(); !ready {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprintf(w, "not ready: %s\n", reason)
+			return
+		}
+		fmt.Fprintln(w, "ready")
+	})
+	return mux
+}
+
+// StartHealthServer はaddrでヘルスチェック用のHTTPサーバーを開始する
+// 待ち受けに失敗した場合はエラーを返す。返したサーバーのAddrには実際の待ち受けアドレスを設定する
+func StartHealthServer(addr string, h *HealthState) (*http.Server, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on --health-addr %s: %w", addr, err)
+	}
+	server := &http.Server{
+		Addr:              listener.Addr().String(),
+		Handler:           h.Handler(),
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(os.Stderr, "Health server error: %v\n", err)
+		}
+	}()
+	return server, nil
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const healthWindow = 5 * time.Second
+
+// get はhandlerにGETリクエストを送り、ステータスコードと本文を返す
+func get(handler http.Handler, path string) (int, string) {
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, path, nil))
+	return recorder.Code, recorder.Body.String()
+}
+
+// expect はpathのステータスコードと本文（部分一致）を検証する
+func expect(handler http.Handler, path string, wantCode int, wantBody string) error {
+	code, body := get(handler, path)
+	if code != wantCode || !strings.Contains(body, wantBody) {
+		return fmt.Errorf("%s: got %d %q, want %d containing %q", path, code, body, wantCode, wantBody)
+	}
+	return nil
+}
+
+// TestHealthReadiness は接続状態とメディア受信時刻に応じて /readyz が変化することを検証する
+func TestHealthReadiness(t *testing.T) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	health := NewHealthState(healthWindow)
+	health.SetClock(clock)
+	handler := health.Handler()
+
+	steps := []struct {
+		name     string
+		action   func()
+		code     int
+		contains string
+	}{
+		{"initial", func() {}, http.StatusServiceUnavailable, "not connected"},
+		{"connected without media", func() { health.SetConnected(true) }, http.StatusServiceUnavailable, "no media received yet"},
+		{"media received", func() { health.MarkActivity() }, http.StatusOK, "ready"},
+		{"within window", func() { clock.Advance(healthWindow) }, http.StatusOK, "ready"},
+		{"media stalled", func() { clock.Advance(time.Second) }, http.StatusServiceUnavailable, "no media for 6s"},
+		{"media resumed", func() { health.MarkActivity() }, http.StatusOK, "ready"},
+		{"disconnected", func() { health.SetConnected(false) }, http.StatusServiceUnavailable, "not connected"},
+	}
+	for _, step := range steps {
+		step.action()
+		if err := expect(handler, "/healthz", http.StatusOK, "ok"); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if err := expect(handler, "/readyz", step.code, step.contains); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+	}
+}
+
+// TestHealthServer は実際に待ち受けたサーバーへHTTPでアクセスできることを検証する
+func TestHealthServer(t *testing.T) {
+	health := NewHealthState(healthWindow)
+	server, err := StartHealthServer("127.0.0.1:0", health)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	for path, wantCode := range map[string]int{"/healthz": http.StatusOK, "/readyz": http.StatusServiceUnavailable} {
+		resp, err := http.Get("http://" + server.Addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != wantCode {
+			t.Fatalf("%s: got %d, want %d", path, resp.StatusCode, wantCode)
+		}
+	}
+
+	// 使用中のアドレスは起動時にエラーとする
+	if second, err := StartHealthServer(server.Addr, health); err == nil {
+		second.Close()
+		t.Fatalf("listening on an address in use succeeded")
+	}
+}
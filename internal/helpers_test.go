@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// Matroska要素ID
+const (
+	idCluster     = 0x1F43B675
+	idCodecID     = 0x86
+	idEBML        = 0x1A45DFA3
+	idInfo        = 0x1549A966
+	idMuxingApp   = 0x4D80
+	idPosition    = 0xA7
+	idPrevSize    = 0xAB
+	idProjType    = 0x7671
+	idProjectRoll = 0x7675
+	idProjection  = 0x7670
+	idSegment     = 0x18538067
+	idSimpleBlock = 0xA3
+	idSimpleTag   = 0x67C8
+	idTag         = 0x7373
+	idTagName     = 0x45A3
+	idTagString   = 0x4487
+	idTags        = 0x1254C367
+	idTimecode    = 0xE7
+	idTrackEntry  = 0xAE
+	idTrackNumber = 0xD7
+	idTrackUID    = 0x73C5
+	idTracks      = 0x1654AE6B
+	idWritingApp  = 0x5741
+)
+
+// unknownSize はサイズ不定の要素（Segment/Cluster）に使うサイズ
+var unknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// idBytes はEBML要素IDのバイト列を作る（先頭のマーカーを含む値）
+func idBytes(id uint32) []byte {
+	switch {
+	case id > 0xFFFFFF:
+		return []byte{byte(id >> 24), byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFFFF:
+		return []byte{byte(id >> 16), byte(id >> 8), byte(id)}
+	case id > 0xFF:
+		return []byte{byte(id >> 8), byte(id)}
+	default:
+		return []byte{byte(id)}
+	}
+}
+
+// element はEBML要素（ID、サイズ、データ）を作る
+func element(id uint32, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	out := idBytes(id)
+	out = append(out, 0x08, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(out[len(out)-8:], uint64(len(data)))
+	out[len(out)-8] = 0x01
+	return append(out, data...)
+}
+
+// unsizedElement はサイズ不定のEBML要素を作る
+func unsizedElement(id uint32, children ...[]byte) []byte {
+	out := append(idBytes(id), unknownSize...)
+	return append(out, bytes.Join(children, nil)...)
+}
+
+// uintData はEBMLの符号なし整数要素のデータを8バイトで作る
+func uintData(v uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, v)
+}
+
+// readVint はEBMLの可変長整数を読み、値と長さを返す（keepMarkerでIDとして読む）
+func readVint(data []byte, keepMarker bool) (uint64, int) {
+	if len(data) == 0 {
+		return 0, 0
+	}
+	length := 1
+	for mask := byte(0x80); length <= 8 && data[0]&mask == 0; mask >>= 1 {
+		length++
+	}
+	if length > 8 || len(data) < length {
+		return 0, 0
+	}
+	value := uint64(data[0])
+	if !keepMarker {
+		value &= uint64(0xFF >> length)
+	}
+	for _, b := range data[1:length] {
+		value = value<<8 | uint64(b)
+	}
+	return value, length
+}
+
+// block はSimpleBlockのトラック番号、timecode（ms）とデータ
+type block struct {
+	track    uint64
+	timecode int64
+	data     []byte
+}
+
+// scanBlocks はSimpleBlockを出力順に、クラスタのtimecodeを加えた絶対timecodeで返す
+func scanBlocks(data []byte) ([]block, error) {
+	var blocks []block
+	var clusterTime int64
+	for len(data) > 0 {
+		id, n := readVint(data, true)
+		size, m := readVint(data[n:], false)
+		if n == 0 || m == 0 {
+			return nil, fmt.Errorf("malformed element header")
+		}
+		data = data[n+m:]
+		if id == idSegment || id == idCluster {
+			continue
+		}
+		if uint64(len(data)) < size {
+			return nil, fmt.Errorf("element 0x%X truncated", id)
+		}
+		value := data[:size]
+		data = data[size:]
+		switch id {
+		case idTimecode:
+			clusterTime = 0
+			for _, b := range value {
+				clusterTime = clusterTime<<8 | int64(b)
+			}
+		case idSimpleBlock:
+			track, k := readVint(value, false)
+			if k == 0 || len(value) < k+3 {
+				return nil, fmt.Errorf("malformed SimpleBlock")
+			}
+			relative := int64(int16(binary.BigEndian.Uint16(value[k:])))
+			blocks = append(blocks, block{track: track, timecode: clusterTime + relative, data: value[k+3:]})
+		}
+	}
+	return blocks, nil
+}
+
+// opusSilence は20msの無音Opusパケット
+var opusSilence = []byte{0xF8, 0xFF, 0xFE}
+
+// opusPacket はシーケンス番号を末尾に付けた20msのOpusパケット
+func opusPacket(seq int) []byte {
+	return []byte{0xF8, 0xFF, 0xFE, byte(seq >> 8), byte(seq)}
+}
+
+// connect は受信側のofferと送信側のanswerを交換する（ICE候補の収集完了後のSDP）
+func connect(receiver, sender *webrtc.PeerConnection) error {
+	offer, err := receiver.CreateOffer(nil)
+	if err != nil {
+		return err
+	}
+	gathered := webrtc.GatheringCompletePromise(receiver)
+	if err := receiver.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gathered
+	if err := sender.SetRemoteDescription(*receiver.LocalDescription()); err != nil {
+		return err
+	}
+	answer, err := sender.CreateAnswer(nil)
+	if err != nil {
+		return err
+	}
+	gathered = webrtc.GatheringCompletePromise(sender)
+	if err := sender.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	<-gathered
+	return receiver.SetRemoteDescription(*sender.LocalDescription())
+}
+
+// createAnswer はofferに対するanswerを作成する（ICE候補の収集完了後のSDP）
+func createAnswer(offer string) (string, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return "", err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return "", err
+	}
+	defer peerConnection.Close()
+
+	if err := peerConnection.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeOffer, SDP: offer}); err != nil {
+		return "", err
+	}
+	answer, err := peerConnection.CreateAnswer(nil)
+	if err != nil {
+		return "", err
+	}
+	gathered := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(answer); err != nil {
+		return "", err
+	}
+	<-gathered
+	return peerConnection.LocalDescription().SDP, nil
+}
+
+// newPeerConnection はNewSettingEngine()を使うPeerConnectionを作成する
+func newPeerConnection() (*webrtc.PeerConnection, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	return api.NewPeerConnection(webrtc.Configuration{})
+}
+
+// newSubscriber は映像を受信するPeerConnectionを作成する
+func newSubscriber() (*webrtc.PeerConnection, error) {
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		peerConnection.Close()
+		return nil, err
+	}
+	return peerConnection, nil
+}
+
+// newPublisher はwhip-goと同じ設定で映像トラックを持つ送信側PeerConnectionを作成する
+func newPublisher() (*webrtc.PeerConnection, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(NewPeerConnectionConfig())
+	if err != nil {
+		return nil, err
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+	if err != nil {
+		peerConnection.Close()
+		return nil, err
+	}
+	if _, err := peerConnection.AddTrack(track); err != nil {
+		peerConnection.Close()
+		return nil, err
+	}
+	return peerConnection, nil
+}
+
+// discardWriter はフレームを破棄するStreamWriter
+type discardWriter struct{}
+
+func (discardWriter) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error { return nil }
+func (discardWriter) WriteAudioFrame(data []byte, timestamp uint32) error                { return nil }
+func (discardWriter) Run() error                                                         { return nil }
+func (discardWriter) Close() error                                                       { return nil }
+
+// disableFrameValidation は合成画像がフレーム検証で破損扱いされないよう、テストの間だけ検証を無効化する
+func disableFrameValidation(t testing.TB) {
+	t.Helper()
+	saved := NoFrameValidation
+	NoFrameValidation = true
+	t.Cleanup(func() { NoFrameValidation = saved })
+}
+
+// setInterleaveWindow はテストの間だけ --interleave-window を差し替える
+func setInterleaveWindow(t testing.TB, ms int) {
+	t.Helper()
+	saved := InterleaveWindowMs
+	InterleaveWindowMs = ms
+	t.Cleanup(func() { InterleaveWindowMs = saved })
+}
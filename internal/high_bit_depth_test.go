@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/Azunyan1111/libvpx-go/vpx"
+)
+
+const (
+	highBitDepthWidth  = 8
+	highBitDepthHeight = 4
+)
+
+// plane はデコーダーの出力と同じく、行末に余白のある1プレーン分のサンプル
+type plane struct {
+	data   []byte
+	stride int32
+}
+
+// newPlane はw x hのサンプルをvalue(x, y)で埋めたプレーンを作る（bytesPerSampleは1または2）
+func newPlane(w, h, bytesPerSample int, value func(x, y int) int) plane {
+	stride := (w + 3) * bytesPerSample // 余白を入れてstrideを幅と異なる値にする
+	data := make([]byte, stride*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			offset := y*stride + x*bytesPerSample
+			if bytesPerSample == 2 {
+				binary.LittleEndian.PutUint16(data[offset:], uint16(value(x, y)))
+			} else {
+				data[offset] = byte(value(x, y))
+			}
+		}
+	}
+	return plane{data: data, stride: int32(stride)}
+}
+
+// newImage はformatの画像を作る。色差プレーンの大きさはxshift/yshiftで間引く
+// 色差はどの形式でもI420と同じ値（2x2画素ごとに同じ値）になるよう、I420の色差の位置から値を取る
+// 値は8ビットの値をbitDepthに拡大したもので、下位ビットはlowBitsで埋める
+func newImage(format vpx.ImageFormat, bitDepth uint32, xshift, yshift int, lowBits int) *vpx.Image {
+	bytesPerSample := 1
+	if format&vpx.ImageFormatHighbitdepth != 0 {
+		bytesPerSample = 2
+	}
+	scale := func(v int) int { return v<<(bitDepth-8) | lowBits }
+	// 形式の色差の位置(x, y)に対応するI420の色差の位置
+	i420 := func(x, y int) (int, int) { return (x << xshift) >> 1, (y << yshift) >> 1 }
+	cw, ch := (highBitDepthWidth+(1<<xshift)-1)>>xshift, (highBitDepthHeight+(1<<yshift)-1)>>yshift
+	planes := []plane{
+		newPlane(highBitDepthWidth, highBitDepthHeight, bytesPerSample, func(x, y int) int { return scale(16 + x*28 + y*3) }),
+		newPlane(cw, ch, bytesPerSample, func(x, y int) int {
+			x, y = i420(x, y)
+			return scale(64 + x*40 + y*7)
+		}),
+		newPlane(cw, ch, bytesPerSample, func(x, y int) int {
+			x, y = i420(x, y)
+			return scale(200 - x*30 - y*11)
+		}),
+	}
+	img := &vpx.Image{Fmt: format, BitDepth: bitDepth, W: highBitDepthWidth, H: highBitDepthHeight, DW: highBitDepthWidth, DH: highBitDepthHeight}
+	for i, p := range planes {
+		img.Planes[i] = &p.data[0]
+		img.Stride[i] = p.stride
+	}
+	return img
+}
+
+// TestHighBitDepthI420 は10/12ビットのI420を、同じ値の8ビットのI420と同じRGBAに変換することを検証する
+func TestHighBitDepthI420(t *testing.T) {
+	want, err := imageRGBAInto(newImage(vpx.ImageFormatI420, 8, 1, 1, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, bitDepth := range []uint32{10, 12} {
+		// 下位ビットは8ビットに落とす際に捨てられる
+		img := newImage(vpx.ImageFormatI42016, bitDepth, 1, 1, 1<<(bitDepth-8)-1)
+		got, err := imageRGBAInto(img, nil)
+		if err != nil {
+			t.Fatalf("%d-bit: %v", bitDepth, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%d-bit RGBA differs from the 8-bit conversion of the same values", bitDepth)
+		}
+	}
+}
+
+// TestHighBitDepthChromaLayouts はI422/I440/I444（および高ビット深度）の色差を正しい位置から読むことを検証する
+func TestHighBitDepthChromaLayouts(t *testing.T) {
+	want, err := imageRGBAInto(newImage(vpx.ImageFormatI420, 8, 1, 1, 0), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formats := []struct {
+		name           string
+		format         vpx.ImageFormat
+		bitDepth       uint32
+		xshift, yshift int
+	}{
+		{"I422", vpx.ImageFormatI422, 8, 1, 0},
+		{"I440", vpx.ImageFormatI440, 8, 0, 1},
+		{"I444", vpx.ImageFormatI444, 8, 0, 0},
+		{"I44416 10-bit", vpx.ImageFormatI44416, 10, 0, 0},
+	}
+	for _, f := range formats {
+		img := newImage(f.format, f.bitDepth, f.xshift, f.yshift, 0)
+		got, err := imageRGBAInto(img, nil)
+		if err != nil {
+			t.Fatalf("%s: %v", f.name, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%s: RGBA differs from I420 with the same samples", f.name)
+		}
+	}
+}
+
+// TestHighBitDepthUnsupported は変換できない形式やビット深度を、誤った画像にせずエラーにすることを検証する
+func TestHighBitDepthUnsupported(t *testing.T) {
+	cases := []struct {
+		name string
+		img  *vpx.Image
+	}{
+		{"unknown format", newImage(vpx.ImageFormatNone, 8, 1, 1, 0)},
+		{"16-bit samples with bit depth 20", newImage(vpx.ImageFormatI42016, 12, 1, 1, 0)},
+		{"8-bit format reporting 10-bit samples", newImage(vpx.ImageFormatI420, 8, 1, 1, 0)},
+	}
+	cases[1].img.BitDepth = 20
+	cases[2].img.BitDepth = 10
+	for _, c := range cases {
+		if _, err := imageRGBAInto(c.img, nil); err == nil {
+			t.Fatalf("%s: converted without error", c.name)
+		}
+	}
+}
@@ -0,0 +1,216 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// endpointURL は実在しないエンドポイント（リクエストは注入したトランスポートが応答し、ネットワークには出ない）
+const endpointURL = "https://media.invalid/whep/stream"
+
+// recordingTransport はリクエストを"METHOD path"の形で記録し、WHEP/WHIPサーバーとして応答するhttp.RoundTripper
+type recordingTransport struct {
+	mu         sync.Mutex
+	requests   []string
+	signatures []string // 各リクエストのX-Signatureヘッダー
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body.Close()
+	}
+	t.mu.Lock()
+	t.requests = append(t.requests, req.Method+" "+req.URL.Path)
+	t.signatures = append(t.signatures, req.Header.Get("X-Signature"))
+	t.mu.Unlock()
+
+	switch req.Method {
+	case http.MethodOptions:
+		return response(req, http.StatusNoContent, nil, ""), nil
+	case http.MethodPost:
+		answer, err := createAnswer(string(body))
+		if err != nil {
+			return response(req, http.StatusBadRequest, nil, err.Error()), nil
+		}
+		header := http.Header{"Content-Type": {"application/sdp"}, "Location": {"/session/1"}}
+		return response(req, http.StatusCreated, header, answer), nil
+	case http.MethodDelete:
+		return response(req, http.StatusOK, nil, ""), nil
+	default:
+		return response(req, http.StatusMethodNotAllowed, nil, ""), nil
+	}
+}
+
+// sequence は記録したリクエストをカンマ区切りで返す
+func (t *recordingTransport) sequence() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return strings.Join(t.requests, ", ")
+}
+
+// unsigned は署名の無いリクエストを返す
+func (t *recordingTransport) unsigned() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var unsigned []string
+	for i, signature := range t.signatures {
+		if signature == "" {
+			unsigned = append(unsigned, t.requests[i])
+		}
+	}
+	return unsigned
+}
+
+func response(req *http.Request, status int, header http.Header, body string) *http.Response {
+	if header == nil {
+		header = http.Header{}
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}
+}
+
+// signingTransport は本文とメソッド、パスのSHA-256をX-Signatureとして付けてから次のトランスポートへ渡す
+// SigV4のような署名を行うラッパーの例
+type signingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.GetBody != nil {
+		rc, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		body, _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	sum := sha256.Sum256(append([]byte(req.Method+" "+req.URL.Path+"\n"), body...))
+	signed := req.Clone(req.Context())
+	signed.Header.Set("X-Signature", hex.EncodeToString(sum[:]))
+	return t.next.RoundTrip(signed)
+}
+
+// failingTransport はすべてのリクエストを接続エラーにする
+type failingTransport struct{}
+
+func (failingTransport) RoundTrip(*http.Request) (*http.Response, error) {
+	return nil, errors.New("connection refused by test transport")
+}
+
+// httpClientNewPeerConnection はdirectionの映像トランシーバーを持つPeerConnectionを作成する
+func httpClientNewPeerConnection(direction webrtc.RTPTransceiverDirection) (*webrtc.PeerConnection, error) {
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: direction}); err != nil {
+		peerConnection.Close()
+		return nil, err
+	}
+	return peerConnection, nil
+}
+
+// TestHTTPClientRoundTripper はWithRoundTripperで注入した署名付きのトランスポートが、
+// OPTIONS、offerのPOST、終了時のDELETEのすべてで使われることを検証する
+func TestHTTPClientRoundTripper(t *testing.T) {
+	peerConnection, err := httpClientNewPeerConnection(webrtc.RTPTransceiverDirectionRecvonly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+
+	recorder := &recordingTransport{}
+	session := NewWHEPSession(endpointURL, WithRoundTripper(&signingTransport{next: recorder}))
+	session.SetOptionsICEServers(true)
+	if err := session.ExchangeSDP(peerConnection); err != nil {
+		t.Fatalf("exchange failed: %v (requests: %s)", err, recorder.sequence())
+	}
+	if session.ResourceURL() != "https://media.invalid/session/1" {
+		t.Fatalf("resource URL %q, want the Location resolved against the endpoint", session.ResourceURL())
+	}
+	if peerConnection.RemoteDescription() == nil {
+		t.Fatalf("answer from the injected transport was not set")
+	}
+	if err := session.Delete(); err != nil {
+		t.Fatalf("delete failed: %v", err)
+	}
+
+	if want := "OPTIONS /whep/stream, POST /whep/stream, DELETE /session/1"; recorder.sequence() != want {
+		t.Fatalf("requests %q, want %q", recorder.sequence(), want)
+	}
+	if unsigned := recorder.unsigned(); len(unsigned) > 0 {
+		t.Fatalf("requests without a signature: %v", unsigned)
+	}
+}
+
+// TestHTTPClient はExchangeSDPWithWHIPにWithHTTPClientで渡したクライアントが使われることを検証する
+func TestHTTPClient(t *testing.T) {
+	peerConnection, err := httpClientNewPeerConnection(webrtc.RTPTransceiverDirectionSendonly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+
+	recorder := &recordingTransport{}
+	client := &http.Client{Transport: recorder}
+	if err := ExchangeSDPWithWHIP(peerConnection, endpointURL, WithHTTPClient(client)); err != nil {
+		t.Fatalf("exchange failed: %v (requests: %s)", err, recorder.sequence())
+	}
+	if want := "POST /whep/stream"; recorder.sequence() != want {
+		t.Fatalf("requests %q, want %q", recorder.sequence(), want)
+	}
+}
+
+// TestHTTPClientTransportError は注入したトランスポートのエラーが、デフォルトのクライアントと同じくErrConnectionになることを検証する
+func TestHTTPClientTransportError(t *testing.T) {
+	peerConnection, err := httpClientNewPeerConnection(webrtc.RTPTransceiverDirectionRecvonly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+
+	err = ExchangeSDPWithWHEP(peerConnection, endpointURL, WithRoundTripper(failingTransport{}))
+	if !errors.Is(err, ErrConnection) {
+		t.Fatalf("got %v, want ErrConnection", err)
+	}
+}
+
+// TestHTTPClientNilOptions はnilのクライアントとトランスポートを渡してもデフォルトのクライアントのままであることを検証する
+// 存在しないホストへの接続はErrConnectionになる
+func TestHTTPClientNilOptions(t *testing.T) {
+	peerConnection, err := httpClientNewPeerConnection(webrtc.RTPTransceiverDirectionRecvonly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+
+	err = ExchangeSDPWithWHEP(peerConnection, endpointURL, WithHTTPClient(nil), WithRoundTripper(nil))
+	if !errors.Is(err, ErrConnection) {
+		t.Fatalf("got %v, want ErrConnection from the default client", err)
+	}
+}
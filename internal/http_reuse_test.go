@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// httpReuseServer はendpointをラップし、サーバーが受け付けた接続数とリクエストのプロトコルを記録する
+type httpReuseServer struct {
+	*httptest.Server
+	endpoint *endpoint
+
+	mu          sync.Mutex
+	connections int
+	protos      []string
+}
+
+func newHTTPReuseServer(http2 bool) *httpReuseServer {
+	s := &httpReuseServer{endpoint: &endpoint{optionsLinks: []string{}}}
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.protos = append(s.protos, r.Proto)
+		s.mu.Unlock()
+		s.endpoint.ServeHTTP(w, r)
+	}))
+	s.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			s.mu.Lock()
+			s.connections++
+			s.mu.Unlock()
+		}
+	}
+	if http2 {
+		s.EnableHTTP2 = true
+		s.StartTLS()
+	} else {
+		s.Start()
+	}
+	return s
+}
+
+// httpReuseRunSession はデフォルトのクライアントのセッションでofferのPOST、trickle ICEのPATCH、DELETEを順に送る
+// TLSのサーバーではテスト用の証明書を信頼するよう、クライアントのトランスポートのTLS設定だけを差し替える
+func httpReuseRunSession(server *httpReuseServer, patches int) error {
+	peerConnection, err := httpClientNewPeerConnection(webrtc.RTPTransceiverDirectionRecvonly)
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+
+	session := NewWHEPSession(server.URL + "/whep")
+	if server.TLS != nil {
+		transport := session.client.Transport.(*http.Transport)
+		transport.TLSClientConfig = server.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+	}
+	if err := session.ExchangeSDP(peerConnection); err != nil {
+		return err
+	}
+	for i := 0; i < patches; i++ {
+		if err := session.Patch("application/trickle-ice-sdpfrag", []byte("a=candidate:1 1 udp 1 127.0.0.1 9 typ host\r\n")); err != nil {
+			return err
+		}
+	}
+	return session.Delete()
+}
+
+// TestHTTPReuseKeepAlive はHTTP/1.1のサーバーに対して、1セッションのすべてのリクエストが1つの接続を使い回すことを検証する
+func TestHTTPReuseKeepAlive(t *testing.T) {
+	server := newHTTPReuseServer(false)
+	defer server.Close()
+
+	if err := httpReuseRunSession(server, 5); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.protos) < 7 {
+		t.Fatalf("%d requests, want the POST, 5 PATCHes and the DELETE", len(server.protos))
+	}
+	if server.connections != 1 {
+		t.Fatalf("%d requests opened %d connections, want 1", len(server.protos), server.connections)
+	}
+}
+
+// TestHTTPReuseHTTP2 はTLSのサーバーとHTTP/2で通信し、1つの接続を使い回すことを検証する
+func TestHTTPReuseHTTP2(t *testing.T) {
+	server := newHTTPReuseServer(true)
+	defer server.Close()
+
+	if err := httpReuseRunSession(server, 5); err != nil {
+		t.Fatal(err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for i, proto := range server.protos {
+		if proto != "HTTP/2.0" {
+			t.Fatalf("request %d used %s, want HTTP/2.0", i, proto)
+		}
+	}
+	if server.connections != 1 {
+		t.Fatalf("%d requests opened %d connections, want 1", len(server.protos), server.connections)
+	}
+}
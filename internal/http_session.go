@@ -0,0 +1,454 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const sessionHTTPTimeout = 30 * time.Second
+
+// httpSession はWHEP/WHIPの1セッション分のHTTP状態を保持する
+// offerのPOST、trickle ICEのPATCH、終了時のDELETEで同じクライアントを使い回し、
+// HTTP/2およびkeep-aliveによる接続再利用を行う
+type httpSession struct {
+	protocol    string // "WHEP" または "WHIP"（ログ・エラー表示用）
+	client      *http.Client
+	endpointURL string
+	resourceURL string // POST応答のLocationヘッダーから解決したセッションリソースURL
+	links       []sessionLink
+	iceServers  []webrtc.ICEServer // エンドポイントから取得してPeerConnectionに追加したICEサーバー
+	videoTIAS   int                // offerの映像m-lineに付与するb=TIAS（bps、0は付与しない）
+	postRetries int                // 一時的な失敗でofferのPOSTをやり直す回数（0でやり直さない）
+	postBackoff time.Duration      // 最初のやり直しまでの待ち時間（やり直すごとに2倍にする）
+	twoPhase    bool               // offerの前に空のPOSTでセッションを作成し、offerをPATCHで送る
+	optionsICE  bool               // offerの前にOPTIONSでICEサーバーを問い合わせる
+	customHTTP  bool               // clientがWithHTTPClient/WithRoundTripperで指定されたもの
+}
+
+// sessionLink はOPTIONS/POST応答のLinkヘッダー1件分
+type sessionLink struct {
+	url    string
+	rel    string
+	params map[string]string
+}
+
+// SessionOption はWHEP/WHIPセッションの作成時の設定を変更する
+type SessionOption func(*httpSession)
+
+// WithHTTPClient はセッションのPOST、PATCH、DELETE、OPTIONSにclientを使う
+// 独自の認証やリクエストへの署名、テスト用の応答に使う。nilの場合はデフォルトのクライアントのまま
+func WithHTTPClient(client *http.Client) SessionOption {
+	return func(s *httpSession) {
+		if client != nil {
+			s.client = client
+			s.customHTTP = true
+		}
+	}
+}
+
+// WithRoundTripper はデフォルトのタイムアウトのまま、リクエストをtransportで送る
+// nilの場合はデフォルトのトランスポートのまま
+func WithRoundTripper(transport http.RoundTripper) SessionOption {
+	return func(s *httpSession) {
+		if transport != nil {
+			s.client = &http.Client{Timeout: sessionHTTPTimeout, Transport: transport}
+			s.customHTTP = true
+		}
+	}
+}
+
+func newHTTPSession(protocol, endpointURL string, opts []SessionOption) *httpSession {
+	s := &httpSession{
+		protocol:    protocol,
+		client:      newSessionHTTPClient(),
+		endpointURL: endpointURL,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// newSessionHTTPClient はHTTP/2とkeep-aliveを有効にしたHTTPクライアントを作成する
+func newSessionHTTPClient() *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ForceAttemptHTTP2 = true
+	transport.MaxIdleConnsPerHost = 4
+	transport.IdleConnTimeout = 90 * time.Second
+	return &http.Client{
+		Timeout:   sessionHTTPTimeout,
+		Transport: transport,
+	}
+}
+
+// ResourceURL はセッションリソースURLを返す（未確立の場合は空文字）
+func (s *httpSession) ResourceURL() string {
+	return s.resourceURL
+}
+
+// Link は指定したrelのLinkヘッダーのURLとパラメーターを返す
+func (s *httpSession) Link(rel string) (string, map[string]string, bool) {
+	for _, link := range s.links {
+		if link.rel == rel {
+			return link.url, link.params, true
+		}
+	}
+	return "", nil, false
+}
+
+// exchangeSDP はofferを作成してPOSTし、answerをリモートSDPとして設定する
+// エンドポイントがLinkヘッダーでICEサーバーを広告する場合はPeerConnectionに追加する
+func (s *httpSession) exchangeSDP(peerConnection *webrtc.PeerConnection) error {
+	s.configureICEServersBeforeOffer(peerConnection)
+
+	// 2段階のハンドシェイクでは、セッションとICEサーバーをoffer（ICE候補の収集）の前に得る
+	twoPhase := false
+	if s.twoPhase {
+		var err error
+		if twoPhase, err = s.createSession(peerConnection); err != nil {
+			return err
+		}
+	}
+
+	offerSDP, err := s.createOffer(peerConnection)
+	if err != nil {
+		return err
+	}
+
+	// Send offer to server
+	fmt.Fprintf(os.Stderr, "Sending offer to %s server...\n", s.protocol)
+	if DebugMode {
+		fmt.Fprintf(os.Stderr, "\n=== SDP Offer ===\n%s\n=== End Offer ===\n\n", offerSDP)
+	}
+
+	var answer []byte
+	if twoPhase {
+		if answer, err = s.patchOffer(offerSDP); err != nil {
+			return err
+		}
+	} else {
+		// 同じofferを再送する（ローカルSDPとICE候補は変わらないため作り直さない）
+		var header http.Header
+		answer, header, err = s.postOffer(offerSDP)
+		backoff := s.postBackoff
+		for attempt := 1; err != nil && attempt <= s.postRetries && isRetryablePost(err); attempt++ {
+			fmt.Fprintf(os.Stderr, "%s POST failed: %v; retrying in %v (%d/%d)\n", s.protocol, err, backoff, attempt, s.postRetries)
+			time.Sleep(backoff)
+			backoff *= 2
+			answer, header, err = s.postOffer(offerSDP)
+		}
+		if err != nil {
+			return err
+		}
+		s.links = s.parseLinks(header)
+
+		// answerの無い応答でセッションだけを作るサーバーには、同じofferをPATCHで送る
+		if len(answer) == 0 && s.resourceURL != "" {
+			fmt.Fprintf(os.Stderr, "%s server created the session without an answer, sending the offer by PATCH (two-phase)\n", s.protocol)
+			if answer, err = s.patchOffer(offerSDP); err != nil {
+				return err
+			}
+		}
+	}
+	s.configureICEServersFromAnswer(peerConnection)
+
+	// BUNDLEされないanswerはpionが暗黙に1つのトランスポートとして扱うため、設定前に検証する
+	if err := checkAnswerBundle(string(answer), peerConnection.GetConfiguration().BundlePolicy); err != nil {
+		return err
+	}
+
+	// Set remote description
+	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
+		Type: webrtc.SDPTypeAnswer,
+		SDP:  string(answer),
+	})
+	if err != nil {
+		return err
+	}
+
+	if DebugMode {
+		fmt.Fprintf(os.Stderr, "\n=== SDP Answer ===\n%s\n=== End Answer ===\n\n", string(answer))
+	}
+	if VerboseSDP {
+		PrintSDPSummary(os.Stderr, offerSDP, string(answer))
+	}
+
+	return nil
+}
+
+// postOffer はofferを1回POSTし、answerと応答ヘッダーを返す
+// 失敗した応答にLocationがあった場合は、サーバーに残るセッションを作らないようDELETEしてから返す
+func (s *httpSession) postOffer(offerSDP string) ([]byte, http.Header, error) {
+	req, err := http.NewRequest(http.MethodPost, s.endpointURL, strings.NewReader(offerSDP))
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrConnection, err)
+	}
+	defer resp.Body.Close()
+
+	// 202 AcceptedとLocationはanswerの無い2段階のサーバーの応答（offerはPATCHで送り直す）
+	location := resp.Header.Get("Location")
+	var answer []byte
+	if resp.StatusCode != http.StatusCreated && (resp.StatusCode != http.StatusAccepted || location == "") {
+		body, _ := io.ReadAll(resp.Body)
+		err = &ServerError{Protocol: s.protocol, StatusCode: resp.StatusCode, Body: string(body)}
+	} else if answer, err = io.ReadAll(resp.Body); err != nil {
+		err = fmt.Errorf("%w: failed to read answer: %v", ErrConnection, err)
+	}
+
+	if err != nil {
+		if location != "" {
+			s.deleteOrphan(s.resolveURL(location))
+		}
+		return nil, nil, err
+	}
+	if location != "" {
+		s.resourceURL = s.resolveURL(location)
+		DebugLog("%s session resource: %s (protocol: %s)\n", s.protocol, s.resourceURL, resp.Proto)
+	}
+	return answer, resp.Header, nil
+}
+
+// deleteOrphan は失敗したPOSTで作られたセッションリソースをDELETEする
+// 失敗しても警告のみで、POSTのやり直しは続ける
+func (s *httpSession) deleteOrphan(resourceURL string) {
+	orphan := &httpSession{protocol: s.protocol, client: s.client, resourceURL: resourceURL}
+	if err := orphan.Delete(); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: cannot delete %s session left by a failed POST (%s): %v\n", s.protocol, resourceURL, err)
+	}
+}
+
+// isRetryablePost はofferのPOSTのエラーが一時的なもの（接続エラー、応答の読み込み失敗、5xx）かを返す
+// 4xxはofferや認証の問題のため、やり直しても成功しない
+func isRetryablePost(err error) bool {
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		return serverErr.StatusCode >= 500
+	}
+	return errors.Is(err, ErrConnection)
+}
+
+// createOffer はofferを作成してローカルSDPに設定し、ICE候補の収集完了後に送信するSDPを返す
+func (s *httpSession) createOffer(peerConnection *webrtc.PeerConnection) (string, error) {
+	// Create offer
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		return "", err
+	}
+
+	// Create gathering complete promise
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+
+	// Set local description
+	err = peerConnection.SetLocalDescription(offer)
+	if err != nil {
+		return "", err
+	}
+
+	// Wait for ICE gathering to complete
+	<-gatherComplete
+
+	offerSDP := peerConnection.LocalDescription().SDP
+	if s.videoTIAS > 0 {
+		offerSDP = addVideoTIAS(offerSDP, s.videoTIAS)
+	}
+	return offerSDP, nil
+}
+
+// addVideoTIAS は映像m-lineにb=TIAS（RFC 3890）を追加する
+// b=行はc=行の直後（c=行が無ければm=行の直後）に置く。pionが生成するSDPはCRLF区切り
+func addVideoTIAS(sdp string, bps int) string {
+	lines := strings.SplitAfter(sdp, "\n")
+	out := make([]string, 0, len(lines)+2)
+	inVideo := false
+	pending := false
+	for _, line := range lines {
+		trimmed := strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(trimmed, "m=") {
+			if pending {
+				out = append(out, fmt.Sprintf("b=TIAS:%d\r\n", bps))
+			}
+			inVideo = strings.HasPrefix(trimmed, "m=video ")
+			pending = inVideo
+			out = append(out, line)
+			continue
+		}
+		if pending && !strings.HasPrefix(trimmed, "i=") && !strings.HasPrefix(trimmed, "c=") {
+			out = append(out, fmt.Sprintf("b=TIAS:%d\r\n", bps))
+			pending = false
+		}
+		if inVideo && strings.HasPrefix(trimmed, "b=TIAS:") {
+			continue // 既存のTIASは置き換える
+		}
+		out = append(out, line)
+	}
+	if pending {
+		out = append(out, fmt.Sprintf("b=TIAS:%d\r\n", bps))
+	}
+	return strings.Join(out, "")
+}
+
+// Patch はセッションリソースへPATCHを送信する（trickle ICE等で使用）
+func (s *httpSession) Patch(contentType string, body []byte) error {
+	_, _, err := s.patch(contentType, body, nil)
+	return err
+}
+
+// patch はセッションリソースへPATCHを送信し、応答の本文とヘッダーを返す
+// headerはContent-Type以外に付けるリクエストヘッダー（nilで無し）
+func (s *httpSession) patch(contentType string, body []byte, header http.Header) ([]byte, http.Header, error) {
+	if s.resourceURL == "" {
+		return nil, nil, fmt.Errorf("%s session has no resource URL", s.protocol)
+	}
+
+	req, err := http.NewRequest(http.MethodPatch, s.resourceURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrConnection, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, nil, &ServerError{Protocol: s.protocol, StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: failed to read PATCH response: %v", ErrConnection, err)
+	}
+	return respBody, resp.Header, nil
+}
+
+// Delete はセッションリソースへDELETEを送信してセッションを終了する
+// リソースURLが無い場合は何もしない
+func (s *httpSession) Delete() error {
+	if s.resourceURL == "" {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodDelete, s.resourceURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s DELETE returned status %d", s.protocol, resp.StatusCode)
+	}
+	DebugLog("%s session deleted: %s\n", s.protocol, s.resourceURL)
+	s.resourceURL = ""
+	return nil
+}
+
+// resolveURL はLocationヘッダーの値をエンドポイントURL基準で絶対URLに解決する
+func (s *httpSession) resolveURL(location string) string {
+	base, err := url.Parse(s.endpointURL)
+	if err != nil {
+		return location
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return location
+	}
+	return base.ResolveReference(ref).String()
+}
+
+// parseLinks は応答の全てのLinkヘッダーを解析し、URLをエンドポイントURL基準で解決する
+func (s *httpSession) parseLinks(header http.Header) []sessionLink {
+	var links []sessionLink
+	for _, value := range header.Values("Link") {
+		for _, link := range parseLinkHeader(value) {
+			link.url = s.resolveURL(link.url)
+			links = append(links, link)
+			DebugLog("%s link: <%s> rel=%q\n", s.protocol, link.url, link.rel)
+		}
+	}
+	return links
+}
+
+// parseLinkHeader はLinkヘッダー（RFC 8288）を解析する
+// 1つのヘッダーにカンマ区切りで複数のリンクが含まれる場合がある
+func parseLinkHeader(header string) []sessionLink {
+	var links []sessionLink
+	for _, entry := range splitOutsideQuotes(header, ',') {
+		parts := splitOutsideQuotes(entry, ';')
+		if len(parts) == 0 {
+			continue
+		}
+		target := strings.TrimSpace(parts[0])
+		if !strings.HasPrefix(target, "<") || !strings.HasSuffix(target, ">") {
+			continue
+		}
+		link := sessionLink{
+			url:    target[1 : len(target)-1],
+			params: make(map[string]string),
+		}
+		for _, param := range parts[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			key = strings.ToLower(strings.TrimSpace(key))
+			value = strings.Trim(strings.TrimSpace(value), `"`)
+			if key == "rel" {
+				link.rel = value
+			} else if key != "" {
+				link.params[key] = value
+			}
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// splitOutsideQuotes は引用符と<>の外側にある区切り文字で文字列を分割する
+func splitOutsideQuotes(s string, sep byte) []string {
+	var parts []string
+	inQuote := false
+	inAngle := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			inQuote = !inQuote
+		case '<':
+			if !inQuote {
+				inAngle = true
+			}
+		case '>':
+			if !inQuote {
+				inAngle = false
+			}
+		case sep:
+			if !inQuote && !inAngle {
+				parts = append(parts, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, s[start:])
+}
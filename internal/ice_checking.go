@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICECheckingMonitor はICEがchecking状態のまま進まない場合を検出する
+// checkingの間、候補ペアのSTUN応答・要求の受信数が増えないままtimeoutが経過したら、
+// GetStatsの候補ペアの状態を表示し、restartが設定されていればICE restartを1回だけ行う
+type ICECheckingMonitor struct {
+	timeout time.Duration
+	stats   func() webrtc.StatsReport
+	restart func() error // nilの場合は表示のみ
+	clock   Clock
+
+	mu        sync.Mutex
+	checking  bool
+	since     time.Time // checkingになった時刻、または最後に進展があった時刻
+	received  uint64    // 前回の確認時点の候補ペアのSTUN応答・要求の受信数の合計
+	reported  bool      // 現在のchecking期間の候補ペアを表示済み
+	restarted bool
+}
+
+// NewICECheckingMonitor は新しいICECheckingMonitorを作成する
+// statsは通常PeerConnection.GetStatsで、restartはnilでICE restartを行わない
+func NewICECheckingMonitor(timeout time.Duration, stats func() webrtc.StatsReport, restart func() error) *ICECheckingMonitor {
+	return &ICECheckingMonitor{
+		timeout: timeout,
+		stats:   stats,
+		restart: restart,
+		clock:   SystemClock{},
+	}
+}
+
+// CheckingMonitor は --ice-checking-timeout と --ice-restart の設定でpeerConnectionを監視するICECheckingMonitorを返す
+// --ice-checking-timeout が0の場合はnilを返す
+func (s *httpSession) CheckingMonitor(peerConnection *webrtc.PeerConnection) *ICECheckingMonitor {
+	if ICECheckTimeoutMs <= 0 {
+		return nil
+	}
+	var restart func() error
+	if ICERestart {
+		restart = func() error { return s.RestartICE(peerConnection) }
+	}
+	return NewICECheckingMonitor(time.Duration(ICECheckTimeoutMs)*time.Millisecond, peerConnection.GetStats, restart)
+}
+
+// SetClock は経過時間の計算に使う時刻の取得元を差し替える
+func (m *ICECheckingMonitor) SetClock(clock Clock) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clock = clock
+}
+
+// SetState はICE接続状態の変化を通知する
+func (m *ICECheckingMonitor) SetState(state webrtc.ICEConnectionState) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	checking := state == webrtc.ICEConnectionStateChecking
+	if checking && !m.checking {
+		m.since = m.clock.Now()
+		m.received = 0
+		m.reported = false
+	}
+	m.checking = checking
+}
+
+// Check はcheckingのまま進展が無い時間がtimeoutを超えていれば候補ペアを表示し、必要ならICE restartを行う
+// 表示した場合はtrueを返す
+func (m *ICECheckingMonitor) Check() bool {
+	m.mu.Lock()
+	if !m.checking || m.reported {
+		m.mu.Unlock()
+		return false
+	}
+	report := m.stats()
+	now := m.clock.Now()
+	// STUNの応答や要求が届いている間は、接続の確立が遅いだけとみなして待つ
+	if received := receivedChecks(report); received > m.received {
+		m.received = received
+		m.since = now
+	}
+	stuck := now.Sub(m.since)
+	if stuck < m.timeout {
+		m.mu.Unlock()
+		return false
+	}
+	m.reported = true
+	restart := m.restart
+	if m.restarted {
+		restart = nil
+	}
+	m.restarted = m.restarted || restart != nil
+	m.mu.Unlock()
+
+	fmt.Fprintf(os.Stderr, "ICE has been checking for %v without progress; candidate pairs:\n%s", stuck.Round(time.Millisecond), describeCandidatePairs(report))
+	if restart == nil {
+		return true
+	}
+	fmt.Fprintln(os.Stderr, "Restarting ICE...")
+	if err := restart(); err != nil {
+		fmt.Fprintf(os.Stderr, "ICE restart failed: %v\n", err)
+		return true
+	}
+	// 新しい認証情報で最初からやり直すため、進展の無い時間を数え直す
+	m.mu.Lock()
+	m.since = m.clock.Now()
+	m.received = 0
+	m.reported = false
+	m.mu.Unlock()
+	return true
+}
+
+// Run はstopが閉じられるまで定期的にCheckを呼ぶ
+func (m *ICECheckingMonitor) Run(stop <-chan struct{}) {
+	interval := min(m.timeout/4, 500*time.Millisecond)
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.Check()
+		}
+	}
+}
+
+// receivedChecks は候補ペアが受信したSTUN応答と要求の数の合計を返す
+func receivedChecks(report webrtc.StatsReport) uint64 {
+	var total uint64
+	for _, stats := range report {
+		if pair, ok := stats.(webrtc.ICECandidatePairStats); ok {
+			total += pair.ResponsesReceived + pair.RequestsReceived
+		}
+	}
+	return total
+}
+
+// describeCandidatePairs は候補ペアごとの状態とSTUNの送受信数を1行ずつ整形し、原因の手がかりを添える
+func describeCandidatePairs(report webrtc.StatsReport) string {
+	var pairs []webrtc.ICECandidatePairStats
+	for _, stats := range report {
+		if pair, ok := stats.(webrtc.ICECandidatePairStats); ok {
+			pairs = append(pairs, pair)
+		}
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].ID < pairs[j].ID })
+
+	var b strings.Builder
+	var sent, received uint64
+	for _, pair := range pairs {
+		fmt.Fprintf(&b, "  %s -> %s: %s (requests sent %d, responses received %d, requests received %d)\n",
+			describeCandidate(report, pair.LocalCandidateID), describeCandidate(report, pair.RemoteCandidateID),
+			pair.State, pair.RequestsSent, pair.ResponsesReceived, pair.RequestsReceived)
+		sent += pair.RequestsSent
+		received += pair.ResponsesReceived + pair.RequestsReceived
+	}
+	switch {
+	case len(pairs) == 0:
+		b.WriteString("  (none: no usable remote candidates in the answer, or no local candidates were gathered)\n")
+	case sent > 0 && received == 0:
+		b.WriteString("  No STUN responses on any pair: UDP to the server is likely blocked by a firewall or NAT; configure a TURN server\n")
+	}
+	return b.String()
+}
+
+// describeCandidate は候補の種類、プロトコルとアドレスを返す
+func describeCandidate(report webrtc.StatsReport, id string) string {
+	if candidate, ok := report[id].(webrtc.ICECandidateStats); ok {
+		return fmt.Sprintf("%s %s %s:%d", candidate.CandidateType, candidate.Protocol, candidate.IP, candidate.Port)
+	}
+	return id
+}
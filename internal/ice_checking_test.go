@@ -0,0 +1,336 @@
+package internal
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const timeout = 5 * time.Second
+
+// mockStats はICECheckingMonitorに渡すGetStatsの代わりに、候補ペア1つの統計を返す
+// receivedを増やすと、ペアがSTUNの応答を受け取った（進展があった）ことになる
+type mockStats struct {
+	mu       sync.Mutex
+	sent     uint64
+	received uint64
+}
+
+func (s *mockStats) progress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.received++
+}
+
+func (s *mockStats) report() webrtc.StatsReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent += 3
+	return webrtc.StatsReport{
+		"local1": webrtc.ICECandidateStats{ID: "local1", Type: webrtc.StatsTypeLocalCandidate,
+			CandidateType: webrtc.ICECandidateTypeHost, Protocol: "udp", IP: "192.0.2.10", Port: 50000},
+		"remote1": webrtc.ICECandidateStats{ID: "remote1", Type: webrtc.StatsTypeRemoteCandidate,
+			CandidateType: webrtc.ICECandidateTypeHost, Protocol: "udp", IP: "198.51.100.20", Port: 3478},
+		"pair1": webrtc.ICECandidatePairStats{ID: "pair1", Type: webrtc.StatsTypeCandidatePair,
+			LocalCandidateID: "local1", RemoteCandidateID: "remote1", State: webrtc.StatsICECandidatePairStateInProgress,
+			RequestsSent: s.sent, ResponsesReceived: s.received},
+	}
+}
+
+// newMonitor はManualClockで時刻を進めるICECheckingMonitorを作成する
+func newMonitor(stats *mockStats, restart func() error) (*ICECheckingMonitor, *manualClock) {
+	clock := newManualClock(time.Unix(1700000000, 0))
+	monitor := NewICECheckingMonitor(timeout, stats.report, restart)
+	monitor.SetClock(clock)
+	return monitor, clock
+}
+
+// iceCheckingCaptureStderr はfnの実行中に標準エラー出力へ書かれた内容を返す
+func iceCheckingCaptureStderr(fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		panic(err)
+	}
+	orig := os.Stderr
+	os.Stderr = w
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	fn()
+	os.Stderr = orig
+	w.Close()
+	return <-done
+}
+
+// TestICECheckingReportAfterTimeout はcheckingのまま進展が無い時間がtimeoutを超えた時に一度だけ候補ペアを表示することを検証する
+func TestICECheckingReportAfterTimeout(t *testing.T) {
+	monitor, clock := newMonitor(&mockStats{}, nil)
+	monitor.SetState(webrtc.ICEConnectionStateChecking)
+
+	clock.Advance(timeout - time.Second)
+	if monitor.Check() {
+		t.Fatalf("reported before the timeout")
+	}
+	clock.Advance(time.Second)
+	var reported bool
+	output := iceCheckingCaptureStderr(func() { reported = monitor.Check() })
+	if !reported {
+		t.Fatalf("not reported after %v in checking", timeout)
+	}
+	for _, want := range []string{
+		"host udp 192.0.2.10:50000 -> host udp 198.51.100.20:3478: in-progress",
+		"No STUN responses on any pair",
+	} {
+		if !strings.Contains(output, want) {
+			t.Fatalf("report does not contain %q:\n%s", want, output)
+		}
+	}
+	if strings.Contains(output, "Restarting ICE") {
+		t.Fatalf("restarted ICE without a restart function:\n%s", output)
+	}
+
+	clock.Advance(timeout)
+	if monitor.Check() {
+		t.Fatalf("reported twice in the same checking period")
+	}
+}
+
+// TestICECheckingProgressResetsTimer はSTUNの応答が届いている間は、timeoutを超えても表示しないことを検証する
+func TestICECheckingProgressResetsTimer(t *testing.T) {
+	stats := &mockStats{}
+	monitor, clock := newMonitor(stats, nil)
+	monitor.SetState(webrtc.ICEConnectionStateChecking)
+
+	for i := 0; i < 4; i++ {
+		clock.Advance(timeout / 2)
+		stats.progress()
+		if monitor.Check() {
+			t.Fatalf("reported after %v although responses keep arriving", time.Duration(i+1)*timeout/2)
+		}
+	}
+	clock.Advance(timeout)
+	var reported bool
+	iceCheckingCaptureStderr(func() { reported = monitor.Check() })
+	if !reported {
+		t.Fatalf("not reported after progress stopped for %v", timeout)
+	}
+}
+
+// TestICECheckingNotChecking はchecking以外の状態では表示しないこと、checkingに戻ると数え直すことを検証する
+func TestICECheckingNotChecking(t *testing.T) {
+	monitor, clock := newMonitor(&mockStats{}, nil)
+	clock.Advance(2 * timeout)
+	if monitor.Check() {
+		t.Fatalf("reported before ICE started checking")
+	}
+
+	monitor.SetState(webrtc.ICEConnectionStateChecking)
+	clock.Advance(timeout / 2)
+	monitor.SetState(webrtc.ICEConnectionStateConnected)
+	clock.Advance(2 * timeout)
+	if monitor.Check() {
+		t.Fatalf("reported after ICE connected")
+	}
+
+	monitor.SetState(webrtc.ICEConnectionStateDisconnected)
+	monitor.SetState(webrtc.ICEConnectionStateChecking)
+	clock.Advance(timeout / 2)
+	if monitor.Check() {
+		t.Fatalf("checking time was not reset when ICE returned to checking")
+	}
+}
+
+// TestICECheckingRestartOnce はtimeoutでICE restartを行い、restart後も進まない場合は表示のみで再度restartしないことを検証する
+func TestICECheckingRestartOnce(t *testing.T) {
+	restarts := 0
+	monitor, clock := newMonitor(&mockStats{}, func() error {
+		restarts++
+		return nil
+	})
+	monitor.SetState(webrtc.ICEConnectionStateChecking)
+
+	clock.Advance(timeout)
+	output := iceCheckingCaptureStderr(func() { monitor.Check() })
+	if restarts != 1 || !strings.Contains(output, "Restarting ICE...") {
+		t.Fatalf("restarts=%d after the first timeout, want 1:\n%s", restarts, output)
+	}
+
+	// restart後は新しい認証情報での接続確認を待つため、timeoutを数え直す
+	clock.Advance(timeout / 2)
+	if monitor.Check() {
+		t.Fatalf("reported %v after the restart", timeout/2)
+	}
+	clock.Advance(timeout / 2)
+	var reported bool
+	output = iceCheckingCaptureStderr(func() { reported = monitor.Check() })
+	if !reported {
+		t.Fatalf("not reported when ICE stayed in checking after the restart")
+	}
+	if restarts != 1 || strings.Contains(output, "Restarting ICE") {
+		t.Fatalf("restarts=%d after the second timeout, want 1:\n%s", restarts, output)
+	}
+}
+
+// TestICECheckingRestartFailure はICE restartの失敗を表示し、やり直さないことを検証する
+func TestICECheckingRestartFailure(t *testing.T) {
+	restarts := 0
+	monitor, clock := newMonitor(&mockStats{}, func() error {
+		restarts++
+		return errors.New("405 Method Not Allowed")
+	})
+	monitor.SetState(webrtc.ICEConnectionStateChecking)
+
+	clock.Advance(timeout)
+	output := iceCheckingCaptureStderr(func() { monitor.Check() })
+	if !strings.Contains(output, "ICE restart failed: 405 Method Not Allowed") {
+		t.Fatalf("restart failure not reported:\n%s", output)
+	}
+	clock.Advance(10 * timeout)
+	if monitor.Check() || restarts != 1 {
+		t.Fatalf("restarts=%d after a failed restart, want 1", restarts)
+	}
+}
+
+// restartEndpoint はofferのPOSTにanswerを返し、ICE restartのPATCHに新しい認証情報のSDP断片を返すWHEPサーバー
+type restartEndpoint struct {
+	patchStatus int // 0以外ならPATCHにこのステータスを返す
+
+	mu    sync.Mutex
+	patch *http.Request
+	frag  string
+}
+
+func (e *restartEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	switch r.Method {
+	case http.MethodPost:
+		answer, err := createAnswer(string(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", "/session/1")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+	case http.MethodPatch:
+		e.mu.Lock()
+		e.patch = r
+		e.frag = string(body)
+		e.mu.Unlock()
+		if e.patchStatus != 0 {
+			http.Error(w, "ICE restart not supported", e.patchStatus)
+			return
+		}
+		w.Header().Set("Content-Type", "application/trickle-ice-sdpfrag")
+		io.WriteString(w, "a=ice-ufrag:rstrt\r\na=ice-pwd:restartedpassword0123456789\r\n"+
+			"m=video 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\n"+
+			"a=candidate:1 1 udp 2130706431 127.0.0.1 40000 typ host\r\na=end-of-candidates\r\n")
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// sdpValue はSDPの最初の"a=<attr>:"行の値を返す
+func sdpValue(sdp, attr string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimRight(line, "\r"), "a="+attr+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// restartICE はrestartEndpointとSDPを交換した後にRestartICEを呼び、PeerConnectionを返す
+func restartICE(endpoint *restartEndpoint) (*webrtc.PeerConnection, string, error) {
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	peerConnection, err := newSubscriber()
+	if err != nil {
+		return nil, "", err
+	}
+	session := NewWHEPSession(server.URL + "/whep")
+	if err := session.ExchangeSDP(peerConnection); err != nil {
+		peerConnection.Close()
+		return nil, "", err
+	}
+	ufrag := sdpValue(peerConnection.LocalDescription().SDP, "ice-ufrag")
+	return peerConnection, ufrag, session.RestartICE(peerConnection)
+}
+
+// TestICECheckingRestartICE はICE restartのPATCHが新しい認証情報のSDP断片を送り、応答の認証情報と候補を適用することを検証する
+func TestICECheckingRestartICE(t *testing.T) {
+	endpoint := &restartEndpoint{}
+	peerConnection, oldUfrag, err := restartICE(endpoint)
+	if peerConnection != nil {
+		defer peerConnection.Close()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint.mu.Lock()
+	patch, frag := endpoint.patch, endpoint.frag
+	endpoint.mu.Unlock()
+	if patch == nil {
+		t.Fatalf("no PATCH sent")
+	}
+	if ct := patch.Header.Get("Content-Type"); ct != "application/trickle-ice-sdpfrag" {
+		t.Fatalf("PATCH Content-Type %q, want application/trickle-ice-sdpfrag", ct)
+	}
+	if ifMatch := patch.Header.Get("If-Match"); ifMatch != "*" {
+		t.Fatalf("PATCH If-Match %q, want *", ifMatch)
+	}
+	newUfrag := sdpValue(frag, "ice-ufrag")
+	if newUfrag == "" || newUfrag == oldUfrag {
+		t.Fatalf("PATCH ice-ufrag %q, want new credentials (old %q):\n%s", newUfrag, oldUfrag, frag)
+	}
+	for _, want := range []string{"a=ice-pwd:", "m=video ", "a=mid:0", "a=end-of-candidates"} {
+		if !strings.Contains(frag, want) {
+			t.Fatalf("PATCH body does not contain %q:\n%s", want, frag)
+		}
+	}
+
+	remote := peerConnection.RemoteDescription().SDP
+	if ufrag := sdpValue(remote, "ice-ufrag"); ufrag != "rstrt" {
+		t.Fatalf("remote ice-ufrag %q after the restart, want rstrt", ufrag)
+	}
+	if pwd := sdpValue(remote, "ice-pwd"); pwd != "restartedpassword0123456789" {
+		t.Fatalf("remote ice-pwd %q after the restart", pwd)
+	}
+	if state := peerConnection.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Fatalf("signaling state %s after the restart, want stable", state)
+	}
+}
+
+// TestICECheckingRestartICERejected はサーバーがICE restartを拒否した場合にServerErrorを返し、元のanswerでsignalingをstableに戻すことを検証する
+func TestICECheckingRestartICERejected(t *testing.T) {
+	endpoint := &restartEndpoint{patchStatus: http.StatusMethodNotAllowed}
+	peerConnection, _, err := restartICE(endpoint)
+	if peerConnection != nil {
+		defer peerConnection.Close()
+	}
+	var serverErr *ServerError
+	if !errors.As(err, &serverErr) || serverErr.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("got %v, want ServerError 405", err)
+	}
+	if state := peerConnection.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Fatalf("signaling state %s after the rejected restart, want stable", state)
+	}
+	if ufrag := sdpValue(peerConnection.RemoteDescription().SDP, "ice-ufrag"); ufrag == "rstrt" {
+		t.Fatalf("remote ice-ufrag changed although the restart was rejected")
+	}
+}
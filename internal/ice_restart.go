@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// trickleICEContentType はtrickle ICEとICE restartのPATCHで送るSDP断片（RFC 8840）のContent-Type
+const trickleICEContentType = "application/trickle-ice-sdpfrag"
+
+// RestartICE は新しいICE認証情報でofferを作り直し、セッションリソースへのPATCHでICE restartを行う（RFC 9725 4.3.2）
+// 応答のSDP断片のice-ufrag/ice-pwdでリモートSDPを更新し、候補を追加する
+// 失敗した場合は元のanswerを設定し直す
+func (s *httpSession) RestartICE(peerConnection *webrtc.PeerConnection) error {
+	remote := peerConnection.RemoteDescription()
+	if remote == nil {
+		return fmt.Errorf("%s session has no remote description", s.protocol)
+	}
+
+	offer, err := peerConnection.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		return err
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	<-gatherComplete
+
+	// pionはhave-local-offerからのrollbackに対応していないため、失敗した場合は元のanswerを設定し直してsignalingをstableに戻す
+	restore := func(err error) error {
+		if rErr := peerConnection.SetRemoteDescription(*remote); rErr != nil {
+			DebugLog("Failed to restore the answer after the ICE restart failed: %v\n", rErr)
+		}
+		return err
+	}
+
+	// ICE restartでは他のリソースの更新と競合しないよう、If-Match: * を付ける
+	header := http.Header{"If-Match": []string{"*"}}
+	frag, _, err := s.patch(trickleICEContentType, []byte(iceFragFromSDP(peerConnection.LocalDescription().SDP)), header)
+	if err != nil {
+		return restore(err)
+	}
+	ufrag, pwd, candidates := parseICEFrag(string(frag))
+	if ufrag == "" || pwd == "" {
+		return restore(fmt.Errorf("%s server returned no ICE credentials to the ICE restart PATCH", s.protocol))
+	}
+
+	answer := webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: replaceICECredentials(remote.SDP, ufrag, pwd)}
+	if err := peerConnection.SetRemoteDescription(answer); err != nil {
+		return restore(err)
+	}
+	for _, candidate := range candidates {
+		if err := peerConnection.AddICECandidate(candidate); err != nil {
+			DebugLog("Failed to add ICE candidate from the ICE restart answer: %v\n", err)
+		}
+	}
+	DebugLog("%s ICE restart: new remote ufrag %s, %d candidate(s)\n", s.protocol, ufrag, len(candidates))
+	return nil
+}
+
+// iceFragFromSDP はSDPからICE restartのPATCHで送る断片（ice-ufrag、ice-pwd、m-lineごとの候補）を作る
+func iceFragFromSDP(sdp string) string {
+	var ufrag, pwd string
+	var media strings.Builder
+	inMedia := false
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			if ufrag == "" {
+				ufrag = line
+			}
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			if pwd == "" {
+				pwd = line
+			}
+		case strings.HasPrefix(line, "m="):
+			if inMedia {
+				media.WriteString("a=end-of-candidates\r\n")
+			}
+			inMedia = true
+			media.WriteString(line + "\r\n")
+		case inMedia && (strings.HasPrefix(line, "a=mid:") || strings.HasPrefix(line, "a=candidate:")):
+			media.WriteString(line + "\r\n")
+		}
+	}
+	if inMedia {
+		media.WriteString("a=end-of-candidates\r\n")
+	}
+	return ufrag + "\r\n" + pwd + "\r\n" + media.String()
+}
+
+// parseICEFrag はSDP断片からice-ufrag、ice-pwdと候補（所属するm-lineのmid付き）を取り出す
+func parseICEFrag(frag string) (ufrag, pwd string, candidates []webrtc.ICECandidateInit) {
+	var mid *string
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			ufrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			pwd = strings.TrimPrefix(line, "a=ice-pwd:")
+		case strings.HasPrefix(line, "m="):
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=candidate:"):
+			candidates = append(candidates, webrtc.ICECandidateInit{Candidate: strings.TrimPrefix(line, "a="), SDPMid: mid})
+		}
+	}
+	return ufrag, pwd, candidates
+}
+
+// replaceICECredentials はSDPのすべてのice-ufrag/ice-pwdを置き換える
+func replaceICECredentials(sdp, ufrag, pwd string) string {
+	lines := strings.SplitAfter(sdp, "\n")
+	for i, line := range lines {
+		eol := line[len(strings.TrimRight(line, "\r\n")):]
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			lines[i] = "a=ice-ufrag:" + ufrag + eol
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			lines[i] = "a=ice-pwd:" + pwd + eol
+		}
+	}
+	return strings.Join(lines, "")
+}
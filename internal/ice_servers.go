@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// ICEServerRel はWHIP/WHEPエンドポイントがICEサーバー（STUN/TURN）を広告するLinkヘッダーのrel
+const ICEServerRel = "ice-server"
+
+// iceServerOptionsTimeout はofferを作成する前にICEサーバーを問い合わせるOPTIONSのタイムアウト
+const iceServerOptionsTimeout = 5 * time.Second
+
+// iceServersFromLinks はrel="ice-server"のLinkヘッダーをICEサーバー設定に変換する
+// username/credentialパラメーターはTURNの認証情報。credential-typeはpassword以外は未対応のため無視する
+func iceServersFromLinks(links []sessionLink) []webrtc.ICEServer {
+	var servers []webrtc.ICEServer
+	for _, link := range links {
+		if !hasRel(link.rel, ICEServerRel) {
+			continue
+		}
+		if credentialType, ok := link.params["credential-type"]; ok && credentialType != "password" {
+			DebugLog("Ignoring ICE server %s with credential-type %q\n", link.url, credentialType)
+			continue
+		}
+		server := webrtc.ICEServer{
+			URLs:       []string{link.url},
+			Username:   link.params["username"],
+			Credential: link.params["credential"],
+		}
+		if strings.HasPrefix(link.url, "turn") && (server.Username == "" || server.Credential == "") {
+			fmt.Fprintf(os.Stderr, "Warning: ignoring TURN server %s without username/credential\n", link.url)
+			continue
+		}
+		servers = append(servers, server)
+	}
+	return servers
+}
+
+// hasRel はLinkヘッダーのrel（空白区切りで複数指定可能）にrelが含まれるかを返す
+func hasRel(rels, rel string) bool {
+	for _, value := range strings.Fields(rels) {
+		if strings.EqualFold(value, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// ICEServers はエンドポイントが広告したICEサーバーを返す（OPTIONSとPOST応答の両方）
+func (s *httpSession) ICEServers() []webrtc.ICEServer {
+	return s.iceServers
+}
+
+// fetchICEServers はofferを作成する前にOPTIONSでエンドポイントのICEサーバーを問い合わせる
+// OPTIONSに対応しないサーバーも多いため、失敗した場合は空を返す
+func (s *httpSession) fetchICEServers() []webrtc.ICEServer {
+	req, err := http.NewRequest(http.MethodOptions, s.endpointURL, nil)
+	if err != nil {
+		return nil
+	}
+	client := *s.client
+	client.Timeout = iceServerOptionsTimeout
+	resp, err := client.Do(req)
+	if err != nil {
+		DebugLog("%s OPTIONS failed: %v\n", s.protocol, err)
+		return nil
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		DebugLog("%s OPTIONS returned status %d\n", s.protocol, resp.StatusCode)
+		return nil
+	}
+	return iceServersFromLinks(s.parseLinks(resp.Header))
+}
+
+// applyICEServers は未設定のICEサーバーをPeerConnectionの設定に追加し、追加した数を返す
+// pionはSetConfigurationで更新したICEサーバーを以降のICE候補収集で使う
+// 設定できない場合（不正なURL等）は警告を出し、設定済みのサーバーのまま続行する
+func (s *httpSession) applyICEServers(peerConnection *webrtc.PeerConnection, servers []webrtc.ICEServer) int {
+	configuration := peerConnection.GetConfiguration()
+	var added []webrtc.ICEServer
+	for _, server := range servers {
+		if containsICEServer(configuration.ICEServers, server) {
+			continue
+		}
+		configuration.ICEServers = append(configuration.ICEServers, server)
+		added = append(added, server)
+	}
+	if len(added) == 0 {
+		return 0
+	}
+	if err := peerConnection.SetConfiguration(configuration); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: ignoring ICE servers from the %s endpoint: %v\n", s.protocol, err)
+		return 0
+	}
+	for _, server := range added {
+		DebugLog("%s ICE server: %s (credentials: %v)\n", s.protocol, strings.Join(server.URLs, ","), server.Username != "")
+	}
+	s.iceServers = append(s.iceServers, added...)
+	return len(added)
+}
+
+// containsICEServer はserversに同じURLと認証情報のサーバーがあるかを返す
+func containsICEServer(servers []webrtc.ICEServer, server webrtc.ICEServer) bool {
+	for _, existing := range servers {
+		if strings.Join(existing.URLs, ",") == strings.Join(server.URLs, ",") &&
+			existing.Username == server.Username && existing.Credential == server.Credential {
+			return true
+		}
+	}
+	return false
+}
+
+// SetOptionsICEServers はofferを作成する前にOPTIONSでエンドポイントのICEサーバーを問い合わせるよう設定する
+// OPTIONSに応答しないサーバーでは接続のたびにタイムアウトまで待つため、デフォルトでは問い合わせない
+func (s *httpSession) SetOptionsICEServers(enabled bool) {
+	s.optionsICE = enabled
+}
+
+// configureICEServersBeforeOffer はOPTIONSで得たICEサーバーをoffer作成前にPeerConnectionへ設定する
+// SetOptionsICEServersで有効にした場合のみ問い合わせる
+func (s *httpSession) configureICEServersBeforeOffer(peerConnection *webrtc.PeerConnection) {
+	if !s.optionsICE {
+		return
+	}
+	if added := s.applyICEServers(peerConnection, s.fetchICEServers()); added > 0 {
+		fmt.Fprintf(os.Stderr, "Using %d ICE server(s) from the %s endpoint\n", added, s.protocol)
+	}
+}
+
+// configureICEServersFromAnswer はPOST応答で広告されたICEサーバーをPeerConnectionへ設定する
+// ICE候補はoffer送信前に収集済みのため、ここで追加したサーバーはこのセッションの候補には含まれない
+func (s *httpSession) configureICEServersFromAnswer(peerConnection *webrtc.PeerConnection) {
+	if added := s.applyICEServers(peerConnection, iceServersFromLinks(s.links)); added > 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %s server advertised %d ICE server(s) only in its answer; candidates were already gathered without them (use --options-ice-servers if the server returns them to OPTIONS)\n", s.protocol, added)
+	}
+}
@@ -0,0 +1,272 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pion/turn/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	turnRealm    = "test"
+	turnUsername = "user"
+	turnPassword = "pass"
+)
+
+// startTURNServer はループバックで認証付きのTURNサーバーを起動し、アドレスを返す
+func startTURNServer() (string, func(), error) {
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return "", nil, err
+	}
+	key := turn.GenerateAuthKey(turnUsername, turnRealm, turnPassword)
+	server, err := turn.NewServer(turn.ServerConfig{
+		Realm: turnRealm,
+		AuthHandler: func(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+			return key, username == turnUsername
+		},
+		PacketConnConfigs: []turn.PacketConnConfig{{
+			PacketConn: conn,
+			RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+				RelayAddress: net.ParseIP("127.0.0.1"),
+				Address:      "127.0.0.1",
+			},
+		}},
+	})
+	if err != nil {
+		conn.Close()
+		return "", nil, err
+	}
+	return conn.LocalAddr().String(), func() { server.Close() }, nil
+}
+
+// endpoint はOPTIONS/POSTにLinkヘッダーを付けて応答するWHIP/WHEPサーバー
+type endpoint struct {
+	optionsLinks []string // nilの場合はOPTIONSに405を返す
+	postLinks    []string
+
+	mu      sync.Mutex
+	methods []string
+	offer   string
+}
+
+func (e *endpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	e.methods = append(e.methods, r.Method)
+	e.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodOptions:
+		if e.optionsLinks == nil {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		for _, link := range e.optionsLinks {
+			w.Header().Add("Link", link)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		offer, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e.mu.Lock()
+		e.offer = string(offer)
+		e.mu.Unlock()
+		answer, err := createAnswer(string(offer))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, link := range e.postLinks {
+			w.Header().Add("Link", link)
+		}
+		w.Header().Set("Content-Type", "application/sdp")
+		w.Header().Set("Location", "/session/1")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, answer)
+	default:
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// iceServersNewSubscriber はwhep-goと同じ受信側PeerConnectionを作成する
+func iceServersNewSubscriber() (*webrtc.PeerConnection, error) {
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, err
+	}
+	streamManager := NewStreamManager(NewProbeWriter(), NewDefaultRTPProcessor(), 0, nil)
+	return CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+}
+
+// iceServerLinks はTURN（認証付き）とSTUNを広告するLinkヘッダーを返す
+func iceServerLinks(turnAddr string) []string {
+	return []string{
+		fmt.Sprintf(`<turn:%s?transport=udp>; rel="ice-server"; username="%s"; credential="%s"; credential-type="password"`, turnAddr, turnUsername, turnPassword),
+		fmt.Sprintf(`<stun:%s>; rel="ice-server"`, turnAddr),
+	}
+}
+
+// hasTURNServer はPeerConnectionの設定に認証情報付きのTURNサーバーがあるかを返す
+func hasTURNServer(peerConnection *webrtc.PeerConnection, turnAddr string) bool {
+	for _, server := range peerConnection.GetConfiguration().ICEServers {
+		for _, url := range server.URLs {
+			if strings.Contains(url, "turn:"+turnAddr) && server.Username == turnUsername && server.Credential == turnPassword {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// testOptionsWHIP は--options-ice-servers指定時に、OPTIONSで広告されたTURNサーバーがofferの候補収集に使われることを検証する
+func testOptionsWHIP(turnAddr string) error {
+	server := &endpoint{optionsLinks: iceServerLinks(turnAddr)}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	peerConnection, err := newPublisher()
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+
+	session := NewWHIPSession(httpServer.URL)
+	session.SetOptionsICEServers(true)
+	if err := session.ExchangeSDP(peerConnection); err != nil {
+		return fmt.Errorf("exchange failed: %v", err)
+	}
+	if got := strings.Join(server.methods, ","); got != "OPTIONS,POST" {
+		return fmt.Errorf("requests were %s, want OPTIONS,POST", got)
+	}
+	if !hasTURNServer(peerConnection, turnAddr) {
+		return fmt.Errorf("TURN server from Link header not in PeerConnection configuration")
+	}
+	if n := len(session.ICEServers()); n != 2 {
+		return fmt.Errorf("session reports %d ICE servers, want 2", n)
+	}
+	if !strings.Contains(server.offer, "typ relay") {
+		return fmt.Errorf("offer has no relay candidate from the advertised TURN server")
+	}
+	return nil
+}
+
+// testOptionsDisabled はデフォルトではofferの前にOPTIONSを送らないことを検証する
+func testOptionsDisabled(turnAddr string) error {
+	server := &endpoint{optionsLinks: iceServerLinks(turnAddr)}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	peerConnection, err := newPublisher()
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+
+	session := NewWHIPSession(httpServer.URL)
+	if err := session.ExchangeSDP(peerConnection); err != nil {
+		return fmt.Errorf("exchange failed: %v", err)
+	}
+	if got := strings.Join(server.methods, ","); got != "POST" {
+		return fmt.Errorf("requests were %s, want POST", got)
+	}
+	if hasTURNServer(peerConnection, turnAddr) || strings.Contains(server.offer, "typ relay") {
+		return fmt.Errorf("TURN server advertised only to OPTIONS was used")
+	}
+	return nil
+}
+
+// testAnswerOnlyWHEP はPOST応答でのみ広告されたICEサーバーも設定されることを検証する（WHEP側も同じ処理）
+// 候補はoffer送信前に収集済みのため、offerにrelay候補は含まれない
+func testAnswerOnlyWHEP(turnAddr string) error {
+	server := &endpoint{postLinks: iceServerLinks(turnAddr)}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	peerConnection, err := iceServersNewSubscriber()
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+
+	session := NewWHEPSession(httpServer.URL)
+	if err := session.ExchangeSDP(peerConnection); err != nil {
+		return fmt.Errorf("exchange failed: %v", err)
+	}
+	if !hasTURNServer(peerConnection, turnAddr) {
+		return fmt.Errorf("TURN server from Link header not in PeerConnection configuration")
+	}
+	if n := len(session.ICEServers()); n != 2 {
+		return fmt.Errorf("session reports %d ICE servers, want 2", n)
+	}
+	if strings.Contains(server.offer, "typ relay") {
+		return fmt.Errorf("offer unexpectedly has a relay candidate")
+	}
+	return nil
+}
+
+// testUnusableLinks は認証情報の無いTURN、password以外のcredential-type、別のrelを無視することを検証する
+func testUnusableLinks(turnAddr string) error {
+	server := &endpoint{optionsLinks: []string{
+		fmt.Sprintf(`<turn:%s>; rel="ice-server"`, turnAddr),
+		fmt.Sprintf(`<turn:%s>; rel="ice-server"; username="u"; credential="token"; credential-type="oauth"`, turnAddr),
+		`</events>; rel="urn:ietf:params:whep:ext:core:server-sent-events"`,
+	}}
+	httpServer := httptest.NewServer(server)
+	defer httpServer.Close()
+
+	peerConnection, err := newPublisher()
+	if err != nil {
+		return err
+	}
+	defer peerConnection.Close()
+
+	before := len(peerConnection.GetConfiguration().ICEServers)
+	session := NewWHIPSession(httpServer.URL)
+	session.SetOptionsICEServers(true)
+	if err := session.ExchangeSDP(peerConnection); err != nil {
+		return fmt.Errorf("exchange failed: %v", err)
+	}
+	if after := len(peerConnection.GetConfiguration().ICEServers); after != before {
+		return fmt.Errorf("ICE servers changed from %d to %d", before, after)
+	}
+	if n := len(session.ICEServers()); n != 0 {
+		return fmt.Errorf("session reports %d ICE servers, want 0", n)
+	}
+	return nil
+}
+
+// TestICEServers はローカルのTURNサーバーを使い、OPTIONSとanswerのLinkヘッダーのICEサーバーを検証する
+func TestICEServers(t *testing.T) {
+	turnAddr, stopTURN, err := startTURNServer()
+	if err != nil {
+		t.Fatalf("cannot start TURN server: %v", err)
+	}
+	defer stopTURN()
+
+	tests := []struct {
+		name string
+		fn   func(string) error
+	}{
+		{"ICE servers from OPTIONS (WHIP)", testOptionsWHIP},
+		{"no OPTIONS by default", testOptionsDisabled},
+		{"ICE servers only in the answer (WHEP)", testAnswerOnlyWHEP},
+		{"unusable ice-server links", testUnusableLinks},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.fn(turnAddr); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
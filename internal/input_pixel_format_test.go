@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+const (
+	inputPixelFormatWidth  = 320
+	inputPixelFormatHeight = 240
+	inputPixelFormatFrames = 3
+)
+
+// yuvFrame はYUV420Pのグラデーションフレームを作る
+func yuvFrame(index int) []byte {
+	frame := make([]byte, inputPixelFormatWidth*inputPixelFormatHeight*3/2)
+	for i := range frame {
+		frame[i] = byte(i/inputPixelFormatWidth + index*8)
+	}
+	return frame
+}
+
+// inputPixelFormatMakeMKV はYUV420Pのrawvideoを格納したMKVを作る（colourSpaceが空の場合はColourSpace要素を省略する）
+func inputPixelFormatMakeMKV(colourSpace string) []byte {
+	video := [][]byte{element(0xB0, uintData(inputPixelFormatWidth)), element(0xBA, uintData(inputPixelFormatHeight))}
+	if colourSpace != "" {
+		video = append(video, element(0x2EB524, []byte(colourSpace)))
+	}
+	parts := [][]byte{
+		element(0x1A45DFA3, element(0x4282, []byte("matroska"))),
+		append(idBytes(0x18538067), unknownSize...),
+		element(0x1549A966, element(0x2AD7B1, uintData(1000000))),
+		element(0x1654AE6B, element(0xAE,
+			element(0xD7, uintData(1)),
+			element(0x86, []byte("V_UNCOMPRESSED")),
+			element(0xE0, video...),
+		)),
+		append(idBytes(0x1F43B675), unknownSize...),
+		element(0xE7, uintData(0)),
+	}
+	for i := 0; i < inputPixelFormatFrames; i++ {
+		block := []byte{0x81, 0x00, byte(i * 33), 0x80}
+		parts = append(parts, element(0xA3, block, yuvFrame(i)))
+	}
+	return bytes.Join(parts, nil)
+}
+
+// readVideo はMKVReaderで映像フレームをすべて読み、入力が宣言する画素形式と合わせて返す
+func readVideo(data []byte) (string, []*Frame, error) {
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	var video []*Frame
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return reader.PixelFormat(), video, nil
+		}
+		if err != nil {
+			return "", nil, err
+		}
+		if frame.Type == FrameTypeVideo {
+			video = append(video, frame)
+		}
+	}
+}
+
+// encodeAll はpixelFormatを入力形式としてフレームをすべてエンコードする
+func encodeAll(pixelFormat string, video []*Frame) error {
+	encoder, err := NewVP8Encoder(inputPixelFormatWidth, inputPixelFormatHeight, pixelFormat, 500)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+	for i, frame := range video {
+		if _, _, err := encoder.Encode(frame.Data); err != nil {
+			return fmt.Errorf("frame %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// TestInputPixelFormatValidate は --input-pixel-format の値の検証を確認する
+func TestInputPixelFormatValidate(t *testing.T) {
+	for _, format := range []string{"", "RGBA", "YUV420P", "I420"} {
+		if err := ValidateInputPixelFormat(format); err != nil {
+			t.Fatalf("%q rejected: %v", format, err)
+		}
+	}
+	for _, format := range []string{"rgba", "NV12", "BGRA", "yuv"} {
+		if err := ValidateInputPixelFormat(format); err == nil {
+			t.Fatalf("%q accepted", format)
+		}
+	}
+}
+
+// TestInputPixelFormatMissingColourSpace はColourSpaceの無いYUV420P入力がRGBA扱いでは失敗し、上書きすればエンコードできることを検証する
+func TestInputPixelFormatMissingColourSpace(t *testing.T) {
+	declared, video, err := readVideo(inputPixelFormatMakeMKV(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if declared != "RGBA" {
+		t.Fatalf("input without ColourSpace declares %s, want RGBA", declared)
+	}
+	if len(video) != inputPixelFormatFrames {
+		t.Fatalf("read %d video frames, want %d", len(video), inputPixelFormatFrames)
+	}
+	size := len(video[0].Data)
+	if size == RawFrameSize(declared, inputPixelFormatWidth, inputPixelFormatHeight) {
+		t.Fatalf("YUV420P frame size %d unexpectedly matches RGBA", size)
+	}
+	if guess := GuessPixelFormat(size, inputPixelFormatWidth, inputPixelFormatHeight); guess != "YUV420P" {
+		t.Fatalf("frame size %d guessed as %q, want YUV420P", size, guess)
+	}
+	if err := encodeAll(declared, video); err == nil {
+		t.Fatalf("encoding YUV420P data as RGBA succeeded")
+	}
+	for _, override := range []string{"YUV420P", "I420"} {
+		if err := encodeAll(override, video); err != nil {
+			t.Fatalf("encoding with override %s: %v", override, err)
+		}
+	}
+}
+
+// TestInputPixelFormatDeclaredColourSpace はColourSpaceがある入力ではその画素形式が使われることを検証する
+func TestInputPixelFormatDeclaredColourSpace(t *testing.T) {
+	declared, video, err := readVideo(inputPixelFormatMakeMKV("YUV420P"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if declared != "YUV420P" {
+		t.Fatalf("input declares %s, want YUV420P", declared)
+	}
+	if size := len(video[0].Data); size != RawFrameSize(declared, inputPixelFormatWidth, inputPixelFormatHeight) {
+		t.Fatalf("frame size %d does not match declared %s", size, declared)
+	}
+	if err := encodeAll(declared, video); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,18 +1,65 @@
 package internal
 
 import (
+	"io"
+
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
-// RTPProcessor はRTPパケットを処理するインターフェース
+// RTPProcessor は受信したRTPパケットをフレームに組み立てるデパケッタイザーのインターフェース
+// StreamManagerは映像と音声の読み取りループから受信順に呼び出す。両ループは並行に動くため、
+// 状態を持つ実装はcodecTypeごとに分けるか排他制御する
+// 独自の実装はNewStreamManagerWithProcessorに渡すと、すべての映像パケットを処理できる
 type RTPProcessor interface {
-	// ProcessRTPPacket はRTPパケットを処理する
-	// 返り値は処理されたデータ（複数のNALユニットやフレームを含む可能性がある）
+	// ProcessRTPPacket はRTPパケットを処理し、このパケットで完成したフレームを返す
+	// codecTypeは映像ではネゴシエーションされたコーデック（vp8, vp9）、音声では"opus"
+	// 完成したフレームが無ければnilを返す。各フレームはパケットのRTP timestampでStreamWriterに渡され、
+	// StreamWriterは呼び出し中にのみ参照するため、返したスライスは次の呼び出しで再利用してよい
+	// エラーはそのパケットのみの失敗（ErrFrameDropped）として扱われ、受信は続く
 	ProcessRTPPacket(packet *rtp.Packet, codecType string) ([][]byte, error)
 }
 
+// KeyframeDetector はフレームがキーフレームかを判定できるRTPProcessor
+// 実装しないRTPProcessorのフレームは、codecTypeに応じてVP8/VP9のビットストリームとして判定する
+type KeyframeDetector interface {
+	// IsKeyframe はProcessRTPPacketが返したframeが単独でデコードできるかを返す
+	IsKeyframe(frame []byte, codecType string) bool
+}
+
+// VideoPacketizer はエンコード済みビデオフレームをRTPパケットに分割して送信するインターフェース
+type VideoPacketizer interface {
+	// PacketizeAndWrite はフレームをパケット化してwritePacketで送信し、送信パケット数を返す
+	PacketizeAndWrite(frame []byte, timestampMs int64, isKeyframe bool, writePacket func(*rtp.Packet) error) (int, error)
+}
+
+// PartitionedVideoPacketizer はコーデックのパーティション境界を保持してパケット化できるVideoPacketizer
+type PartitionedVideoPacketizer interface {
+	VideoPacketizer
+	// PacketizePartitionsAndWrite はパーティションごとにパケットを分けて送信し、送信パケット数を返す
+	PacketizePartitionsAndWrite(partitions [][]byte, timestampMs int64, isKeyframe bool, writePacket func(*rtp.Packet) error) (int, error)
+}
+
+// FrameSource はwhip-goに映像/音声フレームを供給する入力のインターフェース
+// 映像/音声の情報は最初の映像フレームを読んだ後に確定する
+type FrameSource interface {
+	// ReadFrame は次のフレームを返す（終端ではio.EOF）
+	ReadFrame() (*Frame, error)
+
+	VideoWidth() int
+	VideoHeight() int
+	// PixelFormat はrawvideoの画素形式（RGBA, YUV420P等）を返す
+	PixelFormat() string
+	// VideoCodec は映像のCodecID（V_UNCOMPRESSED, V_VP8, V_VP9）を返す
+	VideoCodec() string
+	// AudioCodec は音声のCodecID（A_OPUS, A_PCM/INT/LIT）を返す。音声がない場合は空
+	AudioCodec() string
+	AudioSampleRate() int
+	AudioChannels() int
+}
+
 // StreamWriter は処理されたメディアデータを書き込むインターフェース
+// フレーム単位の失敗はErrFrameDroppedで包んで返し、それ以外のエラーは出力の失敗として扱われる
 type StreamWriter interface {
 	// WriteVideoFrame はビデオフレームを書き込む
 	WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error
@@ -27,6 +74,44 @@ type StreamWriter interface {
 	Close() error
 }
 
+// VideoCodecSetter は映像トラックのコーデック確定時に通知を受けるStreamWriter
+type VideoCodecSetter interface {
+	SetVideoCodec(codecType string)
+}
+
+// VideoRotationSetter は映像の表示回転（CVO）の通知を受けるStreamWriter
+type VideoRotationSetter interface {
+	// SetVideoRotation は表示時に時計回りに回転すべき角度（0, 90, 180, 270）を設定する
+	SetVideoRotation(degrees int)
+}
+
+// AudioOnlySetter はサーバーが映像を送らない場合に通知を受けるStreamWriter
+type AudioOnlySetter interface {
+	SetAudioOnly()
+}
+
+// VideoOnlySetter はサーバーが音声を送らない場合に通知を受けるStreamWriter
+type VideoOnlySetter interface {
+	SetVideoOnly()
+}
+
+// MultiAudioWriter は複数の音声トラックを書き込めるStreamWriter
+// 実装しないStreamWriterには最初の音声トラックのみをWriteAudioFrameで渡す
+type MultiAudioWriter interface {
+	// AddAudioTrack は音声トラックを追加し、WriteAudioTrackFrameに渡すインデックスを返す
+	AddAudioTrack() (int, error)
+
+	// WriteAudioTrackFrame はindex番目の音声トラックにフレームを書き込む
+	WriteAudioTrackFrame(index int, data []byte, timestamp uint32) error
+}
+
+// OutputRotator は出力先を切り替えられるライター（--output のSIGHUPによるローテーション用）
+type OutputRotator interface {
+	// Rotate は現在の出力を書き出して終え、以降をnewWriterに新しいファイルとして書き込む
+	// 呼び出し後も古い出力先は閉じないため、呼び出し側で閉じる
+	Rotate(newWriter io.Writer) error
+}
+
 // StreamMuxer は複数のトラックを処理する統合インターフェース
 type StreamMuxer interface {
 	// AddVideoTrack はビデオトラックを追加
@@ -0,0 +1,325 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/Azunyan1111/libvpx-go/vpx"
+)
+
+const (
+	ivfWidth     = 640
+	ivfHeight    = 360
+	ivfFrames    = 10
+	ivfRTPTSStep = 3000 // 90kHz / 30fps
+	rtpTSBase    = 4294960000
+	rtpTSBase2   = 1234567
+)
+
+// ivfHeader はIVFファイルヘッダーの内容
+type ivfHeader struct {
+	signature  string
+	version    uint16
+	headerSize uint16
+	fourcc     string
+	width      uint16
+	height     uint16
+	rate       uint32
+	scale      uint32
+	frameCount uint32
+}
+
+// ivfFrame はIVFのフレームヘッダーとデータ
+type ivfFrame struct {
+	pts  uint64
+	data []byte
+}
+
+// ivfReadIVF はIVFファイルのヘッダーとフレームを読む
+func ivfReadIVF(data []byte) (ivfHeader, []ivfFrame, error) {
+	if len(data) < 32 {
+		return ivfHeader{}, nil, fmt.Errorf("file too short: %d bytes", len(data))
+	}
+	header := ivfHeader{
+		signature:  string(data[0:4]),
+		version:    binary.LittleEndian.Uint16(data[4:6]),
+		headerSize: binary.LittleEndian.Uint16(data[6:8]),
+		fourcc:     string(data[8:12]),
+		width:      binary.LittleEndian.Uint16(data[12:14]),
+		height:     binary.LittleEndian.Uint16(data[14:16]),
+		rate:       binary.LittleEndian.Uint32(data[16:20]),
+		scale:      binary.LittleEndian.Uint32(data[20:24]),
+		frameCount: binary.LittleEndian.Uint32(data[24:28]),
+	}
+
+	var frames []ivfFrame
+	for pos := int(header.headerSize); pos < len(data); {
+		if pos+12 > len(data) {
+			return header, nil, fmt.Errorf("truncated frame header at offset %d", pos)
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos : pos+4]))
+		pts := binary.LittleEndian.Uint64(data[pos+4 : pos+12])
+		pos += 12
+		if pos+size > len(data) {
+			return header, nil, fmt.Errorf("truncated frame at offset %d", pos)
+		}
+		frames = append(frames, ivfFrame{pts: pts, data: data[pos : pos+size]})
+		pos += size
+	}
+	return header, frames, nil
+}
+
+// checkHeader はIVFヘッダーの各フィールドを検証する
+func checkHeader(got ivfHeader, fourcc string, frameCount uint32) error {
+	want := ivfHeader{
+		signature:  "DKIF",
+		version:    0,
+		headerSize: 32,
+		fourcc:     fourcc,
+		width:      ivfWidth,
+		height:     ivfHeight,
+		rate:       90000,
+		scale:      1,
+		frameCount: frameCount,
+	}
+	if got != want {
+		return fmt.Errorf("IVF header: got %+v, want %+v", got, want)
+	}
+	return nil
+}
+
+// ivfEncodeVP8 は実際のVP8エンコーダーでフレーム列を作る（先頭のみキーフレーム）
+func ivfEncodeVP8() ([][]byte, error) {
+	encoder, err := NewVP8Encoder(ivfWidth, ivfHeight, "YUV420P", 1000)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+
+	var out [][]byte
+	frame := make([]byte, ivfWidth*ivfHeight*3/2)
+	for i := 0; i < ivfFrames; i++ {
+		for j := range frame {
+			frame[j] = byte(j*7 + i*13)
+		}
+		encoded, _, err := encoder.Encode(frame)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		out = append(out, encoded)
+	}
+	return out, nil
+}
+
+// encodeVP9Keyframe はlibvpxのVP9エンコーダーでキーフレームを1枚作る
+func encodeVP9Keyframe() ([]byte, error) {
+	ctx := vpx.NewCodecCtx()
+	iface := vpx.EncoderIfaceVP9()
+	cfg := &vpx.CodecEncCfg{}
+	if err := vpx.Error(vpx.CodecEncConfigDefault(iface, cfg, 0)); err != nil {
+		return nil, err
+	}
+	cfg.Deref()
+	cfg.GW = ivfWidth
+	cfg.GH = ivfHeight
+	cfg.GTimebase = vpx.Rational{Num: 1, Den: 30}
+	cfg.RcTargetBitrate = 1000
+	cfg.GLagInFrames = 0
+	if err := vpx.Error(vpx.CodecEncInitVer(ctx, iface, cfg, 0, vpx.EncoderABIVersion)); err != nil {
+		return nil, err
+	}
+	defer vpx.CodecDestroy(ctx)
+
+	img := vpx.ImageAlloc(nil, vpx.ImageFormatI420, ivfWidth, ivfHeight, 1)
+	if img == nil {
+		return nil, fmt.Errorf("failed to allocate image")
+	}
+	defer vpx.ImageFree(img)
+
+	if err := vpx.Error(vpx.CodecEncode(ctx, img, 0, 1, 0, vpx.DlRealtime)); err != nil {
+		return nil, err
+	}
+	var iter vpx.CodecIter
+	for pkt := vpx.CodecGetCxData(ctx, &iter); pkt != nil; pkt = vpx.CodecGetCxData(ctx, &iter) {
+		pkt.Deref()
+		if pkt.Kind == vpx.CodecCxFramePkt && pkt.IsKeyframe() {
+			return pkt.GetFrameData(), nil
+		}
+	}
+	return nil, fmt.Errorf("VP9 encoder returned no keyframe")
+}
+
+// ivfWriteSession は1回の接続分のフレームをIVFWriterのセッションで書き込む
+func ivfWriteSession(writer *IVFWriter, codecType string, encoded [][]byte, tsBase uint32) error {
+	session := writer.Session()
+	session.SetVideoCodec(codecType)
+	runErr := make(chan error, 1)
+	go func() { runErr <- session.Run() }()
+
+	for i, frame := range encoded {
+		if err := session.WriteVideoFrame(frame, tsBase+uint32(i*ivfRTPTSStep), i == 0); err != nil {
+			return fmt.Errorf("frame %d: %v", i, err)
+		}
+		// 音声はIVFに含めない
+		if err := session.WriteAudioFrame([]byte{0xFC, 0x00}, tsBase); err != nil {
+			return err
+		}
+	}
+	if err := session.Close(); err != nil {
+		return err
+	}
+	return <-runErr
+}
+
+// TestIVFVP8File はシーク可能なファイルへの出力で、ヘッダーのフレーム数が書き戻されることを検証する
+// 再接続後のセッションは同じファイルに続けて書き込まれ、タイムスタンプが連続する
+func TestIVFVP8File(t *testing.T) {
+	encoded, err := ivfEncodeVP8()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.CreateTemp("", "test_ivf_*.ivf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	writer := NewIVFWriter(f)
+	// キーフレーム前のインターフレームは書き込まれない
+	if err := ivfWriteSession(writer, "vp8", append([][]byte{encoded[1]}, encoded...), rtpTSBase-ivfRTPTSStep); err != nil {
+		t.Fatal(err)
+	}
+	if err := ivfWriteSession(writer, "vp8", encoded, rtpTSBase2); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, got, err := ivfReadIVF(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHeader(header, "VP80", 2*ivfFrames); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2*ivfFrames {
+		t.Fatalf("got %d frames, want %d", len(got), 2*ivfFrames)
+	}
+	for i, frame := range got {
+		// 1回目はRTP timestampのラップを跨ぎ、2回目は前のセッションの最後のフレームの1フレーム後から続く
+		wantPTS := uint64(i * ivfRTPTSStep)
+		if frame.pts != wantPTS {
+			t.Fatalf("frame %d: pts=%d, want %d", i, frame.pts, wantPTS)
+		}
+		if !bytes.Equal(frame.data, encoded[i%ivfFrames]) {
+			t.Fatalf("frame %d: data mismatch", i)
+		}
+	}
+}
+
+// TestIVFVP8Pipe はシーク不可の出力ではフレーム数を0のままにし、フレームは書き込まれることを検証する
+func TestIVFVP8Pipe(t *testing.T) {
+	encoded, err := ivfEncodeVP8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ivfWriteSession(NewIVFWriter(&out), "vp8", encoded, rtpTSBase); err != nil {
+		t.Fatal(err)
+	}
+	header, got, err := ivfReadIVF(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHeader(header, "VP80", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != ivfFrames {
+		t.Fatalf("got %d frames, want %d", len(got), ivfFrames)
+	}
+}
+
+// TestIVFVP9 はVP9キーフレームのuncompressed headerから解像度を読み取ることを検証する
+func TestIVFVP9(t *testing.T) {
+	keyframe, err := encodeVP9Keyframe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := ivfWriteSession(NewIVFWriter(&out), "vp9", [][]byte{keyframe}, rtpTSBase); err != nil {
+		t.Fatal(err)
+	}
+	header, got, err := ivfReadIVF(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHeader(header, "VP90", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || !bytes.Equal(got[0].data, keyframe) {
+		t.Fatalf("VP9 keyframe was not written as-is")
+	}
+}
+
+// TestIVFCodecSwitch はヘッダー書き込み後に別のコーデックへ切り替わった間のフレームを書き込まず、
+// 元のコーデックに戻った後は書き込みを続けることを検証する（複数コーデックのanswerで送信側がPTを変えた場合）
+func TestIVFCodecSwitch(t *testing.T) {
+	encoded, err := ivfEncodeVP8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vp9Keyframe, err := encodeVP9Keyframe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	session := NewIVFWriter(&out).Session()
+	session.SetVideoCodec("vp8")
+	write := func(frame []byte, i int) error {
+		if err := session.WriteVideoFrame(frame, rtpTSBase+uint32(i*ivfRTPTSStep), false); err != nil {
+			return fmt.Errorf("frame %d: %v", i, err)
+		}
+		return nil
+	}
+	for i := 0; i < 3; i++ {
+		if err := write(encoded[i], i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	session.SetVideoCodec("vp9")
+	if err := write(vp9Keyframe, 3); err != nil {
+		t.Fatal(err)
+	}
+	session.SetVideoCodec("vp8")
+	for i := 3; i < ivfFrames; i++ {
+		if err := write(encoded[i], i+1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, got, err := ivfReadIVF(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkHeader(header, "VP80", 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != ivfFrames {
+		t.Fatalf("got %d frames, want the %d VP8 frames only", len(got), ivfFrames)
+	}
+	for i, frame := range got {
+		if !bytes.Equal(frame.data, encoded[i]) {
+			t.Fatalf("frame %d is not VP8 frame %d", i, i)
+		}
+	}
+}
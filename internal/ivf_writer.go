@@ -0,0 +1,399 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// IVFファイルの定数
+// タイムスタンプはRTPの90kHzクロックをそのまま使う
+const (
+	ivfHeaderSize      = 32
+	ivfFrameHeaderSize = 12
+	ivfTimebaseRate    = 90000
+	ivfTimebaseScale   = 1
+	// 再接続後のセッションは前のセッションの最後のフレームから1フレーム分（30fps）進めて始める
+	ivfSessionGap = ivfTimebaseRate / 30
+)
+
+// IVFWriter は受信したVP8/VP9のビットストリームをデコードせずにIVFとして書き込む
+// 再接続をまたいで1つのファイルになるよう、接続ごとにSessionでStreamWriterを作る
+// ヘッダーのフレーム数は出力がシーク可能な場合のみSession終了時に書き戻す
+type IVFWriter struct {
+	mutex         sync.Mutex
+	out           *outputWriter
+	bufWriter     *bufio.Writer
+	seeker        io.WriteSeeker // シーク不可の場合はnil
+	fourcc        string
+	codecType     string
+	headerWritten bool
+	headerOffset  int64
+	width         int
+	height        int
+	frameCount    uint32
+	lastPTS       uint64
+	flushInterval time.Duration
+	awaitKeyframe bool // ローテーション後、新しいファイルをキーフレームから始めるまでフレームを書き込まない
+	keyframesOnly bool // キーフレームのみを書き込む（--keyframes-only）
+}
+
+// NewIVFWriter は新しいIVFWriterを作成
+func NewIVFWriter(w io.Writer) *IVFWriter {
+	bufferSize := defaultOutputBufferSize
+	if OutputBufferSize > 0 {
+		bufferSize = OutputBufferSize
+	}
+	writer := &IVFWriter{
+		bufWriter:     bufio.NewWriterSize(nil, bufferSize),
+		flushInterval: time.Duration(max(FlushIntervalMs, 0)) * time.Millisecond,
+		keyframesOnly: KeyframesOnly,
+	}
+	writer.setOutput(w)
+	return writer
+}
+
+// setOutput は出力先を設定する
+func (w *IVFWriter) setOutput(output io.Writer) {
+	w.out = newOutputWriter(output)
+	w.bufWriter.Reset(w.out)
+	w.seeker = nil
+	w.headerOffset = 0
+	// パイプ等はSeekが失敗するため、ヘッダーの書き戻しは行わない
+	if seeker, ok := output.(io.WriteSeeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			w.seeker = seeker
+			w.headerOffset = offset
+		}
+	}
+}
+
+// Rotate は現在のIVFを書き出して（シーク可能ならフレーム数を書き戻して）終え、以降をnewWriterに新しいIVFとして書き込む
+// 圧縮されたビットストリームは途中から復号できないため、新しいファイルは次のキーフレームから始める
+// 呼び出し側はキーフレームを要求すること
+func (w *IVFWriter) Rotate(newWriter io.Writer) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.out.Err(); err != nil {
+		return err
+	}
+	if err := w.finish(); err != nil {
+		return err
+	}
+	w.setOutput(newWriter)
+	if w.headerWritten {
+		w.headerWritten = false
+		w.frameCount = 0
+		w.awaitKeyframe = true
+	}
+	return nil
+}
+
+// FrameCount は書き込んだフレーム数を返す
+func (w *IVFWriter) FrameCount() uint32 {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.frameCount
+}
+
+// Session は1回の接続分のStreamWriterを作る
+func (w *IVFWriter) Session() *IVFSession {
+	return &IVFSession{
+		ivf:  w,
+		done: make(chan struct{}),
+	}
+}
+
+// setCodec はコーデックを設定する。ヘッダー書き込み後の変更はIVFで表現できないためエラーとする
+func (w *IVFWriter) setCodec(codecType string) error {
+	fourcc, ok := ivfFourCC(codecType)
+	if !ok {
+		return fmt.Errorf("IVF output does not support codec %q", codecType)
+	}
+	if w.headerWritten && fourcc != w.fourcc {
+		return fmt.Errorf("IVF output cannot switch codec from %s to %s", w.codecType, codecType)
+	}
+	w.fourcc = fourcc
+	w.codecType = codecType
+	return nil
+}
+
+// ivfFourCC はコーデック名をIVFのFourCCに変換する
+func ivfFourCC(codecType string) (string, bool) {
+	switch codecType {
+	case "vp8":
+		return "VP80", true
+	case "vp9":
+		return "VP90", true
+	}
+	return "", false
+}
+
+// headerBytes はIVFファイルヘッダーを作る
+func (w *IVFWriter) headerBytes() []byte {
+	header := make([]byte, ivfHeaderSize)
+	copy(header[0:4], "DKIF")
+	binary.LittleEndian.PutUint16(header[4:6], 0) // version
+	binary.LittleEndian.PutUint16(header[6:8], ivfHeaderSize)
+	copy(header[8:12], w.fourcc)
+	binary.LittleEndian.PutUint16(header[12:14], uint16(w.width))
+	binary.LittleEndian.PutUint16(header[14:16], uint16(w.height))
+	binary.LittleEndian.PutUint32(header[16:20], ivfTimebaseRate)
+	binary.LittleEndian.PutUint32(header[20:24], ivfTimebaseScale)
+	binary.LittleEndian.PutUint32(header[24:28], w.frameCount)
+	return header
+}
+
+// writeFrame はフレームヘッダー（サイズ、タイムスタンプ）とフレームを書き込む
+func (w *IVFWriter) writeFrame(data []byte, pts uint64, keyframe bool) error {
+	if !w.headerWritten {
+		if _, err := w.bufWriter.Write(w.headerBytes()); err != nil {
+			return fmt.Errorf("failed to write IVF header: %w", err)
+		}
+		w.headerWritten = true
+		DebugLog("IVF: header written (%s %dx%d)\n", w.fourcc, w.width, w.height)
+	}
+
+	var frameHeader [ivfFrameHeaderSize]byte
+	binary.LittleEndian.PutUint32(frameHeader[0:4], uint32(len(data)))
+	binary.LittleEndian.PutUint64(frameHeader[4:12], pts)
+	if _, err := w.bufWriter.Write(frameHeader[:]); err != nil {
+		return fmt.Errorf("failed to write IVF frame header: %w", err)
+	}
+	if _, err := w.bufWriter.Write(data); err != nil {
+		return fmt.Errorf("failed to write IVF frame: %w", err)
+	}
+	w.frameCount++
+	w.lastPTS = pts
+
+	// キーフレームはプレイヤーが途中から再生を開始できるよう即座に出力する
+	if keyframe || w.flushInterval == 0 {
+		return w.bufWriter.Flush()
+	}
+	return nil
+}
+
+// finish はバッファを出力し、シーク可能な出力ではヘッダーのフレーム数を書き戻す
+func (w *IVFWriter) finish() error {
+	if !w.headerWritten || w.out.Err() != nil {
+		return nil
+	}
+	if err := w.bufWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush IVF output: %w", err)
+	}
+	if w.seeker == nil {
+		return nil
+	}
+
+	end, err := w.seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return fmt.Errorf("failed to patch IVF header: %w", err)
+	}
+	if _, err := w.seeker.Seek(w.headerOffset, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to patch IVF header: %w", err)
+	}
+	if _, err := w.seeker.Write(w.headerBytes()); err != nil {
+		return fmt.Errorf("failed to patch IVF header: %w", err)
+	}
+	if _, err := w.seeker.Seek(end, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to patch IVF header: %w", err)
+	}
+	return nil
+}
+
+// IVFSession は1回の接続分のIVF書き込みを行うStreamWriter
+// タイムスタンプは接続ごとに最初のフレームを基準とし、前のセッションの続きから始める
+type IVFSession struct {
+	ivf          *IVFWriter
+	unwrapper    rtpTimestampUnwrapper
+	base         uint64
+	seenKeyframe bool
+	codecErr     error // ファイルと異なるコーデックに切り替わった場合のエラー（その間の映像は書き込まない）
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// SetVideoCodec は映像トラックのコーデックを設定する
+// ヘッダー書き込み後にファイルと異なるコーデックへ切り替わった場合（複数コーデックのanswerや再接続）、
+// 別のコーデックのフレームを混ぜないよう、元のコーデックに戻るまで映像を書き込まない
+func (s *IVFSession) SetVideoCodec(codecType string) {
+	s.ivf.mutex.Lock()
+	defer s.ivf.mutex.Unlock()
+	s.codecErr = s.ivf.setCodec(codecType)
+	if s.codecErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v; video is not written until the stream returns to %s\n", s.codecErr, s.ivf.codecType)
+	}
+}
+
+// WriteVideoFrame はVP8/VP9フレームをIVFに書き込む
+// 最初のキーフレームまでのフレームはデコードできないため書き込まない
+func (s *IVFSession) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	w := s.ivf
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.fourcc == "" {
+		return fmt.Errorf("%w: IVF output: video codec is not set", ErrFrameDropped)
+	}
+	if s.codecErr != nil {
+		// 再接続しても同じコーデックになるため、キーフレーム待ちと同じく書き込まずに捨てる
+		DebugLogPeriodic("ivf.codec", time.Second, "IVF: dropping video frame: %v\n", s.codecErr)
+		return nil
+	}
+	if len(data) == 0 {
+		return nil
+	}
+
+	width, height, isKey := ivfKeyframeSize(w.codecType, data)
+	if !s.seenKeyframe {
+		if !isKey {
+			DebugLog("IVF: waiting for keyframe\n")
+			return nil
+		}
+		s.seenKeyframe = true
+		if !w.headerWritten {
+			w.width = width
+			w.height = height
+		} else {
+			s.base = w.lastPTS + ivfSessionGap
+		}
+	}
+
+	pts := s.base + s.unwrapper.Extend(timestamp)
+	if w.awaitKeyframe {
+		if !isKey {
+			DebugLog("IVF: waiting for keyframe after output rotation\n")
+			return nil
+		}
+		w.awaitKeyframe = false
+		w.width = width
+		w.height = height
+	}
+	if w.keyframesOnly && !isKey {
+		return nil
+	}
+	return w.writeFrame(data, pts, isKey)
+}
+
+// WriteAudioFrame はIVFが映像のみのため音声を破棄する
+func (s *IVFSession) WriteAudioFrame(data []byte, timestamp uint32) error {
+	return nil
+}
+
+// Run はCloseまで待機し、flush-intervalごとにバッファを出力する
+func (s *IVFSession) Run() error {
+	var tick <-chan time.Time
+	if s.ivf.flushInterval > 0 {
+		ticker := time.NewTicker(s.ivf.flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case <-tick:
+			s.ivf.mutex.Lock()
+			var err error
+			if s.ivf.out.Err() == nil && s.ivf.bufWriter.Buffered() > 0 {
+				err = s.ivf.bufWriter.Flush()
+			}
+			s.ivf.mutex.Unlock()
+			if err != nil && !errors.Is(err, ErrOutputClosed) {
+				return fmt.Errorf("failed to flush IVF output: %w", err)
+			}
+		}
+	}
+}
+
+// Close はセッションを終了し、バッファの出力とヘッダーの書き戻しを行う
+func (s *IVFSession) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.ivf.mutex.Lock()
+	defer s.ivf.mutex.Unlock()
+	return s.ivf.finish()
+}
+
+// ivfKeyframeSize はフレームがキーフレームであれば、ビットストリームから解像度を読み取って返す
+func ivfKeyframeSize(codecType string, data []byte) (int, int, bool) {
+	switch codecType {
+	case "vp8":
+		// frame tag（3バイト）、sync code（3バイト）の後に14bitの幅・高さが続く
+		if !IsVP8Keyframe(data) || len(data) < 10 || data[3] != 0x9d || data[4] != 0x01 || data[5] != 0x2a {
+			return 0, 0, false
+		}
+		width := int(binary.LittleEndian.Uint16(data[6:8]) & 0x3FFF)
+		height := int(binary.LittleEndian.Uint16(data[8:10]) & 0x3FFF)
+		return width, height, true
+	case "vp9":
+		return vp9KeyframeSize(data)
+	}
+	return 0, 0, false
+}
+
+// vp9KeyframeSize はVP9のuncompressed headerを読み、キーフレームであれば解像度を返す
+func vp9KeyframeSize(data []byte) (int, int, bool) {
+	r := bitReader{data: data}
+	if r.read(2) != 2 { // frame_marker
+		return 0, 0, false
+	}
+	profile := r.read(1) | r.read(1)<<1
+	if profile == 3 {
+		r.read(1) // reserved_zero
+	}
+	if r.read(1) == 1 { // show_existing_frame
+		return 0, 0, false
+	}
+	if r.read(1) != 0 { // frame_type: 0 = KEY_FRAME
+		return 0, 0, false
+	}
+	r.read(2) // show_frame, error_resilient_mode
+	if r.read(24) != 0x498342 {
+		return 0, 0, false
+	}
+	// color_config
+	if profile >= 2 {
+		r.read(1) // ten_or_twelve_bit
+	}
+	if r.read(3) != 7 { // color_space != CS_RGB
+		r.read(1) // color_range
+		if profile == 1 || profile == 3 {
+			r.read(3) // subsampling_x, subsampling_y, reserved_zero
+		}
+	} else if profile == 1 || profile == 3 {
+		r.read(1) // reserved_zero
+	}
+	width := int(r.read(16)) + 1
+	height := int(r.read(16)) + 1
+	if r.overrun {
+		return 0, 0, false
+	}
+	return width, height, true
+}
+
+// bitReader はMSBから順にビットを読む
+type bitReader struct {
+	data    []byte
+	pos     int
+	overrun bool
+}
+
+func (r *bitReader) read(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if r.pos >= len(r.data)*8 {
+			r.overrun = true
+			return 0
+		}
+		bit := (r.data[r.pos/8] >> (7 - r.pos%8)) & 1
+		v = v<<1 | uint32(bit)
+		r.pos++
+	}
+	return v
+}
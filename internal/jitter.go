@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"sync"
+	"time"
+)
+
+// JitterEstimator はRFC 3550（6.4.1, A.8）の到着間隔ジッターを受信側で計算する
+// RTPタイムスタンプの間隔と到着時刻の間隔の差を1/16の重みで平滑化する
+type JitterEstimator struct {
+	mu            sync.Mutex
+	clockRate     uint32
+	started       bool
+	lastTimestamp uint32
+	lastArrival   time.Time
+	jitter        float64 // RTPタイムスタンプ単位
+	packets       int64
+}
+
+// NewJitterEstimator はclockRate（Hz）のトラック用のJitterEstimatorを作成する
+func NewJitterEstimator(clockRate uint32) *JitterEstimator {
+	return &JitterEstimator{clockRate: clockRate}
+}
+
+// Update はRTPタイムスタンプtimestampのパケットがarrivalに到着したことを記録する
+func (j *JitterEstimator) Update(timestamp uint32, arrival time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.packets++
+	if j.clockRate == 0 {
+		return
+	}
+	if !j.started {
+		j.started = true
+		j.lastTimestamp = timestamp
+		j.lastArrival = arrival
+		return
+	}
+	// D(i,j) = (Rj - Ri) - (Sj - Si)（RTPタイムスタンプはラップアラウンドを考慮して差を取る）
+	arrivalDelta := float64(arrival.Sub(j.lastArrival)) * float64(j.clockRate) / float64(time.Second)
+	timestampDelta := float64(int32(timestamp - j.lastTimestamp))
+	d := arrivalDelta - timestampDelta
+	if d < 0 {
+		d = -d
+	}
+	j.jitter += (d - j.jitter) / 16
+	j.lastTimestamp = timestamp
+	j.lastArrival = arrival
+}
+
+// Jitter は現在のジッターを返す
+func (j *JitterEstimator) Jitter() time.Duration {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.clockRate == 0 {
+		return 0
+	}
+	return time.Duration(j.jitter * float64(time.Second) / float64(j.clockRate))
+}
+
+// Packets はUpdateを呼んだパケット数を返す
+func (j *JitterEstimator) Packets() int64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.packets
+}
+
+// TrackJitter は受信中の1トラックのジッターと、abs-capture-timeによるend-to-end遅延
+type TrackJitter struct {
+	Kind    string // "video" または "audio"
+	Index   int    // 音声トラックのインデックス（映像は0）
+	SSRC    uint32
+	Jitter  time.Duration
+	Packets int64
+
+	Latency        time.Duration // LatencySamplesが0の場合は未計測
+	LatencySamples int64
+}
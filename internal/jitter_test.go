@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	jitterAudioStep  = 20 * time.Millisecond // Opusのフレーム長
+	jitterAudioTicks = 960                   // 20ms（48kHz）
+)
+
+// feed は48kHzのn個のパケットを、i番目をi*20ms+delay(i)に到着させてJitterEstimatorに渡す
+func feed(firstTimestamp uint32, n int, delay func(i int) time.Duration) *JitterEstimator {
+	estimator := NewJitterEstimator(48000)
+	start := time.Unix(0, 0)
+	for i := 0; i < n; i++ {
+		arrival := start.Add(time.Duration(i)*jitterAudioStep + delay(i))
+		estimator.Update(firstTimestamp+uint32(i*jitterAudioTicks), arrival)
+	}
+	return estimator
+}
+
+// jitterNear はgotがwantから0.01ms以内かを返す
+func jitterNear(got, want time.Duration) bool {
+	return math.Abs(float64(got-want)) <= float64(10*time.Microsecond)
+}
+
+// TestJitterSteady はRTPタイムスタンプどおりの間隔で到着するパケットのジッターが0であることを検証する
+func TestJitterSteady(t *testing.T) {
+	estimator := feed(0, 100, func(int) time.Duration { return 0 })
+	if got := estimator.Jitter(); got != 0 {
+		t.Fatalf("jitter %v, want 0", got)
+	}
+	if got := estimator.Packets(); got != 100 {
+		t.Fatalf("%d packets counted, want 100", got)
+	}
+}
+
+// TestJitterSingleDelay は1パケットだけ16ms遅れた場合に、RFC 3550の式どおり16ms/16=1msになることを検証する
+func TestJitterSingleDelay(t *testing.T) {
+	estimator := feed(0, 2, func(i int) time.Duration { return time.Duration(i) * 16 * time.Millisecond })
+	if got := estimator.Jitter(); !jitterNear(got, time.Millisecond) {
+		t.Fatalf("jitter %v, want 1ms", got)
+	}
+}
+
+// TestJitterAlternating は1パケットおきに10ms遅れて到着する場合に、ジッターが10msに収束することを検証する
+// 到着間隔は30ms/10msの繰り返しで、|D|は毎回10msになる
+func TestJitterAlternating(t *testing.T) {
+	estimator := feed(0, 500, func(i int) time.Duration { return time.Duration(i%2) * 10 * time.Millisecond })
+	if got := estimator.Jitter(); !jitterNear(got, 10*time.Millisecond) {
+		t.Fatalf("jitter %v, want 10ms", got)
+	}
+}
+
+// TestJitterWraparound はRTPタイムスタンプのラップアラウンドをまたいでもジッターが増えないことを検証する
+func TestJitterWraparound(t *testing.T) {
+	estimator := feed(math.MaxUint32-10*jitterAudioTicks, 20, func(int) time.Duration { return 0 })
+	if got := estimator.Jitter(); got != 0 {
+		t.Fatalf("jitter %v across RTP timestamp wraparound, want 0", got)
+	}
+}
+
+// TestJitterSameTimestamp は同じタイムスタンプの複数パケット（映像の1フレーム）が同時に届いてもジッターが増えないことを検証する
+func TestJitterSameTimestamp(t *testing.T) {
+	estimator := NewJitterEstimator(90000)
+	start := time.Unix(0, 0)
+	for frame := 0; frame < 25; frame++ {
+		arrival := start.Add(time.Duration(frame) * 40 * time.Millisecond)
+		for packet := 0; packet < 3; packet++ {
+			estimator.Update(uint32(frame*3600), arrival)
+		}
+	}
+	if got := estimator.Jitter(); got != 0 {
+		t.Fatalf("jitter %v, want 0", got)
+	}
+}
+
+// TestJitterLoopback はStreamManagerが受信した音声トラックのジッターを、inbound-rtp統計と同じSSRCで報告することを検証する
+func TestJitterLoopback(t *testing.T) {
+	mediaReceived := make(chan struct{}, 1)
+	streamManager := NewStreamManager(&discardWriter{}, NewDefaultRTPProcessor(), 0, mediaReceived)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(receiver, sender); err != nil {
+		t.Fatal(err)
+	}
+
+	go streamManager.Run()
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	defer func() {
+		receiver.Close()
+		streamManager.Stop()
+	}()
+
+	// SRTPの準備完了前のパケットは破棄されるため、十分な数を受信するまで送り続ける
+	var jitter []TrackJitter
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; time.Now().Before(deadline); i++ {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * jitterAudioTicks)},
+			Payload: opusSilence,
+		}
+		if err := track.WriteRTP(packet); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(jitterAudioStep)
+		jitter = streamManager.Jitter()
+		if len(jitter) == 1 && jitter[0].Packets >= 25 {
+			break
+		}
+	}
+	if len(jitter) != 1 || jitter[0].Kind != "audio" || jitter[0].Packets < 25 {
+		t.Fatalf("StreamManager reported %+v, want one audio track with at least 25 packets", jitter)
+	}
+	// ループバックでも送信側のsleepの揺らぎがあるため、上限のみ確認する
+	if jitter[0].Jitter > jitterAudioStep {
+		t.Fatalf("local jitter %v on loopback, want <= %v", jitter[0].Jitter, jitterAudioStep)
+	}
+	for _, report := range receiver.GetStats() {
+		if inbound, ok := report.(webrtc.InboundRTPStreamStats); ok && uint32(inbound.SSRC) == jitter[0].SSRC {
+			return
+		}
+	}
+	t.Fatalf("no inbound-rtp stats for SSRC %x", jitter[0].SSRC)
+}
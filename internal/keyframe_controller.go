@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const defaultKeyframeMaxInterval = 8 * time.Second
+
+// KeyframeController はキーフレーム要求（PLI）を集約して送信頻度を制限する
+// 複数の経路（起動時の待機、フレーム欠落、デコードエラー）から要求されても
+// minInterval以内の要求はまとめ、キーフレームが届かない間は間隔を指数的に延ばす
+type KeyframeController struct {
+	mu              sync.Mutex
+	clock           Clock
+	writeRTCP       func([]rtcp.Packet) error
+	mediaSSRC       uint32
+	minInterval     time.Duration
+	maxInterval     time.Duration
+	currentInterval time.Duration // 現在の最小送信間隔（バックオフで増加）
+	lastRequest     time.Time     // 最後にPLIを送信した時刻
+	awaiting        bool          // PLI送信後キーフレーム未受信
+	sentCount       int64         // 送信したPLI数
+	suppressedCount int64         // 間引いた要求数
+}
+
+// NewKeyframeController は新しいKeyframeControllerを作成する
+// minInterval <= 0 の場合は間引きを行わない
+func NewKeyframeController(minInterval time.Duration) *KeyframeController {
+	maxInterval := defaultKeyframeMaxInterval
+	if minInterval > maxInterval {
+		maxInterval = minInterval
+	}
+	return &KeyframeController{
+		clock:           SystemClock{},
+		minInterval:     minInterval,
+		maxInterval:     maxInterval,
+		currentInterval: minInterval,
+	}
+}
+
+// SetClock は送信間隔の判定に使う時刻の取得元を差し替える（検証用）
+func (c *KeyframeController) SetClock(clock Clock) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.clock = clock
+}
+
+// Attach はPLIの送信先を設定する（映像トラック受信時に呼び出す）
+func (c *KeyframeController) Attach(writeRTCP func([]rtcp.Packet) error, mediaSSRC uint32) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeRTCP = writeRTCP
+	c.mediaSSRC = mediaSSRC
+}
+
+// Request はキーフレームを要求する。実際にPLIを送信した場合trueを返す
+func (c *KeyframeController) Request(reason string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.writeRTCP == nil {
+		return false
+	}
+
+	now := c.clock.Now()
+	if !c.lastRequest.IsZero() && now.Sub(c.lastRequest) < c.currentInterval {
+		c.suppressedCount++
+		return false
+	}
+
+	// 前回の要求後にキーフレームが届いていなければ間隔を倍にする
+	if c.awaiting && c.currentInterval > 0 {
+		c.currentInterval *= 2
+		if c.currentInterval > c.maxInterval {
+			c.currentInterval = c.maxInterval
+		}
+	}
+
+	if err := c.writeRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: c.mediaSSRC}}); err != nil {
+		DebugLog("Failed to send PLI (%s): %v\n", reason, err)
+		return false
+	}
+	c.lastRequest = now
+	c.awaiting = true
+	c.sentCount++
+	DebugLog("PLI sent (%s): next interval=%v, sent=%d, suppressed=%d\n",
+		reason, c.currentInterval, c.sentCount, c.suppressedCount)
+	return true
+}
+
+// RequestBurst は送信間隔の制限を無視してcount個のPLIを続けて送信し、送信できた数を返す
+// パケットロスでPLIが届かない可能性があるため、最後の手段として複数回送る
+func (c *KeyframeController) RequestBurst(reason string, count int) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.writeRTCP == nil {
+		return 0
+	}
+
+	sent := 0
+	for i := 0; i < count; i++ {
+		if err := c.writeRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: c.mediaSSRC}}); err != nil {
+			DebugLog("Failed to send PLI (%s): %v\n", reason, err)
+			break
+		}
+		sent++
+	}
+	if sent > 0 {
+		c.lastRequest = c.clock.Now()
+		c.awaiting = true
+		c.sentCount += int64(sent)
+	}
+	DebugLog("PLI burst sent (%s): %d/%d\n", reason, sent, count)
+	return sent
+}
+
+// OnKeyframe はキーフレーム受信時に呼び出し、バックオフをリセットする
+func (c *KeyframeController) OnKeyframe() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.awaiting = false
+	c.currentInterval = c.minInterval
+}
@@ -0,0 +1,125 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const keyframeControllerSSRC = 0x1234
+
+// keyframeControllerNew はmanualClockで動くKeyframeControllerと、送信したPLIの記録を返す
+func keyframeControllerNew(minInterval time.Duration) (*KeyframeController, *manualClock, *[]rtcp.Packet) {
+	clock := newManualClock(time.Unix(0, 0))
+	var sent []rtcp.Packet
+	c := NewKeyframeController(minInterval)
+	c.SetClock(clock)
+	c.Attach(func(packets []rtcp.Packet) error {
+		sent = append(sent, packets...)
+		return nil
+	}, keyframeControllerSSRC)
+	return c, clock, &sent
+}
+
+// TestKeyframeControllerRateLimit はminInterval以内の要求を間引き、キーフレームが届かない間は間隔を倍にして
+// maxIntervalで止め、キーフレームの受信で元の間隔に戻すことを検証する
+func TestKeyframeControllerRateLimit(t *testing.T) {
+	c, clock, sent := keyframeControllerNew(time.Second)
+
+	if !c.Request("first") {
+		t.Fatal("first request was suppressed")
+	}
+	clock.Advance(999 * time.Millisecond)
+	if c.Request("within interval") {
+		t.Fatal("request 999ms after the first PLI was sent")
+	}
+	clock.Advance(time.Millisecond)
+	if !c.Request("after interval") {
+		t.Fatal("request 1s after the first PLI was suppressed")
+	}
+	if c.sentCount != 2 || c.suppressedCount != 1 {
+		t.Fatalf("sent %d, suppressed %d, want 2 and 1", c.sentCount, c.suppressedCount)
+	}
+
+	// キーフレームが届かないため間隔は2秒になっている
+	clock.Advance(1500 * time.Millisecond)
+	if c.Request("backoff") {
+		t.Fatal("request 1.5s later was sent while backing off to 2s")
+	}
+	clock.Advance(500 * time.Millisecond)
+	if !c.Request("backoff elapsed") {
+		t.Fatal("request 2s later was suppressed")
+	}
+
+	// 倍にし続けてもmaxIntervalを超えない
+	for i := 0; i < 5; i++ {
+		clock.Advance(defaultKeyframeMaxInterval)
+		if !c.Request("max interval") {
+			t.Fatalf("request %d after %v was suppressed", i, defaultKeyframeMaxInterval)
+		}
+	}
+	if c.currentInterval != defaultKeyframeMaxInterval {
+		t.Fatalf("interval %v, want capped at %v", c.currentInterval, defaultKeyframeMaxInterval)
+	}
+
+	c.OnKeyframe()
+	clock.Advance(time.Second)
+	if !c.Request("after keyframe") {
+		t.Fatal("request 1s after a keyframe was suppressed")
+	}
+	for _, packet := range *sent {
+		if pli, ok := packet.(*rtcp.PictureLossIndication); !ok || pli.MediaSSRC != keyframeControllerSSRC {
+			t.Fatalf("sent %v, want PLI for SSRC %d", packet, keyframeControllerSSRC)
+		}
+	}
+}
+
+// TestKeyframeControllerBurst はRequestBurstが間隔の制限を無視して送り、その時刻から次の間隔を数えることを検証する
+func TestKeyframeControllerBurst(t *testing.T) {
+	c, clock, sent := keyframeControllerNew(time.Second)
+
+	c.Request("first")
+	clock.Advance(100 * time.Millisecond)
+	if n := c.RequestBurst("burst", 3); n != 3 {
+		t.Fatalf("burst sent %d PLIs, want 3", n)
+	}
+	if len(*sent) != 4 {
+		t.Fatalf("%d PLIs sent, want 4", len(*sent))
+	}
+	// 次の要求はバーストから1秒間は送らない
+	clock.Advance(950 * time.Millisecond)
+	if c.Request("after burst") {
+		t.Fatal("request 950ms after the burst was sent")
+	}
+	clock.Advance(time.Second)
+	if !c.Request("after burst interval") {
+		t.Fatal("request 1.95s after the burst was suppressed")
+	}
+
+	// 送信に失敗した時点で止める
+	failAfter := 1
+	c.Attach(func(packets []rtcp.Packet) error {
+		if failAfter == 0 {
+			return errors.New("closed")
+		}
+		failAfter--
+		return nil
+	}, keyframeControllerSSRC)
+	if n := c.RequestBurst("failing", 3); n != 1 {
+		t.Fatalf("burst sent %d PLIs before the write error, want 1", n)
+	}
+}
+
+// TestKeyframeControllerDetached は送信先が無い間は要求を送らず、間隔も数え始めないことを検証する
+func TestKeyframeControllerDetached(t *testing.T) {
+	c := NewKeyframeController(time.Second)
+	c.SetClock(newManualClock(time.Unix(0, 0)))
+	if c.Request("detached") || c.RequestBurst("detached", 3) != 0 {
+		t.Fatal("PLI sent without a destination")
+	}
+	if !c.lastRequest.IsZero() {
+		t.Fatalf("last request recorded at %v without a destination", c.lastRequest)
+	}
+}
@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"testing"
+)
+
+const (
+	keyframesOnlyWidth     = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	keyframesOnlyHeight    = 360
+	keyframesOnlyFrames    = 60
+	keyframeEvery          = 15
+	keyframesOnlyRTPTSStep = 3000 // 90kHz / 30fps
+)
+
+// keyframesOnlyEncodedFrame はエンコードしたフレームとキーフレームかどうか
+type keyframesOnlyEncodedFrame struct {
+	data     []byte
+	keyframe bool
+}
+
+// keyframesOnlyEncodeFrames はkeyframeEveryフレームごとにキーフレームを強制してframesフレームをVP8でエンコードする
+func keyframesOnlyEncodeFrames() ([]keyframesOnlyEncodedFrame, error) {
+	encoder, err := NewVP8Encoder(keyframesOnlyWidth, keyframesOnlyHeight, "YUV420P", 500)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+
+	var result []keyframesOnlyEncodedFrame
+	yuv := make([]byte, keyframesOnlyWidth*keyframesOnlyHeight*3/2)
+	for i := 0; i < keyframesOnlyFrames; i++ {
+		if i%keyframeEvery == 0 {
+			encoder.ForceKeyframe()
+		}
+		// 輝度だけを変える灰色の画像（色差は0x80）
+		for j := range yuv {
+			yuv[j] = 0x80
+		}
+		for j := range keyframesOnlyWidth * keyframesOnlyHeight {
+			yuv[j] = byte(0x40 + i)
+		}
+		data, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, keyframesOnlyEncodedFrame{data: data, keyframe: keyframe})
+	}
+	return result, nil
+}
+
+// videoBlock はSimpleBlockのtimecode（ms、クラスタのtimecodeを加えた値）とキーフレームフラグ
+type videoBlock struct {
+	timecode int64
+	keyframe bool
+}
+
+// videoBlocks はSimpleBlockを出力順に返す（映像のみのMKV）
+func videoBlocks(data []byte) ([]videoBlock, error) {
+	var blocks []videoBlock
+	var clusterTime int64
+	for len(data) > 0 {
+		id, n := readVint(data, true)
+		size, m := readVint(data[n:], false)
+		if n == 0 || m == 0 {
+			return nil, fmt.Errorf("malformed element header")
+		}
+		data = data[n+m:]
+		if id == idSegment || id == idCluster {
+			continue
+		}
+		if uint64(len(data)) < size {
+			return nil, fmt.Errorf("element 0x%X truncated", id)
+		}
+		value := data[:size]
+		data = data[size:]
+		switch id {
+		case idTimecode:
+			clusterTime = 0
+			for _, b := range value {
+				clusterTime = clusterTime<<8 | int64(b)
+			}
+		case idSimpleBlock:
+			_, k := readVint(value, false)
+			if k == 0 || len(value) < k+3 {
+				return nil, fmt.Errorf("malformed SimpleBlock")
+			}
+			blocks = append(blocks, videoBlock{
+				timecode: clusterTime + int64(int16(binary.BigEndian.Uint16(value[k:]))),
+				keyframe: value[k+2]&0x80 != 0,
+			})
+		}
+	}
+	return blocks, nil
+}
+
+// keyframesOnlyWriteMKV は --keyframes-only の映像のみのMKVにframesを書き込み、出力と検証統計を返す
+// corruptは書き込む前にフレームのデータを差し替える（nilで差し替えない）
+func keyframesOnlyWriteMKV(encoded []keyframesOnlyEncodedFrame, corrupt func(i int, data []byte) []byte) ([]byte, ValidationStats, error) {
+	KeyframesOnly = true
+	defer func() { KeyframesOnly = false }()
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	writer.SetVideoOnly()
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+	for i, frame := range encoded {
+		data := frame.data
+		if corrupt != nil {
+			data = corrupt(i, data)
+		}
+		if err := writer.WriteVideoFrame(data, uint32(i*keyframesOnlyRTPTSStep), frame.keyframe); err != nil {
+			return nil, ValidationStats{}, fmt.Errorf("frame %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, ValidationStats{}, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, ValidationStats{}, err
+	}
+	return out.Bytes(), writer.GetValidationStats(), nil
+}
+
+// keyframesOnlyKeyframeIndexes はencodedのキーフレームのインデックスを返す
+func keyframesOnlyKeyframeIndexes(encoded []keyframesOnlyEncodedFrame) []int {
+	var indexes []int
+	for i, frame := range encoded {
+		if frame.keyframe {
+			indexes = append(indexes, i)
+		}
+	}
+	return indexes
+}
+
+// TestKeyframesOnlyMKV はキーフレームだけが、それぞれのRTP timestampに対応するtimecodeで書き込まれることを検証する
+func TestKeyframesOnlyMKV(t *testing.T) {
+	encoded, err := keyframesOnlyEncodeFrames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyframes := keyframesOnlyKeyframeIndexes(encoded)
+	if len(keyframes) < keyframesOnlyFrames/keyframeEvery {
+		t.Fatalf("encoder produced keyframes at %v, want one every %d frames", keyframes, keyframeEvery)
+	}
+
+	data, stats, err := keyframesOnlyWriteMKV(encoded, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := videoBlocks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != len(keyframes) {
+		t.Fatalf("%d video blocks written, want %d keyframes", len(blocks), len(keyframes))
+	}
+	for i, block := range blocks {
+		if !block.keyframe {
+			t.Fatalf("block %d at %dms is not a keyframe", i, block.timecode)
+		}
+		// 30fpsのRTP timestampから求めたtimecode（1フレーム33.3ms）
+		if want := int64(keyframes[i]) * keyframesOnlyRTPTSStep / 90; block.timecode != want {
+			t.Fatalf("block %d at %dms, want %dms (frame %d)", i, block.timecode, want, keyframes[i])
+		}
+	}
+	if stats.InterFrames != keyframesOnlyFrames-len(keyframes) {
+		t.Fatalf("%d inter-frames dropped, want %d", stats.InterFrames, keyframesOnlyFrames-len(keyframes))
+	}
+	t.Logf("%d keyframes written at frames %v, %d inter-frames dropped", len(blocks), keyframes, stats.InterFrames)
+}
+
+// TestKeyframesOnlyNoRepeatedFrames はキーフレームのデコードに失敗しても、最後の正常フレームを差分フレームとして繰り返さないことを検証する
+func TestKeyframesOnlyNoRepeatedFrames(t *testing.T) {
+	encoded, err := keyframesOnlyEncodeFrames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyframes := keyframesOnlyKeyframeIndexes(encoded)
+	broken := keyframes[1]
+	data, stats, err := keyframesOnlyWriteMKV(encoded, func(i int, data []byte) []byte {
+		if i != broken {
+			return data
+		}
+		// キーフレームのヘッダーを持つが、デコードできないフレーム
+		corrupted := slices.Clone(data[:min(len(data), 64)])
+		copy(corrupted, []byte{0xF1, 0xFF, 0x0F, 0x9D, 0x01, 0x2A})
+		for j := 10; j < len(corrupted); j++ {
+			corrupted[j] = 0xFF
+		}
+		return corrupted
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks, err := videoBlocks(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, block := range blocks {
+		if !block.keyframe {
+			t.Fatalf("block %d at %dms is not a keyframe", i, block.timecode)
+		}
+	}
+	if stats.DecodeErrors+stats.InvalidFrames == 0 {
+		t.Fatalf("the broken keyframe was decoded")
+	}
+	if stats.RepeatedFrames != 0 {
+		t.Fatalf("%d frames repeated, want none", stats.RepeatedFrames)
+	}
+	if len(blocks) != len(keyframes)-1 {
+		t.Fatalf("%d video blocks written, want %d (all keyframes but the broken one)", len(blocks), len(keyframes)-1)
+	}
+}
+
+// TestKeyframesOnlyIVF はIVF出力でもキーフレームだけを、RTP timestampのPTSで書き込むことを検証する
+func TestKeyframesOnlyIVF(t *testing.T) {
+	encoded, err := keyframesOnlyEncodeFrames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyframes := keyframesOnlyKeyframeIndexes(encoded)
+
+	KeyframesOnly = true
+	defer func() { KeyframesOnly = false }()
+	var out bytes.Buffer
+	session := NewIVFWriter(&out).Session()
+	session.SetVideoCodec("vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- session.Run() }()
+	for i, frame := range encoded {
+		if err := session.WriteVideoFrame(frame.data, uint32(i*keyframesOnlyRTPTSStep), frame.keyframe); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+
+	// IVFのフレームヘッダー（サイズ4バイト、PTS 8バイト）を順に読む
+	data := out.Bytes()
+	var pts []uint64
+	for pos := 32; pos+12 <= len(data); {
+		size := int(binary.LittleEndian.Uint32(data[pos : pos+4]))
+		pts = append(pts, binary.LittleEndian.Uint64(data[pos+4:pos+12]))
+		pos += 12 + size
+	}
+	var want []uint64
+	for _, i := range keyframes {
+		want = append(want, uint64(i*keyframesOnlyRTPTSStep))
+	}
+	if !slices.Equal(pts, want) {
+		t.Fatalf("IVF frames at PTS %v, want the keyframes at %v", pts, want)
+	}
+}
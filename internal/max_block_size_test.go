@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+)
+
+const limit = 1 << 20 // テストで指定する --max-block-size
+
+// maxBlockSizeElement はEBML要素（ID、サイズ、データ）を作る
+func maxBlockSizeElement(id uint32, children ...[]byte) []byte {
+	data := bytes.Join(children, nil)
+	return append(elementHeader(id, int64(len(data))), data...)
+}
+
+// elementHeader はサイズがsizeの要素のヘッダー（ID、8バイトのサイズ）を作る
+func elementHeader(id uint32, size int64) []byte {
+	out := idBytes(id)
+	out = append(out, 0x08, 0, 0, 0, 0, 0, 0, 0)
+	binary.BigEndian.PutUint64(out[len(out)-8:], uint64(size))
+	out[len(out)-8] = 0x01
+	return out
+}
+
+// head はEBMLヘッダーからサイズ不定のClusterの開始までを作る（映像トラック1）
+func head() []byte {
+	return bytes.Join([][]byte{
+		maxBlockSizeElement(0x1A45DFA3, maxBlockSizeElement(0x4282, []byte("matroska"))),
+		append(idBytes(0x18538067), unknownSize...),
+		maxBlockSizeElement(0x1549A966, maxBlockSizeElement(0x2AD7B1, uintData(1000000))),
+		maxBlockSizeElement(0x1654AE6B, maxBlockSizeElement(0xAE,
+			maxBlockSizeElement(0xD7, uintData(1)),
+			maxBlockSizeElement(0x86, []byte("V_VP8")),
+			maxBlockSizeElement(0xE0, maxBlockSizeElement(0xB0, uintData(640)), maxBlockSizeElement(0xBA, uintData(360))),
+		)),
+		append(idBytes(0x1F43B675), unknownSize...),
+		maxBlockSizeElement(0xE7, uintData(0)),
+	}, nil)
+}
+
+// maxBlockSizeSimpleBlock はtrackのtimecode（ms）のキーフレームを、データがsizeバイトのSimpleBlockとして作る
+func maxBlockSizeSimpleBlock(track byte, timecode int16, size int) []byte {
+	data := append([]byte{0x80 | track, byte(uint16(timecode) >> 8), byte(timecode), 0x80}, make([]byte, size)...)
+	return maxBlockSizeElement(0xA3, data)
+}
+
+// maxBlockSizeReadAll はlimitを --max-block-size としてMKVReaderで全フレームを読み、
+// 読み込み中に確保したメモリの合計とともに返す
+func maxBlockSizeReadAll(r io.Reader, maxBlockSize int64) ([]*Frame, uint64, error) {
+	saved := MaxBlockSize
+	MaxBlockSize = maxBlockSize
+	defer func() { MaxBlockSize = saved }()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	reader := NewMKVReader(r)
+	reader.Start()
+	var frames []*Frame
+	var err error
+	for {
+		var frame *Frame
+		frame, err = reader.ReadFrame()
+		if err != nil {
+			break
+		}
+		frames = append(frames, frame)
+	}
+	runtime.ReadMemStats(&after)
+	if errors.Is(err, io.EOF) {
+		err = nil
+	}
+	return frames, after.TotalAlloc - before.TotalAlloc, err
+}
+
+// TestMaxBlockSizeRejectBeforeAllocating は映像トラックの1GiBと宣言されたSimpleBlockを、データを確保せずにErrBlockTooLargeで拒否することを検証する
+// 入力にはBlockの先頭しか無いため、確保してから読んでいればio.ErrUnexpectedEOFになる
+func TestMaxBlockSizeRejectBeforeAllocating(t *testing.T) {
+	const declared = 1 << 30
+	data := append(head(), maxBlockSizeSimpleBlock(1, 0, 100)...)
+	data = append(data, elementHeader(0xA3, declared)...)
+	data = append(data, 0x81, 0x00, 0x21, 0x00)
+
+	frames, allocated, err := maxBlockSizeReadAll(bytes.NewReader(data), limit)
+	if !errors.Is(err, ErrBlockTooLarge) {
+		t.Fatalf("got error %v, want ErrBlockTooLarge", err)
+	}
+	if len(frames) != 1 {
+		t.Fatalf("got %d frames before the oversized block, want 1", len(frames))
+	}
+	if allocated > 64<<20 {
+		t.Fatalf("allocated %d bytes while rejecting a %d byte block", allocated, declared)
+	}
+	t.Logf("error: %v", err)
+}
+
+// TestMaxBlockSizeSkipUnusedTrack は読み込まないトラックの上限を超えるBlockを、バッファせずに読み飛ばして続きを読むことを検証する
+func TestMaxBlockSizeSkipUnusedTrack(t *testing.T) {
+	const size = 8 << 20
+	data := append(head(), maxBlockSizeSimpleBlock(1, 0, 100)...)
+	data = append(data, maxBlockSizeSimpleBlock(3, 10, size)...)
+	data = append(data, maxBlockSizeSimpleBlock(1, 33, 100)...)
+
+	frames, allocated, err := maxBlockSizeReadAll(bytes.NewReader(data), limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || frames[1].TimestampMs != 33 {
+		t.Fatalf("got %d frames, want the two video frames around the skipped block", len(frames))
+	}
+	if allocated > size/2 {
+		t.Fatalf("allocated %d bytes while skipping a %d byte block", allocated, size)
+	}
+}
+
+// TestMaxBlockSizeWithinLimit は上限ちょうどのBlockと、0（無制限）での上限を超えるBlockを読めることを検証する
+func TestMaxBlockSizeWithinLimit(t *testing.T) {
+	const header = 4 // トラック番号、相対timecode、flags
+	for _, tt := range []struct {
+		maxBlockSize int64
+		size         int
+	}{
+		{limit, limit - header},
+		{0, 2 * limit},
+	} {
+		data := append(head(), maxBlockSizeSimpleBlock(1, 0, tt.size)...)
+		frames, _, err := maxBlockSizeReadAll(bytes.NewReader(data), tt.maxBlockSize)
+		if err != nil {
+			t.Fatalf("--max-block-size %d: %v", tt.maxBlockSize, err)
+		}
+		if len(frames) != 1 || len(frames[0].Data) != tt.size {
+			t.Fatalf("--max-block-size %d: got %d frames, want one frame of %d bytes", tt.maxBlockSize, len(frames), tt.size)
+		}
+	}
+}
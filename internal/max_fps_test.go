@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+)
+
+// ptsSequence はfpsのフレームをseconds秒分、ミリ秒に丸めたPTSで生成する（startMsから開始）
+func ptsSequence(fps int, seconds int, startMs int64) []int64 {
+	pts := make([]int64, 0, fps*seconds)
+	for i := 0; i < fps*seconds; i++ {
+		pts = append(pts, startMs+int64(i)*1000/int64(fps))
+	}
+	return pts
+}
+
+// allowed はlimiterを通ったPTSを返す
+func allowed(limiter *FrameRateLimiter, pts []int64) []int64 {
+	var kept []int64
+	for _, p := range pts {
+		if limiter.Allow(p) {
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// expectRate は入力fpsのPTSをmaxFPSで間引き、1秒あたりwantPerSecond(±1)フレームが通ることを検証する
+func expectRate(inputFPS, maxFPS, wantPerSecond int) error {
+	const seconds = 4
+	limiter := NewFrameRateLimiter(maxFPS)
+	kept := allowed(limiter, ptsSequence(inputFPS, seconds, 0))
+
+	for second := 0; second < seconds; second++ {
+		count := 0
+		for _, p := range kept {
+			if p >= int64(second)*1000 && p < int64(second+1)*1000 {
+				count++
+			}
+		}
+		if count < wantPerSecond-1 || count > wantPerSecond+1 {
+			return fmt.Errorf("second %d: %d frames passed, want %d±1", second, count, wantPerSecond)
+		}
+	}
+
+	// 入力とmaxFPSが整数比でない場合は間隔が揃わないため、任意の1秒間でmaxFPSを超えないことを確認する
+	for i := range kept {
+		count := 0
+		for _, p := range kept[i:] {
+			if p >= kept[i]+1000 {
+				break
+			}
+			count++
+		}
+		if count > maxFPS+1 {
+			return fmt.Errorf("%d frames passed within 1s from %dms, want <= %d", count, kept[i], maxFPS+1)
+		}
+	}
+	return nil
+}
+
+// TestMaxFPSPTSReset はPTSが戻った場合（ループ入力等）に再同期し、間引きが続くことを検証する
+func TestMaxFPSPTSReset(t *testing.T) {
+	limiter := NewFrameRateLimiter(30)
+	first := allowed(limiter, ptsSequence(60, 1, 10_000))
+	second := allowed(limiter, ptsSequence(60, 1, 0))
+	if len(second) == 0 || second[0] != 0 {
+		t.Fatalf("first frame after PTS reset was dropped")
+	}
+	for _, kept := range [][]int64{first, second} {
+		if len(kept) < 29 || len(kept) > 31 {
+			t.Fatalf("%d frames passed in one second, want 30±1", len(kept))
+		}
+	}
+}
+
+// TestMaxFPSGap は入力が途切れた後、遅れを取り戻すためにフレームを連続で通さないことを検証する
+func TestMaxFPSGap(t *testing.T) {
+	limiter := NewFrameRateLimiter(30)
+	allowed(limiter, ptsSequence(60, 1, 0))
+	// 5秒の空白の後に60fpsで再開
+	kept := allowed(limiter, ptsSequence(60, 1, 6_000))
+	if len(kept) < 29 || len(kept) > 31 {
+		t.Fatalf("%d frames passed in one second after a gap, want 30±1", len(kept))
+	}
+}
+
+// TestMaxFPSRate は入力のフレームレートごとに --max-fps 30 で出力されるフレームレートを検証する
+func TestMaxFPSRate(t *testing.T) {
+	for _, tt := range []struct{ input, max, want int }{
+		{60, 30, 30},
+		{120, 30, 30},
+		{50, 30, 30},
+		{30, 30, 30},
+		{25, 30, 25},
+	} {
+		t.Run(fmt.Sprintf("%dfps", tt.input), func(t *testing.T) {
+			if err := expectRate(tt.input, tt.max, tt.want); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
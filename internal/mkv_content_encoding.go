@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ContentCompAlgo（Matroska ContentCompression）の値
+const (
+	mkvCompAlgoZlib            = 0
+	mkvCompAlgoBzlib           = 1
+	mkvCompAlgoLZO1X           = 2
+	mkvCompAlgoHeaderStripping = 3
+)
+
+// ContentEncodingType の値
+const (
+	mkvEncodingTypeCompression = 0
+	mkvEncodingTypeEncryption  = 1
+)
+
+// mkvEncodingScopeFrame はContentEncodingScopeのうち、フレームの内容に適用することを示すビット
+const mkvEncodingScopeFrame = 1
+
+// ErrUnsupportedContentEncoding は読み込むトラックのContentEncodingが復元できない方式であることを示す
+var ErrUnsupportedContentEncoding = errors.New("unsupported MKV content encoding")
+
+// mkvContentEncoding はTrackEntryのContentEncodingの1つ
+type mkvContentEncoding struct {
+	order    uint64
+	scope    uint64
+	typ      uint64
+	algo     uint64
+	settings []byte // ContentCompSettings（header strippingで取り除かれた先頭のバイト列）
+}
+
+// newMKVContentEncoding は省略された要素をMatroskaの既定値（フレームの内容をzlibで圧縮）とした値を返す
+func newMKVContentEncoding() mkvContentEncoding {
+	return mkvContentEncoding{scope: mkvEncodingScopeFrame, typ: mkvEncodingTypeCompression, algo: mkvCompAlgoZlib}
+}
+
+// compAlgoName はContentCompAlgoの名前を返す
+func compAlgoName(algo uint64) string {
+	switch algo {
+	case mkvCompAlgoZlib:
+		return "zlib"
+	case mkvCompAlgoBzlib:
+		return "bzlib"
+	case mkvCompAlgoLZO1X:
+		return "lzo1x"
+	case mkvCompAlgoHeaderStripping:
+		return "header stripping"
+	default:
+		return fmt.Sprintf("algorithm %d", algo)
+	}
+}
+
+// frameContentEncodings はフレームの内容に適用されたContentEncodingを、復元する順（ContentEncodingOrderの降順）で返す
+// 復元できない方式（暗号化、zlibとheader stripping以外の圧縮）が含まれる場合はErrUnsupportedContentEncodingを返す
+func frameContentEncodings(encodings []mkvContentEncoding) ([]mkvContentEncoding, error) {
+	var frame []mkvContentEncoding
+	for _, encoding := range encodings {
+		if encoding.scope&mkvEncodingScopeFrame == 0 {
+			continue
+		}
+		if encoding.typ == mkvEncodingTypeEncryption {
+			return nil, fmt.Errorf("%w: encrypted frames", ErrUnsupportedContentEncoding)
+		}
+		if encoding.typ != mkvEncodingTypeCompression {
+			return nil, fmt.Errorf("%w: ContentEncodingType %d", ErrUnsupportedContentEncoding, encoding.typ)
+		}
+		if encoding.algo != mkvCompAlgoZlib && encoding.algo != mkvCompAlgoHeaderStripping {
+			return nil, fmt.Errorf("%w: %s compression (only zlib and header stripping are supported)",
+				ErrUnsupportedContentEncoding, compAlgoName(encoding.algo))
+		}
+		frame = append(frame, encoding)
+	}
+	// 大きいContentEncodingOrderの方式が最後に適用されているため、先に復元する
+	sort.SliceStable(frame, func(i, j int) bool { return frame[i].order > frame[j].order })
+	return frame, nil
+}
+
+// decodeContent はフレームにContentEncodingsを逆に適用し、元のフレームを返す
+// zlibの展開はlimitバイトまでとし、超える場合はエラーとする
+func decodeContent(data []byte, encodings []mkvContentEncoding, limit int64) ([]byte, error) {
+	for _, encoding := range encodings {
+		switch encoding.algo {
+		case mkvCompAlgoHeaderStripping:
+			data = append(append(make([]byte, 0, len(encoding.settings)+len(data)), encoding.settings...), data...)
+		case mkvCompAlgoZlib:
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				return nil, fmt.Errorf("zlib: %w", err)
+			}
+			var out bytes.Buffer
+			n, err := out.ReadFrom(io.LimitReader(zr, limit+1))
+			zr.Close()
+			if err != nil {
+				return nil, fmt.Errorf("zlib: %w", err)
+			}
+			if n > limit {
+				return nil, fmt.Errorf("zlib: frame expands beyond %d bytes", limit)
+			}
+			data = out.Bytes()
+		}
+	}
+	return data, nil
+}
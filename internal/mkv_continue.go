@@ -0,0 +1,94 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// mkvSegmentState は再接続後のセッションが同じSegmentに続けて書き込むための、前のセッションのライターの状態
+// ヘッダーに書いた映像の解像度とトラック構成が同じであれば、EBMLヘッダー・Segment・Info・Tracksを書かずに
+// 次のClusterから続け、timecodeも前のセッションの続きにする
+type mkvSegmentState struct {
+	width         int
+	height        int
+	audioOnly     bool
+	videoOnly     bool
+	audioTracks   int
+	layout        TrackLayout
+	rotation      int
+	written       uint64    // 出力に書き込んだバイト数（Positionの計算用）
+	segmentStart  uint64    // Segmentのデータ開始位置
+	lastClusterAt uint64    // 最後のクラスタの開始位置（PrevSizeの計算用）
+	lastTicks     uint64    // 最後に書き込んだブロックのtimecode（tick）
+	lastBlockAt   time.Time // 最後にブロックを書き込んだ時刻
+}
+
+// segmentState はヘッダーを書き込み済みで出力が使える場合に、次のセッションが続きを書き込むための状態を返す
+// Close後に呼ぶ。ヘッダーを書き込んでいない、または出力が失敗している場合はnilを返す
+func (w *RawVideoMKVWriter) segmentState() *mkvSegmentState {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.isHeaderWritten || w.out.Err() != nil {
+		return nil
+	}
+	return &mkvSegmentState{
+		width:         w.width,
+		height:        w.height,
+		audioOnly:     w.audioOnly,
+		videoOnly:     w.videoOnly,
+		audioTracks:   len(w.audioTracks),
+		layout:        w.trackLayout(),
+		rotation:      w.rotation,
+		written:       w.counter.n,
+		segmentStart:  w.segmentStart,
+		lastClusterAt: w.lastClusterAt,
+		lastTicks:     w.lastBlockTicks,
+		lastBlockAt:   w.lastBlockAt,
+	}
+}
+
+// continueSegment は前のセッションが書き込んだSegmentの続きを書き込むよう設定する（Run開始前に呼ぶ）
+func (w *RawVideoMKVWriter) continueSegment(state *mkvSegmentState) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.continued = state
+}
+
+// resumeSegment はヘッダーを書き込む代わりに前のセッションのSegmentを引き継ぐ
+// 解像度やトラック構成が変わった場合は引き継げないためfalseを返し、新しいヘッダーを書き込ませる
+// timecodeは前のセッションの最後のブロックから、書き込みが途切れていた時間だけ後ろから始める
+func (w *RawVideoMKVWriter) resumeSegment() bool {
+	state := w.continued
+	w.continued = nil
+	if state == nil {
+		return false
+	}
+	if state.audioOnly != w.audioOnly || state.videoOnly != w.videoOnly || state.audioTracks != len(w.audioTracks) ||
+		state.layout != w.trackLayout() || state.rotation != w.rotation ||
+		!w.audioOnly && (state.width != w.width || state.height != w.height) {
+		fmt.Fprintf(os.Stderr, "Stream changed after reconnect (%s), starting a new MKV segment\n", w.describeTracks())
+		return false
+	}
+
+	w.counter.n = state.written
+	w.segmentStart = state.segmentStart
+	w.lastClusterAt = state.lastClusterAt
+	w.hasPrevCluster = true
+	w.timecodeBase = state.lastTicks + uint64(max(w.durationToTicks(w.clock.Now().Sub(state.lastBlockAt)), 1))
+	w.isHeaderWritten = true
+	DebugLog("Continuing the MKV segment after reconnect: timecodes start at %d ticks\n", w.timecodeBase)
+	return true
+}
+
+// describeTracks は新しいSegmentを始める理由の表示用に、トラック構成を文字列にする
+func (w *RawVideoMKVWriter) describeTracks() string {
+	switch {
+	case w.audioOnly:
+		return fmt.Sprintf("audio only, %d audio tracks", len(w.audioTracks))
+	case w.videoOnly:
+		return fmt.Sprintf("%dx%d video only", w.width, w.height)
+	default:
+		return fmt.Sprintf("%dx%d video, %d audio tracks", w.width, w.height, len(w.audioTracks))
+	}
+}
@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+const (
+	mkvCRCWidth  = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	mkvCRCHeight = 360
+	mkvCRCFrames = 3
+)
+
+// Matroska要素ID
+var (
+	mkvCRCInfoID   = []byte{0x15, 0x49, 0xA9, 0x66}
+	mkvCRCTracksID = []byte{0x16, 0x54, 0xAE, 0x6B}
+)
+
+// crcElement は子要素の内容に対するCRC-32要素を作る
+func crcElement(children ...[]byte) []byte {
+	return element(0xBF, binary.LittleEndian.AppendUint32(nil, crc32.ChecksumIEEE(bytes.Join(children, nil))))
+}
+
+// mkvCRCWriteMKV はcrcを設定したRawVideoMKVWriterでVP8フレームを書き込んだ出力を返す
+func mkvCRCWriteMKV(crc bool) ([]byte, error) {
+	MKVCRC = crc
+	defer func() { MKVCRC = false }()
+
+	encoder, err := NewVP8Encoder(mkvCRCWidth, mkvCRCHeight, "YUV420P", 500)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	yuv := bytes.Repeat([]byte{0x80}, mkvCRCWidth*mkvCRCHeight*3/2)
+	for i := 0; i < mkvCRCFrames; i++ {
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		if err := writer.WriteVideoFrame(encoded, uint32(i*3000), keyframe); err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// readMKV はMKVReaderで最後まで読み、映像フレーム数とCRC-32の検証結果を返す
+func readMKV(data []byte) (int, int, int, error) {
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	video := 0
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return video, reader.CRCChecked(), reader.CRCMismatches(), nil
+		}
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if frame.Type == FrameTypeVideo {
+			video++
+		}
+	}
+}
+
+// firstChild はidの要素の先頭の子要素のIDの1バイト目を返す
+func firstChild(data, id []byte) (byte, error) {
+	pos := bytes.Index(data, id)
+	if pos < 0 || pos+len(id) >= len(data) {
+		return 0, fmt.Errorf("element %X not found", id)
+	}
+	sizeLen := 1
+	for mask := byte(0x80); sizeLen <= 8 && data[pos+len(id)]&mask == 0; mask >>= 1 {
+		sizeLen++
+	}
+	header := len(id) + sizeLen
+	if pos+header >= len(data) {
+		return 0, fmt.Errorf("element %X truncated", id)
+	}
+	return data[pos+header], nil
+}
+
+// TestMKVCRCRoundTrip は --mkv-crc でInfo/TracksにCRC-32が書かれ、読み戻しで検証されることを検証する
+func TestMKVCRCRoundTrip(t *testing.T) {
+	data, err := mkvCRCWriteMKV(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range [][]byte{mkvCRCInfoID, mkvCRCTracksID} {
+		child, err := firstChild(data, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if child != 0xBF {
+			t.Fatalf("first child of %X is 0x%02X, want CRC-32 (0xBF)", id, child)
+		}
+	}
+	video, checked, mismatches, err := readMKV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video != mkvCRCFrames || checked != 2 || mismatches != 0 {
+		t.Fatalf("read %d frames, %d CRCs checked, %d mismatches; want %d, 2, 0", video, checked, mismatches, mkvCRCFrames)
+	}
+}
+
+// TestMKVCRCDisabled は --mkv-crc 未指定時にCRC-32を書かないことを検証する
+func TestMKVCRCDisabled(t *testing.T) {
+	data, err := mkvCRCWriteMKV(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if child, err := firstChild(data, mkvCRCInfoID); err != nil || child == 0xBF {
+		t.Fatalf("Info starts with 0x%02X (%v) without --mkv-crc", child, err)
+	}
+	_, checked, _, err := readMKV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 0 {
+		t.Fatalf("%d CRCs checked without --mkv-crc", checked)
+	}
+}
+
+// TestMKVCRCCorruption は書き込み後に書き換えたInfoのCRC-32不一致を検出し、フレームの読み込みは続けることを検証する
+func TestMKVCRCCorruption(t *testing.T) {
+	data, err := mkvCRCWriteMKV(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos := bytes.Index(data, []byte("go-webrtc-whep-client"))
+	if pos < 0 {
+		t.Fatalf("MuxingApp not found")
+	}
+	data[pos] = 'G'
+	video, checked, mismatches, err := readMKV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checked != 2 || mismatches != 1 {
+		t.Fatalf("%d CRCs checked, %d mismatches; want 2 and 1", checked, mismatches)
+	}
+	if video != mkvCRCFrames {
+		t.Fatalf("read %d frames after the CRC mismatch, want %d", video, mkvCRCFrames)
+	}
+
+	report, err := ValidateMKV(bytes.NewReader(data))
+	if err == nil || report.CRCMismatches != 1 {
+		t.Fatalf("ValidateMKV returned %v with %d mismatches, want a CRC failure", err, report.CRCMismatches)
+	}
+}
+
+// TestMKVCRCNested は入れ子のCRC-32（TracksとTrackEntry）を両方検証し、先頭以外のCRC-32は無視することを検証する
+func TestMKVCRCNested(t *testing.T) {
+	trackBody := [][]byte{
+		element(0xD7, uintData(1)),
+		element(0x86, []byte("V_UNCOMPRESSED")),
+		element(0xE0, element(0xB0, uintData(2)), element(0xBA, uintData(2))),
+	}
+	entry := element(0xAE, append([][]byte{crcElement(trackBody...)}, trackBody...)...)
+	// Info内の2番目の子要素として置いたCRC-32（値は不正）は検証対象にならない
+	info := element(0x1549A966, element(0x2AD7B1, uintData(1000000)), element(0xBF, []byte{0, 0, 0, 0}))
+	data := bytes.Join([][]byte{
+		element(0x1A45DFA3, element(0x4282, []byte("matroska"))),
+		append(idBytes(0x18538067), unknownSize...),
+		info,
+		element(0x1654AE6B, crcElement(entry), entry),
+		append(idBytes(0x1F43B675), unknownSize...),
+		element(0xE7, uintData(0)),
+		element(0xA3, []byte{0x81, 0, 0, 0x80}, make([]byte, 16)),
+	}, nil)
+
+	video, checked, mismatches, err := readMKV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video != 1 || checked != 2 || mismatches != 0 {
+		t.Fatalf("read %d frames, %d CRCs checked, %d mismatches; want 1, 2, 0", video, checked, mismatches)
+	}
+}
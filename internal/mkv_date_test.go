@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	mkvDateAudioStep = 20 * time.Millisecond
+	mkvDateFrames    = 10
+)
+
+var (
+	// DateUTC（0x4461、サイズ8）とSegmentUID（0x73A4、サイズ16）の要素ヘッダー
+	dateUTCHeader    = []byte{0x44, 0x61, 0x88}
+	segmentUIDHeader = []byte{0x73, 0xA4, 0x90}
+	// 2024-01-02T03:04:05Z は2001-01-01T00:00:00Zから725857445秒後
+	recordedAt      = time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	recordedAtNanos = int64(725857445) * int64(time.Second)
+)
+
+// mkvDateWriteAudio はManualClock（recordedAt開始）で音声のみのMKVを書き込む
+// rotateToが指定されていれば、後半のフレームはclockを1時間進めてからローテーションした先に書き込む
+func mkvDateWriteAudio(rotateTo *bytes.Buffer) ([]byte, error) {
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	clock := newManualClock(recordedAt)
+	writer.SetClock(clock)
+	writer.SetAudioOnly()
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	for i := 0; i < mkvDateFrames; i++ {
+		if i > 0 {
+			clock.Advance(mkvDateAudioStep)
+		}
+		if rotateTo != nil && i == mkvDateFrames/2 {
+			clock.Advance(time.Hour)
+			if err := writer.Rotate(rotateTo); err != nil {
+				return nil, err
+			}
+		}
+		if err := writer.WriteAudioFrame(opusSilence, uint32(i*960)); err != nil {
+			return nil, fmt.Errorf("audio frame %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// mkvDateDateUTC はMKVのDateUTCの値を返す（無ければfalse）
+func mkvDateDateUTC(data []byte) (int64, bool) {
+	pos := bytes.Index(data, dateUTCHeader)
+	if pos < 0 || pos+len(dateUTCHeader)+8 > len(data) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(data[pos+len(dateUTCHeader):])), true
+}
+
+// mkvDateSegmentUID はMKVのSegmentUIDを返す（無ければnil）
+func mkvDateSegmentUID(data []byte) []byte {
+	pos := bytes.Index(data, segmentUIDHeader)
+	if pos < 0 || pos+len(segmentUIDHeader)+16 > len(data) {
+		return nil
+	}
+	return data[pos+len(segmentUIDHeader) : pos+len(segmentUIDHeader)+16]
+}
+
+// TestMKVDateEncode は日付要素が2001-01-01T00:00:00Zからのナノ秒（符号付き）になることを検証する
+func TestMKVDateEncode(t *testing.T) {
+	tests := []struct {
+		t    time.Time
+		want int64
+	}{
+		{time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC), 0},
+		{time.Date(2001, 1, 1, 0, 0, 1, 500, time.UTC), int64(time.Second) + 500},
+		{time.Date(2000, 12, 31, 23, 59, 59, 0, time.UTC), -int64(time.Second)},
+		{recordedAt, recordedAtNanos},
+		// タイムゾーンに依存しない
+		{recordedAt.In(time.FixedZone("JST", 9*60*60)), recordedAtNanos},
+	}
+	for _, tt := range tests {
+		encoded := EncodeMKVDate(tt.t)
+		if len(encoded) != 8 {
+			t.Fatalf("%v encoded to %d bytes, want 8", tt.t, len(encoded))
+		}
+		if got := int64(binary.BigEndian.Uint64(encoded)); got != tt.want {
+			t.Fatalf("%v encoded to %d, want %d", tt.t, got, tt.want)
+		}
+	}
+}
+
+// TestMKVDateDateUTC はヘッダーを書き込んだ時刻がDateUTCとして書き込まれ、MKVとして読めることを検証する
+func TestMKVDateDateUTC(t *testing.T) {
+	data, err := mkvDateWriteAudio(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := mkvDateDateUTC(data)
+	if !ok {
+		t.Fatalf("DateUTC not found")
+	}
+	if got != recordedAtNanos {
+		t.Fatalf("DateUTC %d, want %d (%v)", got, recordedAtNanos, recordedAt)
+	}
+	if _, err := ValidateMKV(bytes.NewReader(data)); err != nil {
+		t.Fatalf("mkv-validate: %v", err)
+	}
+}
+
+// TestMKVDateNoDate は --no-date でDateUTCを書き込まないことを検証する
+func TestMKVDateNoDate(t *testing.T) {
+	NoDate = true
+	defer func() { NoDate = false }()
+	data, err := mkvDateWriteAudio(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := mkvDateDateUTC(data); ok {
+		t.Fatalf("DateUTC written with --no-date")
+	}
+	if mkvDateSegmentUID(data) == nil {
+		t.Fatalf("SegmentUID not found with --no-date")
+	}
+}
+
+// TestMKVDateSegmentUIDSeed は同じ --segment-uid-seed と --no-date で実行すると同一の出力になり、
+// 同じ実行の中で続けて書き込むSegment、シードが異なるか指定しない場合はSegmentUIDが異なることを検証する
+func TestMKVDateSegmentUIDSeed(t *testing.T) {
+	NoDate = true
+	defer func() { NoDate = false }()
+	// newRun で新しいプロセスとして実行した場合と同じく、シードの系列を最初から使う
+	write := func(seed int64, newRun bool) ([]byte, error) {
+		SegmentUIDSeed = seed
+		defer func() { SegmentUIDSeed = 0 }()
+		if newRun {
+			seededSegmentUIDs.rng = nil
+		}
+		return mkvDateWriteAudio(nil)
+	}
+
+	first, err := write(42, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 再接続などで同じ実行の中で作るライターは、系列の続きの別のSegmentUIDを使う
+	reconnected, err := write(42, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(mkvDateSegmentUID(first), mkvDateSegmentUID(reconnected)) {
+		t.Fatalf("second writer in the same run reused SegmentUID %X", mkvDateSegmentUID(first))
+	}
+	second, err := write(42, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Fatalf("outputs of two runs with the same seed differ")
+	}
+	other, err := write(43, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(mkvDateSegmentUID(first), mkvDateSegmentUID(other)) {
+		t.Fatalf("seeds 42 and 43 produced the same SegmentUID %X", mkvDateSegmentUID(first))
+	}
+	random1, err := write(0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	random2, err := write(0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mkvDateSegmentUID(random1) == nil || bytes.Equal(mkvDateSegmentUID(random1), mkvDateSegmentUID(random2)) {
+		t.Fatalf("random SegmentUIDs %X and %X, want two different UIDs", mkvDateSegmentUID(random1), mkvDateSegmentUID(random2))
+	}
+}
+
+// TestMKVDateRotate はローテーション後のファイルが新しいSegmentUIDとローテーション時刻のDateUTCを持つことを検証する
+func TestMKVDateRotate(t *testing.T) {
+	var second bytes.Buffer
+	first, err := mkvDateWriteAudio(&second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	firstDate, ok1 := mkvDateDateUTC(first)
+	secondDate, ok2 := mkvDateDateUTC(second.Bytes())
+	if !ok1 || !ok2 {
+		t.Fatalf("DateUTC missing (first %v, second %v)", ok1, ok2)
+	}
+	// ローテーションは6フレーム目の前（5回分の20msと1時間の後）
+	want := recordedAtNanos + int64(time.Hour+5*mkvDateAudioStep)
+	if firstDate != recordedAtNanos || secondDate != want {
+		t.Fatalf("DateUTC %d and %d, want %d and %d", firstDate, secondDate, recordedAtNanos, want)
+	}
+	if bytes.Equal(mkvDateSegmentUID(first), mkvDateSegmentUID(second.Bytes())) {
+		t.Fatalf("rotated file reused SegmentUID %X", mkvDateSegmentUID(first))
+	}
+}
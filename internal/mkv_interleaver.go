@@ -0,0 +1,79 @@
+package internal
+
+// pendingBlock は書き込み待ちのSimpleBlock
+type pendingBlock struct {
+	trackNum uint64
+	data     []byte
+	timecode uint64
+	keyframe bool
+}
+
+// blockInterleaver は映像/音声のSimpleBlockを短時間保持し、timecode順に並べ替えて出力する
+// 映像と音声は別goroutineから到着するため、到着順のままではクラスタ内で
+// timecodeが前後することがある。window（tick）分遅れたブロック、または
+// maxDepthを超えたブロックから順に出力し、出力timecodeは単調非減少に補正する
+type blockInterleaver struct {
+	window      uint64 // 保持するtick数
+	maxDepth    int
+	blocks      []pendingBlock // timecode昇順（同一timecodeは到着順）
+	newest      uint64         // 受け取った中で最大のtimecode
+	lastEmitted uint64         // 最後に出力したtimecode
+	hasEmitted  bool
+}
+
+func newBlockInterleaver(window uint64, maxDepth int) *blockInterleaver {
+	if maxDepth < 1 {
+		maxDepth = 1
+	}
+	return &blockInterleaver{
+		window:   window,
+		maxDepth: maxDepth,
+	}
+}
+
+// push はブロックを挿入ソートで保持する
+// dataは呼び出し後に再利用されることがあるため、呼び出し側でコピーしておくこと
+func (b *blockInterleaver) push(block pendingBlock) {
+	if block.timecode > b.newest {
+		b.newest = block.timecode
+	}
+
+	i := len(b.blocks)
+	for i > 0 && b.blocks[i-1].timecode > block.timecode {
+		i--
+	}
+	b.blocks = append(b.blocks, pendingBlock{})
+	copy(b.blocks[i+1:], b.blocks[i:])
+	b.blocks[i] = block
+}
+
+// popReady は出力可能になったブロックをtimecode順に返す
+// flushAllがtrueの場合は保持中のブロックをすべて返す
+func (b *blockInterleaver) popReady(flushAll bool) []pendingBlock {
+	n := 0
+	for n < len(b.blocks) {
+		if !flushAll && len(b.blocks)-n <= b.maxDepth && b.newest-b.blocks[n].timecode < b.window {
+			break
+		}
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	ready := make([]pendingBlock, n)
+	copy(ready, b.blocks[:n])
+	b.blocks = append(b.blocks[:0], b.blocks[n:]...)
+
+	for i := range ready {
+		// 保持期間を過ぎて到着したブロックは直前のtimecodeに揃える
+		if b.hasEmitted && ready[i].timecode < b.lastEmitted {
+			DebugLog("Interleave: late block on track %d (timecode=%d < %d), clamping\n",
+				ready[i].trackNum, ready[i].timecode, b.lastEmitted)
+			ready[i].timecode = b.lastEmitted
+		}
+		b.lastEmitted = ready[i].timecode
+		b.hasEmitted = true
+	}
+	return ready
+}
@@ -0,0 +1,102 @@
+package internal
+
+import "testing"
+
+const (
+	interleaverVideoTrack = 1
+	interleaverAudioTrack = 2
+)
+
+// interleaverPush はブロックを順に渡し、出力されたブロックを返す（最後に残りをすべて出力する）
+func interleaverPush(b *blockInterleaver, blocks []pendingBlock) []pendingBlock {
+	var out []pendingBlock
+	for _, block := range blocks {
+		b.push(block)
+		out = append(out, b.popReady(false)...)
+	}
+	return append(out, b.popReady(true)...)
+}
+
+// TestInterleaverOrder は映像と音声が前後して到着しても、timecode順（同一timecodeは到着順）に出力されることを検証する
+func TestInterleaverOrder(t *testing.T) {
+	// 映像40ms間隔、音声20ms間隔。音声は映像より最大30ms遅れて到着する
+	in := []pendingBlock{
+		{trackNum: interleaverVideoTrack, timecode: 0, keyframe: true},
+		{trackNum: interleaverVideoTrack, timecode: 40},
+		{trackNum: interleaverAudioTrack, timecode: 0},
+		{trackNum: interleaverAudioTrack, timecode: 20},
+		{trackNum: interleaverAudioTrack, timecode: 40},
+		{trackNum: interleaverVideoTrack, timecode: 80},
+		{trackNum: interleaverAudioTrack, timecode: 60},
+		{trackNum: interleaverVideoTrack, timecode: 120},
+		{trackNum: interleaverAudioTrack, timecode: 80},
+		{trackNum: interleaverAudioTrack, timecode: 100},
+	}
+	want := []struct {
+		track    uint64
+		timecode uint64
+	}{
+		{interleaverVideoTrack, 0},
+		{interleaverAudioTrack, 0},
+		{interleaverAudioTrack, 20},
+		{interleaverVideoTrack, 40},
+		{interleaverAudioTrack, 40},
+		{interleaverAudioTrack, 60},
+		{interleaverVideoTrack, 80},
+		{interleaverAudioTrack, 80},
+		{interleaverAudioTrack, 100},
+		{interleaverVideoTrack, 120},
+	}
+
+	out := interleaverPush(newBlockInterleaver(50, 16), in)
+	if len(out) != len(want) {
+		t.Fatalf("%d blocks out, want %d", len(out), len(want))
+	}
+	for i, w := range want {
+		if out[i].trackNum != w.track || out[i].timecode != w.timecode {
+			t.Fatalf("block %d: track %d timecode %d, want track %d timecode %d", i, out[i].trackNum, out[i].timecode, w.track, w.timecode)
+		}
+	}
+	if !out[0].keyframe {
+		t.Fatalf("keyframe flag lost on the first video block")
+	}
+}
+
+// TestInterleaverLateBlock はwindowを過ぎて到着したブロックを直前に出力したtimecodeに揃えることを検証する
+func TestInterleaverLateBlock(t *testing.T) {
+	in := []pendingBlock{
+		{trackNum: interleaverVideoTrack, timecode: 0},
+		{trackNum: interleaverVideoTrack, timecode: 40},
+		{trackNum: interleaverVideoTrack, timecode: 80},
+		{trackNum: interleaverVideoTrack, timecode: 120},
+		{trackNum: interleaverAudioTrack, timecode: 20}, // 映像0と40は出力済み
+	}
+	out := interleaverPush(newBlockInterleaver(50, 16), in)
+	var last uint64
+	for i, block := range out {
+		if block.timecode < last {
+			t.Fatalf("block %d: timecode %d after %d", i, block.timecode, last)
+		}
+		last = block.timecode
+	}
+	for _, block := range out {
+		if block.trackNum == interleaverAudioTrack && block.timecode != 40 {
+			t.Fatalf("late audio block written at %d, want 40", block.timecode)
+		}
+	}
+}
+
+// TestInterleaverDepth はmaxDepthを超えた場合にwindow内でも古いブロックから出力することを検証する
+func TestInterleaverDepth(t *testing.T) {
+	b := newBlockInterleaver(1000, 2)
+	for i := uint64(0); i < 3; i++ {
+		b.push(pendingBlock{trackNum: interleaverAudioTrack, timecode: i * 20})
+	}
+	ready := b.popReady(false)
+	if len(ready) != 1 || ready[0].timecode != 0 {
+		t.Fatalf("popReady over depth returned %v, want only timecode 0", ready)
+	}
+	if rest := b.popReady(true); len(rest) != 2 {
+		t.Fatalf("flush returned %d blocks, want 2", len(rest))
+	}
+}
@@ -5,8 +5,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"math"
+	"os"
 	"time"
 )
 
@@ -20,7 +23,7 @@ const (
 type Frame struct {
 	Type              FrameType
 	Data              []byte
-	TimestampMs       int64
+	TimestampMs       int64 // PTS（ミリ秒、0以上。負の相対timecodeで0より前になるフレームは0に切り上げる）
 	IsKeyframe        bool
 	ClusterTimeMs     int64
 	BlockRelativeTsMs int64
@@ -37,9 +40,17 @@ type MKVReader struct {
 	err              error
 	started          bool
 	pixelFormat      string
+	videoCodec       string
 	audioCodec       string
 	audioSampleRate  int
 	audioChannels    int
+	resyncs          int
+	crcChecked       int
+	crcMismatches    int
+	maxBlockSize     int64                // 読み込むBlockの最大サイズ（0で無制限）
+	videoEncodings   []mkvContentEncoding // 映像トラックのフレームの復元に使うContentEncoding（復元する順）
+	audioEncodings   []mkvContentEncoding // 音声トラックのフレームの復元に使うContentEncoding（復元する順）
+	tags             []MKVTag             // 最後のSegmentのTagsにあったSimpleTag
 }
 
 func NewMKVReader(reader io.Reader) *MKVReader {
@@ -50,6 +61,7 @@ func NewMKVReader(reader io.Reader) *MKVReader {
 		videoTrackNumber: -1,
 		audioTrackNumber: -1,
 		pixelFormat:      "RGBA",
+		maxBlockSize:     MaxBlockSize,
 	}
 }
 
@@ -65,6 +77,11 @@ func (r *MKVReader) PixelFormat() string {
 	return r.pixelFormat
 }
 
+// VideoCodec は映像トラックのCodecID（V_UNCOMPRESSED, V_VP8, V_VP9）を返す
+func (r *MKVReader) VideoCodec() string {
+	return r.videoCodec
+}
+
 func (r *MKVReader) AudioCodec() string {
 	return r.audioCodec
 }
@@ -77,6 +94,27 @@ func (r *MKVReader) AudioChannels() int {
 	return r.audioChannels
 }
 
+// Resyncs は要素サイズの破損から復帰した回数を返す（ReadFrameがio.EOFを返した後に参照する）
+func (r *MKVReader) Resyncs() int {
+	return r.resyncs
+}
+
+// CRCChecked はCRC-32要素を検証した親要素の数を返す（ReadFrameがio.EOFを返した後に参照する）
+func (r *MKVReader) CRCChecked() int {
+	return r.crcChecked
+}
+
+// CRCMismatches はCRC-32が一致しなかった親要素の数を返す（ReadFrameがio.EOFを返した後に参照する）
+func (r *MKVReader) CRCMismatches() int {
+	return r.crcMismatches
+}
+
+// Tags は最後に読んだSegmentのSimpleTagを現れた順に返す（ReadFrameがio.EOFを返した後に参照する）
+// 入れ子のSimpleTagは親の直後に並べる
+func (r *MKVReader) Tags() []MKVTag {
+	return r.tags
+}
+
 func (r *MKVReader) Start() {
 	if r.started {
 		return
@@ -119,16 +157,65 @@ const (
 	ebmlIDColourSpace      = 0x2EB524
 	ebmlIDSimpleBlock      = 0xA3
 	ebmlIDBlock            = 0xA1
+	ebmlIDEBML             = 0x1A45DFA3
+	ebmlIDSeekHead         = 0x114D9B74
+	ebmlIDCues             = 0x1C53BB6B
+	ebmlIDTags             = 0x1254C367
+	ebmlIDChapters         = 0x1043A770
+	ebmlIDAttachments      = 0x1941A469
+	ebmlIDBlockGroup       = 0xA0
+	ebmlIDBlockDuration    = 0x9B
+	ebmlIDReferenceBlock   = 0xFB
+	ebmlIDBlockAdditions   = 0x75A1
+	ebmlIDDiscardPadding   = 0x75A2
+	ebmlIDRefPriority      = 0xFA
+	ebmlIDCodecState       = 0xA4
+	ebmlIDPosition         = 0xA7
+	ebmlIDPrevSize         = 0xAB
+	ebmlIDSilentTracks     = 0x5854
+	ebmlIDEncryptedBlock   = 0xAF
+	ebmlIDVoid             = 0xEC
+	ebmlIDCRC32            = 0xBF
+	ebmlIDTag              = 0x7373
+	ebmlIDSimpleTag        = 0x67C8
+	ebmlIDTagName          = 0x45A3
+	ebmlIDTagString        = 0x4487
+	ebmlIDContentEncodings = 0x6D80
+	ebmlIDContentEncoding  = 0x6240
+	ebmlIDContentOrder     = 0x5031
+	ebmlIDContentScope     = 0x5032
+	ebmlIDContentType      = 0x5033
+	ebmlIDContentCompress  = 0x5034
+	ebmlIDContentEncrypt   = 0x5035
+	ebmlIDContentCompAlgo  = 0x4254
+	ebmlIDContentCompSet   = 0x4255
 	maxEBMLSizeVintBytes   = 8
 	maxEBMLIDVintBytes     = 4
 	defaultParserBufSize   = 256 * 1024
 	maxReasonableFieldSize = 64 * 1024 * 1024
 	frameSendTimeout       = 5 * time.Second
+	// 要素サイズの破損から復帰を試みる上限（超えた場合はエラーで終了する）
+	maxMKVResyncs = 16
+	// 1回の復帰で次のCluster/SimpleBlockを探す最大バイト数
+	maxMKVResyncScanBytes = 64 * 1024 * 1024
 )
 
+// ErrBlockTooLarge は読み込むトラックのBlockが --max-block-size を超えたことを示す
+var ErrBlockTooLarge = errors.New("MKV block too large")
+
+// errMKVDesync は要素の境界を見失ったことを示す
+// parseはこのエラーの場合のみ次のCluster/SimpleBlockへの再同期を試みる
+var errMKVDesync = errors.New("stream desynchronized")
+
 type mkvContainer struct {
-	id  uint64
-	end int64
+	id    uint64
+	start int64
+	end   int64 // サイズ不定の要素はmath.MaxInt64
+	// サイズ不定の要素は、同じかより上位の階層の要素が現れた位置で終わる
+	unknownSize bool
+	// 先頭にCRC-32要素がある場合、残りの内容から計算中のCRCと格納されていた値
+	crc     hash.Hash32
+	crcWant uint32
 }
 
 type mkvStreamParser struct {
@@ -143,8 +230,25 @@ type mkvStreamParser struct {
 	currentClusterTime int64
 
 	inTrackEntry bool
+	audioFound   bool // 現在のTracksで音声トラックを見つけた（2つ目以降の音声トラックは無視する）
 	inVideo      bool
 	inAudio      bool
+	inCluster    bool
+	inBlockGroup bool
+
+	// 読み込み中のTrackEntryのContentEncoding（最後の要素が読み込み中のもの）
+	encodings []mkvContentEncoding
+
+	// 読み込み中のSimpleTagのreader.tagsでの位置（入れ子のSimpleTagの分だけ積む）
+	simpleTags []int
+
+	// BlockGroup内のBlockはBlockDurationとReferenceBlockを読み終えてから処理する
+	pendingBlock      []byte
+	blockDuration     int64 // tick単位、BlockDurationがなければ-1
+	blockHasReference bool
+
+	elementStart int64 // 読み込み中の要素の先頭オフセット
+	crcActive    int   // stack内で検証中のCRC-32の数
 }
 
 const (
@@ -169,91 +273,358 @@ func (r *MKVReader) parse() {
 
 func (p *mkvStreamParser) parse() error {
 	for {
-		p.popExpiredContainers()
-
-		id, err := p.readElementID()
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				p.closeRemainingContainers()
-				return nil
+		err := p.parseElement()
+		if err == nil {
+			continue
+		}
+		if errors.Is(err, errMKVDesync) {
+			err = p.resync(err)
+			if err == nil {
+				continue
 			}
-			return err
 		}
+		if errors.Is(err, io.EOF) {
+			return p.closeRemainingContainers()
+		}
+		return err
+	}
+}
 
-		size, unknownSize, err := p.readElementSize()
-		if err != nil {
+// parseElement は要素を1つ読み込む
+func (p *mkvStreamParser) parseElement() error {
+	if err := p.popExpiredContainers(); err != nil {
+		return err
+	}
+
+	p.elementStart = p.offset
+	id, size, unknownSize, headerLen, err := p.peekElementHeader()
+	if err != nil {
+		return err
+	}
+	if err := p.checkPlausible(id, size, unknownSize, int64(headerLen)); err != nil {
+		return err
+	}
+	if err := p.closeUnknownSizeContainers(id); err != nil {
+		return err
+	}
+	if err := p.discard(int64(headerLen)); err != nil {
+		return err
+	}
+	if isTopLevelElement(id) {
+		p.inCluster = id == ebmlIDCluster
+	}
+
+	if p.isMasterElement(id) {
+		p.pushContainer(id, size, unknownSize)
+		return nil
+	}
+
+	return p.handleElementData(id, size)
+}
+
+// checkPlausible は直前の要素サイズがずれてデータの途中を要素として読んでいないか確認する
+// Cluster内ではCluster直下の要素か次のトップレベル要素しか現れず、
+// サイズ付きの親要素の範囲をはみ出す要素もありえない（サイズ不定の親要素は範囲を確認できない）
+func (p *mkvStreamParser) checkPlausible(id uint64, size int64, unknownSize bool, headerLen int64) error {
+	if p.inCluster && !isTopLevelElement(id) && !isClusterChild(id) && !(p.inBlockGroup && isBlockGroupChild(id)) {
+		return fmt.Errorf("%w: unexpected element ID 0x%x in Cluster at offset %d", errMKVDesync, id, p.offset)
+	}
+
+	if !unknownSize && len(p.stack) > 0 {
+		parent := p.stack[len(p.stack)-1]
+		if !parent.unknownSize && p.offset+headerLen+size > parent.end {
+			return fmt.Errorf("%w: element 0x%x (size %d) overruns its parent 0x%x at offset %d", errMKVDesync, id, size, parent.id, p.offset)
+		}
+	}
+	return nil
+}
+
+// isTopLevelElement はSegment直下（およびEBMLヘッダー、Segment自体）の要素か判定する
+func isTopLevelElement(id uint64) bool {
+	switch id {
+	case ebmlIDEBML, ebmlIDSegment, ebmlIDSeekHead, ebmlIDInfo, ebmlIDTracks, ebmlIDCluster,
+		ebmlIDCues, ebmlIDTags, ebmlIDChapters, ebmlIDAttachments:
+		return true
+	default:
+		return false
+	}
+}
+
+// isClusterChild はCluster直下に現れる要素か判定する
+func isClusterChild(id uint64) bool {
+	switch id {
+	case ebmlIDTimecode, ebmlIDSilentTracks, ebmlIDPosition, ebmlIDPrevSize, ebmlIDSimpleBlock,
+		ebmlIDBlockGroup, ebmlIDEncryptedBlock, ebmlIDVoid, ebmlIDCRC32:
+		return true
+	default:
+		return false
+	}
+}
+
+// isBlockGroupChild はBlockGroup直下に現れる要素か判定する
+func isBlockGroupChild(id uint64) bool {
+	switch id {
+	case ebmlIDBlock, ebmlIDBlockDuration, ebmlIDReferenceBlock, ebmlIDBlockAdditions,
+		ebmlIDDiscardPadding, ebmlIDRefPriority, ebmlIDCodecState, ebmlIDVoid, ebmlIDCRC32:
+		return true
+	default:
+		return false
+	}
+}
+
+// resync は要素の境界を見失った位置から次のCluster、またはCluster内であれば次のSimpleBlockまで読み飛ばす
+// マルチプレクサによっては要素サイズが数バイトずれていることがあるため、ストリーム全体を中断せずに復帰する
+func (p *mkvStreamParser) resync(cause error) error {
+	if p.reader.resyncs >= maxMKVResyncs {
+		return fmt.Errorf("giving up after %d resyncs: %w", maxMKVResyncs, cause)
+	}
+	p.reader.resyncs++
+	p.stopCRCs()
+	p.dropBlockGroup()
+
+	// ヘッダーが不正な要素の先頭にいる場合は、同じ位置で再同期しないよう1バイト進めてから境界を探す
+	start := p.offset
+	if p.offset == p.elementStart {
+		if _, err := p.readByte(); err != nil {
 			return err
 		}
+	}
+	for p.offset-start < maxMKVResyncScanBytes {
+		// Peekは終端付近で要求より短いデータとエラーを返すが、残りのバイトも候補として調べる
+		buf, _ := p.br.Peek(4 + maxEBMLSizeVintBytes + 4)
+		if p.isClusterStart(buf) {
+			p.dropClusterContainers()
+			fmt.Fprintf(os.Stderr, "MKV: %v; resynced to Cluster at offset %d (skipped %d bytes)\n", cause, p.offset, p.offset-start)
+			return nil
+		}
+		if p.inCluster && p.isSimpleBlockStart(buf) {
+			fmt.Fprintf(os.Stderr, "MKV: %v; resynced to SimpleBlock at offset %d (skipped %d bytes)\n", cause, p.offset, p.offset-start)
+			return nil
+		}
+		if _, err := p.readByte(); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("no Cluster or SimpleBlock found within %d bytes: %w", maxMKVResyncScanBytes, cause)
+}
 
-		if p.isMasterElement(id) {
-			if !unknownSize {
-				p.pushContainer(id, size)
-			}
-			continue
+func (p *mkvStreamParser) isClusterStart(buf []byte) bool {
+	return len(buf) >= 4 && binary.BigEndian.Uint32(buf) == ebmlIDCluster
+}
+
+// isSimpleBlockStart はbufがSimpleBlockの先頭らしいか判定する
+// 1バイトのIDは映像データ中にも頻繁に現れるため、既知のトラック番号と予約ビットも確認する
+func (p *mkvStreamParser) isSimpleBlockStart(buf []byte) bool {
+	if len(buf) < 2 || buf[0] != ebmlIDSimpleBlock {
+		return false
+	}
+	size, sizeLen := parseVint(buf[1:])
+	if sizeLen == 0 || size < 4 || len(buf) < 1+sizeLen+4 {
+		return false
+	}
+	header := buf[1+sizeLen:]
+	trackNum, trackNumLen := parseVint(header)
+	if trackNumLen == 0 || len(header) < trackNumLen+3 {
+		return false
+	}
+	if int64(trackNum) != p.reader.videoTrackNumber && int64(trackNum) != p.reader.audioTrackNumber {
+		return false
+	}
+	flags := header[trackNumLen+2]
+	return flags&0x70 == 0
+}
+
+// dropBlockGroup は読み込み途中のBlockGroupを破棄する（境界を見失ったBlockは信用できないため）
+func (p *mkvStreamParser) dropBlockGroup() {
+	for i, container := range p.stack {
+		if container.id == ebmlIDBlockGroup {
+			p.stack = p.stack[:i]
+			break
 		}
+	}
+	p.inBlockGroup = false
+	p.pendingBlock = nil
+}
 
-		if err := p.handleElementData(id, size); err != nil {
-			return err
+// dropClusterContainers はサイズ付きClusterの途中で再同期した場合に、そのClusterを範囲の管理から外す
+func (p *mkvStreamParser) dropClusterContainers() {
+	for i, container := range p.stack {
+		if container.id == ebmlIDCluster {
+			p.stack = p.stack[:i]
+			return
 		}
 	}
 }
 
 func (p *mkvStreamParser) isMasterElement(id uint64) bool {
 	switch id {
-	case ebmlIDSegment, ebmlIDInfo, ebmlIDTracks, ebmlIDCluster, ebmlIDTrackEntry, ebmlIDVideo, ebmlIDAudio:
+	case ebmlIDSegment, ebmlIDInfo, ebmlIDTracks, ebmlIDCluster, ebmlIDTrackEntry, ebmlIDVideo, ebmlIDAudio, ebmlIDBlockGroup,
+		ebmlIDTags, ebmlIDTag, ebmlIDSimpleTag, ebmlIDContentEncodings, ebmlIDContentEncoding, ebmlIDContentCompress:
 		return true
 	default:
 		return false
 	}
 }
 
-func (p *mkvStreamParser) pushContainer(id uint64, size int64) {
+// mkvElementLevel はMatroskaの要素の階層（EBMLヘッダーとSegmentが0）を返す
+// Void、CRC-32はどの階層にも現れ、知らない要素とともに階層を判定できないためfalseを返す
+func mkvElementLevel(id uint64) (int, bool) {
+	switch {
+	case id == ebmlIDEBML || id == ebmlIDSegment:
+		return 0, true
+	case isTopLevelElement(id):
+		return 1, true
+	}
+	switch id {
+	case ebmlIDVoid, ebmlIDCRC32:
+		return 0, false
+	case ebmlIDTimecodeScale, ebmlIDTrackEntry, ebmlIDTag:
+		return 2, true
+	case ebmlIDTrackNumber, ebmlIDCodecID, ebmlIDVideo, ebmlIDAudio, ebmlIDContentEncodings:
+		return 3, true
+	case ebmlIDPixelWidth, ebmlIDPixelHeight, ebmlIDColourSpace, ebmlIDChannels, ebmlIDSamplingFreq, ebmlIDContentEncoding:
+		return 4, true
+	case ebmlIDContentOrder, ebmlIDContentScope, ebmlIDContentType, ebmlIDContentCompress, ebmlIDContentEncrypt:
+		return 5, true
+	case ebmlIDContentCompAlgo, ebmlIDContentCompSet:
+		return 6, true
+	}
+	switch {
+	case isClusterChild(id):
+		return 2, true
+	case isBlockGroupChild(id):
+		return 3, true
+	}
+	return 0, false
+}
+
+// closeUnknownSizeContainers はidの要素が現れたことで終わるサイズ不定の要素を閉じる
+// サイズ不定の要素は、同じかより上位の階層の要素（子要素になりえない要素）が現れた位置で終わる
+func (p *mkvStreamParser) closeUnknownSizeContainers(id uint64) error {
+	level, ok := mkvElementLevel(id)
+	if !ok {
+		return nil
+	}
+	n := len(p.stack)
+	for n > 0 && p.stack[n-1].unknownSize {
+		if parentLevel, _ := mkvElementLevel(p.stack[n-1].id); parentLevel < level {
+			break
+		}
+		n--
+	}
+	return p.popContainers(n)
+}
+
+func (p *mkvStreamParser) pushContainer(id uint64, size int64, unknownSize bool) {
 	container := mkvContainer{
-		id:  id,
-		end: p.offset + size,
+		id:          id,
+		start:       p.offset,
+		end:         p.offset + size,
+		unknownSize: unknownSize,
+	}
+	if unknownSize {
+		container.end = math.MaxInt64
 	}
 	p.stack = append(p.stack, container)
 
 	switch id {
+	case ebmlIDSegment:
+		// 再接続で続いたSegmentのタグは前のSegmentのタグを置き換える
+		p.reader.tags = nil
+		p.simpleTags = nil
+	case ebmlIDTracks:
+		p.audioFound = false
 	case ebmlIDTrackEntry:
 		p.inTrackEntry = true
 		p.currentTrackNumber = 0
 		p.currentTrackType = ""
+		p.encodings = nil
+	case ebmlIDContentEncoding:
+		if p.inTrackEntry {
+			p.encodings = append(p.encodings, newMKVContentEncoding())
+		}
 	case ebmlIDVideo:
 		p.inVideo = true
 	case ebmlIDAudio:
 		p.inAudio = true
+	case ebmlIDBlockGroup:
+		p.inBlockGroup = true
+		p.pendingBlock = nil
+		p.blockDuration = -1
+		p.blockHasReference = false
+	case ebmlIDSimpleTag:
+		p.simpleTags = append(p.simpleTags, len(p.reader.tags))
+		p.reader.tags = append(p.reader.tags, MKVTag{})
 	}
 }
 
-func (p *mkvStreamParser) popExpiredContainers() {
-	for len(p.stack) > 0 {
-		last := p.stack[len(p.stack)-1]
-		if p.offset < last.end {
-			return
+// popExpiredContainers は現在のオフセットで終わった要素を閉じる
+// サイズ付きの要素の中にあるサイズ不定の要素は、親要素の終端で一緒に閉じる
+func (p *mkvStreamParser) popExpiredContainers() error {
+	n := len(p.stack)
+	for i := len(p.stack) - 1; i >= 0; i-- {
+		if !p.stack[i].unknownSize && p.offset >= p.stack[i].end {
+			n = i
 		}
+	}
+	return p.popContainers(n)
+}
+
+// popContainers はstackの上からn個を残して要素を閉じる
+func (p *mkvStreamParser) popContainers(n int) error {
+	for len(p.stack) > n {
+		last := p.stack[len(p.stack)-1]
 		p.stack = p.stack[:len(p.stack)-1]
-		p.onContainerEnd(last.id)
+		if last.crc != nil {
+			p.finishCRC(last)
+		}
+		if err := p.onContainerEnd(last.id); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (p *mkvStreamParser) closeRemainingContainers() {
+func (p *mkvStreamParser) closeRemainingContainers() error {
+	// 終端まで読めなかった要素のCRC-32は検証しない
+	defer func() {
+		p.stack = p.stack[:0]
+		p.crcActive = 0
+	}()
 	for i := len(p.stack) - 1; i >= 0; i-- {
-		p.onContainerEnd(p.stack[i].id)
+		if err := p.onContainerEnd(p.stack[i].id); err != nil {
+			return err
+		}
 	}
-	p.stack = p.stack[:0]
+	return nil
 }
 
-func (p *mkvStreamParser) onContainerEnd(id uint64) {
+func (p *mkvStreamParser) onContainerEnd(id uint64) error {
 	switch id {
 	case ebmlIDTrackEntry:
 		switch p.currentTrackType {
 		case "V_UNCOMPRESSED", "V_VP8", "V_VP9":
+			encodings, err := p.trackEncodings()
+			if err != nil {
+				return err
+			}
 			p.reader.videoTrackNumber = p.currentTrackNumber
+			p.reader.videoCodec = p.currentTrackType
+			p.reader.videoEncodings = encodings
 			DebugLog("Video track number: %d, codec: %s\n", p.currentTrackNumber, p.currentTrackType)
 		case "A_OPUS", "A_PCM/INT/LIT":
+			if p.audioFound {
+				DebugLog("Ignoring additional audio track number: %d, codec: %s\n", p.currentTrackNumber, p.currentTrackType)
+				break
+			}
+			encodings, err := p.trackEncodings()
+			if err != nil {
+				return err
+			}
+			p.audioFound = true
 			p.reader.audioTrackNumber = p.currentTrackNumber
 			p.reader.audioCodec = p.currentTrackType
+			p.reader.audioEncodings = encodings
 			DebugLog("Audio track number: %d, codec: %s\n", p.currentTrackNumber, p.currentTrackType)
 		}
 		p.inTrackEntry = false
@@ -261,15 +632,36 @@ func (p *mkvStreamParser) onContainerEnd(id uint64) {
 		p.inVideo = false
 	case ebmlIDAudio:
 		p.inAudio = false
+	case ebmlIDCluster:
+		p.inCluster = false
+	case ebmlIDSimpleTag:
+		if len(p.simpleTags) == 0 {
+			break
+		}
+		index := p.simpleTags[len(p.simpleTags)-1]
+		p.simpleTags = p.simpleTags[:len(p.simpleTags)-1]
+		// TagNameの無いSimpleTagは不正なため除く
+		if p.reader.tags[index].Name == "" {
+			p.reader.tags = append(p.reader.tags[:index], p.reader.tags[index+1:]...)
+		}
+	case ebmlIDBlockGroup:
+		p.inBlockGroup = false
+		if p.pendingBlock != nil {
+			data := p.pendingBlock
+			p.pendingBlock = nil
+			// ReferenceBlockを持たないBlockはキーフレーム
+			return p.handleBlock(data, !p.blockHasReference, p.blockDuration)
+		}
 	}
+	return nil
 }
 
 func (p *mkvStreamParser) handleElementData(id uint64, size int64) error {
 	if size < 0 {
-		return fmt.Errorf("invalid negative element size: id=%x size=%d", id, size)
+		return fmt.Errorf("%w: invalid negative element size: id=%x size=%d", errMKVDesync, id, size)
 	}
 	if size > maxReasonableFieldSize && id != ebmlIDSimpleBlock && id != ebmlIDBlock {
-		return fmt.Errorf("unexpectedly large element: id=%x size=%d", id, size)
+		return fmt.Errorf("%w: unexpectedly large element: id=%x size=%d", errMKVDesync, id, size)
 	}
 
 	switch id {
@@ -353,6 +745,21 @@ func (p *mkvStreamParser) handleElementData(id uint64, size int64) error {
 		}
 		return nil
 
+	case ebmlIDTagName, ebmlIDTagString:
+		value, err := p.readString(size)
+		if err != nil {
+			return err
+		}
+		if len(p.simpleTags) > 0 {
+			tag := &p.reader.tags[p.simpleTags[len(p.simpleTags)-1]]
+			if id == ebmlIDTagName {
+				tag.Name = value
+			} else {
+				tag.Value = value
+			}
+		}
+		return nil
+
 	case ebmlIDColourSpace:
 		value, err := p.readString(size)
 		if err != nil {
@@ -364,39 +771,143 @@ func (p *mkvStreamParser) handleElementData(id uint64, size int64) error {
 		}
 		return nil
 
-	case ebmlIDSimpleBlock, ebmlIDBlock:
+	case ebmlIDSimpleBlock:
+		if skip, err := p.checkBlockSize(size); skip || err != nil {
+			return err
+		}
+		data, err := p.readBytes(size)
+		if err != nil {
+			return err
+		}
+		return p.handleBlock(data, false, -1)
+
+	case ebmlIDBlock:
+		if skip, err := p.checkBlockSize(size); skip || err != nil {
+			return err
+		}
 		data, err := p.readBytes(size)
 		if err != nil {
 			return err
 		}
-		return p.handleSimpleBlock(data)
+		if p.inBlockGroup {
+			p.pendingBlock = data
+			return nil
+		}
+		// サイズ不定のBlockGroupは終端が分からないため、BlockDurationを待たずに処理する
+		return p.handleBlock(data, true, -1)
+
+	case ebmlIDBlockDuration:
+		value, err := p.readUnsignedInt(size)
+		if err != nil {
+			return err
+		}
+		if p.inBlockGroup {
+			p.blockDuration = int64(value)
+		}
+		return nil
+
+	case ebmlIDReferenceBlock:
+		if p.inBlockGroup {
+			p.blockHasReference = true
+		}
+		return p.discard(size)
+
+	case ebmlIDCRC32:
+		value, err := p.readBytes(size)
+		if err != nil {
+			return err
+		}
+		p.startCRC(value)
+		return nil
+
+	case ebmlIDContentOrder, ebmlIDContentScope, ebmlIDContentType, ebmlIDContentCompAlgo:
+		value, err := p.readUnsignedInt(size)
+		if err != nil {
+			return err
+		}
+		if p.inTrackEntry && len(p.encodings) > 0 {
+			encoding := &p.encodings[len(p.encodings)-1]
+			switch id {
+			case ebmlIDContentOrder:
+				encoding.order = value
+			case ebmlIDContentScope:
+				encoding.scope = value
+			case ebmlIDContentType:
+				encoding.typ = value
+			case ebmlIDContentCompAlgo:
+				encoding.algo = value
+			}
+		}
+		return nil
+
+	case ebmlIDContentCompSet:
+		value, err := p.readBytes(size)
+		if err != nil {
+			return err
+		}
+		if p.inTrackEntry && len(p.encodings) > 0 {
+			p.encodings[len(p.encodings)-1].settings = value
+		}
+		return nil
+
+	case ebmlIDContentEncrypt:
+		// 暗号化されたトラックはContentEncodingTypeで判定し、読み込む場合はエラーとする
+		if p.inTrackEntry && len(p.encodings) > 0 {
+			p.encodings[len(p.encodings)-1].typ = mkvEncodingTypeEncryption
+		}
+		return p.discard(size)
 
 	default:
 		return p.discard(size)
 	}
 }
 
-func (p *mkvStreamParser) handleSimpleBlock(data []byte) error {
+// checkBlockSize はBlockのデータを確保する前に --max-block-size を確認する
+// 上限を超えるBlockは、読み込まないトラックのものであればバッファせずに読み飛ばし（skip=true）、
+// 映像・音声トラックのものであればErrBlockTooLargeを返す
+func (p *mkvStreamParser) checkBlockSize(size int64) (skip bool, err error) {
+	limit := p.reader.maxBlockSize
+	if limit <= 0 || size <= limit {
+		return false, nil
+	}
+	header, _ := p.br.Peek(int(min(size, maxEBMLSizeVintBytes)))
+	trackNum, trackNumSize := parseVint(header)
+	if trackNumSize == 0 {
+		return false, fmt.Errorf("%w: invalid track number in block", errMKVDesync)
+	}
+	if int64(trackNum) != p.reader.videoTrackNumber && int64(trackNum) != p.reader.audioTrackNumber {
+		DebugLog("Skipping %d byte block on unused track %d\n", size, trackNum)
+		return true, p.discard(size)
+	}
+	return false, fmt.Errorf("%w: %d bytes on track %d at offset %d exceeds --max-block-size %d",
+		ErrBlockTooLarge, size, trackNum, p.elementStart, limit)
+}
+
+// handleBlock はSimpleBlockまたはBlockGroup内のBlockを解析してフレームを送る
+// SimpleBlockのキーフレームはflagsで判定し、BlockはReferenceBlockがない場合にkeyframe=trueで呼ばれる
+// durationTicksはBlockDuration（なければ-1）で、lacingされた各フレームに分配する
+func (p *mkvStreamParser) handleBlock(data []byte, keyframe bool, durationTicks int64) error {
 	if len(data) < 4 {
-		return fmt.Errorf("simple block too short")
+		return fmt.Errorf("%w: simple block too short", errMKVDesync)
 	}
 
 	trackNum, trackNumSize := parseVint(data)
 	if trackNumSize == 0 {
-		return fmt.Errorf("invalid track number in simple block")
+		return fmt.Errorf("%w: invalid track number in simple block", errMKVDesync)
 	}
 	if len(data) < trackNumSize+3 {
-		return fmt.Errorf("simple block too short after track number")
+		return fmt.Errorf("%w: simple block too short after track number", errMKVDesync)
 	}
 
 	relativeTs := int16(binary.BigEndian.Uint16(data[trackNumSize : trackNumSize+2]))
 	flags := data[trackNumSize+2]
-	isKeyframe := (flags & 0x80) != 0
+	isKeyframe := (flags&0x80) != 0 || keyframe
 	lacingMode := int((flags & 0x06) >> 1)
 	frameData := data[trackNumSize+3:]
 	clusterTimeMs := p.scaleTicksToMilliseconds(p.currentClusterTime)
 	blockRelativeTsMs := p.scaleTicksToMilliseconds(int64(relativeTs))
-	timestampMs := clusterTimeMs + blockRelativeTsMs
+	// tickのまま加算してから変換し、1ms未満のscaleで端数の切り捨てが二重にならないようにする
+	timestampMs := p.scaleTicksToMilliseconds(p.currentClusterTime + int64(relativeTs))
 
 	var frameType FrameType
 	switch int64(trackNum) {
@@ -410,18 +921,45 @@ func (p *mkvStreamParser) handleSimpleBlock(data []byte) error {
 
 	frames, err := p.parseLacedFrames(frameData, lacingMode)
 	if err != nil {
-		return err
+		return fmt.Errorf("%w: %v", errMKVDesync, err)
 	}
 	if len(frames) == 0 {
 		return nil
 	}
+	// ContentEncodingはlacingされた各フレームに個別に適用されている
+	if err := p.decodeFrames(frameType, frames); err != nil {
+		return fmt.Errorf("track %d at offset %d: %w", trackNum, p.elementStart, err)
+	}
+
+	// BlockDurationがある場合はそれを正とし、各フレームの長さの比で分配する
+	// 累積の比から各フレームの開始時刻を求めるため、フレームの長さの合計はBlockDurationに一致する
+	if durationTicks >= 0 && len(frames) > 1 {
+		startTicks := p.currentClusterTime + int64(relativeTs)
+		weights, total := p.lacedFrameWeights(frameType, frames)
+		var cumulative int64
+		for idx, payload := range frames {
+			frame := &Frame{
+				Type:              frameType,
+				Data:              payload,
+				TimestampMs:       nonNegativeTimestampMs(p.scaleTicksToMilliseconds(startTicks + durationTicks*cumulative/total)),
+				IsKeyframe:        isKeyframe && idx == 0,
+				ClusterTimeMs:     clusterTimeMs,
+				BlockRelativeTsMs: blockRelativeTsMs,
+			}
+			if err := p.sendFrame(frame); err != nil {
+				return err
+			}
+			cumulative += weights[idx]
+		}
+		return nil
+	}
 
 	runningTsMs := timestampMs
 	for idx, payload := range frames {
 		frame := &Frame{
 			Type:              frameType,
 			Data:              payload,
-			TimestampMs:       runningTsMs,
+			TimestampMs:       nonNegativeTimestampMs(runningTsMs),
 			IsKeyframe:        isKeyframe && idx == 0,
 			ClusterTimeMs:     clusterTimeMs,
 			BlockRelativeTsMs: blockRelativeTsMs,
@@ -443,6 +981,76 @@ func (p *mkvStreamParser) handleSimpleBlock(data []byte) error {
 	return nil
 }
 
+// trackEncodings は読み込み中のTrackEntryのContentEncodingを、フレームを復元する順で返す
+func (p *mkvStreamParser) trackEncodings() ([]mkvContentEncoding, error) {
+	encodings, err := frameContentEncodings(p.encodings)
+	if err != nil {
+		return nil, fmt.Errorf("track %d (%s): %w", p.currentTrackNumber, p.currentTrackType, err)
+	}
+	for _, encoding := range encodings {
+		DebugLog("Track %d frames use %s (order %d)\n", p.currentTrackNumber, compAlgoName(encoding.algo), encoding.order)
+	}
+	return encodings, nil
+}
+
+// decodeFrames はトラックのContentEncodingを逆に適用してframesを元のフレームに置き換える
+// 展開後のサイズも --max-block-size（0で無制限）までとする
+func (p *mkvStreamParser) decodeFrames(frameType FrameType, frames [][]byte) error {
+	encodings := p.reader.videoEncodings
+	if frameType == FrameTypeAudio {
+		encodings = p.reader.audioEncodings
+	}
+	if len(encodings) == 0 {
+		return nil
+	}
+	limit := p.reader.maxBlockSize
+	if limit <= 0 {
+		limit = math.MaxInt64 - 1
+	}
+	for i, payload := range frames {
+		decoded, err := decodeContent(payload, encodings, limit)
+		if err != nil {
+			return err
+		}
+		frames[i] = decoded
+	}
+	return nil
+}
+
+// nonNegativeTimestampMs は0より前のPTSを0に切り上げる
+// 最初のClusterで負の相対timecodeを持つBlock（コーデックの先読み分など）はPTSが負になるが、
+// PacerはPTSの後退を再同期として扱い、パケタイザはuint32への変換でRTPタイムスタンプが大きく巻き戻るため
+func nonNegativeTimestampMs(timestampMs int64) int64 {
+	if timestampMs < 0 {
+		DebugLogPeriodic("mkv.negative_pts", time.Second, "MKV block before time 0: PTS=%dms clamped to 0ms\n", timestampMs)
+		return 0
+	}
+	return timestampMs
+}
+
+// lacedFrameWeights はBlockDurationを分配するための各フレームの長さの比と合計を返す
+// PCMはサンプル数（バイト数に比例）、Opusはパケットの想定長で、それ以外は均等に分ける
+func (p *mkvStreamParser) lacedFrameWeights(frameType FrameType, frames [][]byte) ([]int64, int64) {
+	weights := make([]int64, len(frames))
+	var total int64
+	for i, payload := range frames {
+		switch {
+		case frameType == FrameTypeAudio && p.reader.audioCodec == "A_PCM/INT/LIT":
+			weights[i] = int64(len(payload))
+		case frameType == FrameTypeAudio && p.reader.audioCodec == "A_OPUS":
+			weights[i] = estimateOpusPacketDurationMs(payload)
+		}
+		total += weights[i]
+	}
+	if total > 0 {
+		return weights, total
+	}
+	for i := range weights {
+		weights[i] = 1
+	}
+	return weights, int64(len(frames))
+}
+
 func (p *mkvStreamParser) scaleTicksToMilliseconds(ticks int64) int64 {
 	if ticks == 0 {
 		return 0
@@ -721,12 +1329,29 @@ func (p *mkvStreamParser) sendFrame(frame *Frame) error {
 	}
 }
 
-func (p *mkvStreamParser) readElementID() (uint64, error) {
-	first, err := p.readByte()
+// peekElementHeader は要素のIDとサイズを読み進めずに解析し、ヘッダーのバイト数を返す
+// 要素が不正だった場合に、その先頭から再同期できるようにするため
+func (p *mkvStreamParser) peekElementHeader() (id uint64, size int64, unknownSize bool, headerLen int, err error) {
+	buf, err := p.br.Peek(maxEBMLIDVintBytes + maxEBMLSizeVintBytes)
+	if len(buf) == 0 {
+		return 0, 0, false, 0, err
+	}
+
+	id, idLen, err := parseElementID(buf)
 	if err != nil {
-		return 0, err
+		return 0, 0, false, 0, err
+	}
+	size, unknownSize, sizeLen, err := parseElementSize(buf[idLen:])
+	if err != nil {
+		return 0, 0, false, 0, err
 	}
+	return id, size, unknownSize, idLen + sizeLen, nil
+}
 
+// parseElementID はbufの先頭のEBML要素IDを解析する
+// bufが途中で終わっている場合は、ストリームの終端としてio.EOFを返す
+func parseElementID(buf []byte) (uint64, int, error) {
+	first := buf[0]
 	length := 1
 	mask := byte(0x80)
 	for length <= maxEBMLIDVintBytes && (first&mask) == 0 {
@@ -734,27 +1359,25 @@ func (p *mkvStreamParser) readElementID() (uint64, error) {
 		length++
 	}
 	if length > maxEBMLIDVintBytes {
-		return 0, fmt.Errorf("invalid element ID first byte: 0x%02x", first)
+		return 0, 0, fmt.Errorf("%w: invalid element ID first byte: 0x%02x", errMKVDesync, first)
+	}
+	if len(buf) < length {
+		return 0, 0, io.EOF
 	}
 
 	id := uint64(first)
 	for i := 1; i < length; i++ {
-		b, err := p.readByte()
-		if err != nil {
-			return 0, err
-		}
-		id = (id << 8) | uint64(b)
+		id = (id << 8) | uint64(buf[i])
 	}
-
-	return id, nil
+	return id, length, nil
 }
 
-func (p *mkvStreamParser) readElementSize() (int64, bool, error) {
-	first, err := p.readByte()
-	if err != nil {
-		return 0, false, err
+// parseElementSize はbufの先頭のEBML要素サイズを解析する
+func parseElementSize(buf []byte) (int64, bool, int, error) {
+	if len(buf) == 0 {
+		return 0, false, 0, io.EOF
 	}
-
+	first := buf[0]
 	length := 1
 	mask := byte(0x80)
 	for length <= maxEBMLSizeVintBytes && (first&mask) == 0 {
@@ -762,16 +1385,16 @@ func (p *mkvStreamParser) readElementSize() (int64, bool, error) {
 		length++
 	}
 	if length > maxEBMLSizeVintBytes {
-		return 0, false, fmt.Errorf("invalid size first byte: 0x%02x", first)
+		return 0, false, 0, fmt.Errorf("%w: invalid size first byte: 0x%02x", errMKVDesync, first)
+	}
+	if len(buf) < length {
+		return 0, false, 0, io.EOF
 	}
 
 	value := uint64(first & (mask - 1))
 	unknown := value == uint64(mask-1)
 	for i := 1; i < length; i++ {
-		b, err := p.readByte()
-		if err != nil {
-			return 0, false, err
-		}
+		b := buf[i]
 		value = (value << 8) | uint64(b)
 		if b != 0xFF {
 			unknown = false
@@ -779,13 +1402,13 @@ func (p *mkvStreamParser) readElementSize() (int64, bool, error) {
 	}
 
 	if unknown {
-		return 0, true, nil
+		return 0, true, length, nil
 	}
 	if value > math.MaxInt64 {
-		return 0, false, fmt.Errorf("element size too large: %d", value)
+		return 0, false, 0, fmt.Errorf("%w: element size too large: %d", errMKVDesync, value)
 	}
 
-	return int64(value), false, nil
+	return int64(value), false, length, nil
 }
 
 func (p *mkvStreamParser) readByte() (byte, error) {
@@ -794,6 +1417,9 @@ func (p *mkvStreamParser) readByte() (byte, error) {
 		return 0, err
 	}
 	p.offset++
+	if p.crcActive > 0 {
+		p.hashCRC([]byte{b})
+	}
 	return b, nil
 }
 
@@ -810,6 +1436,7 @@ func (p *mkvStreamParser) readBytes(size int64) ([]byte, error) {
 		return nil, err
 	}
 	p.offset += size
+	p.hashCRC(buf)
 	return buf, nil
 }
 
@@ -821,7 +1448,11 @@ func (p *mkvStreamParser) discard(size int64) error {
 		return fmt.Errorf("invalid discard size: %d", size)
 	}
 
-	n, err := io.CopyN(io.Discard, p.br, size)
+	var dst io.Writer = io.Discard
+	if p.crcActive > 0 {
+		dst = crcSink{p}
+	}
+	n, err := io.CopyN(dst, p.br, size)
 	p.offset += n
 	if err != nil {
 		return err
@@ -832,6 +1463,61 @@ func (p *mkvStreamParser) discard(size int64) error {
 	return nil
 }
 
+// startCRC は親要素の先頭にあるCRC-32要素の値を読み、親要素の残りの内容の検証を始める
+// Matroskaの規定どおり先頭の子要素のみを対象とし、サイズ不定の親要素のCRC-32は検証しない
+func (p *mkvStreamParser) startCRC(value []byte) {
+	if len(value) != 4 || len(p.stack) == 0 {
+		return
+	}
+	parent := &p.stack[len(p.stack)-1]
+	if p.elementStart != parent.start || parent.crc != nil || parent.unknownSize {
+		return
+	}
+	parent.crc = crc32.NewIEEE()
+	parent.crcWant = binary.LittleEndian.Uint32(value)
+	p.crcActive++
+}
+
+// finishCRC は親要素の終端で計算したCRC-32を格納されていた値と比較する
+func (p *mkvStreamParser) finishCRC(c mkvContainer) {
+	p.crcActive--
+	p.reader.crcChecked++
+	if got := c.crc.Sum32(); got != c.crcWant {
+		p.reader.crcMismatches++
+		fmt.Fprintf(os.Stderr, "MKV: CRC-32 mismatch in element 0x%X at offset %d (stored %08x, computed %08x)\n", c.id, c.start, c.crcWant, got)
+	}
+}
+
+// stopCRCs は再同期で読み飛ばしたバイトが混ざるため、検証中のCRC-32をすべて破棄する
+func (p *mkvStreamParser) stopCRCs() {
+	for i := range p.stack {
+		p.stack[i].crc = nil
+	}
+	p.crcActive = 0
+}
+
+// hashCRC は読み進めたバイトを検証中のCRC-32に加える
+func (p *mkvStreamParser) hashCRC(data []byte) {
+	if p.crcActive == 0 {
+		return
+	}
+	for i := range p.stack {
+		if p.stack[i].crc != nil {
+			p.stack[i].crc.Write(data)
+		}
+	}
+}
+
+// crcSink はdiscardで読み飛ばすバイトを検証中のCRC-32に加える
+type crcSink struct {
+	p *mkvStreamParser
+}
+
+func (s crcSink) Write(data []byte) (int, error) {
+	s.p.hashCRC(data)
+	return len(data), nil
+}
+
 func (p *mkvStreamParser) readUnsignedInt(size int64) (uint64, error) {
 	if size <= 0 || size > 8 {
 		return 0, fmt.Errorf("invalid integer size: %d", size)
@@ -0,0 +1,114 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"runtime/debug"
+	"strings"
+)
+
+// Matroska Tags element IDs
+const (
+	tagsElement     = 0x1254C367
+	tagElement      = 0x7373
+	targetsElement  = 0x63C0
+	simpleTag       = 0x67C8
+	tagName         = 0x45A3
+	tagString       = 0x4487
+	mkvTitleTagName = "TITLE"
+	mkvURLTagName   = "URL"
+	mkvAppName      = "go-webrtc-whep-client"
+)
+
+// Version はMKVのMuxingApp/WritingAppのデフォルトに付けるバージョン
+// ビルド時に -ldflags "-X github.com/Azunyan1111/go-webrtc-whep-client/internal.Version=v1.2.3" で指定できる
+// 未指定の場合は go install で埋め込まれたモジュールのバージョン、それも無ければ"dev"
+var Version = ""
+
+// DefaultAppName は --muxing-app/--writing-app のデフォルト（"go-webrtc-whep-client <バージョン>"）を返す
+func DefaultAppName() string {
+	version := Version
+	if version == "" {
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			version = info.Main.Version
+		}
+	}
+	if version == "" {
+		version = "dev"
+	}
+	return mkvAppName + " " + version
+}
+
+// MKVTag はMatroskaのSimpleTag（名前と文字列の値）
+type MKVTag struct {
+	Name  string
+	Value string
+}
+
+// ParseMKVTags は --title と --tag の値（KEY=VALUE）から書き込むタグを作る
+// --title はTITLEタグとして先頭に置き、--tag は指定した順に続ける
+func ParseMKVTags(title string, tags []string) ([]MKVTag, error) {
+	var result []MKVTag
+	if title != "" {
+		result = append(result, MKVTag{Name: mkvTitleTagName, Value: title})
+	}
+	for _, tag := range tags {
+		name, value, ok := strings.Cut(tag, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid --tag: %q (use KEY=VALUE, e.g. ARTIST=Alice)", tag)
+		}
+		result = append(result, MKVTag{Name: name, Value: value})
+	}
+	return result, nil
+}
+
+// WithSourceURLTag はtagsに録画元のWHEP URLをURLタグとして加える
+// URLに含まれるユーザー情報とクエリ（トークンを含むことがある）は書き込まない
+// --tag でURLを指定済みの場合はそちらを優先する
+func WithSourceURLTag(tags []MKVTag, source string) []MKVTag {
+	if source == "" {
+		return tags
+	}
+	for _, tag := range tags {
+		if strings.EqualFold(tag.Name, mkvURLTagName) {
+			return tags
+		}
+	}
+	if parsed, err := url.Parse(source); err == nil {
+		parsed.User = nil
+		parsed.RawQuery = ""
+		parsed.ForceQuery = false
+		parsed.Fragment = ""
+		source = parsed.String()
+	}
+	return append(tags, MKVTag{Name: mkvURLTagName, Value: source})
+}
+
+// writeTags はタグをSegment全体を対象とする1つのTagとしてTags要素に書き込む
+// Targetsを空にすると対象はSegment全体（TargetTypeValue 50）になる
+func (w *RawVideoMKVWriter) writeTags() error {
+	tagData := &bytes.Buffer{}
+	if err := w.writeEBMLElement(tagData, targetsElement, nil); err != nil {
+		return err
+	}
+	for _, tag := range w.tags {
+		simpleTagData := &bytes.Buffer{}
+		if err := w.writeEBMLElement(simpleTagData, tagName, []byte(tag.Name)); err != nil {
+			return err
+		}
+		if err := w.writeEBMLElement(simpleTagData, tagString, []byte(tag.Value)); err != nil {
+			return err
+		}
+		if err := w.writeEBMLElement(tagData, simpleTag, simpleTagData.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	tagsData := &bytes.Buffer{}
+	if err := w.writeEBMLElement(tagsData, tagElement, tagData.Bytes()); err != nil {
+		return err
+	}
+	return w.writeEBMLElement(w.writer, tagsElement, tagsData.Bytes())
+}
@@ -0,0 +1,177 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+const mkvTagsFrames = 10
+
+var (
+	tracksID  = []byte{0x16, 0x54, 0xAE, 0x6B}
+	tagsID    = []byte{0x12, 0x54, 0xC3, 0x67}
+	clusterID = []byte{0x1F, 0x43, 0xB6, 0x75}
+)
+
+// mkvTagsWriteAudio はtagsを --title/--tag として音声のみのMKVを書き込む
+func mkvTagsWriteAudio(tags []MKVTag) ([]byte, error) {
+	saved := MKVTags
+	MKVTags = tags
+	defer func() { MKVTags = saved }()
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	writer.SetAudioOnly()
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+	for i := 0; i < mkvTagsFrames; i++ {
+		if err := writer.WriteAudioFrame(opusSilence, uint32(i*960)); err != nil {
+			return nil, fmt.Errorf("audio frame %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// simpleTagBytes はnameとvalueのSimpleTag要素の期待するバイト列を作る（各要素は127バイト未満）
+func simpleTagBytes(name, value string) []byte {
+	content := append([]byte{0x45, 0xA3, 0x80 | byte(len(name))}, name...)
+	content = append(content, 0x44, 0x87, 0x80|byte(len(value)))
+	content = append(content, value...)
+	return append([]byte{0x67, 0xC8, 0x80 | byte(len(content))}, content...)
+}
+
+// TestMKVTagsParse は --title をTITLEタグとして先頭に置き、--tag をKEY=VALUEとして解析することを検証する
+func TestMKVTagsParse(t *testing.T) {
+	tags, err := ParseMKVTags("Weekly meeting", []string{"ARTIST=Alice", "COMMENT=a=b", "EMPTY="})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MKVTag{
+		{Name: "TITLE", Value: "Weekly meeting"},
+		{Name: "ARTIST", Value: "Alice"},
+		{Name: "COMMENT", Value: "a=b"},
+		{Name: "EMPTY", Value: ""},
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Fatalf("got %v, want %v", tags, want)
+	}
+	if tags, err := ParseMKVTags("", nil); err != nil || len(tags) != 0 {
+		t.Fatalf("got %v, %v without --title and --tag, want no tags", tags, err)
+	}
+	for _, invalid := range []string{"ARTIST", "=Alice", " =Alice"} {
+		if _, err := ParseMKVTags("", []string{invalid}); err == nil {
+			t.Fatalf("--tag %q accepted", invalid)
+		}
+	}
+}
+
+// TestMKVTagsWrite はTracksと最初のClusterの間にTags要素を書き込み、
+// SimpleTagのTagName/TagStringがUTF-8のまま格納され、MKVReaderで読み戻せることを検証する
+func TestMKVTagsWrite(t *testing.T) {
+	tags := []MKVTag{
+		{Name: "TITLE", Value: "定例会議"},
+		{Name: "ARTIST", Value: "Alice"},
+	}
+	data, err := mkvTagsWriteAudio(tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tracksAt := bytes.Index(data, tracksID)
+	tagsAt := bytes.Index(data, tagsID)
+	clusterAt := bytes.Index(data, clusterID)
+	if tracksAt < 0 || tagsAt < 0 || clusterAt < 0 {
+		t.Fatalf("Tracks at %d, Tags at %d, Cluster at %d: element missing", tracksAt, tagsAt, clusterAt)
+	}
+	if !(tracksAt < tagsAt && tagsAt < clusterAt) {
+		t.Fatalf("Tags at %d is not between Tracks at %d and the first Cluster at %d", tagsAt, tracksAt, clusterAt)
+	}
+	header := data[tagsAt:clusterAt]
+	for _, tag := range tags {
+		if !bytes.Contains(header, simpleTagBytes(tag.Name, tag.Value)) {
+			t.Fatalf("SimpleTag %s=%s not encoded as TagName/TagString", tag.Name, tag.Value)
+		}
+	}
+	// Targetsが空のTag（Segment全体が対象）
+	if !bytes.Contains(header, []byte{0x63, 0xC0, 0x80}) {
+		t.Fatalf("empty Targets not found in Tag")
+	}
+
+	report, err := ValidateMKV(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Tags, tags) {
+		t.Fatalf("read back %v, want %v", report.Tags, tags)
+	}
+	var printed bytes.Buffer
+	report.Print(&printed)
+	if !bytes.Contains(printed.Bytes(), []byte("Tag: TITLE=定例会議\n")) {
+		t.Fatalf("mkv-validate output does not list the title:\n%s", printed.String())
+	}
+}
+
+// TestMKVTagsNoTags はタグを指定しない場合にTags要素を書き込まないことを検証する
+func TestMKVTagsNoTags(t *testing.T) {
+	data, err := mkvTagsWriteAudio(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, tagsID) {
+		t.Fatalf("Tags element written without --title or --tag")
+	}
+	report, err := ValidateMKV(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Tags) != 0 {
+		t.Fatalf("read back %v, want no tags", report.Tags)
+	}
+}
+
+// TestMKVTagsConcatenatedSegments は再接続で続いたSegmentのタグが前のSegmentのタグを置き換えることと、
+// 入れ子のSimpleTagを親の直後に読むことを検証する
+func TestMKVTagsConcatenatedSegments(t *testing.T) {
+	first, err := mkvTagsWriteAudio([]MKVTag{{Name: "TITLE", Value: "first"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := mkvTagsWriteAudio([]MKVTag{{Name: "TITLE", Value: "second"}, {Name: "ARTIST", Value: "Bob"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := ValidateMKV(bytes.NewReader(append(first, second...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []MKVTag{{Name: "TITLE", Value: "second"}, {Name: "ARTIST", Value: "Bob"}}
+	if !reflect.DeepEqual(report.Tags, want) {
+		t.Fatalf("read back %v from two Segments, want %v", report.Tags, want)
+	}
+
+	// ARTIST=Bob の中にSORT_WITH=Bobを入れ子にしたSimpleTag
+	nested := simpleTagBytes("SORT_WITH", "Bob")
+	outer := append(simpleTagBytes("ARTIST", "Bob")[3:], nested...)
+	outer = append([]byte{0x67, 0xC8, 0x80 | byte(len(outer))}, outer...)
+	tag := append([]byte{0x73, 0x73, 0x80 | byte(len(outer))}, outer...)
+	tagsElement := append(append([]byte{}, tagsID...), 0x80|byte(len(tag)))
+	tagsElement = append(tagsElement, tag...)
+	clusterAt := bytes.Index(first, clusterID)
+	data := append(append(append([]byte{}, first[:clusterAt]...), tagsElement...), first[clusterAt:]...)
+	report, err = ValidateMKV(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = []MKVTag{{Name: "TITLE", Value: "first"}, {Name: "ARTIST", Value: "Bob"}, {Name: "SORT_WITH", Value: "Bob"}}
+	if !reflect.DeepEqual(report.Tags, want) {
+		t.Fatalf("read back %v with a nested SimpleTag, want %v", report.Tags, want)
+	}
+}
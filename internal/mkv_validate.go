@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MKVTrackStats はValidateMKVで集計した1トラック分の統計
+type MKVTrackStats struct {
+	Frames         int
+	Keyframes      int
+	FirstMs        int64
+	LastMs         int64
+	Backwards      int   // 直前のフレームより前に戻ったタイムスタンプの数
+	FirstBackward  int   // 最初に戻ったフレームの番号（0始まり、Backwardsが0の場合は-1）
+	BackwardFromMs int64 // 最初に戻ったときの直前のタイムスタンプ
+	BackwardToMs   int64 // 最初に戻ったときのタイムスタンプ
+}
+
+// MKVReport はValidateMKVの結果
+type MKVReport struct {
+	VideoCodec      string
+	Width           int
+	Height          int
+	PixelFormat     string
+	AudioCodec      string
+	AudioSampleRate int
+	AudioChannels   int
+	Tags            []MKVTag
+	Video           MKVTrackStats
+	Audio           MKVTrackStats
+	// キーフレーム間隔（映像のキーフレームが2つ以上ある場合のみ有効）
+	KeyframeIntervals  int
+	MinKeyframeGapMs   int64
+	MaxKeyframeGapMs   int64
+	TotalKeyframeGapMs int64
+	MaxKeyframeGap     int // キーフレーム間の最大フレーム数
+	// V_UNCOMPRESSEDでPixelFormatと解像度から求めたサイズに一致しないフレーム
+	SizeMismatches int
+	MismatchSize   int
+	MismatchGuess  string
+	Resyncs        int
+	CRCChecked     int // CRC-32要素を検証した親要素の数
+	CRCMismatches  int
+	Err            error // 解析に失敗した場合のエラー（それまでの集計は有効）
+}
+
+// ValidateMKV はストリームをMKVReaderで最後まで読み、トラック情報とフレームの統計を返す
+// 解析に失敗した場合もそれまでの集計を返し、エラーはReport.Errにも格納する
+func ValidateMKV(r io.Reader) (*MKVReport, error) {
+	reader := NewMKVReader(r)
+	reader.Start()
+
+	report := &MKVReport{}
+	report.Video.FirstBackward = -1
+	report.Audio.FirstBackward = -1
+	lastKeyframeMs := int64(-1)
+	framesSinceKeyframe := 0
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			report.Err = err
+			break
+		}
+		stats := &report.Audio
+		if frame.Type == FrameTypeVideo {
+			stats = &report.Video
+		}
+		stats.add(frame)
+
+		if frame.Type != FrameTypeVideo {
+			continue
+		}
+		framesSinceKeyframe++
+		if frame.IsKeyframe {
+			if lastKeyframeMs >= 0 {
+				report.addKeyframeGap(frame.TimestampMs-lastKeyframeMs, framesSinceKeyframe)
+			}
+			lastKeyframeMs = frame.TimestampMs
+			framesSinceKeyframe = 0
+		}
+		if reader.VideoCodec() == "V_UNCOMPRESSED" && len(frame.Data) != RawFrameSize(reader.PixelFormat(), reader.VideoWidth(), reader.VideoHeight()) {
+			if report.SizeMismatches == 0 {
+				report.MismatchSize = len(frame.Data)
+				report.MismatchGuess = GuessPixelFormat(len(frame.Data), reader.VideoWidth(), reader.VideoHeight())
+			}
+			report.SizeMismatches++
+		}
+	}
+
+	report.VideoCodec = reader.VideoCodec()
+	report.Width = reader.VideoWidth()
+	report.Height = reader.VideoHeight()
+	report.PixelFormat = reader.PixelFormat()
+	report.AudioCodec = reader.AudioCodec()
+	report.AudioSampleRate = reader.AudioSampleRate()
+	report.AudioChannels = reader.AudioChannels()
+	report.Tags = reader.Tags()
+	report.Resyncs = reader.Resyncs()
+	report.CRCChecked = reader.CRCChecked()
+	report.CRCMismatches = reader.CRCMismatches()
+	if report.Err == nil && report.VideoCodec == "" && report.AudioCodec == "" {
+		report.Err = fmt.Errorf("no video or audio track found")
+	}
+	if report.Err == nil && report.CRCMismatches > 0 {
+		report.Err = fmt.Errorf("%d of %d CRC-32 checks failed", report.CRCMismatches, report.CRCChecked)
+	}
+	return report, report.Err
+}
+
+func (s *MKVTrackStats) add(frame *Frame) {
+	if s.Frames == 0 {
+		s.FirstMs = frame.TimestampMs
+	} else if frame.TimestampMs < s.LastMs {
+		if s.Backwards == 0 {
+			s.FirstBackward = s.Frames
+			s.BackwardFromMs = s.LastMs
+			s.BackwardToMs = frame.TimestampMs
+		}
+		s.Backwards++
+	}
+	s.Frames++
+	if frame.IsKeyframe {
+		s.Keyframes++
+	}
+	s.LastMs = frame.TimestampMs
+}
+
+func (r *MKVReport) addKeyframeGap(gapMs int64, frames int) {
+	if r.KeyframeIntervals == 0 || gapMs < r.MinKeyframeGapMs {
+		r.MinKeyframeGapMs = gapMs
+	}
+	if r.KeyframeIntervals == 0 || gapMs > r.MaxKeyframeGapMs {
+		r.MaxKeyframeGapMs = gapMs
+	}
+	r.MaxKeyframeGap = max(r.MaxKeyframeGap, frames)
+	r.TotalKeyframeGapMs += gapMs
+	r.KeyframeIntervals++
+}
+
+// Print はレポートを人が読める形式で書き出す
+func (r *MKVReport) Print(w io.Writer) {
+	if r.VideoCodec != "" {
+		fmt.Fprintf(w, "Video track: %s %dx%d", r.VideoCodec, r.Width, r.Height)
+		if r.VideoCodec == "V_UNCOMPRESSED" {
+			fmt.Fprintf(w, " %s", r.PixelFormat)
+		}
+		fmt.Fprintln(w)
+	} else {
+		fmt.Fprintln(w, "Video track: none")
+	}
+	if r.AudioCodec != "" {
+		fmt.Fprintf(w, "Audio track: %s %dHz %dch\n", r.AudioCodec, r.AudioSampleRate, r.AudioChannels)
+	} else {
+		fmt.Fprintln(w, "Audio track: none")
+	}
+	for _, tag := range r.Tags {
+		fmt.Fprintf(w, "Tag: %s=%s\n", tag.Name, tag.Value)
+	}
+	r.Video.print(w, "Video")
+	r.Audio.print(w, "Audio")
+	if r.KeyframeIntervals > 0 {
+		fmt.Fprintf(w, "Keyframe interval: min %dms, max %dms, avg %dms (max %d frames)\n",
+			r.MinKeyframeGapMs, r.MaxKeyframeGapMs, r.TotalKeyframeGapMs/int64(r.KeyframeIntervals), r.MaxKeyframeGap)
+	} else if r.Video.Frames > 0 {
+		fmt.Fprintf(w, "Keyframe interval: n/a (%d keyframes)\n", r.Video.Keyframes)
+	}
+	if r.SizeMismatches > 0 {
+		fmt.Fprintf(w, "Warning: %d video frames do not match %dx%d %s (first is %d bytes", r.SizeMismatches, r.Width, r.Height, r.PixelFormat, r.MismatchSize)
+		if r.MismatchGuess != "" {
+			fmt.Fprintf(w, ", which matches %s; try --input-pixel-format %s", r.MismatchGuess, r.MismatchGuess)
+		}
+		fmt.Fprintln(w, ")")
+	}
+	if r.Resyncs > 0 {
+		fmt.Fprintf(w, "Warning: recovered from %d corrupted element sizes\n", r.Resyncs)
+	}
+	if r.CRCChecked > 0 {
+		fmt.Fprintf(w, "CRC-32: %d of %d elements OK\n", r.CRCChecked-r.CRCMismatches, r.CRCChecked)
+	}
+	if r.Err != nil {
+		fmt.Fprintf(w, "Result: FAILED: %v\n", r.Err)
+		return
+	}
+	fmt.Fprintln(w, "Result: OK")
+}
+
+func (s *MKVTrackStats) print(w io.Writer, kind string) {
+	if s.Frames == 0 {
+		fmt.Fprintf(w, "%s frames: 0\n", kind)
+		return
+	}
+	fmt.Fprintf(w, "%s frames: %d (%d keyframes), %dms - %dms\n", kind, s.Frames, s.Keyframes, s.FirstMs, s.LastMs)
+	if s.Backwards > 0 {
+		fmt.Fprintf(w, "Warning: %s timestamps went backwards %d times (first at frame %d: %dms after %dms)\n",
+			kind, s.Backwards, s.FirstBackward, s.BackwardToMs, s.BackwardFromMs)
+	}
+}
@@ -0,0 +1,176 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strings"
+	"testing"
+)
+
+const (
+	mkvValidateWidth  = 64
+	mkvValidateHeight = 48
+)
+
+// mkvValidateBlock はCluster先頭からの相対時刻relMsのSimpleBlockを作る
+func mkvValidateBlock(track byte, relMs int, keyframe bool, data []byte) []byte {
+	flags := byte(0)
+	if keyframe {
+		flags = 0x80
+	}
+	header := []byte{0x80 | track, byte(relMs >> 8), byte(relMs), flags}
+	return element(0xA3, header, data)
+}
+
+// mkvValidateVideoFrame は映像トラックの1フレーム
+type mkvValidateVideoFrame struct {
+	ms       int
+	keyframe bool
+}
+
+// mkvValidateMakeMKV はYUV420Pのrawvideo（colourSpaceが空の場合はColourSpaceを省略）とPCM音声のMKVを作る
+// 映像はframes、音声は20msごとにaudioFrames個を1つのClusterに書く
+func mkvValidateMakeMKV(colourSpace string, frames []mkvValidateVideoFrame, audioFrames int) []byte {
+	video := [][]byte{element(0xB0, uintData(mkvValidateWidth)), element(0xBA, uintData(mkvValidateHeight))}
+	if colourSpace != "" {
+		video = append(video, element(0x2EB524, []byte(colourSpace)))
+	}
+	parts := [][]byte{
+		element(0x1A45DFA3, element(0x4282, []byte("matroska"))),
+		append(idBytes(0x18538067), unknownSize...),
+		element(0x1549A966, element(0x2AD7B1, uintData(1000000))),
+		element(0x1654AE6B,
+			element(0xAE,
+				element(0xD7, uintData(1)),
+				element(0x86, []byte("V_UNCOMPRESSED")),
+				element(0xE0, video...),
+			),
+			element(0xAE,
+				element(0xD7, uintData(2)),
+				element(0x86, []byte("A_PCM/INT/LIT")),
+				element(0xE1, element(0xB5, binary.BigEndian.AppendUint64(nil, 0x40E7700000000000)), element(0x9F, uintData(2))),
+			),
+		),
+		append(idBytes(0x1F43B675), unknownSize...),
+		element(0xE7, uintData(0)),
+	}
+	yuv := make([]byte, mkvValidateWidth*mkvValidateHeight*3/2)
+	for _, frame := range frames {
+		parts = append(parts, mkvValidateBlock(1, frame.ms, frame.keyframe, yuv))
+	}
+	pcm := make([]byte, 48*20*2*2)
+	for i := 0; i < audioFrames; i++ {
+		parts = append(parts, mkvValidateBlock(2, i*20, true, pcm))
+	}
+	return bytes.Join(parts, nil)
+}
+
+// steadyFrames は30fpsでkeyframeEvery枚ごとにキーフレームを置いたn枚の映像フレームを作る
+func steadyFrames(n, keyframeEvery int) []mkvValidateVideoFrame {
+	frames := make([]mkvValidateVideoFrame, n)
+	for i := range frames {
+		frames[i] = mkvValidateVideoFrame{ms: i * 100 / 3, keyframe: i%keyframeEvery == 0}
+	}
+	return frames
+}
+
+// TestMKVValidateValid は正常な入力のトラック情報、フレーム数、キーフレーム間隔を検証する
+func TestMKVValidateValid(t *testing.T) {
+	report, err := ValidateMKV(bytes.NewReader(mkvValidateMakeMKV("YUV420P", steadyFrames(30, 10), 50)))
+	if err != nil {
+		t.Fatalf("valid input failed: %v", err)
+	}
+	if report.VideoCodec != "V_UNCOMPRESSED" || report.Width != mkvValidateWidth || report.Height != mkvValidateHeight || report.PixelFormat != "YUV420P" {
+		t.Fatalf("video track %s %dx%d %s", report.VideoCodec, report.Width, report.Height, report.PixelFormat)
+	}
+	if report.AudioCodec != "A_PCM/INT/LIT" || report.AudioSampleRate != 48000 || report.AudioChannels != 2 {
+		t.Fatalf("audio track %s %dHz %dch", report.AudioCodec, report.AudioSampleRate, report.AudioChannels)
+	}
+	if report.Video.Frames != 30 || report.Video.Keyframes != 3 || report.Audio.Frames != 50 {
+		t.Fatalf("counted %d video (%d keyframes) and %d audio frames, want 30 (3) and 50",
+			report.Video.Frames, report.Video.Keyframes, report.Audio.Frames)
+	}
+	if report.Video.FirstMs != 0 || report.Video.LastMs != 966 || report.Audio.LastMs != 980 {
+		t.Fatalf("timestamp ranges video %d-%dms audio %d-%dms",
+			report.Video.FirstMs, report.Video.LastMs, report.Audio.FirstMs, report.Audio.LastMs)
+	}
+	if report.Video.Backwards != 0 || report.Audio.Backwards != 0 {
+		t.Fatalf("monotonic input reported %d/%d backwards steps", report.Video.Backwards, report.Audio.Backwards)
+	}
+	if report.KeyframeIntervals != 2 || report.MinKeyframeGapMs != 333 || report.MaxKeyframeGapMs != 333 || report.MaxKeyframeGap != 10 {
+		t.Fatalf("keyframe intervals: %d gaps, min %dms, max %dms, max %d frames",
+			report.KeyframeIntervals, report.MinKeyframeGapMs, report.MaxKeyframeGapMs, report.MaxKeyframeGap)
+	}
+	if report.SizeMismatches != 0 || report.Resyncs != 0 {
+		t.Fatalf("unexpected warnings: %d size mismatches, %d resyncs", report.SizeMismatches, report.Resyncs)
+	}
+	var out bytes.Buffer
+	report.Print(&out)
+	if !strings.HasSuffix(out.String(), "Result: OK\n") || strings.Contains(out.String(), "Warning") {
+		t.Fatalf("unexpected report:\n%s", out.String())
+	}
+}
+
+// TestMKVValidateBackwards は前に戻った映像タイムスタンプを検出することを検証する
+func TestMKVValidateBackwards(t *testing.T) {
+	frames := steadyFrames(10, 5)
+	frames[6].ms = 100
+	report, err := ValidateMKV(bytes.NewReader(mkvValidateMakeMKV("YUV420P", frames, 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := report.Video
+	if v.Backwards != 1 || v.FirstBackward != 6 || v.BackwardFromMs != 166 || v.BackwardToMs != 100 {
+		t.Fatalf("backwards=%d first=%d (%dms after %dms), want 1 at frame 6 (100ms after 166ms)",
+			v.Backwards, v.FirstBackward, v.BackwardToMs, v.BackwardFromMs)
+	}
+	var out bytes.Buffer
+	report.Print(&out)
+	if !strings.Contains(out.String(), "Video timestamps went backwards 1 times") {
+		t.Fatalf("report does not mention the backwards timestamp:\n%s", out.String())
+	}
+}
+
+// TestMKVValidateSizeMismatch はColourSpaceの無いYUV420P入力でサイズの不一致と推定形式を報告することを検証する
+func TestMKVValidateSizeMismatch(t *testing.T) {
+	report, err := ValidateMKV(bytes.NewReader(mkvValidateMakeMKV("", steadyFrames(3, 1), 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.PixelFormat != "RGBA" || report.SizeMismatches != 3 || report.MismatchGuess != "YUV420P" {
+		t.Fatalf("pixel format %s, %d mismatches, guess %q", report.PixelFormat, report.SizeMismatches, report.MismatchGuess)
+	}
+	var out bytes.Buffer
+	report.Print(&out)
+	if !strings.Contains(out.String(), "--input-pixel-format YUV420P") {
+		t.Fatalf("report does not suggest --input-pixel-format:\n%s", out.String())
+	}
+}
+
+// TestMKVValidateTruncated は途中で切れた入力がエラーになり、それまでの集計が残ることを検証する
+func TestMKVValidateTruncated(t *testing.T) {
+	data := mkvValidateMakeMKV("YUV420P", steadyFrames(5, 5), 0)
+	report, err := ValidateMKV(bytes.NewReader(data[:len(data)-100]))
+	if err == nil {
+		t.Fatalf("truncated input passed")
+	}
+	if !errors.Is(report.Err, err) || report.Video.Frames != 4 {
+		t.Fatalf("report has error %v and %d video frames, want the returned error and 4 frames", report.Err, report.Video.Frames)
+	}
+	var out bytes.Buffer
+	report.Print(&out)
+	if !strings.Contains(out.String(), "Result: FAILED") {
+		t.Fatalf("report does not show the failure:\n%s", out.String())
+	}
+}
+
+// TestMKVValidateNoTracks は空の入力やMKVでない入力がエラーになることを検証する
+func TestMKVValidateNoTracks(t *testing.T) {
+	if _, err := ValidateMKV(bytes.NewReader(nil)); err == nil {
+		t.Fatalf("empty input passed")
+	}
+	if _, err := ValidateMKV(strings.NewReader("this is not a matroska file")); err == nil {
+		t.Fatalf("text input passed")
+	}
+}
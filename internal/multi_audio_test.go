@@ -0,0 +1,428 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	multiAudioWidth       = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	multiAudioHeight      = 360
+	multiAudioVideoFrames = 10
+)
+
+// multiAudioOpusPacket はトラックを区別するためのマーカーを末尾に付けた20msのOpusパケット
+func multiAudioOpusPacket(marker byte) []byte {
+	return []byte{0xF8, 0xFF, 0xFE, marker}
+}
+
+func readUint(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// mkvTrack はTrackEntryから読み取ったトラック情報
+type mkvTrack struct {
+	num, uid uint64
+	codec    string
+}
+
+// scanMKV はTrackEntryとトラック番号ごとのSimpleBlockのデータを集める
+// Segment/Tracks/TrackEntry/Clusterの中へ入り、それ以外の要素は読み飛ばす
+func scanMKV(data []byte) ([]mkvTrack, map[uint64][][]byte, error) {
+	var tracks []mkvTrack
+	blocks := map[uint64][][]byte{}
+	for len(data) > 0 {
+		id, n := readVint(data, true)
+		size, m := readVint(data[n:], false)
+		if n == 0 || m == 0 {
+			return nil, nil, fmt.Errorf("malformed element header")
+		}
+		data = data[n+m:]
+		switch id {
+		case idSegment, idTracks, idCluster:
+			continue
+		case idTrackEntry:
+			tracks = append(tracks, mkvTrack{})
+			continue
+		}
+		if uint64(len(data)) < size {
+			return nil, nil, fmt.Errorf("element 0x%X truncated", id)
+		}
+		value := data[:size]
+		data = data[size:]
+		switch id {
+		case idTrackNumber:
+			tracks[len(tracks)-1].num = readUint(value)
+		case idTrackUID:
+			tracks[len(tracks)-1].uid = readUint(value)
+		case idCodecID:
+			tracks[len(tracks)-1].codec = string(value)
+		case idSimpleBlock:
+			num, k := readVint(value, false)
+			if k == 0 || len(value) < k+3 {
+				return nil, nil, fmt.Errorf("malformed SimpleBlock")
+			}
+			blocks[num] = append(blocks[num], value[k+3:])
+		}
+	}
+	return tracks, blocks, nil
+}
+
+// multiAudioWriteMKV はaudioTracks個の音声トラックを追加したRawVideoMKVWriterで映像と音声を書き込んだ出力を返す
+// i番目の音声トラックにはマーカーiのOpusパケットを書き込む
+func multiAudioWriteMKV(layout TrackLayout, audioTracks int) ([]byte, error) {
+	encoder, err := NewVP8Encoder(multiAudioWidth, multiAudioHeight, "YUV420P", 500)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	if err := writer.SetTrackLayout(layout); err != nil {
+		return nil, err
+	}
+	for i := 0; i < audioTracks; i++ {
+		index, err := writer.AddAudioTrack()
+		if err != nil {
+			return nil, fmt.Errorf("audio track %d: %v", i, err)
+		}
+		if index != i {
+			return nil, fmt.Errorf("audio track %d got index %d", i, index)
+		}
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	yuv := bytes.Repeat([]byte{0x80}, multiAudioWidth*multiAudioHeight*3/2)
+	for i := 0; i < multiAudioVideoFrames; i++ {
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		if err := writer.WriteVideoFrame(encoded, uint32(i*3000), keyframe); err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		if i == 0 && audioTracks > 0 {
+			// ヘッダー書き込み後は2つ目以降の音声トラックを追加できない
+			if _, err := writer.AddAudioTrack(); err == nil {
+				return nil, fmt.Errorf("AddAudioTrack succeeded after the MKV header was written")
+			}
+		}
+		for track := 0; track < max(audioTracks, 1); track++ {
+			if err := writer.WriteAudioTrackFrame(track, multiAudioOpusPacket(byte(track)), uint32(i*1920)); err != nil {
+				return nil, fmt.Errorf("audio track %d frame %d: %v", track, i, err)
+			}
+		}
+	}
+	if err := writer.WriteAudioTrackFrame(max(audioTracks, 1), multiAudioOpusPacket(0xFF), 0); !errors.Is(err, ErrFrameDropped) {
+		return nil, fmt.Errorf("write to an unknown audio track returned %v, want ErrFrameDropped", err)
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// checkTracks はMKVの音声トラックの番号・UIDと、各トラックに対応するマーカーのブロックが書かれたことを検証する
+func checkTracks(data []byte, wantNums, wantUIDs []uint64) error {
+	tracks, blocks, err := scanMKV(data)
+	if err != nil {
+		return err
+	}
+	var audio []mkvTrack
+	for _, track := range tracks {
+		if track.codec == "A_OPUS" {
+			audio = append(audio, track)
+		}
+	}
+	if len(audio) != len(wantNums) {
+		return fmt.Errorf("%d audio TrackEntries, want %d", len(audio), len(wantNums))
+	}
+	for i, track := range audio {
+		if track.num != wantNums[i] || track.uid != wantUIDs[i] {
+			return fmt.Errorf("audio track %d is number %d UID %d, want %d and %d", i, track.num, track.uid, wantNums[i], wantUIDs[i])
+		}
+		if len(blocks[track.num]) == 0 {
+			return fmt.Errorf("no blocks for audio track %d", track.num)
+		}
+		for _, block := range blocks[track.num] {
+			if !bytes.Equal(block, multiAudioOpusPacket(byte(i))) {
+				return fmt.Errorf("audio track %d contains block %X, want %X", track.num, block, multiAudioOpusPacket(byte(i)))
+			}
+		}
+	}
+	return nil
+}
+
+// TestMultiAudioParse は --audio-tracks の値の解釈を検証する
+func TestMultiAudioParse(t *testing.T) {
+	for value, want := range map[string]int{"all": AudioTracksAllIndex, "first": 0, "0": 0, "1": 1, "3": 3} {
+		index, err := ParseAudioTracks(value)
+		if err != nil || index != want {
+			t.Fatalf("%q parsed as %d (%v), want %d", value, index, err, want)
+		}
+	}
+	for _, value := range []string{"-1", "4", "second", "1,2"} {
+		if _, err := ParseAudioTracks(value); err == nil {
+			t.Fatalf("%q was accepted", value)
+		}
+	}
+}
+
+// TestMultiAudioWriter は3つの音声トラックが既定のトラック番号・UIDに続く番号で書き込まれることを検証する
+func TestMultiAudioWriter(t *testing.T) {
+	data, err := multiAudioWriteMKV(DefaultTrackLayout, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTracks(data, []uint64{2, 3, 4}, []uint64{2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMultiAudioWriterLayout は追加の音声トラックが映像のトラック番号・UIDを飛ばして割り当てられることを検証する
+func TestMultiAudioWriterLayout(t *testing.T) {
+	layout := TrackLayout{VideoNum: 3, AudioNum: 2, VideoUID: 1001, AudioUID: 1000}
+	data, err := multiAudioWriteMKV(layout, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTracks(data, []uint64{2, 4, 5}, []uint64{1000, 1002, 1003}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMultiAudioSingle はAddAudioTrackを呼ばない場合も従来どおり音声トラックを1つ書き込むことを検証する
+func TestMultiAudioSingle(t *testing.T) {
+	data, err := multiAudioWriteMKV(DefaultTrackLayout, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTracks(data, []uint64{2}, []uint64{2}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMultiAudioReader はMKVReaderが複数の音声トラックのうち最初のトラックのみを読むことを検証する
+func TestMultiAudioReader(t *testing.T) {
+	data, err := multiAudioWriteMKV(DefaultTrackLayout, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	audio := 0
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if frame.Type != FrameTypeAudio {
+			continue
+		}
+		if !bytes.Equal(frame.Data, multiAudioOpusPacket(0)) {
+			t.Fatalf("read audio frame %X from another track", frame.Data)
+		}
+		audio++
+	}
+	if audio == 0 {
+		t.Fatalf("no audio frames read")
+	}
+}
+
+// audioRecorder は音声トラックごとに受信したフレームのマーカーを記録するStreamWriter
+type audioRecorder struct {
+	mu      sync.Mutex
+	tracks  int
+	markers map[int]map[byte]int
+}
+
+func (w *audioRecorder) AddAudioTrack() (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.tracks++
+	return w.tracks - 1, nil
+}
+
+func (w *audioRecorder) WriteAudioTrackFrame(index int, data []byte, timestamp uint32) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.markers[index] == nil {
+		w.markers[index] = map[byte]int{}
+	}
+	w.markers[index][data[len(data)-1]]++
+	return nil
+}
+
+func (w *audioRecorder) WriteAudioFrame(data []byte, timestamp uint32) error {
+	return w.WriteAudioTrackFrame(0, data, timestamp)
+}
+
+func (w *audioRecorder) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	return nil
+}
+
+func (w *audioRecorder) Run() error   { return nil }
+func (w *audioRecorder) Close() error { return nil }
+
+// snapshot はトラックのインデックスごとに、受信したマーカーの一覧を返す
+func (w *audioRecorder) snapshot() map[int][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	result := map[int][]byte{}
+	for index, markers := range w.markers {
+		for marker := range markers {
+			result[index] = append(result[index], marker)
+		}
+	}
+	return result
+}
+
+// multiAudioNewSender は2つのOpus音声トラック（マーカー0と1）を送信するPeerConnectionを作成する
+func multiAudioNewSender() (*webrtc.PeerConnection, []*webrtc.TrackLocalStaticRTP, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, nil, err
+	}
+	var tracks []*webrtc.TrackLocalStaticRTP
+	for _, id := range []string{"program", "commentary"} {
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, id, id)
+		if err != nil {
+			peerConnection.Close()
+			return nil, nil, err
+		}
+		if _, err := peerConnection.AddTrack(track); err != nil {
+			peerConnection.Close()
+			return nil, nil, err
+		}
+		tracks = append(tracks, track)
+	}
+	return peerConnection, tracks, nil
+}
+
+// multiAudioLoopback は --audio-tracks に value を指定して2つの音声トラックを受信し、writerのトラックごとのマーカーを返す
+func multiAudioLoopback(value string, wantTracks int) (map[int][]byte, error) {
+	index, err := ParseAudioTracks(value)
+	if err != nil {
+		return nil, err
+	}
+	AudioTrackIndex = index
+	defer func() { AudioTrackIndex = 0 }()
+
+	writer := &audioRecorder{markers: map[int]map[byte]int{}}
+	streamManager := NewStreamManager(writer, NewDefaultRTPProcessor(), 0, nil)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, err
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		return nil, err
+	}
+	defer receiver.Close()
+	senderPC, tracks, err := multiAudioNewSender()
+	if err != nil {
+		return nil, err
+	}
+	defer senderPC.Close()
+
+	if err := connect(receiver, senderPC); err != nil {
+		return nil, err
+	}
+
+	go streamManager.Run()
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	defer func() {
+		receiver.Close()
+		streamManager.Stop()
+	}()
+
+	// SRTPの準備完了前のパケットは破棄されるため、期待するトラック数の音声を受信するまで送り続ける
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; time.Now().Before(deadline); i++ {
+		for marker, track := range tracks {
+			packet := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * 960)},
+				Payload: multiAudioOpusPacket(byte(marker)),
+			}
+			if err := track.WriteRTP(packet); err != nil {
+				return nil, err
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		if received := writer.snapshot(); len(received) >= wantTracks && i >= 30 {
+			break
+		}
+	}
+	return writer.snapshot(), nil
+}
+
+// checkLoopback はwantのマーカーがそれぞれ別のwriterトラック（0から連番）に書き込まれたことを検証する
+// writerのトラックの順序はトラックの受信開始順のため、マーカーとの対応は問わない
+func checkLoopback(value string, want []byte) error {
+	received, err := multiAudioLoopback(value, len(want))
+	if err != nil {
+		return err
+	}
+	if len(received) != len(want) {
+		return fmt.Errorf("--audio-tracks %s: frames written to %d tracks (%v), want %d", value, len(received), received, len(want))
+	}
+	seen := map[byte]bool{}
+	for i := range want {
+		if len(received[i]) != 1 {
+			return fmt.Errorf("--audio-tracks %s: track %d received markers %v, want a single source", value, i, received[i])
+		}
+		seen[received[i][0]] = true
+	}
+	for _, marker := range want {
+		if !seen[marker] {
+			return fmt.Errorf("--audio-tracks %s: marker %d not written (%v)", value, marker, received)
+		}
+	}
+	return nil
+}
+
+// TestMultiAudioLoopbackAll は --audio-tracks all で2つの音声トラックがそれぞれ別のwriterトラックに書き込まれることを検証する
+func TestMultiAudioLoopbackAll(t *testing.T) {
+	if err := checkLoopback("all", []byte{0, 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMultiAudioLoopbackFirst は --audio-tracks first で最初の音声トラックのみが書き込まれることを検証する
+func TestMultiAudioLoopbackFirst(t *testing.T) {
+	if err := checkLoopback("first", []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestMultiAudioLoopbackIndex は --audio-tracks 1 で2番目の音声トラックのみが書き込まれることを検証する
+func TestMultiAudioLoopbackIndex(t *testing.T) {
+	if err := checkLoopback("1", []byte{1}); err != nil {
+		t.Fatal(err)
+	}
+}
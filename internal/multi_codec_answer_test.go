@@ -0,0 +1,303 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	multiCodecAnswerVideoTicks = 3000 // 30fps（90kHz）
+	multiCodecAnswerFrameStep  = 33 * time.Millisecond
+)
+
+// ペイロードデスクリプタとフレームの先頭
+var (
+	// VP9: B/Eビット（1パケットで1フレーム）、キーフレームはP=0
+	vp9Keyframe = []byte{0x0C, 0x82, 0x49, 0x83, 0x42, 0x00, 0x27, 0xF0, 0x16, 0x70}
+	vp9Delta    = []byte{0x4C, 0x86, 0x00, 0x40, 0x92, 0x00, 0x00, 0x00, 0x00, 0x00}
+	// VP8: Sビット、キーフレームはframe tagのbit0=0とsync code
+	multiCodecAnswerVP8Keyframe = []byte{0x10, 0x50, 0x42, 0x00, 0x9D, 0x01, 0x2A, 0x80, 0x02, 0x68, 0x01}
+	vp8Delta                    = []byte{0x10, 0x51, 0x42, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+)
+
+// rawTrack はパケットごとにペイロードタイプを選んで送れるTrackLocal
+// TrackLocalStaticRTPはバインドしたコーデックのPTで送るため、送信側がPTでコーデックを切り替える動作を再現できない
+type rawTrack struct {
+	mu     sync.Mutex
+	writer webrtc.TrackLocalWriter
+	codecs []webrtc.RTPCodecParameters
+	ssrc   webrtc.SSRC
+	seq    uint16
+}
+
+func (t *rawTrack) Bind(ctx webrtc.TrackLocalContext) (webrtc.RTPCodecParameters, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.writer = ctx.WriteStream()
+	t.codecs = ctx.CodecParameters()
+	t.ssrc = ctx.SSRC()
+	return t.codecs[0], nil
+}
+
+func (t *rawTrack) Unbind(webrtc.TrackLocalContext) error { return nil }
+func (t *rawTrack) ID() string                            { return "video" }
+func (t *rawTrack) RID() string                           { return "" }
+func (t *rawTrack) StreamID() string                      { return "test" }
+func (t *rawTrack) Kind() webrtc.RTPCodecType             { return webrtc.RTPCodecTypeVideo }
+
+// payloadType はネゴシエーションされたmimeTypeのペイロードタイプを返す
+func (t *rawTrack) payloadType(mimeType string) (uint8, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, codec := range t.codecs {
+		if strings.EqualFold(codec.MimeType, mimeType) {
+			return uint8(codec.PayloadType), nil
+		}
+	}
+	return 0, fmt.Errorf("%s was not negotiated", mimeType)
+}
+
+// send はmimeTypeのペイロードタイプで1パケット（1フレーム）を送る
+func (t *rawTrack) send(mimeType string, payload []byte, timestamp uint32) error {
+	pt, err := t.payloadType(mimeType)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.writer == nil {
+		return fmt.Errorf("track is not bound")
+	}
+	header := &rtp.Header{
+		Version:        2,
+		Marker:         true,
+		PayloadType:    pt,
+		SequenceNumber: t.seq,
+		Timestamp:      timestamp,
+		SSRC:           uint32(t.ssrc),
+	}
+	t.seq++
+	_, err = t.writer.WriteRTP(header, payload)
+	return err
+}
+
+// multiCodecAnswerVideoFrame はwriterに渡された映像フレーム
+type multiCodecAnswerVideoFrame struct {
+	codec    string // 書き込み時にwriterに設定されていたコーデック
+	keyframe bool
+}
+
+// multiCodecAnswerRecordingWriter は設定されたコーデックと映像フレームを記録するStreamWriter
+type multiCodecAnswerRecordingWriter struct {
+	mu     sync.Mutex
+	codec  string
+	codecs []string
+	frames []multiCodecAnswerVideoFrame
+}
+
+func (w *multiCodecAnswerRecordingWriter) SetVideoCodec(codecType string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.codec = codecType
+	w.codecs = append(w.codecs, codecType)
+}
+
+func (w *multiCodecAnswerRecordingWriter) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.frames = append(w.frames, multiCodecAnswerVideoFrame{codec: w.codec, keyframe: keyframe})
+	return nil
+}
+func (w *multiCodecAnswerRecordingWriter) WriteAudioFrame(data []byte, timestamp uint32) error {
+	return nil
+}
+func (w *multiCodecAnswerRecordingWriter) Run() error   { return nil }
+func (w *multiCodecAnswerRecordingWriter) Close() error { return nil }
+
+func (w *multiCodecAnswerRecordingWriter) state() ([]string, []multiCodecAnswerVideoFrame) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.codecs...), append([]multiCodecAnswerVideoFrame(nil), w.frames...)
+}
+
+// multiCodecAnswerSession はVP8とVP9の両方をanswerする送信側とのループバック接続
+type multiCodecAnswerSession struct {
+	receiver      *webrtc.PeerConnection
+	sender        *webrtc.PeerConnection
+	track         *rawTrack
+	writer        *multiCodecAnswerRecordingWriter
+	streamManager *StreamManager
+	mediaReceived chan struct{}
+	negotiated    []string
+	frame         int
+}
+
+func multiCodecAnswerNewSession() (*multiCodecAnswerSession, error) {
+	s := &multiCodecAnswerSession{writer: &multiCodecAnswerRecordingWriter{}, track: &rawTrack{}, mediaReceived: make(chan struct{}, 1)}
+	s.streamManager = NewStreamManager(s.writer, NewDefaultRTPProcessor(), 0, s.mediaReceived)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, err
+	}
+	s.receiver, err = CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), s.streamManager)
+	if err != nil {
+		return nil, err
+	}
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		s.close()
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	s.sender, err = api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	if _, err := s.sender.AddTrack(s.track); err != nil {
+		s.close()
+		return nil, err
+	}
+	if err := connect(s.receiver, s.sender); err != nil {
+		s.close()
+		return nil, err
+	}
+	s.negotiated = NegotiatedVideoCodecs(s.receiver)
+	go s.streamManager.Run()
+	return s, nil
+}
+
+func (s *multiCodecAnswerSession) close() {
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	if s.receiver != nil {
+		s.receiver.Close()
+	}
+	if s.sender != nil {
+		s.sender.Close()
+	}
+	s.streamManager.Stop()
+}
+
+// send は次のフレームをmimeTypeのペイロードタイプで送る
+func (s *multiCodecAnswerSession) send(mimeType string, payload []byte) error {
+	err := s.track.send(mimeType, payload, uint32(s.frame*multiCodecAnswerVideoTicks))
+	s.frame++
+	return err
+}
+
+// start は最初のメディアが届くまでmimeTypeのキーフレームを送り続ける
+// SRTPの準備完了前のパケットは破棄されるため
+func (s *multiCodecAnswerSession) start(mimeType string, keyframe []byte) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no media received within 5s")
+		}
+		if err := s.send(mimeType, keyframe); err != nil {
+			return err
+		}
+		select {
+		case <-s.mediaReceived:
+			return nil
+		case <-time.After(multiCodecAnswerFrameStep):
+		}
+	}
+}
+
+// sendFrames は最初にキーフレーム、続けてn-1枚のデルタフレームをmimeTypeのペイロードタイプで送る
+func (s *multiCodecAnswerSession) sendFrames(mimeType string, keyframe, delta []byte, n int) error {
+	for i := 0; i < n; i++ {
+		payload := delta
+		if i == 0 {
+			payload = keyframe
+		}
+		if err := s.send(mimeType, payload); err != nil {
+			return err
+		}
+		time.Sleep(multiCodecAnswerFrameStep)
+	}
+	time.Sleep(200 * time.Millisecond)
+	return nil
+}
+
+// TestMultiCodecAnswerVP9PayloadType はanswerがVP8とVP9を含み、RTPがVP9のPTで届いた場合に、
+// --codec auto（answerの先頭はVP8）でもwriterがVP9として受信することを検証する
+func TestMultiCodecAnswerVP9PayloadType(t *testing.T) {
+	s, err := multiCodecAnswerNewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	if len(s.negotiated) != 2 {
+		t.Fatalf("answer negotiated %v, want both VP8 and VP9", s.negotiated)
+	}
+	if codec, err := SelectVideoCodec(VideoCodecAuto, s.negotiated, false); err != nil || codec != "vp8" {
+		t.Fatalf("--codec auto selected %q, %v from %v, want vp8 (answer order)", codec, err, s.negotiated)
+	}
+	if err := s.start(webrtc.MimeTypeVP9, vp9Keyframe); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sendFrames(webrtc.MimeTypeVP9, vp9Keyframe, vp9Delta, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	codecs, frames := s.writer.state()
+	if len(codecs) != 1 || codecs[0] != "vp9" {
+		t.Fatalf("writer codec set to %v, want [vp9] from the RTP payload type", codecs)
+	}
+	if len(frames) < 10 {
+		t.Fatalf("writer received %d frames, want at least 10", len(frames))
+	}
+	for i, frame := range frames {
+		if frame.codec != "vp9" {
+			t.Fatalf("frame %d written as %s, want vp9", i, frame.codec)
+		}
+	}
+}
+
+// TestMultiCodecAnswerSwitch は送信側が途中でVP8のPTに切り替えた場合に、writerのコーデックを切り替え、
+// VP8のキーフレームから書き込みを再開することを検証する
+func TestMultiCodecAnswerSwitch(t *testing.T) {
+	s, err := multiCodecAnswerNewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.close()
+
+	if err := s.start(webrtc.MimeTypeVP9, vp9Keyframe); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sendFrames(webrtc.MimeTypeVP9, vp9Keyframe, vp9Delta, 5); err != nil {
+		t.Fatal(err)
+	}
+	_, before := s.writer.state()
+	// 切り替え直後のデルタフレームは新しいコーデックのキーフレームまで書き込まれない
+	if err := s.send(webrtc.MimeTypeVP8, vp8Delta); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sendFrames(webrtc.MimeTypeVP8, multiCodecAnswerVP8Keyframe, vp8Delta, 5); err != nil {
+		t.Fatal(err)
+	}
+
+	codecs, frames := s.writer.state()
+	if strings.Join(codecs, ",") != "vp9,vp8" {
+		t.Fatalf("writer codec set to %v, want [vp9 vp8]", codecs)
+	}
+	after := frames[len(before):]
+	if len(after) != 5 {
+		t.Fatalf("writer received %d frames after the switch, want 5 (from the VP8 keyframe)", len(after))
+	}
+	for i, frame := range after {
+		if frame.codec != "vp8" || frame.keyframe != (i == 0) {
+			t.Fatalf("frame %d after the switch: %+v, want vp8 with keyframe=%v", i, frame, i == 0)
+		}
+	}
+}
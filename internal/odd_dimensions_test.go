@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+const (
+	oddDimensionsWidth  = 641
+	oddDimensionsHeight = 361
+	oddDimensionsFrames = 3
+)
+
+// makeEdgeFrame は右端の列を赤、下端の行を緑、それ以外を青にしたRGBA画像を生成する
+func makeEdgeFrame() []byte {
+	rgba := make([]byte, oddDimensionsWidth*oddDimensionsHeight*4)
+	for y := 0; y < oddDimensionsHeight; y++ {
+		for x := 0; x < oddDimensionsWidth; x++ {
+			i := (y*oddDimensionsWidth + x) * 4
+			switch {
+			case x == oddDimensionsWidth-1:
+				rgba[i] = 0xFF
+			case y == oddDimensionsHeight-1:
+				rgba[i+1] = 0xFF
+			default:
+				rgba[i+2] = 0xFF
+			}
+			rgba[i+3] = 0xFF
+		}
+	}
+	return rgba
+}
+
+// decodeMKV はRawVideoMKVWriterの出力を読み戻し、解像度と最後の映像フレームを返す
+func decodeMKV(data []byte) (int, int, []byte, error) {
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	var last []byte
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			break
+		}
+		if frame.Type == FrameTypeVideo {
+			last = frame.Data
+		}
+	}
+	if last == nil {
+		return 0, 0, nil, fmt.Errorf("no video frame decoded")
+	}
+	return reader.VideoWidth(), reader.VideoHeight(), last, nil
+}
+
+// dominant はRGBA画素で最も強いチャンネル（0=R、1=G、2=B）を返す
+func dominant(rgba []byte, x, y int) int {
+	i := (y*oddDimensionsWidth + x) * 4
+	best := 0
+	for c := 1; c < 3; c++ {
+		if rgba[i+c] > rgba[i+best] {
+			best = c
+		}
+	}
+	return best
+}
+
+// TestOddDimensionsRGBA は奇数サイズのRGBA入力をエンコード・デコードし、解像度と端の列・行の色を検証する
+func TestOddDimensionsRGBA(t *testing.T) {
+	encoder, err := NewVP8Encoder(oddDimensionsWidth, oddDimensionsHeight, "RGBA", 2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	frame := makeEdgeFrame()
+	for i := 0; i < oddDimensionsFrames; i++ {
+		encoded, keyframe, err := encoder.Encode(frame)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if err := writer.WriteVideoFrame(encoded, uint32(i*3000), keyframe); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+
+	w, h, decoded, err := decodeMKV(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w != oddDimensionsWidth || h != oddDimensionsHeight {
+		t.Fatalf("decoded resolution %dx%d, want %dx%d", w, h, oddDimensionsWidth, oddDimensionsHeight)
+	}
+	if len(decoded) != oddDimensionsWidth*oddDimensionsHeight*4 {
+		t.Fatalf("decoded frame is %d bytes, want %d", len(decoded), oddDimensionsWidth*oddDimensionsHeight*4)
+	}
+	for _, y := range []int{0, oddDimensionsHeight / 2, oddDimensionsHeight - 2} {
+		if c := dominant(decoded, oddDimensionsWidth-1, y); c != 0 {
+			t.Fatalf("right edge pixel (%d,%d) is not red (dominant channel %d)", oddDimensionsWidth-1, y, c)
+		}
+	}
+	for _, x := range []int{0, oddDimensionsWidth / 2, oddDimensionsWidth - 2} {
+		if c := dominant(decoded, x, oddDimensionsHeight-1); c != 1 {
+			t.Fatalf("bottom edge pixel (%d,%d) is not green (dominant channel %d)", x, oddDimensionsHeight-1, c)
+		}
+	}
+	if c := dominant(decoded, oddDimensionsWidth/2, oddDimensionsHeight/2); c != 2 {
+		t.Fatalf("center pixel is not blue (dominant channel %d)", c)
+	}
+}
+
+// TestOddDimensionsYUV420P は奇数サイズのYUV420P入力（色差プレーンは切り上げ）を受け付けることを検証する
+func TestOddDimensionsYUV420P(t *testing.T) {
+	encoder, err := NewVP8Encoder(oddDimensionsWidth, oddDimensionsHeight, "YUV420P", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	chromaSize := ((oddDimensionsWidth + 1) / 2) * ((oddDimensionsHeight + 1) / 2)
+	frame := bytes.Repeat([]byte{0x80}, oddDimensionsWidth*oddDimensionsHeight+2*chromaSize)
+	encoded, keyframe, err := encoder.Encode(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(encoded) == 0 || !keyframe {
+		t.Fatalf("expected a keyframe, got %d bytes (keyframe=%v)", len(encoded), keyframe)
+	}
+
+	// 色差プレーンを切り捨てで計算したサイズは不正として扱う
+	if _, _, err := encoder.Encode(frame[:oddDimensionsWidth*oddDimensionsHeight+2*(oddDimensionsWidth/2)*(oddDimensionsHeight/2)]); err == nil {
+		t.Fatalf("frame with truncated chroma planes was accepted")
+	}
+}
+
+// TestOddDimensionsInvalidDimensions はVP8で表現できないサイズを拒否することを検証する
+func TestOddDimensionsInvalidDimensions(t *testing.T) {
+	for _, size := range [][2]int{{0, 360}, {640, 0}, {-2, 360}, {16384, 360}} {
+		encoder, err := NewVP8Encoder(size[0], size[1], "RGBA", 1000)
+		if err == nil {
+			encoder.Close()
+			t.Fatalf("%dx%d was accepted", size[0], size[1])
+		}
+	}
+}
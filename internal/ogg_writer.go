@@ -0,0 +1,155 @@
+package internal
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4/pkg/media/oggwriter"
+)
+
+// Ogg Opusの定数
+// グラニュール位置はOpusのRTPクロック（48kHz）をそのまま使う
+const (
+	oggOpusSampleRate = 48000
+	oggOpusChannels   = 2
+	// 再接続後のセッションは前のセッションの最後のパケットから1パケット分（20ms）進めて始める
+	oggSessionGap = oggOpusSampleRate / 50
+)
+
+// OggOpusWriter は受信したOpusパケットをデコードせずにOgg Opusとして書き込む（--audio-out の.ogg/.opus）
+// 再接続をまたいで1つのストリームになるよう、接続ごとにSessionでStreamWriterを作る
+type OggOpusWriter struct {
+	mutex         sync.Mutex
+	out           *outputWriter
+	bufWriter     *bufio.Writer
+	ogg           *oggwriter.OggWriter // 最初のパケットでOpusHead/OpusTagsとともに作る
+	lastTimestamp uint32               // 最後に書き込んだパケットの、セッションをつないだタイムスタンプ
+	flushInterval time.Duration
+}
+
+// NewOggOpusWriter は新しいOggOpusWriterを作成
+func NewOggOpusWriter(w io.Writer) *OggOpusWriter {
+	bufferSize := defaultOutputBufferSize
+	if OutputBufferSize > 0 {
+		bufferSize = OutputBufferSize
+	}
+	out := newOutputWriter(w)
+	return &OggOpusWriter{
+		out:           out,
+		bufWriter:     bufio.NewWriterSize(out, bufferSize),
+		flushInterval: time.Duration(max(FlushIntervalMs, 0)) * time.Millisecond,
+	}
+}
+
+// Session は1回の接続分のStreamWriterを作る
+func (w *OggOpusWriter) Session() *OggOpusSession {
+	return &OggOpusSession{
+		ogg:  w,
+		done: make(chan struct{}),
+	}
+}
+
+// writePacket はOpusパケットを1ページとして書き込む
+func (w *OggOpusWriter) writePacket(data []byte, timestamp uint32) error {
+	if w.ogg == nil {
+		ogg, err := oggwriter.NewWith(w.bufWriter, oggOpusSampleRate, oggOpusChannels)
+		if err != nil {
+			return fmt.Errorf("failed to write Ogg header: %w", err)
+		}
+		w.ogg = ogg
+		DebugLog("Ogg: header written (Opus %dHz %dch)\n", oggOpusSampleRate, oggOpusChannels)
+	}
+	if err := w.ogg.WriteRTP(&rtp.Packet{Header: rtp.Header{Timestamp: timestamp}, Payload: data}); err != nil {
+		return fmt.Errorf("failed to write Ogg page: %w", err)
+	}
+	w.lastTimestamp = timestamp
+	if w.flushInterval == 0 {
+		return w.bufWriter.Flush()
+	}
+	return nil
+}
+
+// flush はバッファを出力する
+func (w *OggOpusWriter) flush() error {
+	if w.out.Err() != nil || w.bufWriter.Buffered() == 0 {
+		return nil
+	}
+	if err := w.bufWriter.Flush(); err != nil {
+		return fmt.Errorf("failed to flush Ogg output: %w", err)
+	}
+	return nil
+}
+
+// OggOpusSession は1回の接続分のOgg Opus書き込みを行うStreamWriter
+// タイムスタンプは前のセッションの続きから始め、グラニュール位置が途切れないようにする
+type OggOpusSession struct {
+	ogg       *OggOpusWriter
+	started   bool
+	offset    uint32 // RTP timestampに足して、セッションをつないだタイムスタンプにする値
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// WriteVideoFrame はOggが音声のみのため映像を破棄する
+func (s *OggOpusSession) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	return nil
+}
+
+// WriteAudioFrame はOpusパケットをOggに書き込む
+func (s *OggOpusSession) WriteAudioFrame(data []byte, timestamp uint32) error {
+	w := s.ogg
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.out.Err(); err != nil {
+		return err
+	}
+	if len(data) == 0 {
+		return nil
+	}
+	if !s.started {
+		s.started = true
+		next := uint32(0)
+		if w.ogg != nil {
+			next = w.lastTimestamp + oggSessionGap
+		}
+		s.offset = next - timestamp
+	}
+	return w.writePacket(data, timestamp+s.offset)
+}
+
+// Run はCloseまで待機し、flush-intervalごとにバッファを出力する
+func (s *OggOpusSession) Run() error {
+	var tick <-chan time.Time
+	if s.ogg.flushInterval > 0 {
+		ticker := time.NewTicker(s.ogg.flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for {
+		select {
+		case <-s.done:
+			return nil
+		case <-tick:
+			s.ogg.mutex.Lock()
+			err := s.ogg.flush()
+			s.ogg.mutex.Unlock()
+			if err != nil && !errors.Is(err, ErrOutputClosed) {
+				return err
+			}
+		}
+	}
+}
+
+// Close はセッションを終了し、バッファを出力する
+func (s *OggOpusSession) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.ogg.mutex.Lock()
+	defer s.ogg.mutex.Unlock()
+	return s.ogg.flush()
+}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"fmt"
+	"time"
 
 	opus "github.com/qrtc/opus-go"
 )
@@ -10,12 +11,14 @@ import (
 type EncodedAudioFrame struct {
 	Data        []byte
 	TimestampMs int64
+	Samples     int // 48kHzでのサンプル数（0の場合はTOCから求める）
 }
 
 type OpusEncoder struct {
 	enc                 *opus.OpusEncoder
 	sampleRate          int
-	channels            int
+	channels            int // エンコードするチャンネル数（1か2）
+	inputChannels       int // 入力PCMのチャンネル数（3以上の場合はステレオにダウンミックスする）
 	frameSize           int // samples per channel per frame (10ms = sampleRate * 10 / 1000)
 	pcmBuffer           []byte
 	bufferStartTSMs     int64 // timestamp of the first sample in pcmBuffer
@@ -26,12 +29,20 @@ type OpusEncoder struct {
 	encodedFrameCounter int64
 }
 
+// NewOpusEncoder はOpusエンコーダーを作成する
+// 3〜8チャンネルの入力はWAVEチャンネル順とみなし、エンコード前にステレオへダウンミックスする
 func NewOpusEncoder(sampleRate, channels int) (*OpusEncoder, error) {
 	if sampleRate != 48000 {
 		return nil, fmt.Errorf("only 48000Hz sample rate is supported, got %d", sampleRate)
 	}
-	if channels != 1 && channels != 2 {
-		return nil, fmt.Errorf("only 1 or 2 channels are supported, got %d", channels)
+	inputChannels := channels
+	if channels > 2 {
+		if !CanDownmixToStereo(channels) {
+			return nil, fmt.Errorf("unsupported channel count %d (supported: 1-8)", channels)
+		}
+		channels = 2
+	} else if channels != 1 && channels != 2 {
+		return nil, fmt.Errorf("unsupported channel count %d (supported: 1-8)", channels)
 	}
 
 	enc, err := opus.CreateOpusEncoder(&opus.OpusEncoderConfig{
@@ -46,13 +57,14 @@ func NewOpusEncoder(sampleRate, channels int) (*OpusEncoder, error) {
 	// 10ms frame at 48000Hz
 	frameSize := sampleRate * 10 / 1000
 
-	DebugLog("Opus encoder initialized: %dHz, %d channels, frame size %d samples\n",
-		sampleRate, channels, frameSize)
+	DebugLog("Opus encoder initialized: %dHz, %d channels (input %d), frame size %d samples\n",
+		sampleRate, channels, inputChannels, frameSize)
 
 	return &OpusEncoder{
 		enc:                 enc,
 		sampleRate:          sampleRate,
 		channels:            channels,
+		inputChannels:       inputChannels,
 		frameSize:           frameSize,
 		pcmBuffer:           make([]byte, 0),
 		bufferStartTSMs:     0,
@@ -67,6 +79,15 @@ func NewOpusEncoder(sampleRate, channels int) (*OpusEncoder, error) {
 // Encode encodes PCM data to Opus frames with timestamps derived from MKV timing.
 // クラスター時刻をアンカーとして、10msごとのOpusフレームにPTSを割り当てる。
 func (e *OpusEncoder) Encode(pcm []byte, inputTimestampMs int64, clusterTimeMs int64) ([]EncodedAudioFrame, error) {
+	frames, _, err := e.EncodeCatchUp(pcm, inputTimestampMs, clusterTimeMs, 0)
+	return frames, err
+}
+
+// EncodeCatchUp はEncodeと同様にエンコードするが、送信が遅れている場合に
+// 先頭サンプル時刻が inputTimestampMs+behindMs より前の10msフレームをエンコード前に破棄する。
+// 破棄した分だけアンカー時刻を進めるため、残りのフレームのPTSは入力と一致したままになる。
+// 返り値の2つ目は破棄したフレーム数
+func (e *OpusEncoder) EncodeCatchUp(pcm []byte, inputTimestampMs int64, clusterTimeMs int64, behindMs int64) ([]EncodedAudioFrame, int, error) {
 	if !e.hasBufferStartTS {
 		e.bufferStartTSMs = inputTimestampMs
 		e.hasBufferStartTS = true
@@ -96,12 +117,33 @@ func (e *OpusEncoder) Encode(pcm []byte, inputTimestampMs int64, clusterTimeMs i
 		e.bufferStartTSMs = inputTimestampMs
 	}
 
+	if e.inputChannels != e.channels {
+		downmixed, err := DownmixToStereo(pcm, e.inputChannels)
+		if err != nil {
+			return nil, 0, err
+		}
+		pcm = downmixed
+	}
 	e.pcmBuffer = append(e.pcmBuffer, pcm...)
 
 	// PCM S16LE: 2 bytes per sample per channel
 	bytesPerFrame := e.frameSize * e.channels * 2
+	frameDurationMs := int64(e.frameSize * 1000 / e.sampleRate)
 	var encodedFrames []EncodedAudioFrame
 
+	skipped := 0
+	if behindMs > 0 {
+		targetMs := inputTimestampMs + behindMs
+		for len(e.pcmBuffer) >= bytesPerFrame && e.bufferStartTSMs < targetMs {
+			e.pcmBuffer = e.pcmBuffer[bytesPerFrame:]
+			e.bufferStartTSMs += frameDurationMs
+			skipped++
+		}
+		if skipped > 0 {
+			DebugLogPeriodic("opus.catchup", time.Second, "Opus catch-up: skipped %d frames before encoding, resynced to %dms\n", skipped, e.bufferStartTSMs)
+		}
+	}
+
 	for len(e.pcmBuffer) >= bytesPerFrame {
 		frameData := e.pcmBuffer[:bytesPerFrame]
 		e.pcmBuffer = e.pcmBuffer[bytesPerFrame:]
@@ -112,7 +154,7 @@ func (e *OpusEncoder) Encode(pcm []byte, inputTimestampMs int64, clusterTimeMs i
 		if err != nil {
 			DebugLog("Opus encode error: %v\n", err)
 			// エンコード失敗時もサンプル消費分だけ時刻を進める。
-			e.bufferStartTSMs += int64(e.frameSize * 1000 / e.sampleRate)
+			e.bufferStartTSMs += frameDurationMs
 			e.encodedFrameCounter++
 			continue
 		}
@@ -121,17 +163,39 @@ func (e *OpusEncoder) Encode(pcm []byte, inputTimestampMs int64, clusterTimeMs i
 			encodedFrames = append(encodedFrames, EncodedAudioFrame{
 				Data:        outBuf[:n],
 				TimestampMs: frameTimestampMs,
+				Samples:     e.frameSize,
 			})
 			// Log once per second (100 frames * 10ms = 1000ms)
 			if e.encodedFrameCounter%100 == 0 {
 				DebugLog("Opus frame encoded: timestamp=%dms, size=%d bytes, total frames=%d\n", frameTimestampMs, n, e.encodedFrameCounter)
 			}
 		}
-		e.bufferStartTSMs += int64(e.frameSize * 1000 / e.sampleRate)
+		e.bufferStartTSMs += frameDurationMs
 		e.encodedFrameCounter++
 	}
 
-	return encodedFrames, nil
+	return encodedFrames, skipped, nil
+}
+
+// Flush は入力終端でバッファに残った1フレーム（10ms）未満のPCMを無音で埋めてエンコードする
+func (e *OpusEncoder) Flush() ([]EncodedAudioFrame, error) {
+	if len(e.pcmBuffer) == 0 {
+		return nil, nil
+	}
+	bytesPerFrame := e.frameSize * e.channels * 2
+	frameData := make([]byte, bytesPerFrame)
+	copy(frameData, e.pcmBuffer)
+	e.pcmBuffer = e.pcmBuffer[:0]
+
+	outBuf := make([]byte, 1500)
+	n, err := e.enc.Encode(frameData, outBuf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode final Opus frame: %v", err)
+	}
+	frame := EncodedAudioFrame{Data: outBuf[:n], TimestampMs: e.bufferStartTSMs, Samples: e.frameSize}
+	e.bufferStartTSMs += int64(e.frameSize * 1000 / e.sampleRate)
+	e.encodedFrameCounter++
+	return []EncodedAudioFrame{frame}, nil
 }
 
 func (e *OpusEncoder) Close() {
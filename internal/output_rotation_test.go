@@ -0,0 +1,370 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"testing"
+)
+
+const (
+	outputRotationWidth     = 640
+	outputRotationHeight    = 360
+	outputRotationRTPTSStep = 3000 // 90kHz / 30fps
+	// 1映像フレーム（33ms）あたりの音声のRTP timestampの進み（48kHz）
+	outputRotationAudioTSStep = 1600
+)
+
+// outputRotationEncodeVP8 はVP8エンコーダーでn枚のフレームを作る（先頭のみキーフレーム）
+func outputRotationEncodeVP8(n int) ([][]byte, []bool, error) {
+	encoder, err := NewVP8Encoder(outputRotationWidth, outputRotationHeight, "YUV420P", 1000)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer encoder.Close()
+
+	var frames [][]byte
+	var keyframes []bool
+	// 無彩色のフレームの輝度を少しずつ変える（フレーム検証で破損と判定されないように）
+	frame := bytes.Repeat([]byte{0x80}, outputRotationWidth*outputRotationHeight*3/2)
+	for i := 0; i < n; i++ {
+		for j := 0; j < outputRotationWidth*outputRotationHeight; j++ {
+			frame[j] = byte(0x60 + i)
+		}
+		encoded, keyframe, err := encoder.Encode(frame)
+		if err != nil {
+			return nil, nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		frames = append(frames, encoded)
+		keyframes = append(keyframes, keyframe)
+	}
+	return frames, keyframes, nil
+}
+
+// createTemp はテスト用の一時ファイルを作る（戻り値の関数で削除する）
+func createTemp(pattern string) (*os.File, func(), error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, func() {
+		f.Close()
+		os.Remove(f.Name())
+	}, nil
+}
+
+// writeMKVWithRotation はRawVideoMKVWriterに映像と音声を書き込み、rotateAtフレーム目の前でsecondにローテーションする
+// 2つ目のファイルの映像がキーフレームから始まることを確かめるため、エンコーダーのキーフレームは先頭のみにする
+func writeMKVWithRotation(first, second *os.File, frames int, rotateAt int) error {
+	encoded, keyframes, err := outputRotationEncodeVP8(frames)
+	if err != nil {
+		return err
+	}
+	for i, keyframe := range keyframes {
+		if keyframe && i > 0 {
+			return fmt.Errorf("encoder produced an extra keyframe at frame %d", i)
+		}
+	}
+
+	writer := NewRawVideoMKVWriter(first, "vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	for i := 0; i < frames; i++ {
+		if i == rotateAt {
+			if err := writer.Rotate(second); err != nil {
+				return fmt.Errorf("rotate: %v", err)
+			}
+		}
+		if err := writer.WriteVideoFrame(encoded[i], uint32(i*outputRotationRTPTSStep), keyframes[i]); err != nil {
+			return fmt.Errorf("video frame %d: %v", i, err)
+		}
+		if err := writer.WriteAudioFrame(opusSilence, uint32(i*outputRotationAudioTSStep)); err != nil {
+			return fmt.Errorf("audio frame %d: %v", i, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return <-runErr
+}
+
+// validateFile はファイルを先頭から読み、単独で有効なMKVであることを検証する
+func validateFile(f *os.File) (*MKVReport, error) {
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return nil, err
+	}
+	report, err := ValidateMKV(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: mkv-validate: %v", f.Name(), err)
+	}
+	if report.VideoCodec != "V_UNCOMPRESSED" || report.Width != outputRotationWidth || report.Height != outputRotationHeight || report.SizeMismatches != 0 {
+		return nil, fmt.Errorf("%s: video %s %dx%d with %d size mismatches, want V_UNCOMPRESSED %dx%d", f.Name(), report.VideoCodec, report.Width, report.Height, report.SizeMismatches, outputRotationWidth, outputRotationHeight)
+	}
+	if report.AudioCodec != "A_OPUS" {
+		return nil, fmt.Errorf("%s: audio codec %q, want A_OPUS", f.Name(), report.AudioCodec)
+	}
+	if report.Video.Backwards != 0 || report.Audio.Backwards != 0 {
+		return nil, fmt.Errorf("%s: %d video and %d audio backward timestamps", f.Name(), report.Video.Backwards, report.Audio.Backwards)
+	}
+	return report, nil
+}
+
+// TestOutputRotationMKVRotate は映像・音声の途中でRotateすると、2つの単独で有効なMKVに分かれることを検証する
+// 2つ目のファイルはヘッダーから始まり、最初の映像ブロックがキーフレームで、timecodeは1つ目の続きになる
+func TestOutputRotationMKVRotate(t *testing.T) {
+	first, cleanupFirst, err := createTemp("test_rotation_1_*.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupFirst()
+	second, cleanupSecond, err := createTemp("test_rotation_2_*.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupSecond()
+
+	const frames, rotateAt = 20, 10
+	if err := writeMKVWithRotation(first, second, frames, rotateAt); err != nil {
+		t.Fatal(err)
+	}
+
+	before, err := validateFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := validateFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if before.Video.Frames+after.Video.Frames != frames {
+		t.Fatalf("%d + %d video frames, want %d in total", before.Video.Frames, after.Video.Frames, frames)
+	}
+	if before.Audio.Frames+after.Audio.Frames != frames {
+		t.Fatalf("%d + %d audio frames, want %d in total", before.Audio.Frames, after.Audio.Frames, frames)
+	}
+	if before.Video.Frames != rotateAt {
+		t.Fatalf("first file has %d video frames, want %d", before.Video.Frames, rotateAt)
+	}
+	if before.Video.Keyframes != 1 || after.Video.Keyframes != 1 {
+		t.Fatalf("keyframes %d and %d, want 1 in each file", before.Video.Keyframes, after.Video.Keyframes)
+	}
+	if after.Video.FirstMs <= before.Video.LastMs {
+		t.Fatalf("second file starts at %dms, before the first file ends at %dms", after.Video.FirstMs, before.Video.LastMs)
+	}
+
+	// 2つ目のファイルの最初の映像ブロックがキーフレーム
+	data, err := os.ReadFile(second.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			t.Fatalf("no video frame in the second file: %v", err)
+		}
+		if frame.Type != FrameTypeVideo {
+			continue
+		}
+		if !frame.IsKeyframe {
+			t.Fatalf("second file starts with a non-keyframe video block")
+		}
+		return
+	}
+}
+
+// TestOutputRotationMKVRotateBeforeHeader はヘッダー書き込み前のRotateでは1つ目のファイルに何も書き込まれないことを検証する
+func TestOutputRotationMKVRotateBeforeHeader(t *testing.T) {
+	first, cleanupFirst, err := createTemp("test_rotation_1_*.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupFirst()
+	second, cleanupSecond, err := createTemp("test_rotation_2_*.mkv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupSecond()
+
+	const frames = 5
+	if err := writeMKVWithRotation(first, second, frames, 0); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(first.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Fatalf("%d bytes written to the first file", info.Size())
+	}
+	report, err := validateFile(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Video.Frames != frames || report.Audio.Frames != frames {
+		t.Fatalf("%d video and %d audio frames, want %d each", report.Video.Frames, report.Audio.Frames, frames)
+	}
+}
+
+// TestOutputRotationMKVRotateAudioOnly は音声のみのMKVでもローテーション後に音声のみのヘッダーから始まることを検証する
+func TestOutputRotationMKVRotateAudioOnly(t *testing.T) {
+	var first, second bytes.Buffer
+	writer := NewRawVideoMKVWriter(&first, "vp8")
+	writer.SetAudioOnly()
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	const frames = 20
+	for i := 0; i < frames; i++ {
+		if i == frames/2 {
+			if err := writer.Rotate(&second); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := writer.WriteAudioFrame(opusSilence, uint32(i*960)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+
+	for name, data := range map[string][]byte{"first": first.Bytes(), "second": second.Bytes()} {
+		report, err := ValidateMKV(bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s file: %v", name, err)
+		}
+		if report.VideoCodec != "" || report.Audio.Frames != frames/2 {
+			t.Fatalf("%s file: video %q, %d audio frames, want audio-only with %d", name, report.VideoCodec, report.Audio.Frames, frames/2)
+		}
+	}
+}
+
+// ivfFile はIVFファイルのヘッダーのフレーム数・解像度と、各フレームのデータ
+type ivfFile struct {
+	frameCount uint32
+	width      int
+	height     int
+	frames     [][]byte
+}
+
+// outputRotationReadIVF はIVFファイルを読む
+func outputRotationReadIVF(name string) (ivfFile, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return ivfFile{}, err
+	}
+	if len(data) < 32 || string(data[0:4]) != "DKIF" {
+		return ivfFile{}, fmt.Errorf("%s: not an IVF file", name)
+	}
+	file := ivfFile{
+		frameCount: binary.LittleEndian.Uint32(data[24:28]),
+		width:      int(binary.LittleEndian.Uint16(data[12:14])),
+		height:     int(binary.LittleEndian.Uint16(data[14:16])),
+	}
+	for pos := 32; pos < len(data); {
+		if pos+12 > len(data) {
+			return ivfFile{}, fmt.Errorf("%s: truncated frame header at offset %d", name, pos)
+		}
+		size := int(binary.LittleEndian.Uint32(data[pos : pos+4]))
+		pos += 12
+		if pos+size > len(data) {
+			return ivfFile{}, fmt.Errorf("%s: truncated frame at offset %d", name, pos)
+		}
+		file.frames = append(file.frames, data[pos:pos+size])
+		pos += size
+	}
+	return file, nil
+}
+
+// TestOutputRotationIVFRotate はIVFのRotateで1つ目のファイルのフレーム数が書き戻され、
+// 2つ目のファイルは次のキーフレームから始まることを検証する
+func TestOutputRotationIVFRotate(t *testing.T) {
+	first, cleanupFirst, err := createTemp("test_rotation_1_*.ivf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupFirst()
+	second, cleanupSecond, err := createTemp("test_rotation_2_*.ivf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupSecond()
+
+	// 2つ目のエンコーダーの先頭フレームがローテーション後のキーフレームになる
+	before, _, err := outputRotationEncodeVP8(8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, _, err := outputRotationEncodeVP8(6)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writer := NewIVFWriter(first)
+	session := writer.Session()
+	session.SetVideoCodec("vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- session.Run() }()
+
+	ts := uint32(0)
+	write := func(frames [][]byte) error {
+		for _, frame := range frames {
+			if err := session.WriteVideoFrame(frame, ts, IsVP8Keyframe(frame)); err != nil {
+				return err
+			}
+			ts += outputRotationRTPTSStep
+		}
+		return nil
+	}
+	if err := write(before[:5]); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Rotate(second); err != nil {
+		t.Fatal(err)
+	}
+	// キーフレームが届くまでのインターフレームは2つ目のファイルに書き込まない
+	if err := write(before[5:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(after); err != nil {
+		t.Fatal(err)
+	}
+	if err := session.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name   string
+		frames [][]byte
+	}{{first.Name(), before[:5]}, {second.Name(), after}} {
+		file, err := outputRotationReadIVF(c.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if file.width != outputRotationWidth || file.height != outputRotationHeight {
+			t.Fatalf("%s: header %dx%d, want %dx%d", c.name, file.width, file.height, outputRotationWidth, outputRotationHeight)
+		}
+		if int(file.frameCount) != len(c.frames) || len(file.frames) != len(c.frames) {
+			t.Fatalf("%s: header frame count %d, %d frames, want %d", c.name, file.frameCount, len(file.frames), len(c.frames))
+		}
+		if !IsVP8Keyframe(file.frames[0]) {
+			t.Fatalf("%s: does not start with a keyframe", c.name)
+		}
+		for i, frame := range file.frames {
+			if !bytes.Equal(frame, c.frames[i]) {
+				t.Fatalf("%s: frame %d does not match", c.name, i)
+			}
+		}
+	}
+}
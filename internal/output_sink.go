@@ -0,0 +1,301 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// OutputFormatOgg は --audio-out の.ogg/.opusで書き込むOgg Opus（デコードしない音声のみ）
+const OutputFormatOgg = "ogg"
+
+// OutputSink は --output-format ごとの出力で、再接続をまたいで1つの出力先に書き込む
+// 接続ごとにSessionでStreamWriterを作り、StreamManagerには形式によらずStreamWriterとして渡す
+// Rotateは現在のセッションの出力を切り替え、以降のセッションも新しい出力先に書き込む
+type OutputSink interface {
+	OutputRotator
+	// Session は1回の接続分のStreamWriterを作る
+	Session(opts SinkOptions) StreamWriter
+}
+
+// SinkOptions はSessionで作るStreamWriterに渡す接続ごとの設定
+type SinkOptions struct {
+	// KeyframeController はライターがキーフレームを要求する先（nilで要求しない）
+	KeyframeController *KeyframeController
+}
+
+// NewOutputSink はformat（OutputFormatMKV, OutputFormatIVF）の出力をwに書き込むOutputSinkを作成する
+func NewOutputSink(format string, w io.Writer) (OutputSink, error) {
+	switch format {
+	case OutputFormatMKV:
+		return &mkvSink{output: w}, nil
+	case OutputFormatIVF:
+		return &ivfSink{ivf: NewIVFWriter(w)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported output format: %s (supported: %s, %s)", format, OutputFormatMKV, OutputFormatIVF)
+	}
+}
+
+// mkvSink はデコードしたrawvideoとOpusのMKVを書き込むOutputSink
+// デコーダーは接続ごとに作り直すため、セッションごとにRawVideoMKVWriterを作る
+// 次のセッションは前のセッションのSegmentに続けて書き込み、解像度やトラック構成が変わった場合のみヘッダーから書き直す
+type mkvSink struct {
+	mu        sync.Mutex
+	output    io.Writer
+	current   *RawVideoMKVWriter // 閉じていないセッションのライター
+	segment   *mkvSegmentState   // 閉じたセッションが書き込んだSegment（nilで次のセッションはヘッダーから書き込む）
+	videoOnly bool               // 音声トラックを書き込まない（--video-out）
+	audioOnly bool               // 映像トラックを書き込まない（--audio-out）
+}
+
+func (s *mkvSink) Session(opts SinkOptions) StreamWriter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	writer := NewRawVideoMKVWriter(s.output, "vp8")
+	if opts.KeyframeController != nil {
+		writer.SetKeyframeController(opts.KeyframeController)
+	}
+	if s.videoOnly {
+		writer.SetVideoOnly()
+	}
+	if s.audioOnly {
+		writer.SetAudioOnly()
+	}
+	if s.segment != nil {
+		writer.continueSegment(s.segment)
+	}
+	s.current = writer
+	return &mkvSession{RawVideoMKVWriter: writer, sink: s}
+}
+
+// Rotate は閉じていないセッションがあればその出力を切り替え、次のセッションからnewWriterに書き込む
+// 閉じたライターはRotateで新しい出力にヘッダーを書いてしまうため切り替えず、次のセッションがヘッダーから書き込む
+func (s *mkvSink) Rotate(newWriter io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.current != nil {
+		if err := s.current.Rotate(newWriter); err != nil {
+			return err
+		}
+	}
+	s.output = newWriter
+	s.segment = nil
+	return nil
+}
+
+// mkvSession はmkvSinkのセッションのStreamWriter
+// RawVideoMKVWriterを埋め込み、VideoCodecSetter等の任意のインターフェースもそのまま満たす
+type mkvSession struct {
+	*RawVideoMKVWriter
+	sink *mkvSink
+}
+
+// Close はライターを閉じ、書き込んだSegmentを次のセッションに引き継ぐ
+// 閉じている間にRotateされないよう、sinkのロックを持ったまま閉じる
+func (s *mkvSession) Close() error {
+	s.sink.mu.Lock()
+	defer s.sink.mu.Unlock()
+	err := s.RawVideoMKVWriter.Close()
+	if s.sink.current != s.RawVideoMKVWriter {
+		return err
+	}
+	s.sink.current = nil
+	if state := s.RawVideoMKVWriter.segmentState(); state != nil {
+		s.sink.segment = state
+	}
+	return err
+}
+
+// ivfSink はVP8/VP9のビットストリームをデコードせずに書き込むOutputSink
+// 再接続をまたいで1つのIVFファイルになるよう、IVFWriterのセッションを作る
+type ivfSink struct {
+	ivf *IVFWriter
+}
+
+func (s *ivfSink) Session(SinkOptions) StreamWriter {
+	return s.ivf.Session()
+}
+
+func (s *ivfSink) Rotate(newWriter io.Writer) error {
+	return s.ivf.Rotate(newWriter)
+}
+
+// oggSink はOpusをデコードせずに書き込むOutputSink（--audio-out の.ogg/.opus）
+// 再接続をまたいで1つのOggストリームになるよう、OggOpusWriterのセッションを作る
+type oggSink struct {
+	ogg *OggOpusWriter
+}
+
+func (s *oggSink) Session(SinkOptions) StreamWriter {
+	return s.ogg.Session()
+}
+
+func (s *oggSink) Rotate(io.Writer) error {
+	return fmt.Errorf("Ogg output cannot be rotated")
+}
+
+// SplitOutputFormat は --video-out（videoがtrue）または --audio-out のパスの拡張子から出力形式を決める
+// 映像はMKV（デコードしたrawvideo）かIVF（VP8/VP9のまま）、音声はOgg（Opusのまま）かMKVに書き込める
+// 受信する映像はVP8/VP9、音声はOpusのみのため、どの組み合わせもコーデックに対応している
+func SplitOutputFormat(path string, video bool) (string, error) {
+	ext := strings.ToLower(filepath.Ext(path))
+	if video {
+		switch ext {
+		case ".mkv":
+			return OutputFormatMKV, nil
+		case ".ivf":
+			return OutputFormatIVF, nil
+		case ".ogg", ".opus":
+			return "", fmt.Errorf("invalid --video-out: %s (Ogg holds Opus audio only, use .mkv or .ivf)", path)
+		}
+		return "", fmt.Errorf("invalid --video-out: %s (use .mkv for decoded rawvideo or .ivf for VP8/VP9 as received)", path)
+	}
+	switch ext {
+	case ".ogg", ".opus":
+		return OutputFormatOgg, nil
+	case ".mkv", ".mka":
+		return OutputFormatMKV, nil
+	case ".ivf":
+		return "", fmt.Errorf("invalid --audio-out: %s (IVF holds VP8/VP9 video only, use .ogg, .opus or .mka)", path)
+	}
+	return "", fmt.Errorf("invalid --audio-out: %s (use .ogg or .opus for Ogg Opus, or .mka/.mkv for audio-only MKV)", path)
+}
+
+// NewSplitOutputSink は映像と音声を別々の出力に書き込むOutputSinkを作成する（--video-out, --audio-out）
+// 形式はSplitOutputFormatの値で、空の形式の出力には書き込まない
+func NewSplitOutputSink(videoFormat string, video io.Writer, audioFormat string, audio io.Writer) (OutputSink, error) {
+	sink := &splitSink{}
+	switch videoFormat {
+	case "":
+	case OutputFormatMKV:
+		sink.video = &mkvSink{output: video, videoOnly: true}
+	case OutputFormatIVF:
+		sink.video = &ivfSink{ivf: NewIVFWriter(video)}
+	default:
+		return nil, fmt.Errorf("unsupported video output format: %s", videoFormat)
+	}
+	switch audioFormat {
+	case "":
+	case OutputFormatMKV:
+		sink.audio = &mkvSink{output: audio, audioOnly: true}
+	case OutputFormatOgg:
+		sink.audio = &oggSink{ogg: NewOggOpusWriter(audio)}
+	default:
+		return nil, fmt.Errorf("unsupported audio output format: %s", audioFormat)
+	}
+	return sink, nil
+}
+
+// splitSink は映像と音声を別々のOutputSinkに書き込むOutputSink
+type splitSink struct {
+	video OutputSink // nilの場合は映像を書き込まない
+	audio OutputSink // nilの場合は音声を書き込まない
+}
+
+func (s *splitSink) Session(opts SinkOptions) StreamWriter {
+	session := &splitSession{}
+	if s.video != nil {
+		session.video = s.video.Session(opts)
+	}
+	if s.audio != nil {
+		session.audio = s.audio.Session(SinkOptions{})
+	}
+	return session
+}
+
+func (s *splitSink) Rotate(io.Writer) error {
+	return fmt.Errorf("separate video and audio outputs cannot be rotated")
+}
+
+// splitSession は映像と音声をそれぞれのライターに振り分けるStreamWriter
+// 各ライターのRunは別のgoroutineで動かす
+type splitSession struct {
+	video      StreamWriter
+	audio      StreamWriter
+	audioAdded bool // 複数の音声トラックに対応しない音声ライターで、音声トラックを割り当て済み
+}
+
+func (s *splitSession) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	if s.video == nil {
+		return nil
+	}
+	return s.video.WriteVideoFrame(data, timestamp, keyframe)
+}
+
+func (s *splitSession) WriteAudioFrame(data []byte, timestamp uint32) error {
+	if s.audio == nil {
+		return nil
+	}
+	return s.audio.WriteAudioFrame(data, timestamp)
+}
+
+// Run は両方のライターのRunを並行に実行し、最初のエラーを返す（エラーが無ければ両方の終了を待つ）
+func (s *splitSession) Run() error {
+	writers := make([]StreamWriter, 0, 2)
+	for _, writer := range []StreamWriter{s.video, s.audio} {
+		if writer != nil {
+			writers = append(writers, writer)
+		}
+	}
+	errs := make(chan error, len(writers))
+	for _, writer := range writers {
+		go func() { errs <- writer.Run() }()
+	}
+	for range writers {
+		if err := <-errs; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *splitSession) Close() error {
+	var errs []error
+	for _, writer := range []StreamWriter{s.video, s.audio} {
+		if writer != nil {
+			errs = append(errs, writer.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *splitSession) SetVideoCodec(codecType string) {
+	if setter, ok := s.video.(VideoCodecSetter); ok {
+		setter.SetVideoCodec(codecType)
+	}
+}
+
+func (s *splitSession) SetVideoRotation(degrees int) {
+	if setter, ok := s.video.(VideoRotationSetter); ok {
+		setter.SetVideoRotation(degrees)
+	}
+}
+
+func (s *splitSession) SetAudioOnly() {
+	if setter, ok := s.audio.(AudioOnlySetter); ok {
+		setter.SetAudioOnly()
+	}
+}
+
+// AddAudioTrack は音声ライターがMultiAudioWriterであれば音声トラックを追加し、
+// それ以外（Ogg、音声を書き込まない場合）は最初の音声トラックのみを受け付ける
+func (s *splitSession) AddAudioTrack() (int, error) {
+	if multi, ok := s.audio.(MultiAudioWriter); ok {
+		return multi.AddAudioTrack()
+	}
+	if s.audioAdded {
+		return 0, fmt.Errorf("output supports a single audio track")
+	}
+	s.audioAdded = true
+	return 0, nil
+}
+
+func (s *splitSession) WriteAudioTrackFrame(index int, data []byte, timestamp uint32) error {
+	if multi, ok := s.audio.(MultiAudioWriter); ok {
+		return multi.WriteAudioTrackFrame(index, data, timestamp)
+	}
+	return s.WriteAudioFrame(data, timestamp)
+}
@@ -0,0 +1,238 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+)
+
+const (
+	outputSinkWidth     = 640
+	outputSinkHeight    = 360
+	outputSinkFrames    = 10
+	outputSinkRTPTSStep = 3000 // 90kHz / 30fps
+	// 1映像フレーム（33ms）あたりの音声のRTP timestampの進み（48kHz）
+	outputSinkAudioTSStep = 1600
+)
+
+// outputSinkEncodeVP8 はVP8エンコーダーでフレーム列を作る（先頭のみキーフレーム）
+func outputSinkEncodeVP8() ([][]byte, error) {
+	encoder, err := NewVP8Encoder(outputSinkWidth, outputSinkHeight, "YUV420P", 1000)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+
+	var out [][]byte
+	frame := bytes.Repeat([]byte{0x80}, outputSinkWidth*outputSinkHeight*3/2)
+	for i := 0; i < outputSinkFrames; i++ {
+		for j := 0; j < outputSinkWidth*outputSinkHeight; j++ {
+			frame[j] = byte(0x60 + i)
+		}
+		encoded, _, err := encoder.Encode(frame)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		out = append(out, encoded)
+	}
+	return out, nil
+}
+
+// outputSinkWriteSession は1回の接続分の映像と音声をOutputSinkのセッションで書き込む
+// whep-goと同じく、ネゴシエーションされたコーデックは任意のインターフェースで通知する
+func outputSinkWriteSession(sink OutputSink, encoded [][]byte) error {
+	session := sink.Session(SinkOptions{})
+	setter, ok := session.(VideoCodecSetter)
+	if !ok {
+		return fmt.Errorf("session %T does not implement VideoCodecSetter", session)
+	}
+	setter.SetVideoCodec("vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- session.Run() }()
+
+	for i, frame := range encoded {
+		if err := session.WriteVideoFrame(frame, uint32(i*outputSinkRTPTSStep), i == 0); err != nil {
+			return fmt.Errorf("video frame %d: %v", i, err)
+		}
+		if err := session.WriteAudioFrame(opusSilence, uint32(i*outputSinkAudioTSStep)); err != nil {
+			return fmt.Errorf("audio frame %d: %v", i, err)
+		}
+	}
+	if err := session.Close(); err != nil {
+		return err
+	}
+	return <-runErr
+}
+
+// validateMKV は出力が単独で有効な、映像と音声がそれぞれwantFramesフレームのMKVであることを検証する
+func validateMKV(data []byte, wantFrames int) error {
+	report, err := ValidateMKV(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("mkv-validate: %v", err)
+	}
+	if report.VideoCodec != "V_UNCOMPRESSED" || report.Width != outputSinkWidth || report.Height != outputSinkHeight {
+		return fmt.Errorf("video %s %dx%d, want V_UNCOMPRESSED %dx%d", report.VideoCodec, report.Width, report.Height, outputSinkWidth, outputSinkHeight)
+	}
+	if report.AudioCodec != "A_OPUS" {
+		return fmt.Errorf("audio codec %q, want A_OPUS", report.AudioCodec)
+	}
+	if report.Video.Frames != wantFrames || report.Audio.Frames != wantFrames {
+		return fmt.Errorf("%d video and %d audio frames, want %d each", report.Video.Frames, report.Audio.Frames, wantFrames)
+	}
+	return nil
+}
+
+// validateIVF は出力がVP8のIVFで、ヘッダーの後にwantFramesフレームが続くことを検証する
+func validateIVF(data []byte, wantFrames int) error {
+	if len(data) < 32 || string(data[0:4]) != "DKIF" || string(data[8:12]) != "VP80" {
+		return fmt.Errorf("output does not start with a VP8 IVF header (%d bytes)", len(data))
+	}
+	got := 0
+	for pos := 32; pos < len(data); got++ {
+		if pos+12 > len(data) {
+			return fmt.Errorf("truncated frame header at offset %d", pos)
+		}
+		pos += 12 + int(uint32(data[pos])|uint32(data[pos+1])<<8|uint32(data[pos+2])<<16|uint32(data[pos+3])<<24)
+		if pos > len(data) {
+			return fmt.Errorf("truncated frame %d", got)
+		}
+	}
+	if got != wantFrames {
+		return fmt.Errorf("got %d frames, want %d", got, wantFrames)
+	}
+	return nil
+}
+
+// TestOutputSinkMKV はmkvの出力がセッションごとに有効なMKVを書き込むことを検証する
+func TestOutputSinkMKV(t *testing.T) {
+	encoded, err := outputSinkEncodeVP8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	sink, err := NewOutputSink(OutputFormatMKV, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := outputSinkWriteSession(sink, encoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateMKV(out.Bytes(), outputSinkFrames); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOutputSinkMKVReconnect は再接続後のセッションがヘッダーを書き直さず、同じSegmentに続けて
+// timecodeが前のセッションより後になるよう書き込むことを検証する
+func TestOutputSinkMKVReconnect(t *testing.T) {
+	encoded, err := outputSinkEncodeVP8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	sink, err := NewOutputSink(OutputFormatMKV, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := outputSinkWriteSession(sink, encoded); err != nil {
+			t.Fatalf("session %d: %v", i, err)
+		}
+	}
+	if err := validateMKV(out.Bytes(), 2*outputSinkFrames); err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []uint32{idEBML, idSegment, idTracks} {
+		var want [4]byte
+		binary.BigEndian.PutUint32(want[:], id)
+		if n := bytes.Count(out.Bytes(), want[:]); n != 1 {
+			t.Fatalf("element 0x%X written %d times, want once", id, n)
+		}
+	}
+
+	blocks, err := scanBlocks(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := map[uint64]int64{}
+	for i, b := range blocks {
+		if prev, ok := last[b.track]; ok && b.timecode <= prev {
+			t.Fatalf("block %d on track %d: timecode %d after %d", i, b.track, b.timecode, prev)
+		}
+		last[b.track] = b.timecode
+	}
+}
+
+// TestOutputSinkIVF はivfの出力が再接続をまたいで1つのIVFファイルに書き込むことを検証する
+func TestOutputSinkIVF(t *testing.T) {
+	encoded, err := outputSinkEncodeVP8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	sink, err := NewOutputSink(OutputFormatIVF, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := outputSinkWriteSession(sink, encoded); err != nil {
+			t.Fatalf("session %d: %v", i+1, err)
+		}
+	}
+	if err := validateIVF(out.Bytes(), 2*outputSinkFrames); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestOutputSinkRotateBetweenSessions はセッションの終了後にRotateすると、新しい出力には次のセッションから書き込み、
+// 閉じたセッションのヘッダー等を書き込まないことを検証する
+func TestOutputSinkRotateBetweenSessions(t *testing.T) {
+	encoded, err := outputSinkEncodeVP8()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		format   string
+		validate func(data []byte) error
+	}{
+		{OutputFormatMKV, func(data []byte) error { return validateMKV(data, outputSinkFrames) }},
+		{OutputFormatIVF, func(data []byte) error { return validateIVF(data, outputSinkFrames) }},
+	} {
+		var first, second bytes.Buffer
+		sink, err := NewOutputSink(tt.format, &first)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := outputSinkWriteSession(sink, encoded); err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		written := first.Len()
+		if err := sink.Rotate(&second); err != nil {
+			t.Fatalf("%s: rotate: %v", tt.format, err)
+		}
+		if first.Len() != written || second.Len() != 0 {
+			t.Fatalf("%s: rotate after the session wrote %d bytes to the old and %d bytes to the new output",
+				tt.format, first.Len()-written, second.Len())
+		}
+		if err := outputSinkWriteSession(sink, encoded); err != nil {
+			t.Fatalf("%s: %v", tt.format, err)
+		}
+		if first.Len() != written {
+			t.Fatalf("%s: the next session wrote %d bytes to the old output", tt.format, first.Len()-written)
+		}
+		if err := tt.validate(first.Bytes()); err != nil {
+			t.Fatalf("%s: first output: %v", tt.format, err)
+		}
+		if err := tt.validate(second.Bytes()); err != nil {
+			t.Fatalf("%s: second output: %v", tt.format, err)
+		}
+	}
+}
+
+// TestOutputSinkUnknownFormat は未対応の形式でエラーを返すことを検証する
+func TestOutputSinkUnknownFormat(t *testing.T) {
+	if _, err := NewOutputSink("webm", &bytes.Buffer{}); err == nil {
+		t.Fatalf("got no error for an unsupported format")
+	}
+}
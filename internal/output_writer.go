@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+)
+
+// ErrOutputClosed は出力先（stdoutのパイプ等）が下流で閉じられたことを示す
+// 一時的なエラーではないため、受け取った側は再接続せずに終了処理を行う
+var ErrOutputClosed = errors.New("output closed by downstream")
+
+// IsBrokenPipe はerrが書き込み先のパイプが閉じられたことによるものか判定する
+func IsBrokenPipe(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrClosedPipe)
+}
+
+// outputWriter は出力先への書き込みでbroken pipeを検出し、以降の書き込みをすべて失敗させるio.Writer
+// bufio.Writerの下に置き、Write/Flushのどちらで検出してもErrOutputClosedを返す
+type outputWriter struct {
+	w   io.Writer
+	err error
+}
+
+func newOutputWriter(w io.Writer) *outputWriter {
+	return &outputWriter{w: w}
+}
+
+func (o *outputWriter) Write(p []byte) (int, error) {
+	if o.err != nil {
+		return 0, o.err
+	}
+	n, err := o.w.Write(p)
+	if err != nil && IsBrokenPipe(err) {
+		o.err = fmt.Errorf("%w: %v", ErrOutputClosed, err)
+		return n, o.err
+	}
+	return n, err
+}
+
+// Err は出力先が閉じられていればErrOutputClosedを包んだエラーを返す
+func (o *outputWriter) Err() error {
+	return o.err
+}
+
+// isSeekableOutput は出力先が通常のファイル（シーク可能）か判定する
+// パイプやソケット、端末の場合はfalseを返す
+func isSeekableOutput(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"sync/atomic"
 	"time"
 )
 
@@ -12,13 +13,34 @@ type Pacer struct {
 	basePTS      int64         // 基準PTS（ミリ秒）
 	initialized  bool          // 初期化済みフラグ
 	maxWait      time.Duration // 最大待機時間（異常PTS対策）
+	clock        Clock
+
+	targetBitrate atomic.Int64 // 帯域推定による送信上限（bps、0は無制限）
+	budgetBytes   float64      // 送信可能な残りバイト数（トークンバケット）
+	budgetAt      time.Time    // budgetBytesを最後に補充した時刻
 }
 
 // NewPacer は新しいPacerを作成する
 func NewPacer(maxWait time.Duration) *Pacer {
 	return &Pacer{
 		maxWait: maxWait,
+		clock:   SystemClock{},
+	}
+}
+
+// SetClock は送信時刻の計算に使う時刻の取得元を差し替える（検証用）
+// clockがSleep(time.Duration)を持つ場合は待機にも使い、実時間では待たない
+func (p *Pacer) SetClock(clock Clock) {
+	p.clock = clock
+}
+
+// sleep はdだけ待機する
+func (p *Pacer) sleep(d time.Duration) {
+	if sleeper, ok := p.clock.(interface{ Sleep(time.Duration) }); ok {
+		sleeper.Sleep(d)
+		return
 	}
+	time.Sleep(d)
 }
 
 // Wait はPTSに基づいて適切なタイミングまで待機する
@@ -38,7 +60,7 @@ func (p *Pacer) Wait(timestampMs int64) {
 	}
 
 	expectedTime := p.baseWallTime.Add(time.Duration(ptsDiff) * time.Millisecond)
-	waitDuration := time.Until(expectedTime)
+	waitDuration := expectedTime.Sub(p.clock.Now())
 
 	// 待機が必要な場合のみスリープ
 	if waitDuration > 0 {
@@ -48,7 +70,7 @@ func (p *Pacer) Wait(timestampMs int64) {
 			waitDuration = p.maxWait
 		}
 		DebugLogPeriodic("pacer.wait", pacingWaitLogInterval, "Pacing: waiting %v (PTS: %dms)\n", waitDuration, timestampMs)
-		time.Sleep(waitDuration)
+		p.sleep(waitDuration)
 	}
 }
 
@@ -79,7 +101,7 @@ func (p *Pacer) ShouldDrop(timestampMs int64, threshold time.Duration) bool {
 
 	// 期待送信時刻を計算
 	expectedTime := p.baseWallTime.Add(time.Duration(ptsDiff) * time.Millisecond)
-	lateness := time.Since(expectedTime)
+	lateness := p.clock.Now().Sub(expectedTime)
 
 	// 遅延が閾値を超えていたら破棄
 	if lateness > threshold {
@@ -96,8 +118,59 @@ func (p *Pacer) ShouldDrop(timestampMs int64, threshold time.Duration) bool {
 	return false
 }
 
+// Lateness はPTSの期待送信時刻からの遅れを返す
+// 初期化前、PTSが基準より前、または期待時刻より早い場合は0を返す
+func (p *Pacer) Lateness(timestampMs int64) time.Duration {
+	if !p.initialized {
+		return 0
+	}
+	ptsDiff := timestampMs - p.basePTS
+	if ptsDiff < 0 {
+		return 0
+	}
+	lateness := p.clock.Now().Sub(p.baseWallTime.Add(time.Duration(ptsDiff) * time.Millisecond))
+	if lateness < 0 {
+		return 0
+	}
+	return lateness
+}
+
 func (p *Pacer) resync(timestampMs int64) {
-	p.baseWallTime = time.Now()
+	p.baseWallTime = p.clock.Now()
 	p.basePTS = timestampMs
 	p.initialized = true
 }
+
+// SetTargetBitrate は帯域推定に基づく送信上限を設定する（0で無制限）
+// 別goroutineから呼び出してよい
+func (p *Pacer) SetTargetBitrate(bps int) {
+	p.targetBitrate.Store(int64(bps))
+}
+
+// ExceedsBitrate はフレームを送信すると送信上限を超えるかを判定する
+// 超えない場合はフレームサイズ分のバジェットを消費する。
+// バジェットは最大1秒分まで蓄積し、キーフレーム等の一時的なバーストを許容する
+func (p *Pacer) ExceedsBitrate(frameBytes int) bool {
+	bps := p.targetBitrate.Load()
+	if bps <= 0 {
+		return false
+	}
+
+	now := p.clock.Now()
+	bytesPerSec := float64(bps) / 8
+	if p.budgetAt.IsZero() {
+		p.budgetBytes = bytesPerSec
+	} else {
+		p.budgetBytes += now.Sub(p.budgetAt).Seconds() * bytesPerSec
+		if p.budgetBytes > bytesPerSec {
+			p.budgetBytes = bytesPerSec
+		}
+	}
+	p.budgetAt = now
+
+	if float64(frameBytes) > p.budgetBytes {
+		return true
+	}
+	p.budgetBytes -= float64(frameBytes)
+	return false
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// LossSimulator は受信したRTPパケットを指定した割合で破棄する（--simulate-loss）
+// PLI・キーフレーム待ち・フレーム検証等の回復処理をネットワークに依存せずに確認するためのもの
+// 同じシードなら同じパケット列に対して同じパケットを破棄する
+type LossSimulator struct {
+	percent float64
+	rng     *rand.Rand
+	total   atomic.Int64
+	dropped atomic.Int64
+}
+
+// NewLossSimulator はpercent（0-100）%のパケットを破棄するLossSimulatorを作成する
+// 読み取りループごとに作成し、複数のgoroutineから共有しない
+func NewLossSimulator(percent float64, seed int64) *LossSimulator {
+	return &LossSimulator{percent: percent, rng: rand.New(rand.NewSource(seed))}
+}
+
+// Drop は次のパケットを破棄する場合にtrueを返す
+func (l *LossSimulator) Drop() bool {
+	l.total.Add(1)
+	if l.rng.Float64()*100 >= l.percent {
+		return false
+	}
+	l.dropped.Add(1)
+	return true
+}
+
+// Total はDropを呼んだパケット数を返す
+func (l *LossSimulator) Total() int64 {
+	return l.total.Load()
+}
+
+// Dropped は破棄したパケット数を返す
+func (l *LossSimulator) Dropped() int64 {
+	return l.dropped.Load()
+}
+
+func (l *LossSimulator) String() string {
+	total, dropped := l.Total(), l.Dropped()
+	rate := 0.0
+	if total > 0 {
+		rate = float64(dropped) / float64(total) * 100
+	}
+	return fmt.Sprintf("dropped %d of %d RTP packets (%.1f%%)", dropped, total, rate)
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	packetLossAudioStep  = 20 * time.Millisecond // Opusのフレーム長
+	packetLossAudioTicks = 960                   // 20ms（48kHz）
+)
+
+// dropRate はn個のパケットに対してLossSimulatorが破棄した割合（%）を返す
+func dropRate(percent float64, seed int64, n int) float64 {
+	loss := NewLossSimulator(percent, seed)
+	for i := 0; i < n; i++ {
+		loss.Drop()
+	}
+	if loss.Total() != int64(n) {
+		return math.NaN()
+	}
+	return float64(loss.Dropped()) / float64(n) * 100
+}
+
+// TestPacketLossRates は設定した割合でパケットが破棄されることを検証する（0%と100%は厳密に）
+func TestPacketLossRates(t *testing.T) {
+	for _, percent := range []float64{0, 1, 5, 10, 25, 50, 100} {
+		got := dropRate(percent, 1, 100000)
+		tolerance := 0.5
+		if percent == 0 || percent == 100 {
+			tolerance = 0
+		}
+		if math.IsNaN(got) || math.Abs(got-percent) > tolerance {
+			t.Fatalf("--simulate-loss %g dropped %.2f%% of packets, want %g%% (±%g)", percent, got, percent, tolerance)
+		}
+	}
+}
+
+// drops はLossSimulatorがn個のパケットのうち何番目を破棄したかを返す
+func drops(seed int64, n int) []bool {
+	loss := NewLossSimulator(10, seed)
+	result := make([]bool, n)
+	for i := range result {
+		result[i] = loss.Drop()
+	}
+	return result
+}
+
+// TestPacketLossSeed は同じ --loss-seed なら同じパケットを破棄し、異なるシードでは異なるパケットを破棄することを検証する
+func TestPacketLossSeed(t *testing.T) {
+	first, second, other := drops(42, 1000), drops(42, 1000), drops(43, 1000)
+	same := true
+	for i := range first {
+		if first[i] != second[i] {
+			t.Fatalf("packet %d: seed 42 dropped=%v then dropped=%v", i, first[i], second[i])
+		}
+		if first[i] != other[i] {
+			same = false
+		}
+	}
+	if same {
+		t.Fatalf("seeds 42 and 43 dropped the same packets")
+	}
+}
+
+// TestPacketLossLoopback はStreamManagerが --simulate-loss の割合で受信RTPを破棄し、残りだけをwriterに渡すことを検証する
+func TestPacketLossLoopback(t *testing.T) {
+	const (
+		percent = 30
+		packets = 400
+	)
+	SimulateLoss = percent
+	LossSeed = 7
+	defer func() {
+		SimulateLoss = 0
+		LossSeed = 0
+	}()
+
+	writer := &packetLossCountingWriter{}
+	mediaReceived := make(chan struct{}, 1)
+	streamManager := NewStreamManager(writer, NewDefaultRTPProcessor(), 0, mediaReceived)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+	if err := connect(receiver, sender); err != nil {
+		t.Fatal(err)
+	}
+
+	go streamManager.Run()
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	defer func() {
+		receiver.Close()
+		streamManager.Stop()
+	}()
+
+	// SRTPの準備完了前のパケットは破棄されるため、最初のメディアが届くまで送り続ける
+	sequence := 0
+	send := func() error {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(sequence), Timestamp: uint32(sequence * packetLossAudioTicks)},
+			Payload: opusSilence,
+		}
+		sequence++
+		return track.WriteRTP(packet)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for received := false; !received; {
+		if time.Now().After(deadline) {
+			t.Fatalf("no media received within 5s")
+		}
+		if err := send(); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case <-mediaReceived:
+			received = true
+		case <-time.After(packetLossAudioStep):
+		}
+	}
+
+	// 最初のメディア以降に送ったパケットのうち、writerに届いた割合を確認する
+	time.Sleep(100 * time.Millisecond)
+	before := writer.audioFrames.Load()
+	for i := 0; i < packets; i++ {
+		if err := send(); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	time.Sleep(300 * time.Millisecond)
+	delivered := writer.audioFrames.Load() - before
+	lost := float64(packets-delivered) / packets * 100
+	if math.Abs(lost-percent) > 8 {
+		t.Fatalf("%d of %d packets reached the writer (%.1f%% lost), want about %d%% lost", delivered, packets, lost, percent)
+	}
+}
+
+// packetLossCountingWriter は書き込まれた音声フレーム数を数えるStreamWriter
+type packetLossCountingWriter struct {
+	audioFrames atomic.Int64
+}
+
+func (*packetLossCountingWriter) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	return nil
+}
+
+func (w *packetLossCountingWriter) WriteAudioFrame(data []byte, timestamp uint32) error {
+	w.audioFrames.Add(1)
+	return nil
+}
+
+func (*packetLossCountingWriter) Run() error   { return nil }
+func (*packetLossCountingWriter) Close() error { return nil }
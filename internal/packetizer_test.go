@@ -0,0 +1,291 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	packetizerWidth  = 640
+	packetizerHeight = 360
+)
+
+// collectPackets はwritePacketに渡されたパケットを保持する
+type collectPackets struct {
+	packets []*rtp.Packet
+}
+
+func (c *collectPackets) write(packet *rtp.Packet) error {
+	c.packets = append(c.packets, packet)
+	return nil
+}
+
+// checkVP8Descriptors はパーティションごとのS bit/PID/マーカーと、ペイロードの連結結果を検証する
+func checkVP8Descriptors(packets []*rtp.Packet, partitions [][]byte) error {
+	idx := 0
+	lastPartition := len(partitions) - 1
+	for pid, partition := range partitions {
+		var reassembled []byte
+		first := true
+		for len(reassembled) < len(partition) {
+			if idx >= len(packets) {
+				return fmt.Errorf("partition %d: ran out of packets", pid)
+			}
+			packet := packets[idx]
+			descriptor := packet.Payload[0]
+
+			if gotPID := int(descriptor & 0x07); gotPID != min(pid, 7) {
+				return fmt.Errorf("packet %d: PID=%d, want %d", idx, gotPID, pid)
+			}
+			if gotS := descriptor&0x10 != 0; gotS != first {
+				return fmt.Errorf("packet %d: S=%v, want %v", idx, gotS, first)
+			}
+			if descriptor&0xE8 != 0 {
+				return fmt.Errorf("packet %d: unexpected descriptor bits %08b", idx, descriptor)
+			}
+
+			reassembled = append(reassembled, packet.Payload[1:]...)
+			wantMarker := pid == lastPartition && len(reassembled) == len(partition)
+			if packet.Marker != wantMarker {
+				return fmt.Errorf("packet %d: marker=%v, want %v", idx, packet.Marker, wantMarker)
+			}
+			first = false
+			idx++
+		}
+		if !bytes.Equal(reassembled, partition) {
+			return fmt.Errorf("partition %d: payload mismatch", pid)
+		}
+	}
+	if idx != len(packets) {
+		return fmt.Errorf("%d extra packets", len(packets)-idx)
+	}
+	for i := 1; i < len(packets); i++ {
+		if packets[i].SequenceNumber != packets[i-1].SequenceNumber+1 {
+			return fmt.Errorf("packet %d: sequence number not contiguous", i)
+		}
+		if packets[i].Timestamp != packets[0].Timestamp {
+			return fmt.Errorf("packet %d: timestamp differs within a frame", i)
+		}
+	}
+	return nil
+}
+
+// TestPacketizerSyntheticPartitions はMTUを跨ぐサイズを含む人工的なパーティションを検証する
+func TestPacketizerSyntheticPartitions(t *testing.T) {
+	partitions := [][]byte{
+		bytes.Repeat([]byte{0x01}, 300),
+		bytes.Repeat([]byte{0x02}, MaxRTPPayload*2+10),
+		bytes.Repeat([]byte{0x03}, 5),
+	}
+	packetizer := NewVP8Packetizer(1234)
+	var c collectPackets
+	sent, err := packetizer.PacketizePartitionsAndWrite(partitions, 1000, true, c.write)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != len(c.packets) || sent != 5 {
+		t.Fatalf("sent %d packets (collected %d), want 5", sent, len(c.packets))
+	}
+	if !packetizer.Partitioned() {
+		t.Fatalf("Partitioned() = false for %d partitions", len(partitions))
+	}
+	if c.packets[0].Timestamp != 90000 {
+		t.Fatalf("timestamp %d, want 90000", c.packets[0].Timestamp)
+	}
+	if err := checkVP8Descriptors(c.packets, partitions); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPacketizerSinglePartition は従来のPacketizeAndWriteの出力（PID=0、先頭のみS=1）が変わらないことを検証する
+func TestPacketizerSinglePartition(t *testing.T) {
+	frame := bytes.Repeat([]byte{0xAB}, MaxRTPPayload+100)
+	packetizer := NewVP8Packetizer(1234)
+	var c collectPackets
+	if _, err := packetizer.PacketizeAndWrite(frame, 0, true, c.write); err != nil {
+		t.Fatal(err)
+	}
+	if packetizer.Partitioned() {
+		t.Fatalf("Partitioned() = true for a single partition")
+	}
+	if err := checkVP8Descriptors(c.packets, [][]byte{frame}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPacketizerEncoderPartitions はエンコーダーが出力したパーティションをパケット化して検証する
+func TestPacketizerEncoderPartitions(t *testing.T) {
+	VP8Partitions = true
+	defer func() { VP8Partitions = false }()
+
+	encoder, err := NewVP8Encoder(packetizerWidth, packetizerHeight, "YUV420P", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	frame := make([]byte, packetizerWidth*packetizerHeight*3/2)
+	packetizer := NewVP8Packetizer(1234)
+	maxPartitions := 0
+	for i := 0; i < 10; i++ {
+		for j := range frame {
+			frame[j] = byte(j*7 + i*13)
+		}
+		partitions, _, err := encoder.EncodePartitions(frame)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if len(partitions) == 0 {
+			continue
+		}
+		maxPartitions = max(maxPartitions, len(partitions))
+
+		var c collectPackets
+		if _, err := packetizer.PacketizePartitionsAndWrite(partitions, int64(i*33), false, c.write); err != nil {
+			t.Fatal(err)
+		}
+		if err := checkVP8Descriptors(c.packets, partitions); err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+	}
+	if maxPartitions < 2 {
+		t.Fatalf("encoder never emitted multiple partitions")
+	}
+	t.Logf("up to %d partitions per frame", maxPartitions)
+}
+
+// checkOpusTimestamps はtimestampがフレームのサンプル数ずつ連続し、マーカーがwantMarkers番目のみに立つことを検証する
+func checkOpusTimestamps(packets []*rtp.Packet, samples []int, wantMarkers map[int]bool) error {
+	if len(packets) != len(samples) {
+		return fmt.Errorf("got %d packets, want %d", len(packets), len(samples))
+	}
+	for i, packet := range packets {
+		if packet.Marker != wantMarkers[i] {
+			return fmt.Errorf("packet %d: marker=%v, want %v", i, packet.Marker, wantMarkers[i])
+		}
+		if i == 0 {
+			continue
+		}
+		if packet.SequenceNumber != packets[i-1].SequenceNumber+1 {
+			return fmt.Errorf("packet %d: sequence number not contiguous", i)
+		}
+		if wantMarkers[i] {
+			continue
+		}
+		if diff := packet.Timestamp - packets[i-1].Timestamp; diff != uint32(samples[i-1]) {
+			return fmt.Errorf("packet %d: timestamp advanced by %d, want %d", i, diff, samples[i-1])
+		}
+	}
+	return nil
+}
+
+// TestPacketizerOpusContinuity はエンコーダー出力のtimestampが10ms（480サンプル）ずつ連続することを検証する
+// 2.5msフレーム相当のPTSを丸めたmsで渡しても、timestampはサンプル数で進むこと
+func TestPacketizerOpusContinuity(t *testing.T) {
+	encoder, err := NewOpusEncoder(48000, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	packetizer := NewOpusPacketizer(5678)
+	pcm := make([]byte, 48000/1000*10*2*2) // 10ms stereo S16LE
+	var packets []*rtp.Packet
+	var samples []int
+	for i := 0; i < 50; i++ {
+		for j := range pcm {
+			pcm[j] = byte(j*3 + i)
+		}
+		frames, err := encoder.Encode(pcm, int64(i*10), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, frame := range frames {
+			samples = append(samples, frame.Samples)
+		}
+		packets = append(packets, packetizer.PacketizeFrames(frames)...)
+	}
+	if err := checkOpusTimestamps(packets, samples, map[int]bool{0: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// 2.5ms CELTフレーム（TOC config=16）: ms単位では表現できない間隔でも連続すること
+	celt := NewOpusPacketizer(5678)
+	var celtFrames []EncodedAudioFrame
+	var celtSamples []int
+	for i := 0; i < 8; i++ {
+		celtFrames = append(celtFrames, EncodedAudioFrame{
+			Data:        []byte{16 << 3, byte(i)},
+			TimestampMs: int64(i) * 5 / 2,
+		})
+		celtSamples = append(celtSamples, 120)
+	}
+	if got := OpusPacketSamples(celtFrames[0].Data); got != 120 {
+		t.Fatalf("OpusPacketSamples(2.5ms CELT) = %d, want 120", got)
+	}
+	if err := checkOpusTimestamps(celt.PacketizeFrames(celtFrames), celtSamples, map[int]bool{0: true}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestPacketizerOpusTalkspurt は入力PTSが飛んだ場合にtalk-spurt先頭としてマーカーが立ち、timestampが合わせ直されることを検証する
+func TestPacketizerOpusTalkspurt(t *testing.T) {
+	packetizer := NewOpusPacketizer(5678)
+	var frames []EncodedAudioFrame
+	var samples []int
+	for i := 0; i < 10; i++ {
+		ts := int64(i * 20)
+		if i >= 5 {
+			ts += 500 // 500msの無音区間
+		}
+		// TOC=0xFC: CELT FB 20ms
+		frames = append(frames, EncodedAudioFrame{Data: []byte{0xFC, byte(i)}, TimestampMs: ts})
+		samples = append(samples, 960)
+	}
+	packets := packetizer.PacketizeFrames(frames)
+	if err := checkOpusTimestamps(packets, samples, map[int]bool{0: true, 5: true}); err != nil {
+		t.Fatal(err)
+	}
+	if want := uint32(600 * 48); packets[5].Timestamp != want {
+		t.Fatalf("talk-spurt timestamp %d, want %d", packets[5].Timestamp, want)
+	}
+}
+
+// TestPacketizerOpusEmptyFrame は空のフレームがパケット化されず、sequence numberとtimestampを進めないことを検証する
+// 送信したパケットのPTSはフレームから取るため、パケットとフレームの対応がずれないこと
+func TestPacketizerOpusEmptyFrame(t *testing.T) {
+	packetizer := NewOpusPacketizer(5678)
+	frames := []EncodedAudioFrame{
+		{Data: []byte{0xFC, 0}, TimestampMs: 0},
+		{TimestampMs: 20},
+		{Data: []byte{0xFC, 2}, TimestampMs: 20},
+		{Data: []byte{0xFC, 3}, TimestampMs: 40},
+	}
+	var packets []*rtp.Packet
+	var sent []EncodedAudioFrame
+	for _, frame := range frames {
+		packet := packetizer.PacketizeFrame(frame)
+		if len(frame.Data) == 0 {
+			if packet != nil {
+				t.Fatalf("empty frame at %dms was packetized", frame.TimestampMs)
+			}
+			continue
+		}
+		packets = append(packets, packet)
+		sent = append(sent, frame)
+	}
+	if err := checkOpusTimestamps(packets, []int{960, 960, 960}, map[int]bool{0: true}); err != nil {
+		t.Fatal(err)
+	}
+	for i, packet := range packets {
+		if want := uint32(sent[i].TimestampMs * 48); packet.Timestamp != want {
+			t.Fatalf("packet %d: timestamp %d, want %d", i, packet.Timestamp, want)
+		}
+		if packet.Payload[1] != sent[i].Data[1] {
+			t.Fatalf("packet %d carries frame %d, want frame %d", i, packet.Payload[1], sent[i].Data[1])
+		}
+	}
+}
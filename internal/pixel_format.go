@@ -0,0 +1,43 @@
+package internal
+
+import "fmt"
+
+// VP8Encoderが入力として受け付けるrawvideoの画素形式
+const (
+	PixelFormatRGBA    = "RGBA"
+	PixelFormatYUV420P = "YUV420P"
+	PixelFormatI420    = "I420"
+)
+
+// ValidateInputPixelFormat は --input-pixel-format の値を検証する（空は入力の指定に従う）
+func ValidateInputPixelFormat(format string) error {
+	switch format {
+	case "", PixelFormatRGBA, PixelFormatYUV420P, PixelFormatI420:
+		return nil
+	default:
+		return fmt.Errorf("invalid --input-pixel-format: %s (supported: %s, %s, %s)", format, PixelFormatRGBA, PixelFormatYUV420P, PixelFormatI420)
+	}
+}
+
+// RawFrameSize は画素形式と解像度から1フレームのバイト数を返す
+// VP8Encoderと同じくYUV420P/I420以外はRGBAとして扱う
+func RawFrameSize(pixelFormat string, width, height int) int {
+	switch pixelFormat {
+	case PixelFormatYUV420P, PixelFormatI420:
+		return i420FrameSize(width, height)
+	default:
+		return width * height * 4
+	}
+}
+
+// GuessPixelFormat はフレームのバイト数に一致する画素形式を返す（一致しない場合は空）
+func GuessPixelFormat(size, width, height int) string {
+	switch size {
+	case RawFrameSize(PixelFormatRGBA, width, height):
+		return PixelFormatRGBA
+	case RawFrameSize(PixelFormatYUV420P, width, height):
+		return PixelFormatYUV420P
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,187 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const backoff = 20 * time.Millisecond
+
+// POSTへの応答の種類
+const (
+	respondReset     = "reset"     // 応答せずに接続を切る
+	respondTruncated = "truncated" // 201とLocationを返すが、answerの途中で接続を切る
+	respond503       = "503"
+	respond400       = "400"
+	respondOK        = "ok"
+)
+
+// flakyEndpoint はPOSTごとにscriptの順に応答するWHIPサーバー（scriptを使い切った後はok）
+type flakyEndpoint struct {
+	script []string
+
+	mu      sync.Mutex
+	posts   int
+	deletes []string // DELETEされたパス
+}
+
+func (e *flakyEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		offer, _ := io.ReadAll(r.Body)
+		e.mu.Lock()
+		e.posts++
+		n := e.posts
+		e.mu.Unlock()
+		respond := respondOK
+		if n <= len(e.script) {
+			respond = e.script[n-1]
+		}
+		location := fmt.Sprintf("/session/%d", n)
+
+		switch respond {
+		case respondReset:
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		case respondTruncated:
+			conn, buf, err := w.(http.Hijacker).Hijack()
+			if err != nil {
+				return
+			}
+			fmt.Fprintf(buf, "HTTP/1.1 201 Created\r\nContent-Type: application/sdp\r\nLocation: %s\r\nContent-Length: 1000\r\n\r\nv=0\r\n", location)
+			buf.Flush()
+			conn.Close()
+		case respond503:
+			w.Header().Set("Location", location)
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		case respond400:
+			http.Error(w, "bad offer", http.StatusBadRequest)
+		default:
+			answer, err := createAnswer(string(offer))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/sdp")
+			w.Header().Set("Location", location)
+			w.WriteHeader(http.StatusCreated)
+			io.WriteString(w, answer)
+		}
+	case http.MethodDelete:
+		e.mu.Lock()
+		e.deletes = append(e.deletes, r.URL.Path)
+		e.mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// postRetryExchange はscriptの順に応答するサーバーとretries回までやり直してSDPを交換する
+// SDP交換のエラー、POSTの回数、DELETEされたパス、セッションのリソースURLを返す
+func postRetryExchange(script []string, retries int) (error, *flakyEndpoint, string, error) {
+	endpoint := &flakyEndpoint{script: script}
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	peerConnection, err := newPublisher()
+	if err != nil {
+		return nil, nil, "", err
+	}
+	defer peerConnection.Close()
+
+	session := NewWHIPSession(server.URL)
+	session.SetPostRetry(retries, backoff)
+	exchangeErr := session.ExchangeSDP(peerConnection)
+	resource := strings.TrimPrefix(session.ResourceURL(), server.URL)
+	return exchangeErr, endpoint, resource, nil
+}
+
+// TestPostRetryTransientErrors は接続の切断と5xxの後にやり直して成功し、5xxで作られたセッションをDELETEすることを検証する
+func TestPostRetryTransientErrors(t *testing.T) {
+	exchangeErr, endpoint, resource, err := postRetryExchange([]string{respondReset, respond503}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exchangeErr != nil {
+		t.Fatalf("exchange failed: %v", exchangeErr)
+	}
+	if endpoint.posts != 3 {
+		t.Fatalf("%d POSTs, want 3", endpoint.posts)
+	}
+	if resource != "/session/3" {
+		t.Fatalf("resource %q, want /session/3", resource)
+	}
+	if got := strings.Join(endpoint.deletes, ","); got != "/session/2" {
+		t.Fatalf("DELETEd %q, want the session of the 503 response (/session/2)", got)
+	}
+}
+
+// TestPostRetryTruncatedAnswer はLocationを受け取った後に応答が途切れた場合に、そのセッションをDELETEしてからやり直すことを検証する
+func TestPostRetryTruncatedAnswer(t *testing.T) {
+	exchangeErr, endpoint, resource, err := postRetryExchange([]string{respondTruncated}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exchangeErr != nil {
+		t.Fatalf("exchange failed: %v", exchangeErr)
+	}
+	if endpoint.posts != 2 || resource != "/session/2" {
+		t.Fatalf("%d POSTs with resource %q, want 2 with /session/2", endpoint.posts, resource)
+	}
+	if got := strings.Join(endpoint.deletes, ","); got != "/session/1" {
+		t.Fatalf("DELETEd %q, want the orphaned /session/1", got)
+	}
+}
+
+// TestPostRetryNoRetryOn4xx は4xxではやり直さずにServerErrorを返すことを検証する
+func TestPostRetryNoRetryOn4xx(t *testing.T) {
+	exchangeErr, endpoint, _, err := postRetryExchange([]string{respond400}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serverErr *ServerError
+	if !errors.As(exchangeErr, &serverErr) || serverErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("got %v, want a 400 ServerError", exchangeErr)
+	}
+	if endpoint.posts != 1 {
+		t.Fatalf("%d POSTs, want 1 (4xx must not be retried)", endpoint.posts)
+	}
+}
+
+// TestPostRetryRetriesExhausted はやり直しの回数を使い切った場合に最後のエラーを返すことを検証する
+func TestPostRetryRetriesExhausted(t *testing.T) {
+	exchangeErr, endpoint, resource, err := postRetryExchange([]string{respondReset, respondReset, respondReset, respondReset}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(exchangeErr, ErrConnection) {
+		t.Fatalf("got %v, want a connection error", exchangeErr)
+	}
+	if endpoint.posts != 3 {
+		t.Fatalf("%d POSTs, want 3 (1 + 2 retries)", endpoint.posts)
+	}
+	if resource != "" {
+		t.Fatalf("resource %q set after a failed exchange", resource)
+	}
+}
+
+// TestPostRetryDisabled はやり直しの回数が0の場合に最初の失敗で返すことを検証する
+func TestPostRetryDisabled(t *testing.T) {
+	exchangeErr, endpoint, _, err := postRetryExchange([]string{respond503}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exchangeErr == nil || endpoint.posts != 1 {
+		t.Fatalf("got %v after %d POSTs, want the 503 after 1 POST", exchangeErr, endpoint.posts)
+	}
+}
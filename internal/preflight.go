@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	preflightGatherTimeout = 10 * time.Second
+	preflightHTTPTimeout   = 10 * time.Second
+)
+
+// PreflightResult は接続前チェックの結果を保持する
+type PreflightResult struct {
+	HostCandidates  int
+	SrflxCandidates int
+	RelayCandidates int
+	GatherErr       error
+	HTTPMethod      string
+	HTTPStatus      int
+	HTTPErr         error
+}
+
+// ICEOK はICE候補が1つ以上収集できたかを返す
+func (r *PreflightResult) ICEOK() bool {
+	return r.GatherErr == nil && r.HostCandidates+r.SrflxCandidates+r.RelayCandidates > 0
+}
+
+// EndpointOK はエンドポイントが到達可能かつ認証エラーでないかを返す
+func (r *PreflightResult) EndpointOK() bool {
+	if r.HTTPErr != nil || r.HTTPStatus == 0 {
+		return false
+	}
+	return r.HTTPStatus != http.StatusUnauthorized && r.HTTPStatus != http.StatusForbidden && r.HTTPStatus < 500
+}
+
+// OK は全てのチェックが成功したかを返す
+func (r *PreflightResult) OK() bool {
+	return r.ICEOK() && r.EndpointOK()
+}
+
+// RunPreflightCheck はICE収集とエンドポイント到達性を確認し、結果を出力する
+// 全チェック成功時はnil、失敗時はエラーを返す
+func RunPreflightCheck(url string) error {
+	result := &PreflightResult{}
+
+	fmt.Fprintln(os.Stderr, "Running preflight check...")
+	gatherPreflightCandidates(result)
+	probeEndpoint(url, result)
+	printPreflightSummary(url, result)
+
+	if !result.OK() {
+		return fmt.Errorf("%w: preflight check failed", ErrConnection)
+	}
+	return nil
+}
+
+// gatherPreflightCandidates は設定済みICEサーバーに対して候補収集を行い、種類ごとに数える
+func gatherPreflightCandidates(result *PreflightResult) {
+	api := webrtc.NewAPI(webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(NewPeerConnectionConfig())
+	if err != nil {
+		result.GatherErr = err
+		return
+	}
+	defer peerConnection.Close()
+
+	var mu sync.Mutex
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		DebugLog("Preflight candidate: %s\n", candidate.String())
+		mu.Lock()
+		defer mu.Unlock()
+		switch candidate.Typ {
+		case webrtc.ICECandidateTypeHost:
+			result.HostCandidates++
+		case webrtc.ICECandidateTypeSrflx, webrtc.ICECandidateTypePrflx:
+			result.SrflxCandidates++
+		case webrtc.ICECandidateTypeRelay:
+			result.RelayCandidates++
+		}
+	})
+
+	// 候補収集を開始するにはトランシーバーが必要
+	if _, err := peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+		webrtc.RTPTransceiverInit{
+			Direction: webrtc.RTPTransceiverDirectionRecvonly,
+		}); err != nil {
+		result.GatherErr = err
+		return
+	}
+
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		result.GatherErr = err
+		return
+	}
+	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
+	if err := peerConnection.SetLocalDescription(offer); err != nil {
+		result.GatherErr = err
+		return
+	}
+
+	select {
+	case <-gatherComplete:
+	case <-time.After(preflightGatherTimeout):
+		result.GatherErr = fmt.Errorf("ICE gathering timeout after %v", preflightGatherTimeout)
+	}
+}
+
+// probeEndpoint はOPTIONSでエンドポイントを確認し、未対応の場合はHEADで再試行する
+func probeEndpoint(url string, result *PreflightResult) {
+	client := &http.Client{Timeout: preflightHTTPTimeout}
+
+	for _, method := range []string{http.MethodOptions, http.MethodHead} {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			result.HTTPErr = err
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			result.HTTPMethod = method
+			result.HTTPErr = err
+			return
+		}
+		resp.Body.Close()
+
+		result.HTTPMethod = method
+		result.HTTPStatus = resp.StatusCode
+		result.HTTPErr = nil
+		if resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotImplemented {
+			return
+		}
+	}
+}
+
+func printPreflightSummary(url string, result *PreflightResult) {
+	fmt.Fprintln(os.Stderr, "\n=== Preflight Check ===")
+
+	iceStatus := "PASS"
+	if !result.ICEOK() {
+		iceStatus = "FAIL"
+	}
+	fmt.Fprintf(os.Stderr, "[%s] ICE gathering: host=%d, srflx=%d, relay=%d\n",
+		iceStatus, result.HostCandidates, result.SrflxCandidates, result.RelayCandidates)
+	if result.GatherErr != nil {
+		fmt.Fprintf(os.Stderr, "       error: %v\n", result.GatherErr)
+	} else if result.SrflxCandidates == 0 {
+		fmt.Fprintln(os.Stderr, "       warning: no srflx candidates (STUN unreachable?)")
+	}
+
+	endpointStatus := "PASS"
+	if !result.EndpointOK() {
+		endpointStatus = "FAIL"
+	}
+	switch {
+	case result.HTTPErr != nil:
+		fmt.Fprintf(os.Stderr, "[%s] Endpoint %s: %v\n", endpointStatus, url, result.HTTPErr)
+	case result.HTTPStatus == http.StatusUnauthorized || result.HTTPStatus == http.StatusForbidden:
+		fmt.Fprintf(os.Stderr, "[%s] Endpoint %s: %s returned %d (authentication rejected)\n",
+			endpointStatus, url, result.HTTPMethod, result.HTTPStatus)
+	default:
+		fmt.Fprintf(os.Stderr, "[%s] Endpoint %s: %s returned %d\n",
+			endpointStatus, url, result.HTTPMethod, result.HTTPStatus)
+	}
+
+	if result.OK() {
+		fmt.Fprintln(os.Stderr, "Result: PASS")
+	} else {
+		fmt.Fprintln(os.Stderr, "Result: FAIL")
+	}
+}
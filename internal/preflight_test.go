@@ -0,0 +1,119 @@
+package internal
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// preflightServer はOPTIONSとHEADにそれぞれ指定したステータスを返すサーバーを起動する
+func preflightServer(optionsStatus, headStatus int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodOptions:
+			w.WriteHeader(optionsStatus)
+		case http.MethodHead:
+			w.WriteHeader(headStatus)
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+}
+
+// TestPreflightEndpoint はOPTIONSに未対応のエンドポイントではHEADで確認し、認証エラーとサーバーエラーを失敗とすることを検証する
+func TestPreflightEndpoint(t *testing.T) {
+	cases := []struct {
+		name          string
+		optionsStatus int
+		headStatus    int
+		wantMethod    string
+		wantStatus    int
+		wantOK        bool
+	}{
+		{"options", http.StatusNoContent, http.StatusOK, http.MethodOptions, http.StatusNoContent, true},
+		{"head after 405", http.StatusMethodNotAllowed, http.StatusOK, http.MethodHead, http.StatusOK, true},
+		{"head after 501", http.StatusNotImplemented, http.StatusOK, http.MethodHead, http.StatusOK, true},
+		{"head not allowed either", http.StatusMethodNotAllowed, http.StatusMethodNotAllowed, http.MethodHead, http.StatusMethodNotAllowed, true},
+		{"unauthorized", http.StatusUnauthorized, http.StatusOK, http.MethodOptions, http.StatusUnauthorized, false},
+		{"forbidden on head", http.StatusMethodNotAllowed, http.StatusForbidden, http.MethodHead, http.StatusForbidden, false},
+		{"server error", http.StatusServiceUnavailable, http.StatusOK, http.MethodOptions, http.StatusServiceUnavailable, false},
+	}
+	for _, c := range cases {
+		server := preflightServer(c.optionsStatus, c.headStatus)
+		result := &PreflightResult{}
+		probeEndpoint(server.URL, result)
+		server.Close()
+
+		if result.HTTPErr != nil {
+			t.Fatalf("%s: %v", c.name, result.HTTPErr)
+		}
+		if result.HTTPMethod != c.wantMethod || result.HTTPStatus != c.wantStatus {
+			t.Fatalf("%s: %s returned %d, want %s returning %d", c.name, result.HTTPMethod, result.HTTPStatus, c.wantMethod, c.wantStatus)
+		}
+		if result.EndpointOK() != c.wantOK {
+			t.Fatalf("%s: EndpointOK() = %v, want %v", c.name, result.EndpointOK(), c.wantOK)
+		}
+	}
+
+	// 接続できないエンドポイント
+	server := preflightServer(http.StatusNoContent, http.StatusOK)
+	server.Close()
+	result := &PreflightResult{}
+	probeEndpoint(server.URL, result)
+	if result.HTTPErr == nil || result.EndpointOK() {
+		t.Fatalf("unreachable endpoint passed: %s returned %d", result.HTTPMethod, result.HTTPStatus)
+	}
+}
+
+// TestPreflightResult はICE候補が無い場合や収集に失敗した場合にチェック全体を失敗とすることを検証する
+func TestPreflightResult(t *testing.T) {
+	reachable := PreflightResult{HTTPMethod: http.MethodOptions, HTTPStatus: http.StatusNoContent}
+
+	hostOnly := reachable
+	hostOnly.HostCandidates = 1
+	if !hostOnly.OK() {
+		t.Fatal("a host candidate and a reachable endpoint failed")
+	}
+	relayOnly := reachable
+	relayOnly.RelayCandidates = 1
+	if !relayOnly.OK() {
+		t.Fatal("a relay candidate and a reachable endpoint failed")
+	}
+	if noCandidates := reachable; noCandidates.ICEOK() || noCandidates.OK() {
+		t.Fatal("passed without any ICE candidate")
+	}
+	timedOut := hostOnly
+	timedOut.GatherErr = errors.New("ICE gathering timeout")
+	if timedOut.ICEOK() || timedOut.OK() {
+		t.Fatal("passed after the ICE gathering failed")
+	}
+}
+
+// TestPreflightCheck は--checkのチェック全体が、結果の表示とErrConnection（終了コード）で成否を返すことを検証する
+func TestPreflightCheck(t *testing.T) {
+	server := preflightServer(http.StatusNoContent, http.StatusOK)
+	defer server.Close()
+	stderr, err := udpRecvBufferCaptureStderr(func() error { return RunPreflightCheck(server.URL) })
+	if err != nil {
+		t.Fatalf("check failed against a reachable endpoint: %v\n%s", err, stderr)
+	}
+	for _, want := range []string{"[PASS] ICE gathering: host=", "[PASS] Endpoint " + server.URL + ": OPTIONS returned 204", "Result: PASS"} {
+		if !strings.Contains(stderr, want) {
+			t.Fatalf("summary does not contain %q:\n%s", want, stderr)
+		}
+	}
+
+	rejecting := preflightServer(http.StatusUnauthorized, http.StatusUnauthorized)
+	defer rejecting.Close()
+	stderr, err = udpRecvBufferCaptureStderr(func() error { return RunPreflightCheck(rejecting.URL) })
+	if !errors.Is(err, ErrConnection) {
+		t.Fatalf("got %v against an endpoint rejecting authentication, want ErrConnection", err)
+	}
+	for _, want := range []string{"OPTIONS returned 401 (authentication rejected)", "Result: FAIL"} {
+		if !strings.Contains(stderr, want) {
+			t.Fatalf("summary does not contain %q:\n%s", want, stderr)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// Preset は --preset でまとめて設定するフラグの値
+// 各フィールドは同名のフラグに対応し、コマンドラインで明示したフラグが優先される
+type Preset struct {
+	OutputBufferSize   int    // --output-buffer
+	FlushIntervalMs    int    // --flush-interval
+	InterleaveWindowMs int    // --interleave-window
+	InterleaveDepth    int    // --interleave-depth
+	QueueCapacity      int    // --queue-capacity
+	NoPacing           bool   // --no-pacing
+	DropThreshold      int    // --drop-threshold
+	EncodeDeadline     string // --encode-deadline
+	CPUUsed            int    // --cpu-used
+	KeyframeInterval   int    // --keyframe-interval
+}
+
+// presets は --preset で指定できるプリセット
+// balancedはフラグのデフォルト値と同じ
+var presets = map[string]Preset{
+	"low-latency": {
+		OutputBufferSize:   minOutputBufferSize,
+		FlushIntervalMs:    0,
+		InterleaveWindowMs: 0,
+		InterleaveDepth:    16,
+		QueueCapacity:      3,
+		NoPacing:           false,
+		DropThreshold:      50,
+		EncodeDeadline:     "realtime",
+		CPUUsed:            8,
+		KeyframeInterval:   30,
+	},
+	"balanced": {
+		OutputBufferSize:   64 * 1024,
+		FlushIntervalMs:    100,
+		InterleaveWindowMs: 0,
+		InterleaveDepth:    16,
+		QueueCapacity:      12,
+		NoPacing:           false,
+		DropThreshold:      200,
+		EncodeDeadline:     "realtime",
+		CPUUsed:            0,
+		KeyframeInterval:   30,
+	},
+	"quality": {
+		OutputBufferSize:   1024 * 1024,
+		FlushIntervalMs:    500,
+		InterleaveWindowMs: 200,
+		InterleaveDepth:    64,
+		QueueCapacity:      60,
+		NoPacing:           false,
+		DropThreshold:      0,
+		EncodeDeadline:     "good",
+		CPUUsed:            4,
+		KeyframeInterval:   150,
+	},
+}
+
+// presetNames はプリセット名を辞書順で返す
+func presetNames() string {
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// applyPreset はプリセットの値をフラグ変数に設定する
+// ParseArgs/ParseWhipArgsの検証前に呼び、コマンドラインで明示されたフラグは上書きしない
+func applyPreset(name string) error {
+	if name == "" {
+		return nil
+	}
+	p, ok := presets[name]
+	if !ok {
+		return fmt.Errorf("invalid --preset: %s (supported: %s)", name, presetNames())
+	}
+	setPresetValue("output-buffer", &OutputBufferSize, p.OutputBufferSize)
+	setPresetValue("flush-interval", &FlushIntervalMs, p.FlushIntervalMs)
+	setPresetValue("interleave-window", &InterleaveWindowMs, p.InterleaveWindowMs)
+	setPresetValue("interleave-depth", &InterleaveDepth, p.InterleaveDepth)
+	setPresetValue("queue-capacity", &QueueCapacity, p.QueueCapacity)
+	setPresetValue("no-pacing", &NoPacing, p.NoPacing)
+	setPresetValue("drop-threshold", &DropThreshold, p.DropThreshold)
+	// cpu-usedの範囲はdeadlineに依存するため、deadlineを明示した場合はcpu-usedもフラグの値を使う
+	if !pflag.CommandLine.Changed("encode-deadline") {
+		setPresetValue("encode-deadline", &EncodeDeadline, p.EncodeDeadline)
+		setPresetValue("cpu-used", &CPUUsed, p.CPUUsed)
+	}
+	setPresetValue("keyframe-interval", &KeyframeInterval, p.KeyframeInterval)
+	DebugLog("Preset %s applied\n", name)
+	return nil
+}
+
+// setPresetValue はフラグが明示されていない場合のみプリセットの値を設定する
+func setPresetValue[T any](flag string, dst *T, value T) {
+	if !pflag.CommandLine.Changed(flag) {
+		*dst = value
+	}
+}
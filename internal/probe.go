@@ -0,0 +1,232 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azunyan1111/libvpx-go/vpx"
+)
+
+// ProbeWriter はMKVを出力せずに受信ストリームの性質（解像度、フレームレート、ビットレート等）を計測するStreamWriter
+// --probe で使用し、映像は実際にデコードして解像度とデコードエラー数を得る
+type ProbeWriter struct {
+	mu        sync.Mutex
+	codecType string
+	ctx       *vpx.CodecCtx
+	startedAt time.Time
+	clock     Clock
+
+	videoFrames    int
+	videoKeyframes int
+	videoBytes     int
+	decodeErrors   int
+	width          int
+	height         int
+	videoTimestamp rtpTimestampUnwrapper
+	videoLastRTP   uint64
+
+	audioFrames    int
+	audioBytes     int
+	audioStereo    bool
+	audioTimestamp rtpTimestampUnwrapper
+	audioLastRTP   uint64
+	audioLastSize  int // 最後の音声フレームのサンプル数（区間長の補正用）
+}
+
+// ProbeResult はProbeWriterの計測結果
+type ProbeResult struct {
+	VideoCodec     string
+	Width          int
+	Height         int
+	VideoFrames    int
+	VideoKeyframes int
+	DecodeErrors   int
+	FPS            float64
+	VideoKbps      float64
+
+	AudioFrames     int
+	AudioChannels   int
+	AudioSampleRate int
+	AudioKbps       float64
+}
+
+// NewProbeWriter は新しいProbeWriterを作成する
+func NewProbeWriter() *ProbeWriter {
+	return &ProbeWriter{codecType: "vp8", clock: SystemClock{}}
+}
+
+// SetClock は経過時間の計算に使う時刻の取得元を差し替える
+func (w *ProbeWriter) SetClock(clock Clock) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.clock = clock
+}
+
+// SetVideoCodec はトラックのコーデック確定時にStreamManagerから呼ばれる
+func (w *ProbeWriter) SetVideoCodec(codecType string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if codecType != "" {
+		w.codecType = codecType
+	}
+}
+
+// WriteVideoFrame はフレームをデコードし、フレーム数とサイズを集計する
+func (w *ProbeWriter) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.startedAt.IsZero() {
+		w.startedAt = w.clock.Now()
+	}
+	w.videoFrames++
+	w.videoBytes += len(data)
+	if keyframe {
+		w.videoKeyframes++
+	}
+	w.videoLastRTP = w.videoTimestamp.Extend(timestamp)
+
+	if w.ctx == nil {
+		var iface *vpx.CodecIface
+		switch w.codecType {
+		case "vp8":
+			iface = vpx.DecoderIfaceVP8()
+		case "vp9":
+			iface = vpx.DecoderIfaceVP9()
+		default:
+			return fmt.Errorf("unsupported codec type: %s", w.codecType)
+		}
+		w.ctx = vpx.NewCodecCtx()
+		if err := vpx.Error(vpx.CodecDecInitVer(w.ctx, iface, nil, 0, vpx.DecoderABIVersion)); err != nil {
+			w.ctx = nil
+			return fmt.Errorf("failed to initialize VPX decoder: %w", err)
+		}
+	}
+
+	if err := vpx.Error(vpx.CodecDecode(w.ctx, string(data), uint32(len(data)), nil, 0)); err != nil {
+		w.decodeErrors++
+		return nil
+	}
+	var iter vpx.CodecIter
+	if img := vpx.CodecGetFrame(w.ctx, &iter); img != nil {
+		img.Deref()
+		w.width = int(img.DW)
+		w.height = int(img.DH)
+	}
+	return nil
+}
+
+// WriteAudioFrame はOpusフレーム数とサイズを集計する
+func (w *ProbeWriter) WriteAudioFrame(data []byte, timestamp uint32) error {
+	if len(data) == 0 {
+		return nil
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.startedAt.IsZero() {
+		w.startedAt = w.clock.Now()
+	}
+	w.audioFrames++
+	w.audioBytes += len(data)
+	// TOCのsビットがステレオを示す（RFC 6716 3.1）
+	if data[0]&0x04 != 0 {
+		w.audioStereo = true
+	}
+	w.audioLastRTP = w.audioTimestamp.Extend(timestamp)
+	w.audioLastSize = OpusPacketSamples(data)
+	return nil
+}
+
+// Run はStreamWriterを満たすためのもので、ProbeWriterは出力を持たない
+func (w *ProbeWriter) Run() error {
+	return nil
+}
+
+// Close はデコーダーを解放する
+func (w *ProbeWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.ctx != nil {
+		vpx.CodecDestroy(w.ctx)
+		w.ctx = nil
+	}
+	return nil
+}
+
+// Result はこれまでの計測結果を返す
+// フレームレートとビットレートはRTP timestampの区間長から求め、
+// 1フレームしかない場合は受信開始からの経過時間を使う
+func (w *ProbeWriter) Result() ProbeResult {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	result := ProbeResult{
+		VideoCodec:     strings.ToUpper(w.codecType),
+		Width:          w.width,
+		Height:         w.height,
+		VideoFrames:    w.videoFrames,
+		VideoKeyframes: w.videoKeyframes,
+		DecodeErrors:   w.decodeErrors,
+		AudioFrames:    w.audioFrames,
+	}
+
+	elapsed := w.clock.Now().Sub(w.startedAt).Seconds()
+	if w.videoFrames > 0 {
+		// 区間長は最後のフレームの表示時間（平均フレーム間隔）を含める
+		duration := elapsed
+		if w.videoFrames > 1 && w.videoLastRTP > 0 {
+			interval := float64(w.videoLastRTP) / 90000 / float64(w.videoFrames-1)
+			duration = float64(w.videoLastRTP)/90000 + interval
+		}
+		if duration > 0 {
+			result.FPS = float64(w.videoFrames) / duration
+			result.VideoKbps = float64(w.videoBytes) * 8 / duration / 1000
+		}
+	}
+	if w.audioFrames > 0 {
+		result.AudioSampleRate = OpusClockRate
+		result.AudioChannels = 1
+		if w.audioStereo {
+			result.AudioChannels = 2
+		}
+		duration := elapsed
+		if w.audioFrames > 1 && w.audioLastRTP > 0 {
+			duration = float64(w.audioLastRTP+uint64(w.audioLastSize)) / OpusClockRate
+		}
+		if duration > 0 {
+			result.AudioKbps = float64(w.audioBytes) * 8 / duration / 1000
+		}
+	}
+	return result
+}
+
+// PrintProbeSummary は計測結果をstderrに出力する
+func PrintProbeSummary(result ProbeResult) {
+	fmt.Fprintln(os.Stderr, "Probe result:")
+	if result.VideoFrames > 0 {
+		resolution := "unknown"
+		if result.Width > 0 && result.Height > 0 {
+			resolution = fmt.Sprintf("%dx%d", result.Width, result.Height)
+		}
+		fmt.Fprintf(os.Stderr, "  Video: %s %s, %.2f fps, %.0f kbps (%d frames, %d keyframes, %d decode errors)\n",
+			result.VideoCodec, resolution, result.FPS, result.VideoKbps,
+			result.VideoFrames, result.VideoKeyframes, result.DecodeErrors)
+	} else {
+		fmt.Fprintln(os.Stderr, "  Video: no frames received")
+	}
+	if result.AudioFrames > 0 {
+		fmt.Fprintf(os.Stderr, "  Audio: OPUS %dHz, %d ch, %.0f kbps (%d frames)\n",
+			result.AudioSampleRate, result.AudioChannels, result.AudioKbps, result.AudioFrames)
+	} else {
+		fmt.Fprintln(os.Stderr, "  Audio: no frames received")
+	}
+}
@@ -0,0 +1,113 @@
+package internal
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// --pts-monotonic の値
+const (
+	PTSMonotonicOff    = "off"    // 戻ったPTSをそのまま送る
+	PTSMonotonicDrop   = "drop"   // 戻ったPTSのフレームを、PTSが追いつくまで破棄する
+	PTSMonotonicRebase = "rebase" // 戻った位置から、最後に通したPTSの続きになるようタイムラインをずらす
+)
+
+// ValidatePTSMonotonic は --pts-monotonic の値を検証する
+func ValidatePTSMonotonic(mode string) error {
+	switch mode {
+	case PTSMonotonicOff, PTSMonotonicDrop, PTSMonotonicRebase:
+		return nil
+	default:
+		return fmt.Errorf("invalid --pts-monotonic: %s (supported: %s, %s, %s)", mode, PTSMonotonicOff, PTSMonotonicDrop, PTSMonotonicRebase)
+	}
+}
+
+// PTSFilter は1トラックのPTSが許容範囲を超えて戻った場合（入力MKVのPTSの乱れ）に、
+// フレームを破棄するか、タイムラインをずらして単調増加に保つ
+// 戻った幅がtoleranceMs以下の場合はミリ秒への丸め等の揺らぎとみなし、そのまま通す
+type PTSFilter struct {
+	mode        string
+	toleranceMs int64
+	lastMs      int64        // 通したフレームの（ずらした後の）最大のPTS
+	stepMs      int64        // 直前に通したフレームとのPTSの間隔（rebaseで次のフレームを置く位置に使う）
+	timeline    *ptsTimeline // rebaseで入力PTSに足すずれ（NewLinkedPTSFiltersで作ったトラック間で共有）
+	initialized bool
+	dropping    bool         // dropでPTSが追いつくのを待っている
+	glitches    atomic.Int64 // 許容範囲を超えてPTSが戻った回数
+	dropped     atomic.Int64 // dropで破棄したフレーム数
+}
+
+// ptsTimeline はrebaseのずれを共有するトラックのPTSFilter
+// 入力のループ等でPTSが戻るとすべてのトラックが同時に戻るため、最初に戻ったトラックで決めたずれを
+// 他のトラックにもそのまま使い、トラック間の同期を保つ
+type ptsTimeline struct {
+	offsetMs int64
+	filters  []*PTSFilter
+}
+
+// NewPTSFilter は新しいPTSFilterを作成する（modeはPTSMonotonicDropまたはPTSMonotonicRebase）
+func NewPTSFilter(mode string, toleranceMs int64) *PTSFilter {
+	return NewLinkedPTSFilters(mode, toleranceMs, 1)[0]
+}
+
+// NewLinkedPTSFilters はrebaseのずれを共有するn個のトラックのPTSFilterを作成する
+// いずれかのトラックのPTSが戻ると、全トラックで最後に通したPTSの続きになるずれを決め、以降は全トラックに足す
+func NewLinkedPTSFilters(mode string, toleranceMs int64, n int) []*PTSFilter {
+	timeline := &ptsTimeline{}
+	for i := 0; i < n; i++ {
+		timeline.filters = append(timeline.filters, &PTSFilter{mode: mode, toleranceMs: toleranceMs, timeline: timeline})
+	}
+	return timeline.filters
+}
+
+// lastMs はトラックが最後に通したPTSのうち最大のもの（未開始のトラックは除く）を返す
+func (t *ptsTimeline) lastMs() int64 {
+	var last int64
+	started := false
+	for _, f := range t.filters {
+		if f.initialized && (!started || f.lastMs > last) {
+			last = f.lastMs
+			started = true
+		}
+	}
+	return last
+}
+
+// Filter はフレームを送る場合は（ずらした後の）PTSとtrue、破棄する場合はfalseを返す
+func (f *PTSFilter) Filter(timestampMs int64) (int64, bool) {
+	pts := timestampMs + f.timeline.offsetMs
+	if !f.initialized {
+		f.initialized = true
+		f.lastMs = pts
+		return pts, true
+	}
+
+	if pts < f.lastMs-f.toleranceMs {
+		if f.mode == PTSMonotonicDrop {
+			if !f.dropping {
+				f.dropping = true
+				f.glitches.Add(1)
+			}
+			f.dropped.Add(1)
+			return 0, false
+		}
+		f.glitches.Add(1)
+		// 直前の間隔を空けて、全トラックで最後に通したPTSの次に置く
+		step := max(f.stepMs, 1)
+		last := f.timeline.lastMs()
+		f.timeline.offsetMs += last + step - pts
+		pts = last + step
+	}
+
+	f.dropping = false
+	if pts > f.lastMs {
+		f.stepMs = pts - f.lastMs
+		f.lastMs = pts
+	}
+	return pts, true
+}
+
+// Glitches は許容範囲を超えてPTSが戻った回数と、dropで破棄したフレーム数を返す（統計用、Filterと並行に呼べる）
+func (f *PTSFilter) Glitches() (glitches, dropped int64) {
+	return f.glitches.Load(), f.dropped.Load()
+}
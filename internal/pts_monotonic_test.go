@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"reflect"
+	"testing"
+)
+
+const ptsMonotonicTolerance = 50
+
+// glitchPTS は30fpsの映像で、100msのフレームの後にPTSが10msへ戻るPTS列
+var glitchPTS = []int64{0, 33, 66, 100, 10, 43, 76, 110, 143}
+
+// filtered はfilterを通ったフレームの（補正後の）PTSを返す
+func filtered(filter *PTSFilter, pts []int64) []int64 {
+	var kept []int64
+	for _, p := range pts {
+		if out, ok := filter.Filter(p); ok {
+			kept = append(kept, out)
+		}
+	}
+	return kept
+}
+
+// TestPTSMonotonicDrop はdropでPTSが戻ったフレームを、最後に通したPTSに追いつくまで破棄することを検証する
+func TestPTSMonotonicDrop(t *testing.T) {
+	filter := NewPTSFilter(PTSMonotonicDrop, ptsMonotonicTolerance)
+	got := filtered(filter, glitchPTS)
+	// 10, 43は100より50ms以上前のため破棄し、76は許容範囲内のため通す
+	want := []int64{0, 33, 66, 100, 76, 110, 143}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if glitches, dropped := filter.Glitches(); glitches != 1 || dropped != 2 {
+		t.Fatalf("got %d glitches and %d dropped frames, want 1 and 2", glitches, dropped)
+	}
+}
+
+// TestPTSMonotonicRebase はrebaseで戻った位置以降のPTSを、最後に通したPTSから直前の間隔を空けて続けることを検証する
+func TestPTSMonotonicRebase(t *testing.T) {
+	filter := NewPTSFilter(PTSMonotonicRebase, ptsMonotonicTolerance)
+	got := filtered(filter, glitchPTS)
+	// 10を100の34ms後（直前の間隔）の134に置き、以降も同じだけずらす
+	want := []int64{0, 33, 66, 100, 134, 167, 200, 234, 267}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if glitches, dropped := filter.Glitches(); glitches != 1 || dropped != 0 {
+		t.Fatalf("got %d glitches and %d dropped frames, want 1 and 0", glitches, dropped)
+	}
+
+	// 入力がループして先頭に戻った場合も、2回目以降のずれを積み重ねる
+	filter = NewPTSFilter(PTSMonotonicRebase, ptsMonotonicTolerance)
+	got = filtered(filter, []int64{0, 100, 200, 0, 100, 200, 0, 100})
+	want = []int64{0, 100, 200, 300, 400, 500, 600, 700}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("looping input: got %v, want %v", got, want)
+	}
+	if glitches, _ := filter.Glitches(); glitches != 2 {
+		t.Fatalf("looping input: got %d glitches, want 2", glitches)
+	}
+}
+
+// TestPTSMonotonicRebaseLinked はrebaseで先にPTSが戻った映像のずれを音声にも使い、ループした入力で
+// 映像と音声の相対的な位置を保ったまま、両トラックとも最後に通したPTSの後に続けることを検証する
+func TestPTSMonotonicRebaseLinked(t *testing.T) {
+	filters := NewLinkedPTSFilters(PTSMonotonicRebase, ptsMonotonicTolerance, 2)
+	video, audio := filters[0], filters[1]
+
+	// 映像40ms間隔、音声20ms間隔の入力が、音声100msの後に先頭へ戻る
+	type frame struct {
+		video bool
+		pts   int64
+	}
+	in := []frame{
+		{true, 0}, {false, 0}, {false, 20}, {true, 40}, {false, 40}, {false, 60}, {true, 80}, {false, 80}, {false, 100},
+		{true, 0}, {false, 0}, {false, 20}, {true, 40}, {false, 40},
+	}
+	var gotVideo, gotAudio []int64
+	for _, f := range in {
+		filter, out := audio, &gotAudio
+		if f.video {
+			filter, out = video, &gotVideo
+		}
+		pts, ok := filter.Filter(f.pts)
+		if !ok {
+			t.Fatalf("frame at %d dropped in rebase mode", f.pts)
+		}
+		*out = append(*out, pts)
+	}
+
+	// 映像の0を両トラックの最後（音声の100）から映像の間隔40msの後に置き、音声も同じ140msずらす
+	if want := []int64{0, 40, 80, 140, 180}; !reflect.DeepEqual(gotVideo, want) {
+		t.Fatalf("video: got %v, want %v", gotVideo, want)
+	}
+	if want := []int64{0, 20, 40, 60, 80, 100, 140, 160, 180}; !reflect.DeepEqual(gotAudio, want) {
+		t.Fatalf("audio: got %v, want %v", gotAudio, want)
+	}
+	videoGlitches, _ := video.Glitches()
+	audioGlitches, _ := audio.Glitches()
+	if videoGlitches != 1 || audioGlitches != 0 {
+		t.Fatalf("got %d video and %d audio glitches, want 1 and 0", videoGlitches, audioGlitches)
+	}
+}
+
+// TestPTSMonotonicTolerance は許容範囲内の逆戻り（丸めの揺らぎ）はそのまま通し、乱れとして数えないことを検証する
+func TestPTSMonotonicTolerance(t *testing.T) {
+	for _, mode := range []string{PTSMonotonicDrop, PTSMonotonicRebase} {
+		filter := NewPTSFilter(mode, ptsMonotonicTolerance)
+		pts := []int64{0, 33, 66, 65, 100, 50, 133}
+		if got := filtered(filter, pts); !reflect.DeepEqual(got, pts) {
+			t.Fatalf("%s: got %v, want %v unchanged", mode, got, pts)
+		}
+		if glitches, _ := filter.Glitches(); glitches != 0 {
+			t.Fatalf("%s: got %d glitches, want 0", mode, glitches)
+		}
+	}
+
+	// 許容範囲0では1msの逆戻りも乱れとする
+	filter := NewPTSFilter(PTSMonotonicDrop, 0)
+	if got := filtered(filter, []int64{0, 20, 19, 40}); !reflect.DeepEqual(got, []int64{0, 20, 40}) {
+		t.Fatalf("tolerance 0: got %v, want [0 20 40]", got)
+	}
+}
+
+// TestPTSMonotonicValidate は --pts-monotonic の値を検証する
+func TestPTSMonotonicValidate(t *testing.T) {
+	for _, mode := range []string{PTSMonotonicOff, PTSMonotonicDrop, PTSMonotonicRebase} {
+		if err := ValidatePTSMonotonic(mode); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ValidatePTSMonotonic("clamp"); err == nil {
+		t.Fatalf("--pts-monotonic clamp accepted")
+	}
+}
@@ -3,9 +3,15 @@ package internal
 import (
 	"bufio"
 	"bytes"
+	crand "crypto/rand"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
+	"math/rand"
+	"os"
 	"sync"
 	"time"
 	"unsafe"
@@ -22,11 +28,18 @@ const (
 	cluster     = 0x1F43B675
 	timecode    = 0xE7
 	simpleBlock = 0xA3
+	crc32Value  = 0xBF
+
+	// Cluster elements
+	clusterPosition = 0xA7
+	clusterPrevSize = 0xAB
 
 	// Info elements
 	timecodeScale = 0x2AD7B1
 	muxingApp     = 0x4D80
 	writingApp    = 0x5741
+	segmentUID    = 0x73A4
+	dateUTC       = 0x4461
 
 	// Track elements
 	trackEntry        = 0xAE
@@ -42,16 +55,37 @@ const (
 	channels          = 0x9F
 	colourSpace       = 0x2EB524
 	bitsPerChannel    = 0x55B2
+	projection        = 0x7670
+	projectionType    = 0x7671
+	projectionRoll    = 0x7675
 
 	// Track types
 	trackTypeVideo = 0x01
 	trackTypeAudio = 0x02
+
+	defaultTimecodeScale = 1000000 // 1ms
+
+	segmentUIDSize = 16
+
+	defaultOutputBufferSize = 64 * 1024
+
+	// --keyframe-timeout の半分が経過した時に送るPLIの数
+	keyframeTimeoutPLIBurst = 3
 )
 
+// ErrKeyframeTimeout は映像RTPを受信しているのに解像度を確定できるキーフレームが届かないことを示す
+// 送信側のエンコーダー設定の問題であることが多く、再接続しても解決しないため受け取った側は終了する
+var ErrKeyframeTimeout = errors.New("keyframe timeout")
+
 // RawVideoMKVWriter はVP8/VP9をデコードしてrawvideoとしてMKVに出力するライター
 type RawVideoMKVWriter struct {
 	writer          io.Writer
 	bufWriter       *bufio.Writer
+	counter         *countingWriter // 書き込んだバイト数（クラスタのPosition/PrevSize計算用）
+	out             *outputWriter   // 出力先が閉じられたことを検出する
+	flushInterval   time.Duration   // バッファを書き出す間隔（0でブロックごと）
+	lastFlush       time.Time
+	clock           Clock
 	ctx             *vpx.CodecCtx
 	codecType       string
 	width           int
@@ -60,17 +94,81 @@ type RawVideoMKVWriter struct {
 	isHeaderWritten bool
 	videoTrackNum   uint64
 	audioTrackNum   uint64
+	videoTrackUID   uint64
+	audioTrackUID   uint64
 	clusterTime     uint64
+	clusterStarted  bool
+	timecodeScale   uint64 // 1tickあたりのナノ秒（MKVのTimecodeScale）
+	lastVideoTicks  uint64 // 最後に受信した映像フレームのtimecode（tick）
+	videoOffset     uint64 // 映像timecodeの開始位置（ヘッダー前に始まった音声の分だけ後ろにずらす、tick）
 	videoTimestamp  rtpTimestampUnwrapper
-	audioTimestamp  rtpTimestampUnwrapper
+	audioTracks     []mkvAudioTrack   // 音声トラックごとの状態（常に1つ以上）
+	audioAdded      bool              // AddAudioTrackで最初の音声トラックを割り当て済み
+	earlyAudio      []earlyAudioFrame // ヘッダー書き込み前に届いた音声（ヘッダー書き込み時に書き込む）
 	mutex           sync.Mutex
 	done            chan struct{}
 	running         chan struct{}
 	initialized     bool
 	decoderInit     bool
 	lastValidFrame  []byte          // 最後に成功したRGBAフレームデータ（デコード失敗時の再出力用）
+	rgbaBuf         []byte          // デコードした画像のRGBA変換先（lastValidFrameと入れ替えて再利用する）
+	highBitDepth    bool            // 高ビット深度（VP9 Profile 2/3）の映像を8ビットに変換していることを表示済み
+	blockBuf        bytes.Buffer    // SimpleBlockのヘッダー（トラック番号、timecode、フラグ）
+	freeBlocks      [][]byte        // 書き込み済みのインターリーブ用バッファ（再利用する）
 	frameValidator  *FrameValidator // フレーム品質検証器
 	validationStats ValidationStats // 検証統計情報
+	decodeRecovery  *decodeRecovery // デコード失敗と破損フレームが続いた場合の対処
+	keyframeCtl     *KeyframeController
+	keyframeTimeout time.Duration     // 最初の映像フレームからキーフレームを待つ上限（0で無効）
+	firstVideoAt    time.Time         // 最初の映像フレームを受け取った時刻
+	firstAudioAt    time.Time         // ヘッダー書き込み前に最初の音声フレームを受け取った時刻
+	audioOnly       bool              // 映像トラック無しでヘッダーを書き込む（以降の映像は破棄する）
+	videoOnly       bool              // 音声トラック無しでヘッダーを書き込む（音声は破棄する、--video-out、音声の無いanswer）
+	audioOnlyAfter  time.Duration     // 最初の音声から映像が届かない場合に音声のみとするまでの時間（0で無効）
+	audioDelay      time.Duration     // 音声のtimecodeに加えるオフセット（--audio-delay-ms、負の値で音声を早める）
+	videoDropWarned bool              // 音声のみのMKVで映像を破棄したことを表示済み
+	keyframeBurst   bool              // キーフレーム待ちのPLIバーストを送信済み
+	interleaver     *blockInterleaver // A/V並べ替えバッファ（nilの場合は到着順に書き込む）
+	robustClusters  bool              // クラスタにPosition/PrevSizeを書き込む
+	segmentStart    uint64            // Segmentのデータ開始位置（Positionの基準）
+	lastClusterAt   uint64            // 直前のクラスタの開始位置
+	hasPrevCluster  bool
+	rotation        int  // 表示時に時計回りに回転すべき角度（CVO、ヘッダー書き込み時に確定）
+	rotationWarned  bool // ヘッダー書き込み後の回転変更を警告済み
+	headerCRC       bool // Info/TracksにCRC-32要素を書き込む（--mkv-crc）
+	rotatedKeyframe bool // ローテーション後の最初の映像ブロックをキーフレームとして書き込む
+	keyframesOnly   bool // キーフレームのみを書き込む（--keyframes-only）
+
+	// 再接続をまたいで同じSegmentに書き込む（mkvSink）
+	continued      *mkvSegmentState // 前のセッションが書き込んだSegment（ヘッダーを書かずに続きを書き込む）
+	timecodeBase   uint64           // すべてのブロックのtimecodeに加える値（前のセッションの続き、tick）
+	lastBlockTicks uint64           // 最後に書き込んだブロックのtimecode（tick）
+	lastBlockAt    time.Time        // 最後にブロックを書き込んだ時刻
+
+	writeDate   bool     // InfoにDateUTCを書き込む（--no-date で無効）
+	segmentSeed int64    // SegmentUIDの乱数シード（--segment-uid-seed、0でcrypto/rand）
+	tags        []MKVTag // Tracksの後に書き込むタグ（--title, --tag、空で書き込まない）
+	muxingApp   string   // InfoのMuxingApp（--muxing-app）
+	writingApp  string   // InfoのWritingApp（--writing-app）
+
+	// --sync-start: キーフレームのデコード後、音声が揃うまでヘッダーと映像を書き込まずに待つ
+	syncStart     bool
+	syncTimeout   time.Duration // キーフレームから音声を待つ上限（0で無制限）
+	syncWaitSince time.Time     // 解像度を確定したキーフレームの時刻（音声待ちの開始）
+	pendingTicks  uint64        // 音声待ちの間に保持しているlastValidFrameのRTP由来のtick
+	videoStart    uint64        // 最初に書き込んだ映像フレームのRTP由来のtick（timecode 0に詰める分）
+}
+
+// countingWriter は書き込んだバイト数を数えるio.Writer
+type countingWriter struct {
+	w io.Writer
+	n uint64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += uint64(n)
+	return n, err
 }
 
 // ValidationStats は検証統計を保持
@@ -79,13 +177,56 @@ type ValidationStats struct {
 	ValidFrames       int
 	InvalidFrames     int
 	RepeatedFrames    int // lastValidFrameを再利用した回数
+	SkippedFrames     int // デコード失敗が続きキーフレームを待つ間、出力しなかったフレーム数
+	InterFrames       int // --keyframes-only でデコードせずに破棄した差分フレーム数
 	DecodeErrors      int
 	LastInvalidReason string
 }
 
+// mkvAudioTrack は音声トラックごとのtimecodeの状態
+type mkvAudioTrack struct {
+	started   bool
+	offset    uint64 // 音声timecodeの開始位置（音声開始時点の映像timecode、tick）
+	timestamp rtpTimestampUnwrapper
+}
+
+// maxEarlyAudioFrames はヘッダー書き込み前に保持する、音声トラックごとのフレームの上限（20msのOpusで5秒分）
+// 超えた場合はそのトラックの古いフレームから破棄する（他のトラックのフレームは押し出さない）
+const maxEarlyAudioFrames = 250
+
+// dropOldestEarlyAudio はindexのトラックの保持している音声がmaxEarlyAudioFramesに達していれば、
+// そのトラックの最も古いフレームを破棄する
+func (w *RawVideoMKVWriter) dropOldestEarlyAudio(index int) {
+	oldest, count := -1, 0
+	for i, frame := range w.earlyAudio {
+		if frame.index != index {
+			continue
+		}
+		if oldest < 0 {
+			oldest = i
+		}
+		count++
+	}
+	if count < maxEarlyAudioFrames {
+		return
+	}
+	w.earlyAudio = append(w.earlyAudio[:oldest], w.earlyAudio[oldest+1:]...)
+	DebugLogPeriodic("mkv.early-audio", time.Second, "Early audio buffer full (%d frames on audio track %d), dropping the oldest frame\n", maxEarlyAudioFrames, index)
+}
+
+// earlyAudioFrame はMKVヘッダーの書き込み前に届いた音声フレーム
+type earlyAudioFrame struct {
+	index     int
+	data      []byte
+	timestamp uint32
+	arrival   time.Time
+}
+
 // rtpTimestampUnwrapper は32bit RTP timestampを64bitの単調増加値へ展開する
+// RTP timestampの初期値はトラックごとにランダムなため、最初の値を0とした相対値を返す
 type rtpTimestampUnwrapper struct {
 	initialized bool
+	firstRaw    uint32
 	lastRaw     uint32
 	wrapCount   uint64
 }
@@ -93,8 +234,9 @@ type rtpTimestampUnwrapper struct {
 func (u *rtpTimestampUnwrapper) Extend(timestamp uint32) uint64 {
 	if !u.initialized {
 		u.initialized = true
+		u.firstRaw = timestamp
 		u.lastRaw = timestamp
-		return uint64(timestamp)
+		return 0
 	}
 
 	// 32bit境界を跨いだ前進のみラップとして扱う
@@ -103,23 +245,220 @@ func (u *rtpTimestampUnwrapper) Extend(timestamp uint32) uint64 {
 	}
 
 	u.lastRaw = timestamp
-	return (u.wrapCount << 32) | uint64(timestamp)
+	extended := (u.wrapCount << 32) | uint64(timestamp)
+	// 最初のパケットより前に並び替えられたパケットは0に揃える
+	if extended < uint64(u.firstRaw) {
+		return 0
+	}
+	return extended - uint64(u.firstRaw)
 }
 
 // NewRawVideoMKVWriter は新しいRawVideoMKVWriterを作成
 func NewRawVideoMKVWriter(w io.Writer, codecType string) *RawVideoMKVWriter {
-	bufWriter := bufio.NewWriterSize(w, 64*1024) // 64KB buffer
+	out := newOutputWriter(w)
+	bufferSize := defaultOutputBufferSize
+	if OutputBufferSize > 0 {
+		bufferSize = OutputBufferSize
+	}
+	bufWriter := bufio.NewWriterSize(out, bufferSize)
+	var interleaver *blockInterleaver
+	scale := uint64(defaultTimecodeScale)
+	if MKVTimecodeScale > 0 {
+		scale = uint64(MKVTimecodeScale)
+	}
+	if InterleaveWindowMs > 0 {
+		// --audio-delay-ms でずらした音声は映像とその分離れて到着するため、保持する時間も延ばす
+		windowMs := InterleaveWindowMs + max(AudioDelayMs, -AudioDelayMs)
+		interleaver = newBlockInterleaver(uint64(windowMs)*uint64(time.Millisecond)/scale, InterleaveDepth)
+	}
+	layout := DefaultTrackLayout
+	if MKVTracks.VideoNum > 0 {
+		layout = MKVTracks.withDefaultUIDs()
+	}
+	counter := &countingWriter{w: bufWriter}
 	return &RawVideoMKVWriter{
-		writer:        bufWriter,
-		bufWriter:     bufWriter,
-		codecType:     codecType,
-		videoTrackNum: 1,
-		audioTrackNum: 2,
-		done:          make(chan struct{}),
-		running:       make(chan struct{}),
+		writer:          counter,
+		bufWriter:       bufWriter,
+		counter:         counter,
+		out:             out,
+		codecType:       codecType,
+		videoTrackNum:   layout.VideoNum,
+		audioTrackNum:   layout.AudioNum,
+		videoTrackUID:   layout.VideoUID,
+		audioTrackUID:   layout.AudioUID,
+		audioTracks:     make([]mkvAudioTrack, 1),
+		done:            make(chan struct{}),
+		running:         make(chan struct{}),
+		interleaver:     interleaver,
+		timecodeScale:   scale,
+		flushInterval:   time.Duration(max(FlushIntervalMs, 0)) * time.Millisecond,
+		keyframeTimeout: time.Duration(max(KeyframeTimeoutMs, 0)) * time.Millisecond,
+		audioOnlyAfter:  time.Duration(max(AudioOnlyTimeoutMs, 0)) * time.Millisecond,
+		audioDelay:      time.Duration(AudioDelayMs) * time.Millisecond,
+		clock:           SystemClock{},
+		robustClusters:  RobustClusters || isSeekableOutput(w),
+		headerCRC:       MKVCRC,
+		keyframesOnly:   KeyframesOnly,
+		writeDate:       !NoDate,
+		segmentSeed:     SegmentUIDSeed,
+		tags:            MKVTags,
+		muxingApp:       MuxingApp,
+		writingApp:      WritingApp,
+		syncStart:       SyncStart,
+		syncTimeout:     time.Duration(max(SyncStartTimeoutMs, 0)) * time.Millisecond,
+		decodeRecovery:  newDecodeRecovery(max(ConcealFrames, 0), time.Duration(max(DecodeStallMs, 0))*time.Millisecond),
 	}
 }
 
+// SetClock はフラッシュ間隔の判定に使う時刻の取得元を差し替える（Run開始前に呼ぶ）
+func (w *RawVideoMKVWriter) SetClock(clock Clock) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.clock = clock
+}
+
+// SetTrackLayout はトラック番号とTrackUIDを設定する（最初のフレームを書き込む前に呼ぶ）
+// UIDが0のトラックはトラック番号をUIDとして使う
+func (w *RawVideoMKVWriter) SetTrackLayout(layout TrackLayout) error {
+	if err := layout.Validate(); err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.isHeaderWritten {
+		return fmt.Errorf("track layout must be set before the MKV header is written")
+	}
+	layout = layout.withDefaultUIDs()
+	if err := layout.validateAudioTracks(len(w.audioTracks)); err != nil {
+		return err
+	}
+	w.videoTrackNum = layout.VideoNum
+	w.audioTrackNum = layout.AudioNum
+	w.videoTrackUID = layout.VideoUID
+	w.audioTrackUID = layout.AudioUID
+	return nil
+}
+
+// trackLayout は現在のトラック番号とTrackUIDを返す
+func (w *RawVideoMKVWriter) trackLayout() TrackLayout {
+	return TrackLayout{VideoNum: w.videoTrackNum, AudioNum: w.audioTrackNum, VideoUID: w.videoTrackUID, AudioUID: w.audioTrackUID}
+}
+
+// AddAudioTrack は音声トラックを追加し、WriteAudioTrackFrameに渡すインデックスを返す
+// 最初の呼び出しは常に存在する音声トラック（インデックス0）を返す。2つ目以降はMKVヘッダーを書き込む前のみ追加でき、
+// トラック番号とTrackUIDは最初の音声トラックに続く値（映像と重なる値は飛ばす）になる
+func (w *RawVideoMKVWriter) AddAudioTrack() (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.audioAdded {
+		w.audioAdded = true
+		return 0, nil
+	}
+	if w.isHeaderWritten {
+		return 0, fmt.Errorf("audio track added after the MKV header was written")
+	}
+	if err := w.trackLayout().validateAudioTracks(len(w.audioTracks) + 1); err != nil {
+		return 0, err
+	}
+	w.audioTracks = append(w.audioTracks, mkvAudioTrack{})
+	return len(w.audioTracks) - 1, nil
+}
+
+// SetAudioOnly は映像を待たずに音声のみのMKVを書き込むよう設定する（サーバーが映像を送らない場合）
+// ヘッダーは次の音声フレームで書き込む。既にヘッダーを書き込んでいる場合は何もしない
+func (w *RawVideoMKVWriter) SetAudioOnly() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.isHeaderWritten {
+		w.audioOnly = true
+	}
+}
+
+// SetVideoOnly は音声トラックの無い映像のみのMKVを書き込むよう設定する
+// （--video-out で音声を別に書き込む場合と、サーバーが音声を送らない場合）
+// 音声を待つ必要が無いため --sync-start は無効になる。最初のフレームを書き込む前に呼ぶ
+func (w *RawVideoMKVWriter) SetVideoOnly() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.isHeaderWritten {
+		w.videoOnly = true
+		w.syncStart = false
+	}
+}
+
+// SetKeyframeController はデコード失敗時のキーフレーム要求先を設定する
+func (w *RawVideoMKVWriter) SetKeyframeController(kc *KeyframeController) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.keyframeCtl = kc
+}
+
+// SetVideoCodec はデコードする映像コーデック（vp8, vp9）を設定する
+// 出力はrawvideoのためヘッダーは変わらず、初期化済みのデコーダーは次のフレームで作り直す
+func (w *RawVideoMKVWriter) SetVideoCodec(codecType string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if codecType == w.codecType {
+		return
+	}
+	if w.decoderInit && w.ctx != nil {
+		vpx.CodecDestroy(w.ctx)
+		w.ctx = nil
+		w.decoderInit = false
+	}
+	w.codecType = codecType
+}
+
+// SetVideoRotation はCVOで通知された表示回転を設定する
+// 回転はヘッダーのProjectionに書くため、ヘッダー書き込み後の変更は反映できず警告のみ行う
+func (w *RawVideoMKVWriter) SetVideoRotation(degrees int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.isHeaderWritten {
+		w.rotation = degrees
+		return
+	}
+	if degrees != w.rotation && !w.rotationWarned {
+		w.rotationWarned = true
+		fmt.Fprintf(os.Stderr, "Warning: video rotation changed to %d degrees after the MKV header was written; output keeps %d degrees\n", degrees, w.rotation)
+	}
+}
+
+// Rotate は現在のMKVを書き出して終え、以降をnewWriterに新しいMKVとして書き込む
+// ヘッダー書き込み後であれば同じ解像度・トラック構成のヘッダーをすぐに書き込み、デコーダーの状態は引き継ぐ
+// rawvideoは各フレームが単独で表示できるため、新しいファイルは次の映像フレームから（キーフレームとして）始まる
+// timecodeは前のファイルから続けるため、ファイルを並べると時刻がそろう
+func (w *RawVideoMKVWriter) Rotate(newWriter io.Writer) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if err := w.out.Err(); err != nil {
+		return err
+	}
+	if w.isHeaderWritten {
+		if err := w.flushInterleaver(); err != nil {
+			return fmt.Errorf("failed to finish the current MKV: %w", err)
+		}
+		if err := w.flush(); err != nil {
+			return fmt.Errorf("failed to finish the current MKV: %w", err)
+		}
+	}
+
+	w.out = newOutputWriter(newWriter)
+	w.bufWriter.Reset(w.out)
+	w.counter.n = 0
+	w.robustClusters = RobustClusters || isSeekableOutput(newWriter)
+	w.clusterStarted = false
+	if !w.isHeaderWritten {
+		return nil
+	}
+	w.rotatedKeyframe = !w.audioOnly
+	if err := w.writeHeaders(); err != nil {
+		return fmt.Errorf("failed to write headers: %w", err)
+	}
+	return nil
+}
+
 // initDecoder はデコーダーを初期化
 func (w *RawVideoMKVWriter) initDecoder() error {
 	var iface *vpx.CodecIface
@@ -152,23 +491,55 @@ func (w *RawVideoMKVWriter) WriteVideoFrame(data []byte, timestamp uint32, keyfr
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
+	// 出力先が閉じられた後はデコードせずに同じエラーを返す
+	if err := w.out.Err(); err != nil {
+		return err
+	}
+
+	// 音声のみのMKVには映像トラックが無いため破棄する
+	if w.audioOnly {
+		if !w.videoDropWarned {
+			w.videoDropWarned = true
+			fmt.Fprintln(os.Stderr, "Video received after the audio-only MKV header was written, dropping video")
+		}
+		return nil
+	}
+
 	w.validationStats.TotalFrames++
 
+	// RTPは届いているのに解像度を確定できるキーフレームが来ない場合、
+	// メディアタイムアウトは発火しないため、ここで待機時間を制限する
+	if !w.resolutionKnown {
+		if err := w.checkKeyframeTimeout(); err != nil {
+			return err
+		}
+	}
+
 	// Debug: dump first frame header
 	if !w.videoTimestamp.initialized && len(data) >= 10 {
 		DebugLog("First frame: len=%d, header=%x, keyframe=%v\n", len(data), data[:10], keyframe)
 	}
 
+	// --keyframes-only では差分フレームをデコードせずに破棄する
+	// キーフレームは前のフレームを参照しないため、間の差分フレームを渡さなくてもデコードできる
+	if w.keyframesOnly && !keyframe {
+		w.validationStats.InterFrames++
+		return nil
+	}
+
 	// デコーダーがまだ初期化されていない場合
+	// 初期化の失敗は出力には影響しないため、フレーム単位の失敗として返す
 	if !w.decoderInit {
 		if err := w.initDecoder(); err != nil {
-			return err
+			return fmt.Errorf("%w: %w", ErrFrameDropped, err)
 		}
 	}
 
-	// Calculate timecode in milliseconds
+	// Calculate timecode in TimecodeScale ticks
 	// PTSはRTP timestampから直接復元し、time.Now()由来の補正は行わない。
-	timecodeMs := (w.videoTimestamp.Extend(timestamp) * 1000) / 90000 // 90kHz to ms
+	rtpTicks := w.rtpToTicks(w.videoTimestamp.Extend(timestamp), 90000)
+	ticks := w.videoOffset + rtpTicks - min(rtpTicks, w.videoStart)
+	w.lastVideoTicks = ticks
 
 	// フレームをデコード
 	if err := vpx.Error(vpx.CodecDecode(w.ctx, string(data), uint32(len(data)), nil, 0)); err != nil {
@@ -177,8 +548,7 @@ func (w *RawVideoMKVWriter) WriteVideoFrame(data []byte, timestamp uint32, keyfr
 		if len(data) >= 10 {
 			DebugLog("Decode failed (skipping): len=%d, header=%x, keyframe=%v\n", len(data), data[:10], keyframe)
 		}
-		// デコード失敗時、lastValidFrameがあれば再出力（画面フリーズ効果）
-		return w.repeatLastValidFrame(timecodeMs, "decode error")
+		return w.handleDecodeFailure(ticks, "decode error", false)
 	}
 
 	// デコードされた画像を取得
@@ -212,14 +582,33 @@ func (w *RawVideoMKVWriter) WriteVideoFrame(data []byte, timestamp uint32, keyfr
 		// FrameValidatorを初期化
 		w.frameValidator = NewFrameValidator(w.width, w.height)
 
-		if err := w.writeHeaders(); err != nil {
-			return fmt.Errorf("failed to write headers: %w", err)
+		if w.syncStart {
+			// ヘッダーは検証を通ったフレームと音声が揃った時に書き込む（startSynced）
+			w.syncWaitSince = w.clock.Now()
+		} else {
+			if err := w.writeHeaders(); err != nil {
+				return fmt.Errorf("failed to write headers: %w", err)
+			}
+			// ヘッダー前に届いた音声を書き込む。音声が先に始まっていた場合は映像のtimecodeがずれる
+			if err := w.writeEarlyAudio(); err != nil {
+				return err
+			}
+			ticks += w.videoOffset
+			w.lastVideoTicks = ticks
 		}
 	}
 
-	// YUV420からRGBAに変換（ImageRGBAメソッドを使用）
-	rgbaImg := img.ImageRGBA()
-	rgba := rgbaImg.Pix
+	// YUVからRGBAに変換（フレームごとに確保しないよう、前回のバッファに書き込む）
+	// 変換できない形式は誤った画像を書き込まないよう、フレーム単位の失敗とする
+	rgba, err := imageRGBAInto(img, w.rgbaBuf)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrFrameDropped, err)
+	}
+	w.rgbaBuf = rgba
+	if img.Fmt&vpx.ImageFormatHighbitdepth != 0 && !w.highBitDepth {
+		w.highBitDepth = true
+		fmt.Fprintf(os.Stderr, "Video is %d-bit (VP9 high bit depth), converting to 8-bit RGBA\n", img.BitDepth)
+	}
 
 	// フレーム品質検証（ノイズ/アーティファクト検出）
 	// --no-validate フラグで無効化可能
@@ -235,28 +624,107 @@ func (w *RawVideoMKVWriter) WriteVideoFrame(data []byte, timestamp uint32, keyfr
 				result.HistogramDiff*100,
 				result.BlockingScore*100)
 
-			// 破損フレーム検出時、lastValidFrameを再出力
-			return w.repeatLastValidFrame(timecodeMs, result.Reason)
+			// 連続して破損が続く場合は、繰り返しの回数によらずキーフレームまで出力しない
+			return w.handleDecodeFailure(ticks, result.Reason, w.frameValidator.ShouldWaitForKeyframe())
 		}
 	}
 
+	// キーフレーム待ちの間は、壊れた参照からデコードされた差分フレームを出力もキャッシュもしない
+	accept, err := w.decodeRecovery.acceptFrame(w.clock.Now(), keyframe)
+	if err != nil {
+		return err
+	}
+	if !accept {
+		w.validationStats.SkippedFrames++
+		return nil
+	}
+
 	// 検証成功：正常フレームをキャッシュ
+	// コピーせずに変換先と入れ替え、次のフレームは古いlastValidFrameのバッファに変換する
+	// writeBlockは書き込みかコピーを終えてから戻るため、次の変換で書き込み前のデータが変わることはない
 	w.validationStats.ValidFrames++
-	if w.lastValidFrame == nil || len(w.lastValidFrame) != len(rgba) {
-		w.lastValidFrame = make([]byte, len(rgba))
+	w.lastValidFrame, w.rgbaBuf = rgba, w.lastValidFrame
+
+	// --sync-start で音声を待っている間は書き込まず、最新のフレームだけを保持する
+	if !w.isHeaderWritten {
+		w.pendingTicks = rtpTicks
+		if len(w.earlyAudio) > 0 {
+			return w.startSynced()
+		}
+		if w.syncTimeout > 0 && w.clock.Now().Sub(w.syncWaitSince) >= w.syncTimeout {
+			fmt.Fprintf(os.Stderr, "--sync-start: no audio within %v of the first keyframe, starting with video only\n", w.syncTimeout)
+			return w.startSynced()
+		}
+		return nil
 	}
-	copy(w.lastValidFrame, rgba)
 
 	// SimpleBlockとして書き込み
-	return w.writeSimpleBlock(w.videoTrackNum, rgba, timecodeMs, keyframe)
+	return w.writeBlock(w.videoTrackNum, rgba, ticks, keyframe)
+}
+
+// checkKeyframeTimeout は最初の映像フレームからkeyframeTimeoutが経過していればエラーを返す
+// 半分経過した時点で一度だけPLIをまとめて送り、送信側にキーフレームを促す
+func (w *RawVideoMKVWriter) checkKeyframeTimeout() error {
+	now := w.clock.Now()
+	if w.firstVideoAt.IsZero() {
+		w.firstVideoAt = now
+	}
+	if w.keyframeTimeout <= 0 {
+		return nil
+	}
+
+	elapsed := now.Sub(w.firstVideoAt)
+	if elapsed >= w.keyframeTimeout {
+		return fmt.Errorf("%w: no decodable keyframe >= 640x360 within %v of the first video frame (%d frames received, %d decode errors); check the sender's encoder keyframe settings",
+			ErrKeyframeTimeout, w.keyframeTimeout, w.validationStats.TotalFrames, w.validationStats.DecodeErrors)
+	}
+	if !w.keyframeBurst && elapsed >= w.keyframeTimeout/2 && w.keyframeCtl != nil {
+		w.keyframeBurst = true
+		w.keyframeCtl.RequestBurst("keyframe timeout approaching", keyframeTimeoutPLIBurst)
+	}
+	return nil
+}
+
+// handleDecodeFailure はデコードか検証に失敗したフレームの代わりに、decodeRecoveryの段階に応じて
+// キーフレームを要求し、最後の正常フレームを再出力するか何も出力しない
+// キーフレーム待ちに移った時は、PLIが失われても届くよう間隔の制限を無視してまとめて送る
+// 解像度が確定する前の失敗は途中からの受信によるもので、--keyframe-timeout で扱う
+func (w *RawVideoMKVWriter) handleDecodeFailure(ticks uint64, reason string, waitForKeyframe bool) error {
+	if !w.resolutionKnown {
+		if w.keyframeCtl != nil {
+			w.keyframeCtl.Request(reason)
+		}
+		return nil
+	}
+	repeat, escalated, err := w.decodeRecovery.onFailure(w.clock.Now(), waitForKeyframe)
+	if err != nil {
+		return err
+	}
+	if w.keyframeCtl != nil {
+		if escalated {
+			w.keyframeCtl.RequestBurst(reason+" persists", keyframeTimeoutPLIBurst)
+		} else {
+			w.keyframeCtl.Request(reason)
+		}
+	}
+	if escalated {
+		DebugLog("Video %s after %d failures (%s), writing no video until a keyframe\n", w.decodeRecovery.stage, w.decodeRecovery.failures, reason)
+	}
+	// --keyframes-only では最後の正常フレームを差分フレームとして繰り返さない
+	if !repeat || w.keyframesOnly {
+		w.validationStats.SkippedFrames++
+		return nil
+	}
+	// lastValidFrameがあれば再出力（画面フリーズ効果）
+	return w.repeatLastValidFrame(ticks, reason)
 }
 
 // repeatLastValidFrame は最後の正常フレームを再出力する
-func (w *RawVideoMKVWriter) repeatLastValidFrame(timecodeMs uint64, reason string) error {
+func (w *RawVideoMKVWriter) repeatLastValidFrame(ticks uint64, reason string) error {
 	if len(w.lastValidFrame) > 0 && w.isHeaderWritten {
 		w.validationStats.RepeatedFrames++
-		DebugLog("Using cached frame (freeze effect) due to %s: timecode=%dms\n", reason, timecodeMs)
-		return w.writeSimpleBlock(w.videoTrackNum, w.lastValidFrame, timecodeMs, false)
+		DebugLog("Using cached frame (freeze effect) due to %s: timecode=%d\n", reason, ticks)
+		return w.writeBlock(w.videoTrackNum, w.lastValidFrame, ticks, false)
 	}
 	DebugLog("No cached frame available, skipping (reason: %s)\n", reason)
 	return nil
@@ -269,8 +737,13 @@ func (w *RawVideoMKVWriter) GetValidationStats() ValidationStats {
 	return w.validationStats
 }
 
-// WriteAudioFrame はオーディオフレームを書き込む
+// WriteAudioFrame はオーディオフレームを最初の音声トラックに書き込む
 func (w *RawVideoMKVWriter) WriteAudioFrame(data []byte, timestamp uint32) error {
+	return w.WriteAudioTrackFrame(0, data, timestamp)
+}
+
+// WriteAudioTrackFrame はindex番目の音声トラックにオーディオフレームを書き込む
+func (w *RawVideoMKVWriter) WriteAudioTrackFrame(index int, data []byte, timestamp uint32) error {
 	if len(data) == 0 {
 		return nil
 	}
@@ -281,16 +754,156 @@ func (w *RawVideoMKVWriter) WriteAudioFrame(data []byte, timestamp uint32) error
 	w.mutex.Lock()
 	defer w.mutex.Unlock()
 
-	// ヘッダーがまだ書き込まれていない場合はスキップ
-	if !w.isHeaderWritten {
+	if err := w.out.Err(); err != nil {
+		return err
+	}
+
+	if index < 0 || index >= len(w.audioTracks) {
+		return fmt.Errorf("%w: unknown audio track index %d", ErrFrameDropped, index)
+	}
+	// 映像のみのMKVには音声トラックが無いため破棄する
+	if w.videoOnly {
 		return nil
 	}
 
-	// Calculate timecode in milliseconds
+	// ヘッダーがまだ書き込まれていない場合は保持し、ヘッダー書き込み時に書き込む
+	if !w.isHeaderWritten {
+		now := w.clock.Now()
+		w.dropOldestEarlyAudio(index)
+		w.earlyAudio = append(w.earlyAudio, earlyAudioFrame{
+			index:     index,
+			data:      append([]byte(nil), data...),
+			timestamp: timestamp,
+			arrival:   now,
+		})
+
+		// --sync-start で映像が揃っていれば、この音声とそろえて書き込みを始める
+		if w.syncStart && len(w.lastValidFrame) > 0 && !w.audioOnly {
+			return w.startSynced()
+		}
+
+		// 映像が1フレームも届かないまま時間が経過した場合は音声のみのストリームとみなす
+		if w.firstAudioAt.IsZero() {
+			w.firstAudioAt = now
+		}
+		if !w.audioOnly && w.audioOnlyAfter > 0 && w.firstVideoAt.IsZero() && now.Sub(w.firstAudioAt) >= w.audioOnlyAfter {
+			fmt.Fprintf(os.Stderr, "No video within %v of the first audio frame, writing audio-only MKV\n", w.audioOnlyAfter)
+			w.audioOnly = true
+		}
+		if !w.audioOnly {
+			return nil
+		}
+		if err := w.writeHeaders(); err != nil {
+			return fmt.Errorf("failed to write headers: %w", err)
+		}
+		return w.writeEarlyAudio()
+	}
+
+	return w.writeAudioBlock(index, data, timestamp)
+}
+
+// writeAudioBlock はindex番目の音声トラックのフレームをtimecodeを計算して書き込む
+func (w *RawVideoMKVWriter) writeAudioBlock(index int, data []byte, timestamp uint32) error {
+	track := &w.audioTracks[index]
+
+	// Calculate timecode in TimecodeScale ticks
 	// PTSはRTP timestampから直接復元し、time.Now()由来の補正は行わない。
-	timecodeMs := (w.audioTimestamp.Extend(timestamp) * 1000) / 48000 // 48kHz to ms
+	// 映像と音声のRTP timestampは基準が異なるため、音声は開始時点の映像timecodeを起点とする
+	if !track.started {
+		track.started = true
+		track.offset = w.lastVideoTicks
+	}
+	ticks := track.offset + w.rtpToTicks(track.timestamp.Extend(timestamp), 48000)
+	ticks = w.delayAudio(ticks)
+
+	trackNum, _ := w.trackLayout().audioTrack(index)
+	return w.writeBlock(trackNum, data, ticks, false)
+}
+
+// delayAudio は音声のtimecodeに --audio-delay-ms のオフセットを加える
+// 負のオフセットで0より前になる場合は0に切り詰める
+func (w *RawVideoMKVWriter) delayAudio(ticks uint64) uint64 {
+	if w.audioDelay == 0 || w.audioOnly {
+		return ticks
+	}
+	delay := w.durationToTicks(w.audioDelay.Abs())
+	if w.audioDelay > 0 {
+		return ticks + uint64(delay)
+	}
+	if ticks < uint64(delay) {
+		return 0
+	}
+	return ticks - uint64(delay)
+}
+
+// writeEarlyAudio はヘッダー書き込み前に保持した音声を書き込む
+// 各トラックの最初のフレームの到着時刻と、ヘッダーを書き込む映像フレームの到着時刻（現在）の差から音声の開始位置を決める
+// 音声が映像のtimecodeより前に始まっていた場合は、負のtimecodeにならないよう映像のtimecodeをその分後ろにずらす
+func (w *RawVideoMKVWriter) writeEarlyAudio() error {
+	if len(w.earlyAudio) == 0 {
+		return nil
+	}
+	now := w.clock.Now()
+	starts := map[int]int64{}
+	earliest := int64(0)
+	for _, frame := range w.earlyAudio {
+		if _, ok := starts[frame.index]; ok {
+			continue
+		}
+		start := int64(w.lastVideoTicks) - w.durationToTicks(now.Sub(frame.arrival))
+		starts[frame.index] = start
+		earliest = min(earliest, start)
+	}
+	w.videoOffset = uint64(-earliest)
+	for index, start := range starts {
+		w.audioTracks[index].started = true
+		w.audioTracks[index].offset = uint64(start - earliest)
+	}
+	DebugLog("Writing %d audio frames received before the MKV header (video timecodes shifted by %d ticks)\n", len(w.earlyAudio), w.videoOffset)
+
+	frames := w.earlyAudio
+	w.earlyAudio = nil
+	for _, frame := range frames {
+		if err := w.writeAudioBlock(frame.index, frame.data, frame.timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startSynced は --sync-start で映像と音声が揃った（または音声待ちがタイムアウトした）時にヘッダーを書き込み、
+// 最新の映像フレームと、各音声トラックで最後に届いたフレームをtimecode 0にそろえて書き込む
+// それより前に届いた音声は映像の無い区間になるため破棄する。以降の映像のtimecodeは最初のフレームからの差になる
+func (w *RawVideoMKVWriter) startSynced() error {
+	if err := w.writeHeaders(); err != nil {
+		return fmt.Errorf("failed to write headers: %w", err)
+	}
+	w.videoStart = w.pendingTicks
+	w.lastVideoTicks = 0
 
-	return w.writeSimpleBlock(w.audioTrackNum, data, timecodeMs, false)
+	last := map[int]earlyAudioFrame{}
+	for _, frame := range w.earlyAudio {
+		last[frame.index] = frame
+	}
+	if dropped := len(w.earlyAudio) - len(last); dropped > 0 {
+		DebugLog("--sync-start: dropping %d audio frames received before the first video frame\n", dropped)
+	}
+	w.earlyAudio = nil
+
+	if err := w.writeBlock(w.videoTrackNum, w.lastValidFrame, 0, true); err != nil {
+		return err
+	}
+	for index := range w.audioTracks {
+		frame, ok := last[index]
+		if !ok {
+			continue
+		}
+		// 最初のフレームは開始時点の映像timecode（0）から始まる
+		if err := w.writeAudioBlock(index, frame.data, frame.timestamp); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Run はメインループを実行
@@ -301,10 +914,38 @@ func (w *RawVideoMKVWriter) Run() error {
 	close(w.running)
 
 	// Keep running until Stop() is called
-	<-w.done
+	// 書き込みが途絶えてもバッファに残ったデータがflushInterval以上留まらないよう定期的にフラッシュする
+	var tick <-chan time.Time
+	if w.flushInterval > 0 {
+		ticker := time.NewTicker(w.flushInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for running := true; running; {
+		select {
+		case <-w.done:
+			running = false
+		case <-tick:
+			w.mutex.Lock()
+			var err error
+			if w.isHeaderWritten && w.out.Err() == nil && w.bufWriter.Buffered() > 0 {
+				err = w.flushIfDue(false)
+			}
+			w.mutex.Unlock()
+			if err != nil {
+				return fmt.Errorf("failed to flush buffer: %w", err)
+			}
+		}
+	}
 
 	// Final flush
-	if err := w.bufWriter.Flush(); err != nil {
+	// 出力先が閉じられている場合はエラーをStreamManager側で処理済みのため書き込まない
+	if w.out.Err() != nil {
+		return nil
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.flush(); err != nil {
 		return fmt.Errorf("failed to flush final data: %w", err)
 	}
 
@@ -331,14 +972,29 @@ func (w *RawVideoMKVWriter) Close() error {
 		w.decoderInit = false
 	}
 
-	if w.isHeaderWritten {
-		return w.bufWriter.Flush()
+	// --sync-start で音声を待ったまま終了した場合も、保持している映像を書き込む
+	if w.syncStart && !w.isHeaderWritten && len(w.lastValidFrame) > 0 && w.out.Err() == nil {
+		if err := w.startSynced(); err != nil {
+			return err
+		}
+	}
+
+	if w.isHeaderWritten && w.out.Err() == nil {
+		if err := w.flushInterleaver(); err != nil {
+			return err
+		}
+		return w.flush()
 	}
 	return nil
 }
 
 // writeHeaders はEBML/MKVヘッダーを書き込む
+// 前のセッションのSegmentを引き継げる場合は書き込まずに続きから書き込む
 func (w *RawVideoMKVWriter) writeHeaders() error {
+	if w.resumeSegment() {
+		return nil
+	}
+
 	// Write EBML header
 	if err := w.writeEBMLHeader(); err != nil {
 		return fmt.Errorf("failed to write EBML header: %w", err)
@@ -359,8 +1015,15 @@ func (w *RawVideoMKVWriter) writeHeaders() error {
 		return fmt.Errorf("failed to write tracks: %w", err)
 	}
 
+	// Write Tags（最初のClusterより前）
+	if len(w.tags) > 0 {
+		if err := w.writeTags(); err != nil {
+			return fmt.Errorf("failed to write tags: %w", err)
+		}
+	}
+
 	// Flush headers immediately
-	if err := w.bufWriter.Flush(); err != nil {
+	if err := w.flush(); err != nil {
 		return fmt.Errorf("failed to flush headers: %w", err)
 	}
 	w.isHeaderWritten = true
@@ -386,41 +1049,124 @@ func (w *RawVideoMKVWriter) writeEBMLHeader() error {
 
 func (w *RawVideoMKVWriter) writeSegmentHeader() error {
 	// Segment with unknown size (0x01FFFFFFFFFFFFFF)
-	_, err := w.writer.Write([]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
-	return err
+	if _, err := w.writer.Write([]byte{0x18, 0x53, 0x80, 0x67, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}); err != nil {
+		return err
+	}
+	w.segmentStart = w.counter.n
+	w.hasPrevCluster = false
+	return nil
 }
 
 func (w *RawVideoMKVWriter) writeInfo() error {
 	infoData := &bytes.Buffer{}
 
-	// TimecodeScale (1ms = 1000000ns)
-	if err := w.writeEBMLElement(infoData, timecodeScale, w.encodeUInt(1000000)); err != nil {
+	// TimecodeScale (default 1ms = 1000000ns)
+	if err := w.writeEBMLElement(infoData, timecodeScale, w.encodeUInt(w.timecodeScale)); err != nil {
 		return err
 	}
 
 	// MuxingApp
-	if err := w.writeEBMLElement(infoData, muxingApp, []byte("go-webrtc-whep-client")); err != nil {
+	if err := w.writeEBMLElement(infoData, muxingApp, []byte(w.muxingApp)); err != nil {
 		return err
 	}
 
 	// WritingApp
-	if err := w.writeEBMLElement(infoData, writingApp, []byte("go-webrtc-whep-client")); err != nil {
+	if err := w.writeEBMLElement(infoData, writingApp, []byte(w.writingApp)); err != nil {
 		return err
 	}
 
+	// SegmentUID（ローテーションで作る各ファイルで異なる値）
+	uid, err := w.newSegmentUID()
+	if err != nil {
+		return err
+	}
+	if err := w.writeEBMLElement(infoData, segmentUID, uid); err != nil {
+		return err
+	}
+
+	// DateUTC（ヘッダーを書き込んだ時刻）
+	if w.writeDate {
+		if err := w.writeEBMLElement(infoData, dateUTC, EncodeMKVDate(w.clock.Now())); err != nil {
+			return err
+		}
+	}
+
 	// Write Info element
-	return w.writeEBMLElement(w.writer, info, infoData.Bytes())
+	return w.writeEBMLElement(w.writer, info, w.withCRC(infoData.Bytes()))
+}
+
+// seededSegmentUIDs は --segment-uid-seed から作る、プロセス全体で共有するSegmentUIDの乱数
+// ライターごとに同じシードから作り直すと、再接続やローテーションで書き込むSegmentがすべて同じUIDになるため、
+// 一度だけ作り、以降のSegmentは同じ系列の続きの値を使う（シードが変わった場合は作り直す）
+var seededSegmentUIDs struct {
+	mutex sync.Mutex
+	seed  int64
+	rng   *rand.Rand
+}
+
+// readSeededSegmentUID はseedの系列から次のSegmentUIDをuidに読み込む
+func readSeededSegmentUID(seed int64, uid []byte) {
+	seededSegmentUIDs.mutex.Lock()
+	defer seededSegmentUIDs.mutex.Unlock()
+	if seededSegmentUIDs.rng == nil || seededSegmentUIDs.seed != seed {
+		seededSegmentUIDs.seed = seed
+		seededSegmentUIDs.rng = rand.New(rand.NewSource(seed))
+	}
+	seededSegmentUIDs.rng.Read(uid)
+}
+
+// newSegmentUID は16バイトのSegmentUIDを作る
+// --segment-uid-seed 指定時はシードから決まる値になり、同じシードで実行すれば同じ出力を再現できる
+func (w *RawVideoMKVWriter) newSegmentUID() ([]byte, error) {
+	uid := make([]byte, segmentUIDSize)
+	if w.segmentSeed != 0 {
+		readSeededSegmentUID(w.segmentSeed, uid)
+		return uid, nil
+	}
+	if _, err := crand.Read(uid); err != nil {
+		return nil, fmt.Errorf("failed to generate SegmentUID: %w", err)
+	}
+	return uid, nil
+}
+
+// mkvDateEpoch はMatroskaの日付要素の基準時刻（2001-01-01T00:00:00 UTC）
+var mkvDateEpoch = time.Date(2001, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// EncodeMKVDate はtをMatroskaの日付要素（基準時刻からのナノ秒、8バイトの符号付き整数）にエンコードする
+func EncodeMKVDate(t time.Time) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(t.Sub(mkvDateEpoch).Nanoseconds()))
 }
 
 func (w *RawVideoMKVWriter) writeTracks() error {
 	tracksData := &bytes.Buffer{}
 
-	// Video track - V_UNCOMPRESSED (RGBA)
+	// Video track - V_UNCOMPRESSED (RGBA)（音声のみのMKVでは書き込まない）
+	if !w.audioOnly {
+		if err := w.writeVideoTrackEntry(tracksData); err != nil {
+			return err
+		}
+	}
+
+	// Audio tracks - A_OPUS（受信した音声トラックごと、映像のみのMKVでは書き込まない）
+	if !w.videoOnly {
+		for i := range w.audioTracks {
+			if err := w.writeAudioTrackEntry(tracksData, i); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Write Tracks element
+	return w.writeEBMLElement(w.writer, tracks, w.withCRC(tracksData.Bytes()))
+}
+
+// writeVideoTrackEntry は映像トラック（RGBAのrawvideo）のTrackEntryを書き込む
+func (w *RawVideoMKVWriter) writeVideoTrackEntry(tracksData *bytes.Buffer) error {
 	videoEntry := &bytes.Buffer{}
 	if err := w.writeEBMLElement(videoEntry, trackNumber, w.encodeUInt(w.videoTrackNum)); err != nil {
 		return err
 	}
-	if err := w.writeEBMLElement(videoEntry, trackUID, w.encodeUInt(w.videoTrackNum)); err != nil {
+	if err := w.writeEBMLElement(videoEntry, trackUID, w.encodeUInt(w.videoTrackUID)); err != nil {
 		return err
 	}
 	if err := w.writeEBMLElement(videoEntry, trackType, []byte{trackTypeVideo}); err != nil {
@@ -446,20 +1192,34 @@ func (w *RawVideoMKVWriter) writeTracks() error {
 	if err := w.writeEBMLElement(videoSettings, bitsPerChannel, w.encodeUInt(8)); err != nil {
 		return err
 	}
+	// Projection - 矩形（2D）映像の表示回転（ProjectionPoseRollは反時計回り）
+	if w.rotation != 0 {
+		projectionData := &bytes.Buffer{}
+		if err := w.writeEBMLElement(projectionData, projectionType, w.encodeUInt(0)); err != nil {
+			return err
+		}
+		if err := w.writeEBMLElement(projectionData, projectionRoll, w.encodeFloat(projectionPoseRoll(w.rotation))); err != nil {
+			return err
+		}
+		if err := w.writeEBMLElement(videoSettings, projection, projectionData.Bytes()); err != nil {
+			return err
+		}
+	}
 	if err := w.writeEBMLElement(videoEntry, video, videoSettings.Bytes()); err != nil {
 		return err
 	}
 
-	if err := w.writeEBMLElement(tracksData, trackEntry, videoEntry.Bytes()); err != nil {
-		return err
-	}
+	return w.writeEBMLElement(tracksData, trackEntry, videoEntry.Bytes())
+}
 
-	// Audio track - A_OPUS
+// writeAudioTrackEntry はindex番目の音声トラック（Opus 48kHz 2ch）のTrackEntryを書き込む
+func (w *RawVideoMKVWriter) writeAudioTrackEntry(tracksData *bytes.Buffer, index int) error {
+	num, uid := w.trackLayout().audioTrack(index)
 	audioEntry := &bytes.Buffer{}
-	if err := w.writeEBMLElement(audioEntry, trackNumber, w.encodeUInt(w.audioTrackNum)); err != nil {
+	if err := w.writeEBMLElement(audioEntry, trackNumber, w.encodeUInt(num)); err != nil {
 		return err
 	}
-	if err := w.writeEBMLElement(audioEntry, trackUID, w.encodeUInt(w.audioTrackNum)); err != nil {
+	if err := w.writeEBMLElement(audioEntry, trackUID, w.encodeUInt(uid)); err != nil {
 		return err
 	}
 	if err := w.writeEBMLElement(audioEntry, trackType, []byte{trackTypeAudio}); err != nil {
@@ -481,30 +1241,115 @@ func (w *RawVideoMKVWriter) writeTracks() error {
 		return err
 	}
 
-	if err := w.writeEBMLElement(tracksData, trackEntry, audioEntry.Bytes()); err != nil {
-		return err
+	return w.writeEBMLElement(tracksData, trackEntry, audioEntry.Bytes())
+}
+
+// withCRC は --mkv-crc 指定時に親要素の内容の先頭へCRC-32要素を付ける
+// 値は残りの内容全体に対するCRC-32（IEEE）で、Matroskaの規定どおりリトルエンディアンで格納する
+func (w *RawVideoMKVWriter) withCRC(data []byte) []byte {
+	if !w.headerCRC {
+		return data
+	}
+	out := make([]byte, 0, 6+len(data))
+	out = append(out, crc32Value, 0x84) // ID、サイズ4
+	out = binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(data))
+	return append(out, data...)
+}
+
+// writeBlock はインターリーブバッファ経由でSimpleBlockを書き込む
+func (w *RawVideoMKVWriter) writeBlock(trackNum uint64, data []byte, ticks uint64, keyframe bool) error {
+	ticks += w.timecodeBase
+	if w.interleaver == nil {
+		return w.writeSimpleBlock(trackNum, data, ticks, keyframe)
 	}
 
-	// Write Tracks element
-	return w.writeEBMLElement(w.writer, tracks, tracksData.Bytes())
+	// デコーダーの出力バッファやlastValidFrameは再利用されるためコピーして保持する
+	buf := append(w.blockBuffer(len(data)), data...)
+	w.interleaver.push(pendingBlock{trackNum: trackNum, data: buf, timecode: ticks, keyframe: keyframe})
+
+	for _, block := range w.interleaver.popReady(false) {
+		if err := w.writeSimpleBlock(block.trackNum, block.data, block.timecode, block.keyframe); err != nil {
+			return err
+		}
+		w.releaseBlockBuffer(block.data)
+	}
+	return nil
+}
+
+// blockBuffer はインターリーブバッファに保持するための、容量size以上の空のバッファを返す
+// 書き込み済みのバッファがあれば再利用し、映像フレームごとの確保を避ける
+func (w *RawVideoMKVWriter) blockBuffer(size int) []byte {
+	for i, buf := range w.freeBlocks {
+		if cap(buf) >= size {
+			last := len(w.freeBlocks) - 1
+			w.freeBlocks[i] = w.freeBlocks[last]
+			w.freeBlocks = w.freeBlocks[:last]
+			return buf[:0]
+		}
+	}
+	return make([]byte, 0, size)
+}
+
+// releaseBlockBuffer は書き込みを終えたインターリーブ用バッファを再利用に回す
+// 保持する数はインターリーブバッファの深さまでとし、超える場合は最も小さい（音声の）バッファと入れ替える
+func (w *RawVideoMKVWriter) releaseBlockBuffer(buf []byte) {
+	if len(w.freeBlocks) < InterleaveDepth+1 {
+		w.freeBlocks = append(w.freeBlocks, buf)
+		return
+	}
+	smallest := 0
+	for i, free := range w.freeBlocks {
+		if cap(free) < cap(w.freeBlocks[smallest]) {
+			smallest = i
+		}
+	}
+	if cap(buf) > cap(w.freeBlocks[smallest]) {
+		w.freeBlocks[smallest] = buf
+	}
 }
 
-func (w *RawVideoMKVWriter) writeSimpleBlock(trackNum uint64, data []byte, timecodeMs uint64, keyframe bool) error {
+// flushInterleaver はインターリーブバッファに残っているブロックをすべて書き込む
+func (w *RawVideoMKVWriter) flushInterleaver() error {
+	if w.interleaver == nil {
+		return nil
+	}
+	for _, block := range w.interleaver.popReady(true) {
+		if err := w.writeSimpleBlock(block.trackNum, block.data, block.timecode, block.keyframe); err != nil {
+			return err
+		}
+		w.releaseBlockBuffer(block.data)
+	}
+	return nil
+}
+
+func (w *RawVideoMKVWriter) writeSimpleBlock(trackNum uint64, data []byte, ticks uint64, keyframe bool) error {
 	// Start new cluster on keyframe or every second
+	// クラスタ相対timecodeはint16のため、範囲外になる場合も新しいクラスタを開始する
+	relative := int64(ticks) - int64(w.clusterTime)
+	maxRelative := w.durationToTicks(time.Second)
+	if maxRelative > math.MaxInt16 {
+		maxRelative = math.MaxInt16
+	}
+	if w.rotatedKeyframe && trackNum == w.videoTrackNum {
+		w.rotatedKeyframe = false
+		keyframe = true
+	}
 	needNewCluster := false
 	if keyframe && trackNum == w.videoTrackNum {
 		needNewCluster = true
-	} else if timecodeMs-w.clusterTime > 1000 || w.clusterTime == 0 {
+	} else if !w.clusterStarted || relative > maxRelative || relative < math.MinInt16 {
 		needNewCluster = true
 	}
 
 	if needNewCluster {
-		if err := w.startNewCluster(timecodeMs); err != nil {
+		if err := w.startNewCluster(ticks); err != nil {
 			return fmt.Errorf("failed to start new cluster: %w", err)
 		}
 	}
 
-	block := &bytes.Buffer{}
+	// ヘッダー部分のみ組み立て、フレームデータはコピーせずに直接書き込む
+	block := &w.blockBuf
+	block.Reset()
 
 	// Track number (variable size integer)
 	if err := w.writeVarInt(block, trackNum); err != nil {
@@ -512,7 +1357,7 @@ func (w *RawVideoMKVWriter) writeSimpleBlock(trackNum uint64, data []byte, timec
 	}
 
 	// Timecode (relative to cluster)
-	relativeTime := int16(timecodeMs - w.clusterTime)
+	relativeTime := int16(ticks - w.clusterTime)
 	if err := binary.Write(block, binary.BigEndian, relativeTime); err != nil {
 		return fmt.Errorf("failed to write timecode: %w", err)
 	}
@@ -526,19 +1371,25 @@ func (w *RawVideoMKVWriter) writeSimpleBlock(trackNum uint64, data []byte, timec
 		return fmt.Errorf("failed to write flags: %w", err)
 	}
 
-	// Frame data
-	if _, err := block.Write(data); err != nil {
-		return fmt.Errorf("failed to write frame data: %w", err)
-	}
-
 	// Write SimpleBlock
-	if err := w.writeEBMLElement(w.writer, simpleBlock, block.Bytes()); err != nil {
+	if err := w.writeEBMLID(w.writer, simpleBlock); err != nil {
+		return fmt.Errorf("failed to write simple block: %w", err)
+	}
+	if err := w.writeVarInt(w.writer, uint64(block.Len()+len(data))); err != nil {
+		return fmt.Errorf("failed to write simple block: %w", err)
+	}
+	if _, err := w.writer.Write(block.Bytes()); err != nil {
 		return fmt.Errorf("failed to write simple block: %w", err)
 	}
+	if _, err := w.writer.Write(data); err != nil {
+		return fmt.Errorf("failed to write frame data: %w", err)
+	}
+	w.lastBlockTicks = max(w.lastBlockTicks, ticks)
+	w.lastBlockAt = w.clock.Now()
 
-	// Flush more frequently for lower latency
-	if w.isHeaderWritten && (keyframe || timecodeMs-w.clusterTime > 100) {
-		if err := w.bufWriter.Flush(); err != nil {
+	// キーフレームは受信側がすぐにデコードを始められるよう即座に書き出す
+	if w.isHeaderWritten {
+		if err := w.flushIfDue(keyframe); err != nil {
 			return fmt.Errorf("failed to flush buffer: %w", err)
 		}
 	}
@@ -546,8 +1397,42 @@ func (w *RawVideoMKVWriter) writeSimpleBlock(trackNum uint64, data []byte, timec
 	return nil
 }
 
-func (w *RawVideoMKVWriter) startNewCluster(timecodeMs uint64) error {
-	w.clusterTime = timecodeMs
+// flushIfDue はforceの場合、または前回のフラッシュからflushIntervalが経過した場合にバッファを書き出す
+func (w *RawVideoMKVWriter) flushIfDue(force bool) error {
+	if !force && w.flushInterval > 0 && w.clock.Now().Sub(w.lastFlush) < w.flushInterval {
+		return nil
+	}
+	return w.flush()
+}
+
+func (w *RawVideoMKVWriter) flush() error {
+	if err := w.bufWriter.Flush(); err != nil {
+		return err
+	}
+	w.lastFlush = w.clock.Now()
+	return nil
+}
+
+// rtpToTicks はRTP timestamp（clockRate Hz）をTimecodeScale単位のtickに変換する
+// 秒と端数に分けて計算し、長時間の配信でも64bitを溢れないようにする
+func (w *RawVideoMKVWriter) rtpToTicks(rtpTime uint64, clockRate uint64) uint64 {
+	sec := rtpTime / clockRate
+	rem := rtpTime % clockRate
+	return sec*uint64(time.Second)/w.timecodeScale + rem*uint64(time.Second)/(clockRate*w.timecodeScale)
+}
+
+// durationToTicks は時間をTimecodeScale単位のtickに変換する
+func (w *RawVideoMKVWriter) durationToTicks(d time.Duration) int64 {
+	return int64(uint64(d) / w.timecodeScale)
+}
+
+// startNewCluster はサイズ不明のClusterを開始する
+// robustClusters時はPosition（Segmentデータ先頭からの位置）とPrevSize（直前のClusterの全体サイズ）も書き込み、
+// シークや破損後にプレイヤーがクラスタ境界を見つけやすくする
+func (w *RawVideoMKVWriter) startNewCluster(ticks uint64) error {
+	w.clusterTime = ticks
+	w.clusterStarted = true
+	clusterAt := w.counter.n
 
 	// Write Cluster element with unknown size
 	if _, err := w.writer.Write([]byte{0x1F, 0x43, 0xB6, 0x75, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}); err != nil {
@@ -555,7 +1440,23 @@ func (w *RawVideoMKVWriter) startNewCluster(timecodeMs uint64) error {
 	}
 
 	// Write Timecode
-	return w.writeEBMLElement(w.writer, timecode, w.encodeUInt(timecodeMs))
+	if err := w.writeEBMLElement(w.writer, timecode, w.encodeUInt(ticks)); err != nil {
+		return err
+	}
+
+	if w.robustClusters {
+		if err := w.writeEBMLElement(w.writer, clusterPosition, w.encodeUInt(clusterAt-w.segmentStart)); err != nil {
+			return err
+		}
+		if w.hasPrevCluster {
+			if err := w.writeEBMLElement(w.writer, clusterPrevSize, w.encodeUInt(clusterAt-w.lastClusterAt)); err != nil {
+				return err
+			}
+		}
+	}
+	w.lastClusterAt = clusterAt
+	w.hasPrevCluster = true
+	return nil
 }
 
 func (w *RawVideoMKVWriter) writeEBMLElement(wr io.Writer, id uint32, data []byte) error {
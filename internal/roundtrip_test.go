@@ -0,0 +1,612 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	roundtripWidth       = 640
+	roundtripHeight      = 360
+	roundtripVideoFrames = 45 // 30fps x 1.5秒（クラスタを跨ぐ）
+	roundtripAudioFrames = 75 // 20ms x 1.5秒
+	keyframeDist         = 30
+	roundtripVideoTSStep = 3000 // 90kHz / 30fps
+	roundtripAudioTSStep = 960  // 48kHz x 20ms
+	// RTP timestampの初期値はランダムなため、映像と音声で異なる値から始める
+	videoTSBase = 123456789
+	audioTSBase = 987654
+)
+
+// expectedFrame は書き込んだフレームの期待値
+type expectedFrame struct {
+	frameType   FrameType
+	timestampMs int64
+	keyframe    bool
+}
+
+// makeRGBAFrame はフレーム番号に応じて変化するグラデーション画像を生成する
+func makeRGBAFrame(n int) []byte {
+	rgba := make([]byte, roundtripWidth*roundtripHeight*4)
+	for y := 0; y < roundtripHeight; y++ {
+		for x := 0; x < roundtripWidth; x++ {
+			i := (y*roundtripWidth + x) * 4
+			rgba[i] = byte(x + n)
+			rgba[i+1] = byte(y + n)
+			rgba[i+2] = byte(x + y)
+			rgba[i+3] = 0xFF
+		}
+	}
+	return rgba
+}
+
+// rtpToMs はRTP時間をTimecodeScale単位に丸めた後のミリ秒に変換する
+func rtpToMs(rtpTime, clockRate, scale int64) int64 {
+	ticks := rtpTime * 1000000000 / (clockRate * scale)
+	return ticks * scale / 1000000
+}
+
+// roundtripWriteTestMKV はRawVideoMKVWriterでVP8映像とOpus音声を含むMKVを生成する
+func roundtripWriteTestMKV(out *bytes.Buffer, scale int64) ([]expectedFrame, error) {
+	encoder, err := NewVP8Encoder(roundtripWidth, roundtripHeight, "RGBA", 1000)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create encoder: %v", err)
+	}
+	defer encoder.Close()
+
+	writer := NewRawVideoMKVWriter(out, "vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	var expected []expectedFrame
+	audioIndex := 0
+	for i := 0; i < roundtripVideoFrames; i++ {
+		encoded, keyframe, err := encoder.Encode(makeRGBAFrame(i))
+		if err != nil {
+			return nil, fmt.Errorf("encode error at frame %d: %v", i, err)
+		}
+		if encoded == nil {
+			return nil, fmt.Errorf("encoder returned no data at frame %d", i)
+		}
+		wantKeyframe := i%keyframeDist == 0
+		if keyframe != wantKeyframe {
+			return nil, fmt.Errorf("unexpected keyframe flag at frame %d: got %v", i, keyframe)
+		}
+
+		videoTS := videoTSBase + uint32(i*roundtripVideoTSStep)
+		if err := writer.WriteVideoFrame(encoded, videoTS, keyframe); err != nil {
+			return nil, fmt.Errorf("failed to write video frame %d: %v", i, err)
+		}
+		// 出力timecodeは各トラックの最初のRTP timestampを0とした値
+		videoMs := rtpToMs(int64(i*roundtripVideoTSStep), 90000, scale)
+		expected = append(expected, expectedFrame{FrameTypeVideo, videoMs, keyframe})
+
+		// 映像フレームの時刻までの音声を書き込む
+		for audioIndex < roundtripAudioFrames {
+			audioTS := audioTSBase + uint32(audioIndex*roundtripAudioTSStep)
+			audioMs := rtpToMs(int64(audioIndex*roundtripAudioTSStep), 48000, scale)
+			if audioMs > videoMs {
+				break
+			}
+			// TOC=0xFC: Opus CELT FB 20ms mono、ペイロードは内容を問わない
+			payload := []byte{0xFC, byte(audioIndex), 0x00, 0x01}
+			if err := writer.WriteAudioFrame(payload, audioTS); err != nil {
+				return nil, fmt.Errorf("failed to write audio frame %d: %v", audioIndex, err)
+			}
+			expected = append(expected, expectedFrame{FrameTypeAudio, audioMs, false})
+			audioIndex++
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, fmt.Errorf("failed to close writer: %v", err)
+	}
+	if err := <-runErr; err != nil {
+		return nil, fmt.Errorf("writer run error: %v", err)
+	}
+	return expected, nil
+}
+
+// readTestMKV はMKVReaderで読み戻してフレームを比較する
+func readTestMKV(data []byte, expected []expectedFrame) error {
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+
+	var videos, audios []*Frame
+	var lastClusterMs, lastTimestampMs int64
+	for {
+		frame, err := reader.ReadFrame()
+		if err != nil {
+			break
+		}
+		// クラスタおよびブロックのtimecodeは書き込み順に単調非減少であること
+		if frame.ClusterTimeMs < lastClusterMs {
+			return fmt.Errorf("cluster timecode went backwards: %dms after %dms", frame.ClusterTimeMs, lastClusterMs)
+		}
+		if frame.TimestampMs < lastTimestampMs {
+			return fmt.Errorf("block timecode went backwards: %dms after %dms", frame.TimestampMs, lastTimestampMs)
+		}
+		lastClusterMs = frame.ClusterTimeMs
+		lastTimestampMs = frame.TimestampMs
+		if frame.Type == FrameTypeVideo {
+			videos = append(videos, frame)
+		} else {
+			audios = append(audios, frame)
+		}
+	}
+
+	if reader.VideoWidth() != roundtripWidth || reader.VideoHeight() != roundtripHeight {
+		return fmt.Errorf("resolution mismatch: got %dx%d, want %dx%d", reader.VideoWidth(), reader.VideoHeight(), roundtripWidth, roundtripHeight)
+	}
+	if reader.VideoCodec() != "V_UNCOMPRESSED" || reader.PixelFormat() != "RGBA" {
+		return fmt.Errorf("video codec mismatch: got %s/%s", reader.VideoCodec(), reader.PixelFormat())
+	}
+	if reader.AudioCodec() != "A_OPUS" {
+		return fmt.Errorf("audio codec mismatch: got %s", reader.AudioCodec())
+	}
+
+	var wantVideos, wantAudios []expectedFrame
+	for _, f := range expected {
+		if f.frameType == FrameTypeVideo {
+			wantVideos = append(wantVideos, f)
+		} else {
+			wantAudios = append(wantAudios, f)
+		}
+	}
+	if err := compareFrames("video", videos, wantVideos); err != nil {
+		return err
+	}
+	if err := compareFrames("audio", audios, wantAudios); err != nil {
+		return err
+	}
+
+	for _, frame := range videos {
+		if len(frame.Data) != roundtripWidth*roundtripHeight*4 {
+			return fmt.Errorf("video frame size mismatch at %dms: got %d", frame.TimestampMs, len(frame.Data))
+		}
+	}
+
+	return nil
+}
+
+func compareFrames(kind string, got []*Frame, want []expectedFrame) error {
+	if len(got) != len(want) {
+		return fmt.Errorf("%s frame count mismatch: got %d, want %d", kind, len(got), len(want))
+	}
+	for i := range want {
+		if got[i].TimestampMs != want[i].timestampMs {
+			return fmt.Errorf("%s frame %d timestamp mismatch: got %dms, want %dms", kind, i, got[i].TimestampMs, want[i].timestampMs)
+		}
+		if got[i].IsKeyframe != want[i].keyframe {
+			return fmt.Errorf("%s frame %d keyframe mismatch: got %v, want %v", kind, i, got[i].IsKeyframe, want[i].keyframe)
+		}
+	}
+	return nil
+}
+
+// timecodeScales は検証するTimecodeScale（1ms、0.1ms）
+var timecodeScales = []int64{1000000, 100000}
+
+func testRoundTrip(scale int64) error {
+	MKVTimecodeScale = int(scale)
+
+	var buf bytes.Buffer
+	expected, err := roundtripWriteTestMKV(&buf, scale)
+	if err != nil {
+		return err
+	}
+	return readTestMKV(buf.Bytes(), expected)
+}
+
+// videoBlockOffsets はRawVideoMKVWriterの出力から映像SimpleBlockの要素先頭のオフセットを返す
+// 最初のClusterから順に要素をたどる（Clusterはサイズ不定、それ以外はサイズ付き）
+func videoBlockOffsets(data []byte) ([]int, error) {
+	clusterID := []byte{0x1F, 0x43, 0xB6, 0x75}
+	pos := bytes.Index(data, clusterID)
+	if pos < 0 {
+		return nil, fmt.Errorf("no Cluster found")
+	}
+
+	var offsets []int
+	for pos < len(data) {
+		if bytes.HasPrefix(data[pos:], clusterID) {
+			pos += len(clusterID) + 8
+			continue
+		}
+		id := data[pos]
+		size, sizeLen := readVint(data[pos+1:], false)
+		if sizeLen == 0 {
+			return nil, fmt.Errorf("invalid element size at offset %d", pos)
+		}
+		if id == 0xA3 && data[pos+1+sizeLen] == 0x81 {
+			offsets = append(offsets, pos)
+		}
+		pos += 1 + sizeLen + int(size)
+	}
+	return offsets, nil
+}
+
+// testCorruptedSize は映像SimpleBlockの1つのサイズをdeltaバイトずらしたMKVを読み、
+// 破損したブロックの後で再同期し、ストリームを中断せずに以降のフレームを読み続けることを検証する
+func testCorruptedSize(delta int) error {
+	MKVTimecodeScale = 1000000
+
+	var buf bytes.Buffer
+	expected, err := roundtripWriteTestMKV(&buf, 1000000)
+	if err != nil {
+		return err
+	}
+	data := buf.Bytes()
+
+	offsets, err := videoBlockOffsets(data)
+	if err != nil {
+		return err
+	}
+	if len(offsets) != roundtripVideoFrames {
+		return fmt.Errorf("found %d video blocks, want %d", len(offsets), roundtripVideoFrames)
+	}
+	// クラスタの途中にあるインターフレームを破損させる
+	corrupted := roundtripVideoFrames/2 + 5
+	pos := offsets[corrupted]
+	vint, sizeLen := readVint(data[pos+1:], false)
+	if sizeLen != 3 {
+		return fmt.Errorf("unexpected size length %d for video block", sizeLen)
+	}
+	size := int(vint) + delta
+	data[pos+1] = byte(size>>16) | 0x20
+	data[pos+2] = byte(size >> 8)
+	data[pos+3] = byte(size)
+
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	var videos, audios []*Frame
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reader did not recover: %v", err)
+		}
+		if frame.Type == FrameTypeVideo {
+			videos = append(videos, frame)
+		} else {
+			audios = append(audios, frame)
+		}
+	}
+	if reader.Resyncs() != 1 {
+		return fmt.Errorf("resync count = %d, want 1", reader.Resyncs())
+	}
+
+	var wantVideos, wantAudios []expectedFrame
+	for _, f := range expected {
+		if f.frameType == FrameTypeVideo {
+			wantVideos = append(wantVideos, f)
+		} else {
+			wantAudios = append(wantAudios, f)
+		}
+	}
+	// 破損したブロックの直後の要素は再同期で失われうる
+	if len(videos) < len(wantVideos)-1 || len(audios) < len(wantAudios)-1 {
+		return fmt.Errorf("lost too many frames: video %d/%d, audio %d/%d", len(videos), len(wantVideos), len(audios), len(wantAudios))
+	}
+	last := videos[len(videos)-1]
+	if want := wantVideos[len(wantVideos)-1].timestampMs; last.TimestampMs != want {
+		return fmt.Errorf("last video frame at %dms, want %dms", last.TimestampMs, want)
+	}
+	for i, frame := range videos {
+		if i != corrupted && len(frame.Data) != roundtripWidth*roundtripHeight*4 {
+			return fmt.Errorf("video frame %d size mismatch at %dms: got %d", i, frame.TimestampMs, len(frame.Data))
+		}
+	}
+
+	return nil
+}
+
+// epipeWriter はlimitバイトを書き込んだ後、下流が閉じられたものとしてEPIPEを返すio.Writer
+type epipeWriter struct {
+	limit   int
+	written int
+	calls   int // EPIPEを返した後の呼び出し回数
+}
+
+func (w *epipeWriter) Write(p []byte) (int, error) {
+	if w.written >= w.limit {
+		w.calls++
+		return 0, &os.PathError{Op: "write", Path: "/dev/stdout", Err: syscall.EPIPE}
+	}
+	n := min(len(p), w.limit-w.written)
+	w.written += n
+	if n < len(p) {
+		w.calls++
+		return n, &os.PathError{Op: "write", Path: "/dev/stdout", Err: syscall.EPIPE}
+	}
+	return n, nil
+}
+
+// writeUntilError はエラーになるまでVP8フレームを書き込み、書き込めたフレーム数と最初のエラーを返す
+func writeUntilError(writer *RawVideoMKVWriter, frames int) (int, error) {
+	encoder, err := NewVP8Encoder(roundtripWidth, roundtripHeight, "RGBA", 1000)
+	if err != nil {
+		return 0, err
+	}
+	defer encoder.Close()
+	for i := 0; i < frames; i++ {
+		encoded, keyframe, err := encoder.Encode(makeRGBAFrame(i))
+		if err != nil {
+			return i, err
+		}
+		if err := writer.WriteVideoFrame(encoded, uint32(i*roundtripVideoTSStep), keyframe); err != nil {
+			return i, err
+		}
+	}
+	return frames, nil
+}
+
+// testBrokenPipe は書き込み先がEPIPEを返した時にErrOutputClosedとして検出され、
+// 以降の書き込みが下流に触れずに同じエラーで失敗し、Closeがエラーを返さないことを検証する
+func testBrokenPipe(out io.Writer, calls func() int) error {
+	writer := NewRawVideoMKVWriter(out, "vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	written, err := writeUntilError(writer, roundtripVideoFrames)
+	if err == nil {
+		return fmt.Errorf("no error after %d frames", written)
+	}
+	if !errors.Is(err, ErrOutputClosed) {
+		return fmt.Errorf("frame %d: error %v is not ErrOutputClosed", written, err)
+	}
+	before := calls()
+	if err := writer.WriteAudioFrame([]byte{0xFC, 0x00}, 0); !errors.Is(err, ErrOutputClosed) {
+		return fmt.Errorf("audio write after close: %v, want ErrOutputClosed", err)
+	}
+	if _, err := writeUntilError(writer, 1); !errors.Is(err, ErrOutputClosed) {
+		return fmt.Errorf("video write after close: %v, want ErrOutputClosed", err)
+	}
+	if after := calls(); after != before {
+		return fmt.Errorf("writer touched the closed output %d more times", after-before)
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("close: %v", err)
+	}
+	if err := <-runErr; err != nil {
+		return fmt.Errorf("writer run error: %v", err)
+	}
+	return nil
+}
+
+// TestRoundtripClosedPipe は実際のパイプの読み出し側を閉じた場合もErrOutputClosedになることを検証する
+func TestRoundtripClosedPipe(t *testing.T) {
+	disableFrameValidation(t)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r.Close()
+	calls := 0
+	if err := testBrokenPipe(writerFunc(func(p []byte) (int, error) {
+		calls++
+		return w.Write(p)
+	}), func() int { return calls }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countWriter は書き込みを保持せず、Write呼び出し回数を数える
+type countWriter struct {
+	mu     sync.Mutex
+	writes int
+}
+
+func (w *countWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	return len(p), nil
+}
+
+func (w *countWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writes
+}
+
+// testFlushInterval はManualClockで時刻を進めた時だけ、キーフレーム以外のブロックがフラッシュされることを検証する
+// flushIntervalMsが0の場合はブロックごとにフラッシュされること
+func testFlushInterval(flushIntervalMs int) error {
+	// インターリーブバッファに保持されると書き込みタイミングが変わるため無効化する
+	savedFlush, savedInterleave := FlushIntervalMs, InterleaveWindowMs
+	FlushIntervalMs = flushIntervalMs
+	InterleaveWindowMs = 0
+	defer func() {
+		FlushIntervalMs = savedFlush
+		InterleaveWindowMs = savedInterleave
+	}()
+
+	out := &countWriter{}
+	clock := newManualClock(time.Unix(0, 0))
+	writer := NewRawVideoMKVWriter(out, "vp8")
+	writer.SetClock(clock)
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	// キーフレームでヘッダーとクラスタが書き出される
+	if _, err := writeUntilError(writer, 1); err != nil {
+		return err
+	}
+	afterKeyframe := out.count()
+
+	for i := 0; i < 3; i++ {
+		if err := writer.WriteAudioFrame([]byte{0xFC, byte(i)}, uint32(i*roundtripAudioTSStep)); err != nil {
+			return err
+		}
+	}
+	buffered := out.count()
+	if flushIntervalMs == 0 {
+		if buffered != afterKeyframe+3 {
+			return fmt.Errorf("flush-interval=0: %d writes for 3 audio blocks, want 3", buffered-afterKeyframe)
+		}
+	} else {
+		if buffered != afterKeyframe {
+			return fmt.Errorf("audio blocks flushed before the interval elapsed (%d writes)", buffered-afterKeyframe)
+		}
+		clock.Advance(time.Duration(flushIntervalMs) * time.Millisecond)
+		if err := writer.WriteAudioFrame([]byte{0xFC, 0x03}, 3*roundtripAudioTSStep); err != nil {
+			return err
+		}
+		if out.count() != afterKeyframe+1 {
+			return fmt.Errorf("%d writes after the interval elapsed, want 1 flush", out.count()-afterKeyframe)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	return <-runErr
+}
+
+// TestRoundtripKeyframeTimeout はインターフレームだけが届き続ける場合に、
+// 待機時間の半分でPLIをまとめて送り、--keyframe-timeout でErrKeyframeTimeoutを返すことを検証する
+func TestRoundtripKeyframeTimeout(t *testing.T) {
+	disableFrameValidation(t)
+	KeyframeTimeoutMs = 2000
+	defer func() { KeyframeTimeoutMs = 10000 }()
+
+	encoder, err := NewVP8Encoder(roundtripWidth, roundtripHeight, "RGBA", 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+
+	var plis int
+	keyframeCtl := NewKeyframeController(time.Second)
+	keyframeCtl.Attach(func(packets []rtcp.Packet) error {
+		plis += len(packets)
+		return nil
+	}, 0x1234)
+
+	clock := newManualClock(time.Unix(0, 0))
+	keyframeCtl.SetClock(clock)
+	writer := NewRawVideoMKVWriter(io.Discard, "vp8")
+	writer.SetClock(clock)
+	writer.SetKeyframeController(keyframeCtl)
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+	defer func() {
+		writer.Close()
+		<-runErr
+	}()
+
+	// 先頭のキーフレームを捨て、インターフレームだけを100msごとに書き込む
+	for i := 0; i < 40; i++ {
+		encoded, keyframe, err := encoder.Encode(makeRGBAFrame(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if keyframe {
+			continue
+		}
+		elapsed := clock.Now().Sub(time.Unix(0, 0))
+		before := plis
+		err = writer.WriteVideoFrame(encoded, uint32(i*roundtripVideoTSStep), false)
+		if elapsed >= 2*time.Second {
+			if !errors.Is(err, ErrKeyframeTimeout) {
+				t.Fatalf("got %v after %v, want ErrKeyframeTimeout", err, elapsed)
+			}
+			t.Logf("%v", err)
+			return
+		}
+		if err != nil {
+			t.Fatalf("unexpected error after %v: %v", elapsed, err)
+		}
+		// デコードエラーによるPLIは間引かれて1つずつ、半分経過した時点では間引かずに3つ続けて送る
+		if elapsed == time.Second && plis-before < 3 {
+			t.Fatalf("%d PLIs sent at half the timeout, want a burst of 3", plis-before)
+		}
+		if elapsed != time.Second && plis-before > 1 {
+			t.Fatalf("%d PLIs sent after %v, want at most 1", plis-before, elapsed)
+		}
+		clock.Advance(100 * time.Millisecond)
+	}
+	t.Fatalf("keyframe timeout did not fire")
+}
+
+// TestRoundtripProbeElapsed はProbeWriterが1フレームしかない場合に、Clockの経過時間からビットレートを求めることを検証する
+func TestRoundtripProbeElapsed(t *testing.T) {
+	disableFrameValidation(t)
+	clock := newManualClock(time.Unix(0, 0))
+	probe := NewProbeWriter()
+	probe.SetClock(clock)
+	if err := probe.WriteAudioFrame(make([]byte, 250), 0); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(2 * time.Second)
+	if got := probe.Result().AudioKbps; got != 1 {
+		t.Fatalf("audio %.3f kbps over 2s, want 1", got)
+	}
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+// TestRoundtripRawVideoMKVWriter はTimecodeScaleごとにRawVideoMKVWriterの出力をMKVReaderで読み戻す
+func TestRoundtripRawVideoMKVWriter(t *testing.T) {
+	disableFrameValidation(t)
+	// 映像と音声は別goroutineから書き込むため、timecode順に並べ替えて書き込む
+	setInterleaveWindow(t, 50)
+	for _, scale := range timecodeScales {
+		t.Run(fmt.Sprintf("TimecodeScale=%dns", scale), func(t *testing.T) {
+			if err := testRoundTrip(scale); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestRoundtripCorruptedSize はSimpleBlockのサイズが壊れたMKVからMKVReaderが再同期することを検証する
+func TestRoundtripCorruptedSize(t *testing.T) {
+	disableFrameValidation(t)
+	for _, delta := range []int{3, -3} {
+		t.Run(fmt.Sprintf("%+d bytes", delta), func(t *testing.T) {
+			if err := testCorruptedSize(delta); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// TestRoundtripBrokenPipe は200KBの後にEPIPEを返す出力でRawVideoMKVWriterが終了することを検証する
+func TestRoundtripBrokenPipe(t *testing.T) {
+	disableFrameValidation(t)
+	epipe := &epipeWriter{limit: 200 * 1024}
+	if err := testBrokenPipe(epipe, func() int { return epipe.calls }); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRoundtripFlushInterval は手動の時計で --flush-interval ごとの書き出しを検証する
+func TestRoundtripFlushInterval(t *testing.T) {
+	disableFrameValidation(t)
+	for _, flushIntervalMs := range []int{100, 0} {
+		t.Run(fmt.Sprintf("%dms", flushIntervalMs), func(t *testing.T) {
+			if err := testFlushInterval(flushIntervalMs); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
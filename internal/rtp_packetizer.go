@@ -4,18 +4,40 @@ import (
 	"github.com/pion/rtp"
 )
 
+// 登録・送信に使うペイロードタイプ（--payload-typesで変更可能）
+var (
+	VP8PayloadType  uint8 = 97
+	VP9PayloadType  uint8 = 98
+	OpusPayloadType uint8 = 111
+)
+
 const (
-	VP8PayloadType  = 97
-	OpusPayloadType = 111
-	VP8ClockRate    = 90000
-	OpusClockRate   = 48000
-	MaxRTPPayload   = 1200
+	VP8ClockRate  = 90000
+	VP9ClockRate  = 90000
+	OpusClockRate = 48000
+	MaxRTPPayload = 1200
+
+	vp8MaxPartitionID = 7 // PIDは3bit
+
+	// 入力PTSが連続したRTP timestampからこれ以上ずれた場合は新しいtalk-spurtとして扱う
+	opusTalkspurtGapMs = 60
 )
 
+// rtpTimestamp はミリ秒のPTSをclockRateのRTP timestampにする
+// tick数を64bitで求めてから下位32bitを返すため、32bitを一周する長時間の配信（90kHzで約13.3時間、48kHzで約24.9時間）でも
+// 境界の前後のフレームの差はPTSの差のまま保たれ、受信側はRFC 3550に従い一周を検出できる
+// 負のPTSも一周前の値として連続する
+func rtpTimestamp(timestampMs int64, clockRate uint32) uint32 {
+	ticks := timestampMs * int64(clockRate) / 1000
+	return uint32(uint64(ticks) & 0xFFFFFFFF)
+}
+
 type VP8Packetizer struct {
 	sequenceNumber uint16
 	ssrc           uint32
 	clockRate      uint32
+	payloadType    uint8
+	partitioned    bool // 直前のフレームをパーティション単位でパケット化したか
 }
 
 func NewVP8Packetizer(ssrc uint32) *VP8Packetizer {
@@ -23,6 +45,7 @@ func NewVP8Packetizer(ssrc uint32) *VP8Packetizer {
 		sequenceNumber: 0,
 		ssrc:           ssrc,
 		clockRate:      VP8ClockRate,
+		payloadType:    VP8PayloadType,
 	}
 }
 
@@ -32,7 +55,7 @@ func (p *VP8Packetizer) Packetize(frame []byte, timestampMs int64, isKeyframe bo
 	}
 
 	// Convert timestamp from ms to RTP timestamp (90kHz clock)
-	timestamp := uint32(timestampMs * int64(p.clockRate) / 1000)
+	timestamp := rtpTimestamp(timestampMs, p.clockRate)
 
 	var packets []*rtp.Packet
 	remaining := frame
@@ -63,7 +86,7 @@ func (p *VP8Packetizer) Packetize(frame []byte, timestampMs int64, isKeyframe bo
 				Padding:        false,
 				Extension:      false,
 				Marker:         isLast,
-				PayloadType:    VP8PayloadType,
+				PayloadType:    p.payloadType,
 				SequenceNumber: p.sequenceNumber,
 				Timestamp:      timestamp,
 				SSRC:           p.ssrc,
@@ -81,13 +104,112 @@ func (p *VP8Packetizer) Packetize(frame []byte, timestampMs int64, isKeyframe bo
 	return packets
 }
 
-func (p *VP8Packetizer) PacketizeAndWrite(frame []byte, timestampMs int64, _ bool, writePacket func(*rtp.Packet) error) (int, error) {
+func (p *VP8Packetizer) PacketizeAndWrite(frame []byte, timestampMs int64, isKeyframe bool, writePacket func(*rtp.Packet) error) (int, error) {
+	if len(frame) == 0 {
+		return 0, nil
+	}
+	return p.PacketizePartitionsAndWrite([][]byte{frame}, timestampMs, isKeyframe, writePacket)
+}
+
+// PacketizePartitionsAndWrite はVP8パーティションごとにパケットを分けて送信する
+// 各パーティションの先頭パケットにS bitを立て、PIDにパーティション番号を設定する（RFC 7741 4.2）
+// パーティションが1つの場合は従来どおり先頭パケットのみS=1, PID=0となる
+func (p *VP8Packetizer) PacketizePartitionsAndWrite(partitions [][]byte, timestampMs int64, _ bool, writePacket func(*rtp.Packet) error) (int, error) {
+	// Convert timestamp from ms to RTP timestamp (90kHz clock)
+	timestamp := rtpTimestamp(timestampMs, p.clockRate)
+
+	// 最後の空でないパーティションでマーカーを立てる
+	lastPartition := -1
+	for i, partition := range partitions {
+		if len(partition) > 0 {
+			lastPartition = i
+		}
+	}
+	if lastPartition < 0 {
+		return 0, nil
+	}
+	p.partitioned = lastPartition > 0
+
+	sentCount := 0
+	for pid, partition := range partitions {
+		remaining := partition
+		isFirst := true
+
+		for len(remaining) > 0 {
+			payloadSize := len(remaining)
+			if payloadSize > MaxRTPPayload-1 { // -1 for VP8 payload descriptor
+				payloadSize = MaxRTPPayload - 1
+			}
+
+			// VP8 Payload Descriptor (minimal, 1 byte)
+			// https://datatracker.ietf.org/doc/html/rfc7741
+			// |X|R|N|S|R| PID |
+			descriptor := byte(min(pid, vp8MaxPartitionID))
+			if isFirst {
+				descriptor |= 0x10 // S (start of partition)
+			}
+
+			payload := make([]byte, 1+payloadSize)
+			payload[0] = descriptor
+			copy(payload[1:], remaining[:payloadSize])
+
+			isLast := pid == lastPartition && len(remaining) <= payloadSize
+			packet := &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					Padding:        false,
+					Extension:      false,
+					Marker:         isLast,
+					PayloadType:    p.payloadType,
+					SequenceNumber: p.sequenceNumber,
+					Timestamp:      timestamp,
+					SSRC:           p.ssrc,
+				},
+				Payload: payload,
+			}
+
+			if err := writePacket(packet); err != nil {
+				return sentCount, err
+			}
+
+			sentCount++
+			p.sequenceNumber++
+			remaining = remaining[payloadSize:]
+			isFirst = false
+		}
+	}
+
+	return sentCount, nil
+}
+
+// Partitioned は直前のフレームを複数パーティションに分けてパケット化したかを返す
+func (p *VP8Packetizer) Partitioned() bool {
+	return p.partitioned
+}
+
+type VP9Packetizer struct {
+	sequenceNumber uint16
+	ssrc           uint32
+	clockRate      uint32
+	payloadType    uint8
+}
+
+func NewVP9Packetizer(ssrc uint32) *VP9Packetizer {
+	return &VP9Packetizer{
+		sequenceNumber: 0,
+		ssrc:           ssrc,
+		clockRate:      VP9ClockRate,
+		payloadType:    VP9PayloadType,
+	}
+}
+
+func (p *VP9Packetizer) PacketizeAndWrite(frame []byte, timestampMs int64, isKeyframe bool, writePacket func(*rtp.Packet) error) (int, error) {
 	if len(frame) == 0 {
 		return 0, nil
 	}
 
 	// Convert timestamp from ms to RTP timestamp (90kHz clock)
-	timestamp := uint32(timestampMs * int64(p.clockRate) / 1000)
+	timestamp := rtpTimestamp(timestampMs, p.clockRate)
 
 	remaining := frame
 	isFirst := true
@@ -95,28 +217,36 @@ func (p *VP8Packetizer) PacketizeAndWrite(frame []byte, timestampMs int64, _ boo
 
 	for len(remaining) > 0 {
 		payloadSize := len(remaining)
-		if payloadSize > MaxRTPPayload-1 { // -1 for VP8 payload descriptor
+		if payloadSize > MaxRTPPayload-1 { // -1 for VP9 payload descriptor
 			payloadSize = MaxRTPPayload - 1
 		}
 
-		// VP8 Payload Descriptor (minimal, 1 byte)
+		isLast := len(remaining) <= payloadSize
+
+		// VP9 Payload Descriptor (minimal, 1 byte, non-flexible mode)
+		// |I|P|L|F|B|E|V|Z|
 		var descriptor byte = 0
+		if !isKeyframe {
+			descriptor |= 0x40 // P (inter-picture predicted)
+		}
 		if isFirst {
-			descriptor |= 0x10 // S (start of partition)
+			descriptor |= 0x08 // B (start of frame)
+		}
+		if isLast {
+			descriptor |= 0x04 // E (end of frame)
 		}
 
 		payload := make([]byte, 1+payloadSize)
 		payload[0] = descriptor
 		copy(payload[1:], remaining[:payloadSize])
 
-		isLast := len(remaining) <= payloadSize
 		packet := &rtp.Packet{
 			Header: rtp.Header{
 				Version:        2,
 				Padding:        false,
 				Extension:      false,
 				Marker:         isLast,
-				PayloadType:    VP8PayloadType,
+				PayloadType:    p.payloadType,
 				SequenceNumber: p.sequenceNumber,
 				Timestamp:      timestamp,
 				SSRC:           p.ssrc,
@@ -141,6 +271,12 @@ type OpusPacketizer struct {
 	sequenceNumber uint16
 	ssrc           uint32
 	clockRate      uint32
+	payloadType    uint8
+	// PacketizeFrames用の連続timestamp状態
+	started        bool
+	nextTimestamp  uint32 // 次フレームのRTP timestamp
+	anchorMs       int64  // talk-spurt先頭フレームの入力PTS
+	elapsedSamples int64  // talk-spurt先頭からのサンプル数
 }
 
 func NewOpusPacketizer(ssrc uint32) *OpusPacketizer {
@@ -148,6 +284,7 @@ func NewOpusPacketizer(ssrc uint32) *OpusPacketizer {
 		sequenceNumber: 0,
 		ssrc:           ssrc,
 		clockRate:      OpusClockRate,
+		payloadType:    OpusPayloadType,
 	}
 }
 
@@ -157,7 +294,7 @@ func (p *OpusPacketizer) Packetize(frame []byte, timestampMs int64) *rtp.Packet
 	}
 
 	// Convert timestamp from ms to RTP timestamp (48kHz clock)
-	timestamp := uint32(timestampMs * int64(p.clockRate) / 1000)
+	timestamp := rtpTimestamp(timestampMs, p.clockRate)
 
 	packet := &rtp.Packet{
 		Header: rtp.Header{
@@ -165,7 +302,7 @@ func (p *OpusPacketizer) Packetize(frame []byte, timestampMs int64) *rtp.Packet
 			Padding:        false,
 			Extension:      false,
 			Marker:         true,
-			PayloadType:    OpusPayloadType,
+			PayloadType:    p.payloadType,
 			SequenceNumber: p.sequenceNumber,
 			Timestamp:      timestamp,
 			SSRC:           p.ssrc,
@@ -177,3 +314,91 @@ func (p *OpusPacketizer) Packetize(frame []byte, timestampMs int64) *rtp.Packet
 
 	return packet
 }
+
+// PacketizeFrames はエンコード済みOpusフレームをパケット化する
+// RTP timestampは各フレームのサンプル数だけ進め、msからの再計算による丸め誤差を避ける。
+// マーカービットはRFC 7587に従いtalk-spurtの先頭パケットにのみ立てる。
+// 入力PTSが連続時刻からopusTalkspurtGapMs以上ずれた場合（ドロップや無音区間の後）は
+// 新しいtalk-spurtとしてtimestampを入力PTSに合わせ直す
+func (p *OpusPacketizer) PacketizeFrames(frames []EncodedAudioFrame) []*rtp.Packet {
+	packets := make([]*rtp.Packet, 0, len(frames))
+	for _, frame := range frames {
+		if packet := p.PacketizeFrame(frame); packet != nil {
+			packets = append(packets, packet)
+		}
+	}
+	return packets
+}
+
+// PacketizeFrame はエンコード済みOpusフレーム1つをPacketizeFramesと同じ規則でパケット化する
+// 空のフレームはパケット化せずnilを返す（sequence numberもtimestampも進めない）
+func (p *OpusPacketizer) PacketizeFrame(frame EncodedAudioFrame) *rtp.Packet {
+	if len(frame.Data) == 0 {
+		return nil
+	}
+	samples := int64(frame.Samples)
+	if samples <= 0 {
+		samples = int64(OpusPacketSamples(frame.Data))
+	}
+
+	marker := false
+	expectedMs := p.anchorMs + p.elapsedSamples*1000/int64(p.clockRate)
+	if gap := frame.TimestampMs - expectedMs; !p.started || gap >= opusTalkspurtGapMs || gap <= -opusTalkspurtGapMs {
+		if p.started {
+			DebugLog("Opus talk-spurt restart: pts=%dms expected=%dms\n", frame.TimestampMs, expectedMs)
+		}
+		p.nextTimestamp = rtpTimestamp(frame.TimestampMs, p.clockRate)
+		p.anchorMs = frame.TimestampMs
+		p.elapsedSamples = 0
+		p.started = true
+		marker = true
+	}
+
+	packet := &rtp.Packet{
+		Header: rtp.Header{
+			Version:        2,
+			Marker:         marker,
+			PayloadType:    p.payloadType,
+			SequenceNumber: p.sequenceNumber,
+			Timestamp:      p.nextTimestamp,
+			SSRC:           p.ssrc,
+		},
+		Payload: frame.Data,
+	}
+	p.sequenceNumber++
+	p.nextTimestamp += uint32(samples)
+	p.elapsedSamples += samples
+	return packet
+}
+
+// opusFrameDurations はTOCのconfig（上位5bit）ごとのフレーム長（48kHzサンプル数）
+// RFC 6716 3.1: SILK 10/20/40/60ms, Hybrid 10/20ms, CELT 2.5/5/10/20ms
+var opusFrameDurations = [32]int{
+	480, 960, 1920, 2880, 480, 960, 1920, 2880, 480, 960, 1920, 2880,
+	480, 960, 480, 960,
+	120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960, 120, 240, 480, 960,
+}
+
+// OpusPacketSamples はOpusパケットのTOCから48kHzでのサンプル数を求める
+// 解析できない場合は0を返す
+func OpusPacketSamples(packet []byte) int {
+	if len(packet) == 0 {
+		return 0
+	}
+	toc := packet[0]
+	frameSamples := opusFrameDurations[toc>>3]
+
+	var frameCount int
+	switch toc & 0x03 {
+	case 0:
+		frameCount = 1
+	case 1, 2:
+		frameCount = 2
+	default:
+		if len(packet) < 2 {
+			return 0
+		}
+		frameCount = int(packet[1] & 0x3F)
+	}
+	return frameSamples * frameCount
+}
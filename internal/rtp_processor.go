@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"fmt"
+	"os"
+
 	"github.com/pion/rtp"
 )
 
@@ -13,11 +16,36 @@ type DefaultRTPProcessor struct {
 	lastSequence   uint16 // 前回のシーケンス番号
 	hasSequence    bool   // シーケンス番号初期化フラグ
 	frameCorrupted bool   // 現在のフレームが破損しているか
+	maxTemporalID  int    // これより上のテンポラルレイヤーのパケットを破棄する（負の値で無効）
+	droppedLayers  int    // テンポラルレイヤー制限で破棄したフレーム数
+	// VP9の空間レイヤー選択（--spatial-layer）
+	maxSpatialID     int      // これより上の空間レイヤーのパケットを破棄する（負の値で無効）
+	droppedSpatial   int      // 空間レイヤー制限で破棄したレイヤーフレーム数
+	spatialLayers    int      // SSで通知された空間レイヤー数（0で未受信）
+	pictureLayers    [][]byte // 組み立て中のピクチャの空間レイヤーフレーム
+	pictureCorrupted bool     // 組み立て中のピクチャが破損しているか
 }
 
 // NewDefaultRTPProcessor は新しいRTPプロセッサを作成
 func NewDefaultRTPProcessor() RTPProcessor {
-	return &DefaultRTPProcessor{}
+	return &DefaultRTPProcessor{maxTemporalID: MaxTemporalLayer, maxSpatialID: SpatialLayer}
+}
+
+// skipTemporalLayer はtidが --max-temporal-layer より上のレイヤーかを判定する
+// 上位レイヤーのフレームは下位レイヤーから参照されないため、破棄しても基本レイヤーはデコードできる
+// シーケンス番号は破棄したパケットも含めて更新済みのため、破損扱いにはならない
+func (p *DefaultRTPProcessor) skipTemporalLayer(tid int, isStart bool) bool {
+	if p.maxTemporalID < 0 || tid <= p.maxTemporalID {
+		return false
+	}
+	if isStart {
+		p.droppedLayers++
+		if p.droppedLayers == 1 {
+			DebugLog("Dropping temporal layer %d frames (--max-temporal-layer %d)\n", tid, p.maxTemporalID)
+		}
+	}
+	p.currentFrame = nil
+	return true
 }
 
 // ProcessRTPPacket はRTPパケットを処理してメディアデータを抽出
@@ -66,78 +94,30 @@ func (p *DefaultRTPProcessor) processVP8Packet(packet *rtp.Packet) ([][]byte, er
 	p.lastTimestamp = packet.Timestamp
 
 	// VP8 payload descriptor parsing (RFC 7741)
-	// First byte:
-	//  X R N S R PID
-	//  X: Extension bit
-	//  R: Reserved
-	//  N: Non-reference frame
-	//  S: Start of VP8 partition
-	//  PID: Partition index (3 bits)
-
-	headerSize := 1
-	firstByte := payload[0]
-
-	// Check S bit for start of partition
-	isStart := (firstByte & 0x10) != 0
-
-	// X bit - extension present
-	if firstByte&0x80 != 0 {
-		if len(payload) < 2 {
-			return nil, nil
-		}
-		headerSize++
-		extByte := payload[1]
-
-		// I bit - PictureID present
-		if extByte&0x80 != 0 {
-			headerSize++
-			if len(payload) < headerSize {
-				return nil, nil
-			}
-			// M bit - PictureID is 16 bits
-			if payload[headerSize-1]&0x80 != 0 {
-				headerSize++
-			}
-		}
-
-		// L bit - TL0PICIDX present
-		if extByte&0x40 != 0 {
-			headerSize++
-		}
-
-		// T or K bit - TID/KEYIDX present
-		if extByte&0x20 != 0 || extByte&0x10 != 0 {
-			headerSize++
-		}
+	descriptor, err := ParseVP8PayloadDescriptor(payload)
+	if err != nil || len(payload) <= descriptor.HeaderSize {
+		return nil, nil
 	}
-
-	if len(payload) <= headerSize {
+	// S bitはパーティションごとに立つため、フレームの先頭はPID=0のパケットのみ
+	isStart := descriptor.FrameStart()
+	if p.skipTemporalLayer(int(descriptor.TID), isStart) {
 		return nil, nil
 	}
 
-	payloadData := payload[headerSize:]
+	payloadData := payload[descriptor.HeaderSize:]
 
-	// キーフレームチェック - VP8ビットストリームの最初のバイトで判定
-	// VP8 keyframe: bit 0 = 0 (P bit), and starts with sync code after frame tag
-	isKeyFrame := false
-	if isStart && len(payloadData) >= 10 {
+	// キーフレームチェック - 第1パーティション先頭のframe tagで判定
+	if isStart && len(payloadData) >= 10 && IsVP8Keyframe(payloadData) {
 		// VP8 uncompressed data chunk starts with:
 		// - frame_tag (3 bytes): bit 0 is key_frame (0=key, 1=inter)
 		// - For keyframes: sync code (3 bytes): 0x9d 0x01 0x2a
-		frameTag := payloadData[0]
-		isKeyFrame = (frameTag & 0x01) == 0
-
-		if isKeyFrame {
-			// キーフレームの場合、sync codeを確認
-			if payloadData[3] == 0x9d && payloadData[4] == 0x01 && payloadData[5] == 0x2a {
-				DebugLog("VP8 keyframe detected: sync code OK\n")
-				p.seenKeyFrame = true
-			} else {
-				DebugLog("VP8 keyframe but no sync code: %x\n", payloadData[:10])
-				// sync codeがなくても、frame_tagがキーフレームを示していれば受け入れる
-				p.seenKeyFrame = true
-			}
+		if payloadData[3] == 0x9d && payloadData[4] == 0x01 && payloadData[5] == 0x2a {
+			DebugLog("VP8 keyframe detected: sync code OK\n")
+		} else {
+			// sync codeがなくても、frame_tagがキーフレームを示していれば受け入れる
+			DebugLog("VP8 keyframe but no sync code: %x\n", payloadData[:10])
 		}
+		p.seenKeyFrame = true
 	}
 
 	// キーフレームをまだ見ていない場合はスキップ
@@ -171,7 +151,8 @@ func (p *DefaultRTPProcessor) processVP8Packet(packet *rtp.Packet) ([][]byte, er
 }
 
 // processVP9Packet はVP9 RTPパケットを処理
-// draft-ietf-payload-vp9に基づくVP9ペイロードデスクリプタの解析
+// RFC 9628に基づくVP9ペイロードデスクリプタの解析
+// --spatial-layer 指定時は選択した空間レイヤーまでのレイヤーフレームをsuperframeにまとめて1フレームとして返す
 func (p *DefaultRTPProcessor) processVP9Packet(packet *rtp.Packet) ([][]byte, error) {
 	payload := packet.Payload
 	if len(payload) < 1 {
@@ -190,110 +171,34 @@ func (p *DefaultRTPProcessor) processVP9Packet(packet *rtp.Packet) ([][]byte, er
 	p.hasSequence = true
 
 	// タイムスタンプが変わった場合、前のフレームをリセット
+	// 空間レイヤーが揃わなかったピクチャもここで破棄する
 	if p.lastTimestamp != 0 && p.lastTimestamp != packet.Timestamp {
 		p.currentFrame = nil
-	}
-	p.lastTimestamp = packet.Timestamp
-
-	// VP9 payload descriptor parsing
-	// First byte:
-	//  I P L F B E V Z
-	//  I: Picture ID present
-	//  P: Inter-picture predicted layer frame
-	//  L: Layer indices present
-	//  F: Flexible mode
-	//  B: Start of frame
-	//  E: End of frame
-	//  V: Scalability structure present
-	//  Z: Not a reference frame for upper spatial layers
-
-	headerSize := 1
-	firstByte := payload[0]
-
-	// B bit - beginning of frame
-	isStart := (firstByte & 0x08) != 0
-	// E bit - end of frame
-	isEnd := (firstByte & 0x04) != 0
-	// P bit - inter-picture predicted frame (0 = keyframe)
-	isInterFrame := (firstByte & 0x40) != 0
-
-	// I bit - Picture ID present
-	if firstByte&0x80 != 0 {
-		headerSize++
-		if len(payload) < headerSize {
-			return nil, nil
-		}
-		// M bit - Picture ID is 16 bits
-		if payload[headerSize-1]&0x80 != 0 {
-			headerSize++
+		if len(p.pictureLayers) > 0 {
+			DebugLog("Dropping incomplete VP9 picture (%d spatial layers received)\n", len(p.pictureLayers))
 		}
+		p.resetPicture()
 	}
+	p.lastTimestamp = packet.Timestamp
 
-	// L bit - Layer indices present
-	if firstByte&0x20 != 0 {
-		headerSize++
-		if len(payload) < headerSize {
-			return nil, nil
-		}
-		// Check if TL0PICIDX is present (non-flexible mode)
-		if (firstByte & 0x10) == 0 {
-			headerSize++
-		}
+	descriptor, err := ParseVP9PayloadDescriptor(payload)
+	if err != nil || len(payload) <= descriptor.HeaderSize {
+		return nil, nil
 	}
-
-	// F bit - Flexible mode, reference indices present
-	if (firstByte&0x10) != 0 && isInterFrame {
-		// In flexible mode with P=1, we have reference indices
-		// Each P_DIFF is 1 byte, N bit indicates more follow
-		if len(payload) > headerSize {
-			for {
-				if len(payload) <= headerSize {
-					break
-				}
-				refByte := payload[headerSize]
-				headerSize++
-				// N bit - more reference indices follow
-				if refByte&0x01 == 0 {
-					break
-				}
-			}
-		}
+	if descriptor.SS != nil {
+		p.updateSpatialLayers(descriptor.SS)
 	}
-
-	// V bit - Scalability structure present
-	if firstByte&0x02 != 0 {
-		if len(payload) <= headerSize {
-			return nil, nil
-		}
-		ssHeader := payload[headerSize]
-		headerSize++
-
-		nSpatial := ((ssHeader >> 5) & 0x07) + 1
-		yBit := (ssHeader & 0x10) != 0
-		gBit := (ssHeader & 0x08) != 0
-
-		if yBit {
-			headerSize += int(nSpatial) * 4 // WIDTH (2) + HEIGHT (2) per spatial layer
-		}
-
-		if gBit {
-			if len(payload) <= headerSize {
-				return nil, nil
-			}
-			nG := payload[headerSize]
-			headerSize++
-			headerSize += int(nG) * 3 // Each PG has 3 bytes
-		}
+	if p.skipTemporalLayer(int(descriptor.TID), descriptor.Start) {
+		return nil, nil
 	}
-
-	if len(payload) <= headerSize {
+	if p.skipSpatialLayer(int(descriptor.SID), descriptor.Start) {
 		return nil, nil
 	}
 
-	payloadData := payload[headerSize:]
+	payloadData := payload[descriptor.HeaderSize:]
 
-	// Check if keyframe (P=0 means keyframe)
-	if isStart && !isInterFrame {
+	// P=0はキーフレームまたはレイヤー間予測のみのフレーム。キーフレームは基本空間レイヤーで判定する
+	if descriptor.Start && !descriptor.InterPicture && descriptor.SID == 0 {
 		DebugLog("VP9 keyframe detected\n")
 		p.seenKeyFrame = true
 	}
@@ -304,26 +209,101 @@ func (p *DefaultRTPProcessor) processVP9Packet(packet *rtp.Packet) ([][]byte, er
 	}
 
 	// Accumulate frame data
-	if isStart {
+	if descriptor.Start {
 		p.currentFrame = nil
 		p.frameCorrupted = false // 新フレーム開始でリセット
+		// 下位の空間レイヤーを参照するのに、このピクチャの下位レイヤーを受信していない
+		if p.maxSpatialID >= 0 && descriptor.InterLayer && len(p.pictureLayers) == 0 {
+			p.pictureCorrupted = true
+		}
 	}
 	p.currentFrame = append(p.currentFrame, payloadData...)
 
 	// Return frame when we have end bit or marker
-	if (isEnd || packet.Marker) && len(p.currentFrame) > 0 {
+	if !(descriptor.End || packet.Marker) || len(p.currentFrame) == 0 {
+		return nil, nil
+	}
+	frame := make([]byte, len(p.currentFrame))
+	copy(frame, p.currentFrame)
+	corrupted := p.frameCorrupted
+	p.currentFrame = nil
+	p.frameCorrupted = false
+
+	if p.maxSpatialID < 0 {
 		// 破損フレームは返さない
-		if p.frameCorrupted {
+		if corrupted {
 			DebugLog("Dropping corrupted frame (VP9)\n")
-			p.currentFrame = nil
-			p.frameCorrupted = false
 			return nil, nil
 		}
-		frame := make([]byte, len(p.currentFrame))
-		copy(frame, p.currentFrame)
-		p.currentFrame = nil
 		return [][]byte{frame}, nil
 	}
 
-	return nil, nil
+	// 選択した空間レイヤー（またはピクチャの最後のレイヤー）まで揃ったらまとめて返す
+	p.pictureLayers = append(p.pictureLayers, frame)
+	p.pictureCorrupted = p.pictureCorrupted || corrupted
+	if int(descriptor.SID) < p.maxSpatialID && !packet.Marker {
+		return nil, nil
+	}
+	return p.finishPicture(), nil
+}
+
+// skipSpatialLayer はsidが --spatial-layer より上の空間レイヤーかを判定する
+// 下位の空間レイヤーは上位レイヤーを参照しないため、破棄しても選択したレイヤーまではデコードできる
+func (p *DefaultRTPProcessor) skipSpatialLayer(sid int, isStart bool) bool {
+	if p.maxSpatialID < 0 || sid <= p.maxSpatialID {
+		return false
+	}
+	if isStart {
+		p.droppedSpatial++
+		if p.droppedSpatial == 1 {
+			DebugLog("Dropping spatial layer %d frames (--spatial-layer %d)\n", sid, p.maxSpatialID)
+		}
+	}
+	p.currentFrame = nil
+	return true
+}
+
+// updateSpatialLayers はSSで通知された空間レイヤー数が変わった場合に、デコードするレイヤーを表示する
+func (p *DefaultRTPProcessor) updateSpatialLayers(ss *VP9ScalabilityStructure) {
+	if p.maxSpatialID < 0 || ss.SpatialLayers == p.spatialLayers {
+		return
+	}
+	p.spatialLayers = ss.SpatialLayers
+	layer := min(p.maxSpatialID, ss.SpatialLayers-1)
+	resolution := ""
+	if layer < len(ss.Widths) {
+		resolution = fmt.Sprintf(" (%dx%d)", ss.Widths[layer], ss.Heights[layer])
+	}
+	fmt.Fprintf(os.Stderr, "VP9 SVC: %d spatial layers, decoding layer %d%s\n", ss.SpatialLayers, layer, resolution)
+}
+
+// finishPicture はピクチャの空間レイヤーフレームをsuperframeにまとめて返す
+func (p *DefaultRTPProcessor) finishPicture() [][]byte {
+	defer p.resetPicture()
+	if p.pictureCorrupted {
+		DebugLog("Dropping corrupted picture (VP9, %d spatial layers)\n", len(p.pictureLayers))
+		return nil
+	}
+	superframe := buildVP9Superframe(p.pictureLayers)
+	if superframe == nil {
+		DebugLog("Dropping VP9 picture: too many frames for a superframe\n")
+		return nil
+	}
+	return [][]byte{superframe}
+}
+
+// resetCodec は映像コーデックの切り替え時に、組み立て中のフレームとキーフレームの受信状態を破棄する
+// 新しいコーデックのフレームはそのキーフレームから返す
+func (p *DefaultRTPProcessor) resetCodec() {
+	p.currentFrame = nil
+	p.seenKeyFrame = false
+	p.frameCorrupted = false
+	p.lastTimestamp = 0
+	p.resetPicture()
+}
+
+// resetPicture は組み立て中のピクチャを破棄する
+func (p *DefaultRTPProcessor) resetPicture() {
+	p.pictureLayers = nil
+	p.pictureCorrupted = false
 }
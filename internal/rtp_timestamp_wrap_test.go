@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	rtpTimestampWrapWidth  = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	rtpTimestampWrapHeight = 360
+	// 90kHzのRTP timestampが32bitを一周するPTS（約13.3時間）
+	videoWrapMs = int64(1<<32) * 1000 / 90000
+	// 48kHzのRTP timestampが32bitを一周するPTS（約24.9時間）
+	audioWrapMs = int64(1<<32) * 1000 / 48000
+)
+
+// checkContinuous はPTS（ms）ごとのRTP timestampが、32bitの剰余でPTSの差×clockRate/1000ずつ進み、
+// 途中で32bitの境界を越えていることを検証する
+func checkContinuous(pts []int64, timestamps []uint32, ticksPerMs int64) error {
+	wrapped := false
+	for i := 1; i < len(timestamps); i++ {
+		want := uint32((pts[i] - pts[i-1]) * ticksPerMs)
+		if got := timestamps[i] - timestamps[i-1]; got != want {
+			return fmt.Errorf("RTP timestamp advanced by %d from %dms to %dms, want %d", got, pts[i-1], pts[i], want)
+		}
+		if timestamps[i] < timestamps[i-1] {
+			wrapped = true
+		}
+	}
+	if !wrapped {
+		return fmt.Errorf("RTP timestamps %d..%d did not cross the 32-bit boundary", timestamps[0], timestamps[len(timestamps)-1])
+	}
+	return nil
+}
+
+// videoPTS は一周する時刻の前後にまたがる30fps相当のPTS列を返す
+func videoPTS() []int64 {
+	var pts []int64
+	for ms := videoWrapMs - 200; ms < videoWrapMs+200; ms += 33 {
+		pts = append(pts, ms)
+	}
+	return pts
+}
+
+// packetizeVideo はVideoPacketizerでPTSごとに1バイトのフレームを送り、各フレームのRTP timestampを返す
+func packetizeVideo(packetizer VideoPacketizer, pts []int64) ([]uint32, error) {
+	var timestamps []uint32
+	for _, ms := range pts {
+		if _, err := packetizer.PacketizeAndWrite([]byte{0x00}, ms, false, func(packet *rtp.Packet) error {
+			timestamps = append(timestamps, packet.Timestamp)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return timestamps, nil
+}
+
+// TestRTPTimestampWrapVP8 はVP8のRTP timestampが約13.3時間の32bit境界を越えても連続することを検証する
+func TestRTPTimestampWrapVP8(t *testing.T) {
+	pts := videoPTS()
+	timestamps, err := packetizeVideo(NewVP8Packetizer(1), pts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkContinuous(pts, timestamps, 90); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRTPTimestampWrapVP9 はVP9のRTP timestampが約13.3時間の32bit境界を越えても連続することを検証する
+func TestRTPTimestampWrapVP9(t *testing.T) {
+	pts := videoPTS()
+	timestamps, err := packetizeVideo(NewVP9Packetizer(1), pts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkContinuous(pts, timestamps, 90); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRTPTimestampWrapOpus はOpusのRTP timestampが約24.9時間の32bit境界を越えても、
+// talk-spurtの先頭で入力PTSに合わせ直した時もその後にサンプル数で進めた時も連続することを検証する
+func TestRTPTimestampWrapOpus(t *testing.T) {
+	packetizer := NewOpusPacketizer(1)
+	var pts []int64
+	var timestamps []uint32
+	// 境界の手前でtalk-spurtが始まり、20msのフレームで境界を越える
+	for ms := audioWrapMs - 100; ms < audioWrapMs+100; ms += 20 {
+		packets := packetizer.PacketizeFrames([]EncodedAudioFrame{{Data: []byte{0xF8, 0xFF, 0xFE}, TimestampMs: ms}})
+		pts = append(pts, ms)
+		timestamps = append(timestamps, packets[0].Timestamp)
+	}
+	if err := checkContinuous(pts, timestamps, 48); err != nil {
+		t.Fatal(err)
+	}
+
+	// 境界を越えた後の無音区間の後に、新しいtalk-spurtとして入力PTSから合わせ直す
+	resumeMs := audioWrapMs + 1000
+	packets := packetizer.PacketizeFrames([]EncodedAudioFrame{{Data: []byte{0xF8, 0xFF, 0xFE}, TimestampMs: resumeMs}})
+	if !packets[0].Marker {
+		t.Fatalf("no marker on the talk-spurt after the gap")
+	}
+	if want := uint32((resumeMs - pts[len(pts)-1]) * 48); packets[0].Timestamp-timestamps[len(timestamps)-1] != want {
+		t.Fatalf("RTP timestamp advanced by %d over the gap, want %d", packets[0].Timestamp-timestamps[len(timestamps)-1], want)
+	}
+}
+
+// TestRTPTimestampWrapNegativePTS は先頭より前のブロック等の負のPTSから0をまたいでもRTP timestampが連続することを検証する
+func TestRTPTimestampWrapNegativePTS(t *testing.T) {
+	var pts []int64
+	for ms := int64(-99); ms < 100; ms += 33 {
+		pts = append(pts, ms)
+	}
+	timestamps, err := packetizeVideo(NewVP8Packetizer(1), pts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkContinuous(pts, timestamps, 90); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// videoTimecodes はSimpleBlockのtimecode（ms、クラスタのtimecodeを加えた値）を出力順に返す
+func videoTimecodes(data []byte) ([]int64, error) {
+	var timecodes []int64
+	var clusterTime int64
+	for len(data) > 0 {
+		id, n := readVint(data, true)
+		size, m := readVint(data[n:], false)
+		if n == 0 || m == 0 {
+			return nil, fmt.Errorf("malformed element header")
+		}
+		data = data[n+m:]
+		if id == idSegment || id == idCluster {
+			continue
+		}
+		if uint64(len(data)) < size {
+			return nil, fmt.Errorf("element 0x%X truncated", id)
+		}
+		value := data[:size]
+		data = data[size:]
+		switch id {
+		case idTimecode:
+			clusterTime = 0
+			for _, b := range value {
+				clusterTime = clusterTime<<8 | int64(b)
+			}
+		case idSimpleBlock:
+			_, k := readVint(value, false)
+			if k == 0 || len(value) < k+3 {
+				return nil, fmt.Errorf("malformed SimpleBlock")
+			}
+			timecodes = append(timecodes, clusterTime+int64(int16(binary.BigEndian.Uint16(value[k:]))))
+		}
+	}
+	return timecodes, nil
+}
+
+// TestRTPTimestampWrapReceiveAcrossWrap はwhip-goのVP8PacketizerのRTP timestampをそのまま受信側のRawVideoMKVWriterに渡し、
+// 32bitの境界を越えてもMKVのtimecodeが戻らずに33msずつ進むことを検証する
+func TestRTPTimestampWrapReceiveAcrossWrap(t *testing.T) {
+	NoFrameValidation = true
+	defer func() { NoFrameValidation = false }()
+
+	encoder, err := NewVP8Encoder(rtpTimestampWrapWidth, rtpTimestampWrapHeight, "YUV420P", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	packetizer := NewVP8Packetizer(1)
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	writer.SetVideoOnly()
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	pts := videoPTS()
+	for i, ms := range pts {
+		encoded, keyframe, err := encoder.Encode(bytes.Repeat([]byte{byte(0x40 + i)}, rtpTimestampWrapWidth*rtpTimestampWrapHeight*3/2))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var timestamp uint32
+		if _, err := packetizer.PacketizeAndWrite(encoded, ms, keyframe, func(packet *rtp.Packet) error {
+			timestamp = packet.Timestamp
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if err := writer.WriteVideoFrame(encoded, timestamp, keyframe); err != nil {
+			t.Fatalf("frame at %dms: %v", ms, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-runErr; err != nil {
+		t.Fatal(err)
+	}
+
+	timecodes, err := videoTimecodes(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timecodes) != len(pts) {
+		t.Fatalf("%d video blocks written, want %d", len(timecodes), len(pts))
+	}
+	for i, timecode := range timecodes {
+		if want := pts[i] - pts[0]; timecode != want {
+			t.Fatalf("block %d at %dms, want %dms", i, timecode, want)
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+// ErrAnswerNotBundled はanswerが全てのm-lineをBUNDLEしておらず、受け付けられないことを示す
+var ErrAnswerNotBundled = errors.New("answer is not bundled")
+
+// bundlePolicyFromName は --bundle-policy の値をwebrtc.BundlePolicyに変換する
+func bundlePolicyFromName(name string) webrtc.BundlePolicy {
+	switch name {
+	case BundlePolicyMaxCompat:
+		return webrtc.BundlePolicyMaxCompat
+	case BundlePolicyMaxBundle:
+		return webrtc.BundlePolicyMaxBundle
+	default:
+		return webrtc.BundlePolicyBalanced
+	}
+}
+
+// answerBundle はanswerのBUNDLE構成
+type answerBundle struct {
+	unbundled []string // a=group:BUNDLEに含まれない有効なm-line（mid、無い場合は種類と位置）
+	sharedICE bool     // 全ての有効なm-lineのice-ufrag/ice-pwdが同じ（1つのICEトランスポートで扱える）
+}
+
+// parseAnswerBundle はanswerのa=group:BUNDLEとm-lineごとのICE認証情報を調べる
+// ポート0で拒否されたm-lineは対象外
+func parseAnswerBundle(raw string) (answerBundle, error) {
+	desc := &sdp.SessionDescription{}
+	if err := desc.UnmarshalString(raw); err != nil {
+		return answerBundle{}, err
+	}
+
+	bundled := make(map[string]bool)
+	for _, attr := range desc.Attributes {
+		if attr.Key != "group" {
+			continue
+		}
+		fields := strings.Fields(attr.Value)
+		if len(fields) > 0 && fields[0] == "BUNDLE" {
+			for _, mid := range fields[1:] {
+				bundled[mid] = true
+			}
+		}
+	}
+
+	// セッションレベルの値はm-lineで上書きされない場合のデフォルト
+	sessionUfrag, _ := desc.Attribute("ice-ufrag")
+	sessionPwd, _ := desc.Attribute("ice-pwd")
+
+	result := answerBundle{sharedICE: true}
+	var firstCredentials string
+	for i, md := range desc.MediaDescriptions {
+		if md.MediaName.Port.Value == 0 {
+			continue
+		}
+		mid, ok := md.Attribute("mid")
+		if !ok || !bundled[mid] {
+			if mid == "" {
+				mid = fmt.Sprintf("%s#%d", md.MediaName.Media, i)
+			}
+			result.unbundled = append(result.unbundled, mid)
+		}
+
+		ufrag, pwd := sessionUfrag, sessionPwd
+		if value, ok := md.Attribute("ice-ufrag"); ok {
+			ufrag = value
+		}
+		if value, ok := md.Attribute("ice-pwd"); ok {
+			pwd = value
+		}
+		credentials := ufrag + ":" + pwd
+		if firstCredentials == "" {
+			firstCredentials = credentials
+		} else if credentials != firstCredentials {
+			result.sharedICE = false
+		}
+	}
+	return result, nil
+}
+
+// checkAnswerBundle はanswerのBUNDLE構成をpolicyに従って検証する
+// pionのPeerConnectionは1つのICE/DTLSトランスポートしか持たないため、BUNDLEされないanswerは
+// 全てのm-lineが同じICE認証情報を使う場合のみ受け付けられる（BundlePolicyはpion内部では参照されない）
+func checkAnswerBundle(answer string, policy webrtc.BundlePolicy) error {
+	bundle, err := parseAnswerBundle(answer)
+	if err != nil {
+		// 解析できないanswerはSetRemoteDescriptionのエラーとして報告する
+		return nil
+	}
+	if len(bundle.unbundled) == 0 {
+		return nil
+	}
+
+	unbundled := strings.Join(bundle.unbundled, ", ")
+	if policy == webrtc.BundlePolicyMaxBundle {
+		return fmt.Errorf("%w: m-lines %s are outside a=group:BUNDLE (--bundle-policy %s)", ErrAnswerNotBundled, unbundled, BundlePolicyMaxBundle)
+	}
+	if !bundle.sharedICE {
+		return fmt.Errorf("%w: m-lines %s use separate ICE transports, which this client does not support", ErrAnswerNotBundled, unbundled)
+	}
+	fmt.Fprintf(os.Stderr, "Answer does not bundle m-lines %s; all media will use the shared ICE transport\n", unbundled)
+	return nil
+}
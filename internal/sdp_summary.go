@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pion/sdp/v3"
+)
+
+// sdpMediaSummary はm-line単位のSDP要約
+type sdpMediaSummary struct {
+	kind        string
+	mid         string
+	direction   string
+	codecs      []string // "VP8/90000 (pt=97)" 形式
+	codecNames  []string // 比較用のコーデック名（大文字）
+	iceUfrag    string
+	fingerprint string
+}
+
+// PrintSDPSummary はofferとanswerをm-line単位で要約してwに出力し、
+// offerに含まれていたがanswerで選択されなかったコーデックを強調表示する
+func PrintSDPSummary(w io.Writer, offerSDP, answerSDP string) {
+	offer, offerErr := summarizeSDP(offerSDP)
+	answer, answerErr := summarizeSDP(answerSDP)
+
+	fmt.Fprintln(w, "\n=== SDP Summary ===")
+	if offerErr != nil {
+		fmt.Fprintf(w, "failed to parse offer: %v\n", offerErr)
+	} else {
+		printMediaSummaries(w, "Offer", offer)
+	}
+	if answerErr != nil {
+		fmt.Fprintf(w, "failed to parse answer: %v\n", answerErr)
+	} else {
+		printMediaSummaries(w, "Answer", answer)
+	}
+
+	if offerErr == nil && answerErr == nil {
+		printCodecDiff(w, offer, answer)
+	}
+	fmt.Fprintln(w, "=== End SDP Summary ===")
+}
+
+func summarizeSDP(raw string) ([]sdpMediaSummary, error) {
+	desc := &sdp.SessionDescription{}
+	if err := desc.UnmarshalString(raw); err != nil {
+		return nil, err
+	}
+
+	// セッションレベルの値はm-lineで上書きされない場合のデフォルト
+	sessionUfrag, _ := desc.Attribute("ice-ufrag")
+	sessionFingerprint, _ := desc.Attribute("fingerprint")
+
+	summaries := make([]sdpMediaSummary, 0, len(desc.MediaDescriptions))
+	for _, md := range desc.MediaDescriptions {
+		summary := sdpMediaSummary{
+			kind:        md.MediaName.Media,
+			direction:   "sendrecv",
+			iceUfrag:    sessionUfrag,
+			fingerprint: sessionFingerprint,
+		}
+		if mid, ok := md.Attribute("mid"); ok {
+			summary.mid = mid
+		}
+		if ufrag, ok := md.Attribute("ice-ufrag"); ok {
+			summary.iceUfrag = ufrag
+		}
+		if fingerprint, ok := md.Attribute("fingerprint"); ok {
+			summary.fingerprint = fingerprint
+		}
+
+		rtpmaps := make(map[string]string)
+		for _, attr := range md.Attributes {
+			switch attr.Key {
+			case "sendrecv", "sendonly", "recvonly", "inactive":
+				summary.direction = attr.Key
+			case "rtpmap":
+				parts := strings.SplitN(attr.Value, " ", 2)
+				if len(parts) == 2 {
+					rtpmaps[parts[0]] = parts[1]
+				}
+			}
+		}
+
+		for _, pt := range md.MediaName.Formats {
+			codec, ok := rtpmaps[pt]
+			if !ok {
+				continue
+			}
+			summary.codecs = append(summary.codecs, fmt.Sprintf("%s (pt=%s)", codec, pt))
+			name := strings.ToUpper(strings.SplitN(codec, "/", 2)[0])
+			summary.codecNames = append(summary.codecNames, name)
+		}
+
+		summaries = append(summaries, summary)
+	}
+
+	return summaries, nil
+}
+
+func printMediaSummaries(w io.Writer, label string, summaries []sdpMediaSummary) {
+	fmt.Fprintf(w, "%s:\n", label)
+	for i, m := range summaries {
+		fmt.Fprintf(w, "  m=%s [%d] mid=%s direction=%s\n", m.kind, i, m.mid, m.direction)
+		fmt.Fprintf(w, "    codecs: %s\n", strings.Join(m.codecs, ", "))
+		fmt.Fprintf(w, "    ice-ufrag: %s\n", m.iceUfrag)
+		fmt.Fprintf(w, "    fingerprint: %s\n", m.fingerprint)
+	}
+}
+
+// printCodecDiff はofferで提示したがanswerで採用されなかったコーデックを出力する
+// m-lineはJSEPの規則によりofferとanswerで同じ順序になる
+func printCodecDiff(w io.Writer, offer, answer []sdpMediaSummary) {
+	for i, offered := range offer {
+		if i >= len(answer) {
+			fmt.Fprintf(w, "!! m=%s [%d] mid=%s missing from answer\n", offered.kind, i, offered.mid)
+			continue
+		}
+
+		answered := make(map[string]bool)
+		for _, name := range answer[i].codecNames {
+			answered[name] = true
+		}
+
+		var rejected []string
+		for j, name := range offered.codecNames {
+			if !answered[name] {
+				rejected = append(rejected, offered.codecs[j])
+			}
+		}
+		if len(rejected) > 0 {
+			fmt.Fprintf(w, "!! m=%s [%d] offered but not answered: %s\n",
+				offered.kind, i, strings.Join(rejected, ", "))
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// sdpSummaryOffer は映像にVP8/VP9/H264、音声にOpusを提示するoffer
+const sdpSummaryOffer = "v=0\r\n" +
+	"o=- 1 1 IN IP4 0.0.0.0\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=fingerprint:sha-256 AA:BB\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96 98 102\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=ice-ufrag:offerufrag\r\n" +
+	"a=recvonly\r\n" +
+	"a=rtpmap:96 VP8/90000\r\n" +
+	"a=rtpmap:98 VP9/90000\r\n" +
+	"a=rtpmap:102 H264/90000\r\n" +
+	"m=audio 9 UDP/TLS/RTP/SAVPF 111\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:1\r\n" +
+	"a=ice-ufrag:offerufrag\r\n" +
+	"a=recvonly\r\n" +
+	"a=rtpmap:111 opus/48000/2\r\n"
+
+// sdpSummaryAnswer は映像でVP8だけを採用し、音声のm-lineを返さないanswer
+const sdpSummaryAnswer = "v=0\r\n" +
+	"o=- 2 2 IN IP4 0.0.0.0\r\n" +
+	"s=-\r\n" +
+	"t=0 0\r\n" +
+	"a=fingerprint:sha-256 CC:DD\r\n" +
+	"m=video 9 UDP/TLS/RTP/SAVPF 96\r\n" +
+	"c=IN IP4 0.0.0.0\r\n" +
+	"a=mid:0\r\n" +
+	"a=ice-ufrag:answerufrag\r\n" +
+	"a=sendonly\r\n" +
+	"a=rtpmap:96 vp8/90000\r\n"
+
+// TestPrintSDPSummaryCodecDiff はanswerで採用されなかったコーデックと、answerに無いm-lineが強調表示されることを検証する
+func TestPrintSDPSummaryCodecDiff(t *testing.T) {
+	var output bytes.Buffer
+	PrintSDPSummary(&output, sdpSummaryOffer, sdpSummaryAnswer)
+	got := output.String()
+
+	for _, want := range []string{
+		"  m=video [0] mid=0 direction=recvonly\n    codecs: VP8/90000 (pt=96), VP9/90000 (pt=98), H264/90000 (pt=102)\n    ice-ufrag: offerufrag\n    fingerprint: sha-256 AA:BB\n",
+		"Answer:\n  m=video [0] mid=0 direction=sendonly\n    codecs: vp8/90000 (pt=96)\n",
+		// コーデック名は大文字小文字を区別せずに比較する
+		"!! m=video [0] offered but not answered: VP9/90000 (pt=98), H264/90000 (pt=102)\n",
+		"!! m=audio [1] mid=1 missing from answer\n",
+	} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("summary does not contain %q:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "not answered: VP8") {
+		t.Fatalf("answered codec reported as rejected:\n%s", got)
+	}
+	if !strings.HasPrefix(got, "\n=== SDP Summary ===\n") || !strings.HasSuffix(got, "=== End SDP Summary ===\n") {
+		t.Fatalf("summary is not framed by the header and footer:\n%s", got)
+	}
+}
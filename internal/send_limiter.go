@@ -0,0 +1,130 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	// sendLimiterBurst は送信を待たずに続けて送れる量（上限のビットレートでのこの時間分）
+	// 短くするほど送信が均され、回線のバッファを溢れさせにくい
+	sendLimiterBurst = 20 * time.Millisecond
+	// minSendBurstBytes は低いビットレートでも1パケットは待たずに送れるようにするバーストの下限
+	minSendBurstBytes = 1500
+)
+
+// ErrSendLimiterStopped はStopの後、または送信を待っている間にStopされた書き込みが返すエラー
+var ErrSendLimiterStopped = errors.New("send rate limiter stopped")
+
+// SendRateLimiter は送信するRTPパケットをトークンバケットで均し、送信のビットレートを上限以下に保つ（--max-send-bitrate）
+// フレーム単位のPacerとは別に、RTPの書き込みの直前でパケットごとに待つため、
+// --no-pacing や入力のバーストでもパケットを回線の許す速さを超えて送らない
+// 映像と音声で1つを共有し、合計を上限以下にする
+type SendRateLimiter struct {
+	mu          sync.Mutex
+	clock       Clock
+	bytesPerSec float64
+	burstBytes  float64
+	tokens      float64   // 待たずに送れる残りのバイト数（予約済みの送信が待っている間は負）
+	updatedAt   time.Time // tokensを最後に補充した時刻
+
+	limitedPackets int64         // 送信を待たせたパケット数（累計）
+	limitedBytes   int64         // 送信を待たせたパケットのバイト数（累計）
+	waited         time.Duration // 待たせた時間の合計
+
+	stop     chan struct{} // Stopで閉じ、送信の待ちを打ち切る
+	stopOnce sync.Once
+}
+
+// NewSendRateLimiter はbitrateBpsを上限とするSendRateLimiterを作成する
+// bitrateBps <= 0 の場合は制限しないためnilを返す（nilのままWrapできる）
+func NewSendRateLimiter(bitrateBps int) *SendRateLimiter {
+	if bitrateBps <= 0 {
+		return nil
+	}
+	bytesPerSec := float64(bitrateBps) / 8
+	return &SendRateLimiter{
+		clock:       SystemClock{},
+		bytesPerSec: bytesPerSec,
+		burstBytes:  max(bytesPerSec*sendLimiterBurst.Seconds(), minSendBurstBytes),
+		stop:        make(chan struct{}),
+	}
+}
+
+// SetClock はトークンの補充に使う時刻の取得元を差し替える（検証用）
+func (l *SendRateLimiter) SetClock(clock Clock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = clock
+}
+
+// Reserve はsizeバイトの送信を予約し、送信する前に待つべき時間を返す
+// 待っている間に別の送信が予約された場合は、その分だけ後ろに並ぶ
+func (l *SendRateLimiter) Reserve(size int) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+	if l.updatedAt.IsZero() {
+		l.tokens = l.burstBytes
+	} else if elapsed := now.Sub(l.updatedAt); elapsed > 0 {
+		l.tokens = min(l.tokens+elapsed.Seconds()*l.bytesPerSec, l.burstBytes)
+	}
+	l.updatedAt = now
+
+	l.tokens -= float64(size)
+	if l.tokens >= 0 {
+		return 0
+	}
+	wait := time.Duration(-l.tokens / l.bytesPerSec * float64(time.Second))
+	l.limitedPackets++
+	l.limitedBytes += int64(size)
+	l.waited += wait
+	return wait
+}
+
+// Wrap はwriteの前にReserveで予約した時間だけ待つRTPの書き込み関数を返す
+// 待ちはclockで測り、Stopされると書き込まずにErrSendLimiterStoppedを返す
+// lがnilの場合はwriteをそのまま返す
+func (l *SendRateLimiter) Wrap(write func(*rtp.Packet) error) func(*rtp.Packet) error {
+	if l == nil {
+		return write
+	}
+	return func(packet *rtp.Packet) error {
+		select {
+		case <-l.stop:
+			return ErrSendLimiterStopped
+		default:
+		}
+		if wait := l.Reserve(packet.MarshalSize()); wait > 0 {
+			DebugLogPeriodic("send_limiter.wait", time.Second, "Send rate limit: waiting %v before a %d byte packet\n", wait, packet.MarshalSize())
+			select {
+			case <-clockAfter(l.clock, wait):
+			case <-l.stop:
+				return ErrSendLimiterStopped
+			}
+		}
+		return write(packet)
+	}
+}
+
+// Stop は送信を待っている書き込みを打ち切り、以後の書き込みを止める
+// 停止時に上限の待ちで終了が遅れないようにするためのもので、複数回呼んでもよい（nilでもよい）
+func (l *SendRateLimiter) Stop() {
+	if l == nil {
+		return
+	}
+	l.stopOnce.Do(func() {
+		close(l.stop)
+	})
+}
+
+// Stats は送信を待たせたパケット数、バイト数と待たせた時間の合計を返す
+func (l *SendRateLimiter) Stats() (packets, bytes int64, waited time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.limitedPackets, l.limitedBytes, l.waited
+}
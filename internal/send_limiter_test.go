@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	capBps            = 1_000_000 // 1Mbps = 125000バイト/秒
+	packetSize        = 1200
+	sendLimiterWindow = 100 * time.Millisecond
+)
+
+// sent は送信したパケットの時刻とバイト数
+type sent struct {
+	at   time.Duration
+	size int
+}
+
+// burst はManualClock上で、limiterの返す時間だけ待ちながらn個のパケットを続けて送った時刻を返す
+// 入力のバーストを --no-pacing で送る場合と同じく、送信側は待つ以外に間を空けない
+func burst(limiter *SendRateLimiter, clock *manualClock, start time.Time, n int) []sent {
+	var packets []sent
+	for i := 0; i < n; i++ {
+		clock.Advance(limiter.Reserve(packetSize))
+		packets = append(packets, sent{at: clock.Now().Sub(start), size: packetSize})
+	}
+	return packets
+}
+
+// maxWindowBytes はwindowの長さのどの区間でも送ったバイト数の最大値を返す
+func maxWindowBytes(packets []sent) int {
+	most := 0
+	for i := range packets {
+		total := 0
+		for _, p := range packets[i:] {
+			if p.at-packets[i].at >= sendLimiterWindow {
+				break
+			}
+			total += p.size
+		}
+		most = max(most, total)
+	}
+	return most
+}
+
+// TestSendLimiterBurstUnderCap は500パケット（600KB）のバーストでも、100msのどの区間の送信量も
+// 上限の100ms分と最初のバースト（上限の20ms分）の合計を超えないことを検証する
+func TestSendLimiterBurstUnderCap(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := newManualClock(start)
+	limiter := NewSendRateLimiter(capBps)
+	limiter.SetClock(clock)
+
+	packets := burst(limiter, clock, start, 500)
+	allowed := capBps/8*int(sendLimiterWindow/time.Millisecond)/1000 + capBps/8*20/1000
+	if got := maxWindowBytes(packets); got > allowed {
+		t.Fatalf("%d bytes sent within %v, want at most %d", got, sendLimiterWindow, allowed)
+	}
+	// 全体では上限のビットレートで送り終える
+	last := packets[len(packets)-1].at
+	want := time.Duration(float64(500*packetSize-capBps/8*20/1000) / (capBps / 8) * float64(time.Second))
+	if last < want-time.Millisecond || last > want+10*time.Millisecond {
+		t.Fatalf("last packet sent at %v, want about %v", last, want)
+	}
+	t.Logf("500 packets in %v, at most %d bytes per %v", last, maxWindowBytes(packets), sendLimiterWindow)
+}
+
+// TestSendLimiterNoIdleCredit は送信の無い時間が続いても、待たずに送れる量がバースト（上限の20ms分）を超えて貯まらないことを検証する
+func TestSendLimiterNoIdleCredit(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := newManualClock(start)
+	limiter := NewSendRateLimiter(capBps)
+	limiter.SetClock(clock)
+
+	burst(limiter, clock, start, 10)
+	clock.Advance(5 * time.Second)
+	immediate := 0
+	for limiter.Reserve(packetSize) == 0 {
+		immediate++
+	}
+	// 20ms分は2500バイトのため、待たずに送れるのは2パケット
+	if immediate != 2 {
+		t.Fatalf("%d packets sent without waiting after 5s idle, want 2", immediate)
+	}
+}
+
+// TestSendLimiterStats は待たせたパケットの数、バイト数と待ち時間を数えることを検証する
+func TestSendLimiterStats(t *testing.T) {
+	start := time.Unix(0, 0)
+	clock := newManualClock(start)
+	limiter := NewSendRateLimiter(capBps)
+	limiter.SetClock(clock)
+
+	packets := burst(limiter, clock, start, 100)
+	count, bytes, waited := limiter.Stats()
+	if count != 98 || bytes != 98*packetSize {
+		t.Fatalf("%d packets (%d bytes) limited, want 98 (%d bytes)", count, bytes, 98*packetSize)
+	}
+	if last := packets[len(packets)-1].at; waited != last {
+		t.Fatalf("waited %v in total, want %v", waited, last)
+	}
+}
+
+// sendLimiterPacket は12バイトのヘッダーと988バイトのペイロードで、ちょうど1000バイトのパケット
+func sendLimiterPacket() *rtp.Packet {
+	return &rtp.Packet{Header: rtp.Header{Version: 2}, Payload: make([]byte, 988)}
+}
+
+// TestSendLimiterWrap はWrapした書き込み関数がclockで予約した時間だけ待ってから書き込み、上限より速く送らないことを検証する
+// 上限を指定しない場合は書き込み関数をそのまま使う
+func TestSendLimiterWrap(t *testing.T) {
+	if limiter := NewSendRateLimiter(0); limiter != nil {
+		t.Fatalf("limiter created without a cap")
+	}
+	var unlimited *SendRateLimiter
+	writes := 0
+	write := unlimited.Wrap(func(*rtp.Packet) error {
+		writes++
+		return nil
+	})
+	if err := write(&rtp.Packet{}); err != nil || writes != 1 {
+		t.Fatalf("unlimited write: err=%v, writes=%d", err, writes)
+	}
+	unlimited.Stop()
+
+	// 400kbps（50000バイト/秒）では1000バイトのパケットを20msごとに送る
+	// 最初のバースト（1500バイト）で1つ目は待たず、2つ目は残りの500バイト分の10msだけ待つ
+	start := time.Unix(0, 0)
+	clock := newManualClock(start)
+	limiter := NewSendRateLimiter(400_000)
+	limiter.SetClock(clock)
+	var writtenAt []time.Duration
+	write = limiter.Wrap(func(packet *rtp.Packet) error {
+		writtenAt = append(writtenAt, clock.Now().Sub(start))
+		return nil
+	})
+	const packets = 25
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < packets; i++ {
+			if err := write(sendLimiterPacket()); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	for i := 1; i < packets; i++ {
+		want := 20 * time.Millisecond
+		if i == 1 {
+			want = 10 * time.Millisecond
+		}
+		if got := clock.waitTimer(t); got != want {
+			t.Fatalf("packet %d: waiting %v, want %v", i, got, want)
+		}
+		clock.Advance(want)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	for i, at := range writtenAt {
+		want := time.Duration(0)
+		if i > 0 {
+			want = 10*time.Millisecond + time.Duration(i-1)*20*time.Millisecond
+		}
+		if at != want {
+			t.Fatalf("packet %d written at %v, want %v", i, at, want)
+		}
+	}
+	if len(writtenAt) != packets {
+		t.Fatalf("%d packets written, want %d", len(writtenAt), packets)
+	}
+}
+
+// TestSendLimiterStop はStopが送信を待っている書き込みを打ち切り、以後の書き込みも止めることを検証する
+func TestSendLimiterStop(t *testing.T) {
+	clock := newManualClock(time.Unix(0, 0))
+	limiter := NewSendRateLimiter(400_000)
+	limiter.SetClock(clock)
+	writes := 0
+	write := limiter.Wrap(func(*rtp.Packet) error {
+		writes++
+		return nil
+	})
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < 2; i++ {
+			if err := write(sendLimiterPacket()); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	// 2つ目のパケットが待ち始めたところで、時計を進めずに止める
+	clock.waitTimer(t)
+	limiter.Stop()
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrSendLimiterStopped) {
+			t.Fatalf("waiting write returned %v, want ErrSendLimiterStopped", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop did not interrupt the waiting write")
+	}
+	if writes != 1 {
+		t.Fatalf("%d packets written, want 1", writes)
+	}
+
+	limiter.Stop()
+	if err := write(sendLimiterPacket()); !errors.Is(err, ErrSendLimiterStopped) || writes != 1 {
+		t.Fatalf("write after Stop: err=%v, writes=%d", err, writes)
+	}
+}
@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+)
+
+// settingEngineField はSettingEngineの非公開フィールドをpathの順にたどって返す
+// pionのSettingEngineは設定値の取得APIを持たないため、読み出しにだけreflectを使う
+func settingEngineField(settingEngine webrtc.SettingEngine, path ...string) reflect.Value {
+	v := reflect.ValueOf(settingEngine)
+	for _, name := range path {
+		v = v.FieldByName(name)
+	}
+	return v
+}
+
+// settingEngineNetType はSettingEngineに設定されたtransport.Netの型を返す（未設定時はnil）
+func settingEngineNetType(settingEngine webrtc.SettingEngine) reflect.Type {
+	v := settingEngineField(settingEngine, "net")
+	if v.IsNil() {
+		return nil
+	}
+	return v.Elem().Type()
+}
+
+// TestSettingEngineMDNS は --disable-mdns でSettingEngineのmDNSモードが無効になり、未指定時はpionのデフォルトのままであることを検証する
+func TestSettingEngineMDNS(t *testing.T) {
+	defer func() { DisableMDNS = false }()
+
+	DisableMDNS = false
+	if mode := settingEngineField(NewSettingEngine(), "candidates", "MulticastDNSMode").Uint(); mode != 0 {
+		t.Fatalf("mDNS mode %d without --disable-mdns, want unset", mode)
+	}
+	DisableMDNS = true
+	if mode := settingEngineField(NewSettingEngine(), "candidates", "MulticastDNSMode").Uint(); mode != uint64(ice.MulticastDNSModeDisabled) {
+		t.Fatalf("mDNS mode %d with --disable-mdns, want %d (disabled)", mode, ice.MulticastDNSModeDisabled)
+	}
+}
+
+// TestSettingEngineNet は --dscp と --udp-recv-buffer の指定に応じてソケットを作るtransport.Netが重なることを検証する
+func TestSettingEngineNet(t *testing.T) {
+	defer func() { DSCPCodepoint, UDPRecvBuffer = 0, 0 }()
+
+	cases := []struct {
+		dscp, recvBuffer int
+		want             reflect.Type
+	}{
+		{0, 0, nil},
+		{46, 0, reflect.TypeOf(&dscpNet{})},
+		{0, 8192, reflect.TypeOf(&recvBufferNet{})},
+		{46, 8192, reflect.TypeOf(&recvBufferNet{})},
+	}
+	for _, c := range cases {
+		DSCPCodepoint, UDPRecvBuffer = c.dscp, c.recvBuffer
+		settingEngine := NewSettingEngine()
+		if got := settingEngineNetType(settingEngine); got != c.want {
+			t.Fatalf("--dscp %d --udp-recv-buffer %d: net %v, want %v", c.dscp, c.recvBuffer, got, c.want)
+		}
+		// 併用時はDSCPを設定するNetの上に受信バッファのNetを重ねる
+		if c.dscp > 0 && c.recvBuffer > 0 {
+			base := settingEngineField(settingEngine, "net").Elem().Elem().FieldByName("Net").Elem().Type()
+			if base != reflect.TypeOf(&dscpNet{}) {
+				t.Fatalf("receive buffer net wraps %v, want the DSCP net", base)
+			}
+		}
+	}
+}
+
+// TestSettingEngineCandidates は --disable-mdns 指定時にCreatePeerConnectionのホスト候補が.local名ではなく実IPになることを検証する
+func TestSettingEngineCandidates(t *testing.T) {
+	DisableMDNS = true
+	defer func() { DisableMDNS = false }()
+
+	peerConnection, err := iceServersNewSubscriber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerConnection.Close()
+
+	candidates := make(chan *webrtc.ICECandidate, 16)
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate != nil && candidate.Typ == webrtc.ICECandidateTypeHost {
+			candidates <- candidate
+		}
+	})
+	offer, err := peerConnection.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := peerConnection.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case candidate := <-candidates:
+		if strings.HasSuffix(candidate.Address, ".local") {
+			t.Fatalf("host candidate %s uses an mDNS name", candidate.Address)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no host candidate gathered")
+	}
+}
@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// simulcastOfferSDP はaudioとvideoのm-lineを持つpion形式（CRLF区切り）のofferを作る
+func simulcastOfferSDP(videoLines ...string) string {
+	lines := []string{
+		"v=0",
+		"o=- 1 1 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"m=audio 9 UDP/TLS/RTP/SAVPF 111",
+		"c=IN IP4 0.0.0.0",
+		"a=rtpmap:111 opus/48000/2",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+	}
+	lines = append(lines, videoLines...)
+	lines = append(lines, "a=rtpmap:96 VP8/90000")
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// TestSimulcastAddVideoTIAS はb=TIASが映像m-lineのc=行の直後にだけ追加され、既存のTIASを置き換えることを検証する
+func TestSimulcastAddVideoTIAS(t *testing.T) {
+	cases := []struct {
+		name  string
+		offer string
+		want  string
+	}{
+		{
+			"after c=",
+			simulcastOfferSDP("c=IN IP4 0.0.0.0"),
+			simulcastOfferSDP("c=IN IP4 0.0.0.0", "b=TIAS:1500000"),
+		},
+		{
+			"without c=",
+			simulcastOfferSDP(),
+			simulcastOfferSDP("b=TIAS:1500000"),
+		},
+		{
+			"after i= and c=",
+			simulcastOfferSDP("i=camera", "c=IN IP4 0.0.0.0"),
+			simulcastOfferSDP("i=camera", "c=IN IP4 0.0.0.0", "b=TIAS:1500000"),
+		},
+		{
+			"replaces existing TIAS",
+			simulcastOfferSDP("c=IN IP4 0.0.0.0", "b=TIAS:500000"),
+			simulcastOfferSDP("c=IN IP4 0.0.0.0", "b=TIAS:1500000"),
+		},
+	}
+	for _, c := range cases {
+		if got := addVideoTIAS(c.offer, 1500000); got != c.want {
+			t.Fatalf("%s:\ngot:\n%s\nwant:\n%s", c.name, got, c.want)
+		}
+	}
+
+	// 映像m-lineが最後の行で終わる場合も末尾に追加する
+	offer := "v=0\r\nm=video 9 UDP/TLS/RTP/SAVPF 96\r\n"
+	if got, want := addVideoTIAS(offer, 1000), offer+"b=TIAS:1000\r\n"; got != want {
+		t.Fatalf("trailing video m-line: got %q, want %q", got, want)
+	}
+	// 音声のm-lineには追加しない
+	audioOnly := "v=0\r\nm=audio 9 UDP/TLS/RTP/SAVPF 111\r\nc=IN IP4 0.0.0.0\r\n"
+	if got := addVideoTIAS(audioOnly, 1000); got != audioOnly {
+		t.Fatalf("TIAS added to an offer without video: %q", got)
+	}
+}
+
+// TestSimulcastParseRIDs は --simulcast のRID一覧の解析と検証を確認する
+func TestSimulcastParseRIDs(t *testing.T) {
+	cases := []struct {
+		spec string
+		want []string
+	}{
+		{"", nil},
+		{"low,high", []string{"low", "high"}},
+		{" q , h , f ", []string{"q", "h", "f"}},
+		{"layer-0,layer_1", []string{"layer-0", "layer_1"}},
+	}
+	for _, c := range cases {
+		got, err := parseSimulcastRIDs(c.spec)
+		if err != nil {
+			t.Fatalf("%q: %v", c.spec, err)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("%q: got %q, want %q", c.spec, got, c.want)
+		}
+	}
+
+	for _, spec := range []string{
+		"high",      // 1レイヤー
+		"a,b,c,d",   // maxSimulcastLayersを超える
+		"low,,high", // 空のRID
+		"low,low",   // 重複
+		"low,hi gh", // 空白を含む
+		"low,high!", // 使用できない文字
+		"low,高画質",   // ASCII以外
+	} {
+		if _, err := parseSimulcastRIDs(spec); err == nil {
+			t.Fatalf("%q was accepted", spec)
+		}
+	}
+}
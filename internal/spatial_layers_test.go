@@ -0,0 +1,336 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	pictures            = 6
+	spatialLayers       = 3
+	packetsPerLyr       = 2
+	spatialLayersTsStep = 3000
+)
+
+// layerSizes はL3T1の空間レイヤーごとの解像度
+var layerSizes = [spatialLayers][2]int{{320, 180}, {640, 360}, {1280, 720}}
+
+// layerData はピクチャ番号と空間レイヤーIDを末尾に埋め込んだレイヤーフレームを作る
+// 末尾のバイトはsuperframeのマーカー（0xC0-0xDF）と重ならない値にする
+func layerData(picture, sid int) []byte {
+	data := make([]byte, 16+8*sid)
+	data[0] = 0x82 // frame_marker
+	data[len(data)-2] = byte(picture)
+	data[len(data)-1] = byte(sid)
+	return data
+}
+
+// scalabilityStructure はN_S=3、Y=1、G=0のSSを作る
+func scalabilityStructure() []byte {
+	ss := []byte{byte(spatialLayers-1)<<5 | 0x10}
+	for _, size := range layerSizes {
+		ss = append(ss, byte(size[0]>>8), byte(size[0]), byte(size[1]>>8), byte(size[1]))
+	}
+	return ss
+}
+
+// spatialLayersVP9Descriptor はPictureID（15bit）とレイヤーインデックス（非flexibleモード）を含むVP9ペイロードデスクリプタを作る
+// 先頭のピクチャはキーフレームで、基本レイヤーの先頭パケットにSSを付ける
+// 上位の空間レイヤーは常に下位レイヤーを参照する（D=1）
+func spatialLayersVP9Descriptor(picture, sid int, start, end bool) []byte {
+	first := byte(0x80 | 0x20) // I, L
+	if picture > 0 {
+		first |= 0x40 // P: インターフレーム
+	}
+	if start {
+		first |= 0x08
+	}
+	if end {
+		first |= 0x04
+	}
+	withSS := picture == 0 && sid == 0 && start
+	if withSS {
+		first |= 0x02
+	}
+	layer := byte(sid) << 1 // TID(3) U SID(3) D
+	if sid > 0 {
+		layer |= 0x01
+	}
+	descriptor := []byte{first, 0x80 | byte(picture>>8), byte(picture), layer, byte(picture)}
+	if withSS {
+		descriptor = append(descriptor, scalabilityStructure()...)
+	}
+	return descriptor
+}
+
+// spatialLayersMakePackets はL3T1のピクチャを空間レイヤーごとに2パケットずつに分割したRTPパケット列を作る
+// マーカービットはピクチャの最上位レイヤーの最後のパケットにのみ付ける
+func spatialLayersMakePackets() []*rtp.Packet {
+	var packets []*rtp.Packet
+	seq := uint16(1000)
+	for i := 0; i < pictures; i++ {
+		for sid := 0; sid < spatialLayers; sid++ {
+			data := layerData(i, sid)
+			half := len(data) / 2
+			for p := 0; p < packetsPerLyr; p++ {
+				start, end := p == 0, p == packetsPerLyr-1
+				packets = append(packets, &rtp.Packet{
+					Header: rtp.Header{
+						Version:        2,
+						SequenceNumber: seq,
+						Timestamp:      uint32(90000 + i*spatialLayersTsStep),
+						Marker:         end && sid == spatialLayers-1,
+					},
+					Payload: append(spatialLayersVP9Descriptor(i, sid, start, end), data[half*p:half*(p+1)]...),
+				})
+				seq++
+			}
+		}
+	}
+	return packets
+}
+
+// splitSuperframe はsuperframeのインデックス（VP9 Bitstream Specification Annex B）を読んで個々のフレームに分割する
+func splitSuperframe(data []byte) ([][]byte, error) {
+	marker := data[len(data)-1]
+	if marker&0xE0 != 0xC0 {
+		return [][]byte{data}, nil
+	}
+	frames := int(marker&0x07) + 1
+	mag := int(marker>>3&0x03) + 1
+	indexSize := 2 + mag*frames
+	if len(data) < indexSize || data[len(data)-indexSize] != marker {
+		return nil, fmt.Errorf("superframe index markers do not match")
+	}
+	index := data[len(data)-indexSize+1:]
+	var result [][]byte
+	offset := 0
+	for i := 0; i < frames; i++ {
+		size := 0
+		for b := 0; b < mag; b++ {
+			size |= int(index[i*mag+b]) << (8 * b)
+		}
+		if offset+size > len(data)-indexSize {
+			return nil, fmt.Errorf("superframe frame %d overruns the data", i)
+		}
+		result = append(result, data[offset:offset+size])
+		offset += size
+	}
+	if offset != len(data)-indexSize {
+		return nil, fmt.Errorf("superframe has %d trailing bytes", len(data)-indexSize-offset)
+	}
+	return result, nil
+}
+
+// spatialLayersReceive はspatialLayerを設定したRTPプロセッサにパケットを渡し、出力されたフレームを返す
+func spatialLayersReceive(spatialLayer int, packets []*rtp.Packet) ([][]byte, error) {
+	SpatialLayer = spatialLayer
+	defer func() { SpatialLayer = -1 }()
+
+	processor := NewDefaultRTPProcessor()
+	var got [][]byte
+	for _, packet := range packets {
+		out, err := processor.ProcessRTPPacket(packet, "vp9")
+		if err != nil {
+			return nil, err
+		}
+		got = append(got, out...)
+	}
+	return got, nil
+}
+
+// describe はフレームを「ピクチャ番号:空間レイヤーID」の列に変換する
+func describe(frames [][]byte) ([]string, error) {
+	var result []string
+	for _, frame := range frames {
+		layers, err := splitSuperframe(frame)
+		if err != nil {
+			return nil, err
+		}
+		entry := ""
+		for i, layer := range layers {
+			if i > 0 {
+				entry += "+"
+			}
+			entry += fmt.Sprintf("%d:%d", layer[len(layer)-2], layer[len(layer)-1])
+		}
+		result = append(result, entry)
+	}
+	return result, nil
+}
+
+// expectPictures はピクチャごとに空間レイヤー0..maxLayerのsuperframeが1つずつ出力されることを検証する
+func expectPictures(spatialLayer int) error {
+	frames, err := spatialLayersReceive(spatialLayer, spatialLayersMakePackets())
+	if err != nil {
+		return err
+	}
+	got, err := describe(frames)
+	if err != nil {
+		return err
+	}
+	var want []string
+	for i := 0; i < pictures; i++ {
+		entry := ""
+		for sid := 0; sid <= spatialLayer; sid++ {
+			if sid > 0 {
+				entry += "+"
+			}
+			entry += fmt.Sprintf("%d:%d", i, sid)
+		}
+		want = append(want, entry)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		return fmt.Errorf("frames %v, want %v", got, want)
+	}
+	// 各レイヤーフレームはデスクリプタを除いて元のデータと一致する
+	for i, frame := range frames {
+		layers, _ := splitSuperframe(frame)
+		for sid, layer := range layers {
+			if fmt.Sprint(layer) != fmt.Sprint(layerData(i, sid)) {
+				return fmt.Errorf("picture %d layer %d: bitstream does not match", i, sid)
+			}
+		}
+	}
+	return nil
+}
+
+// TestSpatialLayersAllLayers は--spatial-layer未指定時に、従来どおりレイヤーフレームを個別に出力することを検証する
+func TestSpatialLayersAllLayers(t *testing.T) {
+	frames, err := spatialLayersReceive(-1, spatialLayersMakePackets())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := describe(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != pictures*spatialLayers {
+		t.Fatalf("got %d frames, want %d", len(got), pictures*spatialLayers)
+	}
+	for i, entry := range got {
+		if want := fmt.Sprintf("%d:%d", i/spatialLayers, i%spatialLayers); entry != want {
+			t.Fatalf("frame %d is %s, want %s", i, entry, want)
+		}
+	}
+}
+
+// TestSpatialLayersLayerLoss は選択したレイヤー以下のパケットロスでピクチャ全体が破棄され、
+// 破棄したレイヤーのロスは影響しないことを検証する
+func TestSpatialLayersLayerLoss(t *testing.T) {
+	packetsPerPicture := spatialLayers * packetsPerLyr
+	for _, tc := range []struct {
+		name    string
+		picture int
+		sid     int
+		packet  int
+		want    []string
+	}{
+		// ピクチャ2の基本レイヤーの2番目のパケット
+		{"base layer", 2, 0, 1, []string{"0:0+0:1", "1:0+1:1", "3:0+3:1", "4:0+4:1", "5:0+5:1"}},
+		// ピクチャ3のレイヤー1の先頭パケット（基本レイヤーが揃っていてもピクチャごと破棄）
+		{"selected layer start", 3, 1, 0, []string{"0:0+0:1", "1:0+1:1", "2:0+2:1", "4:0+4:1", "5:0+5:1"}},
+		// ピクチャ4のレイヤー2（破棄対象）
+		{"dropped layer", 4, 2, 1, []string{"0:0+0:1", "1:0+1:1", "2:0+2:1", "3:0+3:1", "4:0+4:1", "5:0+5:1"}},
+	} {
+		packets := spatialLayersMakePackets()
+		lost := tc.picture*packetsPerPicture + tc.sid*packetsPerLyr + tc.packet
+		packets = append(packets[:lost], packets[lost+1:]...)
+
+		frames, err := spatialLayersReceive(1, packets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := describe(frames)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Fatalf("%s loss: frames %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+// TestSpatialLayersNoSpatialLayers は空間レイヤー情報を持たないストリームが制限の影響を受けないことを検証する
+func TestSpatialLayersNoSpatialLayers(t *testing.T) {
+	var packets []*rtp.Packet
+	for i := 0; i < pictures; i++ {
+		first := byte(0x08 | 0x04) // B, E
+		if i > 0 {
+			first |= 0x40
+		}
+		packets = append(packets, &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(90000 + i*spatialLayersTsStep), Marker: true},
+			Payload: append([]byte{first}, layerData(i, 0)...),
+		})
+	}
+	frames, err := spatialLayersReceive(0, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := describe(frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != pictures {
+		t.Fatalf("got %d frames %v, want %d", len(got), got, pictures)
+	}
+}
+
+// TestSpatialLayersDescriptorParsing はSS付きのVP9ペイロードデスクリプタの解析を検証する
+func TestSpatialLayersDescriptorParsing(t *testing.T) {
+	d, err := ParseVP9PayloadDescriptor(spatialLayersVP9Descriptor(0, 0, true, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.SS == nil || d.SS.SpatialLayers != spatialLayers {
+		t.Fatalf("SS not parsed: %+v", d.SS)
+	}
+	for sid, size := range layerSizes {
+		if d.SS.Widths[sid] != size[0] || d.SS.Heights[sid] != size[1] {
+			t.Fatalf("layer %d: %dx%d, want %dx%d", sid, d.SS.Widths[sid], d.SS.Heights[sid], size[0], size[1])
+		}
+	}
+	if want := 5 + 1 + 4*spatialLayers; d.HeaderSize != want {
+		t.Fatalf("HeaderSize=%d, want %d", d.HeaderSize, want)
+	}
+	if !d.Start || d.End || d.InterPicture || d.SID != 0 {
+		t.Fatalf("unexpected flags: %+v", d)
+	}
+
+	d, err = ParseVP9PayloadDescriptor(spatialLayersVP9Descriptor(3, 2, false, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.SID != 2 || !d.InterLayer || !d.InterPicture || d.Start || !d.End || d.SS != nil || d.HeaderSize != 5 {
+		t.Fatalf("unexpected layer descriptor: %+v", d)
+	}
+
+	// SSにピクチャグループ（N_G=2、R=1と0）を含む場合
+	withGroups := []byte{0x0A, 0x08, 0x02, 0x04, 0x01, 0x00}
+	d, err = ParseVP9PayloadDescriptor(withGroups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.SS == nil || d.SS.SpatialLayers != 1 || d.SS.Widths != nil || d.HeaderSize != len(withGroups) {
+		t.Fatalf("SS with groups: HeaderSize=%d SS=%+v", d.HeaderSize, d.SS)
+	}
+
+	truncated := spatialLayersVP9Descriptor(0, 0, true, false)
+	if _, err := ParseVP9PayloadDescriptor(truncated[:len(truncated)-1]); err == nil {
+		t.Fatalf("truncated SS accepted")
+	}
+}
+
+// TestSpatialLayersSelected はL3T1の各 --spatial-layer で受信するピクチャを検証する
+func TestSpatialLayersSelected(t *testing.T) {
+	for _, layer := range []int{0, 1, 2} {
+		t.Run(fmt.Sprintf("layer %d", layer), func(t *testing.T) {
+			if err := expectPictures(layer); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
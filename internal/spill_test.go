@@ -0,0 +1,208 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const (
+	queueCapacity = 4
+	frameSize     = 1000
+)
+
+// readSpillDir はdirのspillファイルのフレームをファイル番号順に読む
+func readSpillDir(dir string) ([][]*Frame, error) {
+	var files [][]*Frame
+	for i := 0; ; i++ {
+		data, err := os.ReadFile(SpillFilePath(dir, i))
+		if os.IsNotExist(err) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		frames, err := ReadSpillFile(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("spill file %d: %v", i, err)
+		}
+		files = append(files, frames)
+	}
+}
+
+// dirSize はdirのファイルの合計サイズを返す
+func dirSize(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+// frame はPTSがtimestampMsで、データの先頭にPTSを入れた映像フレームを作る
+func frame(timestampMs int64) *Frame {
+	data := make([]byte, frameSize)
+	data[0], data[1] = byte(timestampMs>>8), byte(timestampMs)
+	return &Frame{Type: FrameTypeVideo, Data: data, TimestampMs: timestampMs, IsKeyframe: timestampMs%10 == 0}
+}
+
+// TestSpillBackpressure はwhip-goのキューと同じく、満杯のキューの先頭を破棄して入れる入力に対して
+// 送信が追いつかない間に破棄したフレームが全て書き出され、送信したフレームと合わせて入力の全てになることを検証する
+func TestSpillBackpressure(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_spill_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spiller, err := NewFrameSpiller(dir, 64<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 送信側は1フレームに5msかかり、入力は1msごとに届く
+	const total = 200
+	queue := make(chan *Frame, queueCapacity)
+	sent := make(map[int64]bool)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for f := range queue {
+			sent[f.TimestampMs] = true
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	for i := int64(0); i < total; i++ {
+		f := frame(i)
+		for {
+			select {
+			case queue <- f:
+			default:
+				select {
+				case dropped := <-queue:
+					spiller.Spill(dropped)
+				default:
+				}
+				continue
+			}
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(queue)
+	<-done
+	if err := spiller.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := readSpillDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spilled := make(map[int64]bool)
+	for _, frames := range files {
+		for _, f := range frames {
+			if len(f.Data) != frameSize || int64(f.Data[0])<<8|int64(f.Data[1]) != f.TimestampMs || f.IsKeyframe != (f.TimestampMs%10 == 0) {
+				t.Fatalf("spilled frame at %dms does not match the dropped frame", f.TimestampMs)
+			}
+			spilled[f.TimestampMs] = true
+		}
+	}
+	frames, dataBytes, skipped := spiller.Stats()
+	if frames == 0 || frames != int64(len(spilled)) || dataBytes != frames*frameSize || skipped != 0 {
+		t.Fatalf("stats frames=%d bytes=%d skipped=%d for %d spilled frames", frames, dataBytes, skipped, len(spilled))
+	}
+	for i := int64(0); i < total; i++ {
+		if sent[i] == spilled[i] {
+			t.Fatalf("frame %dms: sent=%v spilled=%v, want exactly one", i, sent[i], spilled[i])
+		}
+	}
+	t.Logf("sent %d, spilled %d of %d frames", len(sent), len(spilled), total)
+}
+
+// TestSpillRingBound は上限を超えて書き出すと古いファイルから上書きし、ディレクトリの合計が上限以下で
+// 最新のフレームが残ることを検証する
+// 前回の実行で残ったリングのファイルも消してから始める
+func TestSpillRingBound(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_spill_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	stale := SpillFilePath(dir, 3)
+	if err := os.WriteFile(stale, make([]byte, 1<<20), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	const maxSize = 1 << 20
+	spiller, err := NewFrameSpiller(dir, maxSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Fatalf("stale spill file from a previous run was not removed")
+	}
+	const total = 3000 // 約3MB
+	for i := int64(0); i < total; i++ {
+		spiller.Spill(frame(i))
+	}
+	if err := spiller.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := dirSize(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size > maxSize {
+		t.Fatalf("spill directory holds %d bytes, limit is %d", size, maxSize)
+	}
+	files, err := readSpillDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 4 {
+		t.Fatalf("got %d spill files, want a ring of 4", len(files))
+	}
+	var latest int64 = -1
+	for _, frames := range files {
+		for _, f := range frames {
+			latest = max(latest, f.TimestampMs)
+		}
+	}
+	if latest != total-1 {
+		t.Fatalf("latest spilled frame is %dms, want %dms", latest, total-1)
+	}
+	if frames, _, _ := spiller.Stats(); frames != total {
+		t.Fatalf("counted %d spilled frames, want %d", frames, total)
+	}
+}
+
+// TestSpillTooLarge は1ファイルに収まらないフレームを書き出さずに数えることを検証する
+func TestSpillTooLarge(t *testing.T) {
+	dir, err := os.MkdirTemp("", "test_spill_*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	spiller, err := NewFrameSpiller(filepath.Join(dir, "nested"), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spiller.Close()
+	spiller.Spill(&Frame{Type: FrameTypeVideo, Data: make([]byte, 1<<20)})
+	spiller.Spill(frame(1))
+	if frames, _, skipped := spiller.Stats(); frames != 1 || skipped != 1 {
+		t.Fatalf("counted frames=%d skipped=%d, want 1 and 1", frames, skipped)
+	}
+}
@@ -0,0 +1,227 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/pion/webrtc/v4/pkg/media/oggreader"
+)
+
+const (
+	splitOutputWidth       = 640 // RawVideoMKVWriterは640x360未満のキーフレームをプレビューとして読み飛ばす
+	splitOutputHeight      = 360
+	splitOutputVideoFrames = 30
+	splitOutputVideoTSStep = 3000 // 90kHz / 30fps
+	splitOutputAudioTSStep = 960  // 48kHz x 20ms
+	splitOutputAudioFrames = 50   // 1秒分
+)
+
+// splitOutputWriteSession はsinkのセッション1回分に、VP8映像とOpus音声をRTP timestamp baseから書き込む
+func splitOutputWriteSession(sink OutputSink, base uint32) error {
+	encoder, err := NewVP8Encoder(splitOutputWidth, splitOutputHeight, "RGBA", 500)
+	if err != nil {
+		return fmt.Errorf("failed to create encoder: %v", err)
+	}
+	defer encoder.Close()
+
+	session := sink.Session(SinkOptions{})
+	if setter, ok := session.(VideoCodecSetter); ok {
+		setter.SetVideoCodec("vp8")
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- session.Run() }()
+
+	rgba := make([]byte, splitOutputWidth*splitOutputHeight*4)
+	audioIndex := 0
+	for i := 0; i < splitOutputVideoFrames; i++ {
+		for j := range rgba {
+			rgba[j] = byte(i + j)
+		}
+		encoded, keyframe, err := encoder.Encode(rgba)
+		if err != nil {
+			return fmt.Errorf("encode error at frame %d: %v", i, err)
+		}
+		if err := session.WriteVideoFrame(encoded, base+uint32(i*splitOutputVideoTSStep), keyframe); err != nil {
+			return fmt.Errorf("failed to write video frame %d: %v", i, err)
+		}
+		for audioIndex < splitOutputAudioFrames && audioIndex*splitOutputAudioTSStep*90000/48000 <= i*splitOutputVideoTSStep {
+			if err := session.WriteAudioFrame(opusSilence, base+uint32(audioIndex*splitOutputAudioTSStep)); err != nil {
+				return fmt.Errorf("failed to write audio frame %d: %v", audioIndex, err)
+			}
+			audioIndex++
+		}
+	}
+	for ; audioIndex < splitOutputAudioFrames; audioIndex++ {
+		if err := session.WriteAudioFrame(opusSilence, base+uint32(audioIndex*splitOutputAudioTSStep)); err != nil {
+			return fmt.Errorf("failed to write audio frame %d: %v", audioIndex, err)
+		}
+	}
+
+	if err := session.Close(); err != nil {
+		return fmt.Errorf("failed to close session: %v", err)
+	}
+	return <-runErr
+}
+
+// readOgg はOgg Opusを読み、OpusHeadのサンプリング周波数と音声ページのグラニュール位置を返す
+func readOgg(data []byte) (uint32, []uint64, error) {
+	reader, header, err := oggreader.NewWith(bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, fmt.Errorf("not an Ogg Opus stream: %v", err)
+	}
+	var granules []uint64
+	for {
+		payload, page, err := reader.ParseNextPage()
+		if errors.Is(err, io.EOF) {
+			return header.SampleRate, granules, nil
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if _, ok := page.HeaderType(payload); ok {
+			continue // OpusTags
+		}
+		granules = append(granules, page.GranulePosition)
+	}
+}
+
+// TestSplitOutputFormats は拡張子から映像と音声の出力形式を決め、格納できないコーデックの組み合わせを拒否することを検証する
+func TestSplitOutputFormats(t *testing.T) {
+	valid := []struct {
+		path  string
+		video bool
+		want  string
+	}{
+		{"out.mkv", true, OutputFormatMKV},
+		{"OUT.IVF", true, OutputFormatIVF},
+		{"out.ogg", false, OutputFormatOgg},
+		{"out.opus", false, OutputFormatOgg},
+		{"out.mka", false, OutputFormatMKV},
+	}
+	for _, v := range valid {
+		got, err := SplitOutputFormat(v.path, v.video)
+		if err != nil || got != v.want {
+			t.Fatalf("%s (video=%v): got %q, %v, want %q", v.path, v.video, got, err, v.want)
+		}
+	}
+	invalid := []struct {
+		path  string
+		video bool
+	}{
+		{"out.ogg", true},  // Oggは音声のみ
+		{"out.opus", true}, // Oggは音声のみ
+		{"out.ivf", false}, // IVFは映像のみ
+		{"out.mp4", true},
+		{"out.wav", false},
+		{"out", false},
+	}
+	for _, v := range invalid {
+		if _, err := SplitOutputFormat(v.path, v.video); err == nil {
+			t.Fatalf("%s accepted (video=%v)", v.path, v.video)
+		}
+	}
+}
+
+// TestSplitOutputIVFAndOgg は映像をIVF、音声をOggに同時に書き込み、それぞれ単独で読めることを検証する
+func TestSplitOutputIVFAndOgg(t *testing.T) {
+	var video, audio bytes.Buffer
+	sink, err := NewSplitOutputSink(OutputFormatIVF, &video, OutputFormatOgg, &audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := splitOutputWriteSession(sink, 12345); err != nil {
+		t.Fatal(err)
+	}
+
+	data := video.Bytes()
+	if len(data) < 32 || string(data[0:4]) != "DKIF" || string(data[8:12]) != "VP80" {
+		t.Fatalf("video output is not a VP8 IVF file")
+	}
+	if len(data) <= 32 {
+		t.Fatalf("no video frames written")
+	}
+
+	rate, granules, err := readOgg(audio.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rate != 48000 {
+		t.Fatalf("OpusHead sample rate %d, want 48000", rate)
+	}
+	if len(granules) != splitOutputAudioFrames {
+		t.Fatalf("got %d audio pages, want %d", len(granules), splitOutputAudioFrames)
+	}
+	for i := 1; i < len(granules); i++ {
+		if granules[i]-granules[i-1] != splitOutputAudioTSStep {
+			t.Fatalf("page %d: granule position advanced by %d, want %d", i, granules[i]-granules[i-1], splitOutputAudioTSStep)
+		}
+	}
+}
+
+// TestSplitOutputMKVVideoAndAudio は映像と音声をそれぞれMKVに書き込み、映像のみ・音声のみのファイルになることを検証する
+func TestSplitOutputMKVVideoAndAudio(t *testing.T) {
+	var video, audio bytes.Buffer
+	sink, err := NewSplitOutputSink(OutputFormatMKV, &video, OutputFormatMKV, &audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := splitOutputWriteSession(sink, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := ValidateMKV(bytes.NewReader(video.Bytes()))
+	if err != nil {
+		t.Fatalf("video file: %v", err)
+	}
+	if report.VideoCodec != "V_UNCOMPRESSED" || report.Video.Frames == 0 {
+		t.Fatalf("video file: got codec %q with %d frames", report.VideoCodec, report.Video.Frames)
+	}
+	if report.AudioCodec != "" || report.Audio.Frames != 0 {
+		t.Fatalf("video file has audio track %q with %d frames", report.AudioCodec, report.Audio.Frames)
+	}
+
+	report, err = ValidateMKV(bytes.NewReader(audio.Bytes()))
+	if err != nil {
+		t.Fatalf("audio file: %v", err)
+	}
+	if report.AudioCodec != "A_OPUS" || report.Audio.Frames != splitOutputAudioFrames {
+		t.Fatalf("audio file: got codec %q with %d frames, want A_OPUS with %d", report.AudioCodec, report.Audio.Frames, splitOutputAudioFrames)
+	}
+	if report.VideoCodec != "" || report.Video.Frames != 0 {
+		t.Fatalf("audio file has video track %q with %d frames", report.VideoCodec, report.Video.Frames)
+	}
+}
+
+// TestSplitOutputOggReconnect は再接続で2回目のセッションになっても、Oggのグラニュール位置が戻らずに続くことを検証する
+func TestSplitOutputOggReconnect(t *testing.T) {
+	var audio bytes.Buffer
+	sink, err := NewSplitOutputSink("", nil, OutputFormatOgg, &audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := splitOutputWriteSession(sink, 4000000000); err != nil {
+		t.Fatal(err)
+	}
+	// 再接続後の送信側は別のRTP timestampから始まる
+	if err := splitOutputWriteSession(sink, 1000); err != nil {
+		t.Fatal(err)
+	}
+	_, granules, err := readOgg(audio.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(granules) != 2*splitOutputAudioFrames {
+		t.Fatalf("got %d audio pages from two sessions, want %d", len(granules), 2*splitOutputAudioFrames)
+	}
+	for i := 1; i < len(granules); i++ {
+		if granules[i] <= granules[i-1] || granules[i]-granules[i-1] > 2*splitOutputAudioTSStep {
+			t.Fatalf("page %d: granule position %d after %d", i, granules[i], granules[i-1])
+		}
+	}
+	if err := sink.Rotate(&bytes.Buffer{}); err == nil {
+		t.Fatalf("Rotate succeeded on separate outputs")
+	}
+}
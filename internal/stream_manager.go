@@ -1,22 +1,33 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"sync"
 	"time"
 
+	"github.com/pion/ice/v4"
 	"github.com/pion/interceptor"
 	"github.com/pion/interceptor/pkg/videoframe"
 	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v4"
 )
 
+var (
+	// ErrFrameDropped はそのフレームを処理・書き込みできなかったが、出力自体は継続できることを示す
+	// StreamWriterはフレーム単位の失敗をこのエラーで包んで返し、それ以外のエラーは出力の失敗として扱われる
+	ErrFrameDropped = errors.New("frame dropped")
+	// ErrStreamWrite は書き込みエラーにより処理を終了すべきことを示す
+	// 出力自体の失敗（再接続しても回復しない）、または --on-write-error exit の場合に返す
+	ErrStreamWrite = errors.New("stream write failed")
+)
+
 // StreamManager はストリーム処理を管理する統合クラス
 type StreamManager struct {
 	videoTrack      *webrtc.TrackRemote
-	audioTrack      *webrtc.TrackRemote
+	audioTracks     []audioTrack
 	writer          StreamWriter
 	processor       RTPProcessor
 	codecType       string
@@ -26,16 +37,41 @@ type StreamManager struct {
 	closeOnce       sync.Once
 	mu              sync.Mutex
 	running         bool
-	baseTimeout     time.Duration   // RTP読み取り基本タイムアウト（2秒）
-	maxTimeout      time.Duration   // RTP読み取り最大タイムアウト
-	timeoutStep     time.Duration   // タイムアウト増加ステップ（1秒）
-	currentTimeout  time.Duration   // 現在のタイムアウト値
+	streamTimeout   time.Duration   // 受信開始後にトラックのRTPが途絶えたとみなすまでの時間（0で無効）
 	mediaReceivedCh chan<- struct{} // 最初のメディア受信通知用
 	firstMediaSent  bool            // 通知済みフラグ
 	seenKeyFrame    bool            // videoframe用: キーフレーム受信済みフラグ
 	lastFrameID     int64           // 最後に処理したフレームID（ギャップ検出用）
 	frameCount      int64           // 受信フレーム総数
 	droppedFrames   int64           // ドロップされたフレーム数（ギャップから推定）
+	keyframeCtl     *KeyframeController
+	health          *HealthState // RTPパケット受信時刻の記録先（未設定時はnil）
+	onWriteError    string       // フレーム単位の書き込みエラー時の動作（--on-write-error）
+	droppedWrites   int64        // --on-write-error ignore で破棄したフレーム数
+	cvoExtensionID  uint8        // CVOヘッダー拡張のID（0で無効）
+	videoRotation   int          // 最後にwriterへ通知した回転角度（-1で未通知）
+	videoJitter     *JitterEstimator
+	videoLatency    *LatencyEstimator
+	videoCaptureID  uint8   // 映像のabs-capture-timeヘッダー拡張のID（--measure-latency、0で無効）
+	audioCaptureID  uint8   // 音声のabs-capture-timeヘッダー拡張のID（--measure-latency、0で無効）
+	lossPercent     float64 // --simulate-loss で破棄する受信RTPパケットの割合（0で無効）
+	lossSeed        int64   // --loss-seed（トラックごとにずらして使う）
+	processAll      bool    // videoframe interceptorのフレームを使わず、すべての映像パケットをprocessorで処理する
+	videoPT         uint8   // 最後に受信した映像RTPのペイロードタイプ（コーデックの切り替え検出用）
+
+	// audioTap は最初の音声トラックのフレームを書き込む追加の出力（--wav-out、nilで無効）
+	audioTap func(data []byte, timestamp uint32) error
+
+	// feedbackSSRCs はPeerConnectionが送ったRTCPフィードバックのSSRCの記録（CreatePeerConnectionが設定、RTCP BYE用）
+	feedbackSSRCs *feedbackSSRCRecorder
+}
+
+// audioTrack は受信中の音声トラックと、書き込み先のwriterの音声トラックのインデックス
+type audioTrack struct {
+	track   *webrtc.TrackRemote
+	index   int
+	jitter  *JitterEstimator
+	latency *LatencyEstimator
 }
 
 // rtpReadResult はReadRTPの結果を格納
@@ -46,29 +82,41 @@ type rtpReadResult struct {
 }
 
 // NewStreamManager は新しいストリームマネージャーを作成
-// maxTimeout: 最大タイムアウト値（タイムアウトは2秒から開始し、1秒ずつ増加してこの値に達する）
-func NewStreamManager(writer StreamWriter, processor RTPProcessor, maxTimeout time.Duration, mediaReceivedCh chan<- struct{}) *StreamManager {
-	baseTimeout := 2 * time.Second
-	timeoutStep := 1 * time.Second
+// streamTimeout: トラックが最初のRTPを受信した後、この時間RTPが届かなければメディアが途絶えたとしてRunがエラーを返す（0で無効）
+// 最初のRTPを待つ時間は呼び出し側（メディアタイムアウト）で制限する
+func NewStreamManager(writer StreamWriter, processor RTPProcessor, streamTimeout time.Duration, mediaReceivedCh chan<- struct{}) *StreamManager {
 	return &StreamManager{
 		writer:          writer,
 		processor:       processor,
 		done:            make(chan struct{}),
 		errChan:         make(chan error, 2),
-		baseTimeout:     baseTimeout,
-		maxTimeout:      maxTimeout,
-		timeoutStep:     timeoutStep,
-		currentTimeout:  baseTimeout,
+		streamTimeout:   streamTimeout,
 		mediaReceivedCh: mediaReceivedCh,
+		onWriteError:    OnWriteError,
+		lossPercent:     SimulateLoss,
+		lossSeed:        LossSeed,
+		videoRotation:   -1,
 	}
 }
 
+// NewStreamManagerWithProcessor はすべての映像RTPパケットをprocessorで処理するStreamManagerを作成する
+// NewStreamManagerはVP8ではvideoframe interceptorが組み立てたフレームを優先し、processorはフォールバックとしてのみ使う
+// 独自のデパケッタイザー（実験的なコーデック等）を使う場合はこちらを使う。引数はNewStreamManagerと同じ
+func NewStreamManagerWithProcessor(writer StreamWriter, processor RTPProcessor, streamTimeout time.Duration, mediaReceivedCh chan<- struct{}) *StreamManager {
+	sm := NewStreamManager(writer, processor, streamTimeout, mediaReceivedCh)
+	sm.processAll = true
+	return sm
+}
+
 // readRTPWithTimeout はタイムアウト付きでRTPパケットを読み取る
-// タイムアウトは2秒から開始し、タイムアウト発生ごとに1秒ずつ増加（最大maxTimeoutまで）
-// パケット受信成功時はタイムアウトを2秒にリセット
-func (sm *StreamManager) readRTPWithTimeout(track *webrtc.TrackRemote) (*rtp.Packet, interceptor.Attributes, error) {
-	if sm.maxTimeout <= 0 {
-		return track.ReadRTP()
+// startedがfalse（トラックがまだRTPを受信していない）の場合はタイムアウトせず、Stopまで待つ
+func (sm *StreamManager) readRTPWithTimeout(track *webrtc.TrackRemote, started bool) (*rtp.Packet, interceptor.Attributes, error) {
+	if sm.streamTimeout <= 0 {
+		packet, attrs, err := track.ReadRTP()
+		if err == nil {
+			sm.markActivity()
+		}
+		return packet, attrs, err
 	}
 
 	resultChan := make(chan rtpReadResult, 1)
@@ -81,28 +129,131 @@ func (sm *StreamManager) readRTPWithTimeout(track *webrtc.TrackRemote) (*rtp.Pac
 		}
 	}()
 
-	sm.mu.Lock()
-	timeout := sm.currentTimeout
-	sm.mu.Unlock()
+	var timeout <-chan time.Time
+	if started {
+		timer := time.NewTimer(sm.streamTimeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
 
 	select {
 	case <-sm.done:
 		return nil, nil, io.EOF
 	case result := <-resultChan:
-		// 成功時はタイムアウトをリセット
-		sm.mu.Lock()
-		sm.currentTimeout = sm.baseTimeout
-		sm.mu.Unlock()
+		if result.err == nil {
+			sm.markActivity()
+		}
 		return result.packet, result.attrs, result.err
-	case <-time.After(timeout):
-		// タイムアウト時は次回のタイムアウト値を増加
-		sm.mu.Lock()
-		sm.currentTimeout += sm.timeoutStep
-		if sm.currentTimeout > sm.maxTimeout {
-			sm.currentTimeout = sm.maxTimeout
+	case <-timeout:
+		return nil, nil, fmt.Errorf("%w: media stopped, no RTP for %v", ErrMediaTimeout, sm.streamTimeout)
+	}
+}
+
+// sendError はRunにエラーを通知する（停止済みの場合は破棄）
+func (sm *StreamManager) sendError(err error) {
+	select {
+	case sm.errChan <- err:
+	case <-sm.done:
+	}
+}
+
+// handleWriteError はフレームの処理・書き込みエラーを --on-write-error に従って処理する
+// 処理を続ける場合はtrueを返す。ErrFrameDroppedを含まないエラーは出力の失敗として常に終了させる
+func (sm *StreamManager) handleWriteError(kind string, err error) bool {
+	if errors.Is(err, ErrFrameDropped) {
+		switch sm.onWriteError {
+		case OnWriteErrorIgnore:
+			sm.mu.Lock()
+			sm.droppedWrites++
+			dropped := sm.droppedWrites
+			sm.mu.Unlock()
+			if dropped == 1 {
+				fmt.Fprintf(os.Stderr, "Dropping %s frame (--on-write-error ignore): %v\n", kind, err)
+			} else {
+				DebugLog("Dropping %s frame (%d dropped): %v\n", kind, dropped, err)
+			}
+			// 映像はデコーダーの参照が壊れるため、キーフレームで復帰を図る
+			if kind == "video" {
+				sm.requestKeyframe("write error")
+			}
+			return true
+		case OnWriteErrorReconnect:
+			// ErrStreamWriteを含めずに返し、呼び出し側で再接続させる
+			sm.sendError(fmt.Errorf("error writing %s frame: %w", kind, err))
+			return false
 		}
-		sm.mu.Unlock()
-		return nil, nil, fmt.Errorf("RTP read timeout after %v", timeout)
+	}
+	sm.sendError(fmt.Errorf("%w: error writing %s frame: %w", ErrStreamWrite, kind, err))
+	return false
+}
+
+// isTrackClosedError はトラックやPeerConnectionのクローズに伴う読み取りエラーかを判定する
+// 終了処理中のこれらのエラーは正常終了として扱い、エラー通知しない
+func isTrackClosedError(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe) || errors.Is(err, ice.ErrClosed)
+}
+
+// SetKeyframeController はキーフレーム要求に使用するKeyframeControllerを設定する
+func (sm *StreamManager) SetKeyframeController(kc *KeyframeController) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.keyframeCtl = kc
+}
+
+// SetHealthState はRTPパケットの受信を記録するHealthStateを設定する（Run開始前に呼ぶ）
+func (sm *StreamManager) SetHealthState(health *HealthState) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.health = health
+}
+
+// SetAudioTap は最初の音声トラックのフレームをwriterとは別に渡す先を設定する（Run開始前に呼ぶ）
+// tapのエラーは出力の書き込みエラーとして扱う
+func (sm *StreamManager) SetAudioTap(tap func(data []byte, timestamp uint32) error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.audioTap = tap
+}
+
+// markActivity はHealthStateにRTPパケットの受信を記録する
+func (sm *StreamManager) markActivity() {
+	sm.mu.Lock()
+	health := sm.health
+	sm.mu.Unlock()
+	if health != nil {
+		health.MarkActivity()
+	}
+}
+
+// setFeedbackSSRCRecorder はPeerConnectionが送ったRTCPフィードバックのSSRCの記録先を設定する
+func (sm *StreamManager) setFeedbackSSRCRecorder(recorder *feedbackSSRCRecorder) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.feedbackSSRCs = recorder
+}
+
+// FeedbackSSRCs はこのセッションのPeerConnectionがこれまでに送ったRTCPフィードバックの送信元SSRCを返す
+// SendGoodbyeに渡し、受信の終了をRTCP BYEで通知するために使う
+func (sm *StreamManager) FeedbackSSRCs() []uint32 {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.feedbackSSRCs == nil {
+		return nil
+	}
+	return sm.feedbackSSRCs.list()
+}
+
+// KeyframeController は設定済みのKeyframeControllerを返す（未設定時はnil）
+func (sm *StreamManager) KeyframeController() *KeyframeController {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.keyframeCtl
+}
+
+// requestKeyframe はKeyframeController経由でキーフレームを要求する
+func (sm *StreamManager) requestKeyframe(reason string) {
+	if kc := sm.KeyframeController(); kc != nil {
+		kc.Request(reason)
 	}
 }
 
@@ -120,6 +271,50 @@ func (sm *StreamManager) notifyMediaReceived() {
 	}
 }
 
+// SetVideoOrientationExtension はネゴシエーションされたCVOヘッダー拡張のIDを設定する
+// AddVideoTrackより前に呼ぶ。送信側が拡張に対応していない場合は0となり、回転は通知されない
+func (sm *StreamManager) SetVideoOrientationExtension(id uint8) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.cvoExtensionID = id
+	if id == 0 {
+		fmt.Fprintln(os.Stderr, "--auto-rotate: sender did not negotiate video orientation (CVO), output is not rotated")
+	}
+}
+
+// SetAbsCaptureTimeExtension はkindのトラックでネゴシエーションされたabs-capture-timeヘッダー拡張のIDを設定する
+// AddVideoTrack/AddAudioTrackより前に呼ぶ。送信側が拡張に対応していない場合は0となり、遅延は計測されない
+func (sm *StreamManager) SetAbsCaptureTimeExtension(kind webrtc.RTPCodecType, id uint8) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if kind == webrtc.RTPCodecTypeVideo {
+		sm.videoCaptureID = id
+	} else {
+		sm.audioCaptureID = id
+	}
+	if id == 0 {
+		fmt.Fprintf(os.Stderr, "--measure-latency: sender did not negotiate abs-capture-time for %s, its latency is not measured\n", kind)
+	}
+}
+
+// updateVideoRotation はRTPパケットのCVO拡張を読み、回転が変わった場合にwriterへ通知する
+// CVOはキーフレームの最終パケット等にのみ付くため、拡張の無いパケットでは直前の値を維持する
+func (sm *StreamManager) updateVideoRotation(packet *rtp.Packet) {
+	degrees, ok := packetVideoRotation(packet, sm.cvoExtensionID)
+	if !ok || degrees == sm.videoRotation {
+		return
+	}
+	if sm.videoRotation < 0 && degrees == 0 {
+		sm.videoRotation = 0
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Video orientation: rotate %d degrees clockwise for display (CVO)\n", degrees)
+	sm.videoRotation = degrees
+	if setter, ok := sm.writer.(VideoRotationSetter); ok {
+		setter.SetVideoRotation(degrees)
+	}
+}
+
 // AddVideoTrack はビデオトラックを追加
 func (sm *StreamManager) AddVideoTrack(track *webrtc.TrackRemote, codecType string) {
 	sm.mu.Lock()
@@ -127,6 +322,14 @@ func (sm *StreamManager) AddVideoTrack(track *webrtc.TrackRemote, codecType stri
 
 	sm.videoTrack = track
 	sm.codecType = codecType
+	if track != nil {
+		sm.videoPT = uint8(track.PayloadType())
+		sm.videoJitter = NewJitterEstimator(track.Codec().ClockRate)
+		sm.videoLatency = NewLatencyEstimator(sm.videoCaptureID)
+	}
+	if setter, ok := sm.writer.(VideoCodecSetter); ok {
+		setter.SetVideoCodec(codecType)
+	}
 
 	// 既に実行中かつ停止していない場合、新しいトラックの処理を開始
 	if sm.running && track != nil {
@@ -140,21 +343,90 @@ func (sm *StreamManager) AddVideoTrack(track *webrtc.TrackRemote, codecType stri
 	}
 }
 
+// Jitter は受信中の各トラックについて、読み取りループで計算した到着間隔ジッターを返す
+func (sm *StreamManager) Jitter() []TrackJitter {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	var result []TrackJitter
+	if sm.videoTrack != nil && sm.videoJitter != nil {
+		result = append(result, TrackJitter{
+			Kind:    "video",
+			SSRC:    uint32(sm.videoTrack.SSRC()),
+			Jitter:  sm.videoJitter.Jitter(),
+			Packets: sm.videoJitter.Packets(),
+
+			Latency:        sm.videoLatency.Latency(),
+			LatencySamples: sm.videoLatency.Samples(),
+		})
+	}
+	for _, audio := range sm.audioTracks {
+		result = append(result, TrackJitter{
+			Kind:    "audio",
+			Index:   audio.index,
+			SSRC:    uint32(audio.track.SSRC()),
+			Jitter:  audio.jitter.Jitter(),
+			Packets: audio.jitter.Packets(),
+
+			Latency:        audio.latency.Latency(),
+			LatencySamples: audio.latency.Samples(),
+		})
+	}
+	return result
+}
+
+// SetAudioOnly は映像が無いストリームであることをwriterに通知する（AudioOnlySetterを実装する場合）
+func (sm *StreamManager) SetAudioOnly() {
+	if setter, ok := sm.writer.(AudioOnlySetter); ok {
+		setter.SetAudioOnly()
+	}
+}
+
+// SetVideoOnly は音声が無いストリームであることをwriterに通知する（VideoOnlySetterを実装する場合）
+func (sm *StreamManager) SetVideoOnly() {
+	if setter, ok := sm.writer.(VideoOnlySetter); ok {
+		setter.SetVideoOnly()
+	}
+}
+
 // AddAudioTrack はオーディオトラックを追加
+// writerがMultiAudioWriterの場合はトラックごとに別の音声トラックへ書き込み、それ以外は最初のトラックのみを使う
 func (sm *StreamManager) AddAudioTrack(track *webrtc.TrackRemote) {
+	if track == nil {
+		return
+	}
+
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
-	sm.audioTrack = track
+	index := 0
+	if multi, ok := sm.writer.(MultiAudioWriter); ok {
+		i, err := multi.AddAudioTrack()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Ignoring audio track %s: %v\n", track.ID(), err)
+			return
+		}
+		index = i
+	} else if len(sm.audioTracks) > 0 {
+		fmt.Fprintf(os.Stderr, "Ignoring audio track %s: output supports a single audio track\n", track.ID())
+		return
+	}
+	audio := audioTrack{
+		track:   track,
+		index:   index,
+		jitter:  NewJitterEstimator(track.Codec().ClockRate),
+		latency: NewLatencyEstimator(sm.audioCaptureID),
+	}
+	sm.audioTracks = append(sm.audioTracks, audio)
 
 	// 既に実行中かつ停止していない場合、新しいトラックの処理を開始
-	if sm.running && track != nil {
+	if sm.running {
 		select {
 		case <-sm.done:
 			return
 		default:
 			sm.wg.Add(1)
-			go sm.processAudioStream()
+			go sm.processAudioStream(audio)
 		}
 	}
 }
@@ -165,15 +437,15 @@ func (sm *StreamManager) Run() error {
 	sm.running = true
 	// 現在のトラックを取得
 	videoTrack := sm.videoTrack
-	audioTrack := sm.audioTrack
+	audioTracks := append([]audioTrack(nil), sm.audioTracks...)
 	sm.mu.Unlock()
 
 	// WriterのRunメソッドがあれば実行
+	// Writerのフラッシュ等の失敗は出力の失敗のため、再接続せずに終了させる
 	if runner, ok := sm.writer.(interface{ Run() error }); ok {
 		go func() {
-			select {
-			case sm.errChan <- runner.Run():
-			case <-sm.done:
+			if err := runner.Run(); err != nil {
+				sm.sendError(fmt.Errorf("%w: writer: %w", ErrStreamWrite, err))
 			}
 		}()
 	}
@@ -184,10 +456,10 @@ func (sm *StreamManager) Run() error {
 		go sm.processVideoStream()
 	}
 
-	// オーディオストリーム処理
-	if audioTrack != nil {
+	// オーディオストリーム処理（トラックごと）
+	for _, audio := range audioTracks {
 		sm.wg.Add(1)
-		go sm.processAudioStream()
+		go sm.processAudioStream(audio)
 	}
 
 	// エラー監視: doneチャネルかerrChanからのエラーを待つ
@@ -220,11 +492,52 @@ func (sm *StreamManager) Stop() error {
 	return nil
 }
 
+// newLossSimulator は --simulate-loss が有効な場合に読み取りループ用のLossSimulatorを作成する（無効ならnil）
+// 破棄はNACK等のinterceptorより後で行うため、再送では回復しない損失として扱われる
+// VP8のvideoframe interceptorが組み立てたフレームは、完成させたパケットと一緒に破棄される
+func (sm *StreamManager) newLossSimulator(seed int64) *LossSimulator {
+	if sm.lossPercent <= 0 {
+		return nil
+	}
+	return NewLossSimulator(sm.lossPercent, seed)
+}
+
+// updateVideoCodec は映像RTPのペイロードタイプが変わった場合に、そのPTでネゴシエーションされたコーデックに切り替える
+// 複数の映像コーデックを含むanswerでは、送信側がRTPのPTでコーデックを選び、途中で変えることもある
+// TrackRemoteはReadRTPで受信したパケットのPTからCodecを更新するため、それに合わせてwriterのコーデックを変える
+func (sm *StreamManager) updateVideoCodec(payloadType uint8) {
+	sm.videoPT = payloadType
+	codecType := MimeTypeToCodec(sm.videoTrack.Codec().MimeType)
+	if codecType == "" || codecType == sm.codecType {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "Video payload type changed to %d: switching codec from %s to %s\n", payloadType, sm.codecType, codecType)
+	sm.mu.Lock()
+	sm.codecType = codecType
+	sm.mu.Unlock()
+	// 新しいコーデックのキーフレームまでは書き込まない
+	sm.seenKeyFrame = false
+	if processor, ok := sm.processor.(*DefaultRTPProcessor); ok {
+		processor.resetCodec()
+	}
+	if setter, ok := sm.writer.(VideoCodecSetter); ok {
+		setter.SetVideoCodec(codecType)
+	}
+	sm.requestKeyframe("video codec changed")
+}
+
 // processVideoStream はビデオストリームを処理
 func (sm *StreamManager) processVideoStream() {
 	defer sm.wg.Done()
 	fmt.Fprintf(os.Stderr, "Starting video stream processing\n")
 
+	loss := sm.newLossSimulator(sm.lossSeed)
+	if loss != nil {
+		defer func() { fmt.Fprintf(os.Stderr, "Simulated loss (video): %v\n", loss) }()
+	}
+
+	// 最初のRTPを受信するまではメディアタイムアウト（呼び出し側）で待つ
+	started := false
 	for {
 		select {
 		case <-sm.done:
@@ -232,9 +545,10 @@ func (sm *StreamManager) processVideoStream() {
 		default:
 		}
 
-		rtpPacket, attrs, err := sm.readRTPWithTimeout(sm.videoTrack)
+		rtpPacket, attrs, err := sm.readRTPWithTimeout(sm.videoTrack, started)
 		if err != nil {
-			if err == io.EOF {
+			if isTrackClosedError(err) {
+				DebugLog("Video track closed: %v\n", err)
 				return
 			}
 			select {
@@ -243,12 +557,29 @@ func (sm *StreamManager) processVideoStream() {
 			}
 			return
 		}
+		if loss != nil && loss.Drop() {
+			continue
+		}
+
+		started = true
+		arrival := time.Now()
+		sm.videoJitter.Update(rtpPacket.Timestamp, arrival)
+		sm.videoLatency.Update(rtpPacket, arrival)
 
 		// 最初のメディア受信を通知
 		sm.notifyMediaReceived()
 
+		if rtpPacket.PayloadType != sm.videoPT {
+			sm.updateVideoCodec(rtpPacket.PayloadType)
+		}
+
+		// フレームを書き込む前に回転を反映し、ヘッダーに間に合わせる
+		if sm.cvoExtensionID != 0 {
+			sm.updateVideoRotation(rtpPacket)
+		}
+
 		// videoframe interceptorからEncodedFrameを取得（VP8の場合）
-		if sm.codecType == "vp8" && attrs != nil {
+		if sm.codecType == "vp8" && attrs != nil && !sm.processAll {
 			if val := attrs.Get(videoframe.EncodedFramesKey); val != nil {
 				if encodedFrames, ok := val.([]*videoframe.EncodedFrame); ok && len(encodedFrames) > 0 {
 					for _, frame := range encodedFrames {
@@ -258,9 +589,13 @@ func (sm *StreamManager) processVideoStream() {
 						if !sm.seenKeyFrame {
 							if keyframe {
 								sm.seenKeyFrame = true
+								if kc := sm.KeyframeController(); kc != nil {
+									kc.OnKeyframe()
+								}
 								sm.lastFrameID = frame.ID
 								DebugLog("videoframe: First keyframe received, ID=%d, Size=%d\n", frame.ID, len(frame.Data))
 							} else {
+								sm.requestKeyframe("waiting for first keyframe")
 								continue // キーフレーム前のデルタフレームはスキップ
 							}
 						} else {
@@ -272,9 +607,15 @@ func (sm *StreamManager) processVideoStream() {
 									sm.droppedFrames += gap
 									DebugLog("videoframe: FRAME GAP detected! expected=%d, got=%d, dropped=%d frames (total dropped=%d)\n",
 										expectedID, frame.ID, gap, sm.droppedFrames)
+									sm.requestKeyframe("frame gap")
 								}
 							}
 							sm.lastFrameID = frame.ID
+							if keyframe {
+								if kc := sm.KeyframeController(); kc != nil {
+									kc.OnKeyframe()
+								}
+							}
 						}
 						sm.frameCount++
 
@@ -286,11 +627,9 @@ func (sm *StreamManager) processVideoStream() {
 						}
 
 						if err := sm.writer.WriteVideoFrame(frame.Data, frame.Timestamp, keyframe); err != nil {
-							select {
-							case sm.errChan <- fmt.Errorf("error writing video frame: %w", err):
-							case <-sm.done:
+							if !sm.handleWriteError("video", err) {
+								return
 							}
-							return
 						}
 					}
 					continue
@@ -299,34 +638,51 @@ func (sm *StreamManager) processVideoStream() {
 		}
 
 		// フォールバック: 従来のRTPプロセッサを使用
+		// 不正なパケットはそのフレームのみの失敗として扱う
 		frames, err := sm.processor.ProcessRTPPacket(rtpPacket, sm.codecType)
 		if err != nil {
-			select {
-			case sm.errChan <- fmt.Errorf("error processing video RTP: %w", err):
-			case <-sm.done:
+			if !sm.handleWriteError("video", fmt.Errorf("%w: error processing video RTP: %w", ErrFrameDropped, err)) {
+				return
 			}
-			return
+			continue
 		}
 
 		// フレームを書き込み
 		for _, frame := range frames {
 			keyframe := sm.isKeyframe(frame, sm.codecType)
 			if err := sm.writer.WriteVideoFrame(frame, rtpPacket.Timestamp, keyframe); err != nil {
-				select {
-				case sm.errChan <- fmt.Errorf("error writing video frame: %w", err):
-				case <-sm.done:
+				if !sm.handleWriteError("video", err) {
+					return
 				}
-				return
 			}
 		}
 	}
 }
 
 // processAudioStream はオーディオストリームを処理
-func (sm *StreamManager) processAudioStream() {
+func (sm *StreamManager) processAudioStream(audio audioTrack) {
 	defer sm.wg.Done()
 	fmt.Fprintf(os.Stderr, "Starting audio stream processing\n")
 
+	write := sm.writer.WriteAudioFrame
+	if multi, ok := sm.writer.(MultiAudioWriter); ok {
+		write = func(data []byte, timestamp uint32) error {
+			return multi.WriteAudioTrackFrame(audio.index, data, timestamp)
+		}
+	}
+	sm.mu.Lock()
+	tap := sm.audioTap
+	sm.mu.Unlock()
+	if audio.index != 0 {
+		tap = nil
+	}
+
+	loss := sm.newLossSimulator(sm.lossSeed + 1 + int64(audio.index))
+	if loss != nil {
+		defer func() { fmt.Fprintf(os.Stderr, "Simulated loss (audio %d): %v\n", audio.index, loss) }()
+	}
+
+	started := false
 	for {
 		select {
 		case <-sm.done:
@@ -334,9 +690,10 @@ func (sm *StreamManager) processAudioStream() {
 		default:
 		}
 
-		rtpPacket, _, err := sm.readRTPWithTimeout(sm.audioTrack)
+		rtpPacket, _, err := sm.readRTPWithTimeout(audio.track, started)
 		if err != nil {
-			if err == io.EOF {
+			if isTrackClosedError(err) {
+				DebugLog("Audio track closed: %v\n", err)
 				return
 			}
 			select {
@@ -345,42 +702,59 @@ func (sm *StreamManager) processAudioStream() {
 			}
 			return
 		}
+		if loss != nil && loss.Drop() {
+			continue
+		}
+
+		started = true
+		arrival := time.Now()
+		audio.jitter.Update(rtpPacket.Timestamp, arrival)
+		audio.latency.Update(rtpPacket, arrival)
+
+		// 音声のみのストリームもあるため、音声でも最初のメディア受信を通知する
+		sm.notifyMediaReceived()
 
 		// RTPパケットを処理（オーディオは通常opus）
 		frames, err := sm.processor.ProcessRTPPacket(rtpPacket, "opus")
 		if err != nil {
-			select {
-			case sm.errChan <- fmt.Errorf("error processing audio RTP: %w", err):
-			case <-sm.done:
+			if !sm.handleWriteError("audio", fmt.Errorf("%w: error processing audio RTP: %w", ErrFrameDropped, err)) {
+				return
 			}
-			return
+			continue
 		}
 
 		// フレームを書き込み
 		for _, frame := range frames {
-			if err := sm.writer.WriteAudioFrame(frame, rtpPacket.Timestamp); err != nil {
-				select {
-				case sm.errChan <- fmt.Errorf("error writing audio frame: %w", err):
-				case <-sm.done:
+			if tap != nil {
+				if err := tap(frame, rtpPacket.Timestamp); err != nil {
+					if !sm.handleWriteError("audio", err) {
+						return
+					}
+				}
+			}
+			if err := write(frame, rtpPacket.Timestamp); err != nil {
+				if !sm.handleWriteError("audio", err) {
+					return
 				}
-				return
 			}
 		}
 	}
 }
 
 // isKeyframe はフレームがキーフレームかどうかを判定
+// processorがKeyframeDetectorを実装していればその判定を使う
 func (sm *StreamManager) isKeyframe(frame []byte, codecType string) bool {
 	if len(frame) == 0 {
 		return false
 	}
+	if detector, ok := sm.processor.(KeyframeDetector); ok {
+		return detector.IsKeyframe(frame, codecType)
+	}
 
 	switch codecType {
 	case "vp8":
-		// VP8のキーフレームをチェック
-		if len(frame) > 0 {
-			return (frame[0] & 0x01) == 0
-		}
+		// VP8のキーフレームをチェック（frameはデスクリプタ除去済みのビットストリーム）
+		return IsVP8Keyframe(frame)
 	case "vp9":
 		// VP9のキーフレームをチェック
 		// 簡略化された判定
@@ -389,51 +763,3 @@ func (sm *StreamManager) isKeyframe(frame []byte, codecType string) bool {
 
 	return false
 }
-
-// stripVP8PayloadDescriptor はVP8 RTPペイロードデスクリプタを除去してビットストリームを取得
-// RFC 7741に基づく
-func stripVP8PayloadDescriptor(data []byte) []byte {
-	if len(data) < 1 {
-		return data
-	}
-
-	headerSize := 1
-	firstByte := data[0]
-
-	// X bit - extension present
-	if firstByte&0x80 != 0 {
-		if len(data) < 2 {
-			return data
-		}
-		headerSize++
-		extByte := data[1]
-
-		// I bit - PictureID present
-		if extByte&0x80 != 0 {
-			headerSize++
-			if len(data) < headerSize {
-				return data
-			}
-			// M bit - PictureID is 16 bits
-			if data[headerSize-1]&0x80 != 0 {
-				headerSize++
-			}
-		}
-
-		// L bit - TL0PICIDX present
-		if extByte&0x40 != 0 {
-			headerSize++
-		}
-
-		// T or K bit - TID/KEYIDX present
-		if extByte&0x20 != 0 || extByte&0x10 != 0 {
-			headerSize++
-		}
-	}
-
-	if len(data) <= headerSize {
-		return data
-	}
-
-	return data[headerSize:]
-}
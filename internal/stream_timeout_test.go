@@ -0,0 +1,154 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	streamTimeoutAudioStep  = 20 * time.Millisecond // Opusのフレーム長
+	streamTimeoutAudioTicks = 960                   // 20ms（48kHz）
+	streamTimeout           = 500 * time.Millisecond
+)
+
+// streamTimeoutLoopback は受信側（StreamManager）と送信側の音声トラックをループバックで接続したもの
+type streamTimeoutLoopback struct {
+	streamManager *StreamManager
+	receiver      *webrtc.PeerConnection
+	sender        *webrtc.PeerConnection
+	track         *webrtc.TrackLocalStaticRTP
+	mediaReceived chan struct{}
+}
+
+// newLoopback はストリームタイムアウトを指定したStreamManagerで受信するループバック接続を作成する
+func newLoopback(timeout time.Duration) (*streamTimeoutLoopback, error) {
+	l := &streamTimeoutLoopback{mediaReceived: make(chan struct{}, 1)}
+	l.streamManager = NewStreamManager(&discardWriter{}, NewDefaultRTPProcessor(), timeout, l.mediaReceived)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, err
+	}
+	l.receiver, err = CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), l.streamManager)
+	if err != nil {
+		return nil, err
+	}
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		l.close()
+		return nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	l.sender, err = api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+	l.track, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "test")
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+	if _, err := l.sender.AddTrack(l.track); err != nil {
+		l.close()
+		return nil, err
+	}
+	if err := connect(l.receiver, l.sender); err != nil {
+		l.close()
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *streamTimeoutLoopback) close() {
+	if l.sender != nil {
+		l.sender.Close()
+	}
+	if l.receiver != nil {
+		l.receiver.Close()
+	}
+}
+
+// sendUntilReceived はStreamManagerが最初のメディアを受信するまで音声パケットを送り続ける
+// SRTPの準備完了前のパケットは破棄されるため、1回の送信では届かないことがある
+func (l *streamTimeoutLoopback) sendUntilReceived() error {
+	deadline := time.Now().Add(5 * time.Second)
+	for i := 0; time.Now().Before(deadline); i++ {
+		packet := &rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: uint16(i), Timestamp: uint32(i * streamTimeoutAudioTicks)},
+			Payload: opusSilence,
+		}
+		if err := l.track.WriteRTP(packet); err != nil {
+			return err
+		}
+		select {
+		case <-l.mediaReceived:
+			return nil
+		case <-time.After(streamTimeoutAudioStep):
+		}
+	}
+	return fmt.Errorf("no media received within 5s")
+}
+
+// TestStreamTimeoutMediaStopped はRTPの受信開始後に送信が止まると、streamTimeout後にRunがErrMediaTimeoutを返すことを検証する
+func TestStreamTimeoutMediaStopped(t *testing.T) {
+	l, err := newLoopback(streamTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- l.streamManager.Run() }()
+	defer l.streamManager.Stop()
+
+	if err := l.sendUntilReceived(); err != nil {
+		t.Fatal(err)
+	}
+	stopped := time.Now()
+	select {
+	case err := <-runErr:
+		if !errors.Is(err, ErrMediaTimeout) {
+			t.Fatalf("Run returned %v, want ErrMediaTimeout", err)
+		}
+		if !strings.Contains(err.Error(), "media stopped") {
+			t.Fatalf("error %q does not say the media stopped", err)
+		}
+		if elapsed := time.Since(stopped); elapsed < streamTimeout-100*time.Millisecond {
+			t.Fatalf("Run returned after %v, before the %v stream timeout", elapsed, streamTimeout)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return within 5s after the media stopped")
+	}
+}
+
+// TestStreamTimeoutDisabled はストリームタイムアウトが0の場合、送信が止まってもRunがエラーを返さないことを検証する
+func TestStreamTimeoutDisabled(t *testing.T) {
+	l, err := newLoopback(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- l.streamManager.Run() }()
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	defer func() {
+		l.close()
+		l.streamManager.Stop()
+	}()
+
+	if err := l.sendUntilReceived(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-runErr:
+		t.Fatalf("Run returned %v with the stream timeout disabled", err)
+	case <-time.After(3 * streamTimeout):
+	}
+}
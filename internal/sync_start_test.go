@@ -0,0 +1,245 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+const (
+	syncStartWidth     = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	syncStartHeight    = 360
+	syncStartAudioStep = 20 * time.Millisecond // Opusのフレーム長
+	syncStartVideoStep = 40 * time.Millisecond // 25fps
+	syncStartDuration  = 1500 * time.Millisecond
+)
+
+// track番号（DefaultTrackLayout）
+const (
+	syncStartVideoTrack = 1
+	syncStartAudioTrack = 2
+)
+
+// syncStartScenario は音声と映像の開始時刻（書き込み開始からの経過時間、負で無し）
+type syncStartScenario struct {
+	audioStart time.Duration
+	videoStart time.Duration
+	end        time.Duration
+}
+
+// syncStartBlock はSimpleBlockのトラック番号、timecode（ms）、キーフレームフラグとデータ
+type syncStartBlock struct {
+	track    uint64
+	timecode int64
+	keyframe bool
+	data     []byte
+}
+
+// syncStartScanBlocks はSimpleBlockを出力順に、クラスタのtimecodeを加えた絶対timecodeで返す
+func syncStartScanBlocks(data []byte) ([]syncStartBlock, error) {
+	var blocks []syncStartBlock
+	var clusterTime int64
+	for len(data) > 0 {
+		id, n := readVint(data, true)
+		size, m := readVint(data[n:], false)
+		if n == 0 || m == 0 {
+			return nil, fmt.Errorf("malformed element header")
+		}
+		data = data[n+m:]
+		if id == idSegment || id == idCluster {
+			continue
+		}
+		if uint64(len(data)) < size {
+			return nil, fmt.Errorf("element 0x%X truncated", id)
+		}
+		value := data[:size]
+		data = data[size:]
+		switch id {
+		case idTimecode:
+			clusterTime = 0
+			for _, b := range value {
+				clusterTime = clusterTime<<8 | int64(b)
+			}
+		case idSimpleBlock:
+			track, k := readVint(value, false)
+			if k == 0 || len(value) < k+3 {
+				return nil, fmt.Errorf("malformed SimpleBlock")
+			}
+			relative := int64(int16(binary.BigEndian.Uint16(value[k:])))
+			blocks = append(blocks, syncStartBlock{
+				track:    track,
+				timecode: clusterTime + relative,
+				keyframe: value[k+2]&0x80 != 0,
+				data:     value[k+3:],
+			})
+		}
+	}
+	return blocks, nil
+}
+
+// syncStartEncodeFrames はVP8フレームをn枚エンコードする（最初のフレームがキーフレーム）
+func syncStartEncodeFrames(n int) ([][]byte, []bool, error) {
+	encoder, err := NewVP8Encoder(syncStartWidth, syncStartHeight, "YUV420P", 500)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer encoder.Close()
+	yuv := bytes.Repeat([]byte{0x80}, syncStartWidth*syncStartHeight*3/2)
+	var frames [][]byte
+	var keyframes []bool
+	for i := 0; i < n; i++ {
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return nil, nil, err
+		}
+		frames = append(frames, encoded)
+		keyframes = append(keyframes, keyframe)
+	}
+	return frames, keyframes, nil
+}
+
+// syncStartRun は --sync-start を有効にし、ManualClockを20msずつ進めながらscenarioどおりに音声と映像を書き込んだ出力のブロックを返す
+func syncStartRun(s syncStartScenario, timeout time.Duration) ([]syncStartBlock, error) {
+	SyncStart = true
+	SyncStartTimeoutMs = int(timeout.Milliseconds())
+	defer func() {
+		SyncStart = false
+		SyncStartTimeoutMs = 2000
+	}()
+
+	frames, keyframes, err := syncStartEncodeFrames(int((s.end - s.videoStart + syncStartVideoStep - 1) / syncStartVideoStep))
+	if err != nil {
+		return nil, err
+	}
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	clock := newManualClock(time.Unix(0, 0))
+	writer.SetClock(clock)
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	for t := time.Duration(0); t < s.end; t += syncStartAudioStep {
+		if t > 0 {
+			clock.Advance(syncStartAudioStep)
+		}
+		if t >= s.videoStart && (t-s.videoStart)%syncStartVideoStep == 0 {
+			i := int((t - s.videoStart) / syncStartVideoStep)
+			if err := writer.WriteVideoFrame(frames[i], uint32((t-s.videoStart)*90000/time.Second), keyframes[i]); err != nil {
+				return nil, fmt.Errorf("video frame %d: %v", i, err)
+			}
+		}
+		if s.audioStart >= 0 && t >= s.audioStart {
+			seq := int((t - s.audioStart) / syncStartAudioStep)
+			if err := writer.WriteAudioFrame(opusPacket(seq), uint32(seq*960)); err != nil {
+				return nil, fmt.Errorf("audio frame %d: %v", seq, err)
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return syncStartScanBlocks(out.Bytes())
+}
+
+// syncStartCheck は最初の映像ブロックが到着時刻videoFromのフレーム、最初の音声ブロックがシーケンス番号audioFromのフレームで、
+// 両方がtimecode 0から始まり、以降のブロックがそこからの経過時間に並ぶことを検証する（audioFromが負なら音声無し）
+func syncStartCheck(s syncStartScenario, blocks []syncStartBlock, videoFrom time.Duration, audioFrom int) error {
+	if len(blocks) == 0 {
+		return fmt.Errorf("no blocks written")
+	}
+	videoFrames, audioFrames := 0, 0
+	for i, b := range blocks {
+		switch b.track {
+		case syncStartVideoTrack:
+			want := (time.Duration(videoFrames) * syncStartVideoStep).Milliseconds()
+			if b.timecode != want {
+				return fmt.Errorf("video frame %d at %dms, want %dms", videoFrames, b.timecode, want)
+			}
+			if videoFrames == 0 && !b.keyframe {
+				return fmt.Errorf("first video block is not a keyframe")
+			}
+			videoFrames++
+		case syncStartAudioTrack:
+			if audioFrom < 0 {
+				return fmt.Errorf("unexpected audio block %d", i)
+			}
+			seq := int(b.data[3])<<8 | int(b.data[4])
+			if want := audioFrom + audioFrames; seq != want {
+				return fmt.Errorf("audio frame %d written, want frame %d", seq, want)
+			}
+			if want := (time.Duration(audioFrames) * syncStartAudioStep).Milliseconds(); b.timecode != want {
+				return fmt.Errorf("audio frame %d at %dms, want %dms", seq, b.timecode, want)
+			}
+			audioFrames++
+		default:
+			return fmt.Errorf("block on unexpected track %d", b.track)
+		}
+	}
+	if want := int((s.end - videoFrom + syncStartVideoStep - 1) / syncStartVideoStep); videoFrames != want {
+		return fmt.Errorf("%d video frames written, want %d (from %v)", videoFrames, want, videoFrom)
+	}
+	if audioFrom >= 0 {
+		if want := int((s.end-s.audioStart+syncStartAudioStep-1)/syncStartAudioStep) - audioFrom; audioFrames != want {
+			return fmt.Errorf("%d audio frames written, want %d (from frame %d)", audioFrames, want, audioFrom)
+		}
+	}
+	return nil
+}
+
+// TestSyncStartAudioLeading は映像より500ms先に始まった音声のうち、キーフレームより前のフレームを捨て、
+// キーフレームの直前に届いた音声フレームとキーフレームをtimecode 0にそろえることを検証する
+func TestSyncStartAudioLeading(t *testing.T) {
+	s := syncStartScenario{audioStart: 0, videoStart: 500 * time.Millisecond, end: syncStartDuration}
+	blocks, err := syncStartRun(s, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 500msのキーフレームの時点で最後に届いている音声は480msのフレーム24
+	if err := syncStartCheck(s, blocks, s.videoStart, 24); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSyncStartVideoLeading は音声より500ms先に始まった映像を音声が届くまで書き込まず、
+// その時点の最新の映像フレームと最初の音声フレームをtimecode 0にそろえることを検証する
+func TestSyncStartVideoLeading(t *testing.T) {
+	s := syncStartScenario{audioStart: 500 * time.Millisecond, videoStart: 0, end: syncStartDuration}
+	blocks, err := syncStartRun(s, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 500msの音声の時点で最新の映像は480msのフレーム
+	if err := syncStartCheck(s, blocks, 480*time.Millisecond, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSyncStartTimeout は --sync-start-timeout までに音声が届かなければ映像のみで書き込みを始めることを検証する
+func TestSyncStartTimeout(t *testing.T) {
+	s := syncStartScenario{audioStart: -1, videoStart: 0, end: syncStartDuration}
+	blocks, err := syncStartRun(s, 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// キーフレームから200ms後のフレームで待機をやめる
+	if err := syncStartCheck(s, blocks, 200*time.Millisecond, -1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestSyncStartCloseWhileWaiting は音声を待っている間に終了した場合も、保持している映像を書き込むことを検証する
+func TestSyncStartCloseWhileWaiting(t *testing.T) {
+	s := syncStartScenario{audioStart: -1, videoStart: 0, end: 200 * time.Millisecond}
+	blocks, err := syncStartRun(s, 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) != 1 || blocks[0].track != syncStartVideoTrack || blocks[0].timecode != 0 || !blocks[0].keyframe {
+		t.Fatalf("got %d blocks, want the last video frame as one keyframe at 0ms", len(blocks))
+	}
+}
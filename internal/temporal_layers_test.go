@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	temporalLayersFrames = 16
+	packetsPerFrm        = 2
+	temporalLayersTsStep = 3000
+)
+
+// l1t3 は1空間レイヤー・3テンポラルレイヤー（L1T3）のTIDパターン
+var l1t3 = []int{0, 2, 1, 2}
+
+// frameTID はフレーム番号のテンポラルレイヤーIDを返す
+func frameTID(i int) int {
+	return l1t3[i%len(l1t3)]
+}
+
+// frameData はフレーム番号を埋め込んだビットストリームを作る
+// VP8はframe tagのbit 0でキーフレームを判定するため、先頭のフレームのみキーフレームにする
+func frameData(i int) []byte {
+	data := make([]byte, 24)
+	if i == 0 {
+		copy(data, []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a})
+	} else {
+		data[0] = 0x11
+	}
+	data[len(data)-1] = byte(i)
+	return data
+}
+
+// vp8Descriptor はPictureID（15bit）、TL0PICIDX、TIDを含むVP8ペイロードデスクリプタを作る
+func vp8Descriptor(i int, start bool, withTID bool) []byte {
+	if !withTID {
+		if start {
+			return []byte{0x10}
+		}
+		return []byte{0x00}
+	}
+	first := byte(0x80)
+	if start {
+		first |= 0x10
+	}
+	tid := frameTID(i)
+	tidByte := byte(tid) << 6
+	if tid > 0 {
+		tidByte |= 0x20 // Y: 基本レイヤーのみ参照
+	}
+	return []byte{first, 0xE0, 0x80 | byte(i>>8), byte(i), byte(i / len(l1t3)), tidByte}
+}
+
+// temporalLayersVP9Descriptor はPictureID（15bit）とレイヤーインデックス（非flexibleモード）を含むVP9ペイロードデスクリプタを作る
+func temporalLayersVP9Descriptor(i int, start, end bool) []byte {
+	first := byte(0x80 | 0x20) // I, L
+	if i > 0 {
+		first |= 0x40 // P: インターフレーム
+	}
+	if start {
+		first |= 0x08
+	}
+	if end {
+		first |= 0x04
+	}
+	layer := byte(frameTID(i)) << 5 // TID(3) U SID(3) D
+	return []byte{first, 0x80 | byte(i>>8), byte(i), layer, byte(i / len(l1t3))}
+}
+
+// temporalLayersMakePackets はL1T3のフレームを2パケットずつに分割したRTPパケット列を作る
+func temporalLayersMakePackets(codec string, withTID bool) []*rtp.Packet {
+	var packets []*rtp.Packet
+	seq := uint16(1000)
+	for i := 0; i < temporalLayersFrames; i++ {
+		data := frameData(i)
+		half := len(data) / 2
+		for p := 0; p < packetsPerFrm; p++ {
+			start, end := p == 0, p == packetsPerFrm-1
+			chunk := data[half*p : half*(p+1)]
+			var descriptor []byte
+			if codec == "vp9" {
+				descriptor = temporalLayersVP9Descriptor(i, start, end)
+			} else {
+				descriptor = vp8Descriptor(i, start, withTID)
+			}
+			packets = append(packets, &rtp.Packet{
+				Header: rtp.Header{
+					Version:        2,
+					SequenceNumber: seq,
+					Timestamp:      uint32(90000 + i*temporalLayersTsStep),
+					Marker:         end,
+				},
+				Payload: append(append([]byte{}, descriptor...), chunk...),
+			})
+			seq++
+		}
+	}
+	return packets
+}
+
+// temporalLayersReceive はmaxTemporalLayerを設定したRTPプロセッサにパケットを渡し、出力されたフレーム番号を返す
+func temporalLayersReceive(codec string, maxTemporalLayer int, packets []*rtp.Packet) ([]int, error) {
+	MaxTemporalLayer = maxTemporalLayer
+	defer func() { MaxTemporalLayer = -1 }()
+
+	processor := NewDefaultRTPProcessor()
+	var got []int
+	for _, packet := range packets {
+		out, err := processor.ProcessRTPPacket(packet, codec)
+		if err != nil {
+			return nil, err
+		}
+		for _, frame := range out {
+			got = append(got, int(frame[len(frame)-1]))
+		}
+	}
+	return got, nil
+}
+
+// expectLayers はmaxTemporalLayer以下のレイヤーのフレームだけが欠けずに出力されることを検証する
+func expectLayers(codec string, maxTemporalLayer int) error {
+	got, err := temporalLayersReceive(codec, maxTemporalLayer, temporalLayersMakePackets(codec, true))
+	if err != nil {
+		return err
+	}
+	var want []int
+	for i := 0; i < temporalLayersFrames; i++ {
+		if maxTemporalLayer < 0 || frameTID(i) <= maxTemporalLayer {
+			want = append(want, i)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		return fmt.Errorf("frames %v, want %v", got, want)
+	}
+	return nil
+}
+
+// TestTemporalLayersNoTemporalLayers はTIDを持たないストリームが制限の影響を受けないことを検証する
+func TestTemporalLayersNoTemporalLayers(t *testing.T) {
+	got, err := temporalLayersReceive("vp8", 0, temporalLayersMakePackets("vp8", false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != temporalLayersFrames {
+		t.Fatalf("got %d frames, want %d", len(got), temporalLayersFrames)
+	}
+}
+
+// TestTemporalLayersLossStillDetected は上位レイヤーの破棄中も、基本レイヤーのパケットロスは破損として扱われることを検証する
+func TestTemporalLayersLossStillDetected(t *testing.T) {
+	packets := temporalLayersMakePackets("vp8", true)
+	// フレーム4（TID 0）の2番目のパケットを失う
+	lost := 4*packetsPerFrm + 1
+	packets = append(packets[:lost], packets[lost+1:]...)
+
+	got, err := temporalLayersReceive("vp8", 0, packets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, i := range got {
+		if i == 4 {
+			t.Fatalf("frame 4 with a lost packet was returned: %v", got)
+		}
+	}
+	if fmt.Sprint(got) != fmt.Sprint([]int{0, 8, 12}) {
+		t.Fatalf("frames %v, want [0 8 12]", got)
+	}
+}
+
+// TestTemporalLayersDescriptorTID はVP8ペイロードデスクリプタのTID/Y bitの解析を検証する
+func TestTemporalLayersDescriptorTID(t *testing.T) {
+	for i := 0; i < len(l1t3); i++ {
+		d, err := ParseVP8PayloadDescriptor(vp8Descriptor(i, true, true))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !d.HasTID || int(d.TID) != frameTID(i) || d.LayerSync != (frameTID(i) > 0) {
+			t.Fatalf("frame %d: HasTID=%v TID=%d Y=%v, want TID=%d", i, d.HasTID, d.TID, d.LayerSync, frameTID(i))
+		}
+		if d.HeaderSize != 6 {
+			t.Fatalf("frame %d: HeaderSize=%d, want 6", i, d.HeaderSize)
+		}
+	}
+	// K bitのみ（TIDなし）
+	d, err := ParseVP8PayloadDescriptor([]byte{0x90, 0x10, 0xC1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.HasTID || d.TID != 0 {
+		t.Fatalf("KEYIDX-only descriptor parsed as TID %d", d.TID)
+	}
+	if _, err := ParseVP8PayloadDescriptor([]byte{0x90, 0x20}); err == nil {
+		t.Fatalf("truncated TID byte accepted")
+	}
+}
+
+// TestTemporalLayersMax はVP8/VP9のL1T3の各 --max-temporal-layer で受信するフレームを検証する
+func TestTemporalLayersMax(t *testing.T) {
+	for _, codec := range []string{"vp8", "vp9"} {
+		for _, maxLayer := range []int{-1, 0, 1, 2} {
+			t.Run(fmt.Sprintf("%s max %d", codec, maxLayer), func(t *testing.T) {
+				if err := expectLayers(codec, maxLayer); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"encoding/binary"
+	"math"
+	"time"
+)
+
+// --input testsrc の既定値
+const (
+	TestSourceWidth      = 640
+	TestSourceHeight     = 360
+	TestSourceFPS        = 30
+	testSourceSampleRate = 48000
+	testSourceChannels   = 2
+	testSourceChunkMs    = 20
+	testSourceToneHz     = 440
+)
+
+// テストパターンのカラーバー（白、黄、シアン、緑、マゼンタ、赤、青、黒）のBT.601 YUV値
+var testSourceBars = [8][3]byte{
+	{235, 128, 128},
+	{210, 16, 146},
+	{170, 166, 16},
+	{145, 54, 34},
+	{106, 202, 222},
+	{81, 90, 240},
+	{41, 240, 110},
+	{16, 128, 128},
+}
+
+// TestPatternSource はカラーバーと440Hzのトーンを実時間で生成するFrameSource
+// 映像はYUV420Pのrawvideo、音声はS16LEのPCMとして出力するため、whip-goはMKV入力と同じ経路でエンコードする
+// 動きが分かるよう、白い四角がフレームごとに横へ移動する
+type TestPatternSource struct {
+	width       int
+	height      int
+	fps         int
+	startedAt   time.Time
+	videoFrames int64
+	audioChunks int64
+	bars        []byte // カラーバーのみの画像（フレームごとにコピーして四角を描く）
+	tonePhase   float64
+}
+
+// NewTestPatternSource は新しいTestPatternSourceを作成する
+// width/heightはYUV420Pのため偶数に切り捨てる
+func NewTestPatternSource(width, height, fps int) *TestPatternSource {
+	s := &TestPatternSource{
+		width:  width &^ 1,
+		height: height &^ 1,
+		fps:    fps,
+	}
+	s.bars = s.drawBars()
+	return s
+}
+
+func (s *TestPatternSource) VideoWidth() int {
+	return s.width
+}
+
+func (s *TestPatternSource) VideoHeight() int {
+	return s.height
+}
+
+func (s *TestPatternSource) PixelFormat() string {
+	return "YUV420P"
+}
+
+func (s *TestPatternSource) VideoCodec() string {
+	return "V_UNCOMPRESSED"
+}
+
+func (s *TestPatternSource) AudioCodec() string {
+	return "A_PCM/INT/LIT"
+}
+
+func (s *TestPatternSource) AudioSampleRate() int {
+	return testSourceSampleRate
+}
+
+func (s *TestPatternSource) AudioChannels() int {
+	return testSourceChannels
+}
+
+// ReadFrame はPTSの早い順に映像/音声フレームを返す
+// ライブ入力と同じく、各フレームはPTSの時刻になるまで待ってから返す
+func (s *TestPatternSource) ReadFrame() (*Frame, error) {
+	if s.startedAt.IsZero() {
+		s.startedAt = time.Now()
+	}
+
+	videoPTS := s.videoFrames * 1000 / int64(s.fps)
+	audioPTS := s.audioChunks * testSourceChunkMs
+	var frame *Frame
+	if videoPTS <= audioPTS {
+		frame = &Frame{
+			Type:        FrameTypeVideo,
+			Data:        s.videoFrame(s.videoFrames),
+			TimestampMs: videoPTS,
+			IsKeyframe:  true,
+		}
+		s.videoFrames++
+	} else {
+		frame = &Frame{
+			Type:        FrameTypeAudio,
+			Data:        s.audioChunk(),
+			TimestampMs: audioPTS,
+			IsKeyframe:  true,
+		}
+		s.audioChunks++
+	}
+
+	if wait := time.Until(s.startedAt.Add(time.Duration(frame.TimestampMs) * time.Millisecond)); wait > 0 {
+		time.Sleep(wait)
+	}
+	return frame, nil
+}
+
+// drawBars はカラーバーのYUV420P画像を作る
+func (s *TestPatternSource) drawBars() []byte {
+	ySize := s.width * s.height
+	cWidth, cHeight := s.width/2, s.height/2
+	cSize := cWidth * cHeight
+	img := make([]byte, ySize+2*cSize)
+	for y := 0; y < s.height; y++ {
+		for x := 0; x < s.width; x++ {
+			img[y*s.width+x] = testSourceBars[x*len(testSourceBars)/s.width][0]
+		}
+	}
+	for y := 0; y < cHeight; y++ {
+		for x := 0; x < cWidth; x++ {
+			bar := testSourceBars[x*len(testSourceBars)/cWidth]
+			img[ySize+y*cWidth+x] = bar[1]
+			img[ySize+cSize+y*cWidth+x] = bar[2]
+		}
+	}
+	return img
+}
+
+// videoFrame はn番目のフレームを作る（カラーバーの上を白い四角が横に移動する）
+func (s *TestPatternSource) videoFrame(n int64) []byte {
+	img := make([]byte, len(s.bars))
+	copy(img, s.bars)
+
+	size := (s.height / 4) &^ 1
+	if size == 0 {
+		return img
+	}
+	travel := s.width - size
+	left := 0
+	if travel > 0 {
+		left = (int(n*4) % travel) &^ 1
+	}
+	top := ((s.height - size) / 2) &^ 1
+	for y := top; y < top+size; y++ {
+		for x := left; x < left+size; x++ {
+			img[y*s.width+x] = 235
+		}
+	}
+	ySize := s.width * s.height
+	cWidth := s.width / 2
+	cSize := cWidth * (s.height / 2)
+	for y := top / 2; y < (top+size)/2; y++ {
+		for x := left / 2; x < (left+size)/2; x++ {
+			img[ySize+y*cWidth+x] = 128
+			img[ySize+cSize+y*cWidth+x] = 128
+		}
+	}
+	return img
+}
+
+// audioChunk はtestSourceChunkMs分の440Hzトーン（S16LE、インターリーブ）を作る
+func (s *TestPatternSource) audioChunk() []byte {
+	samples := testSourceSampleRate * testSourceChunkMs / 1000
+	pcm := make([]byte, samples*testSourceChannels*2)
+	step := 2 * math.Pi * testSourceToneHz / testSourceSampleRate
+	for i := 0; i < samples; i++ {
+		v := int16(math.Sin(s.tonePhase) * 0.25 * math.MaxInt16)
+		for c := 0; c < testSourceChannels; c++ {
+			binary.LittleEndian.PutUint16(pcm[(i*testSourceChannels+c)*2:], uint16(v))
+		}
+		s.tonePhase += step
+		if s.tonePhase >= 2*math.Pi {
+			s.tonePhase -= 2 * math.Pi
+		}
+	}
+	return pcm
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/pion/ice/v4"
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+// TestTrackClosedErrorClassification はクローズに伴う読み取りエラーだけを正常終了として扱い、
+// メディアのタイムアウト等の本当のエラーは通知対象に残すことを検証する
+func TestTrackClosedErrorClassification(t *testing.T) {
+	closed := []error{
+		io.EOF,
+		io.ErrClosedPipe,
+		ice.ErrClosed,
+		fmt.Errorf("read rtp: %w", io.EOF),
+		fmt.Errorf("srtp: %w", io.ErrClosedPipe),
+		fmt.Errorf("transport: %w", ice.ErrClosed),
+	}
+	for _, err := range closed {
+		if !isTrackClosedError(err) {
+			t.Fatalf("%v was not treated as a closed track", err)
+		}
+	}
+
+	genuine := []error{
+		nil,
+		io.ErrUnexpectedEOF,
+		os.ErrDeadlineExceeded,
+		fmt.Errorf("%w: media stopped, no RTP for %v", ErrMediaTimeout, time.Second),
+		errors.New("EOF"), // 文字列が同じでも別のエラー
+	}
+	for _, err := range genuine {
+		if isTrackClosedError(err) {
+			t.Fatalf("%v was treated as a closed track", err)
+		}
+	}
+}
+
+// TestTrackClosedRead はPeerConnectionを閉じた後のTrackRemote.ReadRTPのエラーが、クローズとして判定されることを検証する
+func TestTrackClosedRead(t *testing.T) {
+	receiver, err := newSubscriber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+	sender, err := newPeerConnection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := sender.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+
+	remote := make(chan *webrtc.TrackRemote, 1)
+	receiver.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		remote <- track
+	})
+	if err := connect(receiver, sender); err != nil {
+		t.Fatal(err)
+	}
+
+	var trackRemote *webrtc.TrackRemote
+	deadline := time.After(setupTimeout)
+	for trackRemote == nil {
+		if err := track.WriteSample(media.Sample{Data: []byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a}, Duration: 33 * time.Millisecond}); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case trackRemote = <-remote:
+		case <-deadline:
+			t.Fatal("track not received")
+		case <-time.After(33 * time.Millisecond):
+		}
+	}
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := trackRemote.ReadRTP(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	if err := receiver.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-readErr:
+		if !isTrackClosedError(err) {
+			t.Fatalf("ReadRTP after Close returned %v (%T), not treated as a closed track", err, err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadRTP did not return after Close")
+	}
+}
@@ -0,0 +1,104 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxTrackNumber はSimpleBlockのトラック番号に使える最大値（4バイトのvint）
+const maxTrackNumber = 1<<28 - 2
+
+// TrackLayout はMKVに書き込む映像・音声のトラック番号とTrackUID
+// 既存のファイルに合わせてremuxする場合に指定する（UIDが0の場合はトラック番号を使う）
+type TrackLayout struct {
+	VideoNum, AudioNum uint64
+	VideoUID, AudioUID uint64
+}
+
+// DefaultTrackLayout は映像を1、音声を2とし、UIDにトラック番号を使う
+var DefaultTrackLayout = TrackLayout{VideoNum: 1, AudioNum: 2, VideoUID: 1, AudioUID: 2}
+
+// withDefaultUIDs はUIDが0のトラックにトラック番号をUIDとして設定する
+func (l TrackLayout) withDefaultUIDs() TrackLayout {
+	if l.VideoUID == 0 {
+		l.VideoUID = l.VideoNum
+	}
+	if l.AudioUID == 0 {
+		l.AudioUID = l.AudioNum
+	}
+	return l
+}
+
+// Validate はトラック番号が1以上でSimpleBlockに書ける範囲にあり、映像と音声で重複しないことを検証する
+func (l TrackLayout) Validate() error {
+	for _, n := range []uint64{l.VideoNum, l.AudioNum} {
+		if n < 1 || n > maxTrackNumber {
+			return fmt.Errorf("invalid track number %d (must be 1..%d)", n, maxTrackNumber)
+		}
+	}
+	if l.VideoNum == l.AudioNum {
+		return fmt.Errorf("video and audio track numbers must differ (both %d)", l.VideoNum)
+	}
+	l = l.withDefaultUIDs()
+	if l.VideoUID == l.AudioUID {
+		return fmt.Errorf("video and audio track UIDs must differ (both %d)", l.VideoUID)
+	}
+	return nil
+}
+
+// ParseTrackLayout は --mkv-track-layout の値（VIDEO[:UID],AUDIO[:UID]）を解析する
+// 空の場合はDefaultTrackLayoutを返す
+func ParseTrackLayout(value string) (TrackLayout, error) {
+	if value == "" {
+		return DefaultTrackLayout, nil
+	}
+	parts := strings.Split(value, ",")
+	if len(parts) != 2 {
+		return TrackLayout{}, fmt.Errorf("invalid --mkv-track-layout: %s (use VIDEO[:UID],AUDIO[:UID], e.g. 1,2 or 3:1001,4:1002)", value)
+	}
+	var nums, uids [2]uint64
+	for i, part := range parts {
+		numStr, uidStr, hasUID := strings.Cut(part, ":")
+		num, err := strconv.ParseUint(strings.TrimSpace(numStr), 10, 64)
+		if err != nil {
+			return TrackLayout{}, fmt.Errorf("invalid --mkv-track-layout: %s (bad track number %q)", value, numStr)
+		}
+		nums[i] = num
+		if hasUID {
+			uid, err := strconv.ParseUint(strings.TrimSpace(uidStr), 10, 64)
+			if err != nil || uid == 0 {
+				return TrackLayout{}, fmt.Errorf("invalid --mkv-track-layout: %s (bad track UID %q)", value, uidStr)
+			}
+			uids[i] = uid
+		}
+	}
+	layout := TrackLayout{VideoNum: nums[0], AudioNum: nums[1], VideoUID: uids[0], AudioUID: uids[1]}
+	if err := layout.Validate(); err != nil {
+		return TrackLayout{}, fmt.Errorf("invalid --mkv-track-layout: %w", err)
+	}
+	return layout.withDefaultUIDs(), nil
+}
+
+// audioTrack はi番目の音声トラックの番号とUIDを返す（0は指定された音声トラック）
+// 2番目以降は音声のトラック番号・UIDに続く値のうち、映像と重ならないものを割り当てる
+func (l TrackLayout) audioTrack(i int) (uint64, uint64) {
+	return skipValue(l.AudioNum, l.VideoNum, i), skipValue(l.AudioUID, l.VideoUID, i)
+}
+
+// validateAudioTracks はcount個の音声トラックの番号がSimpleBlockに書ける範囲に収まることを検証する
+func (l TrackLayout) validateAudioTracks(count int) error {
+	if num, _ := l.audioTrack(count - 1); num > maxTrackNumber {
+		return fmt.Errorf("audio track number %d for %d audio tracks exceeds %d", num, count, maxTrackNumber)
+	}
+	return nil
+}
+
+// skipValue はbaseからi番目の値を、skipを飛ばして数えて返す
+func skipValue(base, skip uint64, i int) uint64 {
+	v := base + uint64(i)
+	if base < skip && v >= skip {
+		v++
+	}
+	return v
+}
@@ -0,0 +1,295 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+const (
+	trackLayoutWidth       = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	trackLayoutHeight      = 360
+	trackLayoutVideoFrames = 30 // 30fps x 1秒（1つのClusterに収まる）
+	trackLayoutAudioFrames = 50 // 20ms x 1秒
+	trackLayoutVideoTSStep = 3000
+	trackLayoutAudioTSStep = 960
+)
+
+// trackLayoutWriteMKV はlayoutを設定したRawVideoMKVWriterで映像と音声を書き込んだ出力を返す
+func trackLayoutWriteMKV(layout TrackLayout) ([]byte, error) {
+	encoder, err := NewVP8Encoder(trackLayoutWidth, trackLayoutHeight, "YUV420P", 500)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	if err := writer.SetTrackLayout(layout); err != nil {
+		return nil, err
+	}
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	yuv := make([]byte, trackLayoutWidth*trackLayoutHeight*3/2)
+	audio := 0
+	for i := 0; i < trackLayoutVideoFrames; i++ {
+		for j := range yuv {
+			yuv[j] = byte(j + i*3)
+		}
+		encoded, keyframe, err := encoder.Encode(yuv)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		if err := writer.WriteVideoFrame(encoded, uint32(i*trackLayoutVideoTSStep), keyframe); err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		// 映像フレームの時刻までの音声を書き込む
+		for ; audio < trackLayoutAudioFrames && audio*20 <= i*100/3; audio++ {
+			if err := writer.WriteAudioFrame(opusSilence, uint32(audio*trackLayoutAudioTSStep)); err != nil {
+				return nil, fmt.Errorf("audio frame %d: %v", audio, err)
+			}
+		}
+	}
+	for ; audio < trackLayoutAudioFrames; audio++ {
+		if err := writer.WriteAudioFrame(opusSilence, uint32(audio*trackLayoutAudioTSStep)); err != nil {
+			return nil, fmt.Errorf("audio frame %d: %v", audio, err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := <-runErr; err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func uintValue(data []byte) uint64 {
+	var v uint64
+	for _, b := range data {
+		v = v<<8 | uint64(b)
+	}
+	return v
+}
+
+// mkvLayout はMKVを要素単位でたどった結果
+type mkvLayout struct {
+	entries    [][2]uint64 // TrackEntryごとの（TrackNumber, TrackUID）
+	blockTrack map[uint64]int
+	blocks     []int // SimpleBlockの要素先頭のオフセット
+}
+
+// walk はdataの要素をたどり、TrackEntryとSimpleBlockのトラック番号を集める
+// Segment/Tracks/TrackEntry/Clusterは子要素に降りる（サイズ不定の場合は残り全体を子要素とみなす）
+func walk(data []byte, base int, layout *mkvLayout) error {
+	for pos := 0; pos < len(data); {
+		id, idLen := readVint(data[pos:], true)
+		size, sizeLen := readVint(data[pos+idLen:], false)
+		if idLen == 0 || sizeLen == 0 {
+			return fmt.Errorf("invalid element header at offset %d", base+pos)
+		}
+		start := pos + idLen + sizeLen
+		end := start + int(size)
+		if size == 1<<(7*sizeLen)-1 || end > len(data) {
+			end = len(data)
+		}
+		body := data[start:end]
+		switch id {
+		case 0x18538067, 0x1654AE6B, 0x1F43B675: // Segment, Tracks, Cluster
+			if err := walk(body, base+start, layout); err != nil {
+				return err
+			}
+		case 0xAE: // TrackEntry
+			var entry [2]uint64
+			for p := 0; p < len(body); {
+				cid, cidLen := readVint(body[p:], true)
+				csize, csizeLen := readVint(body[p+cidLen:], false)
+				value := body[p+cidLen+csizeLen : p+cidLen+csizeLen+int(csize)]
+				switch cid {
+				case 0xD7:
+					entry[0] = uintValue(value)
+				case 0x73C5:
+					entry[1] = uintValue(value)
+				}
+				p += cidLen + csizeLen + int(csize)
+			}
+			layout.entries = append(layout.entries, entry)
+		case 0xA3: // SimpleBlock
+			track, _ := readVint(body, false)
+			layout.blockTrack[track]++
+			layout.blocks = append(layout.blocks, base+pos)
+		}
+		pos = end
+	}
+	return nil
+}
+
+// trackLayoutReadFrames はMKVReaderで最後まで読み、映像と音声のフレーム数と再同期の回数を返す
+func trackLayoutReadFrames(data []byte) (int, int, int, error) {
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	video, audio := 0, 0
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return video, audio, reader.Resyncs(), nil
+		}
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		if frame.Type == FrameTypeVideo {
+			video++
+		} else {
+			audio++
+		}
+	}
+}
+
+// TestTrackLayoutParse は --mkv-track-layout の解析と検証を確認する
+func TestTrackLayoutParse(t *testing.T) {
+	disableFrameValidation(t)
+	valid := []struct {
+		value string
+		want  TrackLayout
+	}{
+		{"", DefaultTrackLayout},
+		{"3,4", TrackLayout{VideoNum: 3, AudioNum: 4, VideoUID: 3, AudioUID: 4}},
+		{"130:1001,2", TrackLayout{VideoNum: 130, AudioNum: 2, VideoUID: 1001, AudioUID: 2}},
+		{"1:18446744073709551615,2:7", TrackLayout{VideoNum: 1, AudioNum: 2, VideoUID: 18446744073709551615, AudioUID: 7}},
+	}
+	for _, c := range valid {
+		got, err := ParseTrackLayout(c.value)
+		if err != nil {
+			t.Fatalf("%q rejected: %v", c.value, err)
+		}
+		if got != c.want {
+			t.Fatalf("%q parsed as %+v, want %+v", c.value, got, c.want)
+		}
+	}
+	for _, value := range []string{"1", "1,2,3", "1,1", "0,2", "a,2", "1:0,2", "1:5,2:5", "1,2:1", "268435455,1", "-1,2"} {
+		if _, err := ParseTrackLayout(value); err == nil {
+			t.Fatalf("%q accepted", value)
+		}
+	}
+}
+
+// TestTrackLayoutDefault はレイアウト未指定時に従来どおりトラック1/2、UIDはトラック番号になることを検証する
+func TestTrackLayoutDefault(t *testing.T) {
+	disableFrameValidation(t)
+	data, err := trackLayoutWriteMKV(DefaultTrackLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := &mkvLayout{blockTrack: map[uint64]int{}}
+	if err := walk(data, 0, layout); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(layout.entries) != "[[1 1] [2 2]]" {
+		t.Fatalf("track entries %v, want [[1 1] [2 2]]", layout.entries)
+	}
+}
+
+// TestTrackLayoutMultiByte はトラック番号130（2バイトのvint）とUIDを書き込み、MKVReaderで読み戻せることを検証する
+func TestTrackLayoutMultiByte(t *testing.T) {
+	disableFrameValidation(t)
+	data, err := trackLayoutWriteMKV(TrackLayout{VideoNum: 130, AudioNum: 2, VideoUID: 1001})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := &mkvLayout{blockTrack: map[uint64]int{}}
+	if err := walk(data, 0, layout); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(layout.entries) != "[[130 1001] [2 2]]" {
+		t.Fatalf("track entries %v, want [[130 1001] [2 2]]", layout.entries)
+	}
+	if layout.blockTrack[130] != trackLayoutVideoFrames || layout.blockTrack[2] != trackLayoutAudioFrames || len(layout.blockTrack) != 2 {
+		t.Fatalf("SimpleBlocks per track %v, want 130:%d 2:%d", layout.blockTrack, trackLayoutVideoFrames, trackLayoutAudioFrames)
+	}
+	// トラック番号130は0x40 0x82と符号化される
+	first := layout.blocks[0]
+	if _, sizeLen := readVint(data[first+1:], false); !bytes.HasPrefix(data[first+1+sizeLen:], []byte{0x40, 0x82}) {
+		t.Fatalf("first SimpleBlock track number bytes %X, want 4082", data[first+1+sizeLen:first+3+sizeLen])
+	}
+
+	video, audio, _, err := trackLayoutReadFrames(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video != trackLayoutVideoFrames || audio != trackLayoutAudioFrames {
+		t.Fatalf("read %d video and %d audio frames, want %d and %d", video, audio, trackLayoutVideoFrames, trackLayoutAudioFrames)
+	}
+}
+
+// TestTrackLayoutResync は2バイトのトラック番号のSimpleBlockでも、サイズ破損後にClusterを待たずに再同期できることを検証する
+func TestTrackLayoutResync(t *testing.T) {
+	disableFrameValidation(t)
+	data, err := trackLayoutWriteMKV(TrackLayout{VideoNum: 130, AudioNum: 131})
+	if err != nil {
+		t.Fatal(err)
+	}
+	layout := &mkvLayout{blockTrack: map[uint64]int{}}
+	if err := walk(data, 0, layout); err != nil {
+		t.Fatal(err)
+	}
+	// Clusterの途中にある映像ブロック（サイズが3バイトのvint）のサイズを3バイト増やす
+	pos, size, sizeLen := 0, uint64(0), 0
+	for _, p := range layout.blocks[len(layout.blocks)/2:] {
+		if size, sizeLen = readVint(data[p+1:], false); sizeLen == 3 {
+			pos = p
+			break
+		}
+	}
+	if sizeLen != 3 {
+		t.Fatalf("no block with a 3-byte size after the middle of the stream")
+	}
+	size += 3
+	data[pos+1] = byte(size>>16) | 0x20
+	data[pos+2] = byte(size >> 8)
+	data[pos+3] = byte(size)
+
+	video, audio, resyncs, err := trackLayoutReadFrames(data)
+	if err != nil {
+		t.Fatalf("reader did not recover: %v", err)
+	}
+	if resyncs != 1 {
+		t.Fatalf("resync count = %d, want 1", resyncs)
+	}
+	// 破損したブロックとその直後の要素のみ失われうる
+	if video+audio < trackLayoutVideoFrames+trackLayoutAudioFrames-2 {
+		t.Fatalf("lost too many frames: video %d/%d, audio %d/%d", video, trackLayoutVideoFrames, audio, trackLayoutAudioFrames)
+	}
+}
+
+// TestTrackLayoutSetTrackLayout は不正なレイアウトとヘッダー書き込み後の変更を拒否することを検証する
+func TestTrackLayoutSetTrackLayout(t *testing.T) {
+	disableFrameValidation(t)
+	writer := NewRawVideoMKVWriter(io.Discard, "vp8")
+	if err := writer.SetTrackLayout(TrackLayout{VideoNum: 1, AudioNum: 1}); err == nil {
+		t.Fatalf("duplicate track numbers accepted")
+	}
+	if err := writer.SetTrackLayout(TrackLayout{VideoNum: 0, AudioNum: 2}); err == nil {
+		t.Fatalf("track number 0 accepted")
+	}
+
+	encoder, err := NewVP8Encoder(trackLayoutWidth, trackLayoutHeight, "YUV420P", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	encoded, keyframe, err := encoder.Encode(make([]byte, trackLayoutWidth*trackLayoutHeight*3/2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	go writer.Run()
+	defer writer.Close()
+	if err := writer.WriteVideoFrame(encoded, 0, keyframe); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.SetTrackLayout(TrackLayout{VideoNum: 3, AudioNum: 4}); err == nil {
+		t.Fatalf("track layout changed after the header was written")
+	}
+}
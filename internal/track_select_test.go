@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// trackSelectVP8Keyframe はVP8のペイロードデスクリプタ（Sビット）とキーフレームの先頭
+// 末尾にトラックを区別するマーカーを付けて送る
+var trackSelectVP8Keyframe = []byte{0x10, 0x50, 0x42, 0x00, 0x9D, 0x01, 0x2A, 0x80, 0x02, 0x68, 0x01}
+
+// videoRecorder は映像フレーム末尾のマーカーごとの書き込み回数を記録するStreamWriter
+type videoRecorder struct {
+	mu      sync.Mutex
+	markers map[byte]int
+}
+
+func (w *videoRecorder) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.markers[data[len(data)-1]]++
+	return nil
+}
+
+func (w *videoRecorder) WriteAudioFrame(data []byte, timestamp uint32) error { return nil }
+func (w *videoRecorder) Run() error                                          { return nil }
+func (w *videoRecorder) Close() error                                        { return nil }
+
+// snapshot は書き込まれたマーカーの一覧を昇順で返す
+func (w *videoRecorder) snapshot() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var markers []byte
+	for marker := range w.markers {
+		markers = append(markers, marker)
+	}
+	sort.Slice(markers, func(i, j int) bool { return markers[i] < markers[j] })
+	return markers
+}
+
+// trackSelectNewSender は2つのVP8映像トラック（マーカー0と1）を送信するPeerConnectionを作成し、各トラックのSSRCを返す
+func trackSelectNewSender() (*webrtc.PeerConnection, []*webrtc.TrackLocalStaticRTP, []uint32, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	var tracks []*webrtc.TrackLocalStaticRTP
+	var ssrcs []uint32
+	for _, id := range []string{"main", "alternate"} {
+		track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, id, id)
+		if err != nil {
+			peerConnection.Close()
+			return nil, nil, nil, err
+		}
+		sender, err := peerConnection.AddTrack(track)
+		if err != nil {
+			peerConnection.Close()
+			return nil, nil, nil, err
+		}
+		tracks = append(tracks, track)
+		ssrcs = append(ssrcs, uint32(sender.GetParameters().Encodings[0].SSRC))
+	}
+	return peerConnection, tracks, ssrcs, nil
+}
+
+// trackSelectLoopback は2つの映像トラックを受信し、writerに書き込まれたマーカーを返す
+// selectTrackは送信側のSSRCを知った後、受信側の作成前に --ssrc / --mid を設定する
+func trackSelectLoopback(selectTrack func(ssrcs []uint32)) ([]byte, error) {
+	senderPC, tracks, ssrcs, err := trackSelectNewSender()
+	if err != nil {
+		return nil, err
+	}
+	defer senderPC.Close()
+	selectTrack(ssrcs)
+	defer func() {
+		SelectSSRC = 0
+		SelectMID = ""
+	}()
+
+	writer := &videoRecorder{markers: map[byte]int{}}
+	streamManager := NewStreamManager(writer, NewDefaultRTPProcessor(), 0, nil)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, err
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		return nil, err
+	}
+	defer receiver.Close()
+
+	if err := connect(receiver, senderPC); err != nil {
+		return nil, err
+	}
+
+	go streamManager.Run()
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	defer func() {
+		receiver.Close()
+		streamManager.Stop()
+	}()
+
+	// SRTPの準備完了前のパケットは破棄されるため、しばらく両方のトラックからキーフレームを送り続ける
+	for i := 0; i < 60; i++ {
+		for marker, track := range tracks {
+			packet := &rtp.Packet{
+				Header:  rtp.Header{Version: 2, Marker: true, SequenceNumber: uint16(i), Timestamp: uint32(i * 3000)},
+				Payload: append(append([]byte(nil), trackSelectVP8Keyframe...), byte(marker)),
+			}
+			if err := track.WriteRTP(packet); err != nil {
+				return nil, err
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return writer.snapshot(), nil
+}
+
+// trackSelectCheck は指定したトラックのマーカーwantのみが書き込まれたことを検証する
+func trackSelectCheck(name string, selectTrack func(ssrcs []uint32), want byte) error {
+	got, err := trackSelectLoopback(selectTrack)
+	if err != nil {
+		return err
+	}
+	if len(got) != 1 || got[0] != want {
+		return fmt.Errorf("%s: frames written from tracks %v, want only track %d", name, got, want)
+	}
+	return nil
+}
+
+// TestTrackSelectSSRC は --ssrc で2番目の映像トラックのSSRCを指定すると、そのトラックのみが書き込まれることを検証する
+func TestTrackSelectSSRC(t *testing.T) {
+	if err := trackSelectCheck("--ssrc", func(ssrcs []uint32) { SelectSSRC = ssrcs[1] }, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTrackSelectMID は --mid で最初の映像m-lineを指定すると、そのトラックのみが書き込まれることを検証する
+func TestTrackSelectMID(t *testing.T) {
+	if err := trackSelectCheck("--mid", func([]uint32) { SelectMID = "0" }, 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTrackSelectSelected は --ssrc / --mid の一致判定を検証する
+func TestTrackSelectSelected(t *testing.T) {
+	cases := []struct {
+		ssrc     uint32
+		mid      string
+		wantSSRC uint32
+		wantMID  string
+		want     bool
+	}{
+		{1234, "0", 0, "", true},
+		{1234, "0", 1234, "", true},
+		{1234, "0", 5678, "", false},
+		{1234, "1", 0, "1", true},
+		{1234, "1", 0, "0", false},
+		{1234, "1", 1234, "1", true},
+		{1234, "1", 1234, "0", false},
+	}
+	for _, c := range cases {
+		if got := VideoTrackSelected(c.ssrc, c.mid, c.wantSSRC, c.wantMID); got != c.want {
+			t.Fatalf("ssrc=%d mid=%s with --ssrc %d --mid %q: got %v, want %v", c.ssrc, c.mid, c.wantSSRC, c.wantMID, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v4"
+)
+
+const twccFeedbackLogInterval = 5 * time.Second
+
+// twccFeedbackSent は送信したTWCCフィードバック（transport-cc）のRTCPパケット数
+var twccFeedbackSent atomic.Int64
+
+// TWCCFeedbackSent はこれまでに送信したTWCCフィードバックのRTCPパケット数を返す
+func TWCCFeedbackSent() int64 {
+	return twccFeedbackSent.Load()
+}
+
+// twccExtensionID はネゴシエーションされたtransport-wide-ccヘッダー拡張のIDを返す（無い場合は0）
+// 拡張が無ければ送信側はシーケンス番号を付けず、フィードバックも送られない
+func twccExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == sdp.TransportCCURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// logTWCCNegotiation は受信トラックでTWCCフィードバックを送るかどうかを表示する
+func logTWCCNegotiation(kind webrtc.RTPCodecType, receiver *webrtc.RTPReceiver) {
+	if !ExtensionEnabled("transport-cc") {
+		return
+	}
+	if id := twccExtensionID(receiver); id != 0 {
+		DebugLog("TWCC: sending feedback for the %s track (transport-wide-cc extension id=%d)\n", kind, id)
+		return
+	}
+	DebugLog("TWCC: answer has no transport-wide-cc extension for the %s track, no feedback is sent\n", kind)
+}
+
+// twccFeedbackLoggerFactory はTWCCフィードバックの送信を数えるインターセプターを作成する
+// 先に登録したインターセプターほど送信路の下流になるため、TWCCのインターセプターより前に登録する
+type twccFeedbackLoggerFactory struct{}
+
+func (twccFeedbackLoggerFactory) NewInterceptor(_ string) (interceptor.Interceptor, error) {
+	return &twccFeedbackLogger{}, nil
+}
+
+// twccFeedbackLogger は送信するRTCPのうちTWCCフィードバックを数え、定期的にデバッグ表示する
+type twccFeedbackLogger struct {
+	interceptor.NoOp
+}
+
+func (l *twccFeedbackLogger) BindRTCPWriter(writer interceptor.RTCPWriter) interceptor.RTCPWriter {
+	return interceptor.RTCPWriterFunc(func(pkts []rtcp.Packet, attributes interceptor.Attributes) (int, error) {
+		for _, pkt := range pkts {
+			feedback, ok := pkt.(*rtcp.TransportLayerCC)
+			if !ok {
+				continue
+			}
+			total := twccFeedbackSent.Add(1)
+			DebugLogPeriodic("twcc.feedback", twccFeedbackLogInterval,
+				"TWCC: feedback sent for media SSRC %x: %d packets from seq %d (%d feedback packets total)\n",
+				feedback.MediaSSRC, feedback.PacketStatusCount, feedback.BaseSequenceNumber, total)
+		}
+		return writer.Write(pkts, attributes)
+	})
+}
@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pion/interceptor"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	twccFeedbackOpusTicks = 960 // 20ms（48kHz）
+	twccFeedbackOpusStep  = 20 * time.Millisecond
+	// 受信側のTWCCインターセプターは100msごとにフィードバックを送る
+	sendDuration = time.Second
+)
+
+// feedbackCount はwhep-goと同じ受信側に、transport-wide-ccのシーケンス番号を付ける送信側から音声を送り、
+// 送信側が受け取ったTWCCフィードバックの数と、受信側が数えた送信数の増分を返す
+func feedbackCount() (received int, sent int64, err error) {
+	mediaReceived := make(chan struct{}, 1)
+	streamManager := NewStreamManager(discardWriter{}, NewDefaultRTPProcessor(), 0, mediaReceived)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return 0, 0, err
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer receiver.Close()
+
+	// libwebrtc等の送信側と同じく、ネゴシエーションされていればパケットにシーケンス番号を付ける
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		return 0, 0, err
+	}
+	registry := &interceptor.Registry{}
+	if err := webrtc.ConfigureTWCCHeaderExtensionSender(senderEngine, registry); err != nil {
+		return 0, 0, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithInterceptorRegistry(registry),
+		webrtc.WithSettingEngine(NewSettingEngine()))
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}, "audio", "test")
+	if err != nil {
+		return 0, 0, err
+	}
+	rtpSender, err := sender.AddTrack(track)
+	if err != nil {
+		return 0, 0, err
+	}
+	if err := connect(receiver, sender); err != nil {
+		return 0, 0, err
+	}
+
+	feedback := make(chan struct{}, 1000)
+	go func() {
+		for {
+			packets, _, err := rtpSender.ReadRTCP()
+			if err != nil {
+				return
+			}
+			for _, packet := range packets {
+				if _, ok := packet.(*rtcp.TransportLayerCC); ok {
+					feedback <- struct{}{}
+				}
+			}
+		}
+	}()
+
+	go streamManager.Run()
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	defer func() {
+		receiver.Close()
+		streamManager.Stop()
+	}()
+
+	var seq uint16
+	send := func() error {
+		seq++
+		return track.WriteRTP(&rtp.Packet{
+			Header:  rtp.Header{Version: 2, SequenceNumber: seq, Timestamp: uint32(seq) * twccFeedbackOpusTicks},
+			Payload: []byte{0xF8, 0xFF, 0xFE},
+		})
+	}
+
+	// SRTPの準備完了前のパケットは破棄されるため、最初のメディアが届くまで送り続ける
+	deadline := time.Now().Add(5 * time.Second)
+	for received := false; !received; {
+		if time.Now().After(deadline) {
+			return 0, 0, fmt.Errorf("no media received within 5s")
+		}
+		if err := send(); err != nil {
+			return 0, 0, err
+		}
+		select {
+		case <-mediaReceived:
+			received = true
+		case <-time.After(twccFeedbackOpusStep):
+		}
+	}
+
+	before := TWCCFeedbackSent()
+	for len(feedback) > 0 {
+		<-feedback
+	}
+	for end := time.Now().Add(sendDuration); time.Now().Before(end); {
+		if err := send(); err != nil {
+			return 0, 0, err
+		}
+		time.Sleep(twccFeedbackOpusStep)
+	}
+	time.Sleep(300 * time.Millisecond)
+	return len(feedback), TWCCFeedbackSent() - before, nil
+}
+
+// TestTWCCFeedback はtransport-wide-ccのシーケンス番号付きで届いたパケットに対して、
+// 受信側がTWCCフィードバックを定期的に送り、送信数を数えることを検証する
+func TestTWCCFeedback(t *testing.T) {
+	received, sent, err := feedbackCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 100msごとなので1秒で約10回
+	if received < 5 {
+		t.Fatalf("sender received %d TWCC feedback packets in %v, want about 10", received, sendDuration)
+	}
+	if sent < int64(received) {
+		t.Fatalf("receiver counted %d TWCC feedback packets sent, sender received %d", sent, received)
+	}
+}
+
+// TestTWCCFeedbackNoFeedback は --no-twcc-feedback でtransport-wide-ccをネゴシエーションせず、フィードバックを送らないことを検証する
+func TestTWCCFeedbackNoFeedback(t *testing.T) {
+	NoTWCC = true
+	defer func() { NoTWCC = false }()
+	received, sent, err := feedbackCount()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != 0 || sent != 0 {
+		t.Fatalf("sender received %d and receiver counted %d TWCC feedback packets, want none", received, sent)
+	}
+}
@@ -0,0 +1,67 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// createSession は2段階のハンドシェイクの1段階目として、本文の無いPOSTでセッションリソースを作成する
+// 応答のLinkヘッダーのICEサーバーはoffer作成前にPeerConnectionへ設定する
+// サーバーが空のPOSTを4xxで拒否した場合や、Locationを返さない場合はfalseを返し、offerのPOSTにフォールバックする
+func (s *httpSession) createSession(peerConnection *webrtc.PeerConnection) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.endpointURL, nil)
+	if err != nil {
+		return false, err
+	}
+
+	fmt.Fprintf(os.Stderr, "Creating %s session before the offer (two-phase)...\n", s.protocol)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", ErrConnection, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	location := resp.Header.Get("Location")
+	switch {
+	case resp.StatusCode >= 500:
+		return false, &ServerError{Protocol: s.protocol, StatusCode: resp.StatusCode, Body: string(body)}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		// 認証の失敗はofferのPOSTでも変わらない
+		return false, &ServerError{Protocol: s.protocol, StatusCode: resp.StatusCode, Body: string(body)}
+	case resp.StatusCode >= 300:
+		fmt.Fprintf(os.Stderr, "%s server rejected the POST without an offer (status %d), falling back to a single POST\n", s.protocol, resp.StatusCode)
+		return false, nil
+	case location == "":
+		fmt.Fprintf(os.Stderr, "%s server returned no Location for the POST without an offer, falling back to a single POST\n", s.protocol)
+		return false, nil
+	}
+
+	s.resourceURL = s.resolveURL(location)
+	s.links = s.parseLinks(resp.Header)
+	DebugLog("%s session resource: %s (two-phase, status %d)\n", s.protocol, s.resourceURL, resp.StatusCode)
+	if added := s.applyICEServers(peerConnection, iceServersFromLinks(s.links)); added > 0 {
+		fmt.Fprintf(os.Stderr, "Using %d ICE server(s) from the %s session\n", added, s.protocol)
+	}
+	return true, nil
+}
+
+// patchOffer は2段階のハンドシェイクの2段階目として、offerをセッションリソースへPATCHし、answerを返す
+// 失敗した場合は作成済みのセッションを残さないようDELETEする
+func (s *httpSession) patchOffer(offerSDP string) ([]byte, error) {
+	answer, header, err := s.patch("application/sdp", []byte(offerSDP), nil)
+	if err == nil && len(answer) == 0 {
+		err = fmt.Errorf("%s server returned no answer to the offer PATCH", s.protocol)
+	}
+	if err != nil {
+		s.deleteOrphan(s.resourceURL)
+		s.resourceURL = ""
+		return nil, err
+	}
+	s.links = append(s.links, s.parseLinks(header)...)
+	return answer, nil
+}
@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const stunServer = "stun:stun.example.com:3478"
+
+// サーバーの動作
+const (
+	serverTwoPhase = "two-phase" // 空のPOSTでセッションを作り、offerはPATCHでのみ受け付ける
+	serverAccepted = "accepted"  // offerのPOSTに202とLocationのみを返し、answerはPATCHで返す
+	serverSingle   = "single"    // 従来のWHEP（空のPOSTは400）
+)
+
+// mockEndpoint はmodeに従って応答するWHEPサーバー
+// 受け取ったリクエストを"POST(empty)"、"POST(offer)"、"PATCH"、"DELETE /session/1"の形で記録する
+type mockEndpoint struct {
+	mode        string
+	patchStatus int // 0以外ならPATCHにこのステータスを返す
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (e *mockEndpoint) record(request string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.requests = append(e.requests, request)
+}
+
+func (e *mockEndpoint) sequence() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return strings.Join(e.requests, ", ")
+}
+
+func (e *mockEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		if len(body) == 0 {
+			e.record("POST(empty)")
+			if e.mode != serverTwoPhase {
+				http.Error(w, "missing offer", http.StatusBadRequest)
+				return
+			}
+			w.Header().Set("Location", "/session/1")
+			w.Header().Add("Link", fmt.Sprintf("<%s>; rel=\"ice-server\"", stunServer))
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		e.record("POST(offer)")
+		switch e.mode {
+		case serverTwoPhase:
+			http.Error(w, "send the offer by PATCH", http.StatusBadRequest)
+		case serverAccepted:
+			w.Header().Set("Location", "/session/1")
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			e.answer(w, string(body), http.StatusCreated)
+		}
+	case http.MethodPatch:
+		e.record("PATCH")
+		if e.patchStatus != 0 {
+			http.Error(w, "patch failed", e.patchStatus)
+			return
+		}
+		if r.URL.Path != "/session/1" || r.Header.Get("Content-Type") != "application/sdp" {
+			http.Error(w, "unexpected PATCH", http.StatusBadRequest)
+			return
+		}
+		e.answer(w, string(body), http.StatusOK)
+	case http.MethodDelete:
+		e.record("DELETE " + r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// answer はofferに対するanswerをstatusで返す
+func (e *mockEndpoint) answer(w http.ResponseWriter, offer string, status int) {
+	answer, err := createAnswer(offer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/sdp")
+	if status == http.StatusCreated {
+		w.Header().Set("Location", "/session/1")
+	}
+	w.WriteHeader(status)
+	io.WriteString(w, answer)
+}
+
+// twoPhaseResult はSDP交換の結果
+type twoPhaseResult struct {
+	err        error
+	requests   string
+	resource   string // セッションのリソースURL（サーバーのURLを除いたパス）
+	iceServers []string
+	remoteSet  bool // answerがリモートSDPとして設定された
+}
+
+// twoPhaseExchange はmodeのサーバーと、twoPhaseを指定したWHEPSessionでSDPを交換する
+func twoPhaseExchange(endpoint *mockEndpoint, twoPhase bool) (twoPhaseResult, error) {
+	server := httptest.NewServer(endpoint)
+	defer server.Close()
+
+	peerConnection, err := newSubscriber()
+	if err != nil {
+		return twoPhaseResult{}, err
+	}
+	defer peerConnection.Close()
+
+	session := NewWHEPSession(server.URL)
+	session.SetTwoPhase(twoPhase)
+	r := twoPhaseResult{err: session.ExchangeSDP(peerConnection)}
+	r.requests = endpoint.sequence()
+	r.resource = strings.TrimPrefix(session.ResourceURL(), server.URL)
+	for _, iceServer := range peerConnection.GetConfiguration().ICEServers {
+		r.iceServers = append(r.iceServers, iceServer.URLs...)
+	}
+	r.remoteSet = peerConnection.RemoteDescription() != nil
+	return r, nil
+}
+
+// TestTwoPhase は --whep-two-phase で空のPOSTのICEサーバーをofferの前に設定し、offerをPATCHで送ることを検証する
+func TestTwoPhase(t *testing.T) {
+	r, err := twoPhaseExchange(&mockEndpoint{mode: serverTwoPhase}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.err != nil {
+		t.Fatalf("exchange failed: %v (requests: %s)", r.err, r.requests)
+	}
+	if r.requests != "POST(empty), PATCH" {
+		t.Fatalf("requests %q, want \"POST(empty), PATCH\"", r.requests)
+	}
+	if r.resource != "/session/1" || !r.remoteSet {
+		t.Fatalf("resource %q, answer set %v, want /session/1 and the PATCH answer", r.resource, r.remoteSet)
+	}
+	if strings.Join(r.iceServers, ",") != stunServer {
+		t.Fatalf("ICE servers %v, want %s from the empty POST", r.iceServers, stunServer)
+	}
+}
+
+// TestTwoPhaseAutoDetect はフラグが無くても、offerのPOSTに202とLocationのみが返った場合に、offerをPATCHで送ることを検証する
+func TestTwoPhaseAutoDetect(t *testing.T) {
+	r, err := twoPhaseExchange(&mockEndpoint{mode: serverAccepted}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.err != nil {
+		t.Fatalf("exchange failed: %v (requests: %s)", r.err, r.requests)
+	}
+	if r.requests != "POST(offer), PATCH" || r.resource != "/session/1" || !r.remoteSet {
+		t.Fatalf("requests %q with resource %q (answer set %v), want \"POST(offer), PATCH\" with /session/1", r.requests, r.resource, r.remoteSet)
+	}
+}
+
+// TestTwoPhaseFallback は従来のサーバーが空のPOSTを拒否した場合に、offerのPOSTで交換することを検証する
+func TestTwoPhaseFallback(t *testing.T) {
+	r, err := twoPhaseExchange(&mockEndpoint{mode: serverSingle}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.err != nil {
+		t.Fatalf("exchange failed: %v (requests: %s)", r.err, r.requests)
+	}
+	if r.requests != "POST(empty), POST(offer)" || r.resource != "/session/1" || !r.remoteSet {
+		t.Fatalf("requests %q with resource %q (answer set %v), want \"POST(empty), POST(offer)\" with /session/1", r.requests, r.resource, r.remoteSet)
+	}
+}
+
+// TestTwoPhasePatchFailure はofferのPATCHが失敗した場合に、ServerErrorを返して作成済みのセッションをDELETEすることを検証する
+func TestTwoPhasePatchFailure(t *testing.T) {
+	r, err := twoPhaseExchange(&mockEndpoint{mode: serverTwoPhase, patchStatus: http.StatusServiceUnavailable}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var serverErr *ServerError
+	if !errors.As(r.err, &serverErr) || serverErr.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("got %v, want a 503 ServerError", r.err)
+	}
+	if r.requests != "POST(empty), PATCH, DELETE /session/1" {
+		t.Fatalf("requests %q, want the session DELETEd after the failed PATCH", r.requests)
+	}
+	if r.resource != "" {
+		t.Fatalf("resource %q left after the failed PATCH", r.resource)
+	}
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/pion/transport/v4"
+)
+
+// recvBufferNet はpionが開くUDPソケットの受信バッファサイズを設定するtransport.Net
+// pionのSettingEngineは受信バッファを直接設定できないため、dscpNetと同様にソケット作成をフックする
+type recvBufferNet struct {
+	transport.Net
+	size     int
+	logOnce  sync.Once
+	warnOnce sync.Once
+}
+
+// NewRecvBufferNet はbaseが開くUDPソケットに受信バッファsize（バイト）を要求するtransport.Netを作成する
+func NewRecvBufferNet(base transport.Net, size int) transport.Net {
+	return &recvBufferNet{Net: base, size: size}
+}
+
+// ListenUDP はICEのホスト候補・srflx候補のソケットを作成する
+func (n *recvBufferNet) ListenUDP(network string, locAddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.ListenUDP(network, locAddr)
+	if err == nil {
+		n.apply(conn)
+	}
+	return conn, err
+}
+
+// ListenPacket はTURNのrelay候補のソケットを作成する
+func (n *recvBufferNet) ListenPacket(network string, address string) (net.PacketConn, error) {
+	conn, err := n.Net.ListenPacket(network, address)
+	if err == nil {
+		n.apply(conn)
+	}
+	return conn, err
+}
+
+// DialUDP はsrflx候補の問い合わせ用ソケットを作成する
+func (n *recvBufferNet) DialUDP(network string, laddr, raddr *net.UDPAddr) (transport.UDPConn, error) {
+	conn, err := n.Net.DialUDP(network, laddr, raddr)
+	if err == nil {
+		n.apply(conn)
+	}
+	return conn, err
+}
+
+// apply はソケットの受信バッファを設定し、最初のソケットで実際のサイズを表示する
+// OSが要求より小さく制限した場合は一度だけ警告する
+func (n *recvBufferNet) apply(conn any) {
+	udpConn, ok := conn.(*net.UDPConn)
+	if !ok {
+		return
+	}
+	if err := udpConn.SetReadBuffer(n.size); err != nil {
+		n.warnOnce.Do(func() {
+			fmt.Fprintf(os.Stderr, "Warning: --udp-recv-buffer not applied: %v\n", err)
+		})
+		return
+	}
+	effective, err := SocketRecvBuffer(udpConn)
+	if err != nil {
+		n.logOnce.Do(func() {
+			fmt.Fprintf(os.Stderr, "UDP receive buffer: requested %d bytes (effective size unknown: %v)\n", n.size, err)
+		})
+		return
+	}
+	n.logOnce.Do(func() {
+		fmt.Fprintf(os.Stderr, "UDP receive buffer: requested %d bytes, effective %d bytes\n", n.size, effective)
+	})
+	if effective < n.size {
+		n.warnOnce.Do(func() {
+			fmt.Fprintf(os.Stderr, "Warning: OS clamped the UDP receive buffer to %d bytes (requested %d); raise the limit (Linux: sysctl net.core.rmem_max) to avoid loss at high bitrate\n", effective, n.size)
+		})
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd)
+
+package internal
+
+import (
+	"errors"
+	"net"
+)
+
+// SocketRecvBuffer はソケットの実際の受信バッファサイズを返す（このプラットフォームでは取得できない）
+func SocketRecvBuffer(conn *net.UDPConn) (int, error) {
+	return 0, errors.New("not supported on this platform")
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd
+
+package internal
+
+import (
+	"net"
+	"runtime"
+	"syscall"
+)
+
+// SocketRecvBuffer はソケットの実際の受信バッファサイズ（SO_RCVBUF）を返す
+// Linuxはカーネルの管理領域分として設定値の2倍を返すため、半分にして要求値と比較できるようにする
+func SocketRecvBuffer(conn *net.UDPConn) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var size int
+	var sockErr error
+	if err := raw.Control(func(fd uintptr) {
+		size, sockErr = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}); err != nil {
+		return 0, err
+	}
+	if sockErr != nil {
+		return 0, sockErr
+	}
+	if runtime.GOOS == "linux" {
+		size /= 2
+	}
+	return size, nil
+}
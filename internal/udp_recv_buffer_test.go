@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/transport/v4/stdnet"
+	"github.com/pion/webrtc/v4"
+)
+
+const udpRecvBufferConnectTimeout = 10 * time.Second
+
+// udpRecvBufferCaptureStderr はfnの実行中にos.Stderrへ書き込まれた内容を返す
+func udpRecvBufferCaptureStderr(fn func() error) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	saved := os.Stderr
+	os.Stderr = w
+	output := make(chan string, 1)
+	go func() {
+		data, _ := io.ReadAll(r)
+		output <- string(data)
+	}()
+	fnErr := fn()
+	os.Stderr = saved
+	w.Close()
+	return <-output, fnErr
+}
+
+// listen は受信バッファsizeを要求するNetでn個のUDPソケットを作成し、最初のソケットの実際のサイズを返す
+func listen(size, n int) (int, error) {
+	base, err := stdnet.NewNet()
+	if err != nil {
+		return 0, err
+	}
+	recvNet := NewRecvBufferNet(base, size)
+	effective := 0
+	for i := 0; i < n; i++ {
+		conn, err := recvNet.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			return 0, err
+		}
+		defer conn.Close()
+		udpConn, ok := conn.(*net.UDPConn)
+		if !ok {
+			return 0, fmt.Errorf("ListenUDP returned %T, want *net.UDPConn", conn)
+		}
+		if i == 0 {
+			if effective, err = SocketRecvBuffer(udpConn); err != nil {
+				return 0, fmt.Errorf("cannot read SO_RCVBUF on this platform: %v", err)
+			}
+		}
+	}
+	return effective, nil
+}
+
+// TestUDPRecvBufferApplied はOSの制限より小さい要求がそのまま設定され、警告が出ないことを検証する
+func TestUDPRecvBufferApplied(t *testing.T) {
+	const size = 8192
+	var effective int
+	stderr, err := udpRecvBufferCaptureStderr(func() error {
+		var err error
+		effective, err = listen(size, 1)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if effective != size {
+		t.Fatalf("effective receive buffer %d bytes, want %d", effective, size)
+	}
+	if want := fmt.Sprintf("requested %d bytes, effective %d bytes", size, size); !strings.Contains(stderr, want) {
+		t.Fatalf("stderr %q does not report %q", stderr, want)
+	}
+	if strings.Contains(stderr, "Warning") {
+		t.Fatalf("unexpected warning: %q", stderr)
+	}
+}
+
+// TestUDPRecvBufferClamped はOSの制限を超える要求で警告が出て、複数のソケットでも表示が1回だけであることを検証する
+func TestUDPRecvBufferClamped(t *testing.T) {
+	const size = 1 << 30
+	var effective int
+	stderr, err := udpRecvBufferCaptureStderr(func() error {
+		var err error
+		effective, err = listen(size, 3)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if effective >= size {
+		t.Fatalf("effective receive buffer %d bytes, expected the OS to clamp %d", effective, size)
+	}
+	if n := strings.Count(stderr, "UDP receive buffer: requested"); n != 1 {
+		t.Fatalf("effective size reported %d times for 3 sockets, want 1: %q", n, stderr)
+	}
+	if n := strings.Count(stderr, "Warning: OS clamped the UDP receive buffer"); n != 1 {
+		t.Fatalf("clamp warning printed %d times for 3 sockets, want 1: %q", n, stderr)
+	}
+}
+
+// TestUDPRecvBufferConnect は--udp-recv-bufferと--dscpを併用してもPeerConnection同士がDTLSまで接続できることを検証する
+func TestUDPRecvBufferConnect(t *testing.T) {
+	UDPRecvBuffer = 8192
+	DSCPCodepoint = 46
+	defer func() {
+		UDPRecvBuffer = 0
+		DSCPCodepoint = 0
+	}()
+
+	stderr, err := udpRecvBufferCaptureStderr(func() error {
+		offerer, err := newPeerConnection()
+		if err != nil {
+			return err
+		}
+		defer offerer.Close()
+		answerer, err := newPeerConnection()
+		if err != nil {
+			return err
+		}
+		defer answerer.Close()
+
+		if _, err := offerer.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo); err != nil {
+			return err
+		}
+		if err := connect(offerer, answerer); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(udpRecvBufferConnectTimeout)
+		for offerer.SCTP().Transport().State() != webrtc.DTLSTransportStateConnected {
+			if time.Now().After(deadline) {
+				return fmt.Errorf("DTLS not connected within %v", udpRecvBufferConnectTimeout)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(stderr, "UDP receive buffer: requested 8192 bytes") {
+		t.Fatalf("receive buffer not applied to PeerConnection sockets: %q", stderr)
+	}
+}
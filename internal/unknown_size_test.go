@@ -0,0 +1,209 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+const (
+	unknownSizeWidth       = 640 // RawVideoMKVWriterは640x360未満のキーフレームをプレビューとして読み飛ばす
+	unknownSizeHeight      = 360
+	unknownSizeVideoFrames = 70   // 30fps x 約2.3秒（キーフレームと1秒ごとに新しいクラスタ）
+	unknownSizeVideoTSStep = 3000 // 90kHz / 30fps
+	unknownSizeAudioTSStep = 960  // 48kHz x 20ms
+)
+
+// unknownElement はサイズ不定の要素を作る（終端は後続の要素で決まる）
+func unknownElement(id uint32, children ...[]byte) []byte {
+	return append(append(idBytes(id), unknownSize...), bytes.Join(children, nil)...)
+}
+
+// blockData はtrackのtimecode（ms）のBlockのデータ（payloadの先頭1バイトがmarker）を作る
+func blockData(track byte, timecode int16, flags byte, marker byte) []byte {
+	return []byte{0x80 | track, byte(uint16(timecode) >> 8), byte(timecode), flags, marker, 0, 0, 0}
+}
+
+// unknownSizeWriteTestMKV はRawVideoMKVWriterでVP8映像（デコードしてrawvideoで書かれる）とOpus音声を書き込む
+// SegmentとClusterはサイズ不定で書かれる
+func unknownSizeWriteTestMKV(out io.Writer) error {
+	encoder, err := NewVP8Encoder(unknownSizeWidth, unknownSizeHeight, "RGBA", 500)
+	if err != nil {
+		return fmt.Errorf("failed to create encoder: %v", err)
+	}
+	defer encoder.Close()
+
+	writer := NewRawVideoMKVWriter(out, "vp8")
+	runErr := make(chan error, 1)
+	go func() { runErr <- writer.Run() }()
+
+	rgba := make([]byte, unknownSizeWidth*unknownSizeHeight*4)
+	audioIndex := 0
+	for i := 0; i < unknownSizeVideoFrames; i++ {
+		for j := range rgba {
+			rgba[j] = byte(i + j)
+		}
+		encoded, keyframe, err := encoder.Encode(rgba)
+		if err != nil {
+			return fmt.Errorf("encode error at frame %d: %v", i, err)
+		}
+		if err := writer.WriteVideoFrame(encoded, uint32(i*unknownSizeVideoTSStep), keyframe); err != nil {
+			return fmt.Errorf("failed to write video frame %d: %v", i, err)
+		}
+		for audioIndex*unknownSizeAudioTSStep*90000/48000 <= i*unknownSizeVideoTSStep {
+			if err := writer.WriteAudioFrame([]byte{0xFC, byte(audioIndex), 0x00}, uint32(audioIndex*unknownSizeAudioTSStep)); err != nil {
+				return fmt.Errorf("failed to write audio frame %d: %v", audioIndex, err)
+			}
+			audioIndex++
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return fmt.Errorf("failed to close writer: %v", err)
+	}
+	return <-runErr
+}
+
+// unknownSizeReadFrames はMKVReaderで全フレームを読む
+func unknownSizeReadFrames(data []byte) (*MKVReader, []*Frame, error) {
+	reader := NewMKVReader(bytes.NewReader(data))
+	reader.Start()
+	var frames []*Frame
+	for {
+		frame, err := reader.ReadFrame()
+		if errors.Is(err, io.EOF) {
+			return reader, frames, nil
+		}
+		if err != nil {
+			return reader, frames, err
+		}
+		frames = append(frames, frame)
+	}
+}
+
+// TestUnknownSizeWriterOutput はRawVideoMKVWriterが書いたサイズ不定のSegment/Clusterを、
+// 再接続で2つ続けた出力も含めて、再同期せずに全フレーム読めることを検証する
+func TestUnknownSizeWriterOutput(t *testing.T) {
+	var out bytes.Buffer
+	if err := unknownSizeWriteTestMKV(&out); err != nil {
+		t.Fatal(err)
+	}
+	single, err := ValidateMKV(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if single.VideoCodec != "V_UNCOMPRESSED" || single.Width != unknownSizeWidth || single.Height != unknownSizeHeight {
+		t.Fatalf("got video %s %dx%d, want V_UNCOMPRESSED %dx%d", single.VideoCodec, single.Width, single.Height, unknownSizeWidth, unknownSizeHeight)
+	}
+	if single.AudioCodec != "A_OPUS" {
+		t.Fatalf("got audio codec %q, want A_OPUS", single.AudioCodec)
+	}
+	// ライターが出力を始めるまでのフレームは書かれないため、書き込んだ数より少なくなる
+	if single.Video.Frames == 0 || single.Video.Frames > unknownSizeVideoFrames || single.Audio.Frames == 0 {
+		t.Fatalf("got %d video and %d audio frames from one session", single.Video.Frames, single.Audio.Frames)
+	}
+
+	if err := unknownSizeWriteTestMKV(&out); err != nil {
+		t.Fatal(err)
+	}
+	report, err := ValidateMKV(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Video.Frames != 2*single.Video.Frames || report.Audio.Frames != 2*single.Audio.Frames {
+		t.Fatalf("got %d video and %d audio frames from two sessions, want %d and %d",
+			report.Video.Frames, report.Audio.Frames, 2*single.Video.Frames, 2*single.Audio.Frames)
+	}
+	if report.Resyncs != 0 {
+		t.Fatalf("reader resynced %d times", report.Resyncs)
+	}
+}
+
+// TestUnknownSizeTracks はTracks/TrackEntry/Videoもサイズ不定の場合に、トラック情報を読めることと、
+// サイズ不定のBlockGroupが同じ階層のSimpleBlockの前で閉じられることを検証する
+func TestUnknownSizeTracks(t *testing.T) {
+	data := bytes.Join([][]byte{
+		element(0x1A45DFA3, element(0x4282, []byte("matroska"))),
+		unknownElement(0x18538067),
+		unknownElement(0x1549A966, element(0x2AD7B1, uintData(1000000))),
+		unknownElement(0x1654AE6B, unknownElement(0xAE,
+			element(0xD7, uintData(1)),
+			element(0x86, []byte("V_VP8")),
+			unknownElement(0xE0, element(0xB0, uintData(unknownSizeWidth)), element(0xBA, uintData(unknownSizeHeight))),
+		)),
+		unknownElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			element(0xA3, blockData(1, 0, 0x80, 1)),
+			unknownElement(0xA0, element(0xA1, blockData(1, 33, 0, 2)), element(0xFB, uintData(0))),
+			element(0xA3, blockData(1, 66, 0, 3)),
+		),
+		unknownElement(0x1F43B675,
+			element(0xE7, uintData(100)),
+			unknownElement(0xA0, element(0xA1, blockData(1, 0, 0, 4))),
+		),
+	}, nil)
+
+	reader, frames, err := unknownSizeReadFrames(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reader.VideoCodec() != "V_VP8" || reader.VideoWidth() != unknownSizeWidth || reader.VideoHeight() != unknownSizeHeight {
+		t.Fatalf("got video %q %dx%d, want V_VP8 %dx%d", reader.VideoCodec(), reader.VideoWidth(), reader.VideoHeight(), unknownSizeWidth, unknownSizeHeight)
+	}
+	want := []struct {
+		marker      byte
+		timestampMs int64
+		keyframe    bool
+	}{
+		{1, 0, true},
+		{2, 33, false},
+		{3, 66, false},
+		{4, 100, true}, // 終端で閉じたBlockGroup（ReferenceBlockが無いためキーフレーム）
+	}
+	if len(frames) != len(want) {
+		t.Fatalf("got %d frames, want %d", len(frames), len(want))
+	}
+	for i, w := range want {
+		f := frames[i]
+		if f.Data[0] != w.marker || f.TimestampMs != w.timestampMs || f.IsKeyframe != w.keyframe {
+			t.Fatalf("frame %d: got marker %d at %dms keyframe=%v, want marker %d at %dms keyframe=%v",
+				i, f.Data[0], f.TimestampMs, f.IsKeyframe, w.marker, w.timestampMs, w.keyframe)
+		}
+	}
+	if reader.Resyncs() != 0 {
+		t.Fatalf("reader resynced %d times", reader.Resyncs())
+	}
+}
+
+// TestUnknownSizeInSizedParent はサイズ付きのSegment内のサイズ不定のClusterとBlockGroupが、
+// Segmentの終端で閉じられ、続くSegmentの前にBlockGroupのフレームが出力されることを検証する
+func TestUnknownSizeInSizedParent(t *testing.T) {
+	header := element(0x1A45DFA3, element(0x4282, []byte("matroska")))
+	tracks := element(0x1654AE6B, element(0xAE,
+		element(0xD7, uintData(1)),
+		element(0x86, []byte("V_VP8")),
+		element(0xE0, element(0xB0, uintData(unknownSizeWidth)), element(0xBA, uintData(unknownSizeHeight))),
+	))
+	data := bytes.Join([][]byte{
+		header,
+		element(0x18538067, tracks, unknownElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			unknownElement(0xA0, element(0xA1, blockData(1, 0, 0, 1))),
+		)),
+		header,
+		unknownElement(0x18538067, tracks, unknownElement(0x1F43B675,
+			element(0xE7, uintData(0)),
+			element(0xA3, blockData(1, 0, 0x80, 2)),
+		)),
+	}, nil)
+
+	_, frames, err := unknownSizeReadFrames(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 || frames[0].Data[0] != 1 || frames[1].Data[0] != 2 {
+		t.Fatalf("got %d frames, want the BlockGroup frame of the first Segment followed by the second Segment's frame", len(frames))
+	}
+}
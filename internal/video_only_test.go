@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+const (
+	videoOnlyWidth         = 640 // RawVideoMKVWriterは640x360未満のキーフレームを低解像度プレビューとして読み飛ばす
+	videoOnlyHeight        = 360
+	videoOnlyFrameInterval = 33 * time.Millisecond
+)
+
+// videoOnlyAnswerSDP はaudioの行を音声のm-lineとして含むanswerを作る（空の場合は映像のみ）
+func videoOnlyAnswerSDP(audio string) string {
+	lines := []string{
+		"v=0",
+		"o=- 1 1 IN IP4 127.0.0.1",
+		"s=-",
+		"t=0 0",
+		"m=video 9 UDP/TLS/RTP/SAVPF 96",
+		"c=IN IP4 0.0.0.0",
+		"a=sendonly",
+		"a=msid:stream video",
+		"a=rtpmap:96 VP8/90000",
+	}
+	if audio != "" {
+		lines = append(lines, strings.Split(audio, "\n")...)
+	}
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// TestVideoOnlyAnswerHasAudio はanswerのm-lineからサーバーが音声を送るかどうかを判定できることを検証する
+func TestVideoOnlyAnswerHasAudio(t *testing.T) {
+	cases := []struct {
+		name  string
+		audio string
+		want  bool
+	}{
+		{"sendonly audio", "m=audio 9 UDP/TLS/RTP/SAVPF 111\na=sendonly\na=msid:stream audio\na=rtpmap:111 opus/48000/2", true},
+		{"audio with ssrc only", "m=audio 9 UDP/TLS/RTP/SAVPF 111\na=sendonly\na=rtpmap:111 opus/48000/2\na=ssrc:1234 cname:test", true},
+		{"sendonly without a track", "m=audio 9 UDP/TLS/RTP/SAVPF 111\na=sendonly\na=rtpmap:111 opus/48000/2", false},
+		{"inactive audio", "m=audio 9 UDP/TLS/RTP/SAVPF 111\na=inactive\na=msid:stream audio\na=rtpmap:111 opus/48000/2", false},
+		{"declined audio", "m=audio 0 UDP/TLS/RTP/SAVPF 0\na=inactive", false},
+		{"no audio m-line", "", false},
+	}
+	for _, c := range cases {
+		if got := AnswerHasAudio(videoOnlyAnswerSDP(c.audio)); got != c.want {
+			t.Fatalf("%s: AnswerHasAudio = %v, want %v", c.name, got, c.want)
+		}
+	}
+	if !AnswerHasAudio("not an SDP") {
+		t.Fatalf("an unparsable answer was treated as video-only")
+	}
+}
+
+// TestVideoOnlyLoopback は映像トラックのみを送るサーバーとネゴシエーションし、
+// 音声トラックを宣言しない映像のみのMKVを書き込むことを検証する
+// --sync-start でも届かない音声を待たずに書き込む
+func TestVideoOnlyLoopback(t *testing.T) {
+	NoFrameValidation = true
+	defer func() { NoFrameValidation = false }()
+	SyncStart = true
+	defer func() { SyncStart = false }()
+
+	var out bytes.Buffer
+	writer := NewRawVideoMKVWriter(&out, "vp8")
+	streamManager := NewStreamManager(writer, NewDefaultRTPProcessor(), 0, nil)
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := CreatePeerConnection(mediaEngine, make(chan ConnectionEvent, 10), streamManager)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiver.Close()
+
+	senderEngine := &webrtc.MediaEngine{}
+	if err := senderEngine.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(senderEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	sender, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sender.Close()
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rtpSender, err := sender.AddTrack(track)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PLI等のRTCPを読み捨てる
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := rtpSender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	if err := connect(receiver, sender); err != nil {
+		t.Fatal(err)
+	}
+	answer := receiver.RemoteDescription().SDP
+	if !AnswerHasVideo(answer) {
+		t.Fatalf("answer from a video-only sender was detected as having no video")
+	}
+	if AnswerHasAudio(answer) {
+		t.Fatalf("answer from a video-only sender was detected as having audio")
+	}
+	streamManager.SetVideoOnly()
+
+	go streamManager.Run()
+	stopped := false
+	// ReadRTPを終わらせるため、PeerConnectionを閉じてから停止する
+	stop := func() {
+		if !stopped {
+			stopped = true
+			receiver.Close()
+			streamManager.Stop()
+		}
+	}
+	defer stop()
+
+	encoder, err := NewVP8Encoder(videoOnlyWidth, videoOnlyHeight, "YUV420P", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	// SRTPの準備完了前のパケットは破棄されるため、キーフレームを定期的に送る
+	frame := make([]byte, videoOnlyWidth*videoOnlyHeight*3/2)
+	for i := 0; i < 60; i++ {
+		if i%10 == 0 {
+			encoder.ForceKeyframe()
+		}
+		for j := range frame {
+			frame[j] = byte(j + i*5)
+		}
+		encoded, _, err := encoder.Encode(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := track.WriteSample(media.Sample{Data: encoded, Duration: videoOnlyFrameInterval}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(videoOnlyFrameInterval)
+	}
+	stop()
+
+	report, err := ValidateMKV(bytes.NewReader(out.Bytes()))
+	if err != nil {
+		t.Fatalf("mkv-validate: %v (%d bytes)", err, out.Len())
+	}
+	if report.AudioCodec != "" || report.Audio.Frames != 0 {
+		t.Fatalf("audio track %q with %d frames in the MKV of a video-only answer", report.AudioCodec, report.Audio.Frames)
+	}
+	if report.VideoCodec == "" || report.Video.Frames == 0 {
+		t.Fatalf("MKV has video %q with %d frames, want video frames", report.VideoCodec, report.Video.Frames)
+	}
+	t.Logf("%s %dx%d, %d video frames, no audio track", report.VideoCodec, report.Width, report.Height, report.Video.Frames)
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// VideoOrientationURI はCVO（Coordination of Video Orientation, 3GPP TS 26.114）のRTPヘッダー拡張
+// モバイル端末は縦向きの映像を回転させずに送り、表示時の回転をこの拡張で通知する
+const VideoOrientationURI = "urn:3gpp:video-orientation"
+
+// RegisterVideoOrientation は --auto-rotate 指定時にCVOヘッダー拡張をネゴシエーション対象に加える
+func RegisterVideoOrientation(mediaEngine *webrtc.MediaEngine) error {
+	if err := mediaEngine.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: VideoOrientationURI}, webrtc.RTPCodecTypeVideo); err != nil {
+		return fmt.Errorf("failed to register %s: %w", VideoOrientationURI, err)
+	}
+	return nil
+}
+
+// videoOrientationExtensionID はネゴシエーションされたCVOヘッダー拡張のIDを返す（無い場合は0）
+func videoOrientationExtensionID(receiver *webrtc.RTPReceiver) uint8 {
+	for _, ext := range receiver.GetParameters().HeaderExtensions {
+		if ext.URI == VideoOrientationURI {
+			return uint8(ext.ID)
+		}
+	}
+	return 0
+}
+
+// ParseVideoOrientation はCVOの1バイト（0 0 0 0 C F R1 R0）から時計回りの回転角度と左右反転を返す
+func ParseVideoOrientation(b byte) (degrees int, flip bool) {
+	return int(b&0x03) * 90, b&0x04 != 0
+}
+
+// packetVideoRotation はRTPパケットのCVO拡張から回転角度を返す（拡張が無い場合はok=false）
+func packetVideoRotation(packet *rtp.Packet, extensionID uint8) (int, bool) {
+	if extensionID == 0 {
+		return 0, false
+	}
+	payload := packet.GetExtension(extensionID)
+	if len(payload) < 1 {
+		return 0, false
+	}
+	degrees, _ := ParseVideoOrientation(payload[0])
+	return degrees, true
+}
+
+// projectionPoseRoll は時計回りの表示回転をMatroskaのProjectionPoseRoll（反時計回り、-180〜180）に変換する
+func projectionPoseRoll(degrees int) float64 {
+	roll := -degrees % 360
+	if roll <= -180 {
+		roll += 360
+	}
+	return float64(roll)
+}
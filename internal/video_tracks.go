@@ -0,0 +1,46 @@
+package internal
+
+import (
+	"fmt"
+
+	"github.com/pion/webrtc/v4"
+)
+
+// MaxVideoTracks は --ssrc / --mid の指定時にofferに含める映像m-lineの数
+// サーバーが複数の映像ストリームを送れるよう、指定が無い場合の1本より多くする
+const MaxVideoTracks = 4
+
+// videoTransceiverCount はofferに含める映像のrecvonlyトランシーバー数を返す
+func videoTransceiverCount(ssrc uint32, mid string) int {
+	if ssrc == 0 && mid == "" {
+		return 1
+	}
+	return MaxVideoTracks
+}
+
+// VideoTrackSelected は受信した映像トラックが --ssrc / --mid の指定に一致するかを返す（未指定は任意のトラックに一致）
+func VideoTrackSelected(ssrc uint32, mid string, wantSSRC uint32, wantMID string) bool {
+	if wantSSRC != 0 && ssrc != wantSSRC {
+		return false
+	}
+	return wantMID == "" || mid == wantMID
+}
+
+// receiverMid はreceiverのトランシーバーのMIDを返す（見つからない場合は空）
+func receiverMid(pc *webrtc.PeerConnection, receiver *webrtc.RTPReceiver) string {
+	for _, transceiver := range pc.GetTransceivers() {
+		if transceiver.Receiver() == receiver {
+			return transceiver.Mid()
+		}
+	}
+	return ""
+}
+
+// describeTrack は受信したトラックのSSRC、MID、RID（simulcastの場合のみ）をログ用に整形する
+func describeTrack(track *webrtc.TrackRemote, mid string) string {
+	desc := fmt.Sprintf("ssrc=%d mid=%s", uint32(track.SSRC()), mid)
+	if rid := track.RID(); rid != "" {
+		desc += " rid=" + rid
+	}
+	return desc
+}
@@ -0,0 +1,45 @@
+package internal
+
+/*
+// libvpxはlibvpx-goがリンクするため、ヘッダーを参照せずに必要な宣言だけを置く
+// libvpx-goはvpx_codec_control_のバインディングを持たず、可変長引数はcgoから直接呼べないためラップする
+typedef struct vpx_codec_ctx vpx_codec_ctx_t;
+extern int vpx_codec_control_(vpx_codec_ctx_t *ctx, int ctrl_id, ...);
+
+// VP8E_SET_CPUUSED, VP8E_SET_TOKEN_PARTITIONS（vp8cx.h）
+#define VP8E_SET_CPUUSED 13
+#define VP8E_SET_TOKEN_PARTITIONS 18
+
+static int vp8_set_cpu_used(void *ctx, int value) {
+	return vpx_codec_control_((vpx_codec_ctx_t *)ctx, VP8E_SET_CPUUSED, value);
+}
+
+static int vp8_set_token_partitions(void *ctx, int value) {
+	return vpx_codec_control_((vpx_codec_ctx_t *)ctx, VP8E_SET_TOKEN_PARTITIONS, value);
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"math/bits"
+	"unsafe"
+
+	"github.com/Azunyan1111/libvpx-go/vpx"
+)
+
+// setVP8CPUUsed はVP8E_SET_CPUUSED（速度と画質のトレードオフ）を設定する
+func setVP8CPUUsed(ctx *vpx.CodecCtx, value int) error {
+	// CodecCtxはC側で確保されたvpx_codec_ctx_tそのもの
+	return vpx.Error(vpx.CodecErr(C.vp8_set_cpu_used(unsafe.Pointer(ctx), C.int(value))))
+}
+
+// setVP8TokenPartitions はVP8E_SET_TOKEN_PARTITIONSでトークンパーティション数（1, 2, 4, 8）を設定する
+// libvpxには数の2を底とする対数（vp8e_token_partitions）で渡す
+func setVP8TokenPartitions(ctx *vpx.CodecCtx, partitions int) error {
+	if partitions < 1 || partitions > 8 || partitions&(partitions-1) != 0 {
+		return fmt.Errorf("unsupported token partition count %d", partitions)
+	}
+	log2 := bits.TrailingZeros(uint(partitions))
+	return vpx.Error(vpx.CodecErr(C.vp8_set_token_partitions(unsafe.Pointer(ctx), C.int(log2))))
+}
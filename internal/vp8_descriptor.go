@@ -0,0 +1,112 @@
+package internal
+
+import (
+	"errors"
+)
+
+var errVP8DescriptorTruncated = errors.New("truncated VP8 payload descriptor")
+
+// VP8PayloadDescriptor はVP8 RTPペイロードデスクリプタ（RFC 7741）の解析結果
+type VP8PayloadDescriptor struct {
+	HeaderSize   int   // デスクリプタのバイト数（ビットストリームの開始位置）
+	NonReference bool  // N bit
+	Start        bool  // S bit（パーティションの先頭）
+	PartitionID  uint8 // PID
+	HasTID       bool  // T bit（テンポラルレイヤー情報あり）
+	TID          uint8 // テンポラルレイヤーID（HasTIDがfalseの場合は0）
+	LayerSync    bool  // Y bit（下位レイヤーのみを参照するフレーム）
+}
+
+// FrameStart はパケットがフレームの先頭（第1パーティションの先頭）かどうかを返す
+// S bitはパーティションごとに立つため、PID=0の場合のみフレームの先頭になる
+func (d VP8PayloadDescriptor) FrameStart() bool {
+	return d.Start && d.PartitionID == 0
+}
+
+// ParseVP8PayloadDescriptor はRTPペイロード先頭のVP8ペイロードデスクリプタを解析する
+//
+//	 0 1 2 3 4 5 6 7
+//	+-+-+-+-+-+-+-+-+
+//	|X|R|N|S|R| PID | (必須)
+//	+-+-+-+-+-+-+-+-+
+//	|I|L|T|K| RSV   | (X=1の場合)
+//	+-+-+-+-+-+-+-+-+
+//	|M| PictureID   | (I=1の場合、M=1なら2バイト)
+//	+-+-+-+-+-+-+-+-+
+//	|   TL0PICIDX   | (L=1の場合)
+//	+-+-+-+-+-+-+-+-+
+//	|TID|Y| KEYIDX  | (T=1またはK=1の場合)
+//	+-+-+-+-+-+-+-+-+
+func ParseVP8PayloadDescriptor(payload []byte) (VP8PayloadDescriptor, error) {
+	if len(payload) < 1 {
+		return VP8PayloadDescriptor{}, errVP8DescriptorTruncated
+	}
+
+	firstByte := payload[0]
+	d := VP8PayloadDescriptor{
+		HeaderSize:   1,
+		NonReference: firstByte&0x20 != 0,
+		Start:        firstByte&0x10 != 0,
+		PartitionID:  firstByte & 0x07,
+	}
+
+	// X bit - extension present
+	if firstByte&0x80 != 0 {
+		if len(payload) < 2 {
+			return VP8PayloadDescriptor{}, errVP8DescriptorTruncated
+		}
+		extByte := payload[1]
+		d.HeaderSize++
+
+		// I bit - PictureID present
+		if extByte&0x80 != 0 {
+			if len(payload) < d.HeaderSize+1 {
+				return VP8PayloadDescriptor{}, errVP8DescriptorTruncated
+			}
+			// M bit - PictureID is 16 bits
+			if payload[d.HeaderSize]&0x80 != 0 {
+				d.HeaderSize++
+			}
+			d.HeaderSize++
+		}
+
+		// L bit - TL0PICIDX present
+		if extByte&0x40 != 0 {
+			d.HeaderSize++
+		}
+
+		// T or K bit - TID/KEYIDX present
+		if extByte&0x20 != 0 || extByte&0x10 != 0 {
+			if len(payload) < d.HeaderSize+1 {
+				return VP8PayloadDescriptor{}, errVP8DescriptorTruncated
+			}
+			if extByte&0x20 != 0 {
+				d.HasTID = true
+				d.TID = payload[d.HeaderSize] >> 6
+				d.LayerSync = payload[d.HeaderSize]&0x20 != 0
+			}
+			d.HeaderSize++
+		}
+	}
+
+	if len(payload) < d.HeaderSize {
+		return VP8PayloadDescriptor{}, errVP8DescriptorTruncated
+	}
+	return d, nil
+}
+
+// IsVP8Keyframe はVP8ビットストリーム（デスクリプタ除去後のフレーム）がキーフレームかどうかを判定する
+// 第1パーティション先頭のframe tag（3バイト）のbit 0が0ならキーフレーム
+func IsVP8Keyframe(bitstream []byte) bool {
+	return len(bitstream) >= 3 && bitstream[0]&0x01 == 0
+}
+
+// IsVP8KeyframePayload はRTPペイロードがキーフレームの先頭パケットかどうかを判定する
+// デスクリプタの長さを考慮し、フレーム先頭（S=1、PID=0）のパケットのみframe tagを読む
+func IsVP8KeyframePayload(payload []byte) bool {
+	d, err := ParseVP8PayloadDescriptor(payload)
+	if err != nil || !d.FrameStart() {
+		return false
+	}
+	return IsVP8Keyframe(payload[d.HeaderSize:])
+}
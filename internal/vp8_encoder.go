@@ -1,22 +1,36 @@
 package internal
 
 import (
+	"bytes"
 	"fmt"
 	"runtime"
+	"sync/atomic"
 	"unsafe"
 
 	"github.com/Azunyan1111/libvpx-go/vpx"
 )
 
 type VP8Encoder struct {
-	ctx         *vpx.CodecCtx
-	img         *vpx.Image
-	width       int
-	height      int
-	pts         int64
-	pixelFormat string
+	ctx                *vpx.CodecCtx
+	cfg                *vpx.CodecEncCfg
+	img                *vpx.Image
+	width              int
+	height             int
+	pts                int64
+	pixelFormat        string
+	deadline           uint         // vpx.DlRealtime / DlGoodQuality / DlBestQuality
+	bitrateKbps        int          // 現在エンコーダーに設定されている目標ビットレート
+	pendingBitrateKbps atomic.Int64 // SetBitrateで要求された目標ビットレート（0は変更なし）
+
+	forceInterval    int64        // キーフレームを強制する間隔（フレーム数、0で無効）
+	forceRequested   atomic.Bool  // ForceKeyframeで次のフレームのキーフレームが要求されている
+	forcedKeyframes  atomic.Int64 // 強制したキーフレーム数
+	naturalKeyframes atomic.Int64 // エンコーダーが自ら判断したキーフレーム数（最初のフレームを含む）
 }
 
+// VP8のフレームヘッダーで表現できる最大の幅・高さ（14bit）
+const maxVP8Dimension = 16383
+
 var (
 	yRTable [256]int
 	yGTable [256]int
@@ -49,6 +63,9 @@ func NewVP8Encoder(width, height int, pixelFormat string, targetBitrateKbps int)
 	if targetBitrateKbps <= 0 {
 		return nil, fmt.Errorf("invalid video bitrate: %d (must be > 0)", targetBitrateKbps)
 	}
+	if width <= 0 || height <= 0 || width > maxVP8Dimension || height > maxVP8Dimension {
+		return nil, fmt.Errorf("invalid video dimensions: %dx%d (must be 1..%d)", width, height, maxVP8Dimension)
+	}
 
 	ctx := vpx.NewCodecCtx()
 	if ctx == nil {
@@ -76,7 +93,7 @@ func NewVP8Encoder(width, height int, pixelFormat string, targetBitrateKbps int)
 	cfg.GPass = vpx.RcOnePass
 	cfg.RcEndUsage = vpx.Cbr
 	cfg.KfMode = vpx.KfAuto
-	cfg.KfMaxDist = 30
+	cfg.KfMaxDist = uint32(KeyframeInterval)
 	// スレッド数は上限を設けてCPU過負荷を抑える
 	numThreads := runtime.NumCPU()
 	if numThreads > 4 {
@@ -91,42 +108,102 @@ func NewVP8Encoder(width, height int, pixelFormat string, targetBitrateKbps int)
 	cfg.RcMaxQuantizer = 48
 	// リアルタイムエンコード用のプロファイル設定
 	cfg.GProfile = 0 // Simple profile for faster encoding
+	// エラー耐性モードではフレーム間で確率テーブルを引き継がないため、パケット損失の影響が後続のフレームに及ばない
+	if ErrorResilient {
+		cfg.GErrorResilient = vpx.ErrorResilientDefault
+	}
 
-	if err := vpx.Error(vpx.CodecEncInitVer(ctx, iface, cfg, 0, vpx.EncoderABIVersion)); err != nil {
+	// パーティション単位で出力すると、パケット化時にパーティション境界を保持できる
+	var initFlags vpx.CodecFlags
+	if VP8Partitions {
+		initFlags |= vpx.CodecUseOutputPartition
+	}
+
+	if err := vpx.Error(vpx.CodecEncInitVer(ctx, iface, cfg, initFlags, vpx.EncoderABIVersion)); err != nil {
 		vpx.CodecDestroy(ctx)
 		return nil, fmt.Errorf("failed to initialize encoder: %v", err)
 	}
 
+	// cpu-usedはエンコーダー初期化後にのみ設定できる
+	if err := setVP8CPUUsed(ctx, CPUUsed); err != nil {
+		vpx.CodecDestroy(ctx)
+		return nil, fmt.Errorf("failed to set cpu-used %d: %v", CPUUsed, err)
+	}
+	if TokenPartitions > 1 {
+		if err := setVP8TokenPartitions(ctx, TokenPartitions); err != nil {
+			vpx.CodecDestroy(ctx)
+			return nil, fmt.Errorf("failed to set %d token partitions: %v", TokenPartitions, err)
+		}
+	}
+
 	img := vpx.ImageAlloc(nil, vpx.ImageFormatI420, uint32(width), uint32(height), 1)
 	if img == nil {
 		vpx.CodecDestroy(ctx)
 		return nil, fmt.Errorf("failed to allocate image")
 	}
 	img.Deref()
+	// 奇数サイズでもI420の2x2ブロック単位で変換できるよう、画像は偶数サイズに切り上げて確保されている必要がある
+	if int(img.DW) != width || int(img.DH) != height || int(img.W) < evenCeil(width) || int(img.H) < evenCeil(height) ||
+		int(img.Stride[vpx.PlaneY]) < evenCeil(width) || int(img.Stride[vpx.PlaneU]) < evenCeil(width)/2 || int(img.Stride[vpx.PlaneV]) < evenCeil(width)/2 {
+		vpx.ImageFree(img)
+		vpx.CodecDestroy(ctx)
+		return nil, fmt.Errorf("unexpected image layout for %dx%d: W=%d H=%d DW=%d DH=%d", width, height, img.W, img.H, img.DW, img.DH)
+	}
 
-	DebugLog("VP8Encoder: requested %dx%d, image W=%d H=%d DW=%d DH=%d, pixelFormat=%s, threads=%d\n",
-		width, height, img.W, img.H, img.DW, img.DH, pixelFormat, numThreads)
+	DebugLog("VP8Encoder: requested %dx%d, image W=%d H=%d DW=%d DH=%d, pixelFormat=%s, threads=%d, deadline=%s, cpu-used=%d, error-resilient=%v, partitions=%d\n",
+		width, height, img.W, img.H, img.DW, img.DH, pixelFormat, numThreads, EncodeDeadline, CPUUsed, ErrorResilient, TokenPartitions)
 
 	return &VP8Encoder{
 		ctx:         ctx,
+		cfg:         cfg,
 		img:         img,
 		width:       width,
 		height:      height,
 		pts:         0,
 		pixelFormat: pixelFormat,
+		deadline:    vp8Deadline(EncodeDeadline),
+		bitrateKbps: targetBitrateKbps,
+
+		forceInterval: int64(ForceKeyframeEvery),
 	}, nil
 }
 
+// vp8Deadline は --encode-deadline の値をlibvpxのdeadlineに変換する
+func vp8Deadline(name string) uint {
+	switch name {
+	case "good":
+		return vpx.DlGoodQuality
+	case "best":
+		return vpx.DlBestQuality
+	default:
+		return vpx.DlRealtime
+	}
+}
+
+// Encode はフレームをエンコードし、パーティションを連結したVP8フレームを返す
 func (e *VP8Encoder) Encode(frameData []byte) ([]byte, bool, error) {
+	partitions, isKeyframe, err := e.EncodePartitions(frameData)
+	if err != nil || len(partitions) == 0 {
+		return nil, false, err
+	}
+	if len(partitions) == 1 {
+		return partitions[0], isKeyframe, nil
+	}
+	return bytes.Join(partitions, nil), isKeyframe, nil
+}
+
+// EncodePartitions はフレームをエンコードし、VP8パーティション単位で返す
+// --vp8-partitions 無効時は常に1パーティションとなる
+func (e *VP8Encoder) EncodePartitions(frameData []byte) ([][]byte, bool, error) {
 	// Use image's actual dimensions (DW, DH) for size check
 	w := int(e.img.DW)
 	h := int(e.img.DH)
 
 	switch e.pixelFormat {
 	case "YUV420P", "I420":
-		expectedSize := w * h * 3 / 2
+		expectedSize := i420FrameSize(w, h)
 		if len(frameData) != expectedSize {
-			DebugLog("Invalid YUV420P data size: expected %d (%dx%dx3/2), got %d\n", expectedSize, w, h, len(frameData))
+			DebugLog("Invalid YUV420P data size: expected %d (%dx%d), got %d\n", expectedSize, w, h, len(frameData))
 			return nil, false, fmt.Errorf("invalid YUV420P data size: expected %d, got %d", expectedSize, len(frameData))
 		}
 		e.yuv420pToI420(frameData)
@@ -140,58 +217,131 @@ func (e *VP8Encoder) Encode(frameData []byte) ([]byte, bool, error) {
 		e.rgbaToI420(frameData)
 	}
 
-	// Encode frame (DlRealtime for low-latency encoding)
-	if err := vpx.Error(vpx.CodecEncode(e.ctx, e.img, vpx.CodecPts(e.pts), 1, 0, vpx.DlRealtime)); err != nil {
+	e.applyPendingBitrate()
+
+	// --force-keyframe-interval の周期（最初のフレームは常にキーフレームなので除く）とForceKeyframeの要求でキーフレームを強制する
+	var flags vpx.EncFrameFlags
+	forced := e.forceRequested.Swap(false) || (e.forceInterval > 0 && e.pts > 0 && e.pts%e.forceInterval == 0)
+	if forced {
+		flags |= vpx.EflagForceKf
+	}
+
+	// Encode frame (既定はDlRealtime、録画/変換用途では --encode-deadline で変更する)
+	if err := vpx.Error(vpx.CodecEncode(e.ctx, e.img, vpx.CodecPts(e.pts), 1, flags, e.deadline)); err != nil {
 		detail := vpx.CodecErrorDetail(e.ctx)
 		return nil, false, fmt.Errorf("failed to encode frame: %v (detail: %s)", err, detail)
 	}
 	e.pts++
 
 	// Get encoded data
+	// パーティション出力時は1フレームが複数のパケット（最後以外はFrameIsFragment）に分かれる
+	var partitions [][]byte
+	isKeyframe := false
+	complete := false
 	var iter vpx.CodecIter
-	pkt := vpx.CodecGetCxData(e.ctx, &iter)
-	if pkt == nil {
+	for pkt := vpx.CodecGetCxData(e.ctx, &iter); pkt != nil; pkt = vpx.CodecGetCxData(e.ctx, &iter) {
+		pkt.Deref()
+		if pkt.Kind != vpx.CodecCxFramePkt {
+			continue
+		}
+		partitions = append(partitions, pkt.GetFrameData())
+		isKeyframe = isKeyframe || pkt.IsKeyframe()
+		if pkt.GetFrameFlags()&vpx.FrameIsFragment == 0 {
+			complete = true
+			break
+		}
+	}
+	if len(partitions) == 0 {
 		return nil, false, nil
 	}
-	pkt.Deref()
+	if isKeyframe && forced {
+		e.forcedKeyframes.Add(1)
+	} else if isKeyframe {
+		e.naturalKeyframes.Add(1)
+	}
 
-	if pkt.Kind != vpx.CodecCxFramePkt {
-		return nil, false, nil
+	// 最後のパーティションが揃わなかった場合は境界情報を捨て、1パーティションとして扱う
+	if !complete && len(partitions) > 1 {
+		DebugLog("VP8Encoder: incomplete partition sequence (%d fragments), sending as single partition\n", len(partitions))
+		partitions = [][]byte{bytes.Join(partitions, nil)}
+	}
+
+	return partitions, isKeyframe, nil
+}
+
+// SetBitrate は目標ビットレートの変更を要求する
+// libvpxのコンテキストはスレッドセーフではないため、実際の反映は次のEncode呼び出し時に行う
+func (e *VP8Encoder) SetBitrate(kbps int) {
+	if kbps <= 0 {
+		return
 	}
+	e.pendingBitrateKbps.Store(int64(kbps))
+}
+
+// ForceKeyframe は次にエンコードするフレームをキーフレームにする
+// 別goroutineから呼び出してよい
+func (e *VP8Encoder) ForceKeyframe() {
+	e.forceRequested.Store(true)
+}
 
-	data := pkt.GetFrameData()
-	isKeyframe := pkt.IsKeyframe()
+// KeyframeCounts はこれまでに強制したキーフレーム数と、エンコーダーが自ら判断したキーフレーム数を返す
+// 別goroutineから呼び出してよい
+func (e *VP8Encoder) KeyframeCounts() (forced, natural int64) {
+	return e.forcedKeyframes.Load(), e.naturalKeyframes.Load()
+}
+
+// BitrateKbps は現在エンコーダーに設定されている目標ビットレートを返す
+func (e *VP8Encoder) BitrateKbps() int {
+	return e.bitrateKbps
+}
 
-	return data, isKeyframe, nil
+func (e *VP8Encoder) applyPendingBitrate() {
+	kbps := int(e.pendingBitrateKbps.Swap(0))
+	if kbps <= 0 || kbps == e.bitrateKbps {
+		return
+	}
+
+	e.cfg.RcTargetBitrate = uint32(kbps)
+	if err := vpx.Error(vpx.CodecEncConfigSet(e.ctx, e.cfg)); err != nil {
+		DebugLog("VP8Encoder: failed to set bitrate %dkbps: %v\n", kbps, err)
+		e.cfg.RcTargetBitrate = uint32(e.bitrateKbps)
+		return
+	}
+	DebugLog("VP8Encoder: target bitrate %dkbps -> %dkbps\n", e.bitrateKbps, kbps)
+	e.bitrateKbps = kbps
 }
 
+// rgbaToI420 はRGBAをI420に変換する
+// 奇数サイズの場合は右端の列・下端の行を複製して偶数サイズに拡張し、2x2ブロック単位で処理する
 func (e *VP8Encoder) rgbaToI420(rgba []byte) {
 	h := int(e.img.DH)
 	w := int(e.img.DW)
+	paddedH := evenCeil(h)
+	paddedW := evenCeil(w)
 
 	yStride := int(e.img.Stride[vpx.PlaneY])
 	uStride := int(e.img.Stride[vpx.PlaneU])
 	vStride := int(e.img.Stride[vpx.PlaneV])
 
 	// Access planes directly via unsafe.Pointer (same as libvpx-go test code)
-	yPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneY])))[:yStride*h]
-	uPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneU])))[:uStride*h/2]
-	vPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneV])))[:vStride*h/2]
+	yPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneY])))[:yStride*paddedH]
+	uPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneU])))[:uStride*paddedH/2]
+	vPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneV])))[:vStride*paddedH/2]
 
 	// Convert RGBA to YUV420 with 2x2 traversal to avoid per-pixel modulo checks.
-	for row := 0; row < h; row += 2 {
+	for row := 0; row < paddedH; row += 2 {
 		row0Base := row * w * 4
 		yRow0 := row * yStride
 
+		// 奇数の高さでは下端の行を複製する
 		row1 := row + 1
-		hasRow1 := row1 < h
-		row1Base := row1 * w * 4
+		row1Base := min(row1, h-1) * w * 4
 		yRow1 := row1 * yStride
 
 		uvRow := (row / 2) * uStride
 		vvRow := (row / 2) * vStride
 
-		for col := 0; col < w; col += 2 {
+		for col := 0; col < paddedW; col += 2 {
 			idx00 := row0Base + col*4
 			r00 := int(rgba[idx00])
 			g00 := int(rgba[idx00+1])
@@ -199,33 +349,29 @@ func (e *VP8Encoder) rgbaToI420(rgba []byte) {
 			y00 := ((yRTable[r00] + yGTable[g00] + yBTable[b00] + 128) >> 8) + 16
 			yPlane[yRow0+col] = clampToByte(y00)
 
+			// 奇数の幅では右端の列を複製する
 			col1 := col + 1
-			if col1 < w {
-				idx01 := idx00 + 4
-				r01 := int(rgba[idx01])
-				g01 := int(rgba[idx01+1])
-				b01 := int(rgba[idx01+2])
-				y01 := ((yRTable[r01] + yGTable[g01] + yBTable[b01] + 128) >> 8) + 16
-				yPlane[yRow0+col1] = clampToByte(y01)
-			}
-
-			if hasRow1 {
-				idx10 := row1Base + col*4
-				r10 := int(rgba[idx10])
-				g10 := int(rgba[idx10+1])
-				b10 := int(rgba[idx10+2])
-				y10 := ((yRTable[r10] + yGTable[g10] + yBTable[b10] + 128) >> 8) + 16
-				yPlane[yRow1+col] = clampToByte(y10)
-
-				if col1 < w {
-					idx11 := idx10 + 4
-					r11 := int(rgba[idx11])
-					g11 := int(rgba[idx11+1])
-					b11 := int(rgba[idx11+2])
-					y11 := ((yRTable[r11] + yGTable[g11] + yBTable[b11] + 128) >> 8) + 16
-					yPlane[yRow1+col1] = clampToByte(y11)
-				}
-			}
+			srcCol1 := min(col1, w-1)
+			idx01 := row0Base + srcCol1*4
+			r01 := int(rgba[idx01])
+			g01 := int(rgba[idx01+1])
+			b01 := int(rgba[idx01+2])
+			y01 := ((yRTable[r01] + yGTable[g01] + yBTable[b01] + 128) >> 8) + 16
+			yPlane[yRow0+col1] = clampToByte(y01)
+
+			idx10 := row1Base + col*4
+			r10 := int(rgba[idx10])
+			g10 := int(rgba[idx10+1])
+			b10 := int(rgba[idx10+2])
+			y10 := ((yRTable[r10] + yGTable[g10] + yBTable[b10] + 128) >> 8) + 16
+			yPlane[yRow1+col] = clampToByte(y10)
+
+			idx11 := row1Base + srcCol1*4
+			r11 := int(rgba[idx11])
+			g11 := int(rgba[idx11+1])
+			b11 := int(rgba[idx11+2])
+			y11 := ((yRTable[r11] + yGTable[g11] + yBTable[b11] + 128) >> 8) + 16
+			yPlane[yRow1+col1] = clampToByte(y11)
 
 			uvCol := col / 2
 			uVal := ((uRTable[r00] + uGTable[g00] + uBTable[b00] + 128) >> 8) + 128
@@ -246,22 +392,28 @@ func clampToByte(v int) byte {
 	return byte(v)
 }
 
+// yuv420pToI420 はYUV420PをI420画像にコピーする
+// 奇数サイズの色差プレーンは切り上げた (w+1)/2 x (h+1)/2 とし（ffmpegと同じ）、輝度の端は複製して偶数サイズに拡張する
 func (e *VP8Encoder) yuv420pToI420(yuv []byte) {
 	h := int(e.img.DH)
 	w := int(e.img.DW)
+	paddedH := evenCeil(h)
+	paddedW := evenCeil(w)
 
 	yStride := int(e.img.Stride[vpx.PlaneY])
 	uStride := int(e.img.Stride[vpx.PlaneU])
 	vStride := int(e.img.Stride[vpx.PlaneV])
 
 	// Access planes directly via unsafe.Pointer
-	yPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneY])))[:yStride*h]
-	uPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneU])))[:uStride*h/2]
-	vPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneV])))[:vStride*h/2]
+	yPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneY])))[:yStride*paddedH]
+	uPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneU])))[:uStride*paddedH/2]
+	vPlane := (*(*[1 << 30]byte)(unsafe.Pointer(e.img.Planes[vpx.PlaneV])))[:vStride*paddedH/2]
 
 	// YUV420P layout: Y plane, then U plane, then V plane
+	uvW := paddedW / 2
+	uvH := paddedH / 2
 	ySize := w * h
-	uvSize := w * h / 4
+	uvSize := uvW * uvH
 
 	srcY := yuv[:ySize]
 	srcU := yuv[ySize : ySize+uvSize]
@@ -269,12 +421,17 @@ func (e *VP8Encoder) yuv420pToI420(yuv []byte) {
 
 	// Copy Y plane (row by row to handle stride)
 	for row := 0; row < h; row++ {
-		copy(yPlane[row*yStride:row*yStride+w], srcY[row*w:(row+1)*w])
+		dst := yPlane[row*yStride : row*yStride+paddedW]
+		copy(dst, srcY[row*w:(row+1)*w])
+		if paddedW > w {
+			dst[w] = dst[w-1]
+		}
+	}
+	if paddedH > h {
+		copy(yPlane[h*yStride:h*yStride+paddedW], yPlane[(h-1)*yStride:(h-1)*yStride+paddedW])
 	}
 
 	// Copy U plane
-	uvH := h / 2
-	uvW := w / 2
 	for row := 0; row < uvH; row++ {
 		copy(uPlane[row*uStride:row*uStride+uvW], srcU[row*uvW:(row+1)*uvW])
 	}
@@ -285,6 +442,16 @@ func (e *VP8Encoder) yuv420pToI420(yuv []byte) {
 	}
 }
 
+// evenCeil はnを偶数に切り上げる
+func evenCeil(n int) int {
+	return (n + 1) &^ 1
+}
+
+// i420FrameSize はwidth x heightのYUV420Pフレームのバイト数を返す（色差プレーンは切り上げ）
+func i420FrameSize(width, height int) int {
+	return width*height + 2*(evenCeil(width)/2)*(evenCeil(height)/2)
+}
+
 func (e *VP8Encoder) Close() {
 	if e.img != nil {
 		vpx.ImageFree(e.img)
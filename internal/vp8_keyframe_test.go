@@ -0,0 +1,164 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+const (
+	vp8KeyframeWidth  = 640
+	vp8KeyframeHeight = 360
+	vp8KeyframeFrames = 10
+)
+
+// vp8KeyframeEncodedFrame はエンコーダーが出力した1フレーム
+type vp8KeyframeEncodedFrame struct {
+	partitions [][]byte
+	keyframe   bool
+}
+
+// vp8KeyframeEncodeFrames は実際のVP8エンコーダーで先頭のキーフレームと後続のインターフレームを作る
+func vp8KeyframeEncodeFrames(partitioned bool) ([]vp8KeyframeEncodedFrame, error) {
+	VP8Partitions = partitioned
+	defer func() { VP8Partitions = false }()
+
+	encoder, err := NewVP8Encoder(vp8KeyframeWidth, vp8KeyframeHeight, "YUV420P", 1000)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+
+	var out []vp8KeyframeEncodedFrame
+	frame := make([]byte, vp8KeyframeWidth*vp8KeyframeHeight*3/2)
+	for i := 0; i < vp8KeyframeFrames; i++ {
+		for j := range frame {
+			frame[j] = byte(j*7 + i*13)
+		}
+		partitions, keyframe, err := encoder.EncodePartitions(frame)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		if len(partitions) > 0 {
+			out = append(out, vp8KeyframeEncodedFrame{partitions: partitions, keyframe: keyframe})
+		}
+	}
+	if len(out) < 2 || !out[0].keyframe || out[1].keyframe {
+		return nil, fmt.Errorf("expected a keyframe followed by interframes")
+	}
+	return out, nil
+}
+
+// descriptorVariants はS=1、PID=0のデスクリプタを長さ違いで用意する
+// デスクリプタ長を考慮しない判定では、frame tagではなくデスクリプタのバイトを読んでしまう
+var descriptorVariants = []struct {
+	name       string
+	descriptor []byte
+}{
+	{"1-byte", []byte{0x10}},
+	{"7-bit PictureID", []byte{0x90, 0x80, 0x01}},
+	{"15-bit PictureID + TL0PICIDX + TID", []byte{0x90, 0xE0, 0x80, 0x00, 0x05, 0x40}},
+	{"KEYIDX only", []byte{0x90, 0x10, 0x01}},
+}
+
+// TestVP8KeyframePayload はRTPペイロード単位のキーフレーム判定を検証する
+func TestVP8KeyframePayload(t *testing.T) {
+	encoded, err := vp8KeyframeEncodeFrames(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, variant := range descriptorVariants {
+		for i, frame := range encoded {
+			bitstream := frame.partitions[0]
+			payload := append(append([]byte{}, variant.descriptor...), bitstream...)
+			if got := IsVP8KeyframePayload(payload); got != frame.keyframe {
+				t.Fatalf("%s descriptor, frame %d: keyframe=%v, want %v", variant.name, i, got, frame.keyframe)
+			}
+
+			// 継続パケット（S=0）と第2パーティション以降の先頭（PID=1）はframe tagを含まない
+			continuation := append([]byte{}, payload...)
+			continuation[0] &^= 0x10
+			if IsVP8KeyframePayload(continuation) {
+				t.Fatalf("%s descriptor, frame %d: continuation packet detected as keyframe", variant.name, i)
+			}
+			partition := append([]byte{}, payload...)
+			partition[0] |= 0x01
+			if IsVP8KeyframePayload(partition) {
+				t.Fatalf("%s descriptor, frame %d: PID=1 packet detected as keyframe", variant.name, i)
+			}
+		}
+	}
+	if IsVP8KeyframePayload([]byte{0x90, 0x80}) {
+		t.Fatalf("truncated descriptor detected as keyframe")
+	}
+}
+
+// extendDescriptor はパケタイザーの1バイトデスクリプタに15-bit PictureIDを追加する
+func extendDescriptor(packet *rtp.Packet, pictureID uint16) {
+	payload := []byte{packet.Payload[0] | 0x80, 0x80, 0x80 | byte(pictureID>>8), byte(pictureID)}
+	packet.Payload = append(payload, packet.Payload[1:]...)
+}
+
+// testProcessorReassembly はパーティション分割されたパケットをRTPプロセッサで再構成し、
+// フレームの境界とキーフレーム判定がエンコーダーの出力と一致することを検証する
+func testProcessorReassembly(extended bool) error {
+	encoded, err := vp8KeyframeEncodeFrames(true)
+	if err != nil {
+		return err
+	}
+
+	packetizer := NewVP8Packetizer(1234)
+	processor := NewDefaultRTPProcessor()
+	multiPartition := false
+	for i, frame := range encoded {
+		multiPartition = multiPartition || len(frame.partitions) > 1
+
+		var packets []*rtp.Packet
+		collect := func(packet *rtp.Packet) error {
+			packets = append(packets, packet)
+			return nil
+		}
+		if _, err := packetizer.PacketizePartitionsAndWrite(frame.partitions, int64(i*33), frame.keyframe, collect); err != nil {
+			return err
+		}
+
+		var got [][]byte
+		for _, packet := range packets {
+			if extended {
+				extendDescriptor(packet, uint16(i))
+			}
+			out, err := processor.ProcessRTPPacket(packet, "vp8")
+			if err != nil {
+				return fmt.Errorf("frame %d: %v", i, err)
+			}
+			got = append(got, out...)
+		}
+
+		if len(got) != 1 {
+			return fmt.Errorf("frame %d: got %d frames, want 1", i, len(got))
+		}
+		if !bytes.Equal(got[0], bytes.Join(frame.partitions, nil)) {
+			return fmt.Errorf("frame %d (%d partitions): reassembled frame mismatch", i, len(frame.partitions))
+		}
+		if keyframe := IsVP8Keyframe(got[0]); keyframe != frame.keyframe {
+			return fmt.Errorf("frame %d: keyframe=%v, want %v", i, keyframe, frame.keyframe)
+		}
+	}
+	if !multiPartition {
+		return fmt.Errorf("encoder never emitted multiple partitions")
+	}
+	return nil
+}
+
+// TestVP8KeyframeProcessorReassembly は分割されたVP8フレームの再構成を、拡張ディスクリプタの有無で検証する
+func TestVP8KeyframeProcessorReassembly(t *testing.T) {
+	for _, extended := range []bool{false, true} {
+		t.Run(fmt.Sprintf("extended=%v", extended), func(t *testing.T) {
+			if err := testProcessorReassembly(extended); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,221 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+const (
+	vp8ResilienceWidth  = 640
+	vp8ResilienceHeight = 360
+	vp8ResilienceFrames = 5
+)
+
+// boolDecoder はVP8の算術復号器（RFC 6386 7.3）
+type boolDecoder struct {
+	data     []byte
+	pos      int
+	value    uint32
+	rng      uint32
+	bitCount int
+}
+
+func newBoolDecoder(data []byte) *boolDecoder {
+	d := &boolDecoder{data: data, rng: 255}
+	for i := 0; i < 2; i++ {
+		d.value <<= 8
+		if d.pos < len(d.data) {
+			d.value |= uint32(d.data[d.pos])
+			d.pos++
+		}
+	}
+	return d
+}
+
+func (d *boolDecoder) bool(prob uint32) bool {
+	split := 1 + (((d.rng - 1) * prob) >> 8)
+	bigSplit := split << 8
+	bit := d.value >= bigSplit
+	if bit {
+		d.rng -= split
+		d.value -= bigSplit
+	} else {
+		d.rng = split
+	}
+	for d.rng < 128 {
+		d.value <<= 1
+		d.rng <<= 1
+		d.bitCount++
+		if d.bitCount == 8 {
+			d.bitCount = 0
+			if d.pos < len(d.data) {
+				d.value |= uint32(d.data[d.pos])
+				d.pos++
+			}
+		}
+	}
+	return bit
+}
+
+// literal はnビットの値を上位ビットから読む
+func (d *boolDecoder) literal(n int) int {
+	v := 0
+	for i := 0; i < n; i++ {
+		v <<= 1
+		if d.bool(128) {
+			v |= 1
+		}
+	}
+	return v
+}
+
+// skipSigned はフラグが立っていればnビットの値と符号を読み飛ばす
+func (d *boolDecoder) skipSigned(n int) {
+	if d.literal(1) == 1 {
+		d.literal(n + 1)
+	}
+}
+
+// keyframeHeader はキーフレームのフレームヘッダー（RFC 6386 9.2〜9.7）から読んだ値
+type keyframeHeader struct {
+	partitions     int  // トークンパーティション数
+	refreshEntropy bool // refresh_entropy_probs（エラー耐性モードでは0）
+}
+
+// parseKeyframeHeader はキーフレームの第1パーティションの先頭を読み、トークンパーティション数とrefresh_entropy_probsを返す
+func parseKeyframeHeader(frame []byte) (keyframeHeader, error) {
+	if len(frame) < 10 || frame[0]&0x01 != 0 || !bytes.Equal(frame[3:6], []byte{0x9D, 0x01, 0x2A}) {
+		return keyframeHeader{}, fmt.Errorf("not a VP8 keyframe")
+	}
+	firstPartSize := int(frame[0])>>5 | int(frame[1])<<3 | int(frame[2])<<11
+	if len(frame) < 10+firstPartSize {
+		return keyframeHeader{}, fmt.Errorf("first partition truncated")
+	}
+	d := newBoolDecoder(frame[10 : 10+firstPartSize])
+	d.literal(2) // color_space, clamping_type
+
+	if d.literal(1) == 1 { // segmentation_enabled
+		updateMap := d.literal(1) == 1
+		if d.literal(1) == 1 { // update_segment_feature_data
+			d.literal(1) // segment_feature_mode
+			for i := 0; i < 4; i++ {
+				d.skipSigned(7) // quantizer
+			}
+			for i := 0; i < 4; i++ {
+				d.skipSigned(6) // loop filter level
+			}
+		}
+		if updateMap {
+			for i := 0; i < 3; i++ {
+				if d.literal(1) == 1 {
+					d.literal(8) // segment_prob
+				}
+			}
+		}
+	}
+
+	d.literal(1 + 6 + 3)   // filter_type, loop_filter_level, sharpness_level
+	if d.literal(1) == 1 { // loop_filter_adj_enable
+		if d.literal(1) == 1 { // mode_ref_lf_delta_update
+			for i := 0; i < 8; i++ {
+				d.skipSigned(6)
+			}
+		}
+	}
+
+	header := keyframeHeader{partitions: 1 << d.literal(2)}
+	d.literal(7) // y_ac_qi
+	for i := 0; i < 5; i++ {
+		d.skipSigned(4) // y_dc, y2_dc, y2_ac, uv_dc, uv_ac delta
+	}
+	header.refreshEntropy = d.literal(1) == 1
+	return header, nil
+}
+
+// encodeKeyframe は --error-resilient と --partitions を設定したエンコーダーでフレームを作り、
+// 最初のキーフレームのパーティションの一覧を返す
+// --partitions が2以上の場合、ParseWhipArgsと同じく --vp8-partitions も有効にする
+func encodeKeyframe(errorResilient bool, partitions int) ([][]byte, error) {
+	ErrorResilient = errorResilient
+	TokenPartitions = partitions
+	VP8Partitions = partitions > 1
+	defer func() {
+		ErrorResilient = false
+		TokenPartitions = 1
+		VP8Partitions = false
+	}()
+
+	encoder, err := NewVP8Encoder(vp8ResilienceWidth, vp8ResilienceHeight, "YUV420P", 1000)
+	if err != nil {
+		return nil, err
+	}
+	defer encoder.Close()
+
+	var keyframe [][]byte
+	frame := make([]byte, vp8ResilienceWidth*vp8ResilienceHeight*3/2)
+	for i := 0; i < vp8ResilienceFrames; i++ {
+		for j := range frame {
+			frame[j] = byte(j*7 + i*13)
+		}
+		encoded, isKeyframe, err := encoder.EncodePartitions(frame)
+		if err != nil {
+			return nil, fmt.Errorf("frame %d: %v", i, err)
+		}
+		if isKeyframe && keyframe == nil {
+			keyframe = encoded
+		}
+	}
+	if keyframe == nil {
+		return nil, fmt.Errorf("no keyframe encoded")
+	}
+	return keyframe, nil
+}
+
+// vp8ResilienceCheck はエンコードしたキーフレームのパーティション数とヘッダーの値を検証する
+func vp8ResilienceCheck(errorResilient bool, partitions int) error {
+	encoded, err := encodeKeyframe(errorResilient, partitions)
+	if err != nil {
+		return err
+	}
+	header, err := parseKeyframeHeader(bytes.Join(encoded, nil))
+	if err != nil {
+		return err
+	}
+	if header.partitions != partitions {
+		return fmt.Errorf("frame header declares %d token partitions, want %d", header.partitions, partitions)
+	}
+	if header.refreshEntropy == errorResilient {
+		return fmt.Errorf("refresh_entropy_probs=%v with error resilience %v, want %v", header.refreshEntropy, errorResilient, !errorResilient)
+	}
+	// パーティション単位の出力は、第1パーティションとトークンパーティションに分かれる
+	want := 1
+	if partitions > 1 {
+		want = partitions + 1
+	}
+	if len(encoded) != want {
+		return fmt.Errorf("encoder output %d partitions, want %d for separate packetization", len(encoded), want)
+	}
+	return nil
+}
+
+func TestVP8ResilienceDefault(t *testing.T) {
+	if err := vp8ResilienceCheck(false, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+func TestVP8ResilienceErrorResilient(t *testing.T) {
+	if err := vp8ResilienceCheck(true, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+func TestVP8ResiliencePartitions(t *testing.T) {
+	if err := vp8ResilienceCheck(false, 4); err != nil {
+		t.Fatal(err)
+	}
+}
+func TestVP8ResilienceBoth(t *testing.T) {
+	if err := vp8ResilienceCheck(true, 8); err != nil {
+		t.Fatal(err)
+	}
+}
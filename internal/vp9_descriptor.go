@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errVP9DescriptorTruncated = errors.New("truncated VP9 payload descriptor")
+
+// VP9PayloadDescriptor はVP9 RTPペイロードデスクリプタ（RFC 9628）の解析結果
+type VP9PayloadDescriptor struct {
+	HeaderSize     int  // デスクリプタのバイト数（ビットストリームの開始位置）
+	InterPicture   bool // P bit（前のピクチャを参照する。0ならキーフレームまたはレイヤー間予測のみ）
+	HasLayers      bool // L bit（レイヤーインデックスあり）
+	Flexible       bool // F bit
+	Start          bool // B bit（レイヤーフレームの先頭）
+	End            bool // E bit（レイヤーフレームの末尾）
+	NotRefForUpper bool // Z bit（上位の空間レイヤーから参照されない）
+	TID            uint8
+	SwitchingUp    bool  // U bit
+	SID            uint8 // 空間レイヤーID（HasLayersがfalseの場合は0）
+	InterLayer     bool  // D bit（下位の空間レイヤーを参照する）
+	// SS はScalability Structure（V=1の場合のみ、通常はキーフレームの先頭パケット）
+	SS *VP9ScalabilityStructure
+}
+
+// VP9ScalabilityStructure はScalability Structure（SS）の解析結果
+type VP9ScalabilityStructure struct {
+	SpatialLayers int
+	// Widths/Heights は空間レイヤーごとの解像度（Y=0の場合はnil）
+	Widths  []int
+	Heights []int
+}
+
+// ParseVP9PayloadDescriptor はRTPペイロード先頭のVP9ペイロードデスクリプタを解析する
+//
+//	 0 1 2 3 4 5 6 7
+//	+-+-+-+-+-+-+-+-+
+//	|I|P|L|F|B|E|V|Z| (必須)
+//	+-+-+-+-+-+-+-+-+
+//	|M| PICTURE ID  | (I=1の場合、M=1なら2バイト)
+//	+-+-+-+-+-+-+-+-+
+//	| TID |U| SID |D| (L=1の場合)
+//	+-+-+-+-+-+-+-+-+
+//	|   TL0PICIDX   | (L=1かつF=0の場合)
+//	+-+-+-+-+-+-+-+-+
+//	| P_DIFF      |N| (F=1かつP=1の場合、N=1なら続く。最大3個)
+//	+-+-+-+-+-+-+-+-+
+//	|      SS       | (V=1の場合)
+//	+-+-+-+-+-+-+-+-+
+func ParseVP9PayloadDescriptor(payload []byte) (VP9PayloadDescriptor, error) {
+	if len(payload) < 1 {
+		return VP9PayloadDescriptor{}, errVP9DescriptorTruncated
+	}
+
+	firstByte := payload[0]
+	d := VP9PayloadDescriptor{
+		HeaderSize:     1,
+		InterPicture:   firstByte&0x40 != 0,
+		HasLayers:      firstByte&0x20 != 0,
+		Flexible:       firstByte&0x10 != 0,
+		Start:          firstByte&0x08 != 0,
+		End:            firstByte&0x04 != 0,
+		NotRefForUpper: firstByte&0x01 != 0,
+	}
+
+	// I bit - Picture ID present
+	if firstByte&0x80 != 0 {
+		if len(payload) < d.HeaderSize+1 {
+			return VP9PayloadDescriptor{}, errVP9DescriptorTruncated
+		}
+		// M bit - Picture ID is 15 bits
+		if payload[d.HeaderSize]&0x80 != 0 {
+			d.HeaderSize++
+		}
+		d.HeaderSize++
+	}
+
+	// L bit - Layer indices present
+	if d.HasLayers {
+		if len(payload) < d.HeaderSize+1 {
+			return VP9PayloadDescriptor{}, errVP9DescriptorTruncated
+		}
+		layerByte := payload[d.HeaderSize]
+		d.TID = layerByte >> 5
+		d.SwitchingUp = layerByte&0x10 != 0
+		d.SID = (layerByte >> 1) & 0x07
+		d.InterLayer = layerByte&0x01 != 0
+		d.HeaderSize++
+		// 非flexibleモードではTL0PICIDXが続く
+		if !d.Flexible {
+			d.HeaderSize++
+		}
+	}
+
+	// F bit - flexibleモードでP=1の場合は参照インデックスが続く
+	if d.Flexible && d.InterPicture {
+		for i := 0; ; i++ {
+			if i == 3 || len(payload) < d.HeaderSize+1 {
+				return VP9PayloadDescriptor{}, errVP9DescriptorTruncated
+			}
+			refByte := payload[d.HeaderSize]
+			d.HeaderSize++
+			// N bit - more reference indices follow
+			if refByte&0x01 == 0 {
+				break
+			}
+		}
+	}
+
+	// V bit - Scalability structure present
+	if firstByte&0x02 != 0 {
+		ss, size, err := parseVP9ScalabilityStructure(payload[min(d.HeaderSize, len(payload)):])
+		if err != nil {
+			return VP9PayloadDescriptor{}, err
+		}
+		d.SS = ss
+		d.HeaderSize += size
+	}
+
+	if len(payload) < d.HeaderSize {
+		return VP9PayloadDescriptor{}, errVP9DescriptorTruncated
+	}
+	return d, nil
+}
+
+// parseVP9ScalabilityStructure はSSを解析し、SSのバイト数とともに返す
+//
+//	+-+-+-+-+-+-+-+-+
+//	| N_S |Y|G|-|-|-|
+//	+-+-+-+-+-+-+-+-+
+//	|     WIDTH     | (Y=1の場合、空間レイヤーごとに16bit)
+//	|     HEIGHT    | (Y=1の場合、空間レイヤーごとに16bit)
+//	+-+-+-+-+-+-+-+-+
+//	|      N_G      | (G=1の場合)
+//	+-+-+-+-+-+-+-+-+
+//	| TID |U| R |-|-| (N_G個のピクチャグループ)
+//	|    P_DIFF     | (R個)
+//	+-+-+-+-+-+-+-+-+
+func parseVP9ScalabilityStructure(data []byte) (*VP9ScalabilityStructure, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errVP9DescriptorTruncated
+	}
+	ss := &VP9ScalabilityStructure{SpatialLayers: int(data[0]>>5) + 1}
+	hasResolution := data[0]&0x10 != 0
+	hasGroups := data[0]&0x08 != 0
+	size := 1
+
+	if hasResolution {
+		if len(data) < size+4*ss.SpatialLayers {
+			return nil, 0, errVP9DescriptorTruncated
+		}
+		for i := 0; i < ss.SpatialLayers; i++ {
+			ss.Widths = append(ss.Widths, int(binary.BigEndian.Uint16(data[size:])))
+			ss.Heights = append(ss.Heights, int(binary.BigEndian.Uint16(data[size+2:])))
+			size += 4
+		}
+	}
+
+	if hasGroups {
+		if len(data) < size+1 {
+			return nil, 0, errVP9DescriptorTruncated
+		}
+		groups := int(data[size])
+		size++
+		for i := 0; i < groups; i++ {
+			if len(data) < size+1 {
+				return nil, 0, errVP9DescriptorTruncated
+			}
+			refs := int(data[size]>>2) & 0x03
+			size += 1 + refs
+		}
+		if len(data) < size {
+			return nil, 0, errVP9DescriptorTruncated
+		}
+	}
+	return ss, size, nil
+}
@@ -0,0 +1,82 @@
+package internal
+
+// VP9のsuperframe（VP9 Bitstream Specification Annex B）
+// 複数のフレームを連結し、末尾にフレームサイズのインデックスを付けたもの。
+// libvpxは1回のデコードでsuperframe内のフレームを順にデコードし、最後のフレームのみを出力する
+
+// splitVP9Superframe はsuperframeを個々のフレームに分割する
+// superframeでない場合はdataのみを返す
+func splitVP9Superframe(data []byte) [][]byte {
+	if len(data) == 0 {
+		return [][]byte{data}
+	}
+	marker := data[len(data)-1]
+	if marker&0xE0 != 0xC0 {
+		return [][]byte{data}
+	}
+	frames := int(marker&0x07) + 1
+	mag := int(marker>>3&0x03) + 1
+	indexSize := 2 + mag*frames
+	if len(data) < indexSize || data[len(data)-indexSize] != marker {
+		return [][]byte{data}
+	}
+
+	index := data[len(data)-indexSize+1:]
+	var result [][]byte
+	offset := 0
+	for i := 0; i < frames; i++ {
+		size := 0
+		for b := 0; b < mag; b++ {
+			size |= int(index[i*mag+b]) << (8 * b)
+		}
+		if offset+size > len(data)-indexSize {
+			return [][]byte{data}
+		}
+		result = append(result, data[offset:offset+size])
+		offset += size
+	}
+	return result
+}
+
+// maxVP9SuperframeFrames はsuperframeに含められるフレーム数の上限
+const maxVP9SuperframeFrames = 8
+
+// buildVP9Superframe はフレームを1つのsuperframeにまとめる
+// 入力にsuperframeが含まれる場合は展開してから連結する（superframeは入れ子にできない）
+// 上限を超える場合はnilを返す
+func buildVP9Superframe(layers [][]byte) []byte {
+	var frames [][]byte
+	for _, layer := range layers {
+		frames = append(frames, splitVP9Superframe(layer)...)
+	}
+	if len(frames) == 1 {
+		return frames[0]
+	}
+	if len(frames) > maxVP9SuperframeFrames {
+		return nil
+	}
+
+	maxSize := 0
+	total := 0
+	for _, frame := range frames {
+		maxSize = max(maxSize, len(frame))
+		total += len(frame)
+	}
+	mag := 1
+	for mag < 4 && maxSize >= 1<<(8*mag) {
+		mag++
+	}
+	marker := byte(0xC0 | (mag-1)<<3 | (len(frames) - 1))
+
+	out := make([]byte, 0, total+2+mag*len(frames))
+	for _, frame := range frames {
+		out = append(out, frame...)
+	}
+	out = append(out, marker)
+	for _, frame := range frames {
+		for b := 0; b < mag; b++ {
+			out = append(out, byte(len(frame)>>(8*b)))
+		}
+	}
+	return append(out, marker)
+}
@@ -0,0 +1,307 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const wavOutputSampleRate = 48000
+
+// wavFile は書き込まれたWAVのヘッダーの値とPCM
+type wavFile struct {
+	riffSize      uint32
+	format        uint16
+	channels      int
+	sampleRate    int
+	byteRate      int
+	blockAlign    int
+	bitsPerSample int
+	dataSize      uint32
+	pcm           []byte
+}
+
+// parseWAV はRIFF/WAVEのヘッダーを検証し、値とdataチャンクを返す
+func parseWAV(data []byte) (*wavFile, error) {
+	if len(data) < 44 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" {
+		return nil, fmt.Errorf("not a RIFF/WAVE file")
+	}
+	if string(data[12:16]) != "fmt " || binary.LittleEndian.Uint32(data[16:]) != 16 {
+		return nil, fmt.Errorf("missing 16-byte fmt chunk")
+	}
+	if string(data[36:40]) != "data" {
+		return nil, fmt.Errorf("missing data chunk after fmt")
+	}
+	return &wavFile{
+		riffSize:      binary.LittleEndian.Uint32(data[4:]),
+		format:        binary.LittleEndian.Uint16(data[20:]),
+		channels:      int(binary.LittleEndian.Uint16(data[22:])),
+		sampleRate:    int(binary.LittleEndian.Uint32(data[24:])),
+		byteRate:      int(binary.LittleEndian.Uint32(data[28:])),
+		blockAlign:    int(binary.LittleEndian.Uint16(data[32:])),
+		bitsPerSample: int(binary.LittleEndian.Uint16(data[34:])),
+		dataSize:      binary.LittleEndian.Uint32(data[40:]),
+		pcm:           data[44:],
+	}, nil
+}
+
+// validate はヘッダーのサイズがファイルと一致し、形式がchannelsチャンネルの16bit PCMであることを検証する
+func (f *wavFile) validate(fileSize, channels int) error {
+	if f.format != 1 || f.bitsPerSample != 16 {
+		return fmt.Errorf("format %d, %d bits, want PCM 16 bits", f.format, f.bitsPerSample)
+	}
+	if f.channels != channels || f.sampleRate != wavOutputSampleRate {
+		return fmt.Errorf("%dHz %d channels, want %dHz %d channels", f.sampleRate, f.channels, wavOutputSampleRate, channels)
+	}
+	if f.blockAlign != channels*2 || f.byteRate != wavOutputSampleRate*channels*2 {
+		return fmt.Errorf("block align %d, byte rate %d do not match %d channels", f.blockAlign, f.byteRate, channels)
+	}
+	if int(f.riffSize) != fileSize-8 {
+		return fmt.Errorf("RIFF size %d, want %d", f.riffSize, fileSize-8)
+	}
+	if int(f.dataSize) != len(f.pcm) {
+		return fmt.Errorf("data size %d, want %d", f.dataSize, len(f.pcm))
+	}
+	return nil
+}
+
+// sample はS16LEインターリーブのPCMのi番目のサンプルフレームのチャンネルcの値を返す
+func sample(pcm []byte, channels, i, c int) int16 {
+	return int16(binary.LittleEndian.Uint16(pcm[(i*channels+c)*2:]))
+}
+
+// synthPCM はchannelsチャンネルのframesサンプル分のPCMを作る（チャンネルcのサンプルiは i*(c+1)）
+func synthPCM(frames, channels int) []byte {
+	pcm := make([]byte, frames*channels*2)
+	for i := 0; i < frames; i++ {
+		for c := 0; c < channels; c++ {
+			binary.LittleEndian.PutUint16(pcm[(i*channels+c)*2:], uint16(int16(i*(c+1))))
+		}
+	}
+	return pcm
+}
+
+// writeWAV はtmpディレクトリのファイルにWAVWriterでchannelsチャンネルのWAVを書き、閉じた後の内容を返す
+func writeWAV(channels int, write func(*WAVWriter) error) ([]byte, error) {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("test_wav_output_%d.wav", os.Getpid()))
+	defer os.Remove(path)
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	wav := NewWAVWriter(file, wavOutputSampleRate, channels)
+	writeErr := write(wav)
+	closeErr := wav.Close()
+	file.Close()
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	if closeErr != nil {
+		return nil, closeErr
+	}
+	return os.ReadFile(path)
+}
+
+// TestWAVOutputStereoFrames は10msのステレオPCMを複数回書き込み、ヘッダーのサイズが確定したWAVになることを検証する
+func TestWAVOutputStereoFrames(t *testing.T) {
+	var want []byte
+	data, err := writeWAV(2, func(wav *WAVWriter) error {
+		for i := 0; i < 50; i++ {
+			frame := synthPCM(480, 2)
+			want = append(want, frame...)
+			if err := wav.WritePCM(frame, 2); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parseWAV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.validate(len(data), 2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(f.pcm, want) {
+		t.Fatalf("PCM differs from the written frames")
+	}
+}
+
+// TestWAVOutputEmpty はPCMを書き込まずに閉じた場合も、空の有効なWAVになることを検証する
+func TestWAVOutputEmpty(t *testing.T) {
+	data, err := writeWAV(2, func(*WAVWriter) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parseWAV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.validate(len(data), 2); err != nil {
+		t.Fatal(err)
+	}
+	if f.dataSize != 0 {
+		t.Fatalf("data size %d, want 0", f.dataSize)
+	}
+}
+
+// TestWAVOutputChannelConversion はモノラル、ステレオ、5.1chのPCMをWAVのチャンネル数に変換することを検証する
+func TestWAVOutputChannelConversion(t *testing.T) {
+	// モノラル → ステレオ: 各チャンネルに複製する
+	data, err := writeWAV(2, func(wav *WAVWriter) error { return wav.WritePCM(synthPCM(100, 1), 1) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parseWAV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.validate(len(data), 2); err != nil {
+		t.Fatalf("mono to stereo: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if sample(f.pcm, 2, i, 0) != int16(i) || sample(f.pcm, 2, i, 1) != int16(i) {
+			t.Fatalf("mono to stereo: frame %d is (%d, %d), want (%d, %d)", i, sample(f.pcm, 2, i, 0), sample(f.pcm, 2, i, 1), i, i)
+		}
+	}
+
+	// ステレオ → モノラル: 左右の平均（i と 2i の平均）
+	data, err = writeWAV(1, func(wav *WAVWriter) error { return wav.WritePCM(synthPCM(100, 2), 2) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err = parseWAV(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.validate(len(data), 1); err != nil {
+		t.Fatalf("stereo to mono: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if got, want := sample(f.pcm, 1, i, 0), int16(i*3/2); got != want {
+			t.Fatalf("stereo to mono: frame %d is %d, want %d", i, got, want)
+		}
+	}
+
+	// 5.1ch → ステレオ: FLとFC（-3dB）、BL（-3dB）の合計が左になる
+	data, err = writeWAV(2, func(wav *WAVWriter) error { return wav.WritePCM(synthPCM(100, 6), 6) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f, err = parseWAV(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.validate(len(data), 2); err != nil {
+		t.Fatalf("5.1 to stereo: %v", err)
+	}
+	i := 60
+	wantLeft := float64(i) + 0.7071*float64(i*3) + 0.7071*float64(i*5)
+	if got := float64(sample(f.pcm, 2, i, 0)); math.Abs(got-wantLeft) > 1 {
+		t.Fatalf("5.1 to stereo: left sample %v, want about %v", got, wantLeft)
+	}
+}
+
+// nonSeekable はio.Seekerを実装しない出力（パイプの代わり）
+type nonSeekable struct {
+	bytes.Buffer
+}
+
+// TestWAVOutputNonSeekable はシークできない出力では、ヘッダーのサイズが仮の値のまま残ることを検証する
+func TestWAVOutputNonSeekable(t *testing.T) {
+	out := &nonSeekable{}
+	wav := NewWAVWriter(out, wavOutputSampleRate, 2)
+	if err := wav.WritePCM(synthPCM(480, 2), 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := wav.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f, err := parseWAV(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.riffSize != math.MaxUint32 || f.dataSize != math.MaxUint32 {
+		t.Fatalf("RIFF size %d, data size %d, want placeholders %d", f.riffSize, f.dataSize, uint32(math.MaxUint32))
+	}
+	if len(f.pcm) != 480*4 {
+		t.Fatalf("%d bytes of PCM, want %d", len(f.pcm), 480*4)
+	}
+}
+
+// TestWAVOutputOpusDecode は合成した正弦波をOpusでエンコードし、OpusWAVTapで欠落を無音で埋めたWAVになることを検証する
+func TestWAVOutputOpusDecode(t *testing.T) {
+	encoder, err := NewOpusEncoder(wavOutputSampleRate, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 1秒分の440Hzの正弦波（ステレオ）
+	pcm := make([]byte, wavOutputSampleRate*4)
+	for i := 0; i < wavOutputSampleRate; i++ {
+		v := uint16(int16(8000 * math.Sin(2*math.Pi*440*float64(i)/wavOutputSampleRate)))
+		binary.LittleEndian.PutUint16(pcm[i*4:], v)
+		binary.LittleEndian.PutUint16(pcm[i*4+2:], v)
+	}
+	frames, err := encoder.Encode(pcm, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 100 {
+		t.Fatalf("encoder returned %d frames, want 100", len(frames))
+	}
+
+	const firstTimestamp = 123456
+	data, err := writeWAV(2, func(wav *WAVWriter) error {
+		tap, err := NewOpusWAVTap(wav)
+		if err != nil {
+			return err
+		}
+		defer tap.Close()
+		for i, frame := range frames {
+			// 40〜49番目のパケット（100ms）が欠落したとする
+			if i >= 40 && i < 50 {
+				continue
+			}
+			if err := tap.WriteAudioFrame(frame.Data, uint32(firstTimestamp+i*480)); err != nil {
+				return err
+			}
+		}
+		// 遅れて届いた欠落パケットは書き込まない
+		return tap.WriteAudioFrame(frames[45].Data, uint32(firstTimestamp+45*480))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := parseWAV(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.validate(len(data), 2); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(f.pcm) / 4; got != wavOutputSampleRate {
+		t.Fatalf("%d samples, want %d (1s with the 100ms gap filled)", got, wavOutputSampleRate)
+	}
+	// 欠落した区間は無音、それ以外は正弦波の振幅が出ている
+	if peak := peakAmplitude(f.pcm, 40*480, 50*480); peak != 0 {
+		t.Fatalf("gap has peak amplitude %d, want silence", peak)
+	}
+	if peak := peakAmplitude(f.pcm, 60*480, 100*480); peak < 4000 {
+		t.Fatalf("decoded audio has peak amplitude %d, want about 8000", peak)
+	}
+}
+
+// peakAmplitude はステレオPCMのサンプルフレーム[from, to)の左チャンネルの最大振幅を返す
+func peakAmplitude(pcm []byte, from, to int) int {
+	peak := 0
+	for i := from; i < to; i++ {
+		v := int(sample(pcm, 2, i, 0))
+		peak = max(peak, v, -v)
+	}
+	return peak
+}
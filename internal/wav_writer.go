@@ -0,0 +1,266 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	opus "github.com/qrtc/opus-go"
+)
+
+// WAVのヘッダー（RIFF、fmt、dataチャンクの先頭）のサイズ
+const wavHeaderSize = 44
+
+// wavUnknownSize はサイズが確定するまでRIFFとdataチャンクに書いておく値
+// シークできない出力では書き換えられないため、ストリームとして読むプレイヤー向けに最大値としておく
+const wavUnknownSize = math.MaxUint32
+
+// WAVWriter はS16LEのPCMをRIFF/WAVEとして書き込む（--wav-out）
+// ヘッダーのサイズは仮の値で書き、Closeでシークして確定した値に書き換える
+// 再接続をまたいで1つのファイルになるよう、接続ごとのOpusWAVTapから書き込む
+type WAVWriter struct {
+	mu         sync.Mutex
+	w          io.Writer
+	out        *outputWriter
+	bufWriter  *bufio.Writer
+	sampleRate int
+	channels   int
+	dataSize   int64 // 書き込んだPCMのバイト数
+	started    bool  // ヘッダーを書き込み済み
+	closed     bool
+}
+
+// NewWAVWriter はsampleRate、channelsチャンネルのWAVをwに書き込むWAVWriterを作成する
+// wがio.Seekerでなければ、ヘッダーのサイズは仮の値のまま残る
+func NewWAVWriter(w io.Writer, sampleRate, channels int) *WAVWriter {
+	out := newOutputWriter(w)
+	return &WAVWriter{
+		w:          w,
+		out:        out,
+		bufWriter:  bufio.NewWriterSize(out, defaultOutputBufferSize),
+		sampleRate: sampleRate,
+		channels:   channels,
+	}
+}
+
+// SampleRate は書き込むWAVのサンプリングレートを返す
+func (w *WAVWriter) SampleRate() int {
+	return w.sampleRate
+}
+
+// Channels は書き込むWAVのチャンネル数を返す
+func (w *WAVWriter) Channels() int {
+	return w.channels
+}
+
+// WritePCM はchannelsチャンネルのS16LEインターリーブのPCMを、WAVのチャンネル数に変換して書き込む
+// 最初の呼び出しでヘッダーを書き込む。末尾の不完全なサンプルフレームは捨てる
+func (w *WAVWriter) WritePCM(pcm []byte, channels int) error {
+	converted, err := convertPCMChannels(pcm, channels, w.channels)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return fmt.Errorf("WAV writer is closed")
+	}
+	if !w.started {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.bufWriter.Write(converted); err != nil {
+		return err
+	}
+	w.dataSize += int64(len(converted))
+	return nil
+}
+
+// writeHeader はサイズを仮の値としたヘッダーを書き込む
+func (w *WAVWriter) writeHeader() error {
+	if _, err := w.bufWriter.Write(w.header(wavUnknownSize, wavUnknownSize)); err != nil {
+		return err
+	}
+	w.started = true
+	return nil
+}
+
+// header はRIFFチャンクとdataチャンクのサイズを指定したヘッダーを返す
+func (w *WAVWriter) header(riffSize, dataSize uint32) []byte {
+	blockAlign := w.channels * 2
+	header := make([]byte, wavHeaderSize)
+	copy(header[0:], "RIFF")
+	binary.LittleEndian.PutUint32(header[4:], riffSize)
+	copy(header[8:], "WAVE")
+	copy(header[12:], "fmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1) // WAVE_FORMAT_PCM
+	binary.LittleEndian.PutUint16(header[22:], uint16(w.channels))
+	binary.LittleEndian.PutUint32(header[24:], uint32(w.sampleRate))
+	binary.LittleEndian.PutUint32(header[28:], uint32(w.sampleRate*blockAlign))
+	binary.LittleEndian.PutUint16(header[32:], uint16(blockAlign))
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	binary.LittleEndian.PutUint32(header[40:], dataSize)
+	return header
+}
+
+// Close は残りのPCMを書き出し、出力がシークできればヘッダーのサイズを確定した値に書き換える
+// PCMを1度も書き込んでいない場合も、空のWAVとしてヘッダーを書き込む
+// 4GiBを超えたWAVはサイズを表せないため、仮の値のまま残す
+func (w *WAVWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if !w.started {
+		if err := w.writeHeader(); err != nil {
+			return err
+		}
+	}
+	if err := w.bufWriter.Flush(); err != nil {
+		return err
+	}
+
+	// *os.Fileはパイプでもio.Seekerを満たすため、通常のファイルかを確認する
+	seeker, ok := w.w.(io.Seeker)
+	if _, isFile := w.w.(*os.File); !ok || isFile && !isSeekableOutput(w.w) {
+		return nil
+	}
+	dataSize := w.dataSize
+	if dataSize+wavHeaderSize-8 > math.MaxUint32 {
+		DebugLog("WAV output exceeds 4GiB, leaving the header sizes unset\n")
+		return nil
+	}
+	header := w.header(uint32(dataSize+wavHeaderSize-8), uint32(dataSize))
+	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek WAV output: %w", err)
+	}
+	if _, err := w.out.Write(header); err != nil {
+		return err
+	}
+	if _, err := seeker.Seek(0, io.SeekEnd); err != nil {
+		return fmt.Errorf("failed to seek WAV output: %w", err)
+	}
+	return nil
+}
+
+// convertPCMChannels はS16LEインターリーブのPCMのチャンネル数をfromからtoに変換する
+// モノラルは各チャンネルに複製し、モノラルへは平均を取る
+// 3チャンネル以上はDownmixToStereoの係数でステレオにしてから変換する
+func convertPCMChannels(pcm []byte, from, to int) ([]byte, error) {
+	if from <= 0 || to <= 0 {
+		return nil, fmt.Errorf("invalid PCM channel count: %d to %d", from, to)
+	}
+	if from == to {
+		return pcm[:len(pcm)/(from*2)*(from*2)], nil
+	}
+	if from > 2 {
+		stereo, err := DownmixToStereo(pcm, from)
+		if err != nil {
+			return nil, err
+		}
+		return convertPCMChannels(stereo, 2, to)
+	}
+	frames := len(pcm) / (from * 2)
+	switch {
+	case from == 1:
+		out := make([]byte, frames*to*2)
+		for i := 0; i < frames; i++ {
+			for c := 0; c < to; c++ {
+				copy(out[(i*to+c)*2:], pcm[i*2:i*2+2])
+			}
+		}
+		return out, nil
+	case from == 2 && to == 1:
+		out := make([]byte, frames*2)
+		for i := 0; i < frames; i++ {
+			left := int(int16(binary.LittleEndian.Uint16(pcm[i*4:])))
+			right := int(int16(binary.LittleEndian.Uint16(pcm[i*4+2:])))
+			binary.LittleEndian.PutUint16(out[i*2:], uint16(int16((left+right)/2)))
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("no PCM conversion from %d to %d channels", from, to)
+}
+
+// Opusのデコード設定
+// WebRTCのOpusはRTPクロック48kHz、SDPでは常に2チャンネルとして扱われるため、ステレオでデコードする
+const (
+	opusDecodeChannels = 2
+	// 1パケットの最大の長さ（120ms）
+	opusMaxFrameSamples = 48000 * 120 / 1000
+	// RTP timestampの飛びを無音で埋める上限（これを超える飛びは送信側の再開とみなして埋めない）
+	wavMaxGapSamples = 48000 * 10
+)
+
+// OpusWAVTap は受信したOpusパケットをデコードし、WAVWriterに書き込む
+// 1回の接続分の音声トラック（最初の1本）に使い、デコーダーの状態は接続ごとに作り直す
+// パケットの欠落によるRTP timestampの飛びは無音で埋め、WAVの長さを受信した時間に合わせる
+type OpusWAVTap struct {
+	wav           *WAVWriter
+	decoder       *opus.OpusDecoder
+	pcm           []byte
+	nextTimestamp uint32 // 次のパケットに期待するRTP timestamp
+	started       bool
+}
+
+// NewOpusWAVTap はwavに書き込むOpusWAVTapを作成する
+func NewOpusWAVTap(wav *WAVWriter) (*OpusWAVTap, error) {
+	decoder, err := opus.CreateOpusDecoder(&opus.OpusDecoderConfig{
+		SampleRate:  wav.SampleRate(),
+		MaxChannels: opusDecodeChannels,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Opus decoder: %w", err)
+	}
+	return &OpusWAVTap{
+		wav:     wav,
+		decoder: decoder,
+		pcm:     make([]byte, opusMaxFrameSamples*opusDecodeChannels*2),
+	}, nil
+}
+
+// WriteAudioFrame はOpusパケットをデコードしてWAVに書き込む
+// デコードできないパケットは主の出力に影響しないよう捨て、WAVの書き込みエラーのみを返す
+func (t *OpusWAVTap) WriteAudioFrame(data []byte, timestamp uint32) error {
+	n, err := t.decoder.Decode(data, t.pcm)
+	if err != nil {
+		DebugLogPeriodic("wav.decode", time.Second, "Failed to decode Opus for WAV output, packet skipped: %v\n", err)
+		return nil
+	}
+	samples := n / (opusDecodeChannels * 2)
+	// RTPクロックはデコード後のサンプリングレートと異なる場合があるため、48kHzから換算する
+	rtpSamples := uint32(samples * 48000 / t.wav.SampleRate())
+
+	if t.started {
+		gap := int32(timestamp - t.nextTimestamp)
+		if gap < 0 {
+			// 再送や並べ替えで遅れて届いたパケットは、書き込み済みの位置に戻せないため捨てる
+			return nil
+		}
+		if gap > 0 && gap <= wavMaxGapSamples {
+			silence := make([]byte, int(gap)*t.wav.SampleRate()/48000*opusDecodeChannels*2)
+			if err := t.wav.WritePCM(silence, opusDecodeChannels); err != nil {
+				return err
+			}
+		}
+	}
+	t.started = true
+	t.nextTimestamp = timestamp + rtpSamples
+	return t.wav.WritePCM(t.pcm[:n], opusDecodeChannels)
+}
+
+// Close はデコーダーを解放する（WAVWriterは閉じない）
+func (t *OpusWAVTap) Close() error {
+	return t.decoder.Close()
+}
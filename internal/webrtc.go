@@ -1,12 +1,17 @@
 package internal
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
 
+	"github.com/pion/ice/v4"
 	"github.com/pion/interceptor"
 	"github.com/pion/interceptor/pkg/videoframe"
+	"github.com/pion/rtcp"
+	"github.com/pion/transport/v4"
+	"github.com/pion/transport/v4/stdnet"
 	"github.com/pion/webrtc/v4"
 )
 
@@ -18,6 +23,7 @@ const (
 	StateConnected
 	StateDisconnected
 	StateFailed
+	StateChecking
 )
 
 // ConnectionEvent は接続イベントを通知する構造体
@@ -26,6 +32,32 @@ type ConnectionEvent struct {
 	Error error
 }
 
+// ErrDTLSHandshake はICE接続後のDTLSハンドシェイクに失敗したことを示す
+// SDPのフィンガープリントと証明書が一致しない場合等に起き、ICEの状態には現れないため
+// 検出しないとメディアタイムアウトとしてしか見えない
+var ErrDTLSHandshake = errors.New("DTLS handshake failed - check server certificate/clock skew")
+
+// WatchDTLSState はDTLSトランスポートの状態を監視し、ハンドシェイクに失敗した場合にonFailedを呼ぶ
+func WatchDTLSState(peerConnection *webrtc.PeerConnection, onFailed func()) {
+	peerConnection.SCTP().Transport().OnStateChange(func(state webrtc.DTLSTransportState) {
+		DebugLog("DTLS Transport State has changed: %s\n", state.String())
+		if state == webrtc.DTLSTransportStateFailed {
+			fmt.Fprintln(os.Stderr, "DTLS handshake failed")
+			onFailed()
+		}
+	})
+}
+
+// SendGoodbye は送信中の全SSRC（simulcast時は全レイヤー）と、受信時のRTCPフィードバックのSSRCについてRTCP BYEを送る
+// pionはClose時にBYEを送らないため、正常終了とクラッシュを区別できるよう終了前に明示的に送る
+func SendGoodbye(peerConnection *webrtc.PeerConnection, feedbackSSRCs []uint32) error {
+	sources := GoodbyeSources(peerConnection, feedbackSSRCs)
+	if len(sources) == 0 {
+		return nil
+	}
+	return peerConnection.WriteRTCP([]rtcp.Packet{&rtcp.Goodbye{Sources: sources, Reason: "end of stream"}})
+}
+
 func CreateMediaEngine(codec string) (*webrtc.MediaEngine, error) {
 	mediaEngine := &webrtc.MediaEngine{}
 
@@ -36,7 +68,7 @@ func CreateMediaEngine(codec string) (*webrtc.MediaEngine, error) {
 			RTPCodecCapability: webrtc.RTPCodecCapability{
 				MimeType: webrtc.MimeTypeVP8, ClockRate: 90000,
 			},
-			PayloadType: 97,
+			PayloadType: webrtc.PayloadType(VP8PayloadType),
 		}, webrtc.RTPCodecTypeVideo); err != nil {
 			return nil, err
 		}
@@ -45,7 +77,7 @@ func CreateMediaEngine(codec string) (*webrtc.MediaEngine, error) {
 			RTPCodecCapability: webrtc.RTPCodecCapability{
 				MimeType: webrtc.MimeTypeVP9, ClockRate: 90000,
 			},
-			PayloadType: 98,
+			PayloadType: webrtc.PayloadType(VP9PayloadType),
 		}, webrtc.RTPCodecTypeVideo); err != nil {
 			return nil, err
 		}
@@ -58,35 +90,41 @@ func CreateMediaEngine(codec string) (*webrtc.MediaEngine, error) {
 		RTPCodecCapability: webrtc.RTPCodecCapability{
 			MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2,
 		},
-		PayloadType: 111,
+		PayloadType: webrtc.PayloadType(OpusPayloadType),
 	}, webrtc.RTPCodecTypeAudio); err != nil {
 		return nil, err
 	}
 
+	if err := RegisterHeaderExtensions(mediaEngine); err != nil {
+		return nil, err
+	}
+
 	return mediaEngine, nil
 }
 
+// CreateVP8VP9MediaEngine は受信用にVP8/VP9/Opusを登録したMediaEngineを作成する
+// offerのコーデックは登録順に並ぶため、--codec で指定したコーデックを先に登録して優先させる
 func CreateVP8VP9MediaEngine() (*webrtc.MediaEngine, error) {
 	mediaEngine := &webrtc.MediaEngine{}
 
-	// Register VP8
-	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType: webrtc.MimeTypeVP8, ClockRate: 90000,
+	// Register VP8/VP9
+	video := []webrtc.RTPCodecParameters{
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000},
+			PayloadType:        webrtc.PayloadType(VP8PayloadType),
 		},
-		PayloadType: 97,
-	}, webrtc.RTPCodecTypeVideo); err != nil {
-		return nil, err
-	}
-
-	// Register VP9
-	if err := mediaEngine.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType: webrtc.MimeTypeVP9, ClockRate: 90000,
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000},
+			PayloadType:        webrtc.PayloadType(VP9PayloadType),
 		},
-		PayloadType: 98,
-	}, webrtc.RTPCodecTypeVideo); err != nil {
-		return nil, err
+	}
+	if VideoCodec == VideoCodecVP9 {
+		video[0], video[1] = video[1], video[0]
+	}
+	for _, codec := range video {
+		if err := mediaEngine.RegisterCodec(codec, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
 	}
 
 	// Register audio codec (Opus)
@@ -94,11 +132,15 @@ func CreateVP8VP9MediaEngine() (*webrtc.MediaEngine, error) {
 		RTPCodecCapability: webrtc.RTPCodecCapability{
 			MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2,
 		},
-		PayloadType: 111,
+		PayloadType: webrtc.PayloadType(OpusPayloadType),
 	}, webrtc.RTPCodecTypeAudio); err != nil {
 		return nil, err
 	}
 
+	if err := RegisterHeaderExtensions(mediaEngine); err != nil {
+		return nil, err
+	}
+
 	return mediaEngine, nil
 }
 
@@ -113,10 +155,113 @@ func MimeTypeToCodec(mimeType string) string {
 	}
 }
 
+// NewSettingEngine はフラグに応じて設定したSettingEngineを作成する
+// pionはデフォルトでホスト候補をmDNS(.local)名で秘匿するが、mDNSを解決できない
+// サーバーでは接続できない。--disable-mdns 指定時は実IPを候補として公開する。
+// この場合ローカルIPアドレスがSDP経由でシグナリング先に露出する点に注意。
+// --dscp 指定時はpionのUDPソケットにDSCPを設定する。
+func NewSettingEngine() webrtc.SettingEngine {
+	settingEngine := webrtc.SettingEngine{}
+	if DisableMDNS {
+		settingEngine.SetICEMulticastDNSMode(ice.MulticastDNSModeDisabled)
+		DebugLog("SettingEngine: mDNS disabled, host candidates will use real IPs\n")
+	}
+	var mediaNet transport.Net
+	if DSCPCodepoint > 0 {
+		dscpNet, err := NewDSCPNet(DSCPCodepoint)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: --dscp not applied: %v\n", err)
+		} else {
+			mediaNet = dscpNet
+			DebugLog("SettingEngine: DSCP %d on media sockets\n", DSCPCodepoint)
+		}
+	}
+	if UDPRecvBuffer > 0 {
+		// --dscp と併用する場合はDSCPを設定するtransport.Netの上に重ねる
+		if mediaNet == nil {
+			if stdNet, err := stdnet.NewNet(); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: --udp-recv-buffer not applied: %v\n", err)
+			} else {
+				mediaNet = stdNet
+			}
+		}
+		if mediaNet != nil {
+			mediaNet = NewRecvBufferNet(mediaNet, UDPRecvBuffer)
+			DebugLog("SettingEngine: UDP receive buffer %d bytes on media sockets\n", UDPRecvBuffer)
+		}
+	}
+	if mediaNet != nil {
+		settingEngine.SetNet(mediaNet)
+	}
+	return settingEngine
+}
+
+// RegisterInterceptors はwebrtc.RegisterDefaultInterceptorsと同等のインターセプターを登録する
+// --no-nack / --no-twcc（--no-twcc-feedback）指定時は該当するインターセプターを除外する。
+// --extensions にtransport-ccが無い場合もTWCCのインターセプターを除外する。
+// ヘッダー拡張はMediaEngineの作成時にRegisterHeaderExtensionsで登録する。
+// NACKを無効にすると再送待ちが無くなり遅延は下がるが、パケットロスがそのまま映像破損になる。
+// TWCCを無効にすると輻輳フィードバックが無くなり、送信側の帯域推定が働かなくなる。
+// RTCPレポートはRTCPタイムアウト監視に使用するため常に有効
+func RegisterInterceptors(mediaEngine *webrtc.MediaEngine, interceptorRegistry *interceptor.Registry) error {
+	if !NoNACK {
+		if err := webrtc.ConfigureNack(mediaEngine, interceptorRegistry); err != nil {
+			return err
+		}
+	} else {
+		DebugLog("Interceptors: NACK disabled\n")
+	}
+
+	if err := webrtc.ConfigureRTCPReports(interceptorRegistry); err != nil {
+		return err
+	}
+
+	if err := webrtc.ConfigureStatsInterceptor(interceptorRegistry); err != nil {
+		return err
+	}
+
+	if ExtensionEnabled("transport-cc") {
+		interceptorRegistry.Add(twccFeedbackLoggerFactory{})
+		if err := webrtc.ConfigureTWCCSender(mediaEngine, interceptorRegistry); err != nil {
+			return err
+		}
+	} else {
+		DebugLog("Interceptors: TWCC disabled\n")
+	}
+
+	return nil
+}
+
+// NewPeerConnectionConfig はICEサーバーと --bundle-policy を設定したPeerConnection設定を作成する
+func NewPeerConnectionConfig() webrtc.Configuration {
+	return webrtc.Configuration{
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+		BundlePolicy: bundlePolicyFromName(BundlePolicy),
+	}
+}
+
 func CreatePeerConnection(mediaEngine *webrtc.MediaEngine, eventChan chan<- ConnectionEvent, streamManager *StreamManager) (*webrtc.PeerConnection, error) {
+	if AutoRotate {
+		if err := RegisterVideoOrientation(mediaEngine); err != nil {
+			return nil, err
+		}
+	}
+	if MeasureLatency {
+		if err := RegisterAbsCaptureTime(mediaEngine); err != nil {
+			return nil, err
+		}
+	}
+
 	// Create an InterceptorRegistry
+	// RTCP BYEで送るフィードバックのSSRCを記録するため、他のインターセプターより下流に置く
+	feedbackRecorder := &feedbackSSRCRecorder{}
 	interceptorRegistry := &interceptor.Registry{}
-	if err := webrtc.RegisterDefaultInterceptors(mediaEngine, interceptorRegistry); err != nil {
+	interceptorRegistry.Add(feedbackSSRCRecorderFactory{recorder: feedbackRecorder})
+	if err := RegisterInterceptors(mediaEngine, interceptorRegistry); err != nil {
 		return nil, err
 	}
 
@@ -131,59 +276,95 @@ func CreatePeerConnection(mediaEngine *webrtc.MediaEngine, eventChan chan<- Conn
 	api := webrtc.NewAPI(
 		webrtc.WithMediaEngine(mediaEngine),
 		webrtc.WithInterceptorRegistry(interceptorRegistry),
+		webrtc.WithSettingEngine(NewSettingEngine()),
 	)
 
 	// Create a new PeerConnection
-	config := webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-
-	peerConnection, err := api.NewPeerConnection(config)
+	peerConnection, err := api.NewPeerConnection(NewPeerConnectionConfig())
 	if err != nil {
 		return nil, err
 	}
+	streamManager.setFeedbackSSRCRecorder(feedbackRecorder)
 
 	// Create tracks for receiving
-	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
-		webrtc.RTPTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionRecvonly,
-		}); err != nil {
-		peerConnection.Close()
-		return nil, err
+	// --ssrc / --mid の指定時は、サーバーが送る複数の映像トラックから選べるよう映像m-lineを増やす
+	for i := 0; i < videoTransceiverCount(SelectSSRC, SelectMID); i++ {
+		if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+			webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+			peerConnection.Close()
+			return nil, err
+		}
 	}
 
-	if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
-		webrtc.RTPTransceiverInit{
-			Direction: webrtc.RTPTransceiverDirectionRecvonly,
-		}); err != nil {
-		peerConnection.Close()
-		return nil, err
+	// --audio-tracks に応じて、受信し得る音声トラックの数だけ音声m-lineをofferに含める
+	for i := 0; i < audioTransceiverCount(AudioTrackIndex); i++ {
+		if _, err = peerConnection.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio,
+			webrtc.RTPTransceiverInit{
+				Direction: webrtc.RTPTransceiverDirectionRecvonly,
+			}); err != nil {
+			peerConnection.Close()
+			return nil, err
+		}
 	}
 
 	// Set handlers for incoming tracks
 	peerConnection.OnTrack(func(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		codec := track.Codec()
-		DebugLog("Track received - Type: %s, Codec: %s\n", track.Kind(), codec.MimeType)
+		mid := receiverMid(peerConnection, receiver)
+		DebugLog("Track received - Type: %s, Codec: %s, %s\n", track.Kind(), codec.MimeType, describeTrack(track, mid))
 
 		if track.Kind() == webrtc.RTPCodecTypeVideo {
 			codecType := MimeTypeToCodec(codec.MimeType)
-			fmt.Fprintf(os.Stderr, "Video track received: %s\n", codec.MimeType)
+			if !VideoTrackSelected(uint32(track.SSRC()), mid, SelectSSRC, SelectMID) {
+				fmt.Fprintf(os.Stderr, "Video track received: %s (%s, not selected by --ssrc/--mid, ignored)\n", codec.MimeType, describeTrack(track, mid))
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Video track received: %s (%s)\n", codec.MimeType, describeTrack(track, mid))
+			if kc := streamManager.KeyframeController(); kc != nil {
+				kc.Attach(peerConnection.WriteRTCP, uint32(track.SSRC()))
+			}
+			if AutoRotate {
+				streamManager.SetVideoOrientationExtension(videoOrientationExtensionID(receiver))
+			}
+			if MeasureLatency {
+				streamManager.SetAbsCaptureTimeExtension(track.Kind(), absCaptureTimeExtensionID(receiver))
+			}
+			logTWCCNegotiation(track.Kind(), receiver)
 			streamManager.AddVideoTrack(track, codecType)
 		} else if track.Kind() == webrtc.RTPCodecTypeAudio {
-			fmt.Fprintf(os.Stderr, "Audio track received: %s\n", codec.MimeType)
+			index := audioReceiverIndex(peerConnection, receiver)
+			if AudioTrackIndex != AudioTracksAllIndex && index != AudioTrackIndex {
+				fmt.Fprintf(os.Stderr, "Audio track %d received: %s (%s, not selected by --audio-tracks, ignored)\n", index, codec.MimeType, describeTrack(track, mid))
+				return
+			}
+			fmt.Fprintf(os.Stderr, "Audio track %d received: %s (%s)\n", index, codec.MimeType, describeTrack(track, mid))
+			if MeasureLatency {
+				streamManager.SetAbsCaptureTimeExtension(track.Kind(), absCaptureTimeExtensionID(receiver))
+			}
+			logTWCCNegotiation(track.Kind(), receiver)
 			streamManager.AddAudioTrack(track)
 		}
 	})
 
+	WatchDTLSState(peerConnection, func() {
+		select {
+		case eventChan <- ConnectionEvent{State: StateFailed, Error: ErrDTLSHandshake}:
+		default:
+		}
+	})
+
 	// Set ICE connection state handler
 	peerConnection.OnICEConnectionStateChange(func(connectionState webrtc.ICEConnectionState) {
 		DebugLog("ICE Connection State has changed: %s\n", connectionState.String())
 
 		switch connectionState {
+		case webrtc.ICEConnectionStateChecking:
+			select {
+			case eventChan <- ConnectionEvent{State: StateChecking}:
+			default:
+			}
 		case webrtc.ICEConnectionStateConnected:
 			select {
 			case eventChan <- ConnectionEvent{State: StateConnected}:
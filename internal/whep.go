@@ -1,81 +1,48 @@
 package internal
 
 import (
-	"bytes"
-	"fmt"
-	"io"
-	"net/http"
-	"os"
-	"time"
-
 	"github.com/pion/webrtc/v4"
 )
 
-func ExchangeSDPWithWHEP(peerConnection *webrtc.PeerConnection, url string) error {
-	// Create offer
-	offer, err := peerConnection.CreateOffer(nil)
-	if err != nil {
-		return err
-	}
-
-	// Create gathering complete promise
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-
-	// Set local description
-	err = peerConnection.SetLocalDescription(offer)
-	if err != nil {
-		return err
-	}
-
-	// Wait for ICE gathering to complete
-	<-gatherComplete
-
-	// Send offer to WHEP server
-	fmt.Fprintln(os.Stderr, "Sending offer to WHEP server...")
-	if DebugMode {
-		fmt.Fprintf(os.Stderr, "\n=== SDP Offer ===\n%s\n=== End Offer ===\n\n", peerConnection.LocalDescription().SDP)
-	}
-
-	// Create HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte(peerConnection.LocalDescription().SDP)))
-	if err != nil {
-		return err
-	}
-
-	// Set headers
-	req.Header.Set("Content-Type", "application/sdp")
-
-	// Send request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// WHEPSession はWHEPセッションのHTTPクライアントとリソースURLを保持する
+type WHEPSession struct {
+	*httpSession
+}
 
-	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("WHEP server returned status %d: %s", resp.StatusCode, string(body))
-	}
+// NewWHEPSession は新しいWHEPセッションを作成する
+// optsを省略した場合はHTTP/2とkeep-aliveを有効にしたデフォルトのクライアントを使う
+func NewWHEPSession(url string, opts ...SessionOption) *WHEPSession {
+	return &WHEPSession{httpSession: newHTTPSession("WHEP", url, opts)}
+}
 
-	// Read answer
-	answer, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
+// ExchangeSDP はWHEPサーバーとSDPを交換する
+func (s *WHEPSession) ExchangeSDP(peerConnection *webrtc.PeerConnection) error {
+	return s.exchangeSDP(peerConnection)
+}
 
-	// Set remote description
-	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
-		Type: webrtc.SDPTypeAnswer,
-		SDP:  string(answer),
-	})
-	if err != nil {
-		return err
-	}
+// SetTwoPhase はofferの前に本文の無いPOSTでセッションを作成し、offerをPATCHで送るよう設定する
+// サーバーが空のPOSTを拒否した場合は、offerのPOSTにフォールバックする
+func (s *WHEPSession) SetTwoPhase(enabled bool) {
+	s.twoPhase = enabled
+}
 
-	if DebugMode {
-		fmt.Fprintf(os.Stderr, "\n=== SDP Answer ===\n%s\n=== End Answer ===\n\n", string(answer))
-	}
+// NewEventStream はPOST応答で広告されたSSE拡張のイベントストリームを返す
+// 広告されていない場合はnilを返す
+func (s *WHEPSession) NewEventStream() *WHEPEventStream {
+	subscribeURL, params, ok := s.Link(WHEPServerSentEventsRel)
+	if !ok {
+		return nil
+	}
+	stream := NewWHEPEventStream(subscribeURL, params["events"])
+	if s.customHTTP {
+		// 指定されたクライアントの認証や署名をイベントストリームにも使う（長時間接続のためタイムアウトは外す）
+		client := *s.client
+		client.Timeout = 0
+		stream.client = &client
+	}
+	return stream
+}
 
-	return nil
+func ExchangeSDPWithWHEP(peerConnection *webrtc.PeerConnection, url string, opts ...SessionOption) error {
+	return NewWHEPSession(url, opts...).ExchangeSDP(peerConnection)
 }
@@ -0,0 +1,305 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// WHEPServerSentEventsRel はWHEPのSSE拡張を示すLinkヘッダーのrel
+	WHEPServerSentEventsRel = "urn:ietf:params:whep:ext:core:server-sent-events"
+
+	whepEventsMinBackoff = 1 * time.Second
+	whepEventsMaxBackoff = 30 * time.Second
+)
+
+// whepDefaultEvents はサーバーがeventsパラメーターを広告しない場合に購読するイベント
+var whepDefaultEvents = []string{"active", "inactive", "layers", "viewercount"}
+
+// whepLayer はlayersイベント内の1レイヤー
+type whepLayer struct {
+	EncodingID      string `json:"encodingId"`
+	SpatialLayerID  *int   `json:"spatialLayerId"`
+	TemporalLayerID *int   `json:"temporalLayerId"`
+	Bitrate         int    `json:"bitrate"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+}
+
+// whepLayersEvent はlayersイベントのデータ（メディア種別ごと）
+type whepLayersEvent map[string]struct {
+	Active   []whepLayer `json:"active"`
+	Inactive []whepLayer `json:"inactive"`
+}
+
+// WHEPEventStream はWHEPのserver-sent events拡張を購読し、配信状態やレイヤー変化をログ出力する
+// メディア接続とは独立して動作し、イベントストリームが切れた場合は単独で再接続する
+type WHEPEventStream struct {
+	client       *http.Client
+	subscribeURL string   // Linkヘッダーで広告された購読用URL
+	events       []string // 購読するイベント名
+	streamURL    string   // 購読後に得られるイベントストリームURL
+	lastActive   string
+	lastLayers   string
+	clock        Clock     // 再接続までの待機に使う時刻の取得元
+	output       io.Writer // 配信状態とレイヤー変化の出力先
+}
+
+// NewWHEPEventStream は新しいWHEPEventStreamを作成する
+// eventsParamはLinkヘッダーのeventsパラメーター（カンマ区切り、空の場合はデフォルト）
+func NewWHEPEventStream(subscribeURL, eventsParam string) *WHEPEventStream {
+	events := whepDefaultEvents
+	if eventsParam != "" {
+		events = nil
+		for _, event := range strings.Split(eventsParam, ",") {
+			if event = strings.TrimSpace(event); event != "" {
+				events = append(events, event)
+			}
+		}
+	}
+
+	// SSEは長時間接続のため、セッション用クライアントのタイムアウトは使わない
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	return &WHEPEventStream{
+		client:       &http.Client{Transport: transport},
+		subscribeURL: subscribeURL,
+		events:       events,
+		clock:        SystemClock{},
+		output:       os.Stderr,
+	}
+}
+
+// SetClock は再接続までの待機に使う時刻の取得元を差し替える（検証用、Run開始前に呼ぶ）
+func (s *WHEPEventStream) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// Run はstopChanが閉じられるまでイベントストリームを受信し続ける
+func (s *WHEPEventStream) Run(stopChan <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-stopChan:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	backoff := whepEventsMinBackoff
+	for {
+		err := s.runOnce(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			fmt.Fprintf(s.output, "[WHEP events] %v, reconnecting in %v\n", err, backoff)
+		} else {
+			DebugLog("[WHEP events] stream closed by server, reconnecting in %v\n", backoff)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-clockAfter(s.clock, backoff):
+		}
+		if err != nil {
+			backoff *= 2
+			if backoff > whepEventsMaxBackoff {
+				backoff = whepEventsMaxBackoff
+			}
+		} else {
+			backoff = whepEventsMinBackoff
+		}
+	}
+}
+
+func (s *WHEPEventStream) runOnce(ctx context.Context) error {
+	if s.streamURL == "" {
+		if err := s.subscribe(ctx); err != nil {
+			return fmt.Errorf("subscribe failed: %w", err)
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.streamURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		// ストリームURLが失効した場合は次回購読からやり直す
+		if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone {
+			s.streamURL = ""
+		}
+		return fmt.Errorf("event stream returned status %d", resp.StatusCode)
+	}
+
+	DebugLog("[WHEP events] connected: %s\n", s.streamURL)
+	return s.consume(resp.Body)
+}
+
+// subscribe は購読するイベント一覧をPOSTし、LocationヘッダーからストリームURLを得る
+func (s *WHEPEventStream) subscribe(ctx context.Context) error {
+	body, err := json.Marshal(s.events)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.subscribeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusCreated {
+		return fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+	location := resp.Header.Get("Location")
+	if location == "" {
+		return fmt.Errorf("no Location header in subscribe response")
+	}
+
+	base, err := url.Parse(s.subscribeURL)
+	if err != nil {
+		return err
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return err
+	}
+	s.streamURL = base.ResolveReference(ref).String()
+	DebugLog("[WHEP events] subscribed to %v: %s\n", s.events, s.streamURL)
+	return nil
+}
+
+// consume はtext/event-streamを読み、イベント単位でhandleEventへ渡す
+func (s *WHEPEventStream) consume(r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	eventName := ""
+	var data []string
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			// 空行でイベント確定
+			if len(data) > 0 {
+				if eventName == "" {
+					eventName = "message"
+				}
+				s.handleEvent(eventName, strings.Join(data, "\n"))
+			}
+			eventName = ""
+			data = nil
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			continue // コメント（keep-alive）
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			eventName = value
+		case "data":
+			data = append(data, value)
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *WHEPEventStream) handleEvent(name, data string) {
+	switch name {
+	case "active", "inactive":
+		if name != s.lastActive {
+			fmt.Fprintf(s.output, "[WHEP events] stream %s\n", name)
+			s.lastActive = name
+		}
+	case "layers":
+		var layers whepLayersEvent
+		if err := json.Unmarshal([]byte(data), &layers); err != nil {
+			DebugLog("[WHEP events] invalid layers event: %v\n", err)
+			return
+		}
+		summary := summarizeWHEPLayers(layers)
+		if summary != s.lastLayers {
+			fmt.Fprintf(s.output, "[WHEP events] layers: %s\n", summary)
+			s.lastLayers = summary
+		}
+	case "viewercount":
+		var payload struct {
+			ViewerCount int `json:"viewercount"`
+		}
+		if err := json.Unmarshal([]byte(data), &payload); err != nil {
+			DebugLog("[WHEP events] invalid viewercount event: %v\n", err)
+			return
+		}
+		DebugLog("[WHEP events] viewers: %d\n", payload.ViewerCount)
+	default:
+		DebugLog("[WHEP events] %s: %s\n", name, data)
+	}
+}
+
+// summarizeWHEPLayers はlayersイベントを "video active=[...] inactive=[...]" 形式に要約する
+func summarizeWHEPLayers(layers whepLayersEvent) string {
+	var parts []string
+	for kind, state := range layers {
+		active := make([]string, 0, len(state.Active))
+		for _, layer := range state.Active {
+			active = append(active, layer.String())
+		}
+		inactive := make([]string, 0, len(state.Inactive))
+		for _, layer := range state.Inactive {
+			inactive = append(inactive, layer.String())
+		}
+		parts = append(parts, fmt.Sprintf("%s active=[%s] inactive=[%s]",
+			kind, strings.Join(active, ", "), strings.Join(inactive, ", ")))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
+
+func (l whepLayer) String() string {
+	id := l.EncodingID
+	if l.SpatialLayerID != nil {
+		id += fmt.Sprintf("/S%d", *l.SpatialLayerID)
+	}
+	if l.TemporalLayerID != nil {
+		id += fmt.Sprintf("/T%d", *l.TemporalLayerID)
+	}
+	if id == "" {
+		id = "-"
+	}
+	if l.Width > 0 && l.Height > 0 {
+		id += fmt.Sprintf(" %dx%d", l.Width, l.Height)
+	}
+	if l.Bitrate > 0 {
+		id += fmt.Sprintf(" %dkbps", l.Bitrate/1000)
+	}
+	return id
+}
@@ -0,0 +1,181 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// whepEventsBody は最初の接続で送るイベントストリーム
+// keep-aliveのコメント、重複したactive、複数行のdataに分かれたlayersを含む
+const whepEventsBody = `: keep-alive
+
+event: active
+data: {}
+
+event: active
+data: {}
+
+event: layers
+data: {"video": {"active": [{"encodingId": "h", "width": 1280,
+data:  "height": 720, "bitrate": 2500000}],
+data: "inactive": [{"encodingId": "l", "spatialLayerId": 0, "temporalLayerId": 1}]}}
+
+: comment between events
+event: inactive
+data: {}
+
+`
+
+// whepEventsResponse はイベントストリームのGETに順に返す応答
+type whepEventsResponse struct {
+	status int
+	body   string
+}
+
+// whepEventsServer は購読のPOSTにストリームURLを返し、GETにはresponsesを順に返すテストサーバー
+type whepEventsServer struct {
+	*httptest.Server
+	mu         sync.Mutex
+	responses  []whepEventsResponse
+	requests   []string // "METHOD path" の記録
+	subscribed [][]string
+	streams    int // 発行したストリームURLの数
+}
+
+func newWHEPEventsServer(t *testing.T, responses ...whepEventsResponse) *whepEventsServer {
+	s := &whepEventsServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case http.MethodPost:
+			var events []string
+			if err := json.NewDecoder(r.Body).Decode(&events); err != nil {
+				t.Errorf("subscribe body: %v", err)
+			}
+			s.subscribed = append(s.subscribed, events)
+			s.streams++
+			location := "stream/" + string(rune('0'+s.streams))
+			s.mu.Unlock()
+			// Locationは購読URLからの相対パス
+			w.Header().Set("Location", location)
+			w.WriteHeader(http.StatusCreated)
+		case http.MethodGet:
+			if accept := r.Header.Get("Accept"); accept != "text/event-stream" {
+				t.Errorf("Accept %q, want text/event-stream", accept)
+			}
+			if len(s.responses) == 0 {
+				s.mu.Unlock()
+				// 残りが無い場合はテストの終了まで待たせる
+				<-r.Context().Done()
+				return
+			}
+			response := s.responses[0]
+			s.responses = s.responses[1:]
+			s.mu.Unlock()
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.WriteHeader(response.status)
+			io.WriteString(w, response.body)
+		default:
+			s.mu.Unlock()
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}))
+	return s
+}
+
+// recorded は記録したリクエストを返す
+func (s *whepEventsServer) recorded() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.requests...)
+}
+
+// TestWHEPEventsStreamAndReconnect はイベントストリームの解析と、切断後の再接続の待ち時間を検証する
+// 正常な切断の後は最小の1秒、エラーが続くと倍に延ばし、ストリームURLが失効すると購読からやり直す
+func TestWHEPEventsStreamAndReconnect(t *testing.T) {
+	server := newWHEPEventsServer(t,
+		whepEventsResponse{http.StatusOK, whepEventsBody},
+		whepEventsResponse{http.StatusInternalServerError, ""},
+		whepEventsResponse{http.StatusInternalServerError, ""},
+		whepEventsResponse{http.StatusGone, ""},
+		whepEventsResponse{http.StatusOK, "event: active\ndata: {}\n\n"},
+	)
+	defer server.Close()
+
+	var output bytes.Buffer
+	clock := newManualClock(time.Unix(0, 0))
+	stream := NewWHEPEventStream(server.URL+"/whep/events", "active, layers")
+	stream.SetClock(clock)
+	stream.output = &output
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		stream.Run(stop)
+		close(done)
+	}()
+
+	// 正常な切断（1秒）、500が2回（1秒、2秒）、410（4秒）、購読し直した後の正常な切断（8秒、次から1秒に戻る）
+	for i, want := range []time.Duration{time.Second, time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		got := clock.waitTimer(t)
+		if got != want {
+			t.Fatalf("reconnect %d: waiting %v, want %v (requests %v)", i, got, want, server.recorded())
+		}
+		if i == 4 {
+			break
+		}
+		clock.Advance(got)
+	}
+	close(stop)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after stop")
+	}
+
+	wantRequests := []string{
+		"POST /whep/events",
+		"GET /whep/stream/1",
+		"GET /whep/stream/1",
+		"GET /whep/stream/1",
+		"GET /whep/stream/1",
+		"POST /whep/events",
+		"GET /whep/stream/2",
+	}
+	if got := server.recorded(); !reflect.DeepEqual(got, wantRequests) {
+		t.Fatalf("requests %v, want %v", got, wantRequests)
+	}
+	for _, events := range server.subscribed {
+		if want := []string{"active", "layers"}; !reflect.DeepEqual(events, want) {
+			t.Fatalf("subscribed to %v, want %v", events, want)
+		}
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimSpace(output.String()), "\n") {
+		if !strings.Contains(line, "reconnecting in") {
+			lines = append(lines, line)
+		}
+	}
+	wantLines := []string{
+		"[WHEP events] stream active",
+		"[WHEP events] layers: video active=[h 1280x720 2500kbps] inactive=[l/S0/T1]",
+		"[WHEP events] stream inactive",
+		"[WHEP events] stream active",
+	}
+	if !reflect.DeepEqual(lines, wantLines) {
+		t.Fatalf("output:\n%s\nwant:\n%s", strings.Join(lines, "\n"), strings.Join(wantLines, "\n"))
+	}
+	if !strings.Contains(output.String(), "event stream returned status 500, reconnecting in 1s") {
+		t.Fatalf("output does not report the failed reconnect:\n%s", output.String())
+	}
+}
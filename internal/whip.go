@@ -1,81 +1,40 @@
 package internal
 
 import (
-	"bytes"
-	"fmt"
-	"io"
-	"net/http"
-	"os"
 	"time"
 
 	"github.com/pion/webrtc/v4"
 )
 
-func ExchangeSDPWithWHIP(peerConnection *webrtc.PeerConnection, url string) error {
-	// Create offer
-	offer, err := peerConnection.CreateOffer(nil)
-	if err != nil {
-		return err
-	}
-
-	// Create gathering complete promise
-	gatherComplete := webrtc.GatheringCompletePromise(peerConnection)
-
-	// Set local description
-	err = peerConnection.SetLocalDescription(offer)
-	if err != nil {
-		return err
-	}
-
-	// Wait for ICE gathering to complete
-	<-gatherComplete
-
-	// Send offer to WHIP server
-	fmt.Fprintln(os.Stderr, "Sending offer to WHIP server...")
-	if DebugMode {
-		fmt.Fprintf(os.Stderr, "\n=== SDP Offer ===\n%s\n=== End Offer ===\n\n", peerConnection.LocalDescription().SDP)
-	}
-
-	// Create HTTP request
-	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte(peerConnection.LocalDescription().SDP)))
-	if err != nil {
-		return err
-	}
-
-	// Set headers
-	req.Header.Set("Content-Type", "application/sdp")
-
-	// Send request
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// WHIPSession はWHIPセッションのHTTPクライアントとリソースURLを保持する
+type WHIPSession struct {
+	*httpSession
+}
 
-	if resp.StatusCode != http.StatusCreated {
-		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("WHIP server returned status %d: %s", resp.StatusCode, string(body))
-	}
+// NewWHIPSession は新しいWHIPセッションを作成する
+// optsを省略した場合はHTTP/2とkeep-aliveを有効にしたデフォルトのクライアントを使う
+func NewWHIPSession(url string, opts ...SessionOption) *WHIPSession {
+	return &WHIPSession{httpSession: newHTTPSession("WHIP", url, opts)}
+}
 
-	// Read answer
-	answer, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return err
-	}
+// ExchangeSDP はWHIPサーバーとSDPを交換する
+func (s *WHIPSession) ExchangeSDP(peerConnection *webrtc.PeerConnection) error {
+	return s.exchangeSDP(peerConnection)
+}
 
-	// Set remote description
-	err = peerConnection.SetRemoteDescription(webrtc.SessionDescription{
-		Type: webrtc.SDPTypeAnswer,
-		SDP:  string(answer),
-	})
-	if err != nil {
-		return err
-	}
+// SetVideoBandwidth はofferの映像m-lineにb=TIASとして送信ビットレートの上限を付与する
+// 0の場合は付与しない
+func (s *WHIPSession) SetVideoBandwidth(bps int) {
+	s.videoTIAS = bps
+}
 
-	if DebugMode {
-		fmt.Fprintf(os.Stderr, "\n=== SDP Answer ===\n%s\n=== End Answer ===\n\n", string(answer))
-	}
+// SetPostRetry はofferのPOSTが接続エラーや5xxで失敗した場合に、retries回までやり直すよう設定する
+// 待ち時間はbackoffから始め、やり直すごとに2倍にする
+func (s *WHIPSession) SetPostRetry(retries int, backoff time.Duration) {
+	s.postRetries = retries
+	s.postBackoff = backoff
+}
 
-	return nil
+func ExchangeSDPWithWHIP(peerConnection *webrtc.PeerConnection, url string, opts ...SessionOption) error {
+	return NewWHIPSession(url, opts...).ExchangeSDP(peerConnection)
 }
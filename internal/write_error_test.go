@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/pion/webrtc/v4/pkg/media"
+)
+
+const (
+	writeErrorWidth         = 320
+	writeErrorHeight        = 240
+	failAt                  = 5  // この回数目の映像フレーム書き込みで失敗させる
+	sendFrames              = 60 // 30fps x 2秒
+	writeErrorFrameInterval = 33 * time.Millisecond
+	setupTimeout            = 10 * time.Second
+)
+
+// failingWriter はfailAt回目の映像フレーム書き込みでerrを返すStreamWriter
+type failingWriter struct {
+	mu     sync.Mutex
+	err    error
+	writes int
+	done   chan struct{}
+}
+
+func newFailingWriter(err error) *failingWriter {
+	return &failingWriter{err: err, done: make(chan struct{})}
+}
+
+func (w *failingWriter) WriteVideoFrame(data []byte, timestamp uint32, keyframe bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writes++
+	if w.writes == failAt {
+		return w.err
+	}
+	return nil
+}
+
+func (w *failingWriter) WriteAudioFrame(data []byte, timestamp uint32) error {
+	return nil
+}
+
+func (w *failingWriter) Run() error {
+	<-w.done
+	return nil
+}
+
+func (w *failingWriter) Close() error {
+	select {
+	case <-w.done:
+	default:
+		close(w.done)
+	}
+	return nil
+}
+
+func (w *failingWriter) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writes
+}
+
+// writeErrorNewSender はVP8トラックを1本送信するPeerConnectionを作成する
+func writeErrorNewSender() (*webrtc.PeerConnection, *webrtc.TrackLocalStaticSample, error) {
+	mediaEngine := &webrtc.MediaEngine{}
+	if err := mediaEngine.RegisterDefaultCodecs(); err != nil {
+		return nil, nil, err
+	}
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithSettingEngine(NewSettingEngine()))
+	peerConnection, err := api.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		return nil, nil, err
+	}
+	track, err := webrtc.NewTrackLocalStaticSample(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8}, "video", "test_write_error")
+	if err != nil {
+		peerConnection.Close()
+		return nil, nil, err
+	}
+	sender, err := peerConnection.AddTrack(track)
+	if err != nil {
+		peerConnection.Close()
+		return nil, nil, err
+	}
+	// PLI等のRTCPを読み捨てる
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			if _, _, err := sender.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return peerConnection, track, nil
+}
+
+// sendVideo はVP8エンコーダーで生成したフレームをstopまで送信する
+func sendVideo(track *webrtc.TrackLocalStaticSample, stop <-chan struct{}) error {
+	encoder, err := NewVP8Encoder(writeErrorWidth, writeErrorHeight, "YUV420P", 500)
+	if err != nil {
+		return err
+	}
+	defer encoder.Close()
+
+	frame := make([]byte, writeErrorWidth*writeErrorHeight*3/2)
+	for i := 0; i < sendFrames; i++ {
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(writeErrorFrameInterval):
+		}
+		for j := range frame {
+			frame[j] = byte(j + i*5)
+		}
+		encoded, _, err := encoder.Encode(frame)
+		if err != nil {
+			return err
+		}
+		if err := track.WriteSample(media.Sample{Data: encoded, Duration: writeErrorFrameInterval}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runPolicy はpolicyを設定したStreamManagerで、writerErrを返すライターへ映像を受信する
+// Runが返したエラー（送信終了まで返らなかった場合はnil）と書き込み回数を返す
+func runPolicy(policy string, writerErr error) (error, int, error) {
+	savedPolicy := OnWriteError
+	defer func() { OnWriteError = savedPolicy }()
+	OnWriteError = policy
+	writer := newFailingWriter(writerErr)
+	streamManager := NewStreamManager(writer, NewDefaultRTPProcessor(), 0, nil)
+
+	mediaEngine, err := CreateVP8VP9MediaEngine()
+	if err != nil {
+		return nil, 0, err
+	}
+	eventChan := make(chan ConnectionEvent, 10)
+	receiver, err := CreatePeerConnection(mediaEngine, eventChan, streamManager)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer receiver.Close()
+
+	sender, track, err := writeErrorNewSender()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer sender.Close()
+
+	if err := connect(receiver, sender); err != nil {
+		return nil, 0, err
+	}
+
+	setupTimer := time.NewTimer(setupTimeout)
+	defer setupTimer.Stop()
+WaitConnection:
+	for {
+		select {
+		case event := <-eventChan:
+			if event.State == StateConnected {
+				break WaitConnection
+			}
+		case <-setupTimer.C:
+			return nil, 0, fmt.Errorf("ICE connection timeout")
+		}
+	}
+
+	runErr := make(chan error, 1)
+	go func() { runErr <- streamManager.Run() }()
+
+	stop := make(chan struct{})
+	sendErr := make(chan error, 1)
+	go func() { sendErr <- sendVideo(track, stop) }()
+
+	var streamErr error
+	select {
+	case streamErr = <-runErr:
+		close(stop)
+		<-sendErr
+	case err := <-sendErr:
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := streamManager.Stop(); err != nil {
+		return nil, 0, err
+	}
+	return streamErr, writer.count(), nil
+}
+
+// TestWriteErrorIgnore は --on-write-error ignore でフレームを破棄して受信を続けることを検証する
+func TestWriteErrorIgnore(t *testing.T) {
+	streamErr, writes, err := runPolicy(OnWriteErrorIgnore, fmt.Errorf("%w: injected", ErrFrameDropped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if streamErr != nil {
+		t.Fatalf("stream stopped: %v", streamErr)
+	}
+	if writes <= failAt+10 {
+		t.Fatalf("only %d frames written after the dropped frame", writes-failAt)
+	}
+}
+
+// TestWriteErrorReconnect は --on-write-error reconnect で再接続用のエラー（ErrStreamWriteを含まない）を返すことを検証する
+func TestWriteErrorReconnect(t *testing.T) {
+	streamErr, writes, err := runPolicy(OnWriteErrorReconnect, fmt.Errorf("%w: injected", ErrFrameDropped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(streamErr, ErrFrameDropped) || errors.Is(streamErr, ErrStreamWrite) {
+		t.Fatalf("unexpected stream error: %v", streamErr)
+	}
+	if writes != failAt {
+		t.Fatalf("%d frames written, want %d (processing should stop at the error)", writes, failAt)
+	}
+}
+
+// TestWriteErrorExit は --on-write-error exit で終了用のエラー（ErrStreamWrite）を返すことを検証する
+func TestWriteErrorExit(t *testing.T) {
+	streamErr, writes, err := runPolicy(OnWriteErrorExit, fmt.Errorf("%w: injected", ErrFrameDropped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(streamErr, ErrStreamWrite) {
+		t.Fatalf("unexpected stream error: %v", streamErr)
+	}
+	if writes != failAt {
+		t.Fatalf("%d frames written, want %d (processing should stop at the error)", writes, failAt)
+	}
+}
+
+// TestWriteErrorFatal は出力の失敗（ErrFrameDroppedを含まないエラー）が ignore でも終了になることを検証する
+func TestWriteErrorFatal(t *testing.T) {
+	streamErr, _, err := runPolicy(OnWriteErrorIgnore, errors.New("injected output failure"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(streamErr, ErrStreamWrite) {
+		t.Fatalf("unexpected stream error: %v", streamErr)
+	}
+}
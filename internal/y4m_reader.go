@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	y4mMagic          = "YUV4MPEG2"
+	y4mFrameMagic     = "FRAME"
+	maxY4MHeaderBytes = 4096
+)
+
+// Y4MReader はYUV4MPEG2（ffmpeg -f yuv4mpegpipe）を読み込むFrameSource
+// 4:2:0の8bitのみ対応し、フレームはI420のままエンコーダーに渡す
+// YUV4MPEG2はフレームごとのPTSを持たないため、ヘッダーのフレームレートからPTSを決める
+type Y4MReader struct {
+	reader     *bufio.Reader
+	realtime   bool
+	headerRead bool
+	width      int
+	height     int
+	fpsNum     int64
+	fpsDen     int64
+	colorspace string
+	frameSize  int
+	frameCount int64
+	startedAt  time.Time
+}
+
+// NewY4MReader は新しいY4MReaderを作成する
+// realtimeがtrueの場合、パイプの入力がフレームレートより速くてもPTSの時刻まで待ってから返す
+func NewY4MReader(reader io.Reader, realtime bool) *Y4MReader {
+	return &Y4MReader{
+		reader:   bufio.NewReaderSize(reader, defaultParserBufSize),
+		realtime: realtime,
+	}
+}
+
+func (r *Y4MReader) VideoWidth() int {
+	return r.width
+}
+
+func (r *Y4MReader) VideoHeight() int {
+	return r.height
+}
+
+func (r *Y4MReader) PixelFormat() string {
+	return "I420"
+}
+
+func (r *Y4MReader) VideoCodec() string {
+	return "V_UNCOMPRESSED"
+}
+
+// AudioCodec はYUV4MPEG2が音声を持たないため常に空を返す
+func (r *Y4MReader) AudioCodec() string {
+	return ""
+}
+
+func (r *Y4MReader) AudioSampleRate() int {
+	return 0
+}
+
+func (r *Y4MReader) AudioChannels() int {
+	return 0
+}
+
+// FrameRate はヘッダーのフレームレート（分子, 分母）を返す
+func (r *Y4MReader) FrameRate() (int64, int64) {
+	return r.fpsNum, r.fpsDen
+}
+
+// Colorspace はヘッダーのCパラメータ（省略時は420jpeg）を返す
+func (r *Y4MReader) Colorspace() string {
+	return r.colorspace
+}
+
+// ReadFrame は次のフレームを返す
+// 最初の呼び出しでストリームヘッダーを読み込む
+func (r *Y4MReader) ReadFrame() (*Frame, error) {
+	if !r.headerRead {
+		if err := r.readHeader(); err != nil {
+			return nil, err
+		}
+		r.headerRead = true
+	}
+
+	line, err := r.readLine()
+	if err != nil {
+		if err == io.EOF && line == "" {
+			return nil, io.EOF
+		}
+		return nil, fmt.Errorf("failed to read Y4M frame header: %w", err)
+	}
+	if line != y4mFrameMagic && !strings.HasPrefix(line, y4mFrameMagic+" ") {
+		return nil, fmt.Errorf("invalid Y4M frame header: %q", line)
+	}
+
+	data := make([]byte, r.frameSize)
+	if _, err := io.ReadFull(r.reader, data); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read Y4M frame %d: %w", r.frameCount, err)
+	}
+
+	ptsMs := r.frameCount * 1000 * r.fpsDen / r.fpsNum
+	r.frameCount++
+
+	if r.realtime {
+		if r.startedAt.IsZero() {
+			r.startedAt = time.Now()
+		}
+		if wait := time.Until(r.startedAt.Add(time.Duration(ptsMs) * time.Millisecond)); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+
+	return &Frame{
+		Type:        FrameTypeVideo,
+		Data:        data,
+		TimestampMs: ptsMs,
+		IsKeyframe:  true,
+	}, nil
+}
+
+// readHeader はストリームヘッダー（YUV4MPEG2 W H F I A C X）を解析する
+func (r *Y4MReader) readHeader() error {
+	line, err := r.readLine()
+	if err != nil {
+		if err == io.EOF && line == "" {
+			return fmt.Errorf("empty Y4M input")
+		}
+		return fmt.Errorf("failed to read Y4M header: %w", err)
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || fields[0] != y4mMagic {
+		return fmt.Errorf("not a YUV4MPEG2 stream (header %q)", line)
+	}
+
+	r.colorspace = "420jpeg"
+	for _, field := range fields[1:] {
+		value := field[1:]
+		switch field[0] {
+		case 'W':
+			r.width, err = strconv.Atoi(value)
+		case 'H':
+			r.height, err = strconv.Atoi(value)
+		case 'F':
+			r.fpsNum, r.fpsDen, err = parseY4MRatio(value)
+		case 'C':
+			r.colorspace = value
+		case 'I':
+			if value != "p" && value != "?" {
+				DebugLog("Y4M: interlaced input (I%s) is encoded as progressive\n", value)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("invalid Y4M header field %q: %v", field, err)
+		}
+	}
+
+	if r.width <= 0 || r.height <= 0 {
+		return fmt.Errorf("invalid Y4M dimensions: %dx%d", r.width, r.height)
+	}
+	if r.width%2 != 0 || r.height%2 != 0 {
+		return fmt.Errorf("unsupported Y4M dimensions: %dx%d (must be even)", r.width, r.height)
+	}
+	if r.fpsNum <= 0 || r.fpsDen <= 0 {
+		return fmt.Errorf("Y4M header has no frame rate (F)")
+	}
+	switch r.colorspace {
+	case "420", "420jpeg", "420mpeg2", "420paldv":
+	default:
+		return fmt.Errorf("unsupported Y4M colorspace: C%s (supported: 420, 420jpeg, 420mpeg2, 420paldv)", r.colorspace)
+	}
+	r.frameSize = r.width*r.height + 2*(r.width/2)*(r.height/2)
+	return nil
+}
+
+// readLine は'\n'までを読み、改行を除いて返す
+func (r *Y4MReader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.reader.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxY4MHeaderBytes {
+			return "", fmt.Errorf("Y4M header line exceeds %d bytes", maxY4MHeaderBytes)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return string(line), err
+		}
+		return string(bytes.TrimSuffix(line, []byte{'\n'})), nil
+	}
+}
+
+// parseY4MRatio は"30000:1001"形式の比を解析する
+func parseY4MRatio(value string) (int64, int64, error) {
+	numStr, denStr, ok := strings.Cut(value, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("expected num:den")
+	}
+	num, err := strconv.ParseInt(numStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	den, err := strconv.ParseInt(denStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return num, den, nil
+}
@@ -0,0 +1,112 @@
+package internal
+
+/*
+#include <stdint.h>
+
+// sample はplaneの(row, col)の値を8ビットで返す
+// 高ビット深度（high）の画像は1サンプル2バイト（リトルエンディアン）で、shiftビット右シフトして8ビットにする
+static inline int sample(const uint8_t *plane, unsigned int stride, unsigned long row, unsigned long col, int high, unsigned int shift)
+{
+	if (high) {
+		const uint16_t *line = (const uint16_t *)(plane + row * stride);
+		int value = line[col] >> shift;
+		return value > 255 ? 255 : value;
+	}
+	return plane[row * stride + col];
+}
+
+// libvpx-goのImage.ImageRGBAと同じ変換（BT.601、リミテッドレンジ）を、呼び出し側のバッファに書き込む
+// 色差の間引きはxshift/yshift（I420は1/1、I422は1/0、I440は0/1、I444は0/0）で指定する
+static void yuv_to_rgba(uint16_t width, uint16_t height,
+                        const uint8_t *y, const uint8_t *u, const uint8_t *v,
+                        unsigned int ystride, unsigned int ustride, unsigned int vstride,
+                        unsigned int xshift, unsigned int yshift, int high, unsigned int shift,
+                        uint8_t *out)
+{
+	unsigned long int i, j;
+	for (i = 0; i < height; ++i) {
+		for (j = 0; j < width; ++j) {
+			uint8_t *point = out + 4 * ((i * width) + j);
+			int t_y = sample(y, ystride, i, j, high, shift);
+			int t_u = sample(u, ustride, i >> yshift, j >> xshift, high, shift);
+			int t_v = sample(v, vstride, i >> yshift, j >> xshift, high, shift);
+			t_y = t_y < 16 ? 16 : t_y;
+
+			int r = (298 * (t_y - 16) + 409 * (t_v - 128) + 128) >> 8;
+			int g = (298 * (t_y - 16) - 100 * (t_u - 128) - 208 * (t_v - 128) + 128) >> 8;
+			int b = (298 * (t_y - 16) + 516 * (t_u - 128) + 128) >> 8;
+
+			point[0] = r > 255 ? 255 : r < 0 ? 0 : r;
+			point[1] = g > 255 ? 255 : g < 0 ? 0 : g;
+			point[2] = b > 255 ? 255 : b < 0 ? 0 : b;
+			point[3] = 0xFF;
+		}
+	}
+}
+*/
+import "C"
+
+import (
+	"fmt"
+	"unsafe"
+
+	"github.com/Azunyan1111/libvpx-go/vpx"
+)
+
+// imageRGBAInto はデコードされたYUV画像を8ビットのRGBAに変換してdstに書き込み、書き込んだ範囲を返す
+// I420/I422/I440/I444と、VP9 Profile 2/3の高ビット深度（10/12ビット、1サンプル2バイト）の画像に対応する
+// 高ビット深度は下位ビットを落として8ビットにするため、出力はBitsPerChannel 8のRGBAのまま変わらない
+// img.ImageRGBA()はI420の8ビットのみを前提とし、フレームごとにバッファを確保するため使わない（dstの容量が足りる間は再利用する）
+func imageRGBAInto(img *vpx.Image, dst []byte) ([]byte, error) {
+	high := img.Fmt&vpx.ImageFormatHighbitdepth != 0
+	var xshift, yshift uint
+	switch img.Fmt &^ vpx.ImageFormatHighbitdepth {
+	case vpx.ImageFormatI420, vpx.ImageFormatYv12:
+		xshift, yshift = 1, 1
+	case vpx.ImageFormatI422:
+		xshift, yshift = 1, 0
+	case vpx.ImageFormatI440:
+		xshift, yshift = 0, 1
+	case vpx.ImageFormatI444:
+	default:
+		return dst, fmt.Errorf("unsupported decoded image format %#x", uint32(img.Fmt))
+	}
+	var shift uint
+	if high {
+		if img.BitDepth < 8 || img.BitDepth > 16 {
+			return dst, fmt.Errorf("unsupported decoded bit depth %d", img.BitDepth)
+		}
+		shift = uint(img.BitDepth) - 8
+	} else if img.BitDepth > 8 {
+		return dst, fmt.Errorf("decoded image reports %d-bit samples in an 8-bit format %#x", img.BitDepth, uint32(img.Fmt))
+	}
+
+	size := int(img.DW) * int(img.DH) * 4
+	if cap(dst) < size {
+		dst = make([]byte, size)
+	}
+	dst = dst[:size]
+	if size == 0 {
+		return dst, nil
+	}
+	highFlag := 0
+	if high {
+		highFlag = 1
+	}
+	C.yuv_to_rgba(
+		C.uint16_t(img.DW),
+		C.uint16_t(img.DH),
+		(*C.uint8_t)(unsafe.Pointer(img.Planes[vpx.PlaneY])),
+		(*C.uint8_t)(unsafe.Pointer(img.Planes[vpx.PlaneU])),
+		(*C.uint8_t)(unsafe.Pointer(img.Planes[vpx.PlaneV])),
+		C.uint(img.Stride[vpx.PlaneY]),
+		C.uint(img.Stride[vpx.PlaneU]),
+		C.uint(img.Stride[vpx.PlaneV]),
+		C.uint(xshift),
+		C.uint(yshift),
+		C.int(highFlag),
+		C.uint(shift),
+		(*C.uint8_t)(unsafe.Pointer(&dst[0])),
+	)
+	return dst, nil
+}